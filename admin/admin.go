@@ -0,0 +1,744 @@
+// Package admin provides an authenticated HTTP API for operator actions,
+// such as requeueing, cancelling, skipping and force completing jobs, and
+// pausing the monitor.  Callers authenticate with an API key, or a Google
+// ID token for an allowed identity.  Every call is recorded in an audit log, which is
+// persisted alongside the job history.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/etl-gardener/backfill"
+	"github.com/m-lab/etl-gardener/civil"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/persistence"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Errors that may be returned by admin functions.
+var (
+	ErrInvalidKeys   = errors.New("invalid admin keys")
+	ErrNoJobs        = errors.New("no jobs specified")
+	ErrMissingParams = errors.New("missing required parameters")
+	ErrRangeTooLong  = errors.New("date range too long")
+	// ErrUnverifiedEmail is returned for ID tokens without a verified email.
+	ErrUnverifiedEmail = errors.New("unverified email")
+	// ErrApprovalRequired is returned for backfills whose estimated cost
+	// exceeds the approval threshold, unless they are approved.
+	ErrApprovalRequired = errors.New("approval required")
+)
+
+// maxAuditEntries is the number of audit entries retained in memory.
+const maxAuditEntries = 100
+
+// MaxRangeDays is the most dates a single request may requeue, cancel, skip
+// or force complete.  Longer backfills should use /admin/backfill.
+const MaxRangeDays = 366
+
+// Tracker is the subset of tracker.Tracker used by the admin API.
+type Tracker interface {
+	GetStatus(job tracker.Job) (tracker.Status, error)
+	SetStatus(job tracker.Job, state tracker.State, detail string) error
+}
+
+// Monitor is the subset of ops.Monitor used by the admin API.
+type Monitor interface {
+	Cancel(ctx context.Context, job tracker.Job, reason string) error
+	Reprocess(ctx context.Context, job tracker.Job, reason string) error
+	Pause()
+	Resume()
+	PauseDatatype(experiment, datatype string)
+	ResumeDatatype(experiment, datatype string)
+	ReleaseHold(job tracker.Job, user string) error
+}
+
+// Skipper maintains the list of jobs that should not be dispatched.
+type Skipper interface {
+	SetSkip(ctx context.Context, job tracker.Job, skip bool) error
+	SkipList() []tracker.Job
+}
+
+// Requeuer queues jobs to be dispatched to parsers again, e.g. a
+// job.Service.
+type Requeuer interface {
+	Requeue(ctx context.Context, job tracker.Job) error
+}
+
+// TokenVerifier verifies Google ID tokens, and returns the email of the
+// user or service account a token was issued to, e.g. an IDTokenVerifier.
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) (string, error)
+}
+
+// Onboarder creates the datasets and tables for a new experiment/datatype.
+type Onboarder interface {
+	Onboard(ctx context.Context, experiment, datatype, schemaRef string) ([]string, error)
+}
+
+// VersionFinder finds dates processed with parser releases before a version.
+type VersionFinder interface {
+	OutdatedDates(ctx context.Context, experiment, datatype, version string,
+		start, end time.Time) ([]bq.DateVersions, error)
+}
+
+// Backfiller plans backfills of historical dates, e.g. a job.Service.
+type Backfiller interface {
+	PlanBackfill(ctx context.Context, jobs []tracker.Job) ([]backfill.Item, error)
+	BackfillPlan() []backfill.Item
+}
+
+// CostEstimator estimates the BigQuery cost of a backfill, e.g. a
+// backfill.CostModel.
+type CostEstimator interface {
+	Estimate(ctx context.Context, jobs []tracker.Job) (backfill.Estimate, error)
+}
+
+// AuditEntry records a single admin API call.
+type AuditEntry struct {
+	persistence.Base
+
+	Time   time.Time
+	User   string
+	Action string
+	Jobs   []string
+	Detail string
+}
+
+// GetKind implements persistence.StateObject.GetKind
+func (e AuditEntry) GetKind() string {
+	return reflect.TypeOf(e).String()
+}
+
+// ParseKeys parses a comma separated list of user:key pairs, and
+// returns a map from key to user.
+func ParseKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidKeys, pair)
+		}
+		keys[parts[1]] = parts[0]
+	}
+	return keys, nil
+}
+
+// Handler serves the admin API.
+type Handler struct {
+	keys    map[string]string // Maps API key to user.
+	tokens  TokenVerifier
+	emails  map[string]bool // Identities allowed to use ID tokens.
+	tk      Tracker
+	monitor Monitor
+	skipper Skipper
+	queue   Requeuer
+	saver   persistence.Saver
+	onboard Onboarder
+	finder  VersionFinder
+	planner Backfiller
+	coster  CostEstimator
+
+	lock  sync.Mutex
+	audit []AuditEntry // Most recent last.
+}
+
+// NewHandler creates a Handler.  The keys map API keys to user names.
+// The skipper and saver may be nil.
+func NewHandler(keys map[string]string, tk Tracker, monitor Monitor, skipper Skipper, saver persistence.Saver) *Handler {
+	return &Handler{keys: keys, tk: tk, monitor: monitor, skipper: skipper, saver: saver}
+}
+
+// SetRequeuer enables requeues without force.  Must be called before
+// Register.
+func (h *Handler) SetRequeuer(r Requeuer) {
+	h.queue = r
+}
+
+// SetTokenVerifier also accepts ID tokens, verified by v, for the emails,
+// in place of API keys.  The email is recorded as the user.
+func (h *Handler) SetTokenVerifier(v TokenVerifier, emails []string) {
+	h.tokens = v
+	h.emails = make(map[string]bool, len(emails))
+	for _, e := range emails {
+		if e = strings.TrimSpace(e); e != "" {
+			h.emails[e] = true
+		}
+	}
+}
+
+// SetOnboarder enables the onboard route.  Must be called before Register.
+func (h *Handler) SetOnboarder(o Onboarder) {
+	h.onboard = o
+}
+
+// SetVersionFinder enables the versions route.  Must be called before Register.
+func (h *Handler) SetVersionFinder(f VersionFinder) {
+	h.finder = f
+}
+
+// SetBackfiller enables the backfill routes.  Must be called before Register.
+func (h *Handler) SetBackfiller(b Backfiller) {
+	h.planner = b
+}
+
+// SetCostEstimator enables backfill estimates, and requires approval of
+// backfills whose estimate exceeds the threshold.  Must be called before
+// Register.
+func (h *Handler) SetCostEstimator(c CostEstimator) {
+	h.coster = c
+}
+
+// Register adds the admin routes to the mux.
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/requeue", h.auth(h.requeue))
+	mux.HandleFunc("/admin/cancel", h.auth(h.cancel))
+	mux.HandleFunc("/job/", h.authMethod(http.MethodDelete, "cancel", h.cancelJob, h.jobStatus))
+	mux.HandleFunc("/admin/pause", h.auth(h.pause))
+	mux.HandleFunc("/admin/resume", h.auth(h.resume))
+	mux.HandleFunc("/admin/skip", h.auth(h.skip))
+	mux.HandleFunc("/admin/force-complete", h.auth(h.forceComplete))
+	mux.HandleFunc("/admin/release-hold", h.auth(h.releaseHold))
+	if h.onboard != nil {
+		mux.HandleFunc("/admin/onboard", h.auth(h.onboardDatatype))
+	}
+	mux.HandleFunc("/admin/audit", h.AuditHandler)
+	mux.HandleFunc("/admin/skiplist", h.SkipListHandler)
+	if h.finder != nil {
+		mux.HandleFunc("/admin/versions", h.VersionsHandler)
+	}
+	if h.planner != nil {
+		mux.HandleFunc("/admin/backfill", h.auth(h.backfill))
+		mux.HandleFunc("/admin/backfill-plan", h.BackfillPlanHandler)
+		if h.coster != nil {
+			mux.HandleFunc("/admin/backfill-estimate", h.BackfillEstimateHandler)
+		}
+	}
+}
+
+// user returns the user associated with the bearer token in the request,
+// which is either an API key or, if there is a TokenVerifier, an ID token.
+func (h *Handler) user(req *http.Request) (string, bool) {
+	if user, ok := Authenticate(h.keys, req); ok || h.tokens == nil {
+		return user, ok
+	}
+	token := bearer(req)
+	if token == "" {
+		return "", false
+	}
+	email, err := h.tokens.Verify(req.Context(), token)
+	if err != nil {
+		log.Println("admin token:", err)
+		return "", false
+	}
+	return email, h.emails[email]
+}
+
+// bearer returns the bearer token in the request, if any.
+func bearer(req *http.Request) string {
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
+// Authenticate returns the user associated with the bearer token in the
+// request, if it is one of the keys.  Keys are compared in constant time.
+func Authenticate(keys map[string]string, req *http.Request) (string, bool) {
+	token := bearer(req)
+	if token == "" {
+		return "", false
+	}
+	for key, user := range keys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// RequireKeys wraps a handler so that it only serves requests with a bearer
+// token in keys, e.g. the admin or worker keys, and refuses others with 401.
+func RequireKeys(keys map[string]string, h http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if _, ok := Authenticate(keys, req); !ok {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h(resp, req)
+	}
+}
+
+type adminFunc func(ctx context.Context, user string, req *http.Request) ([]tracker.Job, string, error)
+
+// auth wraps an adminFunc with authentication, and records an audit entry
+// for each successful call.
+func (h *Handler) auth(f adminFunc) http.HandlerFunc {
+	return h.authMethod(http.MethodPost, "", f, nil)
+}
+
+// authMethod is auth for requests with the method, audited as the action, or
+// the path after /admin/ if action is empty.  If respond is not nil, it
+// writes the response for the jobs or error, instead of 200 or 400.
+func (h *Handler) authMethod(method, action string, f adminFunc,
+	respond func(resp http.ResponseWriter, jobs []tracker.Job, err error)) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		user, ok := h.user(req)
+		if !ok {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.Method != method {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := req.ParseForm(); err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		jobs, detail, err := f(req.Context(), user, req)
+		if err != nil {
+			log.Println("admin", req.URL.Path, user, err)
+			if respond != nil {
+				respond(resp, nil, err)
+				return
+			}
+			resp.WriteHeader(http.StatusBadRequest)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+		a := action
+		if a == "" {
+			a = strings.TrimPrefix(req.URL.Path, "/admin/")
+		}
+		h.Record(req.Context(), user, a, jobs, detail)
+		if respond != nil {
+			respond(resp, jobs, nil)
+			return
+		}
+		resp.WriteHeader(http.StatusOK)
+	}
+}
+
+// Record adds an entry to the audit log, and persists it if there is a saver.
+// It is also used to audit changes made by gardener itself, e.g. schema
+// patches.
+func (h *Handler) Record(ctx context.Context, user, action string, jobs []tracker.Job, detail string) {
+	now := time.Now().UTC()
+	e := AuditEntry{
+		Base:   persistence.NewBase(fmt.Sprintf("%s-%s-%s", now.Format(time.RFC3339Nano), user, action)),
+		Time:   now,
+		User:   user,
+		Action: action,
+		Detail: detail,
+	}
+	for _, j := range jobs {
+		e.Jobs = append(e.Jobs, j.Key())
+	}
+	log.Println("admin audit:", e.User, e.Action, e.Jobs, e.Detail)
+
+	h.lock.Lock()
+	h.audit = append(h.audit, e)
+	if len(h.audit) > maxAuditEntries {
+		h.audit = h.audit[len(h.audit)-maxAuditEntries:]
+	}
+	h.lock.Unlock()
+
+	if h.saver != nil {
+		if err := h.saver.Save(ctx, e); err != nil {
+			log.Println("admin audit save error:", err)
+		}
+	}
+}
+
+// Audit returns the recent audit entries, most recent first.
+func (h *Handler) Audit() []AuditEntry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	entries := make([]AuditEntry, len(h.audit))
+	for i, e := range h.audit {
+		entries[len(entries)-1-i] = e
+	}
+	return entries
+}
+
+// AuditHandler returns the recent audit entries as JSON.
+func (h *Handler) AuditHandler(resp http.ResponseWriter, req *http.Request) {
+	if _, ok := h.user(req); !ok {
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(h.Audit()); err != nil {
+		log.Println(err)
+	}
+}
+
+// SkipListHandler returns the current skip list as JSON.
+func (h *Handler) SkipListHandler(resp http.ResponseWriter, req *http.Request) {
+	if _, ok := h.user(req); !ok {
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	list := []tracker.Job{}
+	if h.skipper != nil {
+		list = h.skipper.SkipList()
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(list); err != nil {
+		log.Println(err)
+	}
+}
+
+// BackfillPlanHandler returns the planned backfill jobs, in dispatch order,
+// as JSON.
+func (h *Handler) BackfillPlanHandler(resp http.ResponseWriter, req *http.Request) {
+	if _, ok := h.user(req); !ok {
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(h.planner.BackfillPlan()); err != nil {
+		log.Println(err)
+	}
+}
+
+// BackfillEstimateHandler dry runs a sample of the backfill's dedup queries,
+// for the "job" and "end" parameters, and returns the backfill.Estimate as
+// JSON.  Nothing is planned.
+func (h *Handler) BackfillEstimateHandler(resp http.ResponseWriter, req *http.Request) {
+	if _, ok := h.user(req); !ok {
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	jj, err := jobs(req)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	e, err := h.coster.Estimate(req.Context(), jj)
+	if err != nil {
+		log.Println("admin", req.URL.Path, err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(e); err != nil {
+		log.Println(err)
+	}
+}
+
+// VersionsHandler returns, as JSON, the dates whose raw partitions have rows
+// from parser releases before the "before" version, for the "experiment"
+// and "datatype", from "start" to "end", inclusive.  End defaults to today.
+func (h *Handler) VersionsHandler(resp http.ResponseWriter, req *http.Request) {
+	if _, ok := h.user(req); !ok {
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	q := req.URL.Query()
+	exp, dt, before := q.Get("experiment"), q.Get("datatype"), q.Get("before")
+	start, err := civil.Parse(q.Get("start"))
+	if exp == "" || dt == "" || before == "" || err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(ErrMissingParams.Error()))
+		return
+	}
+	end := civil.Date(time.Now())
+	if e := q.Get("end"); e != "" {
+		if end, err = civil.Parse(e); err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	dates, err := h.finder.OutdatedDates(req.Context(), exp, dt, before, start, end)
+	if err != nil {
+		log.Println("admin", req.URL.Path, err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(dates); err != nil {
+		log.Println(err)
+	}
+}
+
+// jobs parses the "job" parameter, with an optional "end" date.  If end is
+// provided, a job is returned for every date from the job date to end, which
+// may be at most MaxRangeDays.
+func jobs(req *http.Request) ([]tracker.Job, error) {
+	var j tracker.Job
+	if err := j.Unmarshal([]byte(req.Form.Get("job"))); err != nil {
+		return nil, err
+	}
+	end := j.Date
+	if e := req.Form.Get("end"); e != "" {
+		var err error
+		end, err = civil.Parse(e)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if n := civil.Days(j.Date, end) + 1; n > MaxRangeDays {
+		return nil, fmt.Errorf("%w: %d days, more than %d", ErrRangeTooLong, n, MaxRangeDays)
+	}
+	result := []tracker.Job{}
+	for _, d := range civil.Range(j.Date, end) {
+		job := j
+		job.Date = d
+		result = append(result, job)
+	}
+	if len(result) == 0 {
+		return nil, ErrNoJobs
+	}
+	return result, nil
+}
+
+// requeue queues the jobs to be dispatched to parsers again, before other
+// jobs.  Jobs that are in flight are refused.  With "force=true", jobs that
+// are in flight or already complete are reprocessed from the start.
+func (h *Handler) requeue(ctx context.Context, user string, req *http.Request) ([]tracker.Job, string, error) {
+	jj, err := jobs(req)
+	if err != nil {
+		return nil, "", err
+	}
+	if req.Form.Get("force") == "true" {
+		for _, j := range jj {
+			if err := h.monitor.Reprocess(ctx, j, "forced by "+user); err != nil {
+				return nil, "", fmt.Errorf("%v: %w", j, err)
+			}
+		}
+		return jj, "forced", nil
+	}
+	if h.queue == nil {
+		return nil, "", errors.New("requeue not supported")
+	}
+	for _, j := range jj {
+		if s, err := h.tk.GetStatus(j); err == nil && inFlight(s.State()) {
+			return nil, "", fmt.Errorf("%v: %w", j, tracker.ErrJobAlreadyExists)
+		}
+	}
+	for _, j := range jj {
+		if err := h.queue.Requeue(ctx, j); err != nil {
+			return nil, "", fmt.Errorf("%v: %w", j, err)
+		}
+	}
+	return jj, "", nil
+}
+
+// inFlight returns true if a job in the state can't be dispatched again.
+func inFlight(state tracker.State) bool {
+	switch state {
+	case tracker.Complete, tracker.Failed, tracker.PartialComplete:
+		return false
+	}
+	return true
+}
+
+func (h *Handler) cancel(ctx context.Context, user string, req *http.Request) ([]tracker.Job, string, error) {
+	jj, err := jobs(req)
+	if err != nil {
+		return nil, "", err
+	}
+	reason := req.Form.Get("reason")
+	for _, j := range jj {
+		if err := h.monitor.Cancel(ctx, j, reason+" (by "+user+")"); err != nil {
+			return nil, "", fmt.Errorf("%v: %w", j, err)
+		}
+	}
+	return jj, reason, nil
+}
+
+// cancelJob cancels the job whose Key is the path after /job/, with an
+// optional "reason" and, for jobs with a filter, "filter" parameter.
+func (h *Handler) cancelJob(ctx context.Context, user string, req *http.Request) ([]tracker.Job, string, error) {
+	j, err := tracker.ParseJobKey(strings.TrimPrefix(req.URL.EscapedPath(), "/job/"))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrNoJobs, err)
+	}
+	j.Filter = req.Form.Get("filter")
+	reason := req.Form.Get("reason")
+	if err := h.monitor.Cancel(ctx, j, reason+" (by "+user+")"); err != nil {
+		return nil, "", fmt.Errorf("%v: %w", j, err)
+	}
+	return []tracker.Job{j}, reason, nil
+}
+
+// jobStatus responds to a job cancellation with the job's JobStatus, and
+// 202 if the job is still Cancelling, waiting for its parser, or 200 if it
+// has failed.  Unknown jobs get 404, and jobs that can't be cancelled 409.
+func (h *Handler) jobStatus(resp http.ResponseWriter, jobs []tracker.Job, err error) {
+	switch {
+	case errors.Is(err, ErrNoJobs):
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	case errors.Is(err, tracker.ErrJobNotFound):
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, tracker.ErrInvalidStateTransition):
+		resp.WriteHeader(http.StatusConflict)
+		return
+	case err != nil:
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	j := jobs[0]
+	status, err := h.tk.GetStatus(j)
+	if err != nil {
+		// The job may have expired since.
+		status = tracker.Status{}
+	}
+	b, err := json.Marshal(tracker.JobStatus{Job: j, Status: status})
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if status.History != nil && status.State() == tracker.Cancelling {
+		resp.WriteHeader(http.StatusAccepted)
+	}
+	resp.Write(b)
+}
+
+// pause pauses the whole monitor, or a single datatype if the "experiment"
+// and "datatype" parameters are provided.
+func (h *Handler) pause(ctx context.Context, user string, req *http.Request) ([]tracker.Job, string, error) {
+	exp, dt := req.Form.Get("experiment"), req.Form.Get("datatype")
+	if exp != "" && dt != "" {
+		h.monitor.PauseDatatype(exp, dt)
+		return nil, exp + "/" + dt, nil
+	}
+	h.monitor.Pause()
+	return nil, "", nil
+}
+
+// resume resumes the whole monitor, or a single datatype if the "experiment"
+// and "datatype" parameters are provided.
+func (h *Handler) resume(ctx context.Context, user string, req *http.Request) ([]tracker.Job, string, error) {
+	exp, dt := req.Form.Get("experiment"), req.Form.Get("datatype")
+	if exp != "" && dt != "" {
+		h.monitor.ResumeDatatype(exp, dt)
+		return nil, exp + "/" + dt, nil
+	}
+	h.monitor.Resume()
+	return nil, "", nil
+}
+
+// skip adds jobs to the skip list, or removes them if "remove" is true.
+func (h *Handler) skip(ctx context.Context, user string, req *http.Request) ([]tracker.Job, string, error) {
+	if h.skipper == nil {
+		return nil, "", errors.New("skip list not supported")
+	}
+	jj, err := jobs(req)
+	if err != nil {
+		return nil, "", err
+	}
+	remove := req.Form.Get("remove") == "true"
+	for _, j := range jj {
+		if err := h.skipper.SetSkip(ctx, j, !remove); err != nil {
+			return nil, "", fmt.Errorf("%v: %w", j, err)
+		}
+	}
+	if remove {
+		return jj, "removed", nil
+	}
+	return jj, "added", nil
+}
+
+func (h *Handler) forceComplete(ctx context.Context, user string, req *http.Request) ([]tracker.Job, string, error) {
+	jj, err := jobs(req)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, j := range jj {
+		if err := h.tk.SetStatus(j, tracker.Complete, "forced by "+user); err != nil {
+			return nil, "", fmt.Errorf("%v: %w", j, err)
+		}
+	}
+	return jj, "", nil
+}
+
+// releaseHold lets the jobs' copies proceed without waiting for
+// annotations.
+func (h *Handler) releaseHold(ctx context.Context, user string, req *http.Request) ([]tracker.Job, string, error) {
+	jj, err := jobs(req)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, j := range jj {
+		if err := h.monitor.ReleaseHold(j, user); err != nil {
+			return nil, "", fmt.Errorf("%v: %w", j, err)
+		}
+	}
+	return jj, "", nil
+}
+
+// onboardDatatype creates any missing datasets and tables for the
+// "experiment" and "datatype" parameters, using the "schema" parameter,
+// which is either a JSON schema or the dataset.table of an existing table.
+func (h *Handler) onboardDatatype(ctx context.Context, user string, req *http.Request) ([]tracker.Job, string, error) {
+	exp, dt := req.Form.Get("experiment"), req.Form.Get("datatype")
+	schema := req.Form.Get("schema")
+	if exp == "" || dt == "" || schema == "" {
+		return nil, "", ErrMissingParams
+	}
+	created, err := h.onboard.Onboard(ctx, exp, dt, schema)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s/%s: %w", exp, dt, err)
+	}
+	if len(created) == 0 {
+		return nil, exp + "/" + dt + ": nothing to create", nil
+	}
+	return nil, exp + "/" + dt + ": created " + strings.Join(created, ", "), nil
+}
+
+// backfill sizes the jobs' archives, and adds them to the backfill plan.
+// If there is a cost estimator, backfills whose estimate needs approval are
+// refused unless "approve=true".
+func (h *Handler) backfill(ctx context.Context, user string, req *http.Request) ([]tracker.Job, string, error) {
+	jj, err := jobs(req)
+	if err != nil {
+		return nil, "", err
+	}
+	estimate := ""
+	if h.coster != nil {
+		e, err := h.coster.Estimate(ctx, jj)
+		if err != nil {
+			return nil, "", err
+		}
+		if e.NeedsApproval && req.Form.Get("approve") != "true" {
+			return nil, "", fmt.Errorf("%w: %s", ErrApprovalRequired, e)
+		}
+		estimate = ", " + e.String()
+		if e.NeedsApproval {
+			estimate += ", approved"
+		}
+	}
+	items, err := h.planner.PlanBackfill(ctx, jj)
+	if err != nil {
+		return nil, "", err
+	}
+	var total int64
+	for _, item := range items {
+		total += item.Bytes
+	}
+	return jj, fmt.Sprintf("planned %d jobs, %d bytes%s", len(items), total, estimate), nil
+}
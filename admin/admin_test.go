@@ -0,0 +1,674 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/admin"
+	"github.com/m-lab/etl-gardener/backfill"
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/persistence"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+type fakeMonitor struct {
+	paused      bool
+	pausedTypes map[string]bool
+	cancelled   []tracker.Job
+	reason      string
+	reprocessed []tracker.Job
+	released    map[tracker.Job]string
+}
+
+func (m *fakeMonitor) Cancel(ctx context.Context, j tracker.Job, reason string) error {
+	m.cancelled = append(m.cancelled, j)
+	m.reason = reason
+	return nil
+}
+func (m *fakeMonitor) Reprocess(ctx context.Context, j tracker.Job, reason string) error {
+	m.reprocessed = append(m.reprocessed, j)
+	m.reason = reason
+	return nil
+}
+func (m *fakeMonitor) Pause()  { m.paused = true }
+func (m *fakeMonitor) Resume() { m.paused = false }
+func (m *fakeMonitor) PauseDatatype(exp, dt string) {
+	m.pausedTypes[exp+"/"+dt] = true
+}
+func (m *fakeMonitor) ResumeDatatype(exp, dt string) {
+	delete(m.pausedTypes, exp+"/"+dt)
+}
+func (m *fakeMonitor) ReleaseHold(j tracker.Job, user string) error {
+	m.released[j] = user
+	return nil
+}
+
+type fakeSkipper struct {
+	skip map[tracker.Job]bool
+	err  error
+}
+
+func (s *fakeSkipper) SetSkip(ctx context.Context, j tracker.Job, skip bool) error {
+	if s.err != nil {
+		return s.err
+	}
+	if skip {
+		s.skip[j] = true
+	} else {
+		delete(s.skip, j)
+	}
+	return nil
+}
+func (s *fakeSkipper) SkipList() []tracker.Job {
+	list := []tracker.Job{}
+	for j := range s.skip {
+		list = append(list, j)
+	}
+	return list
+}
+
+type fakeRequeuer struct {
+	queued []tracker.Job
+}
+
+func (r *fakeRequeuer) Requeue(ctx context.Context, j tracker.Job) error {
+	r.queued = append(r.queued, j)
+	return nil
+}
+
+type fakeSaver struct {
+	lock  sync.Mutex
+	saved []persistence.StateObject
+}
+
+func (s *fakeSaver) Save(ctx context.Context, o persistence.StateObject) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.saved = append(s.saved, o)
+	return nil
+}
+func (s *fakeSaver) Delete(ctx context.Context, o persistence.StateObject) error {
+	return errors.New("not implemented")
+}
+func (s *fakeSaver) Fetch(ctx context.Context, o persistence.StateObject) error {
+	return errors.New("not implemented")
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := admin.ParseKeys("alice:abc, bob:def,")
+	rtx.Must(err, "parse")
+	if len(keys) != 2 || keys["abc"] != "alice" || keys["def"] != "bob" {
+		t.Error("Wrong keys", keys)
+	}
+	if _, err := admin.ParseKeys("alice"); !errors.Is(err, admin.ErrInvalidKeys) {
+		t.Error("Expected ErrInvalidKeys", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	monitor := &fakeMonitor{pausedTypes: map[string]bool{}}
+	skipper := &fakeSkipper{skip: map[tracker.Job]bool{}}
+	saver := &fakeSaver{}
+	h := admin.NewHandler(map[string]string{"secret": "alice"}, tk, monitor, skipper, saver)
+	requeuer := &fakeRequeuer{}
+	h.SetRequeuer(requeuer)
+	mux := http.NewServeMux()
+	h.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	post := func(path, key string, values url.Values) int {
+		req, err := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(values.Encode()))
+		rtx.Must(err, "request")
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		rtx.Must(err, "post")
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	jobParam := url.Values{"job": {string(job.Marshal())}}
+
+	if code := post("/admin/pause", "", nil); code != http.StatusUnauthorized {
+		t.Error("Expected StatusUnauthorized", code)
+	}
+	if code := post("/admin/pause", "wrong", nil); code != http.StatusUnauthorized {
+		t.Error("Expected StatusUnauthorized", code)
+	}
+	if code := post("/admin/pause", "secret", nil); code != http.StatusOK || !monitor.paused {
+		t.Error("Pause failed", code)
+	}
+	if code := post("/admin/resume", "secret", nil); code != http.StatusOK || monitor.paused {
+		t.Error("Resume failed", code)
+	}
+	typeParam := url.Values{"experiment": {"ndt"}, "datatype": {"ndt7"}}
+	if code := post("/admin/pause", "secret", typeParam); code != http.StatusOK || !monitor.pausedTypes["ndt/ndt7"] || monitor.paused {
+		t.Error("Pause datatype failed", code)
+	}
+	if code := post("/admin/resume", "secret", typeParam); code != http.StatusOK || monitor.pausedTypes["ndt/ndt7"] {
+		t.Error("Resume datatype failed", code)
+	}
+
+	// Requeue a range of three dates, to be dispatched to parsers.
+	rangeParam := url.Values{"job": jobParam["job"], "end": {"2020-01-03"}}
+	if code := post("/admin/requeue", "secret", rangeParam); code != http.StatusOK {
+		t.Error("Requeue failed", code)
+	}
+	if len(requeuer.queued) != 3 || requeuer.queued[0] != job || tk.NumJobs() != 0 {
+		t.Error("Expected 3 queued jobs", requeuer.queued, tk.NumJobs())
+	}
+	// Ranges over MaxRangeDays are refused.
+	longParam := url.Values{"job": jobParam["job"], "end": {"2021-01-01"}}
+	if code := post("/admin/requeue", "secret", longParam); code != http.StatusBadRequest {
+		t.Error("Expected StatusBadRequest", code)
+	}
+	if len(requeuer.queued) != 3 {
+		t.Error("Expected 3 queued jobs", requeuer.queued)
+	}
+	// Requeue of an in-flight job should fail.
+	rtx.Must(tk.AddJob(job), "add job")
+	if code := post("/admin/requeue", "secret", jobParam); code != http.StatusBadRequest {
+		t.Error("Expected StatusBadRequest", code)
+	}
+	if len(requeuer.queued) != 3 {
+		t.Error("Expected 3 queued jobs", requeuer.queued)
+	}
+	// Unless it is forced.
+	if code := post("/admin/requeue", "secret", url.Values{"job": jobParam["job"], "force": {"true"}}); code != http.StatusOK {
+		t.Error("Forced requeue failed", code)
+	}
+	if len(monitor.reprocessed) != 1 || monitor.reprocessed[0] != job || monitor.reason != "forced by alice" {
+		t.Error("Wrong reprocess", monitor.reprocessed, monitor.reason)
+	}
+
+	if code := post("/admin/cancel", "secret", url.Values{"job": jobParam["job"], "reason": {"oops"}}); code != http.StatusOK {
+		t.Error("Cancel failed", code)
+	}
+	if len(monitor.cancelled) != 1 || monitor.reason != "oops (by alice)" {
+		t.Error("Wrong cancel", monitor.cancelled, monitor.reason)
+	}
+
+	if code := post("/admin/skip", "secret", jobParam); code != http.StatusOK || !skipper.skip[job] {
+		t.Error("Skip failed", code)
+	}
+	if code := post("/admin/skip", "secret", url.Values{"job": jobParam["job"], "remove": {"true"}}); code != http.StatusOK || skipper.skip[job] {
+		t.Error("Skip removal failed", code)
+	}
+	// Skips that aren't saved fail, and aren't audited.
+	skipper.err = errors.New("save failed")
+	if code := post("/admin/skip", "secret", jobParam); code != http.StatusBadRequest || skipper.skip[job] {
+		t.Error("Expected StatusBadRequest", code)
+	}
+	skipper.err = nil
+
+	if code := post("/admin/force-complete", "secret", jobParam); code != http.StatusOK {
+		t.Error("Force complete failed", code)
+	}
+	if tk.NumJobs() != 0 {
+		t.Error("Expected no jobs in flight", tk.NumJobs())
+	}
+
+	// Check the audit log.
+	entries := h.Audit()
+	if len(entries) != 10 {
+		t.Fatal("Expected 10 audit entries", entries)
+	}
+	if entries[0].Action != "force-complete" || entries[0].User != "alice" || len(entries[0].Jobs) != 1 {
+		t.Error("Wrong audit entry", entries[0])
+	}
+	if len(saver.saved) != 10 {
+		t.Error("Expected 10 saved entries", len(saver.saved))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/admin/audit", nil)
+	rtx.Must(err, "request")
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	rtx.Must(err, "get")
+	defer resp.Body.Close()
+	var got []admin.AuditEntry
+	rtx.Must(json.NewDecoder(resp.Body).Decode(&got), "decode")
+	if len(got) != 10 || got[9].Action != "pause" {
+		t.Error("Wrong audit response", got)
+	}
+}
+
+type fakeOnboarder struct {
+	calls []string
+}
+
+func (o *fakeOnboarder) Onboard(ctx context.Context, experiment, datatype, schemaRef string) ([]string, error) {
+	o.calls = append(o.calls, experiment+"/"+datatype+":"+schemaRef)
+	return []string{"tmp_" + experiment, "raw_" + experiment}, nil
+}
+
+func TestReleaseHold(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	monitor := &fakeMonitor{released: map[tracker.Job]string{}}
+	h := admin.NewHandler(map[string]string{"secret": "alice"}, tk, monitor, nil, nil)
+	mux := http.NewServeMux()
+	h.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	values := url.Values{"job": {string(job.Marshal())}, "end": {"2020-01-02"}}
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/admin/release-hold", strings.NewReader(values.Encode()))
+	rtx.Must(err, "request")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	rtx.Must(err, "post")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(monitor.released) != 2 || monitor.released[job] != "alice" {
+		t.Error("Release failed", resp.Status, monitor.released)
+	}
+	if entries := h.Audit(); len(entries) != 1 || entries[0].Action != "release-hold" {
+		t.Error("Wrong audit entry", entries)
+	}
+}
+
+func TestOnboard(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	onboarder := &fakeOnboarder{}
+	h := admin.NewHandler(map[string]string{"secret": "alice"}, tk, &fakeMonitor{}, nil, nil)
+	h.SetOnboarder(onboarder)
+	mux := http.NewServeMux()
+	h.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	post := func(values url.Values) int {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/admin/onboard", strings.NewReader(values.Encode()))
+		rtx.Must(err, "request")
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		rtx.Must(err, "post")
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post(url.Values{"experiment": {"foo"}, "datatype": {"bar"}}); code != http.StatusBadRequest {
+		t.Error("Expected StatusBadRequest", code)
+	}
+	params := url.Values{"experiment": {"foo"}, "datatype": {"bar"}, "schema": {"ndt.ndt7"}}
+	if code := post(params); code != http.StatusOK {
+		t.Error("Onboard failed", code)
+	}
+	if len(onboarder.calls) != 1 || onboarder.calls[0] != "foo/bar:ndt.ndt7" {
+		t.Error("Wrong onboard calls", onboarder.calls)
+	}
+	entries := h.Audit()
+	if len(entries) != 1 || entries[0].Action != "onboard" || entries[0].Detail != "foo/bar: created tmp_foo, raw_foo" {
+		t.Error("Wrong audit entry", entries)
+	}
+}
+
+type fakeFinder struct {
+	calls []string
+}
+
+func (f *fakeFinder) OutdatedDates(ctx context.Context, experiment, datatype, version string,
+	start, end time.Time) ([]bq.DateVersions, error) {
+	f.calls = append(f.calls, fmt.Sprintf("%s/%s<%s:%s-%s", experiment, datatype, version,
+		start.Format("2006-01-02"), end.Format("2006-01-02")))
+	return []bq.DateVersions{{Date: "2020-06-01", Versions: []string{"v2.3.0"}}}, nil
+}
+
+func TestVersions(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	finder := &fakeFinder{}
+	h := admin.NewHandler(map[string]string{"secret": "alice"}, tk, &fakeMonitor{}, nil, nil)
+	h.SetVersionFinder(finder)
+	mux := http.NewServeMux()
+	h.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(query string, key string) (*http.Response, []bq.DateVersions) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/admin/versions?"+query, nil)
+		rtx.Must(err, "request")
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		rtx.Must(err, "get")
+		defer resp.Body.Close()
+		dates := []bq.DateVersions{}
+		if resp.StatusCode == http.StatusOK {
+			rtx.Must(json.NewDecoder(resp.Body).Decode(&dates), "decode")
+		}
+		return resp, dates
+	}
+
+	query := "experiment=ndt&datatype=ndt7&before=v2.4.0&start=2020-06-01&end=2020-06-30"
+	if resp, _ := get(query, "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected StatusUnauthorized", resp.Status)
+	}
+	if resp, _ := get("experiment=ndt&datatype=ndt7", "secret"); resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected StatusBadRequest", resp.Status)
+	}
+	resp, dates := get(query, "secret")
+	if resp.StatusCode != http.StatusOK || len(dates) != 1 || dates[0].Date != "2020-06-01" {
+		t.Error("Wrong response", resp.Status, dates)
+	}
+	if len(finder.calls) != 1 || finder.calls[0] != "ndt/ndt7<v2.4.0:2020-06-01-2020-06-30" {
+		t.Error("Wrong finder calls", finder.calls)
+	}
+}
+
+type fakeBackfiller struct {
+	plan []backfill.Item
+}
+
+func (b *fakeBackfiller) PlanBackfill(ctx context.Context, jobs []tracker.Job) ([]backfill.Item, error) {
+	items := []backfill.Item{}
+	for _, j := range jobs {
+		items = append(items, backfill.Item{Job: j, Bytes: 100})
+	}
+	b.plan = append(b.plan, items...)
+	return items, nil
+}
+
+func (b *fakeBackfiller) BackfillPlan() []backfill.Item {
+	return b.plan
+}
+
+func TestBackfill(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	planner := &fakeBackfiller{}
+	h := admin.NewHandler(map[string]string{"secret": "alice"}, tk, &fakeMonitor{}, nil, nil)
+	h.SetBackfiller(planner)
+	mux := http.NewServeMux()
+	h.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	values := url.Values{"job": {string(job.Marshal())}, "end": {"2020-01-03"}}
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/admin/backfill", strings.NewReader(values.Encode()))
+	rtx.Must(err, "request")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	rtx.Must(err, "post")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(planner.plan) != 3 {
+		t.Error("Backfill failed", resp.Status, planner.plan)
+	}
+	entries := h.Audit()
+	if len(entries) != 1 || entries[0].Action != "backfill" || entries[0].Detail != "planned 3 jobs, 300 bytes" {
+		t.Error("Wrong audit entry", entries)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, server.URL+"/admin/backfill-plan", nil)
+	rtx.Must(err, "request")
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	rtx.Must(err, "get")
+	defer resp.Body.Close()
+	plan := []backfill.Item{}
+	rtx.Must(json.NewDecoder(resp.Body).Decode(&plan), "decode")
+	if len(plan) != 3 || plan[0].Job != job {
+		t.Error("Wrong plan", plan)
+	}
+}
+
+type fakeCoster struct {
+	bytes int64
+}
+
+func (c *fakeCoster) Estimate(ctx context.Context, jobs []tracker.Job) (backfill.Estimate, error) {
+	return backfill.Estimate{Jobs: len(jobs), Bytes: c.bytes * int64(len(jobs)),
+		NeedsApproval: c.bytes*int64(len(jobs)) > 1000}, nil
+}
+
+func TestBackfillEstimate(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	planner := &fakeBackfiller{}
+	h := admin.NewHandler(map[string]string{"secret": "alice"}, tk, &fakeMonitor{}, nil, nil)
+	h.SetBackfiller(planner)
+	h.SetCostEstimator(&fakeCoster{bytes: 500})
+	mux := http.NewServeMux()
+	h.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	values := url.Values{"job": {string(job.Marshal())}, "end": {"2020-01-03"}}
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/admin/backfill-estimate?"+values.Encode(), nil)
+	rtx.Must(err, "request")
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	rtx.Must(err, "get")
+	e := backfill.Estimate{}
+	rtx.Must(json.NewDecoder(resp.Body).Decode(&e), "decode")
+	resp.Body.Close()
+	if e.Jobs != 3 || e.Bytes != 1500 || !e.NeedsApproval {
+		t.Errorf("Wrong estimate %+v", e)
+	}
+	if len(planner.plan) != 0 || len(h.Audit()) != 0 {
+		t.Error("Estimates should not plan", planner.plan)
+	}
+
+	post := func(values url.Values) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/admin/backfill", strings.NewReader(values.Encode()))
+		rtx.Must(err, "request")
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		rtx.Must(err, "post")
+		resp.Body.Close()
+		return resp
+	}
+	if resp := post(values); resp.StatusCode != http.StatusBadRequest || len(planner.plan) != 0 {
+		t.Error("Backfill should need approval", resp.Status, planner.plan)
+	}
+	values.Set("approve", "true")
+	if resp := post(values); resp.StatusCode != http.StatusOK || len(planner.plan) != 3 {
+		t.Error("Approved backfill failed", resp.Status, planner.plan)
+	}
+	entries := h.Audit()
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].Detail, ", approved") ||
+		!strings.Contains(entries[0].Detail, "estimated 1500 bytes") {
+		t.Error("Wrong audit entry", entries)
+	}
+	// Small backfills need no approval.
+	values = url.Values{"job": {string(job.Marshal())}}
+	if resp := post(values); resp.StatusCode != http.StatusOK || len(planner.plan) != 4 {
+		t.Error("Backfill failed", resp.Status, planner.plan)
+	}
+}
+
+func TestRequireKeys(t *testing.T) {
+	called := 0
+	h := admin.RequireKeys(map[string]string{"secret": "alice"}, func(resp http.ResponseWriter, req *http.Request) {
+		called++
+	})
+	for _, tt := range []struct {
+		key  string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v2/request", nil)
+		if tt.key != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+		}
+		resp := httptest.NewRecorder()
+		h(resp, req)
+		if resp.Code != tt.want {
+			t.Errorf("RequireKeys(%q) = %d, want %d", tt.key, resp.Code, tt.want)
+		}
+	}
+	if called != 1 {
+		t.Error("Expected a single call", called)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	parsing := tracker.NewJob("bucket", "exp", "type", date)
+	rtx.Must(tk.AddJob(parsing), "add job")
+	rtx.Must(tk.SetStatus(parsing, tracker.Parsing, ""), "set status")
+	sharded := tracker.NewJob("bucket", "exp", "type", date.AddDate(0, 0, 1))
+	rtx.Must(tk.AddSharded(sharded, []string{"a", "b"}), "add sharded")
+	shard := sharded
+	shard.Prefix = "a"
+	rtx.Must(tk.AddJob(shard), "add shard")
+
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	h := admin.NewHandler(map[string]string{"secret": "alice"}, tk, m, nil, nil)
+	mux := http.NewServeMux()
+	h.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	del := func(path, key string) int {
+		req, err := http.NewRequest(http.MethodDelete, server.URL+path, nil)
+		rtx.Must(err, "request")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		rtx.Must(err, "delete")
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := del("/job/"+parsing.Key(), ""); code != http.StatusUnauthorized {
+		t.Error("Expected StatusUnauthorized", code)
+	}
+	if code := del("/job/"+parsing.Key(), "wrong"); code != http.StatusUnauthorized {
+		t.Error("Expected StatusUnauthorized", code)
+	}
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/job/"+parsing.Key(), nil)
+	rtx.Must(err, "request")
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	rtx.Must(err, "get")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("Expected StatusMethodNotAllowed", resp.StatusCode)
+	}
+	if code := del("/job/bucket/exp", "secret"); code != http.StatusBadRequest {
+		t.Error("Expected StatusBadRequest", code)
+	}
+	other := tracker.NewJob("bucket", "exp", "other", date)
+	if code := del("/job/"+other.Key(), "secret"); code != http.StatusNotFound {
+		t.Error("Expected StatusNotFound", code)
+	}
+	if len(h.Audit()) != 0 {
+		t.Error("Failed cancellations should not be audited", h.Audit())
+	}
+
+	// The parser is told with its next heartbeat.
+	if code := del("/job/"+parsing.Key()+"?reason=stuck", "secret"); code != http.StatusAccepted {
+		t.Error("Expected StatusAccepted", code)
+	}
+	if s, _ := tk.GetStatus(parsing); s.State() != tracker.Cancelling || s.Detail() != "stuck (by alice)" {
+		t.Error("Expected Cancelling:", s)
+	}
+	if err := tk.Heartbeat(parsing); !errors.Is(err, tracker.ErrJobCancelled) {
+		t.Error("Expected ErrJobCancelled", err)
+	}
+	if code := del("/job/"+parsing.Key(), "secret"); code != http.StatusConflict {
+		t.Error("Expected StatusConflict", code)
+	}
+	audit := h.Audit()
+	if len(audit) != 1 || audit[0].User != "alice" || audit[0].Action != "cancel" ||
+		audit[0].Detail != "stuck" || len(audit[0].Jobs) != 1 || audit[0].Jobs[0] != parsing.Key() {
+		t.Error("Wrong audit", audit)
+	}
+
+	// Sharded jobs fail immediately, and their shards are cancelled.
+	if code := del("/job/"+sharded.Key()+"?reason=stuck", "secret"); code != http.StatusOK {
+		t.Error("Expected StatusOK", code)
+	}
+	if s, _ := tk.GetStatus(sharded); s.State() != tracker.Failed || !strings.Contains(s.Detail(), "cancelled: stuck") {
+		t.Error("Expected Failed:", s)
+	}
+	if s, _ := tk.GetStatus(shard); s.State() != tracker.Cancelling || s.Detail() != "sharded job cancelled: stuck (by alice)" {
+		t.Error("Expected Cancelling shard:", s)
+	}
+	if len(h.Audit()) != 2 {
+		t.Error("Expected 2 audit entries", h.Audit())
+	}
+}
+
+type fakeVerifier map[string]string // Maps token to email.
+
+func (v fakeVerifier) Verify(ctx context.Context, token string) (string, error) {
+	if email, ok := v[token]; ok {
+		return email, nil
+	}
+	return "", errors.New("invalid token")
+}
+
+func TestTokenVerifier(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	monitor := &fakeMonitor{}
+	h := admin.NewHandler(map[string]string{"secret": "alice"}, tk, monitor, nil, nil)
+	h.SetTokenVerifier(fakeVerifier{"good": "bob@example.com", "other": "eve@example.com"},
+		[]string{"bob@example.com", " carol@example.com"})
+	mux := http.NewServeMux()
+	h.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	pause := func(token string) int {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/admin/pause", nil)
+		rtx.Must(err, "request")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		rtx.Must(err, "post")
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for token, want := range map[string]int{
+		"secret": http.StatusOK,
+		"good":   http.StatusOK,
+		"other":  http.StatusUnauthorized, // Not an allowed identity.
+		"bad":    http.StatusUnauthorized,
+	} {
+		if code := pause(token); code != want {
+			t.Errorf("%s: got %d, want %d", token, code, want)
+		}
+	}
+	users := []string{}
+	for _, e := range h.Audit() {
+		users = append(users, e.User)
+	}
+	if len(users) != 2 || !strings.Contains(strings.Join(users, ","), "bob@example.com") {
+		t.Error("Wrong audit users", users)
+	}
+}
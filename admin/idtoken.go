@@ -0,0 +1,27 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/api/idtoken"
+)
+
+// IDTokenVerifier verifies Google-signed ID tokens for the Audience, e.g.
+// from `gcloud auth print-identity-token --audiences=...`.
+type IDTokenVerifier struct {
+	Audience string
+}
+
+// Verify implements TokenVerifier.Verify.
+func (v IDTokenVerifier) Verify(ctx context.Context, token string) (string, error) {
+	p, err := idtoken.Validate(ctx, token, v.Audience)
+	if err != nil {
+		return "", err
+	}
+	email, _ := p.Claims["email"].(string)
+	if verified, _ := p.Claims["email_verified"].(bool); email == "" || !verified {
+		return "", fmt.Errorf("%w: %q", ErrUnverifiedEmail, email)
+	}
+	return email, nil
+}
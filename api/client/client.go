@@ -0,0 +1,326 @@
+// Package client provides typed access to the gardener manager's HTTP API:
+// the job endpoints used by parsers, the status endpoints, and the
+// authenticated admin API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/m-lab/etl-gardener/backfill"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Errors returned by Client methods.
+var (
+	// ErrRequestFailed is returned, wrapped with the status and response
+	// body, for requests that don't succeed.
+	ErrRequestFailed = errors.New("request failed")
+	// ErrUnknownJob is returned by job updates for jobs the tracker doesn't
+	// have, e.g. because they were cancelled.
+	ErrUnknownJob = errors.New("unknown job")
+	// ErrUnavailable is returned when the manager can't serve the request
+	// for now, e.g. NextJob while dispatch is paused or throttled.  The
+	// request may be tried again later.
+	ErrUnavailable = errors.New("service unavailable")
+	// ErrNotFound is returned for paths the manager doesn't serve, e.g. v2
+	// paths on a manager that predates them.
+	ErrNotFound = errors.New("not found")
+)
+
+// Client calls the gardener API at Base.  Admin calls require Key.
+type Client struct {
+	Base url.URL
+	Key  string
+	// HTTP is the client used for requests.  If nil, http.DefaultClient is
+	// used.
+	HTTP *http.Client
+}
+
+// New returns a Client for the gardener at base, using the admin key, which
+// may be empty.
+func New(base url.URL, key string) *Client {
+	return &Client{Base: base, Key: key}
+}
+
+func (c *Client) url(path string, query url.Values) string {
+	u := c.Base
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// do sends the request, and returns the response body if it succeeds.
+func (c *Client) do(req *http.Request) ([]byte, error) {
+	if c.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Key)
+	}
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return b, nil
+	case http.StatusGone:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownJob, req.URL.Path)
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, req.URL.Path)
+	case http.StatusServiceUnavailable:
+		return nil, fmt.Errorf("%w: %s %s", ErrUnavailable, req.URL.Path, strings.TrimSpace(string(b)))
+	}
+	return nil, fmt.Errorf("%w: %s: %s %s", ErrRequestFailed, req.URL.Path, resp.Status,
+		strings.TrimSpace(string(b)))
+}
+
+// get fetches path, and decodes the JSON response into v.
+func (c *Client) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(path, query), nil)
+	if err != nil {
+		return err
+	}
+	b, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// post sends the form to path, and returns the response body.
+func (c *Client) post(ctx context.Context, path string, form url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url(path, nil), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req)
+}
+
+// postV2 sends v as a v2 JSON request to the v2 path, and returns the
+// response body.  If the manager doesn't serve the v2 path, it falls back to
+// the v1 path, with the form.
+func (c *Client) postV2(ctx context.Context, path string, v interface{}, form url.Values) ([]byte, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url("/"+tracker.ProtocolV2+path, nil), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", tracker.MediaTypeV2)
+	req.Header.Set("Accept", tracker.MediaTypeV2)
+	b, err := c.do(req)
+	if errors.Is(err, ErrNotFound) {
+		return c.post(ctx, path, form)
+	}
+	return b, err
+}
+
+// jobForm returns the form for the job, and every date from the job's date
+// to end, if end is after it.
+func jobForm(job tracker.Job, end time.Time) url.Values {
+	form := url.Values{"job": {string(job.Marshal())}}
+	if end.After(job.Date) {
+		form.Set("end", end.Format("2006-01-02"))
+	}
+	return form
+}
+
+// ---------- Job endpoints, used by parsers ----------
+
+// The job endpoints use the v2 protocol, and fall back to v1 for managers
+// that predate it.
+
+// NextJob requests a job to parse.  It returns ErrUnavailable if dispatch
+// is paused, throttled or at quota.  v1 managers don't report the job's
+// target.
+func (c *Client) NextJob(ctx context.Context) (tracker.JobWithTarget, error) {
+	b, err := c.postV2(ctx, "/job", struct{ Version string }{tracker.ProtocolV2}, nil)
+	if err != nil {
+		return tracker.JobWithTarget{}, err
+	}
+	r := tracker.JobResponse{}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return r.Job, err
+	}
+	if r.Version == "" {
+		// A v1 response is the bare job.
+		err = json.Unmarshal(b, &r.Job)
+	}
+	return r.Job, err
+}
+
+// Update reports the job's state and detail, and the parser release, if
+// version is not empty.
+func (c *Client) Update(ctx context.Context, job tracker.Job, state tracker.State, detail, version string) error {
+	form := url.Values{"job": {string(job.Marshal())}, "state": {string(state)}, "detail": {detail}}
+	if version != "" {
+		form.Set("version", version)
+	}
+	u := tracker.JobUpdate{Job: job, State: state, Detail: detail, ParserVersion: version}
+	_, err := c.postV2(ctx, "/update", u, form)
+	return err
+}
+
+// Heartbeat reports that the job is still being parsed.
+func (c *Client) Heartbeat(ctx context.Context, job tracker.Job) error {
+	_, err := c.postV2(ctx, "/heartbeat", tracker.JobUpdate{Job: job}, url.Values{"job": {string(job.Marshal())}})
+	return err
+}
+
+// Error reports that parsing the job failed.
+func (c *Client) Error(ctx context.Context, job tracker.Job, errString string) error {
+	_, err := c.postV2(ctx, "/error", tracker.JobUpdate{Job: job, Error: errString},
+		url.Values{"job": {string(job.Marshal())}, "error": {errString}})
+	return err
+}
+
+// ---------- Status endpoints ----------
+
+// JobFilter selects jobs by experiment, datatype and state.  Empty fields
+// match all jobs.
+type JobFilter struct {
+	Experiment string
+	Datatype   string
+	State      tracker.State
+}
+
+// Jobs returns the status of the jobs in the tracker that match the filter.
+func (c *Client) Jobs(ctx context.Context, f JobFilter) ([]tracker.JobStatus, error) {
+	q := url.Values{}
+	for k, v := range map[string]string{"experiment": f.Experiment, "datatype": f.Datatype, "state": string(f.State)} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	jobs := []tracker.JobStatus{}
+	err := c.get(ctx, "/jobs.json", q, &jobs)
+	return jobs, err
+}
+
+// Summary returns the state counts, oldest pending dates and failures.
+func (c *Client) Summary(ctx context.Context) (tracker.Summary, error) {
+	s := tracker.Summary{}
+	err := c.get(ctx, "/status.json", nil, &s)
+	return s, err
+}
+
+// ETAs returns the backlog estimates for each experiment/datatype.
+func (c *Client) ETAs(ctx context.Context) ([]tracker.ETA, error) {
+	etas := []tracker.ETA{}
+	err := c.get(ctx, "/eta.json", nil, &etas)
+	return etas, err
+}
+
+// ---------- Admin endpoints, which require Key ----------
+
+// Requeue adds the job, and one for every date to end, if end is after the
+// job's date.  With force, jobs that are in flight or complete are
+// reprocessed from the start.
+func (c *Client) Requeue(ctx context.Context, job tracker.Job, end time.Time, force bool) error {
+	form := jobForm(job, end)
+	if force {
+		form.Set("force", "true")
+	}
+	_, err := c.post(ctx, "/admin/requeue", form)
+	return err
+}
+
+// Backfill plans jobs for every date from the job's date to end, ordered
+// by the manager's backfill policy.  Approve is required for backfills whose
+// estimated cost exceeds the manager's approval threshold.
+func (c *Client) Backfill(ctx context.Context, job tracker.Job, end time.Time, approve bool) error {
+	form := jobForm(job, end)
+	if approve {
+		form.Set("approve", "true")
+	}
+	_, err := c.post(ctx, "/admin/backfill", form)
+	return err
+}
+
+// BackfillEstimate returns the estimated cost of a backfill from the job's
+// date to end, without planning it.  Returns ErrNotFound if the manager
+// doesn't estimate backfills.
+func (c *Client) BackfillEstimate(ctx context.Context, job tracker.Job, end time.Time) (backfill.Estimate, error) {
+	e := backfill.Estimate{}
+	err := c.get(ctx, "/admin/backfill-estimate", jobForm(job, end), &e)
+	return e, err
+}
+
+// BackfillPlan returns the planned backfill jobs, in dispatch order.
+func (c *Client) BackfillPlan(ctx context.Context) ([]backfill.Item, error) {
+	plan := []backfill.Item{}
+	err := c.get(ctx, "/admin/backfill-plan", nil, &plan)
+	return plan, err
+}
+
+// Cancel cancels the job, recording the reason.
+func (c *Client) Cancel(ctx context.Context, job tracker.Job, reason string) error {
+	form := jobForm(job, time.Time{})
+	form.Set("reason", reason)
+	_, err := c.post(ctx, "/admin/cancel", form)
+	return err
+}
+
+// SetSkip adds the job to the skip list, or removes it.
+func (c *Client) SetSkip(ctx context.Context, job tracker.Job, skip bool) error {
+	form := jobForm(job, time.Time{})
+	if !skip {
+		form.Set("remove", "true")
+	}
+	_, err := c.post(ctx, "/admin/skip", form)
+	return err
+}
+
+// SkipList returns the jobs that are not dispatched.
+func (c *Client) SkipList(ctx context.Context) ([]tracker.Job, error) {
+	jobs := []tracker.Job{}
+	err := c.get(ctx, "/admin/skiplist", nil, &jobs)
+	return jobs, err
+}
+
+// ForceComplete marks the job complete.
+func (c *Client) ForceComplete(ctx context.Context, job tracker.Job) error {
+	_, err := c.post(ctx, "/admin/force-complete", jobForm(job, time.Time{}))
+	return err
+}
+
+// Pause pauses new actions for the experiment/datatype, or for all jobs if
+// either is empty.
+func (c *Client) Pause(ctx context.Context, experiment, datatype string) error {
+	return c.pauseOrResume(ctx, "/admin/pause", experiment, datatype)
+}
+
+// Resume resumes new actions for the experiment/datatype, or for all jobs
+// if either is empty.
+func (c *Client) Resume(ctx context.Context, experiment, datatype string) error {
+	return c.pauseOrResume(ctx, "/admin/resume", experiment, datatype)
+}
+
+func (c *Client) pauseOrResume(ctx context.Context, path, experiment, datatype string) error {
+	form := url.Values{}
+	if experiment != "" && datatype != "" {
+		form.Set("experiment", experiment)
+		form.Set("datatype", datatype)
+	}
+	_, err := c.post(ctx, path, form)
+	return err
+}
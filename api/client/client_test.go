@@ -0,0 +1,138 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/admin"
+	"github.com/m-lab/etl-gardener/api/client"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+type fakeMonitor struct {
+	paused   bool
+	canceled []string
+	requeued []tracker.Job
+}
+
+func (m *fakeMonitor) Cancel(ctx context.Context, j tracker.Job, reason string) error {
+	m.canceled = append(m.canceled, j.Key()+" "+reason)
+	return nil
+}
+func (m *fakeMonitor) Reprocess(ctx context.Context, j tracker.Job, reason string) error {
+	return nil
+}
+func (m *fakeMonitor) Requeue(ctx context.Context, j tracker.Job) error {
+	m.requeued = append(m.requeued, j)
+	return nil
+}
+func (m *fakeMonitor) Pause()                        { m.paused = true }
+func (m *fakeMonitor) Resume()                       { m.paused = false }
+func (m *fakeMonitor) PauseDatatype(exp, dt string)  {}
+func (m *fakeMonitor) ResumeDatatype(exp, dt string) {}
+func (m *fakeMonitor) ReleaseHold(j tracker.Job, user string) error {
+	return nil
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	monitor := &fakeMonitor{}
+	dispatch := []tracker.Job{tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))}
+
+	mux := http.NewServeMux()
+	tracker.NewHandler(tk).Register(mux)
+	mux.HandleFunc("/jobs.json", tk.JobsHandler)
+	mux.HandleFunc("/status.json", tk.SummaryHandler)
+	mux.HandleFunc("/job", func(resp http.ResponseWriter, req *http.Request) {
+		if len(dispatch) == 0 {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		jt, err := dispatch[0].Target("mlab-testing.tmp_ndt.ndt7")
+		rtx.Must(err, "target")
+		rtx.Must(tk.AddJob(dispatch[0]), "add")
+		dispatch = dispatch[1:]
+		b, err := json.Marshal(jt)
+		rtx.Must(err, "marshal")
+		resp.Write(b)
+	})
+	h := admin.NewHandler(map[string]string{"secret": "alice"}, tk, monitor, nil, nil)
+	h.SetRequeuer(monitor)
+	h.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	base, err := url.Parse(server.URL)
+	rtx.Must(err, "parse")
+	c := client.New(*base, "secret")
+
+	// Parser calls.
+	jt, err := c.NextJob(ctx)
+	rtx.Must(err, "NextJob")
+	if jt.Job.Date.Day() != 1 || jt.TargetTable.Table != "ndt7" {
+		t.Error("Wrong job", jt)
+	}
+	if _, err := c.NextJob(ctx); !errors.Is(err, client.ErrUnavailable) {
+		t.Error("Expected ErrUnavailable", err)
+	}
+	rtx.Must(c.Heartbeat(ctx, jt.Job), "Heartbeat")
+	rtx.Must(c.Update(ctx, jt.Job, tracker.Parsing, "started", "v2.4.0"), "Update")
+	unknown := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 2, 0, 0, 0, 0, time.UTC))
+	if err := c.Heartbeat(ctx, unknown); !errors.Is(err, client.ErrUnknownJob) {
+		t.Error("Expected ErrUnknownJob", err)
+	}
+
+	// Status calls.
+	jobs, err := c.Jobs(ctx, client.JobFilter{Experiment: "ndt", State: tracker.Parsing})
+	rtx.Must(err, "Jobs")
+	if len(jobs) != 1 || jobs[0].Job != jt.Job || jobs[0].Status.Version != "v2.4.0" {
+		t.Error("Wrong jobs", jobs)
+	}
+	if jobs, err := c.Jobs(ctx, client.JobFilter{Datatype: "annotation"}); err != nil || len(jobs) != 0 {
+		t.Error("Expected no jobs", jobs, err)
+	}
+	rtx.Must(c.Error(ctx, jt.Job, "bad archive"), "Error")
+	s, err := c.Summary(ctx)
+	rtx.Must(err, "Summary")
+	if s.Counts[tracker.ParseError] != 1 {
+		t.Error("Wrong summary", s)
+	}
+
+	// Admin calls.
+	rtx.Must(c.Requeue(ctx, unknown, unknown.Date.AddDate(0, 0, 2), false), "Requeue")
+	if len(monitor.requeued) != 3 || monitor.requeued[0] != unknown {
+		t.Error("Expected 3 requeued jobs", monitor.requeued)
+	}
+	if _, err := c.BackfillEstimate(ctx, unknown, unknown.Date.AddDate(0, 0, 2)); !errors.Is(err, client.ErrNotFound) {
+		t.Error("Expected ErrNotFound without a backfill planner", err)
+	}
+	rtx.Must(c.Cancel(ctx, unknown, "stuck"), "Cancel")
+	if len(monitor.canceled) != 1 || monitor.canceled[0] != unknown.Key()+" stuck (by alice)" {
+		t.Error("Wrong cancel", monitor.canceled)
+	}
+	rtx.Must(c.Pause(ctx, "", ""), "Pause")
+	if !monitor.paused {
+		t.Error("Expected pause")
+	}
+	// There is no skipper, so the skip list is empty, and skips fail.
+	if list, err := c.SkipList(ctx); err != nil || len(list) != 0 {
+		t.Error("Expected empty skip list", list, err)
+	}
+	if err := c.SetSkip(ctx, unknown, true); !errors.Is(err, client.ErrRequestFailed) {
+		t.Error("Expected ErrRequestFailed", err)
+	}
+
+	c.Key = "wrong"
+	if err := c.Resume(ctx, "", ""); !errors.Is(err, client.ErrRequestFailed) || !monitor.paused {
+		t.Error("Expected unauthorized resume to fail", err)
+	}
+}
@@ -0,0 +1,130 @@
+// Package backfill plans the order in which historical dates are
+// reprocessed, using the size of each date's archive, so that the largest
+// dates can be held back until BigQuery slots are otherwise idle, e.g. at
+// night.
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+
+	"github.com/m-lab/etl-gardener/cloud/gcs"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// ErrInvalidPolicy is returned for an unknown order, or invalid idle hours.
+var ErrInvalidPolicy = errors.New("invalid backfill policy")
+
+// Orders in which planned jobs are dispatched.
+const (
+	ByDate   = "date"     // Oldest date first.
+	Largest  = "largest"  // Largest archive first.
+	Smallest = "smallest" // Smallest archive first.
+)
+
+// Sizer returns the size of a job's archive, in bytes.
+type Sizer func(ctx context.Context, job tracker.Job) (int64, error)
+
+// GCSSizer returns a Sizer that lists each job's archive prefix with
+// gcs.Inventory.
+func GCSSizer(client stiface.Client) Sizer {
+	return func(ctx context.Context, job tracker.Job) (int64, error) {
+		inv, err := gcs.Inventory(ctx, client, job)
+		return inv.Bytes, err
+	}
+}
+
+// Item is a planned job, with the size of its archive.
+type Item struct {
+	Job   tracker.Job
+	Bytes int64
+}
+
+// Policy determines the order of planned jobs, and when large jobs may be
+// dispatched.
+type Policy struct {
+	Order string
+	// LargeBytes is the archive size at and above which a job is large.
+	// Zero means no job is large.
+	LargeBytes int64
+	// Large jobs are only dispatched from IdleStart to IdleEnd, in UTC
+	// hours.  The window may wrap past midnight, e.g. 22 to 6.  If they
+	// are equal, large jobs are dispatched at any time.
+	IdleStart, IdleEnd int
+}
+
+// NewPolicy returns the policy for the config.  The order defaults to
+// ByDate.
+func NewPolicy(cfg config.BackfillConfig) (Policy, error) {
+	p := Policy{Order: cfg.Order, LargeBytes: cfg.LargeBytes,
+		IdleStart: cfg.IdleStartHour, IdleEnd: cfg.IdleEndHour}
+	switch p.Order {
+	case "":
+		p.Order = ByDate
+	case ByDate, Largest, Smallest:
+	default:
+		return Policy{}, fmt.Errorf("%w: unknown order %q", ErrInvalidPolicy, p.Order)
+	}
+	if p.LargeBytes < 0 || p.IdleStart < 0 || p.IdleStart > 23 || p.IdleEnd < 0 || p.IdleEnd > 23 {
+		return Policy{}, fmt.Errorf("%w: %+v", ErrInvalidPolicy, cfg)
+	}
+	return p, nil
+}
+
+// Large returns true if the item's archive is large.
+func (p Policy) Large(item Item) bool {
+	return p.LargeBytes > 0 && item.Bytes >= p.LargeBytes
+}
+
+// Idle returns true if now is within the idle window.
+func (p Policy) Idle(now time.Time) bool {
+	h := now.UTC().Hour()
+	switch {
+	case p.IdleStart == p.IdleEnd:
+		return true
+	case p.IdleStart < p.IdleEnd:
+		return h >= p.IdleStart && h < p.IdleEnd
+	default:
+		return h >= p.IdleStart || h < p.IdleEnd
+	}
+}
+
+// Next returns the index of the first item that may be dispatched at now,
+// or -1 if every item is large and now is outside the idle window.
+func (p Policy) Next(items []Item, now time.Time) int {
+	idle := p.Idle(now)
+	for i, item := range items {
+		if idle || !p.Large(item) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Plan sizes the jobs, and returns them in the policy's order.  Jobs of the
+// same size keep their relative order.
+func (p Policy) Plan(ctx context.Context, sizer Sizer, jobs []tracker.Job) ([]Item, error) {
+	items := make([]Item, 0, len(jobs))
+	for _, j := range jobs {
+		n, err := sizer(ctx, j)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", j, err)
+		}
+		items = append(items, Item{Job: j, Bytes: n})
+	}
+	switch p.Order {
+	case Largest:
+		sort.SliceStable(items, func(i, j int) bool { return items[i].Bytes > items[j].Bytes })
+	case Smallest:
+		sort.SliceStable(items, func(i, j int) bool { return items[i].Bytes < items[j].Bytes })
+	default:
+		sort.SliceStable(items, func(i, j int) bool { return items[i].Job.Date.Before(items[j].Job.Date) })
+	}
+	return items, nil
+}
@@ -0,0 +1,90 @@
+package backfill_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/backfill"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func date(day int) time.Time {
+	return time.Date(2020, 6, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestPlan(t *testing.T) {
+	sizes := map[int]int64{1: 10, 2: 300, 3: 20, 4: 300}
+	sizer := func(ctx context.Context, j tracker.Job) (int64, error) {
+		return sizes[j.Date.Day()], nil
+	}
+	jobs := []tracker.Job{}
+	for _, d := range []int{4, 1, 2, 3} {
+		jobs = append(jobs, tracker.NewJob("bucket", "ndt", "ndt7", date(d)))
+	}
+	tests := []struct {
+		order string
+		want  []int
+	}{
+		{"", []int{1, 2, 3, 4}},
+		{"largest", []int{4, 2, 3, 1}},
+		{"smallest", []int{1, 3, 4, 2}},
+	}
+	for _, tt := range tests {
+		p, err := backfill.NewPolicy(config.BackfillConfig{Order: tt.order})
+		rtx.Must(err, "NewPolicy failed")
+		items, err := p.Plan(context.Background(), sizer, jobs)
+		rtx.Must(err, "Plan failed")
+		for i, item := range items {
+			if item.Job.Date.Day() != tt.want[i] || item.Bytes != sizes[tt.want[i]] {
+				t.Errorf("%q: wrong item %d: %+v", tt.order, i, item)
+			}
+		}
+	}
+
+	failing := func(ctx context.Context, j tracker.Job) (int64, error) {
+		return 0, errors.New("listing failed")
+	}
+	if _, err := (backfill.Policy{}).Plan(context.Background(), failing, jobs); err == nil {
+		t.Error("Expected a sizing error")
+	}
+}
+
+func TestNext(t *testing.T) {
+	p, err := backfill.NewPolicy(config.BackfillConfig{
+		Order: "largest", LargeBytes: 100, IdleStartHour: 22, IdleEndHour: 6})
+	rtx.Must(err, "NewPolicy failed")
+	items := []backfill.Item{
+		{Job: tracker.NewJob("bucket", "ndt", "ndt7", date(2)), Bytes: 300},
+		{Job: tracker.NewJob("bucket", "ndt", "ndt7", date(1)), Bytes: 10},
+	}
+	night := time.Date(2020, 7, 1, 23, 0, 0, 0, time.UTC)
+	early := time.Date(2020, 7, 1, 5, 0, 0, 0, time.UTC)
+	day := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+	if p.Next(items, night) != 0 || p.Next(items, early) != 0 {
+		t.Error("Large jobs should run in the idle window")
+	}
+	if p.Next(items, day) != 1 {
+		t.Error("Large jobs should wait for the idle window")
+	}
+	if p.Next(items[:1], day) != -1 {
+		t.Error("Expected no job outside the idle window")
+	}
+	if (backfill.Policy{}).Next(items, day) != 0 {
+		t.Error("The zero policy has no large jobs")
+	}
+}
+
+func TestNewPolicy(t *testing.T) {
+	for _, cfg := range []config.BackfillConfig{
+		{Order: "random"}, {LargeBytes: -1}, {IdleStartHour: 24}, {IdleEndHour: -1},
+	} {
+		if _, err := backfill.NewPolicy(cfg); !errors.Is(err, backfill.ErrInvalidPolicy) {
+			t.Errorf("Expected ErrInvalidPolicy for %+v, got %v", cfg, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package backfill
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// DefaultSlotSecondsPerGB is a rough slot cost of the dedup queries.  It
+// should be calibrated against the slot time of recent dedups.
+const DefaultSlotSecondsPerGB = 10.0
+
+// Estimator returns the bytes a job's dedup query would process.
+type Estimator func(ctx context.Context, job tracker.Job) (int64, error)
+
+// DedupEstimator returns an Estimator that dry runs each job's dedup query,
+// with the source's dedup strategy, using bq.TableOps.EstimateDedup.
+func DedupEstimator(client bqiface.Client, project string, naming bq.Naming, sources []config.SourceConfig) Estimator {
+	strategies := make(map[string]string, len(sources))
+	for _, s := range sources {
+		strategies[s.Experiment+"/"+s.Datatype] = s.Dedup
+	}
+	return func(ctx context.Context, job tracker.Job) (int64, error) {
+		to, err := bq.NewTableOpsWithClientAndNaming(client, job, project, "", naming)
+		if err != nil {
+			return 0, err
+		}
+		to.DedupStrategy = strategies[job.Experiment+"/"+job.Datatype]
+		return to.EstimateDedup(ctx)
+	}
+}
+
+// Estimate is the projected cost of a backfill.
+type Estimate struct {
+	Jobs    int    // Number of jobs in the backfill.
+	Sampled []Item // Sampled jobs, with the bytes their dedup would process.
+	// Bytes is the projected total bytes processed, i.e. the mean of the
+	// sample times the number of jobs.
+	Bytes     int64
+	SlotHours float64
+	// NeedsApproval is true if Bytes exceeds the approval threshold.
+	NeedsApproval bool
+}
+
+// String summarizes the estimate, e.g. for audit entries.
+func (e Estimate) String() string {
+	return fmt.Sprintf("estimated %d bytes, %.1f slot hours, from %d of %d jobs",
+		e.Bytes, e.SlotHours, len(e.Sampled), e.Jobs)
+}
+
+// CostModel estimates the cost of backfills by dry running a sample of
+// their jobs.
+type CostModel struct {
+	Estimator        Estimator
+	Sample           int // Number of jobs to dry run.
+	SlotSecondsPerGB float64
+	// ApprovalBytes is the estimate above which a backfill needs approval.
+	// Zero means never.
+	ApprovalBytes int64
+}
+
+// NewCostModel returns the cost model for the config.  The slot cost
+// defaults to DefaultSlotSecondsPerGB.
+func NewCostModel(cfg config.BackfillConfig, est Estimator) (*CostModel, error) {
+	if cfg.EstimateSample <= 0 || cfg.SlotSecondsPerGB < 0 || cfg.ApprovalBytes < 0 {
+		return nil, fmt.Errorf("%w: %+v", ErrInvalidPolicy, cfg)
+	}
+	m := &CostModel{Estimator: est, Sample: cfg.EstimateSample,
+		SlotSecondsPerGB: cfg.SlotSecondsPerGB, ApprovalBytes: cfg.ApprovalBytes}
+	if m.SlotSecondsPerGB == 0 {
+		m.SlotSecondsPerGB = DefaultSlotSecondsPerGB
+	}
+	return m, nil
+}
+
+// Estimate dry runs up to Sample jobs, evenly spaced through the list, and
+// projects their mean over all the jobs.
+func (m *CostModel) Estimate(ctx context.Context, jobs []tracker.Job) (Estimate, error) {
+	e := Estimate{Jobs: len(jobs), Sampled: []Item{}}
+	n := m.Sample
+	if n > len(jobs) {
+		n = len(jobs)
+	}
+	var sum int64
+	for i := 0; i < n; i++ {
+		j := jobs[i*len(jobs)/n]
+		b, err := m.Estimator(ctx, j)
+		if err != nil {
+			return Estimate{}, fmt.Errorf("%v: %w", j, err)
+		}
+		e.Sampled = append(e.Sampled, Item{Job: j, Bytes: b})
+		sum += b
+	}
+	if n > 0 {
+		e.Bytes = int64(float64(sum) / float64(n) * float64(len(jobs)))
+	}
+	e.SlotHours = float64(e.Bytes) / 1e9 * m.SlotSecondsPerGB / 3600
+	e.NeedsApproval = m.ApprovalBytes > 0 && e.Bytes > m.ApprovalBytes
+	return e, nil
+}
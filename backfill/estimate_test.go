@@ -0,0 +1,92 @@
+package backfill_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/backfill"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestEstimate(t *testing.T) {
+	sampled := []int{}
+	est := func(ctx context.Context, j tracker.Job) (int64, error) {
+		sampled = append(sampled, j.Date.Day())
+		return int64(j.Date.Day()) * 1e9, nil
+	}
+	jobs := []tracker.Job{}
+	for d := 1; d <= 10; d++ {
+		jobs = append(jobs, tracker.NewJob("bucket", "ndt", "ndt7", date(d)))
+	}
+	m, err := backfill.NewCostModel(config.BackfillConfig{
+		EstimateSample: 3, ApprovalBytes: 40e9}, est)
+	rtx.Must(err, "NewCostModel failed")
+
+	e, err := m.Estimate(context.Background(), jobs)
+	rtx.Must(err, "Estimate failed")
+	// Days 1, 4 and 7 average 4GB, projected over 10 jobs.
+	if len(sampled) != 3 || sampled[0] != 1 || sampled[1] != 4 || sampled[2] != 7 {
+		t.Error("Wrong sample", sampled)
+	}
+	if e.Jobs != 10 || len(e.Sampled) != 3 || e.Bytes != 40e9 || e.NeedsApproval {
+		t.Errorf("Wrong estimate %+v", e)
+	}
+	if want := 40 * backfill.DefaultSlotSecondsPerGB / 3600; e.SlotHours != want {
+		t.Error("Wrong slot hours", e.SlotHours, want)
+	}
+
+	// Fewer jobs than the sample.
+	sampled = []int{}
+	e, err = m.Estimate(context.Background(), jobs[9:])
+	rtx.Must(err, "Estimate failed")
+	if len(sampled) != 1 || e.Bytes != 10e9 {
+		t.Errorf("Wrong estimate %+v", e)
+	}
+	e, err = m.Estimate(context.Background(), jobs[4:])
+	rtx.Must(err, "Estimate failed")
+	if !e.NeedsApproval {
+		t.Errorf("Expected approval for %+v", e)
+	}
+	if e, err := m.Estimate(context.Background(), nil); err != nil || e.Bytes != 0 {
+		t.Errorf("Wrong empty estimate %+v %v", e, err)
+	}
+
+	m.Estimator = func(ctx context.Context, j tracker.Job) (int64, error) {
+		return 0, errors.New("dry run failed")
+	}
+	if _, err := m.Estimate(context.Background(), jobs); err == nil {
+		t.Error("Expected an estimate error")
+	}
+}
+
+func TestNewCostModel(t *testing.T) {
+	for _, cfg := range []config.BackfillConfig{
+		{}, {EstimateSample: -1}, {EstimateSample: 1, SlotSecondsPerGB: -1}, {EstimateSample: 1, ApprovalBytes: -1},
+	} {
+		if _, err := backfill.NewCostModel(cfg, nil); !errors.Is(err, backfill.ErrInvalidPolicy) {
+			t.Errorf("Expected ErrInvalidPolicy for %+v, got %v", cfg, err)
+		}
+	}
+}
+
+func TestDedupEstimator(t *testing.T) {
+	c := bqfake.NewClient("fake-project")
+	c.AddResult("ROW_NUMBER", bqfake.Result{Stats: &bigquery.JobStatistics{TotalBytesProcessed: 500}})
+	est := backfill.DedupEstimator(c, "fake-project", bq.DefaultNaming,
+		[]config.SourceConfig{{Experiment: "ndt", Datatype: "ndt7", Dedup: bq.DedupOverwrite}})
+	n, err := est(context.Background(), tracker.NewJob("bucket", "ndt", "ndt7", date(1)))
+	rtx.Must(err, "estimate failed")
+	if n != 500 {
+		t.Error("Wrong estimate", n)
+	}
+	if runs := c.QueryRuns(); len(runs) != 1 || !runs[0].DryRun {
+		t.Error("Expected a dry run", runs)
+	}
+}
@@ -0,0 +1,223 @@
+// Package callbacks invokes external HTTP callbacks when jobs finish
+// configured pipeline stages, so that downstream systems, e.g. a stats
+// pipeline or a cache purger, can react to new data without changes to the
+// gardener.  Each callback is a signed JSON POST of the job and its status.
+package callbacks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// ErrInvalidConfig is returned by New for callbacks without a name, URL,
+// secret or stages.
+var ErrInvalidConfig = errors.New("invalid callback config")
+
+// SignatureHeader holds the hex HMAC-SHA256 of the request body, keyed by
+// the callback's secret, as "sha256=<hex>".
+const SignatureHeader = "X-Gardener-Signature"
+
+// queueSize limits the callbacks waiting to be sent.  Further callbacks
+// are dropped.
+const queueSize = 1000
+
+// Payload is the JSON body of each callback.  Stage is the state that the
+// job finished, or Complete when the job completes.  Time is when the
+// callback was queued, so that receivers can reject replays.
+type Payload struct {
+	Callback string
+	Stage    tracker.State
+	Time     time.Time
+	Job      tracker.Job
+	Status   tracker.Status
+}
+
+// callback is a configured callback.
+type callback struct {
+	name       string
+	url        string
+	secret     []byte
+	experiment string // Empty matches all experiments.
+	datatype   string // Empty matches all datatypes.
+	stages     map[tracker.State]bool
+}
+
+// delivery is a queued callback.
+type delivery struct {
+	cb   *callback
+	body []byte
+}
+
+// Sender queues the callbacks of job transitions, and sends them with Run,
+// so that the tracker is not delayed by slow endpoints.
+type Sender struct {
+	callbacks []*callback
+	queue     chan delivery
+
+	Client *http.Client
+	// Retries is the number of retries of each failed callback.
+	Retries int
+	// Backoff is the delay before the first retry.  It doubles for each
+	// later retry.
+	Backoff time.Duration
+	// Timeout limits each attempt.
+	Timeout time.Duration
+}
+
+// New creates a Sender for the configured callbacks.  URLs are read from the
+// environment variables named by URLEnv, if set, and secrets from those
+// named by SecretEnv, so that they don't appear in the config.
+func New(configs []config.CallbackConfig) (*Sender, error) {
+	s := &Sender{queue: make(chan delivery, queueSize), Client: http.DefaultClient,
+		Retries: 3, Backoff: 10 * time.Second, Timeout: 30 * time.Second}
+	names := map[string]bool{}
+	for _, c := range configs {
+		u := c.URL
+		if c.URLEnv != "" {
+			u = os.Getenv(c.URLEnv)
+		}
+		secret := os.Getenv(c.SecretEnv)
+		if c.Name == "" || names[c.Name] || u == "" || secret == "" || len(c.Stages) == 0 {
+			return nil, fmt.Errorf("%w: %q requires a unique name, a url or url_env, a secret in secret_env, and stages",
+				ErrInvalidConfig, c.Name)
+		}
+		names[c.Name] = true
+		cb := &callback{name: c.Name, url: u, secret: []byte(secret), experiment: c.Experiment,
+			datatype: c.Datatype, stages: map[tracker.State]bool{}}
+		for _, stage := range c.Stages {
+			cb.stages[tracker.State(stage)] = true
+		}
+		s.callbacks = append(s.callbacks, cb)
+	}
+	return s, nil
+}
+
+// Sign returns the signature of the body, as sent in SignatureHeader.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// finished returns the stages that the transition finished.  A stage is
+// finished when the job leaves it for any state but Cancelling or Failed,
+// and Complete when the job completes.
+func finished(s tracker.Status) []tracker.State {
+	if state := s.State(); state == tracker.Cancelling || state == tracker.Failed || len(s.History) < 2 {
+		return nil
+	}
+	stages := []tracker.State{s.Prev()}
+	if s.State() == tracker.Complete {
+		stages = append(stages, tracker.Complete)
+	}
+	return stages
+}
+
+// Observe is an events.Handler that queues a callback for each callback
+// with a stage that the transition finished.  If it finished more than one,
+// e.g. the last stage and Complete, the payload's Stage is the last.
+// Callbacks are dropped if the queue is full.
+func (s *Sender) Observe(j tracker.Job, st tracker.Status) {
+	stages := finished(st)
+	for _, cb := range s.callbacks {
+		if (cb.experiment != "" && cb.experiment != j.Experiment) ||
+			(cb.datatype != "" && cb.datatype != j.Datatype) {
+			continue
+		}
+		var stage tracker.State
+		for _, f := range stages {
+			if cb.stages[f] {
+				stage = f
+			}
+		}
+		if stage == "" {
+			continue
+		}
+		body, err := json.Marshal(Payload{Callback: cb.name, Stage: stage, Time: time.Now().UTC(), Job: j, Status: st})
+		if err != nil {
+			log.Println("Callback", cb.name, "failed to encode", j, err)
+			metrics.CallbackDeliveries.WithLabelValues(cb.name, "error").Inc()
+			continue
+		}
+		select {
+		case s.queue <- delivery{cb: cb, body: body}:
+		default:
+			log.Println("Callback queue full, dropping", cb.name, "for", j)
+			metrics.CallbackDeliveries.WithLabelValues(cb.name, "dropped").Inc()
+		}
+	}
+}
+
+// send posts the body, with retries, and returns the last error.
+func (s *Sender) send(ctx context.Context, d delivery) error {
+	backoff := s.Backoff
+	var err error
+	for try := 0; try <= s.Retries; try++ {
+		if try > 0 {
+			metrics.CallbackDeliveries.WithLabelValues(d.cb.name, "retried").Inc()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		if err = s.post(ctx, d); err == nil {
+			return nil
+		}
+		log.Println("Callback", d.cb.name, "failed:", err)
+	}
+	return err
+}
+
+// post makes a single attempt, and returns an error for non 2xx responses.
+func (s *Sender) post(ctx context.Context, d delivery) error {
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, d.cb.url, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(d.cb.secret, d.body))
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback POST failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// Run sends the queued callbacks, in order, until ctx is done.
+func (s *Sender) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-s.queue:
+			if err := s.send(ctx, d); err != nil {
+				metrics.CallbackDeliveries.WithLabelValues(d.cb.name, "error").Inc()
+				continue
+			}
+			metrics.CallbackDeliveries.WithLabelValues(d.cb.name, "delivered").Inc()
+		}
+	}
+}
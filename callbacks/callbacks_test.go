@@ -0,0 +1,117 @@
+package callbacks_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/callbacks"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestNew(t *testing.T) {
+	os.Setenv("CALLBACK_SECRET", "secret")
+	defer os.Unsetenv("CALLBACK_SECRET")
+	for _, c := range []config.CallbackConfig{
+		{URL: "http://x", SecretEnv: "CALLBACK_SECRET", Stages: []string{"complete"}},
+		{Name: "stats", SecretEnv: "CALLBACK_SECRET", Stages: []string{"complete"}},
+		{Name: "stats", URL: "http://x", Stages: []string{"complete"}},
+		{Name: "stats", URL: "http://x", SecretEnv: "MISSING_SECRET", Stages: []string{"complete"}},
+		{Name: "stats", URL: "http://x", SecretEnv: "CALLBACK_SECRET"},
+	} {
+		if _, err := callbacks.New([]config.CallbackConfig{c}); !errors.Is(err, callbacks.ErrInvalidConfig) {
+			t.Errorf("Expected ErrInvalidConfig for %+v: %v", c, err)
+		}
+	}
+	c := config.CallbackConfig{Name: "stats", URL: "http://x", SecretEnv: "CALLBACK_SECRET", Stages: []string{"complete"}}
+	if _, err := callbacks.New([]config.CallbackConfig{c, c}); !errors.Is(err, callbacks.ErrInvalidConfig) {
+		t.Error("Expected ErrInvalidConfig for duplicate names", err)
+	}
+}
+
+func TestSender(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var lock sync.Mutex
+	received := []callbacks.Payload{}
+	fails := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		rtx.Must(err, "ReadAll")
+		if r.Header.Get(callbacks.SignatureHeader) != callbacks.Sign([]byte("secret"), body) {
+			t.Error("Wrong signature", r.Header.Get(callbacks.SignatureHeader))
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if fails > 0 {
+			fails--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		p := callbacks.Payload{}
+		rtx.Must(json.Unmarshal(body, &p), "Unmarshal")
+		received = append(received, p)
+	}))
+	defer srv.Close()
+
+	os.Setenv("CALLBACK_SECRET", "secret")
+	defer os.Unsetenv("CALLBACK_SECRET")
+	s, err := callbacks.New([]config.CallbackConfig{
+		{Name: "stats", URL: srv.URL, SecretEnv: "CALLBACK_SECRET", Experiment: "ndt",
+			Stages: []string{string(tracker.Copying), string(tracker.Complete)}},
+	})
+	rtx.Must(err, "New")
+	s.Backoff = time.Millisecond
+
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, time.Hour)
+	rtx.Must(err, "InitTracker")
+	tk.AddObserver(s.Observe)
+	go s.Run(ctx)
+
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	j := tracker.NewJob("bucket", "ndt", "ndt7", date)
+	rtx.Must(tk.AddJob(j), "AddJob")
+	for _, state := range []tracker.State{tracker.Parsing, tracker.Copying, tracker.Deleting, tracker.Complete} {
+		rtx.Must(tk.SetStatus(j, state, ""), "SetStatus")
+	}
+	// Failures and other experiments don't fire callbacks.
+	other := tracker.NewJob("bucket", "ndt", "pcap", date)
+	rtx.Must(tk.AddJob(other), "AddJob")
+	rtx.Must(tk.SetStatus(other, tracker.Copying, ""), "SetStatus")
+	rtx.Must(tk.SetStatus(other, tracker.Failed, "bad"), "SetStatus")
+	host := tracker.NewJob("bucket", "host", "nodeinfo", date)
+	rtx.Must(tk.AddJob(host), "AddJob")
+	rtx.Must(tk.SetStatus(host, tracker.Copying, ""), "SetStatus")
+	rtx.Must(tk.SetStatus(host, tracker.Complete, ""), "SetStatus")
+
+	for i := 0; i < 500; i++ {
+		lock.Lock()
+		n := len(received)
+		lock.Unlock()
+		if n >= 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(received) != 2 {
+		t.Fatal("Expected 2 callbacks", received)
+	}
+	if received[0].Stage != tracker.Copying || received[0].Job != j || received[0].Status.State() != tracker.Deleting {
+		t.Errorf("Wrong copy callback %+v", received[0])
+	}
+	if received[1].Stage != tracker.Complete || received[1].Callback != "stats" || received[1].Status.State() != tracker.Complete {
+		t.Errorf("Wrong complete callback %+v", received[1])
+	}
+}
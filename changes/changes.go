@@ -0,0 +1,174 @@
+// Package changes records the raw table partitions that gardener rewrites,
+// and publishes each change, so that downstream caches and materialized
+// rollups know which partitions to recompute.
+package changes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// DefaultRetention is how long changes are served, if no retention is set.
+const DefaultRetention = 30 * 24 * time.Hour
+
+// maxQueued limits the changes waiting to be published.
+const maxQueued = 1000
+
+// Change is a rewrite of a table partition.
+type Change struct {
+	Experiment string
+	Datatype   string
+	Date       string // YYYY-MM-DD
+	// Prefix is the job prefix of a partial job, which rewrote only the
+	// prefix's rows.
+	Prefix       string `json:",omitempty"`
+	Table        string // project.dataset.table
+	LastModified time.Time
+}
+
+// A Publisher publishes an encoded Change, e.g. to a Pub/Sub topic.
+type Publisher interface {
+	Publish(ctx context.Context, data []byte) error
+}
+
+type key struct {
+	table, date, prefix string
+}
+
+// Feed holds the most recent change of each partition, and publishes each
+// change, if there is a Publisher.
+type Feed struct {
+	retention time.Duration
+	publisher Publisher // May be nil.  Static after SetPublisher.
+	queue     chan Change
+
+	lock    sync.Mutex
+	changes map[key]Change
+}
+
+// NewFeed creates a Feed that serves changes for retention.  A zero
+// retention uses DefaultRetention.
+func NewFeed(retention time.Duration) *Feed {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	return &Feed{retention: retention, queue: make(chan Change, maxQueued), changes: map[key]Change{}}
+}
+
+// SetPublisher publishes each change.  Should be called before Run.
+func (f *Feed) SetPublisher(p Publisher) {
+	f.publisher = p
+}
+
+// Record records that the job rewrote its partition of table at modified,
+// and queues the change for publication.  Changes are not published if the
+// queue is full.
+func (f *Feed) Record(j tracker.Job, table string, modified time.Time) {
+	c := Change{
+		Experiment:   j.Experiment,
+		Datatype:     j.Datatype,
+		Date:         j.Date.Format("2006-01-02"),
+		Prefix:       j.Prefix,
+		Table:        table,
+		LastModified: modified.UTC(),
+	}
+	f.lock.Lock()
+	f.changes[key{table: c.Table, date: c.Date, prefix: c.Prefix}] = c
+	f.prune(modified)
+	f.lock.Unlock()
+	if f.publisher == nil {
+		return
+	}
+	select {
+	case f.queue <- c:
+	default:
+		metrics.PartitionChanges.WithLabelValues(c.Experiment, c.Datatype, "dropped").Inc()
+	}
+}
+
+// prune removes the changes older than the retention.
+// Caller must hold the lock.
+func (f *Feed) prune(now time.Time) {
+	for k, c := range f.changes {
+		if now.Sub(c.LastModified) > f.retention {
+			delete(f.changes, k)
+		}
+	}
+}
+
+// Changes returns the changes of the experiment and datatype modified after
+// since, ordered by LastModified.  Empty experiment or datatype match all.
+func (f *Feed) Changes(experiment, datatype string, since time.Time) []Change {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result := []Change{}
+	for _, c := range f.changes {
+		if experiment != "" && c.Experiment != experiment ||
+			datatype != "" && c.Datatype != datatype ||
+			!c.LastModified.After(since) {
+			continue
+		}
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastModified.Before(result[j].LastModified)
+	})
+	return result
+}
+
+// Handler serves the changes for the optional "experiment", "datatype" and
+// "since" (RFC 3339) parameters as JSON.  Callers can poll with the
+// LastModified of the last change they processed as since.
+func (f *Feed) Handler(resp http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	since := time.Time{}
+	if s := q.Get("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(resp, "invalid since:", err)
+			return
+		}
+	}
+	b, err := json.Marshal(f.Changes(q.Get("experiment"), q.Get("datatype"), since))
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
+
+// Run publishes queued changes until ctx is done.  Failed publications are
+// logged and not retried, since the changes are also served by Handler.
+func (f *Feed) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c := <-f.queue:
+			b, err := json.Marshal(c)
+			if err == nil {
+				pctx, cancel := context.WithTimeout(ctx, time.Minute)
+				err = f.publisher.Publish(pctx, b)
+				cancel()
+			}
+			if err != nil {
+				log.Println("Partition change publish failed:", c, err)
+				metrics.PartitionChanges.WithLabelValues(c.Experiment, c.Datatype, "error").Inc()
+				continue
+			}
+			metrics.PartitionChanges.WithLabelValues(c.Experiment, c.Datatype, "published").Inc()
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package changes_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/changes"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+type fakePublisher struct {
+	err  error
+	sent chan []byte
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, data []byte) error {
+	p.sent <- data
+	return p.err
+}
+
+func TestFeed(t *testing.T) {
+	f := changes.NewFeed(48 * time.Hour)
+	now := time.Date(2020, 6, 10, 12, 0, 0, 0, time.UTC)
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	ndt7 := tracker.NewJob("bucket", "ndt", "ndt7", date)
+	ann := tracker.NewJob("bucket", "ndt", "annotation", date)
+
+	f.Record(ndt7, "mlab.raw_ndt.ndt7", now.Add(-72*time.Hour))
+	f.Record(ann, "mlab.raw_ndt.annotation", now.Add(-time.Hour))
+	f.Record(ndt7, "mlab.raw_ndt.ndt7", now.Add(-2*time.Hour))
+	f.Record(ndt7, "measurement-lab.ndt.ndt7", now)
+
+	all := f.Changes("", "", time.Time{})
+	if len(all) != 3 {
+		t.Fatal("Expected the latest change of each partition", all)
+	}
+	if all[0].Table != "mlab.raw_ndt.ndt7" || !all[0].LastModified.Equal(now.Add(-2*time.Hour)) ||
+		all[0].Date != "2020-06-01" {
+		t.Error("Wrong first change", all[0])
+	}
+	if got := f.Changes("ndt", "ndt7", now.Add(-time.Hour)); len(got) != 1 || got[0].Table != "measurement-lab.ndt.ndt7" {
+		t.Error("Wrong filtered changes", got)
+	}
+
+	// Old changes are pruned.
+	f.Record(ann, "mlab.raw_ndt.annotation", now.Add(72*time.Hour))
+	if got := f.Changes("", "", time.Time{}); len(got) != 1 {
+		t.Error("Expected old changes to be pruned", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	f := changes.NewFeed(0)
+	now := time.Now().UTC().Truncate(time.Second)
+	j := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	f.Record(j, "mlab.raw_ndt.ndt7", now)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		f.Handler(resp, httptest.NewRequest(http.MethodGet, "/changes.json?"+query, nil))
+		return resp
+	}
+	if resp := get("since=yesterday"); resp.Code != http.StatusBadRequest {
+		t.Error("Expected BadRequest", resp.Code)
+	}
+	resp := get("experiment=ndt&since=" + now.Add(-time.Minute).Format(time.RFC3339))
+	var got []changes.Change
+	rtx.Must(json.Unmarshal(resp.Body.Bytes(), &got), "Unmarshal")
+	if len(got) != 1 || got[0].Datatype != "ndt7" {
+		t.Error("Wrong changes", resp.Body.String())
+	}
+	resp = get("since=" + now.Format(time.RFC3339))
+	if resp.Body.String() != "[]" {
+		t.Error("Expected no changes", resp.Body.String())
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := &fakePublisher{err: errors.New("unavailable"), sent: make(chan []byte, 10)}
+	f := changes.NewFeed(0)
+	f.SetPublisher(p)
+	go f.Run(ctx)
+
+	j := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	f.Record(j, "mlab.raw_ndt.ndt7", time.Now())
+	select {
+	case b := <-p.sent:
+		var c changes.Change
+		rtx.Must(json.Unmarshal(b, &c), "Unmarshal")
+		if c.Experiment != "ndt" || c.Table != "mlab.raw_ndt.ndt7" {
+			t.Error("Wrong change", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Change not published")
+	}
+	// Failed publications don't affect the served changes.
+	if len(f.Changes("", "", time.Time{})) != 1 {
+		t.Error("Change should be served")
+	}
+}
@@ -0,0 +1,63 @@
+// Package civil does the date arithmetic of job dates.  A job date is a
+// UTC civil date, represented as a time.Time at UTC midnight.  Times in
+// other locations, e.g. as returned by Datastore, or with a time of day, are
+// first converted to the UTC date that contains them, so that a job near
+// midnight, or across a DST change, never lands on the neighbouring date.
+package civil
+
+import (
+	"time"
+)
+
+// Layout is the format of dates in job keys, URLs and queries.
+const Layout = "2006-01-02"
+
+// Date returns the UTC date containing t, at UTC midnight.
+func Date(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// IsDate returns true if t is already a date, i.e. UTC midnight.
+func IsDate(t time.Time) bool {
+	return t.Equal(Date(t)) && t.Location() == time.UTC
+}
+
+// AddDays returns the date n days after the date containing t.  N may be
+// negative.  Month and year boundaries, and leap days, are handled by
+// time.Date.
+func AddDays(t time.Time, n int) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d+n, 0, 0, 0, 0, time.UTC)
+}
+
+// Days returns the number of days from the date containing from to the
+// date containing to, which is negative if to is earlier.
+func Days(from, to time.Time) int {
+	// UTC days are all 24 hours long.
+	return int(Date(to).Sub(Date(from)) / (24 * time.Hour))
+}
+
+// Range returns the dates from the date containing start to the date
+// containing end, inclusive.  It is empty if end is before start.
+func Range(start, end time.Time) []time.Time {
+	n := Days(start, end) + 1
+	if n <= 0 {
+		return []time.Time{}
+	}
+	dates := make([]time.Time, 0, n)
+	for i := 0; i < n; i++ {
+		dates = append(dates, AddDays(start, i))
+	}
+	return dates
+}
+
+// Parse parses a date in the Layout, e.g. "2020-02-29".
+func Parse(s string) (time.Time, error) {
+	return time.Parse(Layout, s)
+}
+
+// Format formats the date containing t in the Layout.
+func Format(t time.Time) string {
+	return t.UTC().Format(Layout)
+}
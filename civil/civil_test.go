@@ -0,0 +1,142 @@
+package civil_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/civil"
+)
+
+func date(s string) time.Time {
+	d, err := civil.Parse(s)
+	rtx.Must(err, "parse")
+	return d
+}
+
+func TestDate(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	rtx.Must(err, "location")
+	tokyo := time.FixedZone("JST", 9*60*60)
+	tests := []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), "2020-06-01"},
+		{time.Date(2020, 6, 1, 23, 59, 59, 999999999, time.UTC), "2020-06-01"},
+		// The UTC date differs from the local date near midnight.
+		{time.Date(2020, 6, 1, 21, 0, 0, 0, ny), "2020-06-02"},
+		{time.Date(2020, 6, 1, 8, 0, 0, 0, tokyo), "2020-05-31"},
+		{time.Date(2020, 12, 31, 20, 0, 0, 0, ny), "2021-01-01"},
+		{time.Date(2021, 1, 1, 3, 0, 0, 0, tokyo), "2020-12-31"},
+		{time.Date(2020, 3, 1, 8, 59, 0, 0, tokyo), "2020-02-29"},
+		// DST changes in New York.
+		{time.Date(2020, 3, 8, 1, 30, 0, 0, ny), "2020-03-08"},
+		{time.Date(2020, 3, 8, 23, 30, 0, 0, ny), "2020-03-09"},
+		{time.Date(2020, 11, 1, 1, 30, 0, 0, ny), "2020-11-01"},
+		{time.Date(2020, 11, 1, 20, 0, 0, 0, ny), "2020-11-02"},
+	}
+	for _, tt := range tests {
+		got := civil.Date(tt.t)
+		if !civil.IsDate(got) || civil.Format(got) != tt.want || civil.Format(tt.t) != tt.want {
+			t.Errorf("Date(%v) = %v, want %s", tt.t, got, tt.want)
+		}
+		if !got.Equal(date(tt.want)) {
+			t.Errorf("Date(%v) = %v, want %v", tt.t, got, date(tt.want))
+		}
+	}
+	if civil.IsDate(time.Date(2020, 6, 1, 0, 0, 0, 0, tokyo)) || civil.IsDate(time.Date(2020, 6, 1, 1, 0, 0, 0, time.UTC)) {
+		t.Error("IsDate should be false")
+	}
+}
+
+func TestAddDays(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	rtx.Must(err, "location")
+	tests := []struct {
+		t    time.Time
+		n    int
+		want string
+	}{
+		{date("2020-06-01"), 0, "2020-06-01"},
+		{date("2020-06-30"), 1, "2020-07-01"},
+		{date("2020-12-31"), 1, "2021-01-01"},
+		{date("2021-01-01"), -1, "2020-12-31"},
+		{date("2020-02-28"), 1, "2020-02-29"},
+		{date("2020-02-29"), 1, "2020-03-01"},
+		{date("2020-03-01"), -1, "2020-02-29"},
+		{date("2019-02-28"), 1, "2019-03-01"},
+		{date("2100-02-28"), 1, "2100-03-01"}, // Not a leap year.
+		{date("2000-02-28"), 1, "2000-02-29"}, // A leap year.
+		{date("2020-02-29"), 366, "2021-03-01"},
+		{date("2019-01-01"), 730, "2020-12-31"},
+		// Time of day and location are dropped.
+		{time.Date(2020, 6, 1, 23, 59, 0, 0, time.UTC), 1, "2020-06-02"},
+		{time.Date(2020, 3, 7, 23, 0, 0, 0, ny), 1, "2020-03-09"},
+		{time.Date(2020, 3, 8, 12, 0, 0, 0, ny), 1, "2020-03-09"},
+		{time.Date(2020, 11, 1, 12, 0, 0, 0, ny), -1, "2020-10-31"},
+	}
+	for _, tt := range tests {
+		got := civil.AddDays(tt.t, tt.n)
+		if !civil.IsDate(got) || civil.Format(got) != tt.want {
+			t.Errorf("AddDays(%v, %d) = %v, want %s", tt.t, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestDays(t *testing.T) {
+	tests := []struct {
+		from, to time.Time
+		want     int
+	}{
+		{date("2020-06-01"), date("2020-06-01"), 0},
+		{date("2020-02-28"), date("2020-03-01"), 2},
+		{date("2019-02-28"), date("2019-03-01"), 1},
+		{date("2020-12-31"), date("2021-01-01"), 1},
+		{date("2020-01-01"), date("2021-01-01"), 366},
+		{date("2021-01-01"), date("2022-01-01"), 365},
+		{date("2021-01-01"), date("2020-01-01"), -366},
+		{date("2020-06-01").Add(23 * time.Hour), date("2020-06-02"), 1},
+		{date("2020-06-01"), date("2020-06-02").Add(23 * time.Hour), 1},
+	}
+	for _, tt := range tests {
+		if got := civil.Days(tt.from, tt.to); got != tt.want {
+			t.Errorf("Days(%v, %v) = %d, want %d", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	got := civil.Range(date("2020-02-27").Add(12*time.Hour), date("2020-03-01"))
+	want := []string{"2020-02-27", "2020-02-28", "2020-02-29", "2020-03-01"}
+	if len(got) != len(want) {
+		t.Fatal("Wrong range", got)
+	}
+	for i := range want {
+		if civil.Format(got[i]) != want[i] || !civil.IsDate(got[i]) {
+			t.Error("Wrong date", got[i], want[i])
+		}
+	}
+	if got := civil.Range(date("2021-01-01"), date("2020-12-31")); len(got) != 0 {
+		t.Error("Range should be empty", got)
+	}
+	if got := civil.Range(date("2020-12-31"), date("2021-01-01")); len(got) != 2 {
+		t.Error("Range should span the year boundary", got)
+	}
+	if got := civil.Range(date("2020-01-01"), date("2020-12-31")); len(got) != 366 {
+		t.Error("2020 should have 366 days", len(got))
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{"2020-02-30", "2019-02-29", "2020-13-01", "20200601", ""} {
+		if _, err := civil.Parse(s); err == nil {
+			t.Error("Expected error for", s)
+		}
+	}
+	d := date("2020-02-29")
+	if !civil.IsDate(d) {
+		t.Error("Parse should return a date", d)
+	}
+}
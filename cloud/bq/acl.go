@@ -0,0 +1,105 @@
+package bq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+
+	"github.com/m-lab/go/dataset"
+)
+
+// Errors associated with dataset access policies.
+var (
+	ErrInvalidReader = errors.New("invalid reader")
+	ErrAccessDrift   = errors.New("dataset access drift")
+)
+
+// entityTypes maps the reader prefixes to access entity types.
+var entityTypes = map[string]bigquery.EntityType{
+	"user":         bigquery.UserEmailEntity,
+	"group":        bigquery.GroupEmailEntity,
+	"domain":       bigquery.DomainEntity,
+	"specialGroup": bigquery.SpecialGroupEntity,
+	"iamMember":    bigquery.IAMMemberEntity,
+}
+
+// Reader is an entity that should be able to read a dataset.
+type Reader struct {
+	Type   bigquery.EntityType
+	Entity string
+}
+
+// ParseReader parses a reader as type:entity, e.g. group:team@example.com,
+// where type is user, group, domain, specialGroup or iamMember.  Special
+// groups, e.g. allAuthenticatedUsers, may omit the type.
+func ParseReader(s string) (Reader, error) {
+	prefix, entity := "specialGroup", s
+	if i := strings.Index(s, ":"); i >= 0 {
+		prefix, entity = s[:i], s[i+1:]
+	}
+	t, ok := entityTypes[prefix]
+	if !ok || entity == "" {
+		return Reader{}, fmt.Errorf("%w: %q", ErrInvalidReader, s)
+	}
+	return Reader{Type: t, Entity: entity}, nil
+}
+
+// ParseReaders parses each reader with ParseReader.
+func ParseReaders(readers []string) ([]Reader, error) {
+	parsed := make([]Reader, 0, len(readers))
+	for _, s := range readers {
+		r, err := ParseReader(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// CheckReaders returns an error wrapping ErrAccessDrift, listing the readers
+// that the dataset's access policy doesn't allow to read, or an error
+// fetching the policy.  Writers and owners can also read.
+func CheckReaders(ctx context.Context, ds bqiface.Dataset, readers []Reader) error {
+	if len(readers) == 0 {
+		return nil
+	}
+	meta, err := ds.Metadata(ctx)
+	if err != nil {
+		return err
+	}
+	allowed := map[Reader]bool{}
+	for _, a := range meta.Access {
+		switch a.Role {
+		case bigquery.ReaderRole, bigquery.WriterRole, bigquery.OwnerRole:
+			allowed[Reader{Type: a.EntityType, Entity: a.Entity}] = true
+		}
+	}
+	missing := []string{}
+	for _, r := range readers {
+		if !allowed[r] {
+			missing = append(missing, r.Entity)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s.%s is not readable by %s", ErrAccessDrift,
+			ds.ProjectID(), ds.DatasetID(), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// CheckAccess checks the access policies of the raw and target datasets
+// with CheckReaders.
+func (to TableOps) CheckAccess(ctx context.Context, target PublishTarget) error {
+	if to.client == nil {
+		return dataset.ErrNilBqClient
+	}
+	if err := CheckReaders(ctx, to.client.Dataset(to.Names.RawDataset), target.RawReaders); err != nil {
+		return err
+	}
+	return CheckReaders(ctx, to.client.DatasetInProject(target.Project, target.Dataset), target.Readers)
+}
@@ -0,0 +1,76 @@
+package bq_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestParseReader(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bq.Reader
+		err  error
+	}{
+		{s: "allAuthenticatedUsers", want: bq.Reader{Type: bigquery.SpecialGroupEntity, Entity: "allAuthenticatedUsers"}},
+		{s: "group:team@example.com", want: bq.Reader{Type: bigquery.GroupEmailEntity, Entity: "team@example.com"}},
+		{s: "user:me@example.com", want: bq.Reader{Type: bigquery.UserEmailEntity, Entity: "me@example.com"}},
+		{s: "domain:example.com", want: bq.Reader{Type: bigquery.DomainEntity, Entity: "example.com"}},
+		{s: "role:me@example.com", err: bq.ErrInvalidReader},
+		{s: "group:", err: bq.ErrInvalidReader},
+	}
+	for _, tt := range tests {
+		got, err := bq.ParseReader(tt.s)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("ParseReader(%q) = %v, %v, want %v, %v", tt.s, got, err, tt.want, tt.err)
+		}
+	}
+	if _, err := bq.ParseReaders([]string{"allUsers", "bogus:x"}); !errors.Is(err, bq.ErrInvalidReader) {
+		t.Error("Expected ErrInvalidReader", err)
+	}
+}
+
+func access(role bigquery.AccessRole, t bigquery.EntityType, entity string) *bqiface.AccessEntry {
+	return &bqiface.AccessEntry{AccessEntry: bigquery.AccessEntry{Role: role, EntityType: t, Entity: entity}}
+}
+
+func TestCheckAccess(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+	readers, err := bq.ParseReaders([]string{"allAuthenticatedUsers"})
+	rtx.Must(err, "ParseReaders")
+	rawReaders, err := bq.ParseReaders([]string{"group:team@example.com"})
+	rtx.Must(err, "ParseReaders")
+	target := bq.PublishTarget{Project: "public-project", Dataset: "ndt",
+		Readers: readers, RawReaders: rawReaders}
+
+	// The datasets don't exist.
+	if err := to.CheckAccess(ctx, target); err == nil || errors.Is(err, bq.ErrAccessDrift) {
+		t.Error("Expected a metadata error", err)
+	}
+
+	c.SetAccess("raw_ndt", []*bqiface.AccessEntry{
+		access(bigquery.WriterRole, bigquery.GroupEmailEntity, "team@example.com")})
+	c.SetAccess("ndt", []*bqiface.AccessEntry{
+		access(bigquery.ReaderRole, bigquery.SpecialGroupEntity, "projectReaders")})
+	if err := to.CheckAccess(ctx, target); !errors.Is(err, bq.ErrAccessDrift) {
+		t.Error("Expected ErrAccessDrift", err)
+	}
+
+	c.SetAccess("ndt", []*bqiface.AccessEntry{
+		access(bigquery.ReaderRole, bigquery.SpecialGroupEntity, "projectReaders"),
+		access(bigquery.ReaderRole, bigquery.SpecialGroupEntity, "allAuthenticatedUsers")})
+	rtx.Must(to.CheckAccess(ctx, target), "CheckAccess")
+}
@@ -0,0 +1,653 @@
+// Package bqfake provides an in-memory fake of the bqiface interfaces, for
+// hermetic tests of code that uses BigQuery.
+//
+// Query results are scripted with AddResult, and matched against each query
+// by substring, after any named query parameters are replaced with their
+// values, as BigQuery would bind them.  All queries, copies, loads and deletes are recorded, so that
+// tests can check what was requested.  Tables that should exist are added
+// with AddTable.
+package bqfake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// Errors returned by the fake.  ErrNotFound is a googleapi.Error, like the
+// errors returned by BigQuery for missing datasets, tables and jobs.
+var (
+	ErrNotFound     error = &googleapi.Error{Code: http.StatusNotFound, Message: "bqfake: not found"}
+	ErrTypeMismatch       = errors.New("bqfake: row type does not match destination")
+)
+
+// Result is a scripted query result.
+type Result struct {
+	Rows   []interface{}           // Rows returned by Read.  Each must be assignable to the Next destination.
+	Err    error                   // Error returned by Query.Run and Query.Read.
+	JobErr error                   // Error returned by Job.Status and Job.Wait.
+	Stats  *bigquery.JobStatistics // Statistics in the Job status.  May be nil.
+}
+
+type rule struct {
+	match  string
+	result Result
+}
+
+// Client is a fake bqiface.Client.  It is safe for concurrent use.
+type Client struct {
+	bqiface.Client
+	project string
+
+	lock     sync.Mutex
+	location string
+	rules    []rule
+	datasets map[string]bool                    // Datasets that exist.
+	access   map[string][]*bqiface.AccessEntry  // Dataset access policies.
+	tables   map[string]*bigquery.TableMetadata // Keyed by dataset.table
+	jobs     map[string]*Job
+	queries  []string
+	runs     []bqiface.QueryConfig
+	reads    []bqiface.QueryConfig
+	copies   []bqiface.CopyConfig
+	loads    []bqiface.LoadConfig
+	deleted  []string
+	inserted map[string][]interface{} // Streamed rows, keyed by dataset.table
+}
+
+// NewClient creates a fake Client for the project.
+func NewClient(project string) *Client {
+	return &Client{
+		project:  project,
+		datasets: make(map[string]bool),
+		access:   make(map[string][]*bqiface.AccessEntry),
+		tables:   make(map[string]*bigquery.TableMetadata),
+		jobs:     make(map[string]*Job),
+		inserted: make(map[string][]interface{}),
+	}
+}
+
+// AddResult scripts the result for all queries containing match.  Rules are
+// checked in the order they were added.  Queries that match no rule return
+// no rows.
+func (c *Client) AddResult(match string, r Result) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rules = append(c.rules, rule{match, r})
+}
+
+// SetResult replaces the result of the rule with the same match, e.g. to
+// script a changing result, or adds a rule if there is none.
+func (c *Client) SetResult(match string, r Result) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i := range c.rules {
+		if c.rules[i].match == match {
+			c.rules[i].result = r
+			return
+		}
+	}
+	c.rules = append(c.rules, rule{match, r})
+}
+
+// AddDataset adds an existing dataset.
+func (c *Client) AddDataset(dataset string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.datasets[dataset] = true
+}
+
+// SetAccess adds the dataset, with the access policy.
+func (c *Client) SetAccess(dataset string, access []*bqiface.AccessEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.datasets[dataset] = true
+	c.access[dataset] = access
+}
+
+// AddTable adds a table, or partition, with the given metadata.  The
+// dataset is also added.
+func (c *Client) AddTable(dataset, table string, meta *bigquery.TableMetadata) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.datasets[dataset] = true
+	c.tables[dataset+"."+table] = meta
+}
+
+// Queries returns all the queries that were run or read, with their
+// parameters bound.
+func (c *Client) Queries() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.queries...)
+}
+
+// QueryRuns returns the configs of all query jobs that were run.
+func (c *Client) QueryRuns() []bqiface.QueryConfig {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]bqiface.QueryConfig(nil), c.runs...)
+}
+
+// Reads returns the configs of all queries that were read directly, without
+// a job.
+func (c *Client) Reads() []bqiface.QueryConfig {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]bqiface.QueryConfig(nil), c.reads...)
+}
+
+// Copies returns the configs of all copy jobs that were run.
+func (c *Client) Copies() []bqiface.CopyConfig {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]bqiface.CopyConfig(nil), c.copies...)
+}
+
+// Loads returns the configs of all load jobs that were run.
+func (c *Client) Loads() []bqiface.LoadConfig {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]bqiface.LoadConfig(nil), c.loads...)
+}
+
+// Deleted returns the dataset.table names of all deleted tables.
+func (c *Client) Deleted() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.deleted...)
+}
+
+// Inserted returns the rows streamed into dataset.table.
+func (c *Client) Inserted(dataset, table string) []interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]interface{}(nil), c.inserted[dataset+"."+table]...)
+}
+
+// result records the query, and returns the first matching Result.
+func (c *Client) result(q string) Result {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.queries = append(c.queries, q)
+	for _, r := range c.rules {
+		if strings.Contains(q, r.match) {
+			return r.result
+		}
+	}
+	return Result{}
+}
+
+// newJob creates and registers a Job in the location of the job config, or
+// of the client if the config has none.
+func (c *Client) newJob(r Result, cfg bigquery.JobIDConfig) *Job {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	location := cfg.Location
+	if location == "" {
+		location = c.location
+	}
+	j := &Job{id: fmt.Sprintf("fake-job-%d", len(c.jobs)+1), result: r, location: location}
+	c.jobs[j.id] = j
+	return j
+}
+
+// Location implements bqiface.Client.
+func (c *Client) Location() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.location
+}
+
+// SetLocation implements bqiface.Client.
+func (c *Client) SetLocation(location string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.location = location
+}
+
+// Dataset implements bqiface.Client.
+func (c *Client) Dataset(id string) bqiface.Dataset {
+	return &Dataset{client: c, project: c.project, id: id}
+}
+
+// DatasetInProject implements bqiface.Client.
+func (c *Client) DatasetInProject(project, id string) bqiface.Dataset {
+	return &Dataset{client: c, project: project, id: id}
+}
+
+// Query implements bqiface.Client.
+func (c *Client) Query(q string) bqiface.Query {
+	return &Query{client: c, config: bqiface.QueryConfig{QueryConfig: bigquery.QueryConfig{Q: q}}}
+}
+
+// JobFromID implements bqiface.Client.  It returns jobs previously created
+// by the fake.
+func (c *Client) JobFromID(ctx context.Context, id string) (bqiface.Job, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	j, ok := c.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return j, nil
+}
+
+// JobFromIDLocation implements bqiface.Client.  Jobs are only found in
+// the location they ran in.
+func (c *Client) JobFromIDLocation(ctx context.Context, id, location string) (bqiface.Job, error) {
+	j, err := c.JobFromID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if location != "" && j.Location() != "" && location != j.Location() {
+		return nil, ErrNotFound
+	}
+	return j, nil
+}
+
+// Close implements bqiface.Client.
+func (c *Client) Close() error { return nil }
+
+// Dataset is a fake bqiface.Dataset.
+type Dataset struct {
+	bqiface.Dataset
+	client  *Client
+	project string
+	id      string
+}
+
+// ProjectID implements bqiface.Dataset.
+func (d *Dataset) ProjectID() string { return d.project }
+
+// DatasetID implements bqiface.Dataset.
+func (d *Dataset) DatasetID() string { return d.id }
+
+// Metadata implements bqiface.Dataset.  It returns ErrNotFound for datasets
+// that were not added or created.
+func (d *Dataset) Metadata(ctx context.Context) (*bqiface.DatasetMetadata, error) {
+	d.client.lock.Lock()
+	defer d.client.lock.Unlock()
+	if !d.client.datasets[d.id] {
+		return nil, ErrNotFound
+	}
+	return &bqiface.DatasetMetadata{Access: d.client.access[d.id]}, nil
+}
+
+// Create implements bqiface.Dataset.
+func (d *Dataset) Create(ctx context.Context, meta *bqiface.DatasetMetadata) error {
+	d.client.lock.Lock()
+	defer d.client.lock.Unlock()
+	if d.client.datasets[d.id] {
+		return &googleapi.Error{Code: http.StatusConflict, Message: "bqfake: already exists"}
+	}
+	d.client.datasets[d.id] = true
+	return nil
+}
+
+// Table implements bqiface.Dataset.
+func (d *Dataset) Table(id string) bqiface.Table {
+	return &Table{client: d.client, project: d.project, dataset: d.id, id: id}
+}
+
+// Tables implements bqiface.Dataset.  It iterates over tables added with
+// AddTable, in name order.
+func (d *Dataset) Tables(ctx context.Context) bqiface.TableIterator {
+	d.client.lock.Lock()
+	defer d.client.lock.Unlock()
+	it := &TableIterator{}
+	prefix := d.id + "."
+	for name := range d.client.tables {
+		if strings.HasPrefix(name, prefix) {
+			it.tables = append(it.tables, d.Table(strings.TrimPrefix(name, prefix)))
+		}
+	}
+	sort.Slice(it.tables, func(i, j int) bool {
+		return it.tables[i].TableID() < it.tables[j].TableID()
+	})
+	return it
+}
+
+// TableIterator is a fake bqiface.TableIterator.
+type TableIterator struct {
+	bqiface.TableIterator
+	tables []bqiface.Table
+}
+
+// Next implements bqiface.TableIterator.
+func (it *TableIterator) Next() (bqiface.Table, error) {
+	if len(it.tables) == 0 {
+		return nil, iterator.Done
+	}
+	t := it.tables[0]
+	it.tables = it.tables[1:]
+	return t, nil
+}
+
+// Table is a fake bqiface.Table.
+type Table struct {
+	bqiface.Table
+	client  *Client
+	project string
+	dataset string
+	id      string
+}
+
+// ProjectID implements bqiface.Table.
+func (t *Table) ProjectID() string { return t.project }
+
+// DatasetID implements bqiface.Table.
+func (t *Table) DatasetID() string { return t.dataset }
+
+// TableID implements bqiface.Table.
+func (t *Table) TableID() string { return t.id }
+
+// FullyQualifiedName implements bqiface.Table.
+func (t *Table) FullyQualifiedName() string {
+	return fmt.Sprintf("%s:%s.%s", t.project, t.dataset, t.id)
+}
+
+// Metadata implements bqiface.Table.  It returns ErrNotFound for tables
+// that were not added with AddTable.
+func (t *Table) Metadata(ctx context.Context) (*bigquery.TableMetadata, error) {
+	t.client.lock.Lock()
+	defer t.client.lock.Unlock()
+	meta, ok := t.client.tables[t.dataset+"."+t.id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return meta, nil
+}
+
+// Create implements bqiface.Table.  The dataset must exist.
+func (t *Table) Create(ctx context.Context, meta *bigquery.TableMetadata) error {
+	t.client.lock.Lock()
+	defer t.client.lock.Unlock()
+	name := t.dataset + "." + t.id
+	if !t.client.datasets[t.dataset] {
+		return ErrNotFound
+	}
+	if _, ok := t.client.tables[name]; ok {
+		return &googleapi.Error{Code: http.StatusConflict, Message: "bqfake: already exists"}
+	}
+	t.client.tables[name] = meta
+	return nil
+}
+
+// Update implements bqiface.Table.  Only Description, Schema,
+// TimePartitioning and ViewQuery are applied.  The etag is ignored.
+func (t *Table) Update(ctx context.Context, tm bigquery.TableMetadataToUpdate, etag string) (*bigquery.TableMetadata, error) {
+	t.client.lock.Lock()
+	defer t.client.lock.Unlock()
+	meta, ok := t.client.tables[t.dataset+"."+t.id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	updated := *meta
+	if d, ok := tm.Description.(string); ok {
+		updated.Description = d
+	}
+	if tm.Schema != nil {
+		updated.Schema = tm.Schema
+	}
+	if tm.TimePartitioning != nil {
+		tp := *tm.TimePartitioning
+		updated.TimePartitioning = &tp
+	}
+	if q, ok := tm.ViewQuery.(string); ok {
+		updated.ViewQuery = q
+	}
+	t.client.tables[t.dataset+"."+t.id] = &updated
+	return &updated, nil
+}
+
+// Delete implements bqiface.Table.  It records the deletion, and removes
+// the table if it was added with AddTable.
+func (t *Table) Delete(ctx context.Context) error {
+	t.client.lock.Lock()
+	defer t.client.lock.Unlock()
+	name := t.dataset + "." + t.id
+	t.client.deleted = append(t.client.deleted, name)
+	delete(t.client.tables, name)
+	return nil
+}
+
+// CopierFrom implements bqiface.Table.
+func (t *Table) CopierFrom(srcs ...bqiface.Table) bqiface.Copier {
+	c := &Copier{client: t.client}
+	c.config.Dst = t
+	c.config.Srcs = srcs
+	return c
+}
+
+// LoaderFrom implements bqiface.Table.
+func (t *Table) LoaderFrom(src bigquery.LoadSource) bqiface.Loader {
+	l := &Loader{client: t.client}
+	l.config.Dst = t
+	l.config.Src = src
+	return l
+}
+
+// Uploader implements bqiface.Table.
+func (t *Table) Uploader() bqiface.Uploader {
+	return &Uploader{table: t}
+}
+
+// Uploader is a fake bqiface.Uploader, that records streamed rows.
+type Uploader struct {
+	bqiface.Uploader
+	table *Table
+}
+
+// Put implements bqiface.Uploader.  Rows may be a single row, or a slice of
+// rows.  It returns ErrNotFound if the table was not added or created.
+func (u *Uploader) Put(ctx context.Context, src interface{}) error {
+	c := u.table.client
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	name := u.table.dataset + "." + u.table.id
+	if _, ok := c.tables[name]; !ok {
+		return ErrNotFound
+	}
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice {
+		c.inserted[name] = append(c.inserted[name], src)
+		return nil
+	}
+	for i := 0; i < v.Len(); i++ {
+		c.inserted[name] = append(c.inserted[name], v.Index(i).Interface())
+	}
+	return nil
+}
+
+// parameterRE matches the named query parameters in a query.
+var parameterRE = regexp.MustCompile(`@\w+`)
+
+// bind returns the query of the config, with the named parameters replaced
+// by their values.  Strings are quoted.  Unknown parameters are unchanged.
+func bind(config bqiface.QueryConfig) string {
+	if len(config.Parameters) == 0 {
+		return config.Q
+	}
+	values := make(map[string]string, len(config.Parameters))
+	for _, p := range config.Parameters {
+		if s, ok := p.Value.(string); ok {
+			values["@"+p.Name] = fmt.Sprintf("%q", s)
+		} else {
+			values["@"+p.Name] = fmt.Sprint(p.Value)
+		}
+	}
+	return parameterRE.ReplaceAllStringFunc(config.Q, func(name string) string {
+		if v, ok := values[name]; ok {
+			return v
+		}
+		return name
+	})
+}
+
+// Query is a fake bqiface.Query.
+type Query struct {
+	bqiface.Query
+	client *Client
+	config bqiface.QueryConfig
+	jobID  bigquery.JobIDConfig
+}
+
+// JobIDConfig implements bqiface.Query.
+func (q *Query) JobIDConfig() *bigquery.JobIDConfig {
+	return &q.jobID
+}
+
+// SetQueryConfig implements bqiface.Query.
+func (q *Query) SetQueryConfig(config bqiface.QueryConfig) {
+	q.config = config
+}
+
+// Run implements bqiface.Query.
+func (q *Query) Run(ctx context.Context) (bqiface.Job, error) {
+	q.client.lock.Lock()
+	q.client.runs = append(q.client.runs, q.config)
+	q.client.lock.Unlock()
+	r := q.client.result(bind(q.config))
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return q.client.newJob(r, q.jobID), nil
+}
+
+// Read implements bqiface.Query.
+func (q *Query) Read(ctx context.Context) (bqiface.RowIterator, error) {
+	q.client.lock.Lock()
+	q.client.reads = append(q.client.reads, q.config)
+	q.client.lock.Unlock()
+	r := q.client.result(bind(q.config))
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return &RowIterator{rows: r.Rows}, nil
+}
+
+// Copier is a fake bqiface.Copier.
+type Copier struct {
+	bqiface.Copier
+	client *Client
+	config bqiface.CopyConfig
+	jobID  bigquery.JobIDConfig
+}
+
+// JobIDConfig implements bqiface.Copier.
+func (c *Copier) JobIDConfig() *bigquery.JobIDConfig {
+	return &c.jobID
+}
+
+// SetCopyConfig implements bqiface.Copier.
+func (c *Copier) SetCopyConfig(config bqiface.CopyConfig) {
+	c.config = config
+}
+
+// Run implements bqiface.Copier.
+func (c *Copier) Run(ctx context.Context) (bqiface.Job, error) {
+	c.client.lock.Lock()
+	c.client.copies = append(c.client.copies, c.config)
+	c.client.lock.Unlock()
+	return c.client.newJob(Result{}, c.jobID), nil
+}
+
+// Loader is a fake bqiface.Loader.
+type Loader struct {
+	bqiface.Loader
+	client *Client
+	config bqiface.LoadConfig
+	jobID  bigquery.JobIDConfig
+}
+
+// JobIDConfig implements bqiface.Loader.
+func (l *Loader) JobIDConfig() *bigquery.JobIDConfig {
+	return &l.jobID
+}
+
+// SetLoadConfig implements bqiface.Loader.
+func (l *Loader) SetLoadConfig(config bqiface.LoadConfig) {
+	l.config = config
+}
+
+// Run implements bqiface.Loader.
+func (l *Loader) Run(ctx context.Context) (bqiface.Job, error) {
+	l.client.lock.Lock()
+	l.client.loads = append(l.client.loads, l.config)
+	l.client.lock.Unlock()
+	return l.client.newJob(Result{}, l.jobID), nil
+}
+
+// Job is a fake bqiface.Job.  Jobs complete immediately.
+type Job struct {
+	bqiface.Job
+	id       string
+	result   Result
+	location string
+}
+
+// ID implements bqiface.Job.
+func (j *Job) ID() string { return j.id }
+
+// Location implements bqiface.Job.
+func (j *Job) Location() string { return j.location }
+
+// Status implements bqiface.Job.
+func (j *Job) Status(ctx context.Context) (*bigquery.JobStatus, error) {
+	return j.LastStatus(), j.result.JobErr
+}
+
+// LastStatus implements bqiface.Job.
+func (j *Job) LastStatus() *bigquery.JobStatus {
+	return &bigquery.JobStatus{State: bigquery.Done, Statistics: j.result.Stats}
+}
+
+// Wait implements bqiface.Job.
+func (j *Job) Wait(ctx context.Context) (*bigquery.JobStatus, error) {
+	return j.Status(ctx)
+}
+
+// Cancel implements bqiface.Job.
+func (j *Job) Cancel(ctx context.Context) error { return nil }
+
+// Read implements bqiface.Job.
+func (j *Job) Read(ctx context.Context) (bqiface.RowIterator, error) {
+	return &RowIterator{rows: j.result.Rows}, nil
+}
+
+// RowIterator is a fake bqiface.RowIterator.
+type RowIterator struct {
+	bqiface.RowIterator
+	rows []interface{}
+}
+
+// TotalRows implements bqiface.RowIterator.
+func (it *RowIterator) TotalRows() uint64 { return uint64(len(it.rows)) }
+
+// Next implements bqiface.RowIterator.  dst must be a pointer to a value
+// of the same type as the scripted row.
+func (it *RowIterator) Next(dst interface{}) error {
+	if len(it.rows) == 0 {
+		return iterator.Done
+	}
+	row := reflect.ValueOf(it.rows[0])
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || !row.Type().AssignableTo(v.Elem().Type()) {
+		return ErrTypeMismatch
+	}
+	v.Elem().Set(row)
+	it.rows = it.rows[1:]
+	return nil
+}
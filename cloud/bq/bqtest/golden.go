@@ -0,0 +1,162 @@
+// Package bqtest provides test helpers for the queries in the bq package.
+//
+// CheckGolden renders every query of every supported datatype for a fixed
+// job, and compares them with golden .sql files, so that template changes
+// are reviewed as SQL diffs.  After an intended change, regenerate the
+// golden files with
+//
+//	go test ./cloud/bq/... -run Golden -update
+package bqtest
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+var update = flag.Bool("update", false, "Regenerate the golden .sql files, rather than comparing with them.")
+
+// GoldenProject is the project of the rendered queries.
+const GoldenProject = "mlab-testing"
+
+// GoldenJob returns the fixed job that the golden queries are rendered for.
+func GoldenJob(datatype string) tracker.Job {
+	return tracker.NewJob("archive-measurement-lab", "ndt", datatype, time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// GoldenPrefix is the prefix of the prefix job variant.
+const GoldenPrefix = "20200601T15"
+
+// A Case is a single rendered query.
+type Case struct {
+	Job      tracker.Job
+	Op       string // One of bq.QueryOps.
+	Strategy string // The dedup strategy, for "dedup" only.
+}
+
+// Name returns the base name of the case's golden file, e.g.
+// "ndt7-dedup-overwrite-prefix".
+func (c Case) Name() string {
+	parts := []string{c.Job.Datatype, c.Op}
+	if c.Strategy != "" {
+		parts = append(parts, c.Strategy)
+	}
+	if c.Job.Prefix != "" {
+		parts = append(parts, "prefix")
+	}
+	return strings.Join(parts, "-")
+}
+
+// Render returns the case's SQL, using the naming scheme.
+func (c Case) Render(naming bq.Naming) (string, error) {
+	to, err := bq.NewTableOpsWithClientAndNaming(nil, c.Job, GoldenProject, "", naming)
+	if err != nil {
+		return "", err
+	}
+	to.DedupStrategy = c.Strategy
+	return to.QueryFor(c.Op)
+}
+
+// Cases returns a case for every supported datatype, query operation and
+// dedup strategy, for the whole date and for a prefix of it.
+func Cases() []Case {
+	cases := []Case{}
+	for _, dt := range bq.Datatypes {
+		whole := GoldenJob(dt)
+		prefix := whole
+		prefix.Prefix = GoldenPrefix
+		for _, j := range []tracker.Job{whole, prefix} {
+			for _, op := range bq.QueryOps {
+				strategies := []string{""}
+				if op == "dedup" {
+					strategies = []string{bq.DedupDelete, bq.DedupOverwrite}
+				}
+				for _, s := range strategies {
+					cases = append(cases, Case{Job: j, Op: op, Strategy: s})
+				}
+			}
+		}
+	}
+	return cases
+}
+
+// firstDiff returns the first line that differs between want and got.
+func firstDiff(want, got string) string {
+	w, g := strings.Split(want, "\n"), strings.Split(got, "\n")
+	for i := 0; i < len(w) || i < len(g); i++ {
+		wl, gl := "<EOF>", "<EOF>"
+		if i < len(w) {
+			wl = w[i]
+		}
+		if i < len(g) {
+			gl = g[i]
+		}
+		if wl != gl {
+			return fmt.Sprintf("line %d:\n  want: %s\n  got:  %s", i+1, wl, gl)
+		}
+	}
+	return ""
+}
+
+// CheckGolden renders all Cases with the naming scheme, and compares each
+// with dir/<name>.sql.  Golden files that match no case are reported too, so
+// that removed queries are noticed.  With the -update flag, the golden files
+// are rewritten instead, and stale ones are removed.
+func CheckGolden(t testing.TB, dir string, naming bq.Naming) {
+	t.Helper()
+	want := map[string]bool{}
+	for _, c := range Cases() {
+		name := c.Name() + ".sql"
+		want[name] = true
+		got, err := c.Render(naming)
+		if err != nil {
+			t.Error(c.Name(), "failed to render:", err)
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if *update {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+				t.Error(err)
+			}
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Error(err, "- run with -update to create it")
+			continue
+		}
+		if diff := firstDiff(string(b), got); diff != "" {
+			t.Errorf("%s differs from the golden file, at %s\nRun with -update if the change is intended.", path, diff)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		if want[filepath.Base(f)] {
+			continue
+		}
+		if *update {
+			if err := os.Remove(f); err != nil {
+				t.Error(err)
+			}
+			continue
+		}
+		t.Error(f, "matches no query - run with -update to remove it")
+	}
+}
@@ -0,0 +1,271 @@
+package bq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"google.golang.org/api/iterator"
+
+	"github.com/m-lab/go/dataset"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// ErrUnknownExperiment is returned for experiments with no datatypes added.
+var ErrUnknownExperiment = errors.New("unknown experiment")
+
+// DatatypeCompletion reports whether a single datatype is complete for a
+// date.
+type DatatypeCompletion struct {
+	Datatype string
+	Complete bool
+	Table    string        // The project.dataset.table$yyyymmdd partition checked.
+	Rows     int64         // Rows in the partition.
+	State    tracker.State `json:",omitempty"` // State of an unfinished job in the tracker.
+	Error    string        `json:",omitempty"`
+}
+
+// Completion reports whether all datatypes of an experiment are complete
+// for a date.
+type Completion struct {
+	Experiment string
+	Date       string // yyyy-mm-dd
+	Complete   bool
+	Datatypes  []DatatypeCompletion
+}
+
+// CompletionTTL is how long Handler caches each Completion, so that
+// frequent polling doesn't drive query cost.
+const CompletionTTL = time.Minute
+
+// PartitionRows is a row count of a table partition, as returned by the
+// completion query.
+type PartitionRows struct {
+	Table string
+	Rows  int64
+}
+
+// CompletionChecker reports whether the datatypes of an experiment are
+// fully published for a date, so that downstream pipelines can wait for
+// gardener.  A datatype is complete when the date's partition of its final
+// table, i.e. the publish target if there is one, or the raw table, has
+// rows, and the tracker has no unfinished job for the date.
+type CompletionChecker struct {
+	client    bqiface.Client
+	project   string
+	naming    Naming
+	tk        *tracker.Tracker
+	datatypes map[string][]string      // Keyed by experiment.
+	publish   map[string]PublishTarget // Keyed by experiment.
+
+	lock  sync.Mutex
+	cache map[string]cachedCompletion // Keyed by experiment/date.
+}
+
+// cachedCompletion is a Completion served by Handler until it expires.
+type cachedCompletion struct {
+	result  *Completion
+	expires time.Time
+}
+
+// NewCompletionChecker creates a CompletionChecker for tables in the project.
+func NewCompletionChecker(client bqiface.Client, project string, naming Naming, tk *tracker.Tracker) *CompletionChecker {
+	return &CompletionChecker{client: client, project: project, naming: naming.WithDefaults(), tk: tk,
+		datatypes: make(map[string][]string), publish: make(map[string]PublishTarget),
+		cache: make(map[string]cachedCompletion)}
+}
+
+// Add adds a datatype of an experiment.  Duplicates are ignored.
+func (c *CompletionChecker) Add(experiment, datatype string) {
+	for _, dt := range c.datatypes[experiment] {
+		if dt == datatype {
+			return
+		}
+	}
+	c.datatypes[experiment] = append(c.datatypes[experiment], datatype)
+	sort.Strings(c.datatypes[experiment])
+}
+
+// SetPublish sets the publish targets, keyed by experiment.  Experiments
+// with a target are complete when the published partitions have rows.
+func (c *CompletionChecker) SetPublish(targets map[string]PublishTarget) {
+	c.publish = targets
+}
+
+// unfinished returns the state of any job for the experiment, datatype and
+// date in the tracker that is not complete, or "" if there is none.
+func unfinished(jobs tracker.JobMap, exp, dt string, date time.Time) tracker.State {
+	for j, s := range jobs {
+		status := s
+		if j.Experiment == exp && j.Datatype == dt && j.Date.Equal(date) &&
+			status.State() != tracker.Complete {
+			return status.State()
+		}
+	}
+	return ""
+}
+
+// finalTable returns the project and dataset of the final table of the
+// datatype, and the table name.
+func (c *CompletionChecker) finalTable(exp, dt string) (string, string, string, error) {
+	names, err := c.naming.Names(tracker.Job{Experiment: exp, Datatype: dt})
+	if err != nil {
+		return "", "", "", err
+	}
+	if target, ok := c.publish[exp]; ok {
+		return target.Project, target.Dataset, names.Table, nil
+	}
+	return c.project, names.RawDataset, names.Table, nil
+}
+
+// partitionRows queries the rows in the date's partition of each table in
+// a dataset.  Tables with no partition for the date are omitted.
+func (c *CompletionChecker) partitionRows(ctx context.Context, project, ds string, tables []string, date time.Time) (map[string]int64, error) {
+	if c.client == nil {
+		return nil, dataset.ErrNilBqClient
+	}
+	q := queryWithParams(c.client, fmt.Sprintf(`
+#standardSQL
+# Rows in the date's partition of each table.
+SELECT table_name AS Table, IFNULL(total_rows, 0) AS Rows
+FROM `+"`%s.%s.INFORMATION_SCHEMA.PARTITIONS`"+`
+WHERE partition_id = @partition AND table_name IN ("%s")`,
+		project, ds, strings.Join(tables, `", "`)),
+		bigquery.QueryParameter{Name: "partition", Value: date.Format("20060102")})
+	if q == nil {
+		return nil, dataset.ErrNilQuery
+	}
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows := map[string]int64{}
+	for {
+		var pr PartitionRows
+		err := it.Next(&pr)
+		if err == iterator.Done {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows[pr.Table] = pr.Rows
+	}
+}
+
+// Check returns the completion of each datatype of the experiment for the
+// date.  Query errors are reported per datatype, which is then incomplete.
+// Returns ErrUnknownExperiment if the experiment has no datatypes.
+func (c *CompletionChecker) Check(ctx context.Context, exp string, date time.Time) (*Completion, error) {
+	datatypes := c.datatypes[exp]
+	if len(datatypes) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownExperiment, exp)
+	}
+	result := &Completion{Experiment: exp, Date: date.Format("2006-01-02"), Complete: true}
+	jobs := c.tk.GetSnapshot().Jobs
+
+	// Group the final tables by dataset, so there is one query per dataset.
+	type location struct{ project, dataset string }
+	locs := make([]location, len(datatypes))
+	names := make([]string, len(datatypes))
+	tables := map[location][]string{}
+	for i, dt := range datatypes {
+		dc := DatatypeCompletion{Datatype: dt, State: unfinished(jobs, exp, dt, date)}
+		project, ds, table, err := c.finalTable(exp, dt)
+		if err != nil {
+			dc.Error = err.Error()
+		} else {
+			dc.Table = fmt.Sprintf("%s.%s.%s$%s", project, ds, table, date.Format("20060102"))
+			locs[i], names[i] = location{project, ds}, table
+			tables[locs[i]] = append(tables[locs[i]], table)
+		}
+		result.Datatypes = append(result.Datatypes, dc)
+	}
+	rows := map[location]map[string]int64{}
+	errs := map[location]error{}
+	for loc, t := range tables {
+		rows[loc], errs[loc] = c.partitionRows(ctx, loc.project, loc.dataset, t, date)
+	}
+	for i := range result.Datatypes {
+		dc := &result.Datatypes[i]
+		if dc.Table != "" {
+			if err := errs[locs[i]]; err != nil {
+				dc.Error = err.Error()
+			}
+			dc.Rows = rows[locs[i]][names[i]]
+		}
+		dc.Complete = dc.Error == "" && dc.State == "" && dc.Rows > 0
+		result.Complete = result.Complete && dc.Complete
+	}
+	return result, nil
+}
+
+// cachedCheck returns the cached Completion of the experiment for the date,
+// if it has not expired, and otherwise calls Check, and caches the result
+// for CompletionTTL.
+func (c *CompletionChecker) cachedCheck(ctx context.Context, exp string, date time.Time) (*Completion, error) {
+	key := exp + "/" + date.Format("2006-01-02")
+	now := time.Now()
+	c.lock.Lock()
+	cached, ok := c.cache[key]
+	c.lock.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.result, nil
+	}
+	result, err := c.Check(ctx, exp, date)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for k, v := range c.cache {
+		if !now.Before(v.expires) {
+			delete(c.cache, k)
+		}
+	}
+	c.cache[key] = cachedCompletion{result: result, expires: now.Add(CompletionTTL)}
+	return result, nil
+}
+
+// Handler serves the Completion for the "experiment" and "date" (yyyy-mm-dd)
+// parameters as JSON.  The response is 200 whether or not the experiment is
+// complete, so callers should check the Complete field.  Results are cached
+// for CompletionTTL.
+func (c *CompletionChecker) Handler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	exp := q.Get("experiment")
+	date, err := time.Parse("2006-01-02", q.Get("date"))
+	if exp == "" || err != nil {
+		http.Error(resp, "experiment and date (yyyy-mm-dd) are required", http.StatusBadRequest)
+		return
+	}
+	result, err := c.cachedCheck(req.Context(), exp, date)
+	if errors.Is(err, ErrUnknownExperiment) {
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
@@ -0,0 +1,117 @@
+package bq_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestCompletionChecker(t *testing.T) {
+	ctx := context.Background()
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	client := bqfake.NewClient("proj")
+	client.AddResult("`public.ndt.INFORMATION_SCHEMA.PARTITIONS`", bqfake.Result{Rows: []interface{}{
+		bq.PartitionRows{Table: "ndt7", Rows: 100}, bq.PartitionRows{Table: "tcpinfo", Rows: 200}}})
+	client.AddResult("`proj.raw_host.INFORMATION_SCHEMA.PARTITIONS`", bqfake.Result{
+		Err: errors.New("query failed")})
+
+	c := bq.NewCompletionChecker(client, "proj", bq.DefaultNaming, tk)
+	c.Add("ndt", "ndt7")
+	c.Add("ndt", "tcpinfo")
+	c.Add("ndt", "ndt7")
+	c.Add("host", "nodeinfo")
+	c.SetPublish(map[string]bq.PublishTarget{"ndt": {Project: "public", Dataset: "ndt"}})
+
+	result, err := c.Check(ctx, "ndt", date)
+	rtx.Must(err, "Check failed")
+	if !result.Complete || len(result.Datatypes) != 2 {
+		t.Errorf("Expected complete %+v", result)
+	}
+	if result.Datatypes[0].Table != "public.ndt.ndt7$20200601" || result.Datatypes[0].Rows != 100 {
+		t.Errorf("Wrong ndt7 completion %+v", result.Datatypes[0])
+	}
+	if !strings.Contains(client.Queries()[0], `partition_id = "20200601"`) {
+		t.Error("Wrong query:", client.Queries()[0])
+	}
+
+	// An unfinished job makes the datatype incomplete.
+	job := tracker.NewJob("bucket", "ndt", "tcpinfo", date)
+	rtx.Must(tk.AddJob(job), "AddJob")
+	rtx.Must(tk.SetStatus(job, tracker.Copying, ""), "SetStatus")
+	result, err = c.Check(ctx, "ndt", date)
+	rtx.Must(err, "Check failed")
+	if result.Complete || !result.Datatypes[0].Complete || result.Datatypes[1].State != tracker.Copying {
+		t.Errorf("Expected tcpinfo to be copying %+v", result)
+	}
+
+	// Query errors are reported per datatype.
+	result, err = c.Check(ctx, "host", date)
+	rtx.Must(err, "Check failed")
+	if result.Complete || result.Datatypes[0].Error != "query failed" {
+		t.Errorf("Expected query error %+v", result)
+	}
+
+	if _, err := c.Check(ctx, "foo", date); !errors.Is(err, bq.ErrUnknownExperiment) {
+		t.Error("Expected ErrUnknownExperiment, got", err)
+	}
+}
+
+func TestCompletionChecker_Handler(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	client := bqfake.NewClient("proj")
+	client.AddResult("`proj.raw_ndt.INFORMATION_SCHEMA.PARTITIONS`", bqfake.Result{Rows: []interface{}{
+		bq.PartitionRows{Table: "ndt7", Rows: 100}}})
+	c := bq.NewCompletionChecker(client, "proj", bq.DefaultNaming, tk)
+	c.Add("ndt", "ndt7")
+	c.Add("ndt", "tcpinfo")
+
+	tests := []struct {
+		method, query string
+		code          int
+	}{
+		{http.MethodGet, "experiment=ndt&date=2020-06-01", http.StatusOK},
+		{http.MethodPost, "experiment=ndt&date=2020-06-01", http.StatusMethodNotAllowed},
+		{http.MethodGet, "experiment=ndt", http.StatusBadRequest},
+		{http.MethodGet, "experiment=ndt&date=20200601", http.StatusBadRequest},
+		{http.MethodGet, "date=2020-06-01", http.StatusBadRequest},
+		{http.MethodGet, "experiment=foo&date=2020-06-01", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/complete?"+tt.query, nil)
+		rec := httptest.NewRecorder()
+		c.Handler(rec, req)
+		if rec.Code != tt.code {
+			t.Error(tt.method, tt.query, "expected", tt.code, "got", rec.Code)
+		}
+	}
+
+	// The result of the first request is cached.
+	queries := len(client.Queries())
+	req := httptest.NewRequest(http.MethodGet, "/complete?experiment=ndt&date=2020-06-01", nil)
+	rec := httptest.NewRecorder()
+	c.Handler(rec, req)
+	if len(client.Queries()) != queries {
+		t.Error("Expected a cached result", client.Queries())
+	}
+	result := bq.Completion{}
+	rtx.Must(json.Unmarshal(rec.Body.Bytes(), &result), "Bad json")
+	// tcpinfo has no partition.
+	if result.Complete || !result.Datatypes[0].Complete || result.Datatypes[1].Datatype != "tcpinfo" ||
+		result.Datatypes[1].Complete || result.Datatypes[1].Rows != 0 {
+		t.Errorf("Wrong result %+v", result)
+	}
+}
@@ -0,0 +1,64 @@
+package bq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"google.golang.org/api/iterator"
+
+	"github.com/m-lab/go/dataset"
+)
+
+// DailyCount is the row count of a single raw partition, as returned by the
+// DailyCounts query.
+type DailyCount struct {
+	Date string // yyyy-mm-dd
+	Rows int64
+}
+
+// dateRange returns the @start and @end parameters of a date range query.
+func dateRange(start, end time.Time) []bigquery.QueryParameter {
+	return []bigquery.QueryParameter{
+		{Name: "start", Value: start.Format("2006-01-02")},
+		{Name: "end", Value: end.Format("2006-01-02")},
+	}
+}
+
+// DailyCounts returns the row counts of the raw table partitions from start
+// to end, inclusive, keyed by yyyy-mm-dd.  Dates without rows are omitted.
+func DailyCounts(ctx context.Context, client bqiface.Client, project string, names Names,
+	start, end time.Time) (map[string]int64, error) {
+	if client == nil {
+		return nil, dataset.ErrNilBqClient
+	}
+	q := queryWithParams(client, fmt.Sprintf(`
+#standardSQL
+# Count the rows in each raw partition.
+SELECT FORMAT_DATE("%%Y-%%m-%%d", date) AS Date, COUNT(*) AS Rows
+FROM `+"`%s.%s.%s`"+`
+WHERE date BETWEEN @start AND @end
+GROUP BY date`,
+		project, names.RawDataset, names.Table), dateRange(start, end)...)
+	if q == nil {
+		return nil, dataset.ErrNilQuery
+	}
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{}
+	for {
+		var c DailyCount
+		err := it.Next(&c)
+		if err == iterator.Done {
+			return counts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		counts[c.Date] = c.Rows
+	}
+}
@@ -0,0 +1,38 @@
+package bq_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestDailyCounts(t *testing.T) {
+	c := bqfake.NewClient("fake-project")
+	c.AddResult("`fake-project.raw_ndt.ndt7`", bqfake.Result{Rows: []interface{}{
+		bq.DailyCount{Date: "2020-06-01", Rows: 10}, bq.DailyCount{Date: "2020-06-03", Rows: 5}}})
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	names, err := bq.DefaultNaming.Names(tracker.NewJob("bucket", "ndt", "ndt7", start))
+	rtx.Must(err, "Names")
+	counts, err := bq.DailyCounts(context.Background(), c, "fake-project", names, start, start.AddDate(0, 0, 2))
+	rtx.Must(err, "DailyCounts")
+	if len(counts) != 2 || counts["2020-06-01"] != 10 || counts["2020-06-03"] != 5 {
+		t.Error("Wrong counts", counts)
+	}
+
+	// The dates are parameters, not part of the SQL.
+	reads := c.Reads()
+	if len(reads) != 1 || strings.Contains(reads[0].Q, "2020-06") ||
+		!strings.Contains(reads[0].Q, "BETWEEN @start AND @end") || len(reads[0].Parameters) != 2 {
+		t.Error("Wrong query", reads)
+	}
+	if q := c.Queries(); len(q) != 1 || !strings.Contains(q[0], `BETWEEN "2020-06-01" AND "2020-06-03"`) {
+		t.Error("Wrong bound query", q)
+	}
+}
@@ -254,3 +254,17 @@ func Dedup(ctx context.Context, dsExt *dataset.Dataset, src string, destTable bq
 	}
 	return job, nil
 }
+
+// Dedup dedups the src table, relative to the project:dataset of the
+// AnnotatedTable's dataset, into the AnnotatedTable, and invalidates its
+// cached info.  See Dedup.
+func (at *AnnotatedTable) Dedup(ctx context.Context, src string) (bqiface.Job, error) {
+	if at.dataset == nil {
+		return nil, ErrNoDataset
+	}
+	job, err := Dedup(ctx, at.dataset, src, at.Table)
+	if err == nil {
+		at.Invalidate()
+	}
+	return job, err
+}
@@ -0,0 +1,56 @@
+package bq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+)
+
+// ErrDuplicateKeys is returned by CheckDedup when the tmp partition still
+// has rows with the same dedup key.
+var ErrDuplicateKeys = errors.New("duplicate keys after dedup")
+
+var dedupCheckTemplate = template.Must(template.New("").Parse(`
+#standardSQL
+# Count the dedup keys that still have more than one row in the tmp
+# partition, and the rows that dedup should have removed.  This scans only
+# the key columns, so it is much cheaper than the dedup.
+SELECT COUNT(*) AS Keys, IFNULL(SUM(key_rows - 1), 0) AS ExtraRows
+FROM (
+  SELECT COUNT(*) AS key_rows
+  FROM ` + tmpTable + `
+  WHERE {{.Date}} = @date` + prefixClause + `
+  GROUP BY {{range $k, $v := .PartitionKeys}}{{$v}}, {{end}}date
+  HAVING key_rows > 1
+)`))
+
+// DuplicateCounts holds the duplicate keys remaining in a partition.
+type DuplicateCounts struct {
+	Keys      int64 // Keys with more than one row.
+	ExtraRows int64 // Rows in excess of one per key.
+}
+
+// CheckDedup counts the dedup keys with more than one row in the tmp
+// partition, e.g. because of rows with the same key and parse time.  It
+// returns an error wrapping ErrDuplicateKeys if there are any, or a query
+// error.
+func (to TableOps) CheckDedup(ctx context.Context) (DuplicateCounts, error) {
+	var counts DuplicateCounts
+	q, err := to.query(to.makeQuery(dedupCheckTemplate))
+	if err != nil {
+		return counts, err
+	}
+	it, err := to.read(ctx, "dedup_check", q)
+	if err != nil {
+		return counts, err
+	}
+	if err := it.Next(&counts); err != nil {
+		return counts, err
+	}
+	if counts.Keys > 0 {
+		return counts, fmt.Errorf("%w: %d keys have %d extra rows", ErrDuplicateKeys,
+			counts.Keys, counts.ExtraRows)
+	}
+	return counts, nil
+}
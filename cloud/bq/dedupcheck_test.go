@@ -0,0 +1,50 @@
+package bq_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestCheckDedup(t *testing.T) {
+	ctx := context.Background()
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	tests := []struct {
+		name   string
+		result bqfake.Result
+		want   error
+	}{
+		{name: "none", result: bqfake.Result{Rows: []interface{}{bq.DuplicateCounts{}}}},
+		{name: "duplicates", result: bqfake.Result{Rows: []interface{}{bq.DuplicateCounts{Keys: 2, ExtraRows: 3}}},
+			want: bq.ErrDuplicateKeys},
+		{name: "query error", result: bqfake.Result{Err: errors.New("query failed")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := bqfake.NewClient("fake-project")
+			c.AddResult("HAVING key_rows > 1", tt.result)
+			to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+			rtx.Must(err, "NewTableOps failed")
+			counts, err := to.CheckDedup(ctx)
+			switch {
+			case tt.want != nil:
+				if !errors.Is(err, tt.want) || counts.Keys != 2 || counts.ExtraRows != 3 {
+					t.Error("Expected ErrDuplicateKeys", counts, err)
+				}
+			case tt.result.Err != nil:
+				if err == nil || errors.Is(err, bq.ErrDuplicateKeys) {
+					t.Error("Expected query error", err)
+				}
+			case err != nil:
+				t.Error(err)
+			}
+		})
+	}
+}
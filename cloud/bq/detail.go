@@ -0,0 +1,139 @@
+package bq
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+
+	"github.com/m-lab/go/dataset"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// PartitionDetails reports the task file and test counts of the tmp and raw
+// partitions for a single date.  The partitions are fetched independently,
+// so a missing tmp partition, e.g. after cleanup, does not hide the raw
+// counts.
+type PartitionDetails struct {
+	Experiment string
+	Datatype   string
+	Date       string    // yyyy-mm-dd
+	Tmp        *Detail   `json:",omitempty"`
+	TmpError   string    `json:",omitempty"`
+	Raw        *Detail   `json:",omitempty"`
+	RawError   string    `json:",omitempty"`
+	Fetched    time.Time // When the older of the two details was fetched.
+}
+
+// DetailCache fetches PartitionDetails through a TableDetailCache, so that
+// repeated requests don't each run queries, and can keep the details of
+// active jobs' partitions fresh in the background.
+type DetailCache struct {
+	client  bqiface.Client
+	project string
+	naming  Naming
+	tables  *TableDetailCache
+}
+
+// NewDetailCache creates a DetailCache that queries the tables named by
+// naming, and caches the results for ttl.
+func NewDetailCache(client bqiface.Client, project string, naming Naming, ttl time.Duration) *DetailCache {
+	return &DetailCache{client: client, project: project, naming: naming,
+		tables: NewTableDetailCache(ttl)}
+}
+
+// partition returns the dataset and table of the date's partition of a table.
+func (c *DetailCache) partition(ds, table string, date time.Time) (*dataset.Dataset, bqiface.Table) {
+	dsExt := &dataset.Dataset{Dataset: c.client.DatasetInProject(c.project, ds), BqClient: c.client}
+	return dsExt, dsExt.Table(table + "$" + date.Format("20060102"))
+}
+
+// Get returns the details for the date's tmp and raw partitions, from the
+// cache if they were fetched within the TTL, unless refresh is true.
+// Returns an error only if the tables can't be named.
+func (c *DetailCache) Get(ctx context.Context, exp, dt string, date time.Time, refresh bool) (*PartitionDetails, error) {
+	names, err := c.naming.Names(tracker.Job{Experiment: exp, Datatype: dt, Date: date})
+	if err != nil {
+		return nil, err
+	}
+	dsExt, table := c.partition(names.TmpDataset, names.Table, date)
+	tmp := c.tables.get(ctx, dsExt, table, refresh)
+	dsExt, table = c.partition(names.RawDataset, names.Table, date)
+	raw := c.tables.get(ctx, dsExt, table, refresh)
+	pd := &PartitionDetails{Experiment: exp, Datatype: dt, Date: date.Format("2006-01-02"),
+		Tmp: tmp.detail, Raw: raw.detail, Fetched: tmp.fetched}
+	if raw.fetched.Before(pd.Fetched) {
+		pd.Fetched = raw.fetched
+	}
+	if tmp.err != nil {
+		pd.TmpError = tmp.err.Error()
+	}
+	if raw.err != nil {
+		pd.RawError = raw.err.Error()
+	}
+	return pd, nil
+}
+
+// Refresh fetches the details of the tmp and raw partitions of each job,
+// and discards expired details.
+func (c *DetailCache) Refresh(ctx context.Context, jobs []tracker.Job) {
+	done := make(map[tracker.Job]bool, len(jobs))
+	for _, j := range jobs {
+		if done[j.Partition()] {
+			continue // Prefix jobs share their date's partitions.
+		}
+		done[j.Partition()] = true
+		if _, err := c.Get(ctx, j.Experiment, j.Datatype, j.Date, true); err != nil {
+			log.Println("Detail refresh:", j, err)
+		}
+	}
+	c.tables.Prune()
+}
+
+// Run refreshes the details of the active jobs' partitions every interval,
+// until ctx is done.
+func (c *DetailCache) Run(ctx context.Context, interval time.Duration, active func() []tracker.Job) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Refresh(ctx, active())
+		}
+	}
+}
+
+// Handler serves the PartitionDetails for the "experiment", "datatype" and
+// "date" (yyyy-mm-dd) parameters as JSON.  With "refresh=true", the cache is
+// bypassed.
+func (c *DetailCache) Handler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	exp, dt := q.Get("experiment"), q.Get("datatype")
+	date, err := time.Parse("2006-01-02", q.Get("date"))
+	if exp == "" || dt == "" || err != nil {
+		http.Error(resp, "experiment, datatype and date (yyyy-mm-dd) are required", http.StatusBadRequest)
+		return
+	}
+	pd, err := c.Get(req.Context(), exp, dt, date, q.Get("refresh") == "true")
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(pd)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
@@ -0,0 +1,83 @@
+package bq_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+)
+
+func TestDetailCache(t *testing.T) {
+	client := bqfake.NewClient("project")
+	client.AddResult("raw_ndt.ndt7", bqfake.Result{Rows: []interface{}{
+		bq.Detail{TaskFileCount: 10, TestCount: 1000}}})
+	c := bq.NewDetailCache(client, "project", bq.DefaultNaming, time.Hour)
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	pd, err := c.Get(context.Background(), "ndt", "ndt7", date, false)
+	rtx.Must(err, "Get")
+	if pd.Raw == nil || pd.Raw.TaskFileCount != 10 || pd.Raw.TestCount != 1000 {
+		t.Errorf("Wrong raw detail %+v", pd.Raw)
+	}
+	// The tmp partition has no rows.
+	if pd.Tmp != nil || pd.TmpError == "" {
+		t.Errorf("Expected tmp error %+v", pd)
+	}
+	q := client.Queries()
+	if len(q) != 2 || !strings.Contains(q[0], "tmp_ndt.ndt7") || !strings.Contains(q[0], `"20200601"`) {
+		t.Error("Wrong queries", q)
+	}
+
+	// Cached.
+	_, err = c.Get(context.Background(), "ndt", "ndt7", date, false)
+	rtx.Must(err, "Get")
+	if len(client.Queries()) != 2 {
+		t.Error("Should have used the cache", client.Queries())
+	}
+	_, err = c.Get(context.Background(), "ndt", "ndt7", date, true)
+	rtx.Must(err, "Get")
+	if len(client.Queries()) != 4 {
+		t.Error("Should have refreshed", client.Queries())
+	}
+}
+
+func TestDetailCache_Handler(t *testing.T) {
+	client := bqfake.NewClient("project")
+	client.AddResult("ndt7", bqfake.Result{Rows: []interface{}{
+		bq.Detail{TaskFileCount: 10, TestCount: 1000}}})
+	c := bq.NewDetailCache(client, "project", bq.DefaultNaming, time.Hour)
+
+	tests := []struct {
+		method, query string
+		code          int
+	}{
+		{http.MethodPost, "experiment=ndt&datatype=ndt7&date=2020-06-01", http.StatusMethodNotAllowed},
+		{http.MethodGet, "experiment=ndt&date=2020-06-01", http.StatusBadRequest},
+		{http.MethodGet, "experiment=ndt&datatype=ndt7&date=20200601", http.StatusBadRequest},
+		{http.MethodGet, "experiment=ndt&datatype=ndt7&date=2020-06-01", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/detail?"+tt.query, nil)
+		rec := httptest.NewRecorder()
+		c.Handler(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s %s: got %d, want %d", tt.method, tt.query, rec.Code, tt.code)
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var pd bq.PartitionDetails
+		rtx.Must(json.Unmarshal(rec.Body.Bytes(), &pd), "unmarshal")
+		if pd.Date != "2020-06-01" || pd.Tmp == nil || pd.Raw == nil || pd.Raw.TestCount != 1000 {
+			t.Errorf("Wrong details %+v", pd)
+		}
+	}
+}
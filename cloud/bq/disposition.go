@@ -0,0 +1,78 @@
+package bq
+
+import (
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Copy write dispositions, for the copy of a job's tmp partition to its raw
+// partition.
+const (
+	// CopyTruncate replaces the raw partition.  This is the default.
+	CopyTruncate = "truncate"
+	// CopyAppend appends the tmp rows to the raw partition, for derived
+	// datatypes that accumulate rows from several jobs.
+	CopyAppend = "append"
+	// CopyIfEmpty writes the raw partition only if it is empty, and fails
+	// the copy otherwise, so that existing rows are never overwritten.
+	CopyIfEmpty = "empty"
+)
+
+// Copy create dispositions.
+const (
+	// CreateIfNeeded creates the raw table if it doesn't exist.  This is the
+	// default.
+	CreateIfNeeded = "if_needed"
+	// CreateNever fails the copy if the raw table doesn't exist.
+	CreateNever = "never"
+)
+
+// ErrUnknownDisposition is returned for unsupported copy dispositions.
+var ErrUnknownDisposition = errors.New("unknown copy disposition")
+
+// CopyDisposition holds the write and create dispositions of CopyToRaw.
+// The zero value truncates the raw partition, and creates the raw table if
+// needed.
+type CopyDisposition struct {
+	Write  bigquery.TableWriteDisposition
+	Create bigquery.TableCreateDisposition
+}
+
+// ParseCopyDisposition returns the CopyDisposition for the write and create
+// names.  Empty names select the defaults.
+func ParseCopyDisposition(write, create string) (CopyDisposition, error) {
+	d := CopyDisposition{}
+	switch write {
+	case "", CopyTruncate:
+		d.Write = bigquery.WriteTruncate
+	case CopyAppend:
+		d.Write = bigquery.WriteAppend
+	case CopyIfEmpty:
+		d.Write = bigquery.WriteEmpty
+	default:
+		return d, fmt.Errorf("%w: write %q", ErrUnknownDisposition, write)
+	}
+	switch create {
+	case "", CreateIfNeeded:
+		d.Create = bigquery.CreateIfNeeded
+	case CreateNever:
+		d.Create = bigquery.CreateNever
+	default:
+		return d, fmt.Errorf("%w: create %q", ErrUnknownDisposition, create)
+	}
+	return d, nil
+}
+
+// withDefaults returns the disposition with any zero fields set to the
+// defaults.
+func (d CopyDisposition) withDefaults() CopyDisposition {
+	if d.Write == "" {
+		d.Write = bigquery.WriteTruncate
+	}
+	if d.Create == "" {
+		d.Create = bigquery.CreateIfNeeded
+	}
+	return d
+}
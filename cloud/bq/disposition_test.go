@@ -0,0 +1,64 @@
+package bq_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestParseCopyDisposition(t *testing.T) {
+	tests := []struct {
+		write, create string
+		want          bq.CopyDisposition
+		err           error
+	}{
+		{"", "", bq.CopyDisposition{Write: bigquery.WriteTruncate, Create: bigquery.CreateIfNeeded}, nil},
+		{"append", "never", bq.CopyDisposition{Write: bigquery.WriteAppend, Create: bigquery.CreateNever}, nil},
+		{"empty", "if_needed", bq.CopyDisposition{Write: bigquery.WriteEmpty, Create: bigquery.CreateIfNeeded}, nil},
+		{"merge", "", bq.CopyDisposition{}, bq.ErrUnknownDisposition},
+		{"", "always", bq.CopyDisposition{}, bq.ErrUnknownDisposition},
+	}
+	for _, tt := range tests {
+		got, err := bq.ParseCopyDisposition(tt.write, tt.create)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("ParseCopyDisposition(%q, %q) error = %v, want %v", tt.write, tt.create, err, tt.err)
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("ParseCopyDisposition(%q, %q) = %+v, want %+v", tt.write, tt.create, got, tt.want)
+		}
+	}
+}
+
+func TestCopyToRaw_Disposition(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+
+	_, err = to.CopyToRaw(ctx, false)
+	rtx.Must(err, "CopyToRaw failed")
+	to.CopyDisposition, err = bq.ParseCopyDisposition("append", "never")
+	rtx.Must(err, "ParseCopyDisposition failed")
+	_, err = to.CopyToRaw(ctx, false)
+	rtx.Must(err, "CopyToRaw failed")
+
+	copies := c.Copies()
+	if len(copies) != 2 {
+		t.Fatal("Wrong copies", copies)
+	}
+	if copies[0].WriteDisposition != bigquery.WriteTruncate || copies[0].CreateDisposition != bigquery.CreateIfNeeded {
+		t.Error("Wrong default disposition", copies[0].WriteDisposition, copies[0].CreateDisposition)
+	}
+	if copies[1].WriteDisposition != bigquery.WriteAppend || copies[1].CreateDisposition != bigquery.CreateNever {
+		t.Error("Wrong disposition", copies[1].WriteDisposition, copies[1].CreateDisposition)
+	}
+}
@@ -1,3 +1,4 @@
 package bq
 
 var DedupQuery = dedupQuery
+var CountQuery = countQuery
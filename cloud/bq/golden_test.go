@@ -0,0 +1,12 @@
+package bq_test
+
+import (
+	"testing"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqtest"
+)
+
+func TestGoldenQueries(t *testing.T) {
+	bqtest.CheckGolden(t, "testdata/golden", bq.DefaultNaming)
+}
@@ -0,0 +1,45 @@
+package bq
+
+import (
+	"strings"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// maxLabelLength is the BigQuery limit on label keys and values.
+const maxLabelLength = 63
+
+// labelValue converts s to a valid BigQuery label value, which may only
+// contain lowercase letters, digits, underscores and dashes.
+func labelValue(s string) string {
+	s = strings.ToLower(s)
+	b := strings.Builder{}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	v := b.String()
+	if len(v) > maxLabelLength {
+		v = v[len(v)-maxLabelLength:]
+	}
+	return v
+}
+
+// JobLabels returns the labels for BigQuery jobs acting on the job's
+// partition, so that BigQuery costs and audit logs can be attributed to
+// datatypes, dates and parser releases.  The version is omitted if empty.
+func JobLabels(j tracker.Job, version string) map[string]string {
+	labels := map[string]string{
+		"gardener_experiment": labelValue(j.Experiment),
+		"gardener_datatype":   labelValue(j.Datatype),
+		"gardener_date":       j.Date.Format("2006-01-02"),
+	}
+	if version != "" {
+		labels["parser_version"] = labelValue(version)
+	}
+	return labels
+}
@@ -0,0 +1,51 @@
+package bq
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+)
+
+var (
+	locationLock sync.Mutex
+	location     string // Empty means the BigQuery default, the US multi-region.
+)
+
+// SetLocation sets the BigQuery location, e.g. "US", "EU" or
+// "europe-west1", of the clients created by NewClient, for deployments
+// whose datasets are not in the US multi-region.  Should be called before
+// any clients are created.
+func SetLocation(loc string) {
+	locationLock.Lock()
+	defer locationLock.Unlock()
+	location = loc
+}
+
+// Location returns the BigQuery location set by SetLocation.
+func Location() string {
+	locationLock.Lock()
+	defer locationLock.Unlock()
+	return location
+}
+
+// NewClient creates a client for the project, whose jobs run in the
+// location set by SetLocation.
+func NewClient(ctx context.Context, project string) (bqiface.Client, error) {
+	c, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	c.Location = Location()
+	return bqiface.AdaptClient(c), nil
+}
+
+// setJobLocation sets the location of a job to the client's location, if
+// the job doesn't already have one.  Jobs must run in the location of the
+// datasets they read and write.
+func setJobLocation(client bqiface.Client, cfg *bigquery.JobIDConfig) {
+	if cfg != nil && cfg.Location == "" {
+		cfg.Location = client.Location()
+	}
+}
@@ -0,0 +1,69 @@
+package bq_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestSetLocation(t *testing.T) {
+	defer bq.SetLocation("")
+	bq.SetLocation("EU")
+	if bq.Location() != "EU" {
+		t.Error("Wrong location", bq.Location())
+	}
+}
+
+func TestTableOps_Location(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	c.SetLocation("europe-west1")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "gs://bucket/ndt/ndt7/2019/03/04/*")
+	rtx.Must(err, "NewTableOps failed")
+
+	prefix := job
+	prefix.Prefix = "foo"
+	prefixOps, err := bq.NewTableOpsWithClient(c, prefix, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+
+	steps := []struct {
+		name string
+		run  func() (string, error)
+	}{
+		{"load", func() (string, error) { j, err := to.LoadToTmp(ctx, false); return location(j, err) }},
+		{"dedup", func() (string, error) { j, err := to.Dedup(ctx, false); return location(j, err) }},
+		{"copy", func() (string, error) { j, err := to.CopyToRaw(ctx, false); return location(j, err) }},
+		{"prefix copy", func() (string, error) { j, err := prefixOps.CopyToRaw(ctx, false); return location(j, err) }},
+	}
+	for _, s := range steps {
+		loc, err := s.run()
+		rtx.Must(err, s.name)
+		if loc != "europe-west1" {
+			t.Errorf("%s job in wrong location %q", s.name, loc)
+		}
+	}
+
+	bqJob, err := to.CopyToRaw(ctx, false)
+	rtx.Must(err, "CopyToRaw failed")
+	found, err := to.JobFromID(ctx, bqJob.ID())
+	rtx.Must(err, "JobFromID failed")
+	if found.ID() != bqJob.ID() {
+		t.Error("Wrong job", found.ID())
+	}
+}
+
+// location returns the location of the job, or the error starting it.
+func location(j bqiface.Job, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	return j.Location(), nil
+}
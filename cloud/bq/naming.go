@@ -0,0 +1,96 @@
+package bq
+
+import (
+	"bytes"
+	"errors"
+	"text/template"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// ErrEmptyName is returned when a naming template produces an empty name.
+var ErrEmptyName = errors.New("naming template produced empty name")
+
+// Naming holds the templates for the dataset and table names used for a job.
+// Templates are text/template strings, and may use {{.Experiment}} and
+// {{.Datatype}}.  Each deployment, e.g. sandbox, staging or a third party,
+// may use its own conventions.
+type Naming struct {
+	TmpDataset   string // Dataset that jobs are loaded into, and deduplicated.
+	RawDataset   string // Dataset that jobs are copied into.
+	FinalDataset string // Dataset for final, user facing tables.
+	Table        string // Table name, used in all datasets.
+}
+
+// DefaultNaming is the naming scheme used by M-Lab deployments.
+var DefaultNaming = Naming{
+	TmpDataset:   "tmp_{{.Experiment}}",
+	RawDataset:   "raw_{{.Experiment}}",
+	FinalDataset: "{{.Experiment}}",
+	Table:        "{{.Datatype}}",
+}
+
+// WithDefaults returns a copy of n, with empty templates replaced by the
+// DefaultNaming templates.
+func (n Naming) WithDefaults() Naming {
+	if n.TmpDataset == "" {
+		n.TmpDataset = DefaultNaming.TmpDataset
+	}
+	if n.RawDataset == "" {
+		n.RawDataset = DefaultNaming.RawDataset
+	}
+	if n.FinalDataset == "" {
+		n.FinalDataset = DefaultNaming.FinalDataset
+	}
+	if n.Table == "" {
+		n.Table = DefaultNaming.Table
+	}
+	return n
+}
+
+// Names holds the dataset and table names for a single job.
+type Names struct {
+	TmpDataset   string
+	RawDataset   string
+	FinalDataset string
+	Table        string
+}
+
+func execute(tmpl string, j tracker.Job) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	out := bytes.Buffer{}
+	if err := t.Execute(&out, j); err != nil {
+		return "", err
+	}
+	if out.Len() == 0 {
+		return "", ErrEmptyName
+	}
+	return out.String(), nil
+}
+
+// Names applies the templates to the job.
+func (n Naming) Names(j tracker.Job) (Names, error) {
+	var names Names
+	var err error
+	if names.TmpDataset, err = execute(n.TmpDataset, j); err != nil {
+		return names, err
+	}
+	if names.RawDataset, err = execute(n.RawDataset, j); err != nil {
+		return names, err
+	}
+	if names.FinalDataset, err = execute(n.FinalDataset, j); err != nil {
+		return names, err
+	}
+	names.Table, err = execute(n.Table, j)
+	return names, err
+}
+
+// Validate checks that the templates are valid, by applying them to a
+// sample job.
+func (n Naming) Validate() error {
+	_, err := n.Names(tracker.Job{Experiment: "experiment", Datatype: "datatype"})
+	return err
+}
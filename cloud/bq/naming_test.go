@@ -0,0 +1,69 @@
+package bq_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestNaming(t *testing.T) {
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	names, err := bq.DefaultNaming.Names(job)
+	rtx.Must(err, "Names failed")
+	want := bq.Names{TmpDataset: "tmp_ndt", RawDataset: "raw_ndt", FinalDataset: "ndt", Table: "ndt7"}
+	if names != want {
+		t.Errorf("got %+v, want %+v", names, want)
+	}
+
+	custom := bq.Naming{TmpDataset: "staging_{{.Experiment}}_tmp", Table: "{{.Datatype}}_v2"}.WithDefaults()
+	rtx.Must(custom.Validate(), "Validate failed")
+	names, err = custom.Names(job)
+	rtx.Must(err, "Names failed")
+	want = bq.Names{TmpDataset: "staging_ndt_tmp", RawDataset: "raw_ndt", FinalDataset: "ndt", Table: "ndt7_v2"}
+	if names != want {
+		t.Errorf("got %+v, want %+v", names, want)
+	}
+
+	bad := []bq.Naming{
+		{TmpDataset: "tmp_{{.Experiment", RawDataset: "raw", FinalDataset: "final", Table: "t"},
+		{TmpDataset: "tmp_{{.Foo}}", RawDataset: "raw", FinalDataset: "final", Table: "t"},
+		{TmpDataset: "tmp", RawDataset: "raw", FinalDataset: "final", Table: ""},
+	}
+	for _, n := range bad {
+		if n.Validate() == nil {
+			t.Errorf("Expected error for %+v", n)
+		}
+	}
+}
+
+func TestTableOpsNaming(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+	to.Names, err = bq.Naming{TmpDataset: "sandbox_tmp", RawDataset: "sandbox_raw_{{.Experiment}}",
+		FinalDataset: "sandbox", Table: "{{.Datatype}}"}.Names(job)
+	rtx.Must(err, "Names failed")
+
+	if qs := bq.DedupQuery(*to); !strings.Contains(qs, "`fake-project.sandbox_tmp.ndt7`") {
+		t.Error("Wrong dedup table:\n", qs)
+	}
+	if qs := bq.CountQuery(*to); !strings.Contains(qs, "`fake-project.sandbox_raw_ndt.ndt7`") {
+		t.Error("Wrong count table:\n", qs)
+	}
+	_, err = to.CopyToRaw(ctx, false)
+	rtx.Must(err, "CopyToRaw failed")
+	copies := c.Copies()
+	if len(copies) != 1 || copies[0].Srcs[0].FullyQualifiedName() != "fake-project:sandbox_tmp.ndt7$20190304" ||
+		copies[0].Dst.FullyQualifiedName() != "fake-project:sandbox_raw_ndt.ndt7$20190304" {
+		t.Error("Wrong copy", copies)
+	}
+}
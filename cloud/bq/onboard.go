@@ -0,0 +1,144 @@
+package bq
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// ErrInvalidSchemaRef is returned when a schema reference can't be resolved.
+var ErrInvalidSchemaRef = errors.New("invalid schema reference")
+
+// Onboarder creates the tmp_ and raw_ datasets and tables for a new
+// experiment/datatype.
+type Onboarder struct {
+	client  bqiface.Client
+	project string
+	naming  Naming
+
+	// TmpExpiration is the partition expiration for tmp tables.  Zero means
+	// partitions never expire.
+	TmpExpiration time.Duration
+	// Clustering lists the clustering columns for new tables.  May be empty.
+	Clustering []string
+}
+
+// NewOnboarder creates an Onboarder, with a 30 day tmp partition expiration.
+func NewOnboarder(client bqiface.Client, project string, naming Naming) *Onboarder {
+	return &Onboarder{client: client, project: project, naming: naming.WithDefaults(),
+		TmpExpiration: 30 * 24 * time.Hour}
+}
+
+func isNotFound(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusNotFound
+}
+
+// schema resolves a schema reference, which is either a JSON schema, as
+// used by the bq command, or the dataset.table name of an existing table
+// whose schema should be copied.
+func (o *Onboarder) schema(ctx context.Context, ref string) (bigquery.Schema, error) {
+	ref = strings.TrimSpace(ref)
+	if strings.HasPrefix(ref, "[") {
+		return bigquery.SchemaFromJSON([]byte(ref))
+	}
+	parts := strings.Split(ref, ".")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, ErrInvalidSchemaRef
+	}
+	meta, err := o.client.Dataset(parts[0]).Table(parts[1]).Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return meta.Schema, nil
+}
+
+// ensureDataset creates the dataset if it does not exist.
+// Returns true if the dataset was created.
+func (o *Onboarder) ensureDataset(ctx context.Context, name string) (bool, error) {
+	ds := o.client.Dataset(name)
+	_, err := ds.Metadata(ctx)
+	if err == nil || !isNotFound(err) {
+		return false, err
+	}
+	// New datasets are created in the client's location, e.g. EU.
+	meta := bqiface.DatasetMetadata{}
+	meta.Location = o.client.Location()
+	return true, ds.Create(ctx, &meta)
+}
+
+// ensureTable creates a date partitioned table if it does not exist.
+// Returns true if the table was created.
+func (o *Onboarder) ensureTable(ctx context.Context, dataset, table string,
+	schema bigquery.Schema, expiration time.Duration) (bool, error) {
+	t := o.client.Dataset(dataset).Table(table)
+	_, err := t.Metadata(ctx)
+	if err == nil || !isNotFound(err) {
+		return false, err
+	}
+	meta := bigquery.TableMetadata{
+		Schema: schema,
+		TimePartitioning: &bigquery.TimePartitioning{
+			Type:       bigquery.DayPartitioningType,
+			Field:      "date",
+			Expiration: expiration,
+		},
+	}
+	if len(o.Clustering) > 0 {
+		meta.Clustering = &bigquery.Clustering{Fields: o.Clustering}
+	}
+	return true, t.Create(ctx, &meta)
+}
+
+// Onboard creates any missing tmp and raw datasets and tables for the
+// experiment/datatype, using the schema reference.  Existing datasets and
+// tables are not modified.  Returns the names of the created resources.
+func (o *Onboarder) Onboard(ctx context.Context, experiment, datatype, schemaRef string) ([]string, error) {
+	names, err := o.naming.Names(tracker.Job{Experiment: experiment, Datatype: datatype})
+	if err != nil {
+		return nil, err
+	}
+	schema, err := o.schema(ctx, schemaRef)
+	if err != nil {
+		return nil, err
+	}
+	if len(schema) == 0 {
+		return nil, ErrInvalidSchemaRef
+	}
+
+	created := []string{}
+	for _, ds := range []string{names.TmpDataset, names.RawDataset} {
+		ok, err := o.ensureDataset(ctx, ds)
+		if err != nil {
+			return created, err
+		}
+		if ok {
+			created = append(created, o.project+":"+ds)
+		}
+	}
+	tables := []struct {
+		dataset    string
+		expiration time.Duration
+	}{
+		{names.TmpDataset, o.TmpExpiration},
+		{names.RawDataset, 0},
+	}
+	for _, t := range tables {
+		ok, err := o.ensureTable(ctx, t.dataset, names.Table, schema, t.expiration)
+		if err != nil {
+			return created, err
+		}
+		if ok {
+			created = append(created, o.project+":"+t.dataset+"."+names.Table)
+		}
+	}
+	return created, nil
+}
@@ -0,0 +1,82 @@
+package bq_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+)
+
+func TestOnboard(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.NewClient("proj")
+	client.AddTable("raw_ndt", "ndt7", &bigquery.TableMetadata{
+		Schema: bigquery.Schema{{Name: "date", Type: bigquery.DateFieldType}, {Name: "id", Type: bigquery.StringFieldType}}})
+
+	o := bq.NewOnboarder(client, "proj", bq.DefaultNaming)
+	o.Clustering = []string{"id"}
+	created, err := o.Onboard(ctx, "foo", "bar", "raw_ndt.ndt7")
+	rtx.Must(err, "Onboard failed")
+	want := []string{"proj:tmp_foo", "proj:raw_foo", "proj:tmp_foo.bar", "proj:raw_foo.bar"}
+	if len(created) != len(want) {
+		t.Fatal("Wrong resources", created)
+	}
+	for i := range want {
+		if created[i] != want[i] {
+			t.Error("Wrong resource", created[i], want[i])
+		}
+	}
+
+	tmp, err := client.Dataset("tmp_foo").Table("bar").Metadata(ctx)
+	rtx.Must(err, "tmp table missing")
+	if tmp.TimePartitioning == nil || tmp.TimePartitioning.Field != "date" ||
+		tmp.TimePartitioning.Expiration != 30*24*time.Hour {
+		t.Error("Wrong tmp partitioning", tmp.TimePartitioning)
+	}
+	if tmp.Clustering == nil || len(tmp.Clustering.Fields) != 1 || len(tmp.Schema) != 2 {
+		t.Error("Wrong tmp table", tmp)
+	}
+	raw, err := client.Dataset("raw_foo").Table("bar").Metadata(ctx)
+	rtx.Must(err, "raw table missing")
+	if raw.TimePartitioning == nil || raw.TimePartitioning.Expiration != 0 {
+		t.Error("Wrong raw partitioning", raw.TimePartitioning)
+	}
+
+	// A second call should be a no-op.
+	created, err = o.Onboard(ctx, "foo", "bar", "raw_ndt.ndt7")
+	rtx.Must(err, "Onboard failed")
+	if len(created) != 0 {
+		t.Error("Expected nothing created", created)
+	}
+
+	// JSON schema, with an existing raw dataset.
+	created, err = o.Onboard(ctx, "foo", "baz", `[{"name": "date", "type": "DATE"}]`)
+	rtx.Must(err, "Onboard failed")
+	if len(created) != 2 || created[0] != "proj:tmp_foo.baz" {
+		t.Error("Wrong resources", created)
+	}
+}
+
+func TestOnboardErrors(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.NewClient("proj")
+	o := bq.NewOnboarder(client, "proj", bq.DefaultNaming)
+	if _, err := o.Onboard(ctx, "foo", "bar", "notatable"); !errors.Is(err, bq.ErrInvalidSchemaRef) {
+		t.Error("Expected ErrInvalidSchemaRef", err)
+	}
+	if _, err := o.Onboard(ctx, "foo", "bar", "raw_ndt.missing"); err == nil {
+		t.Error("Expected error for missing schema table")
+	}
+	if _, err := o.Onboard(ctx, "foo", "bar", "[]"); !errors.Is(err, bq.ErrInvalidSchemaRef) {
+		t.Error("Expected ErrInvalidSchemaRef", err)
+	}
+	if len(client.Queries()) != 0 {
+		t.Error("Unexpected queries")
+	}
+}
@@ -6,10 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
-	"log"
+	"sort"
+	"strings"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"google.golang.org/api/iterator"
 
 	"github.com/m-lab/go/dataset"
 
@@ -23,93 +25,309 @@ type TableOps struct {
 	Project    string
 	Date       string // Name of the partition field
 	Job        tracker.Job
+	Names      Names // Dataset and table names for the Job.
 	// map key is the single field name, value is fully qualified name
 	PartitionKeys map[string]string
 	OrderKeys     string
+	// DedupStrategy selects the dedup query.  Empty means DedupDelete.
+	DedupStrategy string
+	// CopyDisposition controls how CopyToRaw writes the raw partition.  It
+	// does not apply to jobs with a Prefix, which always replace the
+	// prefix's rows.
+	CopyDisposition CopyDisposition
+	// MaxBytesBilled caps the bytes billed by the dedup query.  BigQuery
+	// fails queries that would exceed it, without running them.  Zero
+	// means no cap.
+	MaxBytesBilled int64
+	// Labels are applied to every BigQuery job.  See JobLabels.
+	Labels map[string]string
+}
+
+// Dedup strategies.
+const (
+	// DedupDelete deletes duplicate rows in place, with DELETE and NOT EXISTS.
+	// This is cheap when there are few duplicates.
+	DedupDelete = "delete"
+	// DedupOverwrite selects the preferred rows with ROW_NUMBER, and
+	// overwrites the tmp partition with the result.  This is cheaper for
+	// snapshot heavy tables, with many duplicates.
+	DedupOverwrite = "overwrite"
+)
+
+// ErrUnknownDedupStrategy is returned for unsupported dedup strategies.
+var ErrUnknownDedupStrategy = errors.New("unknown dedup strategy")
+
+// ValidDedupStrategy returns nil if s is a supported dedup strategy.
+func ValidDedupStrategy(s string) error {
+	switch s {
+	case "", DedupDelete, DedupOverwrite:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownDedupStrategy, s)
+}
+
+// ErrCostCapExceeded is returned for queries that would bill more than the
+// configured MaxBytesBilled.
+var ErrCostCapExceeded = errors.New("cost cap exceeded")
+
+// IsCostCapExceeded returns true for BigQuery errors reporting that a query
+// would exceed its maximum bytes billed.
+func IsCostCapExceeded(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrCostCapExceeded) {
+		return true
+	}
+	var bqErr *bigquery.Error
+	if errors.As(err, &bqErr) && bqErr.Reason == "bytesBilledLimitExceeded" {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "limit for bytes billed")
 }
 
 // ErrDatatypeNotSupported is returned by Query for unsupported datatypes.
 var ErrDatatypeNotSupported = errors.New("Datatype not supported")
 
+// Datatypes lists the datatypes that TableOps supports.
+var Datatypes = []string{"annotation", "ndt7"}
+
+// ErrSchemaMismatch is returned when a table is missing columns required by a query.
+var ErrSchemaMismatch = errors.New("schema mismatch")
+
+// ErrChecksumMismatch is returned when the tmp and raw partitions differ after a copy.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
 // NewTableOps creates a suitable QueryParams for a Job.
 // The context is used to create a bigquery client, and should be kept alive while
 // the querier is in use.
 func NewTableOps(ctx context.Context, job tracker.Job, project string, loadSource string) (*TableOps, error) {
-	c, err := bigquery.NewClient(ctx, project)
+	return NewTableOpsWithNaming(ctx, job, project, loadSource, DefaultNaming)
+}
+
+// NewTableOpsWithNaming creates a suitable QueryParams for a Job, using the
+// naming scheme for dataset and table names.
+func NewTableOpsWithNaming(ctx context.Context, job tracker.Job, project string, loadSource string, naming Naming) (*TableOps, error) {
+	bqClient, err := NewClient(ctx, project)
 	if err != nil {
 		return nil, err
 	}
-	bqClient := bqiface.AdaptClient(c)
-	return NewTableOpsWithClient(bqClient, job, project, loadSource)
+	return newTableOps(bqClient, job, project, loadSource, naming)
 }
 
 // NewTableOpsWithClient creates a suitable QueryParams for a Job.
 func NewTableOpsWithClient(client bqiface.Client, job tracker.Job, project string, loadSource string) (*TableOps, error) {
-	switch job.Datatype {
-	case "annotation":
-		return &TableOps{
-			client:        client,
-			LoadSource:    loadSource,
-			Project:       project,
-			Date:          "date",
-			Job:           job,
-			PartitionKeys: map[string]string{"id": "id"},
-			OrderKeys:     "",
-		}, nil
-
-	case "ndt7":
-		return &TableOps{
-			client:        client,
-			LoadSource:    loadSource,
-			Project:       project,
-			Date:          "date",
-			Job:           job,
-			PartitionKeys: map[string]string{"id": "id"},
-			OrderKeys:     "",
-		}, nil
-
-	default:
+	return newTableOps(client, job, project, loadSource, DefaultNaming)
+}
+
+// NewTableOpsWithClientAndNaming creates a suitable QueryParams for a Job,
+// using the naming scheme.  The client may be nil if the TableOps is only used
+// to render queries, e.g. with QueryFor.
+func NewTableOpsWithClientAndNaming(client bqiface.Client, job tracker.Job, project string, loadSource string, naming Naming) (*TableOps, error) {
+	return newTableOps(client, job, project, loadSource, naming)
+}
+
+func newTableOps(client bqiface.Client, job tracker.Job, project string, loadSource string, naming Naming) (*TableOps, error) {
+	supported := false
+	for _, dt := range Datatypes {
+		supported = supported || dt == job.Datatype
+	}
+	if !supported {
 		return nil, ErrDatatypeNotSupported
 	}
+	if err := job.Validate(); err != nil {
+		return nil, err
+	}
+	names, err := naming.Names(job)
+	if err != nil {
+		return nil, err
+	}
+	return &TableOps{
+		client:        client,
+		LoadSource:    loadSource,
+		Project:       project,
+		Date:          "date",
+		Job:           job,
+		Names:         names,
+		PartitionKeys: map[string]string{"id": "id"},
+		OrderKeys:     "",
+	}, nil
 }
 
 var queryTemplates = map[string]*template.Template{
 	"dedup": dedupTemplate,
 }
 
+// Parameters returns the query parameters of the job's queries.  The
+// templates compare the partition date with @date, and the task file URLs
+// of a prefix job with @archive_prefix, rather than interpolating them, so
+// that config supplied values can't change the SQL, and the query text is
+// the same for every date, which makes it cacheable.  Table names, which
+// include the experiment, can't be parameters, so they are interpolated.
+func (to TableOps) Parameters() []bigquery.QueryParameter {
+	params := []bigquery.QueryParameter{{Name: "date", Value: to.Job.Date.Format("2006-01-02")}}
+	if to.Job.Prefix != "" {
+		params = append(params, bigquery.QueryParameter{Name: "archive_prefix", Value: to.ArchivePrefix()})
+	}
+	return params
+}
+
+// parameterComment lists the query parameters as bq query flags, so that
+// rendered queries can be run manually.
+func (to TableOps) parameterComment() string {
+	b := &strings.Builder{}
+	b.WriteString("\n# Parameters, e.g. for bq query --nouse_legacy_sql:")
+	for _, p := range to.Parameters() {
+		fmt.Fprintf(b, "\n#   --parameter=%s::%v", p.Name, p.Value)
+	}
+	return b.String()
+}
+
+// queryConfig returns the config of a query, with the job's parameters and
+// labels.
+func (to TableOps) queryConfig(qs string) bqiface.QueryConfig {
+	return bqiface.QueryConfig{QueryConfig: bigquery.QueryConfig{Q: qs, Parameters: to.Parameters(), Labels: to.Labels}}
+}
+
+// query creates a query with the job's parameters and labels.
+func (to TableOps) query(qs string) (bqiface.Query, error) {
+	if to.client == nil {
+		return nil, dataset.ErrNilBqClient
+	}
+	q := to.client.Query(qs)
+	if q == nil {
+		return nil, dataset.ErrNilQuery
+	}
+	q.SetQueryConfig(to.queryConfig(qs))
+	return q, nil
+}
+
+// queryWithParams creates a query, outside of any job, with the parameters,
+// or returns nil, like client.Query, if the query can't be created.
+func queryWithParams(client bqiface.Client, qs string, params ...bigquery.QueryParameter) bqiface.Query {
+	q := client.Query(qs)
+	if q == nil {
+		return nil
+	}
+	q.SetQueryConfig(bqiface.QueryConfig{QueryConfig: bigquery.QueryConfig{Q: qs, Parameters: params}})
+	return q
+}
+
 // makeQuery creates a query from a template.
 func (to TableOps) makeQuery(t *template.Template) string {
 	out := bytes.NewBuffer(nil)
 	err := t.Execute(out, to)
 	if err != nil {
-		log.Println(err)
+		to.Job.Logger().Errorln(err)
 	}
 	return out.String()
 }
 
 // dedupQuery returns the appropriate query in string form.
 func dedupQuery(to TableOps) string {
+	if to.DedupStrategy == DedupOverwrite {
+		return to.makeQuery(dedupOverwriteTemplate)
+	}
 	return to.makeQuery(dedupTemplate)
 }
 
+// dedupColumns returns the columns referenced by the dedup query.
+func (to TableOps) dedupColumns() []string {
+	cols := []string{to.Date, "parser.Time"}
+	keys := make([]string, 0, len(to.PartitionKeys))
+	for _, v := range to.PartitionKeys {
+		keys = append(keys, v)
+	}
+	sort.Strings(keys)
+	return append(cols, keys...)
+}
+
+// hasColumn returns true if the schema contains the column, which may be a
+// dotted path to a nested field.  BigQuery column names are case insensitive.
+func hasColumn(schema bigquery.Schema, column string) bool {
+	parts := strings.SplitN(column, ".", 2)
+	for _, f := range schema {
+		if strings.EqualFold(f.Name, parts[0]) {
+			return len(parts) == 1 || hasColumn(f.Schema, parts[1])
+		}
+	}
+	return false
+}
+
+// CheckDedupSchema checks that the tmp table has the partition field and all
+// key columns used by the dedup query.  It returns an error wrapping
+// ErrSchemaMismatch if any are missing, or an error from fetching the
+// table metadata.
+func (to TableOps) CheckDedupSchema(ctx context.Context) error {
+	if to.client == nil {
+		return dataset.ErrNilBqClient
+	}
+	table := to.client.Dataset(to.Names.TmpDataset).Table(to.Names.Table)
+	meta, err := table.Metadata(ctx)
+	if err != nil {
+		return err
+	}
+	missing := []string{}
+	for _, col := range to.dedupColumns() {
+		if !hasColumn(meta.Schema, col) {
+			missing = append(missing, col)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s is missing %s", ErrSchemaMismatch,
+			table.FullyQualifiedName(), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
 // Dedup initiates a deduplication query, and returns the bqiface.Job.
 func (to TableOps) Dedup(ctx context.Context, dryRun bool) (bqiface.Job, error) {
+	if err := ValidDedupStrategy(to.DedupStrategy); err != nil {
+		return nil, err
+	}
 	qs := dedupQuery(to)
 	if len(qs) == 0 {
 		return nil, dataset.ErrNilQuery
 	}
-	if to.client == nil {
-		return nil, dataset.ErrNilBqClient
+	q, err := to.query(qs)
+	if err != nil {
+		return nil, err
 	}
-	q := to.client.Query(qs)
-	if q == nil {
-		return nil, dataset.ErrNilQuery
+	qc := to.queryConfig(qs)
+	qc.DryRun = dryRun
+	qc.MaxBytesBilled = to.MaxBytesBilled
+	if to.DedupStrategy == DedupOverwrite {
+		// Replace the tmp partition with the selected rows.
+		qc.WriteDisposition = bigquery.WriteTruncate
+		qc.Dst = to.client.Dataset(to.Names.TmpDataset).Table(
+			fmt.Sprintf("%s$%s", to.Names.Table, to.Job.Date.Format("20060102")))
 	}
-	if dryRun {
-		qc := bqiface.QueryConfig{QueryConfig: bigquery.QueryConfig{DryRun: dryRun, Q: qs}}
-		q.SetQueryConfig(qc)
+	q.SetQueryConfig(qc)
+	setJobLocation(to.client, q.JobIDConfig())
+	return to.run(ctx, "dedup", q, dryRun)
+}
+
+// ErrNoStatistics is returned by EstimateDedup if the dry run has no job
+// statistics.
+var ErrNoStatistics = errors.New("no job statistics")
+
+// EstimateDedup dry runs the dedup query, and returns the bytes it would
+// process.  The tmp partition doesn't exist until the job is loaded, so the
+// query reads the raw partition of an earlier run instead, which is
+// usually about the same size.  Nothing is billed or written.
+func (to TableOps) EstimateDedup(ctx context.Context) (int64, error) {
+	raw := to
+	raw.Names.TmpDataset = to.Names.RawDataset
+	raw.MaxBytesBilled = 0
+	job, err := raw.Dedup(ctx, true)
+	if err != nil {
+		return 0, err
+	}
+	status := job.LastStatus()
+	if status == nil || status.Statistics == nil {
+		return 0, ErrNoStatistics
 	}
-	return q.Run(ctx)
+	return status.Statistics.TotalBytesProcessed, nil
 }
 
 // LoadToTmp loads the tmp_ exp table from GCS files.
@@ -125,22 +343,25 @@ func (to TableOps) LoadToTmp(ctx context.Context, dryRun bool) (bqiface.Job, err
 	gcsRef.SourceFormat = bigquery.JSON
 
 	dest := to.client.
-		Dataset("tmp_" + to.Job.Experiment).
-		Table(to.Job.Datatype)
+		Dataset(to.Names.TmpDataset).
+		Table(to.Names.Table)
 	if dest == nil {
 		return nil, ErrTableNotFound
 	}
 	loader := dest.LoaderFrom(gcsRef)
 	loadConfig := bqiface.LoadConfig{}
 	loadConfig.WriteDisposition = bigquery.WriteAppend
+	loadConfig.Labels = to.Labels
 	loadConfig.Dst = dest
 	loadConfig.Src = gcsRef
 	loader.SetLoadConfig(loadConfig)
+	setJobLocation(to.client, loader.JobIDConfig())
 
 	return loader.Run(ctx)
 }
 
-// CopyToRaw copies the tmp_ job partition to the raw_ job partition.
+// CopyToRaw copies the tmp_ job partition to the raw_ job partition.  For
+// jobs with a Prefix, only the rows from the prefix's task files are replaced.
 func (to TableOps) CopyToRaw(ctx context.Context, dryRun bool) (bqiface.Job, error) {
 	if dryRun {
 		return nil, errors.New("dryrun not implemented")
@@ -148,22 +369,45 @@ func (to TableOps) CopyToRaw(ctx context.Context, dryRun bool) (bqiface.Job, err
 	if to.client == nil {
 		return nil, dataset.ErrNilBqClient
 	}
-	tableName := to.Job.Datatype + "$" + to.Job.Date.Format("20060102")
-	src := to.client.Dataset("tmp_" + to.Job.Experiment).Table(tableName)
-	dest := to.client.Dataset("raw_" + to.Job.Experiment).Table(tableName)
+	if to.Job.Prefix != "" {
+		to.Job.Logger().Println("Replacing", to.ArchivePrefix(), "rows in", to.Names.RawDataset)
+		q, err := to.query(to.makeQuery(copyPrefixTemplate))
+		if err != nil {
+			return nil, err
+		}
+		setJobLocation(to.client, q.JobIDConfig())
+		return to.run(ctx, "copy_prefix", q, false)
+	}
+	tableName := to.Names.Table + "$" + to.Job.Date.Format("20060102")
+	src := to.client.Dataset(to.Names.TmpDataset).Table(tableName)
+	dest := to.client.Dataset(to.Names.RawDataset).Table(tableName)
+	to.Job.Logger().Println("Copying", src.FullyQualifiedName(), "to", dest.FullyQualifiedName())
 
 	copier := dest.CopierFrom(src)
+	d := to.CopyDisposition.withDefaults()
 	config := bqiface.CopyConfig{}
-	config.WriteDisposition = bigquery.WriteTruncate
+	config.WriteDisposition = d.Write
+	config.CreateDisposition = d.Create
+	config.Labels = to.Labels
 	config.Dst = dest
 	config.Srcs = append(config.Srcs, src)
 	copier.SetCopyConfig(config)
+	setJobLocation(to.client, copier.JobIDConfig())
 	return copier.Run(ctx)
 }
 
-// TODO get the tmp_ and raw_ from the job Target?
-const tmpTable = "`{{.Project}}.tmp_{{.Job.Experiment}}.{{.Job.Datatype}}`"
-const rawTable = "`{{.Project}}.raw_{{.Job.Experiment}}.{{.Job.Datatype}}`"
+const tmpTable = "`{{.Project}}.{{.Names.TmpDataset}}.{{.Names.Table}}`"
+const rawTable = "`{{.Project}}.{{.Names.RawDataset}}.{{.Names.Table}}`"
+
+// prefixClause limits a query to the rows parsed from the task files of a
+// job with a Prefix.  It follows a WHERE clause on the partition date.
+const prefixClause = `{{if .Job.Prefix}}
+AND parser.ArchiveURL LIKE CONCAT(@archive_prefix, "%"){{end}}`
+
+// ArchivePrefix returns the ArchiveURL prefix of the job's task files.
+func (to TableOps) ArchivePrefix() string {
+	return to.Job.Path()
+}
 
 var dedupTemplate = template.Must(template.New("").Parse(`
 #standardSQL
@@ -173,7 +417,7 @@ var dedupTemplate = template.Must(template.New("").Parse(`
 # The query is very cheap if there are no duplicates.
 DELETE
 FROM ` + tmpTable + ` AS target
-WHERE {{.Date}} = "{{.Job.Date.Format "2006-01-02"}}"
+WHERE {{.Date}} = @date` + prefixClause + `
 # This identifies all rows that don't match rows to preserve.
 AND NOT EXISTS (
   # This creates list of rows to preserve, based on key and priority.
@@ -188,7 +432,7 @@ AND NOT EXISTS (
       ) row_number
       FROM (
         SELECT * FROM ` + tmpTable + `
-        WHERE {{.Date}} = "{{.Job.Date.Format "2006-01-02"}}"
+        WHERE {{.Date}} = @date` + prefixClause + `
       )
     )
     WHERE row_number = 1
@@ -201,14 +445,281 @@ AND NOT EXISTS (
     target.parser.Time = keep.Time
 )`))
 
+// dedupSelect selects the preferred row for each key in the tmp partition.
+const dedupSelect = `SELECT * EXCEPT(row_number) FROM (
+  SELECT
+    *,
+    ROW_NUMBER() OVER (
+      PARTITION BY {{range $k, $v := .PartitionKeys}}{{$v}}, {{end}}date
+      ORDER BY {{.OrderKeys}} parser.Time DESC
+    ) row_number
+  FROM ` + tmpTable + `
+  WHERE {{.Date}} = @date` + prefixClause + `
+)
+WHERE row_number = 1`
+
+var dedupOverwriteTemplate = template.Must(template.New("").Parse(`
+#standardSQL
+# Select the preferred row for each key, based on priority ordering.  The
+# result overwrites the tmp partition, so this costs a single scan of the
+# partition, regardless of the number of duplicates.
+` + dedupSelect))
+
+var countTemplate = template.Must(template.New("").Parse(`
+#standardSQL
+# Count the task files and rows (tests) in the raw partition.
+SELECT COUNT(DISTINCT parser.ArchiveURL) AS Files, COUNT(*) AS Rows
+FROM ` + rawTable + `
+WHERE {{.Date}} = @date` + prefixClause))
+
+// countQuery returns the raw partition count query in string form.
+func countQuery(to TableOps) string {
+	return to.makeQuery(countTemplate)
+}
+
+var countTmpTemplate = template.Must(template.New("").Parse(`
+#standardSQL
+# Count the rows in the tmp partition.
+SELECT COUNT(*) AS Rows
+FROM ` + tmpTable + `
+WHERE {{.Date}} = @date` + prefixClause))
+
+// CountTmp queries the number of rows in the tmp_ job partition.
+func (to TableOps) CountTmp(ctx context.Context) (int64, error) {
+	q, err := to.query(to.makeQuery(countTmpTemplate))
+	if err != nil {
+		return 0, err
+	}
+	it, err := to.read(ctx, "count_tmp", q)
+	if err != nil {
+		return 0, err
+	}
+	var counts RawCounts
+	err = it.Next(&counts)
+	return counts.Rows, err
+}
+
+// RawCounts holds the task file and row counts for a raw_ table partition.
+type RawCounts struct {
+	Files int64 // Number of distinct task files.
+	Rows  int64 // Number of rows, i.e. tests.
+}
+
+// CountRaw queries the task file and row counts in the raw_ job partition.
+func (to TableOps) CountRaw(ctx context.Context) (RawCounts, error) {
+	counts := RawCounts{}
+	q, err := to.query(countQuery(to))
+	if err != nil {
+		return counts, err
+	}
+	it, err := to.read(ctx, "count", q)
+	if err != nil {
+		return counts, err
+	}
+	err = it.Next(&counts)
+	return counts, err
+}
+
+// CountAnnotations queries the number of rows in the job date's partition
+// of an annotation table, e.g. "mlab-oti.ndt.annotation2".  The table must
+// be partitioned by date.  With a partition filter, the count only reads
+// table metadata, so it is cheap enough to poll.
+func (to TableOps) CountAnnotations(ctx context.Context, table string) (int64, error) {
+	q, err := to.query(fmt.Sprintf(`
+#standardSQL
+# Count the rows in the annotation partition for the job's date.
+SELECT COUNT(*) AS Rows
+FROM `+"`%s`"+`
+WHERE date = @date`, table))
+	if err != nil {
+		return 0, err
+	}
+	it, err := to.read(ctx, "count_annotations", q)
+	if err != nil {
+		return 0, err
+	}
+	var counts RawCounts
+	err = it.Next(&counts)
+	return counts.Rows, err
+}
+
+var checksumTemplate = template.Must(template.New("").Parse(`
+#standardSQL
+# Count the rows, and compute an order independent checksum of the key
+# columns, in both the tmp and raw partitions.
+SELECT "tmp" AS Table, COUNT(*) AS Rows,
+  IFNULL(BIT_XOR(FARM_FINGERPRINT(TO_JSON_STRING(STRUCT({{.Columns}})))), 0) AS Checksum
+FROM ` + tmpTable + `
+WHERE {{.Date}} = @date` + prefixClause + `
+UNION ALL
+SELECT "raw" AS Table, COUNT(*) AS Rows,
+  IFNULL(BIT_XOR(FARM_FINGERPRINT(TO_JSON_STRING(STRUCT({{.Columns}})))), 0) AS Checksum
+FROM ` + rawTable + `
+WHERE {{.Date}} = @date` + prefixClause))
+
+// checksumColumns returns the key columns included in the checksum.
+func (to TableOps) checksumColumns() []string {
+	cols := make([]string, 0, len(to.PartitionKeys)+1)
+	for _, v := range to.PartitionKeys {
+		cols = append(cols, v)
+	}
+	sort.Strings(cols)
+	return append(cols, "parser.Time")
+}
+
+// checksumQuery returns the copy checksum query in string form.
+func checksumQuery(to TableOps) string {
+	out := bytes.NewBuffer(nil)
+	err := checksumTemplate.Execute(out, struct {
+		TableOps
+		Columns string
+	}{to, strings.Join(to.checksumColumns(), ", ")})
+	if err != nil {
+		to.Job.Logger().Errorln(err)
+	}
+	return out.String()
+}
+
+// Checksum holds the row count and key column checksum for a partition.
+type Checksum struct {
+	Table    string // "tmp" or "raw"
+	Rows     int64
+	Checksum int64
+}
+
+// VerifyCopy compares the row counts and key column checksums of the tmp
+// and raw partitions, to detect truncated or duplicated copies.  It returns
+// an error wrapping ErrChecksumMismatch if they differ, or a query error.
+func (to TableOps) VerifyCopy(ctx context.Context) error {
+	q, err := to.query(checksumQuery(to))
+	if err != nil {
+		return err
+	}
+	it, err := to.read(ctx, "checksum", q)
+	if err != nil {
+		return err
+	}
+	sums := map[string]Checksum{}
+	for {
+		var c Checksum
+		err := it.Next(&c)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sums[c.Table] = c
+	}
+	tmp, tmpOK := sums["tmp"]
+	raw, rawOK := sums["raw"]
+	if !tmpOK || !rawOK {
+		return fmt.Errorf("%w: missing checksum rows", ErrChecksumMismatch)
+	}
+	if tmp.Rows != raw.Rows || tmp.Checksum != raw.Checksum {
+		return fmt.Errorf("%w: tmp %d rows (%x), raw %d rows (%x)", ErrChecksumMismatch,
+			tmp.Rows, tmp.Checksum, raw.Rows, raw.Checksum)
+	}
+	return nil
+}
+
+var copyPrefixTemplate = template.Must(template.New("").Parse(`
+#standardSQL
+# Replace the rows parsed from the job's task files in the raw partition with
+# those in the tmp partition, leaving the rest of the partition unchanged.
+BEGIN TRANSACTION;
+DELETE
+FROM ` + rawTable + `
+WHERE {{.Date}} = @date` + prefixClause + `;
+INSERT INTO ` + rawTable + `
+SELECT * FROM ` + tmpTable + `
+WHERE {{.Date}} = @date` + prefixClause + `;
+COMMIT TRANSACTION;`))
+
+var cleanupTemplate = template.Must(template.New("").Parse(`
+#standardSQL
+# Gardener deletes the tmp partition through the tables API, which is free.
+# This statement removes the same rows, at the cost of a partition scan.
+DELETE
+FROM ` + tmpTable + `
+WHERE {{.Date}} = @date` + prefixClause))
+
+// ErrUnknownQuery is returned by QueryFor for unknown operations.
+var ErrUnknownQuery = errors.New("unknown query operation")
+
+// QueryOps lists the operations supported by QueryFor.
+var QueryOps = []string{"dedup", "dedup_check", "count", "checksum", "cleanup", "script"}
+
+// QueryFor returns the SQL that gardener runs for the operation on the job's
+// partition, so that it can be reviewed, or run manually.  The query
+// parameters are listed in a trailing comment.
+func (to TableOps) QueryFor(op string) (string, error) {
+	switch op {
+	case "dedup":
+		if err := ValidDedupStrategy(to.DedupStrategy); err != nil {
+			return "", err
+		}
+		return dedupQuery(to) + to.parameterComment(), nil
+	case "dedup_check":
+		return to.makeQuery(dedupCheckTemplate) + to.parameterComment(), nil
+	case "count":
+		return countQuery(to) + to.parameterComment(), nil
+	case "checksum":
+		return checksumQuery(to) + to.parameterComment(), nil
+	case "cleanup":
+		return to.makeQuery(cleanupTemplate) + to.parameterComment(), nil
+	case "script":
+		return to.makeQuery(scriptTemplate) + to.parameterComment(), nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownQuery, op)
+}
+
+// JobFromID returns the existing BigQuery job with the given ID.
+func (to TableOps) JobFromID(ctx context.Context, id string) (bqiface.Job, error) {
+	if to.client == nil {
+		return nil, dataset.ErrNilBqClient
+	}
+	return to.client.JobFromIDLocation(ctx, id, to.client.Location())
+}
+
+// tmpPartition returns the tmp table partition of the job.
+func (to TableOps) tmpPartition() bqiface.Table {
+	return to.client.Dataset(to.Names.TmpDataset).Table(
+		fmt.Sprintf("%s$%s", to.Names.Table, to.Job.Date.Format("20060102")))
+}
+
 // DeleteTmp deletes the tmp table partition.
 func (to TableOps) DeleteTmp(ctx context.Context) error {
 	if to.client == nil {
 		return dataset.ErrNilBqClient
 	}
-	// TODO - name should be field in queryer.
-	tmp := to.client.Dataset("tmp_" + to.Job.Experiment).Table(
-		fmt.Sprintf("%s$%s", to.Job.Datatype, to.Job.Date.Format("20060102")))
-	log.Println("Deleting", tmp.FullyQualifiedName())
+	tmp := to.tmpPartition()
+	to.Job.Logger().Println("Deleting", tmp.FullyQualifiedName())
 	return tmp.Delete(ctx)
 }
+
+// CleanupTmp deletes the tmp table partition, unless it is already empty,
+// e.g. because an earlier attempt deleted it before failing.  It returns
+// true if the partition was already empty or missing, in which case nothing
+// is deleted.  A partition that disappears before the delete is also
+// treated as already empty.
+func (to TableOps) CleanupTmp(ctx context.Context) (bool, error) {
+	if to.client == nil {
+		return false, dataset.ErrNilBqClient
+	}
+	tmp := to.tmpPartition()
+	meta, err := tmp.Metadata(ctx)
+	if isNotFound(err) || (err == nil && meta.NumRows == 0) {
+		to.Job.Logger().Println(tmp.FullyQualifiedName(), "is already empty")
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	to.Job.Logger().Println("Deleting", meta.NumRows, "rows from", tmp.FullyQualifiedName())
+	err = tmp.Delete(ctx)
+	if isNotFound(err) {
+		return true, nil
+	}
+	return false, err
+}
@@ -2,11 +2,17 @@ package bq_test
 
 import (
 	"context"
+	"errors"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+
 	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
 	"github.com/m-lab/etl-gardener/tracker"
 	"github.com/m-lab/go/rtx"
 )
@@ -19,8 +25,8 @@ func TestTemplate(t *testing.T) {
 	if !strings.Contains(qs, "keep.id") {
 		t.Error("query should contain keep.uuid:\n", q)
 	}
-	if !strings.Contains(qs, `"2019-03-04"`) {
-		t.Error(`query should contain "2019-03-04":\n`, q)
+	if !strings.Contains(qs, "date = @date") {
+		t.Error("query should contain date = @date:\n", qs)
 	}
 	// TODO check final WHERE clause.
 	if !strings.Contains(qs, "target.parser.Time = keep.Time") {
@@ -28,6 +34,53 @@ func TestTemplate(t *testing.T) {
 	}
 }
 
+func TestCountTemplate(t *testing.T) {
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	q, err := bq.NewTableOps(context.Background(), job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+	qs := bq.CountQuery(*q)
+	if !strings.Contains(qs, "`fake-project.raw_ndt.ndt7`") {
+		t.Error("query should contain raw table name:\n", qs)
+	}
+	if !strings.Contains(qs, "date = @date") {
+		t.Error("query should contain date = @date:\n", qs)
+	}
+}
+
+func TestQueryFor(t *testing.T) {
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClientAndNaming(nil, job, "fake-project", "", bq.DefaultNaming)
+	rtx.Must(err, "NewTableOps failed")
+	want := map[string]string{
+		"dedup":       "target.parser.Time = keep.Time",
+		"dedup_check": "HAVING key_rows > 1",
+		"count":       "`fake-project.raw_ndt.ndt7`",
+		"checksum":    "FARM_FINGERPRINT",
+		"cleanup":     "DELETE\nFROM `fake-project.tmp_ndt.ndt7`",
+	}
+	for _, op := range bq.QueryOps {
+		qs, err := to.QueryFor(op)
+		rtx.Must(err, "QueryFor failed")
+		if !strings.Contains(qs, want[op]) {
+			t.Error(op, "query should contain", want[op], ":\n", qs)
+		}
+		if !strings.Contains(qs, "date = @date") {
+			t.Error(op, "query should contain date = @date:\n", qs)
+		}
+		if !strings.Contains(qs, "--parameter=date::2019-03-04") {
+			t.Error(op, "query should list the date parameter:\n", qs)
+		}
+	}
+
+	to.DedupStrategy = bq.DedupOverwrite
+	if qs, _ := to.QueryFor("dedup"); !strings.Contains(qs, "row_number = 1") || strings.Contains(qs, "DELETE") {
+		t.Error("Expected overwrite dedup query:\n", qs)
+	}
+	if _, err := to.QueryFor("drop"); !errors.Is(err, bq.ErrUnknownQuery) {
+		t.Error("Expected ErrUnknownQuery, got", err)
+	}
+}
+
 // NOTE: This validates queries against actual tables in mlab-testing.  It only
 // runs Dryrun queries, so it does not modify the tables.
 func TestValidateQueries(t *testing.T) {
@@ -57,3 +110,330 @@ func TestValidateQueries(t *testing.T) {
 		})
 	}
 }
+
+func TestTableOpsFake(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	c.AddResult("COUNT(DISTINCT parser.ArchiveURL)", bqfake.Result{
+		Rows: []interface{}{bq.RawCounts{Files: 10, Rows: 1000}}})
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "gs://bucket/ndt/ndt7/2019/03/04/*")
+	rtx.Must(err, "NewTableOps failed")
+
+	bqJob, err := to.Dedup(ctx, false)
+	rtx.Must(err, "Dedup failed")
+	if q := c.Queries(); len(q) != 1 || !strings.Contains(q[0], "DELETE") {
+		t.Error("Wrong dedup query", q)
+	}
+	found, err := to.JobFromID(ctx, bqJob.ID())
+	rtx.Must(err, "JobFromID failed")
+	if found.ID() != bqJob.ID() {
+		t.Error("Wrong job", found.ID())
+	}
+
+	counts, err := to.CountRaw(ctx)
+	rtx.Must(err, "CountRaw failed")
+	if counts.Files != 10 || counts.Rows != 1000 {
+		t.Error("Wrong counts", counts)
+	}
+
+	_, err = to.LoadToTmp(ctx, false)
+	rtx.Must(err, "LoadToTmp failed")
+	if loads := c.Loads(); len(loads) != 1 || loads[0].Dst.FullyQualifiedName() != "fake-project:tmp_ndt.ndt7" {
+		t.Error("Wrong load", loads)
+	}
+
+	_, err = to.CopyToRaw(ctx, false)
+	rtx.Must(err, "CopyToRaw failed")
+	copies := c.Copies()
+	if len(copies) != 1 || copies[0].Dst.FullyQualifiedName() != "fake-project:raw_ndt.ndt7$20190304" {
+		t.Error("Wrong copy", copies)
+	}
+
+	rtx.Must(to.DeleteTmp(ctx), "DeleteTmp failed")
+	if deleted := c.Deleted(); len(deleted) != 1 || deleted[0] != "tmp_ndt.ndt7$20190304" {
+		t.Error("Wrong delete", deleted)
+	}
+}
+
+func TestCleanupTmp(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+
+	// Missing partitions are already empty.
+	empty, err := to.CleanupTmp(ctx)
+	rtx.Must(err, "CleanupTmp failed")
+	if !empty || len(c.Deleted()) != 0 {
+		t.Error("Expected no delete for a missing partition", empty, c.Deleted())
+	}
+
+	c.AddTable("tmp_ndt", "ndt7$20190304", &bigquery.TableMetadata{NumRows: 0})
+	empty, err = to.CleanupTmp(ctx)
+	rtx.Must(err, "CleanupTmp failed")
+	if !empty || len(c.Deleted()) != 0 {
+		t.Error("Expected no delete for an empty partition", empty, c.Deleted())
+	}
+
+	c.AddTable("tmp_ndt", "ndt7$20190304", &bigquery.TableMetadata{NumRows: 10})
+	empty, err = to.CleanupTmp(ctx)
+	rtx.Must(err, "CleanupTmp failed")
+	if deleted := c.Deleted(); empty || len(deleted) != 1 || deleted[0] != "tmp_ndt.ndt7$20190304" {
+		t.Error("Wrong delete", empty, deleted)
+	}
+
+	// A retry after the delete succeeds without deleting again.
+	empty, err = to.CleanupTmp(ctx)
+	rtx.Must(err, "CleanupTmp failed")
+	if !empty || len(c.Deleted()) != 1 {
+		t.Error("Expected the retry to find the partition empty", empty, c.Deleted())
+	}
+}
+
+func TestTableOpsFakeErrors(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	c.AddResult("DELETE", bqfake.Result{Err: errors.New("quota exceeded")})
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+
+	if _, err := to.Dedup(ctx, false); err == nil || err.Error() != "quota exceeded" {
+		t.Error("Expected scripted error", err)
+	}
+	// With no scripted rows, CountRaw returns iterator.Done.
+	if _, err := to.CountRaw(ctx); err != iterator.Done {
+		t.Error("Expected iterator.Done", err)
+	}
+}
+
+func TestCheckDedupSchema(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+
+	if err := to.CheckDedupSchema(ctx); err != bqfake.ErrNotFound {
+		t.Error("Expected ErrNotFound", err)
+	}
+
+	c.AddTable("tmp_ndt", "ndt7", &bigquery.TableMetadata{Schema: bigquery.Schema{
+		{Name: "id"},
+		{Name: "date"},
+		{Name: "Parser", Schema: bigquery.Schema{{Name: "Version"}}},
+	}})
+	err = to.CheckDedupSchema(ctx)
+	if !errors.Is(err, bq.ErrSchemaMismatch) || !strings.Contains(err.Error(), "parser.Time") {
+		t.Error("Expected ErrSchemaMismatch for parser.Time", err)
+	}
+
+	c.AddTable("tmp_ndt", "ndt7", &bigquery.TableMetadata{Schema: bigquery.Schema{
+		{Name: "id"},
+		{Name: "date"},
+		{Name: "parser", Schema: bigquery.Schema{{Name: "Time"}}},
+	}})
+	rtx.Must(to.CheckDedupSchema(ctx), "CheckDedupSchema failed")
+}
+
+func TestVerifyCopy(t *testing.T) {
+	ctx := context.Background()
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	tests := []struct {
+		name     string
+		rows     []interface{}
+		err      error
+		mismatch bool
+	}{
+		{name: "match", rows: []interface{}{
+			bq.Checksum{Table: "tmp", Rows: 10, Checksum: 1234},
+			bq.Checksum{Table: "raw", Rows: 10, Checksum: 1234}}},
+		{name: "truncated", rows: []interface{}{
+			bq.Checksum{Table: "tmp", Rows: 10, Checksum: 1234},
+			bq.Checksum{Table: "raw", Rows: 9, Checksum: 1234}}, mismatch: true},
+		{name: "changed", rows: []interface{}{
+			bq.Checksum{Table: "raw", Rows: 10, Checksum: 4321},
+			bq.Checksum{Table: "tmp", Rows: 10, Checksum: 1234}}, mismatch: true},
+		{name: "missing", rows: []interface{}{
+			bq.Checksum{Table: "tmp", Rows: 10, Checksum: 1234}}, mismatch: true},
+		{name: "query error", err: errors.New("query failed")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := bqfake.NewClient("fake-project")
+			c.AddResult("FARM_FINGERPRINT", bqfake.Result{Rows: tt.rows, Err: tt.err})
+			to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+			rtx.Must(err, "NewTableOps failed")
+			err = to.VerifyCopy(ctx)
+			switch {
+			case tt.mismatch:
+				if !errors.Is(err, bq.ErrChecksumMismatch) {
+					t.Error("Expected ErrChecksumMismatch", err)
+				}
+			case tt.err != nil:
+				if err == nil || errors.Is(err, bq.ErrChecksumMismatch) {
+					t.Error("Expected query error", err)
+				}
+			case err != nil:
+				t.Error(err)
+			}
+			q := c.Queries()
+			if len(q) != 1 || !strings.Contains(q[0], "`fake-project.tmp_ndt.ndt7`") ||
+				!strings.Contains(q[0], "`fake-project.raw_ndt.ndt7`") ||
+				!strings.Contains(q[0], "STRUCT(id, parser.Time)") {
+				t.Error("Wrong checksum query", q)
+			}
+		})
+	}
+}
+
+func TestDedupOverwrite(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+	to.DedupStrategy = bq.DedupOverwrite
+
+	qs := bq.DedupQuery(*to)
+	if strings.Contains(qs, "DELETE") || !strings.Contains(qs, "ROW_NUMBER()") ||
+		!strings.Contains(qs, "PARTITION BY id, date") {
+		t.Error("Wrong overwrite query:\n", qs)
+	}
+	_, err = to.Dedup(ctx, false)
+	rtx.Must(err, "Dedup failed")
+	runs := c.QueryRuns()
+	if len(runs) != 1 {
+		t.Fatal("Expected one query", runs)
+	}
+	if runs[0].Dst == nil || runs[0].Dst.FullyQualifiedName() != "fake-project:tmp_ndt.ndt7$20190304" {
+		t.Error("Wrong destination", runs[0].Dst)
+	}
+	if runs[0].WriteDisposition != bigquery.WriteTruncate {
+		t.Error("Wrong write disposition", runs[0].WriteDisposition)
+	}
+	if p := runs[0].Parameters; len(p) != 1 || p[0].Name != "date" || p[0].Value != "2019-03-04" {
+		t.Error("Wrong parameters", p)
+	}
+
+	to.DedupStrategy = "bogus"
+	if _, err := to.Dedup(ctx, false); !errors.Is(err, bq.ErrUnknownDedupStrategy) {
+		t.Error("Expected ErrUnknownDedupStrategy", err)
+	}
+}
+
+func TestDedupCostCap(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+	to.MaxBytesBilled = 1 << 30
+
+	_, err = to.Dedup(ctx, false)
+	rtx.Must(err, "Dedup failed")
+	if runs := c.QueryRuns(); len(runs) != 1 || runs[0].MaxBytesBilled != 1<<30 {
+		t.Error("Expected a capped dedup", runs)
+	}
+
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("other"), false},
+		{bq.ErrCostCapExceeded, true},
+		{&bigquery.Error{Reason: "bytesBilledLimitExceeded"}, true},
+		{errors.New("googleapi: Error 400: Query exceeded limit for bytes billed: 1000. 10485760 or higher required."), true},
+	}
+	for _, tt := range tests {
+		if got := bq.IsCostCapExceeded(tt.err); got != tt.want {
+			t.Errorf("IsCostCapExceeded(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixJob(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+	for _, op := range bq.QueryOps {
+		if qs, _ := to.QueryFor(op); strings.Contains(qs, "ArchiveURL LIKE") {
+			t.Error(op, "query should not filter ArchiveURL:\n", qs)
+		}
+	}
+
+	job.Prefix = "20190304T15"
+	to, err = bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+	clause := `parser.ArchiveURL LIKE CONCAT(@archive_prefix, "%")`
+	for _, op := range bq.QueryOps {
+		qs, err := to.QueryFor(op)
+		rtx.Must(err, "QueryFor failed")
+		if !strings.Contains(qs, clause) {
+			t.Error(op, "query should contain", clause, ":\n", qs)
+		}
+		if !strings.Contains(qs, "--parameter=archive_prefix::gs://bucket/ndt/ndt7/2019/03/04/20190304T15") {
+			t.Error(op, "query should list the archive_prefix parameter:\n", qs)
+		}
+	}
+
+	// Copy replaces only the prefix rows, with a query, rather than a
+	// partition copy.
+	_, err = to.CopyToRaw(ctx, false)
+	rtx.Must(err, "CopyToRaw failed")
+	if len(c.Copies()) != 0 {
+		t.Error("Prefix copy should not copy the partition", c.Copies())
+	}
+	// The fake binds the parameters.
+	bound := `parser.ArchiveURL LIKE CONCAT("gs://bucket/ndt/ndt7/2019/03/04/20190304T15", "%")`
+	qs := c.Queries()
+	if len(qs) != 1 || !strings.Contains(qs[0], "INSERT INTO `fake-project.raw_ndt.ndt7`") ||
+		strings.Count(qs[0], bound) != 2 {
+		t.Error("Wrong copy query", qs)
+	}
+	want := []bigquery.QueryParameter{{Name: "date", Value: "2019-03-04"},
+		{Name: "archive_prefix", Value: "gs://bucket/ndt/ndt7/2019/03/04/20190304T15"}}
+	if runs := c.QueryRuns(); len(runs) != 1 || !reflect.DeepEqual(runs[0].Parameters, want) {
+		t.Error("Wrong copy query parameters", runs)
+	}
+
+	job.Prefix = "../2019"
+	if _, err := bq.NewTableOpsWithClient(c, job, "fake-project", ""); !errors.Is(err, tracker.ErrInvalidPrefix) {
+		t.Error("Expected ErrInvalidPrefix", err)
+	}
+}
+
+func TestEstimateDedup(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	c.AddResult("DELETE", bqfake.Result{Stats: &bigquery.JobStatistics{TotalBytesProcessed: 12345}})
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+	to.MaxBytesBilled = 1
+
+	n, err := to.EstimateDedup(ctx)
+	rtx.Must(err, "EstimateDedup failed")
+	if n != 12345 {
+		t.Error("Wrong estimate", n)
+	}
+	runs := c.QueryRuns()
+	if len(runs) != 1 || !runs[0].DryRun || runs[0].MaxBytesBilled != 0 {
+		t.Fatal("Expected an uncapped dry run", runs)
+	}
+	if q := runs[0].Q; !strings.Contains(q, "`fake-project.raw_ndt.ndt7`") || strings.Contains(q, "tmp_ndt") {
+		t.Error("Estimate should read the raw partition:\n", q)
+	}
+
+	c = bqfake.NewClient("fake-project")
+	to, err = bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+	if _, err := to.EstimateDedup(ctx); !errors.Is(err, bq.ErrNoStatistics) {
+		t.Error("Expected ErrNoStatistics", err)
+	}
+}
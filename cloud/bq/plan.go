@@ -0,0 +1,57 @@
+package bq
+
+import (
+	"fmt"
+)
+
+// PlanOps lists the operations supported by Plan.
+var PlanOps = []string{"load", "dedup", "copy", "script", "delete"}
+
+// partition returns the project:dataset.table$YYYYMMDD name of the job's
+// partition in the dataset.
+func (to TableOps) partition(project, dataset string) string {
+	return fmt.Sprintf("%s:%s.%s$%s", project, dataset, to.Names.Table, to.Job.Date.Format("20060102"))
+}
+
+// Plan describes the mutation that the operation would make for the job,
+// including any SQL, without running it, e.g. for a dry run.  The first
+// line is a summary.  The client is not used, so it may be nil.
+func (to TableOps) Plan(op string) (string, error) {
+	tmp := to.partition(to.Project, to.Names.TmpDataset)
+	raw := to.partition(to.Project, to.Names.RawDataset)
+	switch op {
+	case "load":
+		return fmt.Sprintf("load %s into %s", to.LoadSource, tmp), nil
+	case "dedup":
+		sql, err := to.QueryFor("dedup")
+		if err != nil {
+			return "", err
+		}
+		if to.DedupStrategy == DedupOverwrite {
+			return fmt.Sprintf("dedup (overwrite) %s\n%s", tmp, sql), nil
+		}
+		return fmt.Sprintf("dedup (delete) %s\n%s", tmp, sql), nil
+	case "copy":
+		if to.Job.Prefix != "" {
+			return fmt.Sprintf("replace %s rows in %s from %s\n%s",
+				to.ArchivePrefix(), raw, tmp, to.makeQuery(copyPrefixTemplate)+to.parameterComment()), nil
+		}
+		d := to.CopyDisposition.withDefaults()
+		return fmt.Sprintf("copy %s to %s (%s, %s)", tmp, raw, d.Write, d.Create), nil
+	case "script":
+		sql, err := to.QueryFor("script")
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("dedup %s, replace %s and verify, in a script\n%s", tmp, raw, sql), nil
+	case "delete":
+		return fmt.Sprintf("delete %s", tmp), nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownQuery, op)
+}
+
+// PublishPlan describes the copy that Publish would make, without running it.
+func (to TableOps) PublishPlan(target PublishTarget) string {
+	return fmt.Sprintf("copy %s to %s", to.partition(to.Project, to.Names.RawDataset),
+		to.partition(target.Project, target.Dataset))
+}
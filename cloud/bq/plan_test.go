@@ -0,0 +1,51 @@
+package bq_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestPlan(t *testing.T) {
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClientAndNaming(nil, job, "fake-project", "gs://etl-fake-project/ndt/ndt7/2019/03/04/*", bq.DefaultNaming)
+	rtx.Must(err, "NewTableOps failed")
+	want := map[string]string{
+		"load":   "load gs://etl-fake-project/ndt/ndt7/2019/03/04/* into fake-project:tmp_ndt.ndt7$20190304",
+		"dedup":  "dedup (delete) fake-project:tmp_ndt.ndt7$20190304\n",
+		"copy":   "copy fake-project:tmp_ndt.ndt7$20190304 to fake-project:raw_ndt.ndt7$20190304",
+		"delete": "delete fake-project:tmp_ndt.ndt7$20190304",
+	}
+	for _, op := range bq.PlanOps {
+		p, err := to.Plan(op)
+		rtx.Must(err, "Plan failed")
+		if !strings.HasPrefix(p, want[op]) {
+			t.Error(op, "plan should start with", want[op], ":\n", p)
+		}
+	}
+	if p, _ := to.Plan("dedup"); !strings.Contains(p, "target.parser.Time = keep.Time") {
+		t.Error("dedup plan should include the query:\n", p)
+	}
+	if _, err := to.Plan("drop"); !errors.Is(err, bq.ErrUnknownQuery) {
+		t.Error("Expected ErrUnknownQuery, got", err)
+	}
+
+	p := to.PublishPlan(bq.PublishTarget{Project: "public", Dataset: "ndt_raw"})
+	if p != "copy fake-project:raw_ndt.ndt7$20190304 to public:ndt_raw.ndt7$20190304" {
+		t.Error("Wrong publish plan", p)
+	}
+
+	job.Prefix = "20190304T15"
+	to, err = bq.NewTableOpsWithClientAndNaming(nil, job, "fake-project", "", bq.DefaultNaming)
+	rtx.Must(err, "NewTableOps failed")
+	if p, _ := to.Plan("copy"); !strings.HasPrefix(p, "replace gs://bucket/ndt/ndt7/2019/03/04/20190304T15 rows") ||
+		!strings.Contains(p, "BEGIN TRANSACTION") {
+		t.Error("Wrong prefix copy plan:\n", p)
+	}
+}
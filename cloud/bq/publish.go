@@ -0,0 +1,127 @@
+package bq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"google.golang.org/api/iterator"
+
+	"github.com/m-lab/go/dataset"
+)
+
+// ErrPublishMismatch is returned when a published partition differs from the raw partition.
+var ErrPublishMismatch = errors.New("published partition mismatch")
+
+// PublishTarget is the project and dataset that raw partitions are
+// published to, e.g. the public serving project.  The table name is the
+// same as the raw table.
+type PublishTarget struct {
+	Project string
+	Dataset string
+	// Readers must be able to read the target dataset, and RawReaders the
+	// raw dataset.  See CheckAccess.
+	Readers    []Reader
+	RawReaders []Reader
+	// FailOnDrift fails jobs whose datasets can't be read by the readers,
+	// rather than publishing them with a warning.
+	FailOnDrift bool
+}
+
+func (to TableOps) publishedTable(target PublishTarget) bqiface.Table {
+	return to.client.DatasetInProject(target.Project, target.Dataset).Table(
+		to.Names.Table + "$" + to.Job.Date.Format("20060102"))
+}
+
+// Publish copies the raw partition to the target project and dataset,
+// replacing any existing partition.
+func (to TableOps) Publish(ctx context.Context, target PublishTarget, dryRun bool) (bqiface.Job, error) {
+	if dryRun {
+		return nil, errors.New("dryrun not implemented")
+	}
+	if to.client == nil {
+		return nil, dataset.ErrNilBqClient
+	}
+	src := to.client.Dataset(to.Names.RawDataset).Table(
+		to.Names.Table + "$" + to.Job.Date.Format("20060102"))
+	dest := to.publishedTable(target)
+	to.Job.Logger().Println("Publishing", src.FullyQualifiedName(), "to", dest.FullyQualifiedName())
+
+	copier := dest.CopierFrom(src)
+	config := bqiface.CopyConfig{}
+	config.WriteDisposition = bigquery.WriteTruncate
+	config.Labels = to.Labels
+	config.Dst = dest
+	config.Srcs = append(config.Srcs, src)
+	copier.SetCopyConfig(config)
+	setJobLocation(to.client, copier.JobIDConfig())
+	return copier.Run(ctx)
+}
+
+// PublishCount is a row count for the raw or published partition, as
+// returned by the CheckPublished query.
+type PublishCount struct {
+	Table string
+	Rows  int64
+}
+
+// PublishCounts holds the row counts of the raw and published partitions.
+type PublishCounts struct {
+	Raw       int64
+	Published int64
+}
+
+// CheckPublished compares the row counts of the raw and published
+// partitions.  It returns an error wrapping ErrPublishMismatch if they
+// differ, or a query error.
+func (to TableOps) CheckPublished(ctx context.Context, target PublishTarget) (PublishCounts, error) {
+	counts := PublishCounts{}
+	q, err := to.query(fmt.Sprintf(`
+#standardSQL
+# Count the rows in the raw and published partitions.
+SELECT "raw" AS Table, COUNT(*) AS Rows
+FROM `+"`%s.%s.%s`"+`
+WHERE %s = @date
+UNION ALL
+SELECT "published" AS Table, COUNT(*) AS Rows
+FROM `+"`%s.%s.%s`"+`
+WHERE %s = @date`,
+		to.Project, to.Names.RawDataset, to.Names.Table, to.Date,
+		target.Project, target.Dataset, to.Names.Table, to.Date))
+	if err != nil {
+		return counts, err
+	}
+	it, err := to.read(ctx, "publish_check", q)
+	if err != nil {
+		return counts, err
+	}
+	found := 0
+	for {
+		var c PublishCount
+		err := it.Next(&c)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return counts, err
+		}
+		switch c.Table {
+		case "raw":
+			counts.Raw = c.Rows
+			found++
+		case "published":
+			counts.Published = c.Rows
+			found++
+		}
+	}
+	if found != 2 {
+		return counts, fmt.Errorf("%w: missing count rows", ErrPublishMismatch)
+	}
+	if counts.Raw != counts.Published {
+		return counts, fmt.Errorf("%w: raw %d rows, published %d rows",
+			ErrPublishMismatch, counts.Raw, counts.Published)
+	}
+	return counts, nil
+}
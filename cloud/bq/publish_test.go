@@ -0,0 +1,82 @@
+package bq_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestPublish(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+	target := bq.PublishTarget{Project: "public-project", Dataset: "ndt_raw"}
+
+	_, err = to.Publish(ctx, target, false)
+	rtx.Must(err, "Publish failed")
+	copies := c.Copies()
+	if len(copies) != 1 {
+		t.Fatal("Expected one copy", copies)
+	}
+	if copies[0].Dst.FullyQualifiedName() != "public-project:ndt_raw.ndt7$20190304" ||
+		copies[0].Srcs[0].FullyQualifiedName() != "fake-project:raw_ndt.ndt7$20190304" {
+		t.Error("Wrong copy", copies[0].Srcs[0].FullyQualifiedName(), copies[0].Dst.FullyQualifiedName())
+	}
+	if copies[0].WriteDisposition != bigquery.WriteTruncate {
+		t.Error("Wrong write disposition", copies[0].WriteDisposition)
+	}
+}
+
+func TestCheckPublished(t *testing.T) {
+	ctx := context.Background()
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	target := bq.PublishTarget{Project: "public-project", Dataset: "ndt_raw"}
+	tests := []struct {
+		name     string
+		rows     []interface{}
+		mismatch bool
+	}{
+		{name: "match", rows: []interface{}{
+			bq.PublishCount{Table: "raw", Rows: 10}, bq.PublishCount{Table: "published", Rows: 10}}},
+		{name: "short", rows: []interface{}{
+			bq.PublishCount{Table: "raw", Rows: 10}, bq.PublishCount{Table: "published", Rows: 8}}, mismatch: true},
+		{name: "missing", rows: []interface{}{
+			bq.PublishCount{Table: "raw", Rows: 10}}, mismatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := bqfake.NewClient("fake-project")
+			c.AddResult("`public-project.ndt_raw.ndt7`", bqfake.Result{Rows: tt.rows})
+			to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+			rtx.Must(err, "NewTableOps failed")
+			counts, err := to.CheckPublished(ctx, target)
+			if tt.mismatch {
+				if !errors.Is(err, bq.ErrPublishMismatch) {
+					t.Error("Expected ErrPublishMismatch", err)
+				}
+				return
+			}
+			rtx.Must(err, "CheckPublished failed")
+			if counts.Raw != 10 || counts.Published != 10 {
+				t.Error("Wrong counts", counts)
+			}
+			// The date is a parameter, not part of the SQL.
+			reads := c.Reads()
+			if len(reads) != 1 || strings.Contains(reads[0].Q, "2019-03-04") ||
+				!strings.Contains(reads[0].Q, "date = @date") || len(reads[0].Parameters) == 0 {
+				t.Error("Wrong query", reads)
+			}
+		})
+	}
+}
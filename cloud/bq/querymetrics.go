@@ -0,0 +1,80 @@
+package bq
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+
+	"github.com/m-lab/etl-gardener/metrics"
+)
+
+// recordQuery records the outcome, duration and bytes billed of a query
+// that started at start.  The status may be nil, e.g. for queries that are
+// read directly.
+func recordQuery(key, datatype string, start time.Time, status *bigquery.JobStatus, err error) {
+	if err == nil && status != nil {
+		err = status.Err()
+	}
+	if err != nil {
+		metrics.BQQueryCount.WithLabelValues(key, datatype, "failed").Inc()
+	} else {
+		metrics.BQQueryCount.WithLabelValues(key, datatype, "succeeded").Inc()
+	}
+	metrics.BQQueryDuration.WithLabelValues(key, datatype).Observe(time.Since(start).Seconds())
+	if status == nil || status.Statistics == nil {
+		return
+	}
+	if qs, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+		metrics.BQBytesBilled.WithLabelValues(key, datatype).Add(float64(qs.TotalBytesBilled))
+	}
+}
+
+// instrumentedJob records the outcome of a query job the first time Wait
+// returns, unless the wait was cancelled.
+type instrumentedJob struct {
+	bqiface.Job
+	key, datatype string
+	start         time.Time
+	once          sync.Once
+}
+
+// Wait implements bqiface.Job.
+func (j *instrumentedJob) Wait(ctx context.Context) (*bigquery.JobStatus, error) {
+	status, err := j.Job.Wait(ctx)
+	if ctx.Err() == nil {
+		j.once.Do(func() { recordQuery(j.key, j.datatype, j.start, status, err) })
+	}
+	return status, err
+}
+
+// run starts the query as a job, and records it under the template key.
+// Dry runs are only counted.
+func (to TableOps) run(ctx context.Context, key string, q bqiface.Query, dryRun bool) (bqiface.Job, error) {
+	dt := to.Job.Datatype
+	if dryRun {
+		metrics.BQDryRunCount.WithLabelValues(key, dt).Inc()
+		return q.Run(ctx)
+	}
+	metrics.BQQueryCount.WithLabelValues(key, dt, "started").Inc()
+	start := time.Now()
+	job, err := q.Run(ctx)
+	if err != nil {
+		recordQuery(key, dt, start, nil, err)
+		return nil, err
+	}
+	return &instrumentedJob{Job: job, key: key, datatype: dt, start: start}, nil
+}
+
+// read runs the query and returns its rows, and records it under the
+// template key.
+func (to TableOps) read(ctx context.Context, key string, q bqiface.Query) (bqiface.RowIterator, error) {
+	dt := to.Job.Datatype
+	metrics.BQQueryCount.WithLabelValues(key, dt, "started").Inc()
+	start := time.Now()
+	it, err := q.Read(ctx)
+	recordQuery(key, dt, start, nil, err)
+	return it, err
+}
@@ -0,0 +1,77 @@
+package bq_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestQueryMetrics(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	c.AddResult("DELETE", bqfake.Result{Stats: &bigquery.JobStatistics{
+		Details: &bigquery.QueryStatistics{TotalBytesBilled: 1000}}})
+	c.AddResult("COUNT(DISTINCT parser.ArchiveURL)", bqfake.Result{Err: errors.New("quota exceeded")})
+	job := tracker.NewJob("bucket", "ndt", "annotation", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+
+	// The metrics are global, so compare with the counts before the test.
+	before := map[string]float64{}
+	for _, k := range []string{"dedup/started", "dedup/succeeded", "count/started", "count/failed"} {
+		parts := strings.Split(k, "/")
+		before[k] = testutil.ToFloat64(metrics.BQQueryCount.WithLabelValues(parts[0], "annotation", parts[1]))
+	}
+	count := func(key, status string) float64 {
+		return testutil.ToFloat64(metrics.BQQueryCount.WithLabelValues(key, "annotation", status)) -
+			before[key+"/"+status]
+	}
+	billed := testutil.ToFloat64(metrics.BQBytesBilled.WithLabelValues("dedup", "annotation"))
+	dryRuns := testutil.ToFloat64(metrics.BQDryRunCount.WithLabelValues("dedup", "annotation"))
+
+	bqJob, err := to.Dedup(ctx, false)
+	rtx.Must(err, "Dedup failed")
+	if count("dedup", "started") != 1 || count("dedup", "succeeded") != 0 {
+		t.Error("Expected a started dedup")
+	}
+	// Outcomes are recorded once, when the job is waited for.
+	for i := 0; i < 2; i++ {
+		_, err = bqJob.Wait(ctx)
+		rtx.Must(err, "Wait failed")
+	}
+	if count("dedup", "succeeded") != 1 {
+		t.Error("Expected a succeeded dedup")
+	}
+	if b := testutil.ToFloat64(metrics.BQBytesBilled.WithLabelValues("dedup", "annotation")) - billed; b != 1000 {
+		t.Error("Wrong bytes billed", b)
+	}
+
+	if _, err := to.CountRaw(ctx); err == nil {
+		t.Error("Expected scripted error")
+	}
+	if count("count", "started") != 1 || count("count", "failed") != 1 {
+		t.Error("Expected a failed count")
+	}
+
+	// Dry runs are not started queries.
+	_, err = to.Dedup(ctx, true)
+	rtx.Must(err, "Dedup failed")
+	if n := testutil.ToFloat64(metrics.BQDryRunCount.WithLabelValues("dedup", "annotation")) - dryRuns; n != 1 {
+		t.Error("Wrong dry run count", n)
+	}
+	if count("dedup", "started") != 1 {
+		t.Error("Dry run should not count as started")
+	}
+}
@@ -52,6 +52,8 @@ type Detail struct {
 // AnnotatedTable binds a bigquery.Table with associated additional info.
 // It keeps track of all the info we have so far, automatically fetches
 // more data as needed, and thus avoids possibly fetching multiple times.
+// The cached info may be given a TTL, and is discarded when gardener
+// modifies the table through the AnnotatedTable.
 type AnnotatedTable struct {
 	bqiface.Table
 	dataset *dataset.Dataset // A dataset that can query the table.  May be nil.
@@ -59,17 +61,71 @@ type AnnotatedTable struct {
 	detail  *Detail
 	pInfo   *dataset.PartitionInfo
 	err     error // first error (if any) when attempting to fetch annotation
+
+	ttl     time.Duration // Zero means the cached info never expires.
+	noCache bool          // Fetch the info on every call.
+	fetched time.Time     // When the cached info was first fetched.
+
+	detailCache *TableDetailCache // Shared detail cache.  May be nil.
 }
 
+// timeNow is replaced in tests.
+var timeNow = time.Now
+
 // NewAnnotatedTable creates an AnnotatedTable
 func NewAnnotatedTable(t bqiface.Table, ds *dataset.Dataset) *AnnotatedTable {
 	return &AnnotatedTable{Table: t, dataset: ds}
 }
 
+// SetTTL sets how long the cached info, including any fetch error, is used
+// before it is fetched again.  Zero, the default, caches it for the life of
+// the AnnotatedTable.
+func (at *AnnotatedTable) SetTTL(ttl time.Duration) {
+	at.ttl = ttl
+}
+
+// SetNoCache disables caching, so that every Cached call fetches the
+// current info.
+func (at *AnnotatedTable) SetNoCache(noCache bool) {
+	at.noCache = noCache
+}
+
+// SetDetailCache shares the table's detail through c, so that tables
+// annotated for different checks don't each query the same partition.
+func (at *AnnotatedTable) SetDetailCache(c *TableDetailCache) {
+	at.detailCache = c
+}
+
+// Invalidate discards the cached info and any fetch error.  It should be
+// called whenever the table is modified.
+func (at *AnnotatedTable) Invalidate() {
+	if at.detailCache != nil {
+		at.detailCache.Invalidate(at.Table)
+	}
+	at.meta = nil
+	at.detail = nil
+	at.pInfo = nil
+	at.err = nil
+	at.fetched = time.Time{}
+}
+
+// expire invalidates the cached info if caching is disabled, or the info is
+// older than the TTL.
+func (at *AnnotatedTable) expire() {
+	now := timeNow()
+	if at.noCache || (at.ttl > 0 && !at.fetched.IsZero() && now.Sub(at.fetched) >= at.ttl) {
+		at.Invalidate()
+	}
+	if at.fetched.IsZero() {
+		at.fetched = now
+	}
+}
+
 // CachedMeta returns metadata if available.
 // If ctx is non-nil, will attempt to fetch metadata if it is not already cached.
 // Returns error if meta not available.
 func (at *AnnotatedTable) CachedMeta(ctx context.Context) (*bigquery.TableMetadata, error) {
+	at.expire()
 	if at.meta != nil {
 		return at.meta, nil
 	}
@@ -96,6 +152,7 @@ func (at *AnnotatedTable) LastModifiedTime(ctx context.Context) time.Time {
 
 // CachedDetail returns the cached detail, or fetches it if possible.
 func (at *AnnotatedTable) CachedDetail(ctx context.Context) (*Detail, error) {
+	at.expire()
 	if at.detail != nil {
 		return at.detail, nil
 	}
@@ -108,7 +165,11 @@ func (at *AnnotatedTable) CachedDetail(ctx context.Context) (*Detail, error) {
 	if ctx == nil {
 		return nil, ErrNilContext
 	}
-	at.detail, at.err = GetTableDetail(ctx, at.dataset, at.Table)
+	if at.detailCache != nil {
+		at.detail, at.err = at.detailCache.Get(ctx, at.dataset, at.Table)
+	} else {
+		at.detail, at.err = GetTableDetail(ctx, at.dataset, at.Table)
+	}
 	if at.err != nil {
 		log.Println(at.FullyQualifiedName(), at.TableID())
 	}
@@ -117,6 +178,7 @@ func (at *AnnotatedTable) CachedDetail(ctx context.Context) (*Detail, error) {
 
 // CachedPartitionInfo returns the cached PInfo, possibly fetching it if possible.
 func (at *AnnotatedTable) CachedPartitionInfo(ctx context.Context) (*dataset.PartitionInfo, error) {
+	at.expire()
 	if at.pInfo != nil {
 		return at.pInfo, nil
 	}
@@ -147,6 +209,25 @@ func (at *AnnotatedTable) CheckIsRegular(ctx context.Context) error {
 	return nil
 }
 
+// queryAndParse runs the query, and parses the first row into structPtr.
+// Returns iterator.Done if there are no rows.  Unlike
+// dataset.Dataset.QueryAndParse, this only depends on the bqiface.Client, so
+// it can be used with a fake client.
+func queryAndParse(ctx context.Context, client bqiface.Client, query string, structPtr interface{}) error {
+	if client == nil {
+		return dataset.ErrNilBqClient
+	}
+	q := client.Query(query)
+	if q == nil {
+		return dataset.ErrNilQuery
+	}
+	it, err := q.Read(ctx)
+	if err != nil {
+		return err
+	}
+	return it.Next(structPtr)
+}
+
 // GetTableDetail fetches more detailed info about a partition or table.
 // Expects table to have test_id, and task_filename fields for legacy tables,
 // but it is not true for new traceroute tables.
@@ -202,7 +283,7 @@ func GetTableDetail(ctx context.Context, dsExt *dataset.Dataset, table bqiface.T
 	} else if parts[0] == "traceroute" {
 		query = tracerouteQuery
 	}
-	err := dsExt.QueryAndParse(ctx, query, &detail)
+	err := queryAndParse(ctx, dsExt.BqClient, query, &detail)
 	if err != nil {
 		log.Println(err)
 		log.Println("Query:", query)
@@ -210,27 +291,65 @@ func GetTableDetail(ctx context.Context, dsExt *dataset.Dataset, table bqiface.T
 	return &detail, err
 }
 
-// GetTablesMatching finds all tables matching table filter
-// and collects the basic stats about each of them.
+// ErrStopWalk may be returned by a WalkTablesMatching callback to stop the
+// walk without error.
+var ErrStopWalk = errors.New("stop walking tables")
+
+// WalkTablesMatching calls f for each table in dsExt whose name matches re,
+// as the tables are listed, so that large datasets are not held in memory.
+// No annotations are fetched.  The walk stops if ctx is done, listing fails,
+// or f returns an error, and returns that error, unless it is ErrStopWalk.
+func WalkTablesMatching(ctx context.Context, dsExt *dataset.Dataset, re *regexp.Regexp,
+	f func(at *AnnotatedTable) error) error {
+	ti := dsExt.Tables(ctx)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t, err := ti.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !re.MatchString(t.TableID()) {
+			continue
+		}
+		if err := f(&AnnotatedTable{Table: t, dataset: dsExt}); err != nil {
+			if err == ErrStopWalk {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// GetTablesMatching finds all tables whose names match the filter regular
+// expression, e.g. a plain substring, and collects the basic stats about
+// each of them.
 // It performs many network operations, possibly two per table.
 // Returns slice ordered by decreasing age.
 func GetTablesMatching(ctx context.Context, dsExt *dataset.Dataset, filter string) ([]AnnotatedTable, error) {
+	re, err := regexp.Compile(filter)
+	if err != nil {
+		return nil, err
+	}
 	alt := make([]AnnotatedTable, 0)
-	ti := dsExt.Tables(ctx)
-	for t, err := ti.Next(); err == nil; t, err = ti.Next() {
-		// TODO should this be starts with?  Or a regex?
-		if strings.Contains(t.TableID(), filter) {
-			// TODO - make this run in parallel
-			at := AnnotatedTable{Table: t, dataset: dsExt}
-			_, err := at.CachedMeta(ctx)
-			if err == ErrNotRegularTable {
-				continue
-			}
-			if err != nil {
-				return nil, err
-			}
-			alt = append(alt, at)
+	err = WalkTablesMatching(ctx, dsExt, re, func(at *AnnotatedTable) error {
+		// TODO - make this run in parallel
+		_, err := at.CachedMeta(ctx)
+		if err == ErrNotRegularTable {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
+		alt = append(alt, *at)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	sort.Slice(alt[:], func(i, j int) bool {
 		return alt[i].LastModifiedTime(ctx).Before(alt[j].LastModifiedTime(ctx))
@@ -289,7 +408,7 @@ func (at *AnnotatedTable) GetPartitionInfo(ctx context.Context) (*dataset.Partit
 		WHERE partition_id = "%s" `, fullTable, parts.yyyymmdd)
 	pInfo := dataset.PartitionInfo{}
 
-	err = at.dataset.QueryAndParse(ctx, queryString, &pInfo)
+	err = queryAndParse(ctx, at.dataset.BqClient, queryString, &pInfo)
 	if err != nil {
 		// If the partition doesn't exist, just return empty Info, no error.
 		if err == iterator.Done {
@@ -306,10 +425,64 @@ const IncludeTaskFileCountCheck = false
 const testCountRequirement = 0.99 // Query updated to count DISTINCT test_ids, so this can now be much tighter.
 const taskCountRequirement = 0.99
 
+// SanityThresholds configures the size checks made before a copy.  Losses
+// are fractions of the destination count, e.g. 0.01 allows the source to
+// have 1% fewer tests than the destination.
+type SanityThresholds struct {
+	MaxTestLoss float64 // Largest allowed loss of (distinct) tests.
+	MaxTaskLoss float64 // Largest allowed loss of task files.  1 disables the check.
+}
+
+// DefaultSanityThresholds are the historical thresholds.  The task file
+// check is disabled, because in 2012, some archives contain tests that are
+// entirely redundant with tests in other archives, so they are completely
+// removed in the dedup process, but still appear in the original
+// "base_tables".
+var DefaultSanityThresholds = SanityThresholds{
+	MaxTestLoss: 1 - testCountRequirement,
+	MaxTaskLoss: 1,
+}
+
+func init() {
+	if IncludeTaskFileCountCheck {
+		DefaultSanityThresholds.MaxTaskLoss = 1 - taskCountRequirement
+	}
+}
+
+// CopyDiff describes the comparison of the source and destination tables
+// made by SanityCheckAndCopyWithThresholds, so that callers can report why
+// a copy was rejected.
+type CopyDiff struct {
+	Src          Detail
+	Dest         Detail
+	SrcModified  time.Time
+	DestModified time.Time
+	TestLoss     float64 // Fraction of destination tests missing from the source.  Negative if the source has more.
+	TaskLoss     float64 // Fraction of destination task files missing from the source.
+	Thresholds   SanityThresholds
+}
+
+// loss returns the fraction of dest missing from src.
+func loss(src, dest int) float64 {
+	if dest == 0 {
+		return 0
+	}
+	return float64(dest-src) / float64(dest)
+}
+
+func (d CopyDiff) String() string {
+	return fmt.Sprintf("src %d tests, %d tasks, modified %s; dest %d tests, %d tasks, modified %s; "+
+		"test loss %.2f%% (max %.2f%%), task loss %.2f%% (max %.2f%%)",
+		d.Src.TestCount, d.Src.TaskFileCount, d.SrcModified.Format(time.RFC3339),
+		d.Dest.TestCount, d.Dest.TaskFileCount, d.DestModified.Format(time.RFC3339),
+		100*d.TestLoss, 100*d.Thresholds.MaxTestLoss, 100*d.TaskLoss, 100*d.Thresholds.MaxTaskLoss)
+}
+
 // checkAlmostAsBig compares the current and given AnnotatedTable test counts and
-// task file counts. When the current AnnotatedTable has more than 1% fewer task files or 5%
-// fewer rows compare to the given AnnotatedTable, then a descriptive error is returned.
-func (at *AnnotatedTable) checkAlmostAsBig(ctx context.Context, other *AnnotatedTable) error {
+// task file counts, and records them in diff.  When the current AnnotatedTable has lost
+// more task files or tests than the thresholds allow, compared to the given
+// AnnotatedTable, then a descriptive error is returned.
+func (at *AnnotatedTable) checkAlmostAsBig(ctx context.Context, other *AnnotatedTable, diff *CopyDiff) error {
 	thisDetail, err := at.CachedDetail(ctx)
 	if err != nil {
 		return err
@@ -318,20 +491,17 @@ func (at *AnnotatedTable) checkAlmostAsBig(ctx context.Context, other *Annotated
 	if err != nil {
 		return err
 	}
+	diff.Src = *thisDetail
+	diff.Dest = *otherDetail
+	diff.TaskLoss = loss(thisDetail.TaskFileCount, otherDetail.TaskFileCount)
+	diff.TestLoss = loss(thisDetail.TestCount, otherDetail.TestCount)
 
-	// Check that receiver table contains at least 99% as many tasks as
-	// other table.
 	if thisDetail.TaskFileCount < otherDetail.TaskFileCount {
 		log.Printf("Warning - fewer task files: %s(%d) < %s(%d) possibly due to redundant task files.\n",
 			at.Table.FullyQualifiedName(), thisDetail.TaskFileCount,
 			other.Table.FullyQualifiedName(), otherDetail.TaskFileCount)
 	}
-
-	// NOTE: We have discovered that in 2012, some archives contain tests that are entirely
-	// redundant with tests in other archives.  This means that some archives are completely removed
-	// in the dedup process.  Since these archives appear in the original "base_tables", this check
-	// has been causing the sanity check to fail.
-	if IncludeTaskFileCountCheck && float32(thisDetail.TaskFileCount) < taskCountRequirement*float32(otherDetail.TaskFileCount) {
+	if diff.TaskLoss > diff.Thresholds.MaxTaskLoss {
 		return ErrTooFewTasks
 	}
 
@@ -340,8 +510,7 @@ func (at *AnnotatedTable) checkAlmostAsBig(ctx context.Context, other *Annotated
 			at.Table.FullyQualifiedName(), thisDetail.TestCount,
 			other.Table.FullyQualifiedName(), otherDetail.TestCount)
 	}
-	// We are now using DISTINCT test counts, so we can use a tighter bound.
-	if float32(thisDetail.TestCount) < testCountRequirement*float32(otherDetail.TestCount) {
+	if diff.TestLoss > diff.Thresholds.MaxTestLoss {
 		return ErrTooFewTests
 	}
 	return nil
@@ -399,30 +568,41 @@ func WaitForJob(ctx context.Context, job bqiface.Job, maxBackoff time.Duration)
 // higher priviledge than the reprocessing and dedupping processes.
 // TODO(gfr) Also support copying from a template instead of partition?
 func SanityCheckAndCopy(ctx context.Context, src, dest *AnnotatedTable) error {
+	_, err := SanityCheckAndCopyWithThresholds(ctx, src, dest, DefaultSanityThresholds)
+	return err
+}
+
+// SanityCheckAndCopyWithThresholds is SanityCheckAndCopy with the given size
+// thresholds.  It also returns the counts and times that were compared, which
+// describe why a copy was rejected.
+func SanityCheckAndCopyWithThresholds(ctx context.Context, src, dest *AnnotatedTable, th SanityThresholds) (CopyDiff, error) {
+	diff := CopyDiff{Thresholds: th}
 	// Extract the
 	srcParts, err := getTableParts(src.TableID())
 	if err != nil {
-		return err
+		return diff, err
 	}
 
 	destParts, err := getTableParts(dest.TableID())
 	if err != nil {
-		return err
+		return diff, err
 	}
 	if destParts.yyyymmdd != srcParts.yyyymmdd {
-		return ErrMismatchedPartitions
+		return diff, ErrMismatchedPartitions
 	}
 
-	err = src.checkAlmostAsBig(ctx, dest)
+	err = src.checkAlmostAsBig(ctx, dest, &diff)
 	if err != nil {
-		return err
+		return diff, err
 	}
 
 	err = src.checkModifiedAfter(ctx, dest)
+	diff.SrcModified = src.LastModifiedTime(ctx)
+	diff.DestModified = dest.LastModifiedTime(ctx)
 	if err != nil {
 		// TODO: Should we delete the source table here?
-		log.Printf("%s modified (%v) after %s (%v)\n", src.FullyQualifiedName(), src.LastModifiedTime(ctx), dest.FullyQualifiedName(), dest.LastModifiedTime(ctx))
-		return err
+		log.Printf("%s modified (%v) after %s (%v)\n", src.FullyQualifiedName(), diff.SrcModified, dest.FullyQualifiedName(), diff.DestModified)
+		return diff, err
 	}
 
 	copier := dest.Table.CopierFrom(src.Table)
@@ -431,19 +611,24 @@ func SanityCheckAndCopy(ctx context.Context, src, dest *AnnotatedTable) error {
 	config.Dst = dest.Table
 	config.Srcs = append(config.Srcs, src.Table)
 	copier.SetCopyConfig(config)
+	if dest.dataset != nil && dest.dataset.BqClient != nil {
+		setJobLocation(dest.dataset.BqClient, copier.JobIDConfig())
+	}
 	job, err := copier.Run(ctx)
 	if err != nil {
 		log.Println("Error Copying...", src.TableID(), "error:", err)
-		return err
+		return diff, err
 	}
 	log.Println("Start Copying...", src.TableID(), "JobID:", job.ID())
 
 	err = WaitForJob(ctx, job, 10*time.Second)
+	// The destination may have changed, even if the wait failed.
+	dest.Invalidate()
 	if err != nil {
 		log.Println("Error Waiting...", src.TableID(), "JobID:", job.ID(), "error:", err)
 	} else {
 		log.Println("Done Copying...", src.TableID(), "JobID:", job.ID())
 	}
 	log.Println("SanityCheckAndCopy Done")
-	return err
+	return diff, err
 }
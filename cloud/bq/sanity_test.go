@@ -3,15 +3,15 @@ package bq
 import (
 	"context"
 	"log"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
-	"google.golang.org/api/option"
 
-	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
 	"github.com/m-lab/go/dataset"
 )
 
@@ -99,17 +99,9 @@ func (ds *testDataset) Table(name string) bqiface.Table {
 	return tt
 }
 
-// creates a Dataset with a dry run client.
+// creates a Dataset with a fake client.
 func newTestDataset(project, ds string) dataset.Dataset {
-	ctx := context.Background()
-	dryRun, _ := cloud.DryRunClient()
-	c, err := bigquery.NewClient(ctx, project, option.WithHTTPClient(dryRun))
-	if err != nil {
-		panic(err)
-	}
-
-	bqClient := bqiface.AdaptClient(c)
-
+	bqClient := bqfake.NewClient(project)
 	return dataset.Dataset{Dataset: &testDataset{bqClient.Dataset(ds)}, BqClient: bqClient}
 }
 
@@ -142,3 +134,266 @@ func TestCachedMeta(t *testing.T) {
 	}
 
 }
+
+func newFakeDataset(c *bqfake.Client, ds string) dataset.Dataset {
+	return dataset.Dataset{Dataset: c.Dataset(ds), BqClient: c}
+}
+
+func TestCachedMetaExpiration(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	c := bqfake.NewClient("project")
+	c.AddTable("dataset", "foo", &bigquery.TableMetadata{LastModifiedTime: now})
+	ds := newFakeDataset(c, "dataset")
+	at := NewAnnotatedTable(ds.Table("foo"), &ds)
+	at.SetTTL(time.Hour)
+
+	modify := func(lmt time.Time) {
+		c.AddTable("dataset", "foo", &bigquery.TableMetadata{LastModifiedTime: lmt})
+	}
+	first := now
+	if lmt := at.LastModifiedTime(ctx); !lmt.Equal(first) {
+		t.Error("Wrong LastModifiedTime", lmt)
+	}
+
+	// Changes are not seen until the TTL expires.
+	second := now.Add(time.Minute)
+	modify(second)
+	now = now.Add(59 * time.Minute)
+	if lmt := at.LastModifiedTime(ctx); !lmt.Equal(first) {
+		t.Error("Should use cached LastModifiedTime", lmt)
+	}
+	now = now.Add(time.Minute)
+	if lmt := at.LastModifiedTime(ctx); !lmt.Equal(second) {
+		t.Error("Cached LastModifiedTime should expire", lmt)
+	}
+
+	// Invalidate discards the cache immediately.
+	third := now.Add(time.Minute)
+	modify(third)
+	at.Invalidate()
+	if lmt := at.LastModifiedTime(ctx); !lmt.Equal(third) {
+		t.Error("Invalidate should discard LastModifiedTime", lmt)
+	}
+
+	// Errors also expire.
+	missing := NewAnnotatedTable(ds.Table("bar"), &ds)
+	missing.SetTTL(time.Hour)
+	if _, err := missing.CachedMeta(ctx); err == nil {
+		t.Fatal("Expected error for missing table")
+	}
+	c.AddTable("dataset", "bar", &bigquery.TableMetadata{})
+	if _, err := missing.CachedMeta(ctx); err == nil {
+		t.Error("Error should be cached")
+	}
+	now = now.Add(time.Hour)
+	if _, err := missing.CachedMeta(ctx); err != nil {
+		t.Error("Cached error should expire", err)
+	}
+
+	// Without caching, every call fetches the metadata.
+	at.SetNoCache(true)
+	fourth := now.Add(time.Minute)
+	modify(fourth)
+	if lmt := at.LastModifiedTime(ctx); !lmt.Equal(fourth) {
+		t.Error("Should bypass cache", lmt)
+	}
+}
+
+func TestSanityCheckAndCopyFake(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	c := bqfake.NewClient("project")
+	c.AddTable("dataset", "foo_19990101", &bigquery.TableMetadata{LastModifiedTime: now})
+	c.AddTable("dataset", "foo$19990101", &bigquery.TableMetadata{LastModifiedTime: now.Add(-time.Hour)})
+	c.AddResult("`dataset.foo_19990101`", bqfake.Result{Rows: []interface{}{Detail{TaskFileCount: 10, TestCount: 1000}}})
+	c.AddResult("`dataset.foo`", bqfake.Result{Rows: []interface{}{Detail{TaskFileCount: 10, TestCount: 995}}})
+	ds := newFakeDataset(c, "dataset")
+
+	src := NewAnnotatedTable(ds.Table("foo_19990101"), &ds)
+	dest := NewAnnotatedTable(ds.Table("foo$19990101"), &ds)
+	err := SanityCheckAndCopy(ctx, src, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copies := c.Copies()
+	if len(copies) != 1 || copies[0].Dst.TableID() != "foo$19990101" ||
+		copies[0].Srcs[0].TableID() != "foo_19990101" {
+		t.Error("Wrong copy", copies)
+	}
+	if copies[0].WriteDisposition != bigquery.WriteTruncate {
+		t.Error("Should truncate destination", copies[0].WriteDisposition)
+	}
+	if dest.meta != nil || dest.detail != nil {
+		t.Error("Copy should invalidate the destination cache")
+	}
+
+	// The destination has too many more tests.
+	c = bqfake.NewClient("project")
+	c.AddTable("dataset", "foo_19990101", &bigquery.TableMetadata{LastModifiedTime: now})
+	c.AddResult("`dataset.foo_19990101`", bqfake.Result{Rows: []interface{}{Detail{TaskFileCount: 10, TestCount: 900}}})
+	c.AddResult("`dataset.foo`", bqfake.Result{Rows: []interface{}{Detail{TaskFileCount: 10, TestCount: 1000}}})
+	ds = newFakeDataset(c, "dataset")
+	src = NewAnnotatedTable(ds.Table("foo_19990101"), &ds)
+	dest = NewAnnotatedTable(ds.Table("foo$19990101"), &ds)
+	if err := SanityCheckAndCopy(ctx, src, dest); err != ErrTooFewTests {
+		t.Error("Expected ErrTooFewTests", err)
+	}
+
+	// The source is older than the destination.
+	c = bqfake.NewClient("project")
+	c.AddTable("dataset", "foo_19990101", &bigquery.TableMetadata{LastModifiedTime: now.Add(-time.Hour)})
+	c.AddTable("dataset", "foo$19990101", &bigquery.TableMetadata{LastModifiedTime: now})
+	c.AddResult("`dataset.foo", bqfake.Result{Rows: []interface{}{Detail{TaskFileCount: 10, TestCount: 1000}}})
+	ds = newFakeDataset(c, "dataset")
+	src = NewAnnotatedTable(ds.Table("foo_19990101"), &ds)
+	dest = NewAnnotatedTable(ds.Table("foo$19990101"), &ds)
+	if err := SanityCheckAndCopy(ctx, src, dest); err != ErrSrcOlderThanDest {
+		t.Error("Expected ErrSrcOlderThanDest", err)
+	}
+	if len(c.Copies()) != 0 {
+		t.Error("Should not copy", c.Copies())
+	}
+}
+
+func TestGetPartitionInfoFake(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("project")
+	created := time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC)
+	c.AddResult(`partition_id = "20190101"`, bqfake.Result{Rows: []interface{}{
+		dataset.PartitionInfo{PartitionID: "20190101", CreationTime: created}}})
+	ds := newFakeDataset(c, "dataset")
+
+	at := NewAnnotatedTable(ds.Table("foo$20190101"), &ds)
+	pi, err := at.CachedPartitionInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.PartitionID != "20190101" || !pi.CreationTime.Equal(created) {
+		t.Error("Wrong partition info", pi)
+	}
+	if !strings.Contains(c.Queries()[0], "[project:dataset.foo$__PARTITIONS_SUMMARY__]") {
+		t.Error("Wrong query", c.Queries())
+	}
+
+	// Missing partitions return empty info.
+	at = NewAnnotatedTable(ds.Table("foo$20190102"), &ds)
+	pi, err = at.CachedPartitionInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.PartitionID != "" {
+		t.Error("Expected empty partition info", pi)
+	}
+}
+
+func TestWalkTablesMatching(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	c := bqfake.NewClient("project")
+	c.AddTable("dataset", "ndt_20190101", &bigquery.TableMetadata{LastModifiedTime: now})
+	c.AddTable("dataset", "ndt_20190102", &bigquery.TableMetadata{LastModifiedTime: now.Add(-time.Hour)})
+	c.AddTable("dataset", "ndt_2019010", &bigquery.TableMetadata{})
+	c.AddTable("dataset", "tcpinfo_20190101", &bigquery.TableMetadata{})
+	ds := newFakeDataset(c, "dataset")
+	re := regexp.MustCompile(`^ndt_` + YYYYMMDD + `$`)
+
+	names := []string{}
+	err := WalkTablesMatching(ctx, &ds, re, func(at *AnnotatedTable) error {
+		names = append(names, at.TableID())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "ndt_20190101,ndt_20190102" {
+		t.Error("Wrong tables", names)
+	}
+
+	// ErrStopWalk stops without error.
+	n := 0
+	err = WalkTablesMatching(ctx, &ds, re, func(at *AnnotatedTable) error {
+		n++
+		return ErrStopWalk
+	})
+	if err != nil || n != 1 {
+		t.Error("Walk should stop after one table", n, err)
+	}
+
+	// The walk stops when the context is cancelled.
+	cctx, cancel := context.WithCancel(ctx)
+	n = 0
+	err = WalkTablesMatching(cctx, &ds, re, func(at *AnnotatedTable) error {
+		n++
+		cancel()
+		return nil
+	})
+	if err != context.Canceled || n != 1 {
+		t.Error("Walk should stop when cancelled", n, err)
+	}
+
+	// GetTablesMatching accepts regular expressions, and sorts by age.
+	alt, err := GetTablesMatching(ctx, &ds, `^ndt_\d{8}$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alt) != 2 || alt[0].TableID() != "ndt_20190102" {
+		t.Error("Wrong tables", alt)
+	}
+	if _, err := GetTablesMatching(ctx, &ds, `ndt_(`); err == nil {
+		t.Error("Expected regexp error")
+	}
+}
+
+func TestSanityCheckAndCopyWithThresholds(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	setup := func() (*bqfake.Client, *AnnotatedTable, *AnnotatedTable) {
+		c := bqfake.NewClient("project")
+		c.AddTable("dataset", "foo_19990101", &bigquery.TableMetadata{LastModifiedTime: now})
+		c.AddTable("dataset", "foo$19990101", &bigquery.TableMetadata{LastModifiedTime: now.Add(-time.Hour)})
+		c.AddResult("`dataset.foo_19990101`", bqfake.Result{Rows: []interface{}{Detail{TaskFileCount: 9, TestCount: 950}}})
+		c.AddResult("`dataset.foo`", bqfake.Result{Rows: []interface{}{Detail{TaskFileCount: 10, TestCount: 1000}}})
+		ds := newFakeDataset(c, "dataset")
+		return c, NewAnnotatedTable(ds.Table("foo_19990101"), &ds), NewAnnotatedTable(ds.Table("foo$19990101"), &ds)
+	}
+
+	// The defaults reject a 5% test loss, and report the counts.
+	c, src, dest := setup()
+	diff, err := SanityCheckAndCopyWithThresholds(ctx, src, dest, DefaultSanityThresholds)
+	if err != ErrTooFewTests {
+		t.Error("Expected ErrTooFewTests", err)
+	}
+	if diff.Src.TestCount != 950 || diff.Dest.TestCount != 1000 || diff.Dest.TaskFileCount != 10 {
+		t.Error("Wrong counts", diff)
+	}
+	if diff.TestLoss < 0.0499 || diff.TestLoss > 0.0501 || diff.TaskLoss < 0.099 || diff.TaskLoss > 0.101 {
+		t.Error("Wrong losses", diff)
+	}
+	if !strings.Contains(diff.String(), "test loss 5.00% (max 1.00%)") {
+		t.Error("Wrong description", diff)
+	}
+	if len(c.Copies()) != 0 {
+		t.Error("Should not copy", c.Copies())
+	}
+
+	// Looser thresholds allow the copy.
+	c, src, dest = setup()
+	diff, err = SanityCheckAndCopyWithThresholds(ctx, src, dest, SanityThresholds{MaxTestLoss: 0.1, MaxTaskLoss: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Copies()) != 1 || !diff.SrcModified.Equal(now) {
+		t.Error("Should copy", c.Copies(), diff)
+	}
+
+	// The task file check may be enabled.
+	_, src, dest = setup()
+	_, err = SanityCheckAndCopyWithThresholds(ctx, src, dest, SanityThresholds{MaxTestLoss: 0.1, MaxTaskLoss: 0.05})
+	if err != ErrTooFewTasks {
+		t.Error("Expected ErrTooFewTasks", err)
+	}
+}
@@ -0,0 +1,90 @@
+package bq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/go/dataset"
+)
+
+// ErrIncompatibleSchema is returned by PatchRawSchema when the tmp table
+// has a required field that is missing from the raw table, which can't be
+// added to a table with existing rows.
+var ErrIncompatibleSchema = errors.New("incompatible schema")
+
+// mergeSchema returns raw with the fields of tmp that it is missing
+// appended, including nested fields of records in both, and the dotted
+// names of the added fields.  Fields in both with different types are left
+// for the copy to report.
+func mergeSchema(raw, tmp bigquery.Schema, prefix string) (bigquery.Schema, []string, error) {
+	merged := make(bigquery.Schema, 0, len(raw)+len(tmp))
+	byName := make(map[string]*bigquery.FieldSchema, len(raw))
+	for _, f := range raw {
+		c := *f
+		merged = append(merged, &c)
+		byName[strings.ToLower(f.Name)] = &c
+	}
+	added := []string{}
+	for _, f := range tmp {
+		name := prefix + f.Name
+		existing, ok := byName[strings.ToLower(f.Name)]
+		if !ok {
+			if f.Required {
+				return nil, nil, fmt.Errorf("%w: required field %s is missing from raw", ErrIncompatibleSchema, name)
+			}
+			merged = append(merged, f)
+			added = append(added, name)
+			continue
+		}
+		if existing.Type == bigquery.RecordFieldType && f.Type == bigquery.RecordFieldType {
+			nested, more, err := mergeSchema(existing.Schema, f.Schema, name+".")
+			if err != nil {
+				return nil, nil, err
+			}
+			existing.Schema = nested
+			added = append(added, more...)
+		}
+	}
+	return merged, added, nil
+}
+
+// PatchRawSchema adds the nullable and repeated fields of the tmp table
+// that are missing from the raw table to the raw table, so that the copy
+// doesn't fail when the parser adds fields.  It returns the dotted names of
+// the added fields, which is empty if the schemas already match, or the raw
+// table doesn't exist yet.  With dryRun, the fields are returned but the
+// raw table is not changed.
+func (to TableOps) PatchRawSchema(ctx context.Context, dryRun bool) ([]string, error) {
+	if to.client == nil {
+		return nil, dataset.ErrNilBqClient
+	}
+	tmpMeta, err := to.client.Dataset(to.Names.TmpDataset).Table(to.Names.Table).Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	raw := to.client.Dataset(to.Names.RawDataset).Table(to.Names.Table)
+	rawMeta, err := raw.Metadata(ctx)
+	if isNotFound(err) {
+		// The copy creates the raw table with the tmp schema.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	schema, added, err := mergeSchema(rawMeta.Schema, tmpMeta.Schema, "")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", raw.FullyQualifiedName(), err)
+	}
+	if len(added) == 0 || dryRun {
+		return added, nil
+	}
+	_, err = raw.Update(ctx, bigquery.TableMetadataToUpdate{Schema: schema}, rawMeta.ETag)
+	if err != nil {
+		return nil, err
+	}
+	return added, nil
+}
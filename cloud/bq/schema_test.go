@@ -0,0 +1,83 @@
+package bq_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestPatchRawSchema(t *testing.T) {
+	ctx := context.Background()
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	raw := bigquery.Schema{
+		{Name: "id", Type: bigquery.StringFieldType, Required: true},
+		{Name: "a", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "x", Type: bigquery.IntegerFieldType}}},
+	}
+	tmp := bigquery.Schema{
+		{Name: "id", Type: bigquery.StringFieldType, Required: true},
+		{Name: "A", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "x", Type: bigquery.IntegerFieldType},
+			{Name: "y", Type: bigquery.StringFieldType, Repeated: true}}},
+		{Name: "b", Type: bigquery.FloatFieldType},
+	}
+	tests := []struct {
+		name   string
+		raw    bigquery.Schema
+		tmp    bigquery.Schema
+		dryRun bool
+		added  []string
+		err    error
+	}{
+		{name: "additive", raw: raw, tmp: tmp, added: []string{"A.y", "b"}},
+		{name: "dry run", raw: raw, tmp: tmp, dryRun: true, added: []string{"A.y", "b"}},
+		{name: "current", raw: tmp, tmp: tmp, added: []string{}},
+		{name: "no raw table", tmp: tmp},
+		{name: "required", raw: raw, tmp: append(bigquery.Schema{
+			{Name: "c", Type: bigquery.StringFieldType, Required: true}}, tmp...),
+			err: bq.ErrIncompatibleSchema},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := bqfake.NewClient("fake-project")
+			c.AddTable("tmp_ndt", "ndt7", &bigquery.TableMetadata{Schema: tt.tmp})
+			if tt.raw != nil {
+				c.AddTable("raw_ndt", "ndt7", &bigquery.TableMetadata{Schema: tt.raw})
+			}
+			to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+			rtx.Must(err, "NewTableOps failed")
+			added, err := to.PatchRawSchema(ctx, tt.dryRun)
+			if !errors.Is(err, tt.err) {
+				t.Fatal("Wrong error", err)
+			}
+			if !reflect.DeepEqual(added, tt.added) {
+				t.Error("Wrong added fields", added, tt.added)
+			}
+			if tt.raw == nil {
+				return
+			}
+			meta, err := c.Dataset("raw_ndt").Table("ndt7").Metadata(ctx)
+			rtx.Must(err, "Metadata")
+			if len(tt.added) > 0 && !tt.dryRun {
+				if len(meta.Schema) != 3 || len(meta.Schema[1].Schema) != 2 || meta.Schema[1].Name != "a" {
+					t.Error("Raw schema not patched", meta.Schema)
+				}
+			} else if !reflect.DeepEqual(meta.Schema, tt.raw) {
+				t.Error("Raw schema should not change", meta.Schema)
+			}
+			if len(raw[1].Schema) != 1 {
+				t.Error("Original schema should not be changed", raw[1].Schema)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package bq
+
+import (
+	"context"
+	"html/template"
+
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+)
+
+// scriptTemplate deduplicates, copies and verifies a partition as a single
+// multi-statement job.  The deduplicated rows are held in a temp table,
+// which replaces the raw partition, or the prefix's rows, in a transaction.
+// The final SELECT reports the row counts at each step.
+var scriptTemplate = template.Must(template.New("").Parse(`
+#standardSQL
+# Deduplicate the tmp partition, replace the raw partition with the result,
+# and verify the copy, in a single script job.
+DECLARE tmp_rows, deduped_rows, raw_rows INT64;
+
+SET tmp_rows = (
+  SELECT COUNT(*) FROM ` + tmpTable + `
+  WHERE {{.Date}} = @date` + prefixClause + `);
+
+CREATE TEMP TABLE deduped AS
+` + dedupSelect + `;
+SET deduped_rows = (SELECT COUNT(*) FROM deduped);
+
+BEGIN TRANSACTION;
+DELETE
+FROM ` + rawTable + `
+WHERE {{.Date}} = @date` + prefixClause + `;
+INSERT INTO ` + rawTable + `
+SELECT * FROM deduped;
+COMMIT TRANSACTION;
+
+SET raw_rows = (
+  SELECT COUNT(*) FROM ` + rawTable + `
+  WHERE {{.Date}} = @date` + prefixClause + `);
+ASSERT raw_rows = deduped_rows AS "copy verification failed: raw row count differs from deduplicated rows";
+
+SELECT tmp_rows AS TmpRows, deduped_rows AS DedupedRows, raw_rows AS RawRows;`))
+
+// ScriptResult holds the row counts reported by each step of the script.
+type ScriptResult struct {
+	TmpRows     int64 // Rows in the tmp partition, before dedup.
+	DedupedRows int64 // Rows after dedup.
+	RawRows     int64 // Rows in the raw partition after the copy.
+}
+
+// RunScript starts a script job that deduplicates the tmp partition, copies
+// it to the raw partition, and verifies the copy, saving the round trips of
+// separate dedup, copy and checksum jobs.  The script always replaces the
+// raw partition, or the prefix's rows, so DedupStrategy and CopyDisposition
+// don't apply.  The job fails if the verification fails.  Use
+// ReadScriptResult for the counts.
+func (to TableOps) RunScript(ctx context.Context, dryRun bool) (bqiface.Job, error) {
+	qs := to.makeQuery(scriptTemplate)
+	q, err := to.query(qs)
+	if err != nil {
+		return nil, err
+	}
+	qc := to.queryConfig(qs)
+	qc.DryRun = dryRun
+	q.SetQueryConfig(qc)
+	setJobLocation(to.client, q.JobIDConfig())
+	return to.run(ctx, "script", q, dryRun)
+}
+
+// ReadScriptResult reads the result of the completed script job with the
+// ID, e.g. a resumed job.
+func (to TableOps) ReadScriptResult(ctx context.Context, id string) (ScriptResult, error) {
+	var r ScriptResult
+	job, err := to.JobFromID(ctx, id)
+	if err != nil {
+		return r, err
+	}
+	it, err := job.Read(ctx)
+	if err != nil {
+		return r, err
+	}
+	err = it.Next(&r)
+	return r, err
+}
@@ -0,0 +1,55 @@
+package bq_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestRunScript(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.NewClient("fake-project")
+	c.AddResult("CREATE TEMP TABLE deduped", bqfake.Result{
+		Rows: []interface{}{bq.ScriptResult{TmpRows: 120, DedupedRows: 100, RawRows: 100}}})
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	to, err := bq.NewTableOpsWithClient(c, job, "fake-project", "")
+	rtx.Must(err, "NewTableOps failed")
+
+	bqJob, err := to.RunScript(ctx, false)
+	rtx.Must(err, "RunScript failed")
+	runs := c.QueryRuns()
+	if len(runs) != 1 {
+		t.Fatal("Expected one script job", runs)
+	}
+	for _, want := range []string{"FROM `fake-project.tmp_ndt.ndt7`", "BEGIN TRANSACTION;",
+		"INSERT INTO `fake-project.raw_ndt.ndt7`\nSELECT * FROM deduped;", "ASSERT raw_rows = deduped_rows"} {
+		if !strings.Contains(runs[0].Q, want) {
+			t.Error("Script should contain", want, ":\n", runs[0].Q)
+		}
+	}
+	if p := runs[0].Parameters; len(p) != 1 || p[0].Value != "2019-03-04" {
+		t.Error("Wrong parameters", p)
+	}
+
+	r, err := to.ReadScriptResult(ctx, bqJob.ID())
+	rtx.Must(err, "ReadScriptResult failed")
+	if r.TmpRows != 120 || r.DedupedRows != 100 || r.RawRows != 100 {
+		t.Errorf("Wrong result %+v", r)
+	}
+	if _, err := to.ReadScriptResult(ctx, "no-such-job"); err == nil {
+		t.Error("Expected an error for an unknown job")
+	}
+
+	plan, err := to.Plan("script")
+	rtx.Must(err, "Plan failed")
+	if !strings.HasPrefix(plan, "dedup fake-project:tmp_ndt.ndt7$20190304, replace fake-project:raw_ndt.ndt7$20190304") {
+		t.Error("Wrong plan", plan)
+	}
+}
@@ -0,0 +1,132 @@
+package bq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+
+	"github.com/m-lab/go/dataset"
+
+	"github.com/m-lab/etl-gardener/metrics"
+)
+
+// ErrInvalidThrottle is returned for invalid SlotThrottle parameters.
+var ErrInvalidThrottle = errors.New("invalid slot throttle config")
+
+// SlotUsage is the result of the slot utilization query.
+type SlotUsage struct {
+	SlotMillis int64 // Slot milliseconds used in the window.
+}
+
+// SlotThrottle monitors the slot utilization of a BigQuery reservation,
+// using INFORMATION_SCHEMA, and engages when utilization reaches High,
+// e.g. when interactive users saturate the reservation.  It disengages when
+// utilization drops to Low.  It implements ops.Throttle.
+type SlotThrottle struct {
+	client      bqiface.Client
+	project     string
+	region      string // e.g. "us"
+	reservation string // Reservation ID, e.g. "admin-project:US.batch"
+	capacity    int    // Slots in the reservation.
+	high, low   float64
+
+	// Window is the period over which utilization is averaged.
+	Window time.Duration
+
+	throttled int32 // Accessed atomically.  Non-zero when engaged.
+}
+
+// NewSlotThrottle creates a SlotThrottle for the reservation, which has the
+// given slot capacity.  The high and low watermarks are fractions of
+// capacity, with 0 < low <= high.  The region defaults to "us".
+func NewSlotThrottle(client bqiface.Client, project, region, reservation string,
+	capacity int, high, low float64) (*SlotThrottle, error) {
+	if reservation == "" || capacity <= 0 || low <= 0 || low > high {
+		return nil, ErrInvalidThrottle
+	}
+	if region == "" {
+		region = "us"
+	}
+	return &SlotThrottle{client: client, project: project, region: region,
+		reservation: reservation, capacity: capacity, high: high, low: low,
+		Window: 10 * time.Minute}, nil
+}
+
+// Throttled returns true if the throttle is engaged.
+func (s *SlotThrottle) Throttled() bool {
+	return atomic.LoadInt32(&s.throttled) != 0
+}
+
+// Utilization returns the average fraction of the reservation capacity used
+// over the Window.
+func (s *SlotThrottle) Utilization(ctx context.Context) (float64, error) {
+	if s.client == nil {
+		return 0, dataset.ErrNilBqClient
+	}
+	q := s.client.Query(fmt.Sprintf(`
+#standardSQL
+# Slot milliseconds used by all jobs in the reservation during the window.
+SELECT IFNULL(SUM(period_slot_ms), 0) AS SlotMillis
+FROM `+"`%s.region-%s.INFORMATION_SCHEMA.JOBS_TIMELINE_BY_PROJECT`"+`
+WHERE reservation_id = "%s"
+AND period_start > TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL %d SECOND)`,
+		s.project, s.region, s.reservation, int(s.Window.Seconds())))
+	if q == nil {
+		return 0, dataset.ErrNilQuery
+	}
+	it, err := q.Read(ctx)
+	if err != nil {
+		return 0, err
+	}
+	usage := SlotUsage{}
+	if err := it.Next(&usage); err != nil {
+		return 0, err
+	}
+	available := float64(s.capacity) * float64(s.Window.Milliseconds())
+	return float64(usage.SlotMillis) / available, nil
+}
+
+// Update queries the utilization, and engages or disengages the throttle.
+// On error, the throttle is left unchanged.
+func (s *SlotThrottle) Update(ctx context.Context) error {
+	u, err := s.Utilization(ctx)
+	if err != nil {
+		return err
+	}
+	metrics.SlotUtilization.WithLabelValues(s.reservation).Set(u)
+	switch {
+	case u >= s.high && !s.Throttled():
+		log.Printf("Reservation %s utilization %.2f, throttling", s.reservation, u)
+		atomic.StoreInt32(&s.throttled, 1)
+	case u <= s.low && s.Throttled():
+		log.Printf("Reservation %s utilization %.2f, resuming", s.reservation, u)
+		atomic.StoreInt32(&s.throttled, 0)
+	}
+	if s.Throttled() {
+		metrics.SlotThrottled.WithLabelValues(s.reservation).Set(1)
+	} else {
+		metrics.SlotThrottled.WithLabelValues(s.reservation).Set(0)
+	}
+	return nil
+}
+
+// Run calls Update every interval, until ctx is done.
+func (s *SlotThrottle) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Update(ctx); err != nil {
+			log.Println("Slot utilization error:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
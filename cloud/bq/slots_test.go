@@ -0,0 +1,62 @@
+package bq_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+)
+
+func TestSlotThrottle(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.NewClient("proj")
+	// Each window length scripts a different utilization of the 10 slot
+	// reservation.
+	client.AddResult("INTERVAL 100 SECOND", bqfake.Result{Rows: []interface{}{bq.SlotUsage{SlotMillis: 950000}}})
+	client.AddResult("INTERVAL 200 SECOND", bqfake.Result{Rows: []interface{}{bq.SlotUsage{SlotMillis: 1600000}}})
+	client.AddResult("INTERVAL 300 SECOND", bqfake.Result{Rows: []interface{}{bq.SlotUsage{SlotMillis: 1500000}}})
+	client.AddResult("INTERVAL 400 SECOND", bqfake.Result{Err: errors.New("query failed")})
+
+	st, err := bq.NewSlotThrottle(client, "proj", "", "admin:US.batch", 10, 0.9, 0.6)
+	rtx.Must(err, "NewSlotThrottle failed")
+
+	steps := []struct {
+		window    time.Duration
+		wantErr   bool
+		throttled bool
+	}{
+		{window: 100 * time.Second, throttled: true}, // 0.95 engages.
+		{window: 200 * time.Second, throttled: true}, // 0.8 stays engaged.
+		{window: 400 * time.Second, wantErr: true, throttled: true},
+		{window: 300 * time.Second, throttled: false}, // 0.5 releases.
+		{window: 200 * time.Second, throttled: false}, // 0.8 stays released.
+	}
+	for i, s := range steps {
+		st.Window = s.window
+		err := st.Update(ctx)
+		if (err != nil) != s.wantErr {
+			t.Error(i, "Unexpected error:", err)
+		}
+		if st.Throttled() != s.throttled {
+			t.Error(i, "Expected throttled", s.throttled)
+		}
+	}
+	q := client.Queries()[0]
+	if !strings.Contains(q, "`proj.region-us.INFORMATION_SCHEMA.JOBS_TIMELINE_BY_PROJECT`") ||
+		!strings.Contains(q, `reservation_id = "admin:US.batch"`) {
+		t.Error("Wrong query:", q)
+	}
+
+	if _, err := bq.NewSlotThrottle(client, "proj", "us", "admin:US.batch", 10, 0.5, 0.9); err != bq.ErrInvalidThrottle {
+		t.Error("Expected ErrInvalidThrottle, got", err)
+	}
+	if _, err := bq.NewSlotThrottle(client, "proj", "us", "", 10, 0.9, 0.5); err != bq.ErrInvalidThrottle {
+		t.Error("Expected ErrInvalidThrottle, got", err)
+	}
+}
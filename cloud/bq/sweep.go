@@ -0,0 +1,190 @@
+package bq
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"google.golang.org/api/iterator"
+
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// TmpPartition describes a single partition of a tmp table.
+type TmpPartition struct {
+	PartitionID  string // yyyymmdd
+	Bytes        int64
+	LastModified time.Time
+}
+
+// SweepStats summarizes a Sweep.
+type SweepStats struct {
+	Partitions int   // Number of partitions deleted.
+	Bytes      int64 // Logical bytes reclaimed.
+}
+
+// TmpSweeper enforces partition expiration on tmp tables, and deletes
+// orphaned tmp partitions, e.g. those left behind by cancelled or failed
+// jobs.
+type TmpSweeper struct {
+	client     bqiface.Client
+	project    string
+	naming     Naming
+	expiration time.Duration
+	types      []tracker.Job // Only Experiment and Datatype are used.
+}
+
+// NewTmpSweeper creates a TmpSweeper for tmp tables in the project.  The
+// expiration must be positive.
+func NewTmpSweeper(client bqiface.Client, project string, naming Naming, expiration time.Duration) *TmpSweeper {
+	return &TmpSweeper{client: client, project: project, naming: naming.WithDefaults(), expiration: expiration}
+}
+
+// Add adds an experiment/datatype to be handled by Run.
+func (s *TmpSweeper) Add(experiment, datatype string) {
+	s.types = append(s.types, tracker.Job{Experiment: experiment, Datatype: datatype})
+}
+
+func (s *TmpSweeper) tmpTable(experiment, datatype string) (Names, bqiface.Table, error) {
+	names, err := s.naming.Names(tracker.Job{Experiment: experiment, Datatype: datatype})
+	if err != nil {
+		return names, nil, err
+	}
+	return names, s.client.Dataset(names.TmpDataset).Table(names.Table), nil
+}
+
+// EnforceExpiration sets the partition expiration of the tmp table for the
+// experiment/datatype, if it differs.  Returns true if the table was updated.
+func (s *TmpSweeper) EnforceExpiration(ctx context.Context, experiment, datatype string) (bool, error) {
+	_, t, err := s.tmpTable(experiment, datatype)
+	if err != nil {
+		return false, err
+	}
+	meta, err := t.Metadata(ctx)
+	if err != nil {
+		return false, err
+	}
+	if meta.TimePartitioning == nil {
+		return false, fmt.Errorf("%s is not partitioned", t.FullyQualifiedName())
+	}
+	if meta.TimePartitioning.Expiration == s.expiration {
+		return false, nil
+	}
+	tp := *meta.TimePartitioning
+	tp.Expiration = s.expiration
+	_, err = t.Update(ctx, bigquery.TableMetadataToUpdate{TimePartitioning: &tp}, meta.ETag)
+	return err == nil, err
+}
+
+// Partitions returns the partitions of the tmp table for the experiment/datatype.
+func (s *TmpSweeper) Partitions(ctx context.Context, experiment, datatype string) ([]TmpPartition, error) {
+	names, _, err := s.tmpTable(experiment, datatype)
+	if err != nil {
+		return nil, err
+	}
+	q := s.client.Query(fmt.Sprintf(`
+SELECT
+  partition_id AS PartitionID,
+  IFNULL(total_logical_bytes, 0) AS Bytes,
+  last_modified_time AS LastModified
+FROM `+"`%s.%s.INFORMATION_SCHEMA.PARTITIONS`"+`
+WHERE table_name = "%s" AND partition_id NOT IN ("__NULL__", "__UNPARTITIONED__")`,
+		s.project, names.TmpDataset, names.Table))
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parts := []TmpPartition{}
+	for {
+		var p TmpPartition
+		err := it.Next(&p)
+		if err == iterator.Done {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+}
+
+// Sweep deletes the tmp partitions for the experiment/datatype that were
+// last modified before the expiration, and whose jobs are complete according
+// to the complete function.  Returns the partitions deleted and bytes reclaimed.
+func (s *TmpSweeper) Sweep(ctx context.Context, experiment, datatype string, now time.Time,
+	complete func(tracker.Job) bool) (SweepStats, error) {
+	stats := SweepStats{}
+	parts, err := s.Partitions(ctx, experiment, datatype)
+	if err != nil {
+		return stats, err
+	}
+	names, _, err := s.tmpTable(experiment, datatype)
+	if err != nil {
+		return stats, err
+	}
+	cutoff := now.Add(-s.expiration)
+	for _, p := range parts {
+		if !p.LastModified.Before(cutoff) {
+			continue
+		}
+		date, err := time.Parse("20060102", p.PartitionID)
+		if err != nil {
+			continue
+		}
+		job := tracker.Job{Experiment: experiment, Datatype: datatype, Date: date}
+		if !complete(job) {
+			continue
+		}
+		t := s.client.Dataset(names.TmpDataset).Table(names.Table + "$" + p.PartitionID)
+		if err := t.Delete(ctx); err != nil {
+			return stats, err
+		}
+		stats.Partitions++
+		stats.Bytes += p.Bytes
+	}
+	return stats, nil
+}
+
+// TrackerComplete returns a function that reports whether a job is complete
+// according to jobs, a tracker snapshot taken once per sweep.  The bucket is
+// ignored.  Jobs that are not in the snapshot are considered complete, since
+// nothing is working on them.
+func TrackerComplete(jobs tracker.JobMap) func(tracker.Job) bool {
+	return func(job tracker.Job) bool {
+		return unfinished(jobs, job.Experiment, job.Datatype, job.Date) == ""
+	}
+}
+
+// Run enforces the expiration and sweeps the tmp tables of all added
+// datatypes every interval, until ctx is done.
+func (s *TmpSweeper) Run(ctx context.Context, tk *tracker.Tracker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, t := range s.types {
+			if _, err := s.EnforceExpiration(ctx, t.Experiment, t.Datatype); err != nil {
+				log.Println("Tmp expiration error:", t.Experiment, t.Datatype, err)
+			}
+			complete := TrackerComplete(tk.GetSnapshot().Jobs)
+			stats, err := s.Sweep(ctx, t.Experiment, t.Datatype, time.Now(), complete)
+			if err != nil {
+				log.Println("Tmp sweep error:", t.Experiment, t.Datatype, err)
+			}
+			if stats.Partitions > 0 {
+				log.Printf("Swept %d tmp partitions of %s/%s, reclaimed %d bytes",
+					stats.Partitions, t.Experiment, t.Datatype, stats.Bytes)
+				metrics.TmpPartitionsSwept.WithLabelValues(t.Experiment, t.Datatype).Add(float64(stats.Partitions))
+				metrics.TmpBytesReclaimed.WithLabelValues(t.Experiment, t.Datatype).Add(float64(stats.Bytes))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package bq_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestEnforceExpiration(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.NewClient("proj")
+	client.AddTable("tmp_ndt", "ndt7", &bigquery.TableMetadata{
+		TimePartitioning: &bigquery.TimePartitioning{Field: "date"}})
+	client.AddTable("tmp_ndt", "plain", &bigquery.TableMetadata{})
+
+	s := bq.NewTmpSweeper(client, "proj", bq.DefaultNaming, 7*24*time.Hour)
+	updated, err := s.EnforceExpiration(ctx, "ndt", "ndt7")
+	rtx.Must(err, "EnforceExpiration failed")
+	if !updated {
+		t.Error("Expected update")
+	}
+	meta, err := client.Dataset("tmp_ndt").Table("ndt7").Metadata(ctx)
+	rtx.Must(err, "Metadata failed")
+	if meta.TimePartitioning.Expiration != 7*24*time.Hour || meta.TimePartitioning.Field != "date" {
+		t.Error("Wrong partitioning", meta.TimePartitioning)
+	}
+	updated, err = s.EnforceExpiration(ctx, "ndt", "ndt7")
+	rtx.Must(err, "EnforceExpiration failed")
+	if updated {
+		t.Error("Expected no update")
+	}
+
+	if _, err := s.EnforceExpiration(ctx, "ndt", "plain"); err == nil {
+		t.Error("Expected error for unpartitioned table")
+	}
+	if _, err := s.EnforceExpiration(ctx, "ndt", "missing"); err == nil {
+		t.Error("Expected error for missing table")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 6, 30, 0, 0, 0, 0, time.UTC)
+	old := now.Add(-10 * 24 * time.Hour)
+	client := bqfake.NewClient("proj")
+	client.AddResult("INFORMATION_SCHEMA.PARTITIONS", bqfake.Result{Rows: []interface{}{
+		bq.TmpPartition{PartitionID: "20200601", Bytes: 100, LastModified: old},
+		bq.TmpPartition{PartitionID: "20200602", Bytes: 200, LastModified: old},
+		bq.TmpPartition{PartitionID: "20200603", Bytes: 400, LastModified: now.Add(-time.Hour)},
+		bq.TmpPartition{PartitionID: "20200604", Bytes: 800, LastModified: old},
+	}})
+
+	// The job for 2020-06-04 is still in flight.
+	complete := func(j tracker.Job) bool {
+		return !j.Date.Equal(time.Date(2020, 6, 4, 0, 0, 0, 0, time.UTC))
+	}
+	s := bq.NewTmpSweeper(client, "proj", bq.DefaultNaming, 7*24*time.Hour)
+	stats, err := s.Sweep(ctx, "ndt", "ndt7", now, complete)
+	rtx.Must(err, "Sweep failed")
+	if stats.Partitions != 2 || stats.Bytes != 300 {
+		t.Error("Wrong stats", stats)
+	}
+	deleted := client.Deleted()
+	if len(deleted) != 2 || deleted[0] != "tmp_ndt.ndt7$20200601" || deleted[1] != "tmp_ndt.ndt7$20200602" {
+		t.Error("Wrong deletions", deleted)
+	}
+}
+
+func TestTrackerComplete(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	job := tracker.NewJob("bucket", "ndt", "ndt7", date)
+	rtx.Must(tk.AddJob(job), "AddJob")
+
+	complete := bq.TrackerComplete(tk.GetSnapshot().Jobs)
+	if complete(tracker.Job{Experiment: "ndt", Datatype: "ndt7", Date: date}) {
+		t.Error("In flight job should not be complete")
+	}
+	if !complete(tracker.Job{Experiment: "ndt", Datatype: "ndt7", Date: date.AddDate(0, 0, 1)}) {
+		t.Error("Unknown job should be complete")
+	}
+	rtx.Must(tk.SetStatus(job, tracker.Complete, ""), "SetStatus")
+	// The earlier snapshot is unchanged.
+	if complete(tracker.Job{Experiment: "ndt", Datatype: "ndt7", Date: date}) {
+		t.Error("Snapshot should not change")
+	}
+	complete = bq.TrackerComplete(tk.GetSnapshot().Jobs)
+	if !complete(tracker.Job{Experiment: "ndt", Datatype: "ndt7", Date: date}) {
+		t.Error("Completed job should be complete")
+	}
+}
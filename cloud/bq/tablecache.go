@@ -0,0 +1,107 @@
+package bq
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+
+	"github.com/m-lab/go/dataset"
+
+	"github.com/m-lab/etl-gardener/metrics"
+)
+
+// detailEntry is a cached table detail, or the error fetching it.
+type detailEntry struct {
+	detail  *Detail
+	err     error
+	fetched time.Time
+}
+
+// TableDetailCache caches GetTableDetail results, keyed by table and
+// partition, so that sanity checks and status requests can share queries.
+// Errors are cached too, so that e.g. a missing partition is not queried on
+// every request.  It is safe for concurrent use.
+type TableDetailCache struct {
+	ttl time.Duration
+
+	lock    sync.Mutex
+	entries map[string]detailEntry // Keyed by project.dataset.table$partition
+}
+
+// NewTableDetailCache creates a TableDetailCache that keeps each detail for
+// ttl.
+func NewTableDetailCache(ttl time.Duration) *TableDetailCache {
+	return &TableDetailCache{ttl: ttl, entries: make(map[string]detailEntry)}
+}
+
+func tableKey(table bqiface.Table) string {
+	return table.ProjectID() + "." + table.DatasetID() + "." + table.TableID()
+}
+
+// get returns the cached entry for the table, unless it is older than the
+// TTL, or refresh is true, in which case it is fetched again.
+func (c *TableDetailCache) get(ctx context.Context, dsExt *dataset.Dataset, table bqiface.Table, refresh bool) detailEntry {
+	key := tableKey(table)
+	if refresh {
+		metrics.TableDetailRequests.WithLabelValues("refresh").Inc()
+	} else {
+		c.lock.Lock()
+		e, ok := c.entries[key]
+		c.lock.Unlock()
+		if ok && timeNow().Sub(e.fetched) < c.ttl {
+			metrics.TableDetailRequests.WithLabelValues("hit").Inc()
+			return e
+		}
+		metrics.TableDetailRequests.WithLabelValues("miss").Inc()
+	}
+	e := detailEntry{fetched: timeNow()}
+	e.detail, e.err = GetTableDetail(ctx, dsExt, table)
+	if e.err != nil {
+		e.detail = nil
+	}
+	// Don't cache the errors of cancelled requests.
+	if ctx.Err() == nil {
+		c.lock.Lock()
+		c.entries[key] = e
+		c.lock.Unlock()
+	}
+	return e
+}
+
+// Get returns the detail for the table or partition, from the cache if it
+// was fetched within the TTL.
+func (c *TableDetailCache) Get(ctx context.Context, dsExt *dataset.Dataset, table bqiface.Table) (*Detail, error) {
+	e := c.get(ctx, dsExt, table, false)
+	return e.detail, e.err
+}
+
+// Refresh fetches the detail for the table or partition, and caches it.
+func (c *TableDetailCache) Refresh(ctx context.Context, dsExt *dataset.Dataset, table bqiface.Table) (*Detail, error) {
+	e := c.get(ctx, dsExt, table, true)
+	return e.detail, e.err
+}
+
+// Invalidate discards the cached detail for the table or partition.  It
+// should be called whenever the table is modified.
+func (c *TableDetailCache) Invalidate(table bqiface.Table) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, tableKey(table))
+}
+
+// Prune discards the details older than the TTL, and returns the number
+// discarded.
+func (c *TableDetailCache) Prune() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := 0
+	for key, e := range c.entries {
+		if timeNow().Sub(e.fetched) >= c.ttl {
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
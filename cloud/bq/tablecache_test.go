@@ -0,0 +1,81 @@
+package bq_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/dataset"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestTableDetailCache(t *testing.T) {
+	client := bqfake.NewClient("project")
+	client.AddResult("raw_ndt.ndt7", bqfake.Result{Rows: []interface{}{
+		bq.Detail{TaskFileCount: 10, TestCount: 1000}}})
+	dsExt := &dataset.Dataset{Dataset: client.Dataset("raw_ndt"), BqClient: client}
+	table := dsExt.Table("ndt7$20200601")
+	c := bq.NewTableDetailCache(time.Hour)
+
+	d, err := c.Get(context.Background(), dsExt, table)
+	rtx.Must(err, "Get")
+	if d.TestCount != 1000 {
+		t.Errorf("Wrong detail %+v", d)
+	}
+	_, err = c.Get(context.Background(), dsExt, table)
+	rtx.Must(err, "Get")
+	if len(client.Queries()) != 1 {
+		t.Error("Should have used the cache", client.Queries())
+	}
+	_, err = c.Refresh(context.Background(), dsExt, table)
+	rtx.Must(err, "Refresh")
+	if len(client.Queries()) != 2 {
+		t.Error("Should have refreshed", client.Queries())
+	}
+	c.Invalidate(table)
+	_, err = c.Get(context.Background(), dsExt, table)
+	rtx.Must(err, "Get")
+	if len(client.Queries()) != 3 {
+		t.Error("Should have fetched after Invalidate", client.Queries())
+	}
+
+	// Errors are cached too.
+	other := dsExt.Table("ndt7$2020")
+	if _, err := c.Get(context.Background(), dsExt, other); err == nil {
+		t.Error("Expected invalid partition error")
+	}
+	if n := c.Prune(); n != 0 {
+		t.Error("Nothing should have expired", n)
+	}
+
+	short := bq.NewTableDetailCache(time.Millisecond)
+	_, err = short.Get(context.Background(), dsExt, table)
+	rtx.Must(err, "Get")
+	time.Sleep(2 * time.Millisecond)
+	if n := short.Prune(); n != 1 {
+		t.Error("Expected 1 expired detail", n)
+	}
+}
+
+func TestDetailCache_Refresh(t *testing.T) {
+	client := bqfake.NewClient("project")
+	c := bq.NewDetailCache(client, "project", bq.DefaultNaming, time.Hour)
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	j := tracker.NewJob("bucket", "ndt", "ndt7", date)
+	prefix := j
+	prefix.Prefix = "foo"
+	c.Refresh(context.Background(), []tracker.Job{j, prefix, tracker.NewJob("bucket", "ndt", "ndt7", date.AddDate(0, 0, 1))})
+	// The tmp and raw partitions of 2 dates.
+	if len(client.Queries()) != 4 {
+		t.Error("Wrong queries", client.Queries())
+	}
+	_, err := c.Get(context.Background(), "ndt", "ndt7", date, false)
+	rtx.Must(err, "Get")
+	if len(client.Queries()) != 4 {
+		t.Error("Should have used the refreshed details", client.Queries())
+	}
+}
@@ -0,0 +1,9 @@
+
+#standardSQL
+# Gardener deletes the tmp partition through the tables API, which is free.
+# This statement removes the same rows, at the cost of a partition scan.
+DELETE
+FROM `mlab-testing.tmp_ndt.annotation`
+WHERE date = @date
+# Parameters, e.g. for bq query --nouse_legacy_sql:
+#   --parameter=date::2020-06-01
\ No newline at end of file
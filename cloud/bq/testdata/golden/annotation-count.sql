@@ -0,0 +1,8 @@
+
+#standardSQL
+# Count the task files and rows (tests) in the raw partition.
+SELECT COUNT(DISTINCT parser.ArchiveURL) AS Files, COUNT(*) AS Rows
+FROM `mlab-testing.raw_ndt.annotation`
+WHERE date = @date
+# Parameters, e.g. for bq query --nouse_legacy_sql:
+#   --parameter=date::2020-06-01
\ No newline at end of file
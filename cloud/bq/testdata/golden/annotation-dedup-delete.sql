@@ -0,0 +1,37 @@
+
+#standardSQL
+# Delete all duplicate rows based on key and prefered priority ordering.
+# This is resource intensive for tcpinfo - 20 slot hours for 12M rows with 250M snapshots,
+# roughly proportional to the memory footprint of the table partition.
+# The query is very cheap if there are no duplicates.
+DELETE
+FROM `mlab-testing.tmp_ndt.annotation` AS target
+WHERE date = @date
+# This identifies all rows that don't match rows to preserve.
+AND NOT EXISTS (
+  # This creates list of rows to preserve, based on key and priority.
+  WITH keep AS (
+  SELECT * EXCEPT(row_number) FROM (
+    SELECT
+      id, 
+	  parser.Time,
+      ROW_NUMBER() OVER (
+        PARTITION BY id, date
+        ORDER BY  parser.Time DESC
+      ) row_number
+      FROM (
+        SELECT * FROM `mlab-testing.tmp_ndt.annotation`
+        WHERE date = @date
+      )
+    )
+    WHERE row_number = 1
+  )
+  SELECT * FROM keep
+  # This matches against the keep table based on keys.  Sufficient select keys must be
+  # used to distinguish the preferred row from the others.
+  WHERE
+    target.id = keep.id AND 
+    target.parser.Time = keep.Time
+)
+# Parameters, e.g. for bq query --nouse_legacy_sql:
+#   --parameter=date::2020-06-01
\ No newline at end of file
@@ -0,0 +1,20 @@
+
+#standardSQL
+# Select the preferred row for each key, based on priority ordering.  The
+# result overwrites the tmp partition, so this costs a single scan of the
+# partition, regardless of the number of duplicates.
+SELECT * EXCEPT(row_number) FROM (
+  SELECT
+    *,
+    ROW_NUMBER() OVER (
+      PARTITION BY id, date
+      ORDER BY  parser.Time DESC
+    ) row_number
+  FROM `mlab-testing.tmp_ndt.annotation`
+  WHERE date = @date
+AND parser.ArchiveURL LIKE CONCAT(@archive_prefix, "%")
+)
+WHERE row_number = 1
+# Parameters, e.g. for bq query --nouse_legacy_sql:
+#   --parameter=date::2020-06-01
+#   --parameter=archive_prefix::gs://archive-measurement-lab/ndt/annotation/2020/06/01/20200601T15
\ No newline at end of file
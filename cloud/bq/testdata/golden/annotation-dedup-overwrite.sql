@@ -0,0 +1,18 @@
+
+#standardSQL
+# Select the preferred row for each key, based on priority ordering.  The
+# result overwrites the tmp partition, so this costs a single scan of the
+# partition, regardless of the number of duplicates.
+SELECT * EXCEPT(row_number) FROM (
+  SELECT
+    *,
+    ROW_NUMBER() OVER (
+      PARTITION BY id, date
+      ORDER BY  parser.Time DESC
+    ) row_number
+  FROM `mlab-testing.tmp_ndt.annotation`
+  WHERE date = @date
+)
+WHERE row_number = 1
+# Parameters, e.g. for bq query --nouse_legacy_sql:
+#   --parameter=date::2020-06-01
\ No newline at end of file
@@ -0,0 +1,17 @@
+
+#standardSQL
+# Count the dedup keys that still have more than one row in the tmp
+# partition, and the rows that dedup should have removed.  This scans only
+# the key columns, so it is much cheaper than the dedup.
+SELECT COUNT(*) AS Keys, IFNULL(SUM(key_rows - 1), 0) AS ExtraRows
+FROM (
+  SELECT COUNT(*) AS key_rows
+  FROM `mlab-testing.tmp_ndt.annotation`
+  WHERE date = @date
+AND parser.ArchiveURL LIKE CONCAT(@archive_prefix, "%")
+  GROUP BY id, date
+  HAVING key_rows > 1
+)
+# Parameters, e.g. for bq query --nouse_legacy_sql:
+#   --parameter=date::2020-06-01
+#   --parameter=archive_prefix::gs://archive-measurement-lab/ndt/annotation/2020/06/01/20200601T15
\ No newline at end of file
@@ -0,0 +1,40 @@
+
+#standardSQL
+# Deduplicate the tmp partition, replace the raw partition with the result,
+# and verify the copy, in a single script job.
+DECLARE tmp_rows, deduped_rows, raw_rows INT64;
+
+SET tmp_rows = (
+  SELECT COUNT(*) FROM `mlab-testing.tmp_ndt.annotation`
+  WHERE date = @date);
+
+CREATE TEMP TABLE deduped AS
+SELECT * EXCEPT(row_number) FROM (
+  SELECT
+    *,
+    ROW_NUMBER() OVER (
+      PARTITION BY id, date
+      ORDER BY  parser.Time DESC
+    ) row_number
+  FROM `mlab-testing.tmp_ndt.annotation`
+  WHERE date = @date
+)
+WHERE row_number = 1;
+SET deduped_rows = (SELECT COUNT(*) FROM deduped);
+
+BEGIN TRANSACTION;
+DELETE
+FROM `mlab-testing.raw_ndt.annotation`
+WHERE date = @date;
+INSERT INTO `mlab-testing.raw_ndt.annotation`
+SELECT * FROM deduped;
+COMMIT TRANSACTION;
+
+SET raw_rows = (
+  SELECT COUNT(*) FROM `mlab-testing.raw_ndt.annotation`
+  WHERE date = @date);
+ASSERT raw_rows = deduped_rows AS "copy verification failed: raw row count differs from deduplicated rows";
+
+SELECT tmp_rows AS TmpRows, deduped_rows AS DedupedRows, raw_rows AS RawRows;
+# Parameters, e.g. for bq query --nouse_legacy_sql:
+#   --parameter=date::2020-06-01
\ No newline at end of file
@@ -0,0 +1,15 @@
+
+#standardSQL
+# Count the rows, and compute an order independent checksum of the key
+# columns, in both the tmp and raw partitions.
+SELECT "tmp" AS Table, COUNT(*) AS Rows,
+  IFNULL(BIT_XOR(FARM_FINGERPRINT(TO_JSON_STRING(STRUCT(id, parser.Time)))), 0) AS Checksum
+FROM `mlab-testing.tmp_ndt.ndt7`
+WHERE date = @date
+UNION ALL
+SELECT "raw" AS Table, COUNT(*) AS Rows,
+  IFNULL(BIT_XOR(FARM_FINGERPRINT(TO_JSON_STRING(STRUCT(id, parser.Time)))), 0) AS Checksum
+FROM `mlab-testing.raw_ndt.ndt7`
+WHERE date = @date
+# Parameters, e.g. for bq query --nouse_legacy_sql:
+#   --parameter=date::2020-06-01
\ No newline at end of file
@@ -0,0 +1,11 @@
+
+#standardSQL
+# Gardener deletes the tmp partition through the tables API, which is free.
+# This statement removes the same rows, at the cost of a partition scan.
+DELETE
+FROM `mlab-testing.tmp_ndt.ndt7`
+WHERE date = @date
+AND parser.ArchiveURL LIKE CONCAT(@archive_prefix, "%")
+# Parameters, e.g. for bq query --nouse_legacy_sql:
+#   --parameter=date::2020-06-01
+#   --parameter=archive_prefix::gs://archive-measurement-lab/ndt/ndt7/2020/06/01/20200601T15
\ No newline at end of file
@@ -0,0 +1,10 @@
+
+#standardSQL
+# Count the task files and rows (tests) in the raw partition.
+SELECT COUNT(DISTINCT parser.ArchiveURL) AS Files, COUNT(*) AS Rows
+FROM `mlab-testing.raw_ndt.ndt7`
+WHERE date = @date
+AND parser.ArchiveURL LIKE CONCAT(@archive_prefix, "%")
+# Parameters, e.g. for bq query --nouse_legacy_sql:
+#   --parameter=date::2020-06-01
+#   --parameter=archive_prefix::gs://archive-measurement-lab/ndt/ndt7/2020/06/01/20200601T15
\ No newline at end of file
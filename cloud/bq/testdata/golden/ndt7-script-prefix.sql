@@ -0,0 +1,45 @@
+
+#standardSQL
+# Deduplicate the tmp partition, replace the raw partition with the result,
+# and verify the copy, in a single script job.
+DECLARE tmp_rows, deduped_rows, raw_rows INT64;
+
+SET tmp_rows = (
+  SELECT COUNT(*) FROM `mlab-testing.tmp_ndt.ndt7`
+  WHERE date = @date
+AND parser.ArchiveURL LIKE CONCAT(@archive_prefix, "%"));
+
+CREATE TEMP TABLE deduped AS
+SELECT * EXCEPT(row_number) FROM (
+  SELECT
+    *,
+    ROW_NUMBER() OVER (
+      PARTITION BY id, date
+      ORDER BY  parser.Time DESC
+    ) row_number
+  FROM `mlab-testing.tmp_ndt.ndt7`
+  WHERE date = @date
+AND parser.ArchiveURL LIKE CONCAT(@archive_prefix, "%")
+)
+WHERE row_number = 1;
+SET deduped_rows = (SELECT COUNT(*) FROM deduped);
+
+BEGIN TRANSACTION;
+DELETE
+FROM `mlab-testing.raw_ndt.ndt7`
+WHERE date = @date
+AND parser.ArchiveURL LIKE CONCAT(@archive_prefix, "%");
+INSERT INTO `mlab-testing.raw_ndt.ndt7`
+SELECT * FROM deduped;
+COMMIT TRANSACTION;
+
+SET raw_rows = (
+  SELECT COUNT(*) FROM `mlab-testing.raw_ndt.ndt7`
+  WHERE date = @date
+AND parser.ArchiveURL LIKE CONCAT(@archive_prefix, "%"));
+ASSERT raw_rows = deduped_rows AS "copy verification failed: raw row count differs from deduplicated rows";
+
+SELECT tmp_rows AS TmpRows, deduped_rows AS DedupedRows, raw_rows AS RawRows;
+# Parameters, e.g. for bq query --nouse_legacy_sql:
+#   --parameter=date::2020-06-01
+#   --parameter=archive_prefix::gs://archive-measurement-lab/ndt/ndt7/2020/06/01/20200601T15
\ No newline at end of file
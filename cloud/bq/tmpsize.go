@@ -0,0 +1,135 @@
+package bq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+
+	"github.com/m-lab/go/dataset"
+
+	"github.com/m-lab/etl-gardener/metrics"
+)
+
+// ErrInvalidTmpLimit is returned for invalid TmpWatchdog parameters.
+var ErrInvalidTmpLimit = errors.New("invalid tmp size limit")
+
+// TmpUsage is the result of the tmp dataset size query.
+type TmpUsage struct {
+	Bytes int64 // Logical bytes in all partitions of the dataset.
+}
+
+// TmpWatchdog monitors the total size of the tmp datasets, and engages when
+// it exceeds High bytes, which indicates that cleanup is falling behind.
+// It disengages when the size drops to Low bytes.  It is used to pause
+// dispatch of new jobs to the parsers, which would otherwise keep adding to
+// the tmp tables.
+type TmpWatchdog struct {
+	client    bqiface.Client
+	project   string
+	datasets  []string
+	high, low int64
+
+	// OnChange, if not nil, is called with the total size whenever the
+	// watchdog engages or disengages, e.g. to send an alert.
+	OnChange func(engaged bool, bytes int64)
+
+	throttled int32 // Accessed atomically.  Non-zero when engaged.
+}
+
+// NewTmpWatchdog creates a TmpWatchdog for the tmp datasets in the project.
+// The high and low limits are in bytes, with 0 < low <= high.  A zero low
+// defaults to 80% of high.
+func NewTmpWatchdog(client bqiface.Client, project string, datasets []string, high, low int64) (*TmpWatchdog, error) {
+	if low == 0 {
+		low = high / 10 * 8
+	}
+	if len(datasets) == 0 || high <= 0 || low <= 0 || low > high {
+		return nil, ErrInvalidTmpLimit
+	}
+	return &TmpWatchdog{client: client, project: project, datasets: datasets,
+		high: high, low: low}, nil
+}
+
+// Throttled returns true if the watchdog is engaged.
+func (w *TmpWatchdog) Throttled() bool {
+	return atomic.LoadInt32(&w.throttled) != 0
+}
+
+// Size returns the total logical bytes in the tmp datasets.
+func (w *TmpWatchdog) Size(ctx context.Context) (int64, error) {
+	if w.client == nil {
+		return 0, dataset.ErrNilBqClient
+	}
+	total := int64(0)
+	for _, ds := range w.datasets {
+		q := w.client.Query(fmt.Sprintf(`
+#standardSQL
+# Logical bytes in all partitions of the tmp dataset.
+SELECT IFNULL(SUM(total_logical_bytes), 0) AS Bytes
+FROM `+"`%s.%s.INFORMATION_SCHEMA.PARTITIONS`", w.project, ds))
+		if q == nil {
+			return 0, dataset.ErrNilQuery
+		}
+		it, err := q.Read(ctx)
+		if err != nil {
+			return 0, err
+		}
+		usage := TmpUsage{}
+		if err := it.Next(&usage); err != nil {
+			return 0, err
+		}
+		metrics.TmpBytes.WithLabelValues(ds).Set(float64(usage.Bytes))
+		total += usage.Bytes
+	}
+	return total, nil
+}
+
+// Update queries the size, and engages or disengages the watchdog.
+// On error, the watchdog is left unchanged.
+func (w *TmpWatchdog) Update(ctx context.Context) error {
+	size, err := w.Size(ctx)
+	if err != nil {
+		return err
+	}
+	changed := false
+	switch {
+	case size > w.high && !w.Throttled():
+		log.Printf("Tmp datasets hold %d bytes, over %d, pausing dispatch", size, w.high)
+		atomic.StoreInt32(&w.throttled, 1)
+		changed = true
+	case size <= w.low && w.Throttled():
+		log.Printf("Tmp datasets hold %d bytes, resuming dispatch", size)
+		atomic.StoreInt32(&w.throttled, 0)
+		changed = true
+	}
+	if w.Throttled() {
+		metrics.TmpBackPressure.Set(1)
+	} else {
+		metrics.TmpBackPressure.Set(0)
+	}
+	if changed && w.OnChange != nil {
+		w.OnChange(w.Throttled(), size)
+	}
+	return nil
+}
+
+// Run calls Update every interval, until ctx is done.
+func (w *TmpWatchdog) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := w.Update(ctx); err != nil {
+			log.Println("Tmp size error:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
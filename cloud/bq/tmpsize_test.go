@@ -0,0 +1,64 @@
+package bq_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+)
+
+func TestTmpWatchdog(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.NewClient("proj")
+	client.AddResult("tmp_host", bqfake.Result{Rows: []interface{}{bq.TmpUsage{Bytes: 100}}})
+
+	// The default resume limit is 800 bytes.
+	w, err := bq.NewTmpWatchdog(client, "proj", []string{"tmp_ndt", "tmp_host"}, 1000, 0)
+	rtx.Must(err, "NewTmpWatchdog failed")
+	changes := []bool{}
+	w.OnChange = func(engaged bool, bytes int64) {
+		changes = append(changes, engaged)
+	}
+
+	steps := []struct {
+		ndt       bq.TmpUsage
+		err       error
+		throttled bool
+	}{
+		{ndt: bq.TmpUsage{Bytes: 800}, throttled: false},
+		{ndt: bq.TmpUsage{Bytes: 950}, throttled: true}, // 1050 engages.
+		{ndt: bq.TmpUsage{Bytes: 800}, throttled: true}, // 900 stays engaged.
+		{err: errors.New("query failed"), throttled: true},
+		{ndt: bq.TmpUsage{Bytes: 700}, throttled: false}, // 800 releases.
+		{ndt: bq.TmpUsage{Bytes: 850}, throttled: false}, // 950 stays released.
+	}
+	for i, s := range steps {
+		client.SetResult("tmp_ndt", bqfake.Result{Rows: []interface{}{s.ndt}, Err: s.err})
+		err := w.Update(ctx)
+		if (err != nil) != (s.err != nil) {
+			t.Error(i, "Unexpected error:", err)
+		}
+		if w.Throttled() != s.throttled {
+			t.Error(i, "Expected throttled", s.throttled)
+		}
+	}
+	if len(changes) != 2 || !changes[0] || changes[1] {
+		t.Error("Wrong changes", changes)
+	}
+	q := client.Queries()[0]
+	if !strings.Contains(q, "`proj.tmp_ndt.INFORMATION_SCHEMA.PARTITIONS`") {
+		t.Error("Wrong query:", q)
+	}
+
+	if _, err := bq.NewTmpWatchdog(client, "proj", []string{"tmp_ndt"}, 1000, 2000); err != bq.ErrInvalidTmpLimit {
+		t.Error("Expected ErrInvalidTmpLimit, got", err)
+	}
+	if _, err := bq.NewTmpWatchdog(client, "proj", nil, 1000, 0); err != bq.ErrInvalidTmpLimit {
+		t.Error("Expected ErrInvalidTmpLimit, got", err)
+	}
+}
@@ -0,0 +1,136 @@
+package bq
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"google.golang.org/api/iterator"
+
+	"github.com/m-lab/go/dataset"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// DateVersions lists the parser releases that produced the rows of a
+// single raw partition.
+type DateVersions struct {
+	Date     string // yyyy-mm-dd
+	Versions []string
+}
+
+// ParserVersions returns the distinct parser.Version values in each raw
+// table partition from start to end, inclusive, ordered by date.  Dates
+// without rows are omitted.
+func ParserVersions(ctx context.Context, client bqiface.Client, project string, names Names,
+	start, end time.Time) ([]DateVersions, error) {
+	if client == nil {
+		return nil, dataset.ErrNilBqClient
+	}
+	q := queryWithParams(client, fmt.Sprintf(`
+#standardSQL
+# List the parser releases in each raw partition.
+SELECT FORMAT_DATE("%%Y-%%m-%%d", date) AS Date,
+  ARRAY_AGG(DISTINCT IFNULL(parser.Version, "")) AS Versions
+FROM `+"`%s.%s.%s`"+`
+WHERE date BETWEEN @start AND @end
+GROUP BY date
+ORDER BY date`,
+		project, names.RawDataset, names.Table), dateRange(start, end)...)
+	if q == nil {
+		return nil, dataset.ErrNilQuery
+	}
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := []DateVersions{}
+	for {
+		var dv DateVersions
+		err := it.Next(&dv)
+		if err == iterator.Done {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, dv)
+	}
+}
+
+// versionPattern matches the release in a parser version, e.g.
+// v2.3.4 in https://github.com/m-lab/etl/tree/v2.3.4.
+var versionPattern = regexp.MustCompile(`v?(\d+)(?:\.(\d+))?(?:\.(\d+))?[^/]*$`)
+
+// parseVersion returns the major, minor and patch numbers of a version,
+// and false if it doesn't contain a release.
+func parseVersion(v string) ([3]int, bool) {
+	parts := [3]int{}
+	m := versionPattern.FindStringSubmatch(v)
+	if m == nil {
+		return parts, false
+	}
+	for i := range parts {
+		parts[i], _ = strconv.Atoi(m[i+1])
+	}
+	return parts, true
+}
+
+// VersionLess returns true if version a is an earlier release than b.
+// Versions without a recognizable release, e.g. empty or development
+// versions, are earlier than all releases.
+func VersionLess(a, b string) bool {
+	pa, oka := parseVersion(a)
+	pb, okb := parseVersion(b)
+	if !oka || !okb {
+		return !oka && okb
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			return pa[i] < pb[i]
+		}
+	}
+	return false
+}
+
+// VersionFinder finds the raw partitions processed with old parser releases.
+type VersionFinder struct {
+	client  bqiface.Client
+	project string
+	naming  Naming
+}
+
+// NewVersionFinder creates a VersionFinder for the raw tables in project.
+func NewVersionFinder(client bqiface.Client, project string, naming Naming) *VersionFinder {
+	return &VersionFinder{client: client, project: project, naming: naming.WithDefaults()}
+}
+
+// OutdatedDates returns the dates from start to end, inclusive, whose raw
+// partitions have any rows produced by a parser release earlier than
+// version, e.g. to requeue them after a parser bug fix.
+func (f *VersionFinder) OutdatedDates(ctx context.Context, experiment, datatype, version string,
+	start, end time.Time) ([]DateVersions, error) {
+	names, err := f.naming.Names(tracker.Job{Experiment: experiment, Datatype: datatype})
+	if err != nil {
+		return nil, err
+	}
+	all, err := ParserVersions(ctx, f.client, f.project, names, start, end)
+	if err != nil {
+		return nil, err
+	}
+	outdated := []DateVersions{}
+	for _, dv := range all {
+		for _, v := range dv.Versions {
+			if VersionLess(v, version) {
+				sort.Strings(dv.Versions)
+				outdated = append(outdated, dv)
+				break
+			}
+		}
+	}
+	return outdated, nil
+}
@@ -0,0 +1,80 @@
+package bq_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestVersionLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"v2.3.4", "v2.3.5", true},
+		{"v2.9.0", "v2.10.0", true},
+		{"v2.10.0", "v2.9.0", false},
+		{"v2.3.4", "v2.3.4", false},
+		{"https://github.com/m-lab/etl/tree/v1.2.0", "v1.3", true},
+		{"v3.0.0-rc1", "v2.9.9", false},
+		{"", "v1.0.0", true},
+		{"dev", "v1.0.0", true},
+		{"v1.0.0", "dev", false},
+	}
+	for _, tt := range tests {
+		if got := bq.VersionLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("VersionLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestOutdatedDates(t *testing.T) {
+	client := bqfake.NewClient("project")
+	client.AddResult("parser.Version", bqfake.Result{Rows: []interface{}{
+		bq.DateVersions{Date: "2020-06-01", Versions: []string{"v2.3.0"}},
+		bq.DateVersions{Date: "2020-06-02", Versions: []string{"v2.4.0", "v2.2.1"}},
+		bq.DateVersions{Date: "2020-06-03", Versions: []string{"v2.4.1"}},
+	}})
+	f := bq.NewVersionFinder(client, "project", bq.DefaultNaming)
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	dates, err := f.OutdatedDates(context.Background(), "ndt", "ndt7", "v2.4.0", start, start.AddDate(0, 0, 2))
+	rtx.Must(err, "OutdatedDates")
+	if len(dates) != 2 || dates[0].Date != "2020-06-01" || dates[1].Date != "2020-06-02" ||
+		dates[1].Versions[0] != "v2.2.1" {
+		t.Errorf("Wrong dates %+v", dates)
+	}
+	q := client.Queries()
+	if len(q) != 1 || !strings.Contains(q[0], "`project.raw_ndt.ndt7`") || !strings.Contains(q[0], `BETWEEN "2020-06-01" AND "2020-06-03"`) {
+		t.Error("Wrong query", q)
+	}
+}
+
+func TestJobLabels(t *testing.T) {
+	j := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	labels := bq.JobLabels(j, "https://github.com/m-lab/etl/tree/v2.3.4")
+	if labels["gardener_datatype"] != "ndt7" || labels["gardener_date"] != "2020-06-01" ||
+		labels["parser_version"] != "https___github_com_m-lab_etl_tree_v2_3_4" {
+		t.Error("Wrong labels", labels)
+	}
+	if _, ok := bq.JobLabels(j, "")["parser_version"]; ok {
+		t.Error("Expected no parser_version label")
+	}
+
+	client := bqfake.NewClient("project")
+	to, err := bq.NewTableOpsWithClientAndNaming(client, j, "project", "", bq.DefaultNaming)
+	rtx.Must(err, "NewTableOps")
+	to.Labels = labels
+	_, err = to.Dedup(context.Background(), false)
+	rtx.Must(err, "Dedup")
+	runs := client.QueryRuns()
+	if len(runs) != 1 || runs[0].Labels["parser_version"] == "" || runs[0].Q == "" {
+		t.Errorf("Expected labelled dedup query %+v", runs)
+	}
+}
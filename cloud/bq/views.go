@@ -0,0 +1,193 @@
+package bq
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"text/template"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+
+	"github.com/m-lab/go/dataset"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// AnnotationDatatype is the datatype whose rows annotate the rows of the
+// other datatypes of an experiment, by id and date.
+const AnnotationDatatype = "annotation"
+
+// DefaultViewSuffix is appended to a datatype's table name to name its
+// annotation join view, e.g. ndt7_annotated.
+const DefaultViewSuffix = "_annotated"
+
+// View is a logical view that joins the rows of a datatype with their
+// annotations.
+type View struct {
+	Project           string
+	Dataset           string // Dataset of the view and the datatype's table.
+	Name              string
+	Datatype          string
+	Table             string
+	AnnotationDataset string
+	AnnotationTable   string
+}
+
+var viewTemplate = template.Must(template.New("").Parse(`
+#standardSQL
+# {{.Datatype}} rows, with their annotations.  Generated by gardener.
+SELECT raw.*, ann AS annotation
+FROM ` + "`{{.Project}}.{{.Dataset}}.{{.Table}}`" + ` AS raw
+LEFT JOIN ` + "`{{.Project}}.{{.AnnotationDataset}}.{{.AnnotationTable}}`" + ` AS ann
+ON raw.id = ann.id AND raw.date = ann.date`))
+
+// SQL returns the query of the view.
+func (v View) SQL() string {
+	out := bytes.NewBuffer(nil)
+	if err := viewTemplate.Execute(out, v); err != nil {
+		return ""
+	}
+	return out.String()
+}
+
+// schemaFields appends the names and types of the fields in the schema,
+// including nested fields, to fields.
+func schemaFields(fields []string, prefix string, schema bigquery.Schema) []string {
+	for _, f := range schema {
+		fields = append(fields, fmt.Sprint(prefix, f.Name, " ", f.Type))
+		fields = schemaFields(fields, prefix+f.Name+".", f.Schema)
+	}
+	return fields
+}
+
+// fingerprint returns a hash of the view query and the schemas of the
+// joined tables, which changes whenever the view must be refreshed.
+func fingerprint(sql string, schemas ...bigquery.Schema) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintln(h, sql)
+	for _, s := range schemas {
+		fields := schemaFields(nil, "", s)
+		sort.Strings(fields)
+		fmt.Fprintln(h, fields)
+	}
+	return h.Sum64()
+}
+
+// ViewManager creates and refreshes the annotation join view of each
+// datatype of an experiment that also has annotations.  The views are in
+// the dataset of the datatype's final table, i.e. the publish target if
+// there is one, or the raw dataset.  A view is updated when its query, or
+// the schema of either joined table, changes, since BigQuery fixes the
+// schema of a view when it is created.
+type ViewManager struct {
+	client  bqiface.Client
+	project string
+	naming  Naming
+	suffix  string
+
+	datatypes map[string][]string      // Keyed by experiment.
+	publish   map[string]PublishTarget // Keyed by experiment.
+
+	lock sync.Mutex // Serializes refreshes, so concurrent jobs don't race to create a view.
+}
+
+// NewViewManager creates a ViewManager for tables in the project.  An empty
+// suffix uses DefaultViewSuffix.
+func NewViewManager(client bqiface.Client, project string, naming Naming, suffix string) *ViewManager {
+	if suffix == "" {
+		suffix = DefaultViewSuffix
+	}
+	return &ViewManager{client: client, project: project, naming: naming.WithDefaults(), suffix: suffix,
+		datatypes: make(map[string][]string), publish: make(map[string]PublishTarget)}
+}
+
+// Add adds a datatype of an experiment.  Duplicates are ignored.  Should be
+// called for all sources, including annotation, before Refresh.
+func (vm *ViewManager) Add(experiment, datatype string) {
+	for _, dt := range vm.datatypes[experiment] {
+		if dt == datatype {
+			return
+		}
+	}
+	vm.datatypes[experiment] = append(vm.datatypes[experiment], datatype)
+	sort.Strings(vm.datatypes[experiment])
+}
+
+// SetPublish sets the publish targets, keyed by experiment.  The views of
+// experiments with a target are created in the target dataset.
+func (vm *ViewManager) SetPublish(targets map[string]PublishTarget) {
+	vm.publish = targets
+}
+
+// View returns the view of the datatype, and false if it has none, i.e. it
+// is the annotation datatype, or the experiment has no annotation datatype.
+func (vm *ViewManager) View(experiment, datatype string) (View, bool, error) {
+	annotated := false
+	for _, dt := range vm.datatypes[experiment] {
+		annotated = annotated || dt == AnnotationDatatype
+	}
+	if !annotated || datatype == AnnotationDatatype {
+		return View{}, false, nil
+	}
+	names, err := vm.naming.Names(tracker.Job{Experiment: experiment, Datatype: datatype})
+	if err != nil {
+		return View{}, false, err
+	}
+	ann, err := vm.naming.Names(tracker.Job{Experiment: experiment, Datatype: AnnotationDatatype})
+	if err != nil {
+		return View{}, false, err
+	}
+	v := View{Project: vm.project, Dataset: names.RawDataset, Name: names.Table + vm.suffix,
+		Datatype: datatype, Table: names.Table, AnnotationDataset: ann.RawDataset, AnnotationTable: ann.Table}
+	if target, ok := vm.publish[experiment]; ok {
+		v.Project, v.Dataset, v.AnnotationDataset = target.Project, target.Dataset, target.Dataset
+	}
+	return v, true, nil
+}
+
+// Refresh creates the view of the datatype, or updates it if its query or
+// the schema of a joined table has changed.  It returns true if the view
+// was created or updated, and false if it was current, or the datatype has
+// no view.
+func (vm *ViewManager) Refresh(ctx context.Context, experiment, datatype string) (bool, error) {
+	v, ok, err := vm.View(experiment, datatype)
+	if err != nil || !ok {
+		return false, err
+	}
+	if vm.client == nil {
+		return false, dataset.ErrNilBqClient
+	}
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	ds := vm.client.DatasetInProject(v.Project, v.Dataset)
+	raw, err := ds.Table(v.Table).Metadata(ctx)
+	if err != nil {
+		return false, err
+	}
+	ann, err := vm.client.DatasetInProject(v.Project, v.AnnotationDataset).Table(v.AnnotationTable).Metadata(ctx)
+	if err != nil {
+		return false, err
+	}
+	sql := v.SQL()
+	desc := fmt.Sprintf("%s rows joined with their annotations, generated by gardener.  Fingerprint %016x.",
+		datatype, fingerprint(sql, raw.Schema, ann.Schema))
+
+	view := ds.Table(v.Name)
+	meta, err := view.Metadata(ctx)
+	if isNotFound(err) {
+		return true, view.Create(ctx, &bigquery.TableMetadata{ViewQuery: sql, Description: desc})
+	}
+	if err != nil {
+		return false, err
+	}
+	if meta.ViewQuery == sql && meta.Description == desc {
+		return false, nil
+	}
+	_, err = view.Update(ctx, bigquery.TableMetadataToUpdate{ViewQuery: sql, Description: desc}, meta.ETag)
+	return err == nil, err
+}
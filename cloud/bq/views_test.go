@@ -0,0 +1,83 @@
+package bq_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+)
+
+func TestViewManager(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.NewClient("proj")
+	schema := bigquery.Schema{{Name: "id"}, {Name: "date"}}
+	client.AddTable("raw_ndt", "ndt7", &bigquery.TableMetadata{Schema: schema})
+	client.AddTable("raw_ndt", "annotation", &bigquery.TableMetadata{Schema: schema})
+
+	vm := bq.NewViewManager(client, "proj", bq.DefaultNaming, "")
+	vm.Add("ndt", "ndt7")
+	vm.Add("ndt", "annotation")
+	vm.Add("host", "nodeinfo")
+
+	// Annotations, and experiments without annotations, have no view.
+	for _, s := range [][2]string{{"ndt", "annotation"}, {"host", "nodeinfo"}} {
+		if updated, err := vm.Refresh(ctx, s[0], s[1]); updated || err != nil {
+			t.Error(s, "should have no view", updated, err)
+		}
+	}
+
+	updated, err := vm.Refresh(ctx, "ndt", "ndt7")
+	rtx.Must(err, "Refresh failed")
+	if !updated {
+		t.Error("Expected the view to be created")
+	}
+	meta, err := client.Dataset("raw_ndt").Table("ndt7_annotated").Metadata(ctx)
+	rtx.Must(err, "View not created")
+	for _, want := range []string{"FROM `proj.raw_ndt.ndt7` AS raw",
+		"LEFT JOIN `proj.raw_ndt.annotation` AS ann", "ON raw.id = ann.id AND raw.date = ann.date"} {
+		if !strings.Contains(meta.ViewQuery, want) {
+			t.Error("View query should contain", want, ":\n", meta.ViewQuery)
+		}
+	}
+
+	if updated, err := vm.Refresh(ctx, "ndt", "ndt7"); updated || err != nil {
+		t.Error("Expected the view to be current", updated, err)
+	}
+
+	// A new column in a joined table updates the view.
+	client.AddTable("raw_ndt", "annotation", &bigquery.TableMetadata{
+		Schema: append(schema, &bigquery.FieldSchema{Name: "server"})})
+	if updated, err := vm.Refresh(ctx, "ndt", "ndt7"); !updated || err != nil {
+		t.Error("Expected the view to be updated", updated, err)
+	}
+
+	// Missing tables are errors.
+	vm.Add("other", "annotation")
+	vm.Add("other", "ndt7")
+	if _, err := vm.Refresh(ctx, "other", "ndt7"); err == nil {
+		t.Error("Expected an error for missing tables")
+	}
+}
+
+func TestViewManagerPublished(t *testing.T) {
+	vm := bq.NewViewManager(nil, "proj", bq.DefaultNaming, "_joined")
+	vm.Add("ndt", "ndt7")
+	vm.Add("ndt", "annotation")
+	vm.SetPublish(map[string]bq.PublishTarget{"ndt": {Project: "public", Dataset: "ndt"}})
+	v, ok, err := vm.View("ndt", "ndt7")
+	rtx.Must(err, "View failed")
+	want := bq.View{Project: "public", Dataset: "ndt", Name: "ndt7_joined", Datatype: "ndt7",
+		Table: "ndt7", AnnotationDataset: "ndt", AnnotationTable: "annotation"}
+	if !ok || v != want {
+		t.Errorf("Wrong view %+v", v)
+	}
+	if _, err := vm.Refresh(context.Background(), "ndt", "ndt7"); err == nil {
+		t.Error("Expected an error with a nil client")
+	}
+}
@@ -0,0 +1,72 @@
+package bq
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+
+	"github.com/m-lab/go/dataset"
+)
+
+// DateRows is a partition row count, as returned by the WeekdayRows query.
+type DateRows struct {
+	Date string
+	Rows int64
+}
+
+// WeekdayRows returns the row counts of the published partitions on the
+// same weekday as the job in each of the preceding weeks, most recent first.
+// Missing and empty partitions are omitted.
+func (to TableOps) WeekdayRows(ctx context.Context, target PublishTarget, weeks int) ([]int64, error) {
+	if to.client == nil {
+		return nil, dataset.ErrNilBqClient
+	}
+	// Each date is a parameter, @week1 for the previous week and so on.
+	dates := make([]string, 0, weeks)
+	names := make([]string, 0, weeks)
+	params := make([]bigquery.QueryParameter, 0, weeks)
+	for i := 1; i <= weeks; i++ {
+		d := to.Job.Date.AddDate(0, 0, -7*i).Format("2006-01-02")
+		dates = append(dates, d)
+		names = append(names, fmt.Sprintf("@week%d", i))
+		params = append(params, bigquery.QueryParameter{Name: fmt.Sprintf("week%d", i), Value: d})
+	}
+	q := queryWithParams(to.client, fmt.Sprintf(`
+#standardSQL
+# Count the rows in the published partitions of earlier weeks.
+SELECT CAST(%s AS STRING) AS Date, COUNT(*) AS Rows
+FROM `+"`%s.%s.%s`"+`
+WHERE %s IN (%s)
+GROUP BY Date`,
+		to.Date, target.Project, target.Dataset, to.Names.Table, to.Date, strings.Join(names, ", ")),
+		params...)
+	if q == nil {
+		return nil, dataset.ErrNilQuery
+	}
+	it, err := to.read(ctx, "weekday_rows", q)
+	if err != nil {
+		return nil, err
+	}
+	byDate := map[string]int64{}
+	for {
+		var r DateRows
+		err := it.Next(&r)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		byDate[r.Date] = r.Rows
+	}
+	rows := []int64{}
+	for _, d := range dates {
+		if n := byDate[d]; n > 0 {
+			rows = append(rows, n)
+		}
+	}
+	return rows, nil
+}
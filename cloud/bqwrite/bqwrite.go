@@ -0,0 +1,160 @@
+// Package bqwrite writes rows to BigQuery tables with the Storage Write
+// API, which is cheaper than streaming inserts, and writes each row exactly
+// once, by appending at explicit offsets to a committed stream.  It is used
+// for the job log, and is intended for other exports, e.g. metrics.
+package bqwrite
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/m-lab/etl-gardener/metrics"
+)
+
+// ErrAlreadyExists is returned by an Appender when rows were already
+// written at the offset, e.g. by an append whose response was lost.
+var ErrAlreadyExists = errors.New("rows already written at offset")
+
+// Limits on each append.  The API limits requests to 10MB.
+const (
+	defaultBatchSize = 500
+	maxAppendBytes   = 9 << 20
+)
+
+// Appender appends serialized rows to a stream.
+type Appender interface {
+	// Append writes the rows at the offset of the first row in the stream,
+	// and waits until they are committed.
+	Append(ctx context.Context, rows [][]byte, offset int64) error
+}
+
+// Writer encodes rows, and appends them in batches, retrying failed
+// appends at the same offset, so that rows are not duplicated.
+type Writer struct {
+	name string
+	app  Appender
+	enc  *Encoder
+
+	// BatchSize is the maximum rows per append.
+	BatchSize int
+	// Retries is the number of retries of each failed append.
+	Retries int
+	// Backoff is the delay before the first retry.  It doubles for each
+	// later retry.
+	Backoff time.Duration
+
+	offset int64 // Offset of the next row.  Not thread-safe.
+}
+
+// NewWriter creates a Writer that appends rows encoded by enc to app.  The
+// name labels metrics, e.g. the table name.
+func NewWriter(name string, app Appender, enc *Encoder) *Writer {
+	return &Writer{name: name, app: app, enc: enc,
+		BatchSize: defaultBatchSize, Retries: 3, Backoff: time.Second}
+}
+
+// Write encodes and appends the rows, in order.  Rows that can't be encoded
+// are logged, counted and skipped, so that they don't hold up the rest.  It
+// returns the number of leading rows handled, i.e. written or skipped, which
+// may be fewer than the rows if an append fails.  Rows that are not handled
+// may be written again later.  Not thread-safe.
+func (w *Writer) Write(ctx context.Context, rows []map[string]bigquery.Value) (int, error) {
+	encoded := make([][]byte, 0, len(rows))
+	index := make([]int, 0, len(rows)) // Index in rows of each encoded row.
+	for i, r := range rows {
+		b, err := w.enc.Encode(r)
+		if err != nil {
+			log.Println("Skipping row for", w.name+":", err)
+			metrics.BQWriteRows.WithLabelValues(w.name, "invalid").Inc()
+			continue
+		}
+		encoded = append(encoded, b)
+		index = append(index, i)
+	}
+	written := 0
+	for written < len(encoded) {
+		n := w.batch(encoded[written:])
+		if err := w.append(ctx, encoded[written:written+n]); err != nil {
+			// Any invalid rows before the failed batch were handled.
+			return index[written], err
+		}
+		written += n
+	}
+	return len(rows), nil
+}
+
+// batch returns the number of leading rows that fit in one append.
+func (w *Writer) batch(rows [][]byte) int {
+	size := 0
+	for i, r := range rows {
+		size += len(r)
+		if i > 0 && (i >= w.BatchSize || size > maxAppendBytes) {
+			return i
+		}
+	}
+	return len(rows)
+}
+
+// append appends the rows at the current offset, with retries.
+func (w *Writer) append(ctx context.Context, rows [][]byte) error {
+	backoff := w.Backoff
+	var err error
+	for try := 0; try <= w.Retries; try++ {
+		if try > 0 {
+			metrics.BQWriteRows.WithLabelValues(w.name, "retried").Add(float64(len(rows)))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		err = w.app.Append(ctx, rows, w.offset)
+		if err == nil || errors.Is(err, ErrAlreadyExists) {
+			w.offset += int64(len(rows))
+			metrics.BQWriteRows.WithLabelValues(w.name, "written").Add(float64(len(rows)))
+			return nil
+		}
+		log.Println("Append to", w.name, "failed:", err)
+	}
+	metrics.BQWriteRows.WithLabelValues(w.name, "error").Add(float64(len(rows)))
+	return err
+}
+
+// streamAppender appends to a committed managedwriter stream, whose rows
+// are visible as soon as each append succeeds.
+type streamAppender struct {
+	stream *managedwriter.ManagedStream
+}
+
+// NewStreamAppender creates an Appender that writes rows encoded by enc to
+// a new committed stream on the table.
+func NewStreamAppender(ctx context.Context, client *managedwriter.Client, project, dataset, table string, enc *Encoder) (Appender, error) {
+	stream, err := client.NewManagedStream(ctx,
+		managedwriter.WithDestinationTable(managedwriter.TableParentFromParts(project, dataset, table)),
+		managedwriter.WithType(managedwriter.CommittedStream),
+		managedwriter.WithSchemaDescriptor(enc.Descriptor()))
+	if err != nil {
+		return nil, err
+	}
+	return &streamAppender{stream: stream}, nil
+}
+
+// Append implements Appender.Append.
+func (s *streamAppender) Append(ctx context.Context, rows [][]byte, offset int64) error {
+	result, err := s.stream.AppendRows(ctx, rows, managedwriter.WithOffset(offset))
+	if err == nil {
+		_, err = result.GetResult(ctx)
+	}
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrAlreadyExists
+	}
+	return err
+}
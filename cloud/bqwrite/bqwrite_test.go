@@ -0,0 +1,148 @@
+package bqwrite_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/go/rtx"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"github.com/m-lab/etl-gardener/cloud/bqwrite"
+)
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+var schema = bigquery.Schema{
+	{Name: "name", Type: bigquery.StringFieldType},
+	{Name: "count", Type: bigquery.IntegerFieldType},
+	{Name: "end", Type: bigquery.TimestampFieldType},
+	{Name: "states", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+		{Name: "state", Type: bigquery.StringFieldType},
+		{Name: "seconds", Type: bigquery.FloatFieldType},
+	}},
+}
+
+func TestEncoder(t *testing.T) {
+	enc, err := bqwrite.NewEncoder(schema)
+	rtx.Must(err, "NewEncoder")
+	desc := enc.Descriptor()
+	if len(desc.Field) != 4 || len(desc.NestedType) != 1 {
+		t.Fatal("Wrong descriptor", desc)
+	}
+	if desc.Field[3].GetLabel() != descriptorpb.FieldDescriptorProto_LABEL_REPEATED ||
+		desc.Field[3].GetTypeName() != desc.NestedType[0].GetName() {
+		t.Error("Wrong record field", desc.Field[3])
+	}
+
+	row := map[string]bigquery.Value{
+		"name":  "job",
+		"count": int64(3),
+		"end":   time.Date(2020, 6, 1, 0, 0, 0, 5000, time.UTC),
+		"states": []bigquery.Value{
+			map[string]bigquery.Value{"state": "parsing", "seconds": 1.5},
+			map[string]bigquery.Value{"state": "complete"},
+		},
+	}
+	b, err := enc.Encode(row)
+	rtx.Must(err, "Encode")
+	if len(b) == 0 {
+		t.Error("Empty encoding")
+	}
+
+	if _, err := enc.Encode(map[string]bigquery.Value{"bogus": "x"}); !errors.Is(err, bqwrite.ErrBadValue) {
+		t.Error("Expected ErrBadValue for an unknown field", err)
+	}
+	if _, err := enc.Encode(map[string]bigquery.Value{"count": "x"}); !errors.Is(err, bqwrite.ErrBadValue) {
+		t.Error("Expected ErrBadValue for a string count", err)
+	}
+	bad := bigquery.Schema{{Name: "n", Type: "NUMERIC"}}
+	if _, err := bqwrite.NewEncoder(bad); !errors.Is(err, bqwrite.ErrUnsupportedType) {
+		t.Error("Expected ErrUnsupportedType", err)
+	}
+}
+
+// fakeAppender records appends, and fails the appends listed in errs.
+type fakeAppender struct {
+	offsets []int64
+	sizes   []int
+	errs    []error
+}
+
+func (f *fakeAppender) Append(ctx context.Context, rows [][]byte, offset int64) error {
+	f.offsets = append(f.offsets, offset)
+	f.sizes = append(f.sizes, len(rows))
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return err
+	}
+	return nil
+}
+
+func TestWriter(t *testing.T) {
+	ctx := context.Background()
+	enc, err := bqwrite.NewEncoder(schema)
+	rtx.Must(err, "NewEncoder")
+	app := &fakeAppender{}
+	w := bqwrite.NewWriter("test", app, enc)
+	w.BatchSize = 2
+	w.Backoff = time.Millisecond
+
+	rows := []map[string]bigquery.Value{{"name": "a"}, {"name": "b"}, {"name": "c"}}
+	// A lost response is retried at the same offset, and the rows that
+	// were already written are not duplicated.
+	app.errs = []error{errors.New("unavailable"), bqwrite.ErrAlreadyExists}
+	n, err := w.Write(ctx, rows)
+	rtx.Must(err, "Write")
+	if n != 3 {
+		t.Error("Expected 3 rows written, got", n)
+	}
+	wantOffsets := []int64{0, 0, 2}
+	wantSizes := []int{2, 2, 1}
+	if len(app.offsets) != len(wantOffsets) {
+		t.Fatal("Wrong appends", app.offsets, app.sizes)
+	}
+	for i := range wantOffsets {
+		if app.offsets[i] != wantOffsets[i] || app.sizes[i] != wantSizes[i] {
+			t.Error("Wrong append", i, app.offsets[i], app.sizes[i])
+		}
+	}
+
+	// After the retries are exhausted, only the earlier batches are written.
+	w.Retries = 1
+	app.offsets, app.sizes = nil, nil
+	app.errs = []error{nil, errors.New("unavailable"), errors.New("unavailable")}
+	n, err = w.Write(ctx, rows)
+	if err == nil || n != 2 {
+		t.Error("Expected 2 rows written, and an error", n, err)
+	}
+	if app.offsets[0] != 3 || app.offsets[2] != 5 {
+		t.Error("Wrong offsets", app.offsets)
+	}
+
+	// Invalid rows are skipped, and the rest are written.
+	w.BatchSize = 10
+	app.offsets, app.sizes, app.errs = nil, nil, nil
+	mixed := []map[string]bigquery.Value{{"count": "x"}, {"name": "d"}, {"bogus": "x"}, {"name": "e"}}
+	if n, err := w.Write(ctx, mixed); n != 4 || err != nil {
+		t.Error("Expected 4 rows handled", n, err)
+	}
+	if len(app.sizes) != 1 || app.sizes[0] != 2 || app.offsets[0] != 5 {
+		t.Error("Wrong appends", app.offsets, app.sizes)
+	}
+	if n, err := w.Write(ctx, []map[string]bigquery.Value{{"count": "x"}}); n != 1 || err != nil || len(app.sizes) != 1 {
+		t.Error("Expected the invalid row to be skipped", n, err, app.sizes)
+	}
+	// Invalid rows before a failed append are handled.
+	app.errs = []error{errors.New("unavailable"), errors.New("unavailable")}
+	if n, err := w.Write(ctx, mixed); n != 1 || err == nil {
+		t.Error("Expected 1 row handled, and an error", n, err)
+	}
+}
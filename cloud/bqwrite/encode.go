@@ -0,0 +1,191 @@
+package bqwrite
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Errors associated with encoding rows.
+var (
+	ErrUnsupportedType = errors.New("unsupported field type")
+	ErrBadValue        = errors.New("bad field value")
+)
+
+// rowMessage is the name of the message type of each row.
+const rowMessage = "row"
+
+// Encoder encodes rows as protocol buffer messages for the Storage Write
+// API, using a message type derived from the table schema.
+type Encoder struct {
+	desc *descriptorpb.DescriptorProto
+	msg  protoreflect.MessageDescriptor
+}
+
+// NewEncoder creates an Encoder for rows of the schema.  Records are
+// supported, but not all BigQuery types, e.g. NUMERIC or GEOGRAPHY.
+func NewEncoder(schema bigquery.Schema) (*Encoder, error) {
+	desc := &descriptorpb.DescriptorProto{Name: proto.String(rowMessage)}
+	if err := describe(desc, desc, "record", schema); err != nil {
+		return nil, err
+	}
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:        proto.String(rowMessage + ".proto"),
+		Syntax:      proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{desc},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Encoder{desc: desc, msg: fd.Messages().ByName(rowMessage)}, nil
+}
+
+// describe adds the schema's fields to msg.  Record types are all nested in
+// the root message, named by their path, so that the descriptor is self
+// contained, as the Storage Write API requires.  Type names are prefixed to
+// avoid conflicts with field names.
+func describe(root, msg *descriptorpb.DescriptorProto, path string, schema bigquery.Schema) error {
+	for i, f := range schema {
+		fdp := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(f.Name),
+			Number: proto.Int32(int32(i + 1)),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+		if f.Repeated {
+			fdp.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+		}
+		switch f.Type {
+		case bigquery.StringFieldType:
+			fdp.Type = descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()
+		case bigquery.BytesFieldType:
+			fdp.Type = descriptorpb.FieldDescriptorProto_TYPE_BYTES.Enum()
+		case bigquery.BooleanFieldType:
+			fdp.Type = descriptorpb.FieldDescriptorProto_TYPE_BOOL.Enum()
+		case bigquery.IntegerFieldType, bigquery.TimestampFieldType:
+			// Timestamps are microseconds since epoch.
+			fdp.Type = descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum()
+		case bigquery.DateFieldType:
+			// Dates are days since epoch.
+			fdp.Type = descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum()
+		case bigquery.FloatFieldType:
+			fdp.Type = descriptorpb.FieldDescriptorProto_TYPE_DOUBLE.Enum()
+		case bigquery.RecordFieldType:
+			name := path + "__" + f.Name
+			nested := &descriptorpb.DescriptorProto{Name: proto.String(name)}
+			if err := describe(root, nested, name, f.Schema); err != nil {
+				return err
+			}
+			root.NestedType = append(root.NestedType, nested)
+			fdp.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+			fdp.TypeName = proto.String(name)
+		default:
+			return fmt.Errorf("%w: %s %s", ErrUnsupportedType, f.Name, f.Type)
+		}
+		msg.Field = append(msg.Field, fdp)
+	}
+	return nil
+}
+
+// Descriptor returns the self contained descriptor of the row message.
+func (e *Encoder) Descriptor() *descriptorpb.DescriptorProto {
+	return e.desc
+}
+
+// Encode serializes a row.  Records are map[string]bigquery.Value, repeated
+// fields are []bigquery.Value, and timestamps and dates are time.Time.  Nil
+// values are omitted.
+func (e *Encoder) Encode(row map[string]bigquery.Value) ([]byte, error) {
+	m := dynamicpb.NewMessage(e.msg)
+	if err := set(m, row); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(m)
+}
+
+// set sets the fields of m from the record.
+func set(m *dynamicpb.Message, record map[string]bigquery.Value) error {
+	fields := m.Descriptor().Fields()
+	for name, v := range record {
+		if v == nil {
+			continue
+		}
+		fd := fields.ByName(protoreflect.Name(name))
+		if fd == nil {
+			return fmt.Errorf("%w: %s is not in the schema", ErrBadValue, name)
+		}
+		if !fd.IsList() {
+			pv, err := value(fd, v)
+			if err != nil {
+				return err
+			}
+			m.Set(fd, pv)
+			continue
+		}
+		items, ok := v.([]bigquery.Value)
+		if !ok {
+			return fmt.Errorf("%w: %s is %T, not a list", ErrBadValue, name, v)
+		}
+		list := m.Mutable(fd).List()
+		for _, item := range items {
+			pv, err := value(fd, item)
+			if err != nil {
+				return err
+			}
+			list.Append(pv)
+		}
+	}
+	return nil
+}
+
+// value converts v to the field's type.
+func value(fd protoreflect.FieldDescriptor, v bigquery.Value) (protoreflect.Value, error) {
+	switch x := v.(type) {
+	case string:
+		if fd.Kind() == protoreflect.StringKind {
+			return protoreflect.ValueOfString(x), nil
+		}
+	case []byte:
+		if fd.Kind() == protoreflect.BytesKind {
+			return protoreflect.ValueOfBytes(x), nil
+		}
+	case bool:
+		if fd.Kind() == protoreflect.BoolKind {
+			return protoreflect.ValueOfBool(x), nil
+		}
+	case int:
+		if fd.Kind() == protoreflect.Int64Kind {
+			return protoreflect.ValueOfInt64(int64(x)), nil
+		}
+	case int64:
+		if fd.Kind() == protoreflect.Int64Kind {
+			return protoreflect.ValueOfInt64(x), nil
+		}
+	case float64:
+		if fd.Kind() == protoreflect.DoubleKind {
+			return protoreflect.ValueOfFloat64(x), nil
+		}
+	case time.Time:
+		switch fd.Kind() {
+		case protoreflect.Int64Kind:
+			return protoreflect.ValueOfInt64(x.Unix()*1e6 + int64(x.Nanosecond()/1e3)), nil
+		case protoreflect.Int32Kind:
+			return protoreflect.ValueOfInt32(int32(x.Unix() / 86400)), nil
+		}
+	case map[string]bigquery.Value:
+		if fd.Kind() == protoreflect.MessageKind {
+			nested := dynamicpb.NewMessage(fd.Message())
+			if err := set(nested, x); err != nil {
+				return protoreflect.Value{}, err
+			}
+			return protoreflect.ValueOfMessage(nested), nil
+		}
+	}
+	return protoreflect.Value{}, fmt.Errorf("%w: %s is %T, not %s", ErrBadValue, fd.Name(), v, fd.Kind())
+}
@@ -33,6 +33,7 @@ type BQConfig struct {
 	// TODO: Consider generalizing BQConfig structure & moving to m-lab/go/cloud.
 	BQBatchDataset string // Dataset for intermediate BigQuery tables
 	BQFinalDataset string // Dataset for final BigQuery tables
+	BQLocation     string // Location of the datasets and jobs.  Empty means the US multi-region.
 }
 
 // *******************************************************************
@@ -0,0 +1,170 @@
+// Package gcs provides utilities for inspecting the GCS archive that
+// a job's task files are parsed from.
+package gcs
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"google.golang.org/api/iterator"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// ErrBadArchive is returned by Validate when the archive has no task files,
+// or has empty or corrupt task files.
+var ErrBadArchive = errors.New("bad archive")
+
+// Prefix returns the object prefix, within job.Bucket, for the job's task files.
+func Prefix(job tracker.Job) string {
+	return strings.TrimPrefix(job.Path(), "gs://"+job.Bucket+"/")
+}
+
+// Inventory lists the archive prefix for the job, and returns the number of
+// task files and the total bytes found.
+func Inventory(ctx context.Context, client stiface.Client, job tracker.Job) (tracker.Inventory, error) {
+	inv := tracker.Inventory{}
+	qry := storage.Query{
+		Delimiter: "/",
+		Prefix:    Prefix(job),
+	}
+	it := client.Bucket(job.Bucket).Objects(ctx, &qry)
+	for o, err := it.Next(); err != iterator.Done; o, err = it.Next() {
+		if err != nil {
+			return tracker.Inventory{}, err
+		}
+		// Skip synthetic directory entries.
+		if o.Prefix != "" || strings.HasSuffix(o.Name, "/") {
+			continue
+		}
+		inv.Files++
+		inv.Bytes += o.Size
+	}
+	return inv, nil
+}
+
+// Validate lists the archive prefix for the job, and checks that there are
+// task files, and that none are empty.  It then reads sample of the gzipped
+// task files, spread evenly across the listing, to verify gzip integrity.  A
+// negative sample verifies every file.  Problems with the archive itself
+// return an error wrapping ErrBadArchive.  Other errors, e.g. listing
+// failures, are returned unwrapped.
+func Validate(ctx context.Context, client stiface.Client, job tracker.Job, sample int) error {
+	qry := storage.Query{
+		Delimiter: "/",
+		Prefix:    Prefix(job),
+	}
+	files := []*storage.ObjectAttrs{}
+	it := client.Bucket(job.Bucket).Objects(ctx, &qry)
+	for o, err := it.Next(); err != iterator.Done; o, err = it.Next() {
+		if err != nil {
+			return err
+		}
+		if o.Prefix != "" || strings.HasSuffix(o.Name, "/") {
+			continue
+		}
+		if o.Size == 0 {
+			return fmt.Errorf("%w: empty task file %s", ErrBadArchive, o.Name)
+		}
+		if strings.HasSuffix(o.Name, ".gz") || strings.HasSuffix(o.Name, ".tgz") {
+			files = append(files, o)
+		}
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("%w: no task files in gs://%s/%s", ErrBadArchive, job.Bucket, qry.Prefix)
+	}
+	if sample < 0 || sample > len(files) {
+		sample = len(files)
+	}
+	for i := 0; i < sample; i++ {
+		o := files[i*len(files)/sample]
+		if err := checkGzip(ctx, client, job.Bucket, o.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkGzip reads the whole object, returning ErrBadArchive if it is not a
+// valid gzip stream.
+func checkGzip(ctx context.Context, client stiface.Client, bucket, name string) error {
+	rd, err := client.Bucket(bucket).Object(name).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	gz, err := gzip.NewReader(rd)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrBadArchive, name, err)
+	}
+	_, err = io.Copy(ioutil.Discard, gz)
+	if err == gzip.ErrChecksum || err == gzip.ErrHeader || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %s: %v", ErrBadArchive, name, err)
+	}
+	return err
+}
+
+// prefixes returns the immediate sub prefixes of prefix, e.g. "2020/" for
+// "ndt/ndt7/2020/".
+func prefixes(ctx context.Context, client stiface.Client, bucket, prefix string) ([]string, error) {
+	qry := storage.Query{
+		Delimiter: "/",
+		Prefix:    prefix,
+	}
+	result := []string{}
+	it := client.Bucket(bucket).Objects(ctx, &qry)
+	for o, err := it.Next(); err != iterator.Done; o, err = it.Next() {
+		if err != nil {
+			return nil, err
+		}
+		if o.Prefix != "" {
+			result = append(result, strings.TrimPrefix(o.Prefix, prefix))
+		}
+	}
+	return result, nil
+}
+
+// Dates returns the dates from start to end, inclusive, that have an archive
+// prefix, e.g. ndt/ndt7/2020/06/01/, for the experiment/datatype.  Only the
+// year, month and day prefixes are listed, not the task files.
+func Dates(ctx context.Context, client stiface.Client, bucket, experiment, datatype string,
+	start, end time.Time) ([]time.Time, error) {
+	base := experiment + "/" + datatype + "/"
+	dates := []time.Time{}
+	years, err := prefixes(ctx, client, bucket, base)
+	if err != nil {
+		return nil, err
+	}
+	for _, y := range years {
+		year, err := time.Parse("2006/", y)
+		if err != nil || year.Year() < start.Year() || year.Year() > end.Year() {
+			continue
+		}
+		months, err := prefixes(ctx, client, bucket, base+y)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range months {
+			days, err := prefixes(ctx, client, bucket, base+y+m)
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range days {
+				date, err := time.Parse("2006/01/02/", y+m+d)
+				if err != nil || date.Before(start) || date.After(end) {
+					continue
+				}
+				dates = append(dates, date)
+			}
+		}
+	}
+	return dates, nil
+}
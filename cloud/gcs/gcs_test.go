@@ -0,0 +1,252 @@
+package gcs_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"google.golang.org/api/iterator"
+
+	"github.com/m-lab/etl-gardener/cloud/gcs"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// fakeClient returns a fake BucketHandle that returns a series of fake Objects.
+type fakeClient struct {
+	stiface.Client
+	objects []*storage.ObjectAttrs
+	err     error // Returned by the iterator after all objects.
+	query   *storage.Query
+}
+
+func (f *fakeClient) Bucket(name string) stiface.BucketHandle {
+	return &fakeBucketHandle{client: f}
+}
+
+type fakeBucketHandle struct {
+	stiface.BucketHandle
+	client *fakeClient
+}
+
+func (bh *fakeBucketHandle) Objects(ctx context.Context, q *storage.Query) stiface.ObjectIterator {
+	bh.client.query = q
+	return &fakeObjectIterator{objects: bh.client.objects, err: bh.client.err}
+}
+
+type fakeObjectIterator struct {
+	stiface.ObjectIterator
+	objects []*storage.ObjectAttrs
+	err     error
+}
+
+func (it *fakeObjectIterator) Next() (*storage.ObjectAttrs, error) {
+	if len(it.objects) == 0 {
+		if it.err != nil {
+			return nil, it.err
+		}
+		return nil, iterator.Done
+	}
+	o := it.objects[0]
+	it.objects = it.objects[1:]
+	return o, nil
+}
+
+func TestInventory(t *testing.T) {
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	fc := &fakeClient{objects: []*storage.ObjectAttrs{
+		{Name: "ndt/ndt7/2020/06/01/"},
+		{Name: "ndt/ndt7/2020/06/01/a.tgz", Size: 100},
+		{Name: "ndt/ndt7/2020/06/01/b.tgz", Size: 250},
+		{Prefix: "ndt/ndt7/2020/06/01/subdir/"},
+	}}
+	inv, err := gcs.Inventory(context.Background(), fc, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc.query.Prefix != "ndt/ndt7/2020/06/01/" {
+		t.Error("Wrong prefix", fc.query.Prefix)
+	}
+	if inv.Files != 2 || inv.Bytes != 350 {
+		t.Errorf("Wrong inventory %+v", inv)
+	}
+
+	fc.err = errors.New("listing failed")
+	_, err = gcs.Inventory(context.Background(), fc, job)
+	if err != fc.err {
+		t.Error("Expected listing error", err)
+	}
+}
+
+// prefixClient emulates delimited listing of a set of object names.
+type prefixClient struct {
+	stiface.Client
+	names []string
+}
+
+func (f *prefixClient) Bucket(name string) stiface.BucketHandle {
+	return &prefixBucketHandle{names: f.names}
+}
+
+type prefixBucketHandle struct {
+	stiface.BucketHandle
+	names []string
+}
+
+func (bh *prefixBucketHandle) Objects(ctx context.Context, q *storage.Query) stiface.ObjectIterator {
+	objects := []*storage.ObjectAttrs{}
+	seen := map[string]bool{}
+	for _, name := range bh.names {
+		if !strings.HasPrefix(name, q.Prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, q.Prefix)
+		if i := strings.Index(rest, q.Delimiter); i >= 0 {
+			p := q.Prefix + rest[:i+1]
+			if !seen[p] {
+				seen[p] = true
+				objects = append(objects, &storage.ObjectAttrs{Prefix: p})
+			}
+			continue
+		}
+		objects = append(objects, &storage.ObjectAttrs{Name: name})
+	}
+	return &fakeObjectIterator{objects: objects}
+}
+
+func TestDates(t *testing.T) {
+	client := &prefixClient{names: []string{
+		"ndt/ndt7/2019/12/31/a.tgz",
+		"ndt/ndt7/2020/01/01/a.tgz",
+		"ndt/ndt7/2020/01/01/b.tgz",
+		"ndt/ndt7/2020/01/03/a.tgz",
+		"ndt/ndt7/2020/02/01/a.tgz",
+		"ndt/ndt7/2021/01/01/a.tgz",
+		"ndt/ndt7/README",
+		"ndt/ndt5/2020/01/02/a.tgz",
+	}}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2020, 1, 31, 0, 0, 0, 0, time.UTC)
+	dates, err := gcs.Dates(context.Background(), client, "bucket", "ndt", "ndt7", start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Time{start, start.AddDate(0, 0, 2)}
+	if len(dates) != len(want) {
+		t.Fatal("Wrong dates", dates)
+	}
+	for i := range want {
+		if !dates[i].Equal(want[i]) {
+			t.Error("Wrong date", dates[i], want[i])
+		}
+	}
+}
+
+// archiveClient serves listed objects with the given contents.
+type archiveClient struct {
+	stiface.Client
+	objects  []*storage.ObjectAttrs
+	contents map[string][]byte
+	reads    []string
+}
+
+func (f *archiveClient) Bucket(name string) stiface.BucketHandle {
+	return &archiveBucketHandle{client: f}
+}
+
+type archiveBucketHandle struct {
+	stiface.BucketHandle
+	client *archiveClient
+}
+
+func (bh *archiveBucketHandle) Objects(ctx context.Context, q *storage.Query) stiface.ObjectIterator {
+	return &fakeObjectIterator{objects: bh.client.objects}
+}
+
+func (bh *archiveBucketHandle) Object(name string) stiface.ObjectHandle {
+	return &archiveObjectHandle{client: bh.client, name: name}
+}
+
+type archiveObjectHandle struct {
+	stiface.ObjectHandle
+	client *archiveClient
+	name   string
+}
+
+func (oh *archiveObjectHandle) NewReader(ctx context.Context) (stiface.Reader, error) {
+	oh.client.reads = append(oh.client.reads, oh.name)
+	return &archiveReader{data: bytes.NewReader(oh.client.contents[oh.name])}, nil
+}
+
+type archiveReader struct {
+	stiface.Reader
+	data *bytes.Reader
+}
+
+func (r *archiveReader) Read(p []byte) (int, error) { return r.data.Read(p) }
+func (r *archiveReader) Close() error               { return nil }
+
+func gzipped(s string) []byte {
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestValidate(t *testing.T) {
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	good := gzipped("task file")
+	truncated := good[:len(good)-4]
+	fc := &archiveClient{
+		objects: []*storage.ObjectAttrs{
+			{Name: "ndt/ndt7/2020/06/01/"},
+			{Name: "ndt/ndt7/2020/06/01/a.tgz", Size: 100},
+			{Name: "ndt/ndt7/2020/06/01/b.tgz", Size: 100},
+			{Name: "ndt/ndt7/2020/06/01/c.tgz", Size: 100},
+			{Name: "ndt/ndt7/2020/06/01/d.tgz", Size: 100},
+		},
+		contents: map[string][]byte{
+			"ndt/ndt7/2020/06/01/a.tgz": good,
+			"ndt/ndt7/2020/06/01/b.tgz": good,
+			"ndt/ndt7/2020/06/01/c.tgz": good,
+			"ndt/ndt7/2020/06/01/d.tgz": truncated,
+		},
+	}
+	if err := gcs.Validate(context.Background(), fc, job, 0); err != nil {
+		t.Error("Listing only should succeed", err)
+	}
+	if len(fc.reads) != 0 {
+		t.Error("Should not read files", fc.reads)
+	}
+	if err := gcs.Validate(context.Background(), fc, job, 2); err != nil {
+		t.Error("Sample should miss the corrupt file", err)
+	}
+	if len(fc.reads) != 2 || fc.reads[1] != "ndt/ndt7/2020/06/01/c.tgz" {
+		t.Error("Wrong sample", fc.reads)
+	}
+	err := gcs.Validate(context.Background(), fc, job, -1)
+	if !errors.Is(err, gcs.ErrBadArchive) || !strings.Contains(err.Error(), "d.tgz") {
+		t.Error("Expected ErrBadArchive for d.tgz", err)
+	}
+
+	fc.contents["ndt/ndt7/2020/06/01/d.tgz"] = []byte("not gzip")
+	if err := gcs.Validate(context.Background(), fc, job, -1); !errors.Is(err, gcs.ErrBadArchive) {
+		t.Error("Expected ErrBadArchive", err)
+	}
+
+	fc.objects[2].Size = 0
+	if err := gcs.Validate(context.Background(), fc, job, 0); !errors.Is(err, gcs.ErrBadArchive) {
+		t.Error("Expected ErrBadArchive for empty file", err)
+	}
+
+	fc.objects = fc.objects[:1]
+	if err := gcs.Validate(context.Background(), fc, job, 0); !errors.Is(err, gcs.ErrBadArchive) {
+		t.Error("Expected ErrBadArchive for missing files", err)
+	}
+}
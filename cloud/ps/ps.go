@@ -0,0 +1,120 @@
+// Package ps provides a Pub/Sub subscriber that consumes parser completion
+// notifications, so that the tracker can advance jobs as soon as the parser
+// finishes, rather than waiting for the next polled update.
+package ps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Errors associated with parse completion messages.
+var (
+	ErrMalformedMessage = errors.New("malformed parse complete message")
+	ErrUnexpectedState  = errors.New("job is not in a parsing state")
+
+	// MessageCount counts the parse completion messages received.
+	// Provides metrics:
+	//   gardener_pubsub_messages_total{outcome}
+	// Example usage:
+	//   MessageCount.WithLabelValues("ok").Inc()
+	MessageCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_pubsub_messages_total",
+			Help: "Number of parse completion messages received, by outcome.",
+		},
+		[]string{"outcome"},
+	)
+)
+
+// ParseComplete is the message published by the parser when it has finished
+// processing all files for a job.
+type ParseComplete struct {
+	Job   tracker.Job
+	Files int64 // Number of task files parsed.
+	Rows  int64 // Number of rows committed to BigQuery.
+	// Version is the parser release, if reported.
+	Version string `json:",omitempty"`
+}
+
+// Receiver is the subset of pubsub.Subscription used by the Subscriber.
+type Receiver interface {
+	Receive(ctx context.Context, f func(context.Context, *pubsub.Message)) error
+}
+
+// Subscriber receives ParseComplete messages and updates the tracker.
+type Subscriber struct {
+	rcv     Receiver
+	tracker *tracker.Tracker
+}
+
+// NewSubscriber creates a Subscriber that applies messages from rcv to tk.
+func NewSubscriber(rcv Receiver, tk *tracker.Tracker) *Subscriber {
+	return &Subscriber{rcv: rcv, tracker: tk}
+}
+
+// Run receives messages until the context is canceled or an unrecoverable
+// error occurs.
+func (s *Subscriber) Run(ctx context.Context) error {
+	return s.rcv.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		if err := s.Handle(ctx, msg.Data); err == nil || !retryable(err) {
+			msg.Ack()
+		} else {
+			msg.Nack()
+		}
+	})
+}
+
+// retryable returns true if the message should be redelivered.
+func retryable(err error) bool {
+	return err != ErrMalformedMessage && err != ErrUnexpectedState &&
+		err != tracker.ErrJobNotFound
+}
+
+// Handle applies a single encoded ParseComplete message to the tracker.
+// Jobs that have already advanced past parsing are left unchanged, so
+// that duplicate or late messages are harmless.
+func (s *Subscriber) Handle(ctx context.Context, data []byte) error {
+	var pc ParseComplete
+	if err := json.Unmarshal(data, &pc); err != nil || pc.Job.Date.IsZero() {
+		log.Println(ErrMalformedMessage, string(data))
+		MessageCount.WithLabelValues("malformed").Inc()
+		return ErrMalformedMessage
+	}
+
+	status, err := s.tracker.GetStatus(pc.Job)
+	if err != nil {
+		log.Println(err, pc.Job)
+		MessageCount.WithLabelValues("unknown job").Inc()
+		return err
+	}
+	switch status.State() {
+	case tracker.Init, tracker.Parsing:
+	default:
+		MessageCount.WithLabelValues("ignored").Inc()
+		return ErrUnexpectedState
+	}
+
+	err = s.tracker.SetParseStats(pc.Job, tracker.ParseStats{Files: pc.Files, Rows: pc.Rows})
+	if err == nil && pc.Version != "" {
+		err = s.tracker.SetVersion(pc.Job, pc.Version)
+	}
+	if err == nil {
+		err = s.tracker.SetStatus(pc.Job, tracker.ParseComplete, "notified by parser")
+	}
+	if err != nil {
+		log.Println(err, pc.Job)
+		MessageCount.WithLabelValues("error").Inc()
+		return err
+	}
+	MessageCount.WithLabelValues("ok").Inc()
+	return nil
+}
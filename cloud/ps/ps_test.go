@@ -0,0 +1,99 @@
+package ps_test
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/ps"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+func msg(t *testing.T, job tracker.Job, files, rows int64) []byte {
+	data, err := json.Marshal(ps.ParseComplete{Job: job, Files: files, Rows: rows})
+	rtx.Must(err, "marshal")
+	return data
+}
+
+func TestHandle(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0) // Only using jobmap.
+	rtx.Must(err, "tk init")
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(job), "add job")
+	rtx.Must(tk.SetStatus(job, tracker.Parsing, ""), "set status")
+
+	s := ps.NewSubscriber(nil, tk)
+	if err := s.Handle(ctx, []byte("garbage")); err != ps.ErrMalformedMessage {
+		t.Error("Expected ErrMalformedMessage", err)
+	}
+	other := tracker.NewJob("bucket", "exp", "other", job.Date)
+	if err := s.Handle(ctx, msg(t, other, 1, 2)); err != tracker.ErrJobNotFound {
+		t.Error("Expected ErrJobNotFound", err)
+	}
+
+	if err := s.Handle(ctx, msg(t, job, 10, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	status, err := tk.GetStatus(job)
+	rtx.Must(err, "get status")
+	if status.State() != tracker.ParseComplete {
+		t.Error("Wrong state", status.State())
+	}
+	if status.ParseStats == nil || status.ParseStats.Files != 10 || status.ParseStats.Rows != 2000 {
+		t.Errorf("Wrong stats %+v", status.ParseStats)
+	}
+
+	// A duplicate message should not change the job.
+	if err := s.Handle(ctx, msg(t, job, 11, 2001)); err != ps.ErrUnexpectedState {
+		t.Error("Expected ErrUnexpectedState", err)
+	}
+	status, _ = tk.GetStatus(job)
+	if status.ParseStats.Files != 10 {
+		t.Error("Duplicate message changed stats", status.ParseStats)
+	}
+}
+
+type fakeRequester struct {
+	jobs []tracker.Job
+	err  error
+}
+
+func (f *fakeRequester) Request(job tracker.Job) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.jobs = append(f.jobs, job)
+	return nil
+}
+
+func TestRequestSubscriber(t *testing.T) {
+	ctx := context.Background()
+	req := &fakeRequester{}
+	s := ps.NewRequestSubscriber(nil, req)
+	if err := s.Handle(ctx, []byte("garbage")); err != ps.ErrMalformedMessage {
+		t.Error("Expected ErrMalformedMessage", err)
+	}
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC))
+	data, err := json.Marshal(ps.JobRequest{Job: job, Reason: "corrupt archive"})
+	rtx.Must(err, "marshal")
+	if err := s.Handle(ctx, data); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.jobs) != 1 || req.jobs[0] != job {
+		t.Error("Wrong requests", req.jobs)
+	}
+	req.err = tracker.ErrJobNotFound
+	if err := s.Handle(ctx, data); err != req.err {
+		t.Error("Expected rejection", err)
+	}
+}
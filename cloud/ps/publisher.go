@@ -0,0 +1,28 @@
+package ps
+
+import (
+	"context"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Topic is the subset of pubsub.Topic used by the TopicPublisher.
+type Topic interface {
+	Publish(ctx context.Context, msg *pubsub.Message) *pubsub.PublishResult
+}
+
+// TopicPublisher publishes messages to a Pub/Sub topic.
+type TopicPublisher struct {
+	topic Topic
+}
+
+// NewTopicPublisher creates a TopicPublisher for the topic.
+func NewTopicPublisher(topic Topic) *TopicPublisher {
+	return &TopicPublisher{topic: topic}
+}
+
+// Publish publishes data, and waits for the server to accept it.
+func (p *TopicPublisher) Publish(ctx context.Context, data []byte) error {
+	_, err := p.topic.Publish(ctx, &pubsub.Message{Data: data}).Get(ctx)
+	return err
+}
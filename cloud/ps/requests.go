@@ -0,0 +1,61 @@
+package ps
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"cloud.google.com/go/pubsub"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// JobRequest is the message published to request that a job be processed,
+// e.g. by a parser that found a corrupt task file.
+type JobRequest struct {
+	Job tracker.Job
+	// Reason is logged with the request, if provided.
+	Reason string `json:",omitempty"`
+}
+
+// Requester queues requested jobs, e.g. a job.RequestQueue.
+type Requester interface {
+	Request(job tracker.Job) error
+}
+
+// RequestSubscriber receives JobRequest messages and queues the jobs.
+type RequestSubscriber struct {
+	rcv Receiver
+	req Requester
+}
+
+// NewRequestSubscriber creates a RequestSubscriber that queues the jobs
+// requested by messages from rcv.
+func NewRequestSubscriber(rcv Receiver, req Requester) *RequestSubscriber {
+	return &RequestSubscriber{rcv: rcv, req: req}
+}
+
+// Run receives messages until the context is canceled or an unrecoverable
+// error occurs.  Messages are always acked, since rejected requests would
+// be rejected again.
+func (s *RequestSubscriber) Run(ctx context.Context) error {
+	return s.rcv.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		s.Handle(ctx, msg.Data)
+		msg.Ack()
+	})
+}
+
+// Handle queues the job requested by a single encoded JobRequest message.
+func (s *RequestSubscriber) Handle(ctx context.Context, data []byte) error {
+	var jr JobRequest
+	if err := json.Unmarshal(data, &jr); err != nil || jr.Job.Date.IsZero() {
+		log.Println(ErrMalformedMessage, string(data))
+		return ErrMalformedMessage
+	}
+	if err := s.req.Request(jr.Job); err != nil {
+		log.Println(err, jr.Job)
+		return err
+	}
+	log.Println("Requested", jr.Job, jr.Reason)
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/admin"
+	"github.com/m-lab/etl-gardener/api/client"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+var (
+	gardenerURL = flag.String("gardener_url", "http://localhost:8080", "Base URL of the gardener manager")
+	adminKey    = flag.String("admin_key", "", "API key for the gardener admin API")
+	bucket      = flag.String("bucket", "archive-measurement-lab", "Bucket for job operations")
+	experiment  = flag.String("experiment", "", "Experiment filter, or experiment for job operations")
+	datatype    = flag.String("datatype", "", "Datatype filter, or datatype for job operations")
+	state       = flag.String("state", "", "State filter for jobs")
+	prefix      = flag.String("prefix", "", "Task file name prefix within the day, e.g. 20200601T15, for job operations")
+	reason      = flag.String("reason", "", "Reason recorded for cancel")
+	force       = flag.Bool("force", false, "Requeue and backfill reprocess jobs even if they are in flight or complete")
+	plan        = flag.Bool("plan", false, "Backfill through the planner, ordered by archive size")
+	approve     = flag.Bool("approve", false, "Approve planned backfills whose estimated cost exceeds the manager's threshold")
+	interval    = flag.Duration("interval", 10*time.Second, "Polling interval for tail")
+)
+
+// Errors returned by gardener-ctl.
+var (
+	ErrUsage       = errors.New("invalid usage")
+	ErrJobNotFound = errors.New("job not found")
+	// ErrNotApproved is returned for planned backfills that need -approve.
+	ErrNotApproved = errors.New("backfill not approved")
+)
+
+var usageText = `
+NAME
+  gardener-ctl - operator tool for the gardener manager
+
+SYNOPSIS
+  gardener-ctl [flags] <command> [args]
+
+COMMANDS
+  jobs                       list jobs, filtered by -experiment, -datatype and -state
+  timeline <date>            show the state history of a job
+  requeue <date>...          requeue jobs for the given dates
+  backfill <start> <end>     queue jobs for every date from start to end, inclusive,
+                             in requests of at most a year of dates each
+  cancel <date>              cancel a job, recording -reason
+  skip <date>                add a job to the skip list
+  unskip <date>              remove a job from the skip list
+  pause                      pause the monitor, or a single datatype if -experiment and -datatype are set
+  resume                     resume the monitor, or a single datatype
+  tail                       poll the job list, and print every state change
+
+  Dates are formatted as 2006-01-02.  Job operations require -experiment and
+  -datatype.  Admin commands require -admin_key.  With -force, requeue and
+  backfill reset jobs that are in flight or complete, and reprocess them.
+  With -plan, backfill queues the dates in the order of the manager's backfill
+  policy, e.g. largest archive first.  It first prints the estimated bytes
+  processed and slot hours, from dry runs of a sample of dates.  Backfills
+  whose estimate exceeds the manager's approval threshold also require
+  -approve.
+
+EXAMPLES
+  gardener-ctl -state=failed jobs
+  gardener-ctl -experiment=ndt -datatype=ndt7 timeline 2020-06-01
+  gardener-ctl -admin_key=$KEY -experiment=ndt -datatype=ndt7 backfill 2020-06-01 2020-06-30
+  gardener-ctl -admin_key=$KEY -experiment=ndt -datatype=ndt7 -plan -approve backfill 2019-01-01 2019-12-31
+`
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usageText)
+		flag.PrintDefaults()
+	}
+}
+
+// ctl issues requests to the gardener API.
+type ctl struct {
+	api *client.Client
+	out io.Writer
+}
+
+// getJobs fetches the jobs matching the filters.
+func (c *ctl) getJobs(ctx context.Context, exp, dt, st string) ([]tracker.JobStatus, error) {
+	return c.api.Jobs(ctx, client.JobFilter{Experiment: exp, Datatype: dt, State: tracker.State(st)})
+}
+
+func (c *ctl) jobs(ctx context.Context, exp, dt, st string) error {
+	jobs, err := c.getJobs(ctx, exp, dt, st)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tSTATE\tIN STATE\tDETAIL")
+	for _, js := range jobs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", js.Job, js.Status.State(),
+			time.Since(js.Status.StateChangeTime()).Round(time.Second), js.Status.Detail())
+	}
+	return w.Flush()
+}
+
+func (c *ctl) timeline(ctx context.Context, job tracker.Job) error {
+	jobs, err := c.getJobs(ctx, job.Experiment, job.Datatype, "")
+	if err != nil {
+		return err
+	}
+	for _, js := range jobs {
+		if !js.Job.Date.Equal(job.Date) {
+			continue
+		}
+		w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "STATE\tSTART\tDETAIL")
+		for _, h := range js.Status.History {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", h.State, h.Start.Format(time.RFC3339), h.Detail)
+		}
+		return w.Flush()
+	}
+	return fmt.Errorf("%w: %s", ErrJobNotFound, job)
+}
+
+// backfill prints the estimated cost of the backfill, if the manager
+// estimates backfills, and plans it, unless it needs approval and approve is
+// false.
+func (c *ctl) backfill(ctx context.Context, j tracker.Job, end time.Time, approve bool) error {
+	e, err := c.api.BackfillEstimate(ctx, j, end)
+	switch {
+	case errors.Is(err, client.ErrNotFound):
+	case err != nil:
+		return err
+	default:
+		fmt.Fprintf(c.out, "%d jobs: ~%d bytes processed, ~%.1f slot hours, from %d sampled dates\n",
+			e.Jobs, e.Bytes, e.SlotHours, len(e.Sampled))
+		if e.NeedsApproval && !approve {
+			return fmt.Errorf("%w: estimate exceeds the approval threshold, rerun with -approve", ErrNotApproved)
+		}
+	}
+	return c.api.Backfill(ctx, j, end, approve)
+}
+
+// requeueRange requeues the jobs from the job's date to end, in chunks of
+// at most admin.MaxRangeDays dates, the most the manager accepts per request.
+func (c *ctl) requeueRange(ctx context.Context, j tracker.Job, end time.Time, force bool) error {
+	for !j.Date.After(end) {
+		last := j.Date.AddDate(0, 0, admin.MaxRangeDays-1)
+		if last.After(end) {
+			last = end
+		}
+		if err := c.api.Requeue(ctx, j, last, force); err != nil {
+			return err
+		}
+		j.Date = last.AddDate(0, 0, 1)
+	}
+	return nil
+}
+
+// tail polls the job list, and prints each change of state, until ctx is done.
+func (c *ctl) tail(ctx context.Context, exp, dt string, period time.Duration) error {
+	last := map[tracker.Job]tracker.State{}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		jobs, err := c.getJobs(ctx, exp, dt, "")
+		if err != nil {
+			log.Println(err)
+		} else {
+			now := time.Now().Format("15:04:05")
+			current := make(map[tracker.Job]tracker.State, len(jobs))
+			for _, js := range jobs {
+				s := js.Status.State()
+				current[js.Job] = s
+				if old, ok := last[js.Job]; !ok || old != s {
+					fmt.Fprintf(c.out, "%s %s %s -> %s %s\n", now, js.Job, old, s, js.Status.Detail())
+				}
+			}
+			for j, old := range last {
+				if _, ok := current[j]; !ok {
+					fmt.Fprintf(c.out, "%s %s %s -> removed\n", now, j, old)
+				}
+			}
+			last = current
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// job returns the job for the date argument, using the flag values.
+func job(date string) (tracker.Job, error) {
+	if *experiment == "" || *datatype == "" {
+		return tracker.Job{}, fmt.Errorf("%w: -experiment and -datatype are required", ErrUsage)
+	}
+	d, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return tracker.Job{}, err
+	}
+	j := tracker.NewJob(*bucket, *experiment, *datatype, d)
+	j.Prefix = *prefix
+	return j, nil
+}
+
+func (c *ctl) run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "jobs":
+		return c.jobs(ctx, *experiment, *datatype, *state)
+	case "timeline":
+		if len(args) != 1 {
+			return ErrUsage
+		}
+		j, err := job(args[0])
+		if err != nil {
+			return err
+		}
+		return c.timeline(ctx, j)
+	case "requeue":
+		if len(args) == 0 {
+			return ErrUsage
+		}
+		for _, date := range args {
+			j, err := job(date)
+			if err != nil {
+				return err
+			}
+			if err := c.api.Requeue(ctx, j, time.Time{}, *force); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "backfill":
+		if len(args) != 2 {
+			return ErrUsage
+		}
+		j, err := job(args[0])
+		if err != nil {
+			return err
+		}
+		end, err := time.Parse("2006-01-02", args[1])
+		if err != nil {
+			return err
+		}
+		if *plan {
+			return c.backfill(ctx, j, end, *approve)
+		}
+		return c.requeueRange(ctx, j, end, *force)
+	case "cancel", "skip", "unskip":
+		if len(args) != 1 {
+			return ErrUsage
+		}
+		j, err := job(args[0])
+		if err != nil {
+			return err
+		}
+		if cmd == "cancel" {
+			return c.api.Cancel(ctx, j, *reason)
+		}
+		return c.api.SetSkip(ctx, j, cmd == "skip")
+	case "pause":
+		return c.api.Pause(ctx, *experiment, *datatype)
+	case "resume":
+		return c.api.Resume(ctx, *experiment, *datatype)
+	case "tail":
+		return c.tail(ctx, *experiment, *datatype, *interval)
+	default:
+		return fmt.Errorf("%w: unknown command %q", ErrUsage, cmd)
+	}
+}
+
+func main() {
+	flag.Parse()
+	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not get args from env")
+
+	base, err := url.Parse(*gardenerURL)
+	rtx.Must(err, "Invalid gardener_url")
+	c := &ctl{api: client.New(*base, *adminKey), out: os.Stdout}
+	if err := c.run(context.Background(), flag.Args()); err != nil {
+		if errors.Is(err, ErrUsage) {
+			flag.Usage()
+		}
+		log.Fatal(err)
+	}
+}
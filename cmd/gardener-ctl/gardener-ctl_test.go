@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/api/client"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestRun(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	rtx.Must(tk.AddJob(tracker.NewJob("archive-measurement-lab", "ndt", "ndt7", date)), "add")
+	rtx.Must(tk.SetStatus(tracker.NewJob("archive-measurement-lab", "ndt", "ndt7", date), tracker.Loading, "started"), "set")
+
+	var posted []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs.json", tk.JobsHandler)
+	var estimate []byte
+	mux.HandleFunc("/admin/backfill-estimate", func(resp http.ResponseWriter, req *http.Request) {
+		if estimate == nil {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp.Write(estimate)
+	})
+	mux.HandleFunc("/admin/", func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer key" {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		req.ParseForm()
+		posted = append(posted, req.URL.Path+" "+req.Form.Get("end"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	base, err := url.Parse(server.URL)
+	rtx.Must(err, "parse")
+	out := &bytes.Buffer{}
+	c := &ctl{api: client.New(*base, "key"), out: out}
+	ctx := context.Background()
+
+	rtx.Must(c.run(ctx, []string{"jobs"}), "jobs")
+	if !strings.Contains(out.String(), "20200601:ndt/ndt7  loading") {
+		t.Error("Missing job:", out.String())
+	}
+
+	*experiment, *datatype = "ndt", "ndt7"
+	defer func() { *experiment, *datatype = "", "" }()
+	out.Reset()
+	rtx.Must(c.run(ctx, []string{"timeline", "2020-06-01"}), "timeline")
+	if !strings.Contains(out.String(), "init") || !strings.Contains(out.String(), "started") {
+		t.Error("Wrong timeline:", out.String())
+	}
+	if err := c.run(ctx, []string{"timeline", "2020-06-02"}); !errors.Is(err, ErrJobNotFound) {
+		t.Error("Expected ErrJobNotFound", err)
+	}
+
+	rtx.Must(c.run(ctx, []string{"backfill", "2020-06-01", "2020-06-30"}), "backfill")
+	rtx.Must(c.run(ctx, []string{"pause"}), "pause")
+	*plan = true
+	rtx.Must(c.run(ctx, []string{"backfill", "2020-06-01", "2020-06-30"}), "planned backfill")
+	*plan = false
+	if len(posted) != 3 || posted[0] != "/admin/requeue 2020-06-30" || posted[1] != "/admin/pause " ||
+		posted[2] != "/admin/backfill 2020-06-30" {
+		t.Error("Wrong admin requests", posted)
+	}
+
+	// Planned backfills print the estimate, and need approval above the
+	// threshold.
+	*plan = true
+	defer func() { *plan = false }()
+	estimate = []byte(`{"Jobs":30,"Bytes":3000000000000,"SlotHours":8.3,"NeedsApproval":true}`)
+	out.Reset()
+	posted = nil
+	if err := c.run(ctx, []string{"backfill", "2020-06-01", "2020-06-30"}); !errors.Is(err, ErrNotApproved) {
+		t.Error("Expected ErrNotApproved", err)
+	}
+	if !strings.Contains(out.String(), "30 jobs: ~3000000000000 bytes processed, ~8.3 slot hours") || len(posted) != 0 {
+		t.Error("Wrong estimate output", out.String(), posted)
+	}
+	*approve = true
+	defer func() { *approve = false }()
+	rtx.Must(c.run(ctx, []string{"backfill", "2020-06-01", "2020-06-30"}), "approved backfill")
+	if len(posted) != 1 || posted[0] != "/admin/backfill 2020-06-30" {
+		t.Error("Wrong admin requests", posted)
+	}
+
+	// Long backfills are split into requests the manager accepts.
+	*plan = false
+	posted = nil
+	rtx.Must(c.run(ctx, []string{"backfill", "2019-01-01", "2020-06-30"}), "long backfill")
+	if len(posted) != 2 || posted[0] != "/admin/requeue 2020-01-01" || posted[1] != "/admin/requeue 2020-06-30" {
+		t.Error("Wrong admin requests", posted)
+	}
+
+	c.api.Key = "wrong"
+	if err := c.run(ctx, []string{"resume"}); err == nil {
+		t.Error("Expected unauthorized error")
+	}
+	if err := c.run(ctx, []string{"bogus"}); !errors.Is(err, ErrUsage) {
+		t.Error("Expected ErrUsage", err)
+	}
+}
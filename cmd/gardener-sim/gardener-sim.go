@@ -0,0 +1,159 @@
+// gardener-sim runs the standard gardener state machine against fake
+// BigQuery, GCS and Datastore clients, with simulated parsers, at
+// accelerated time.  It reports the throughput, and checks that every job
+// followed the expected state transitions, so that scheduler changes can be
+// load tested before deployment.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+var (
+	days       = flag.Int("days", 30, "Number of days to simulate")
+	startDate  = flag.String("start_date", "2020-06-01", "First simulated date, as yyyy-mm-dd")
+	experiment = flag.String("experiment", "ndt", "Simulated experiment")
+	datatype   = flag.String("datatype", "ndt7", "Simulated datatype")
+	parsers    = flag.Int("parsers", 4, "Number of concurrent simulated parsers")
+	parseTime  = flag.Duration("parse_time", 30*time.Minute, "Simulated time to parse each day")
+	watch      = flag.Duration("watch_period", 5*time.Second, "Monitor polling period, in simulated time")
+	save       = flag.Duration("save_interval", 5*time.Minute, "Tracker save interval, in simulated time")
+	speedup    = flag.Float64("speedup", 1000, "Ratio of simulated to real time")
+	files      = flag.Int("files", 100, "Mean number of task files per day")
+	rows       = flag.Int("rows", 1000, "Number of rows per task file")
+	maxDedups  = flag.Int("max_dedups", 0, "Maximum concurrent dedups, or zero for unlimited")
+	maxCopies  = flag.Int("max_copies", 0, "Maximum concurrent copies, or zero for unlimited")
+	seed       = flag.Int64("seed", 1, "Seed for the simulated task file counts")
+	limit      = flag.Duration("limit", 10*time.Minute, "Real time limit for the simulation")
+	verbose    = flag.Bool("verbose", false, "Show the gardener logs")
+)
+
+var usageText = `
+NAME
+  gardener-sim - simulate the gardener state machine at accelerated time
+
+DESCRIPTION
+  gardener-sim runs the standard monitor and tracker against fake BigQuery,
+  GCS and Datastore clients.  Simulated parsers add a job for each day, and
+  report it parsed after -parse_time.  Durations are in simulated time, and
+  run -speedup times faster.  The report shows the throughput, the time jobs
+  spent in each state, and any jobs that failed, did not complete, or made
+  unexpected state transitions.  Exits with status 1 if there were any.
+
+EXAMPLES
+  gardener-sim -days=365 -parsers=20 -max_dedups=2
+`
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usageText)
+		flag.PrintDefaults()
+	}
+}
+
+// StateTime summarizes the simulated time jobs spent in a state.
+type StateTime struct {
+	State tracker.State
+	Count int
+	Mean  time.Duration
+	Max   time.Duration
+}
+
+// Report summarizes a simulation run.
+type Report struct {
+	Config    Config
+	Jobs      int
+	Complete  int
+	Elapsed   time.Duration // Real time.
+	Simulated time.Duration
+	States    []StateTime // Sorted by decreasing mean time.
+
+	// Fake BigQuery operations.
+	Loads, Dedups, Copies, Deletes int
+
+	Errors []string // Failed or incomplete jobs, and unexpected transitions.
+}
+
+// OK returns true if every job completed correctly.
+func (r *Report) OK() bool {
+	return len(r.Errors) == 0
+}
+
+// Write writes the report in human readable form.
+func (r *Report) Write(w io.Writer) {
+	c := r.Config
+	fmt.Fprintf(w, "Simulated %d days of %s/%s from %s with %d parsers\n",
+		c.Days, c.Experiment, c.Datatype, c.Start.Format("2006-01-02"), c.Parsers)
+	fmt.Fprintf(w, "Elapsed %s real, %s simulated (speedup %g)\n",
+		r.Elapsed.Round(time.Millisecond), r.Simulated.Round(time.Second), c.Speedup)
+	perHour := 0.0
+	if r.Simulated > 0 {
+		perHour = float64(r.Complete) / r.Simulated.Hours()
+	}
+	fmt.Fprintf(w, "Throughput: %d of %d jobs complete, %.1f jobs per simulated hour, %.1f per real second\n",
+		r.Complete, r.Jobs, perHour, float64(r.Complete)/r.Elapsed.Seconds())
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATE\tJOBS\tMEAN\tMAX")
+	for _, st := range r.States {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", st.State, st.Count, st.Mean.Round(time.Second), st.Max.Round(time.Second))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "BigQuery: %d loads, %d dedups, %d copies, %d deletes\n",
+		r.Loads, r.Dedups, r.Copies, r.Deletes)
+
+	if r.OK() {
+		fmt.Fprintln(w, "Correctness: OK")
+		return
+	}
+	fmt.Fprintf(w, "Correctness: %d errors\n", len(r.Errors))
+	for _, e := range r.Errors {
+		fmt.Fprintln(w, "  ", e)
+	}
+}
+
+func main() {
+	flag.Parse()
+	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not get args from env")
+
+	start, err := time.Parse("2006-01-02", *startDate)
+	rtx.Must(err, "Invalid start_date")
+	if *days <= 0 || *parsers <= 0 || *speedup <= 0 {
+		log.Fatal("days, parsers and speedup must be positive")
+	}
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	sim, err := NewSimulation(Config{
+		Project: "gardener-sim", Bucket: "archive-gardener-sim",
+		Experiment: *experiment, Datatype: *datatype,
+		Start: start, Days: *days, Parsers: *parsers,
+		ParseTime: *parseTime, Watch: *watch, Save: *save, Speedup: *speedup,
+		Files: *files, Rows: *rows, MaxDedups: *maxDedups, MaxCopies: *maxCopies,
+		Seed: *seed, RealLimit: *limit,
+	})
+	rtx.Must(err, "Could not create simulation")
+	report, err := sim.Run(context.Background())
+	rtx.Must(err, "Simulation failed")
+
+	report.Write(os.Stdout)
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+)
+
+func TestSimulation(t *testing.T) {
+	cfg := Config{
+		Project: "sim", Bucket: "bucket", Experiment: "ndt", Datatype: "ndt7",
+		Start: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), Days: 5, Parsers: 2,
+		ParseTime: time.Minute, Watch: 5 * time.Second, Save: time.Minute,
+		Speedup: 1000, Files: 10, Rows: 100, MaxDedups: 1, Seed: 1,
+		RealLimit: time.Minute,
+	}
+	sim, err := NewSimulation(cfg)
+	rtx.Must(err, "NewSimulation failed")
+	report, err := sim.Run(context.Background())
+	rtx.Must(err, "Run failed")
+
+	if !report.OK() || report.Complete != 5 {
+		t.Errorf("Expected 5 complete jobs %+v", report)
+	}
+	if report.Loads != 5 || report.Dedups != 5 || report.Copies != 5 || report.Deletes != 5 {
+		t.Errorf("Wrong BigQuery operations %+v", report)
+	}
+	buf := bytes.Buffer{}
+	report.Write(&buf)
+	if !strings.Contains(buf.String(), "Correctness: OK") ||
+		!strings.Contains(buf.String(), "deduplicating") {
+		t.Error("Bad report", buf.String())
+	}
+}
+
+func TestSimulationTimeout(t *testing.T) {
+	cfg := Config{
+		Project: "sim", Bucket: "bucket", Experiment: "ndt", Datatype: "ndt7",
+		Start: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), Days: 3, Parsers: 1,
+		ParseTime: time.Hour, Watch: 5 * time.Second, Save: time.Minute,
+		Speedup: 1, Files: 10, Rows: 100, RealLimit: 50 * time.Millisecond,
+	}
+	sim, err := NewSimulation(cfg)
+	rtx.Must(err, "NewSimulation failed")
+	report, err := sim.Run(context.Background())
+	rtx.Must(err, "Run failed")
+
+	if report.OK() || report.Complete != 0 || len(report.Errors) != 3 {
+		t.Errorf("Expected 3 incomplete jobs %+v", report)
+	}
+}
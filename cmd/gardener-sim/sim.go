@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"github.com/m-lab/go/cloudtest/dsfake"
+	"google.golang.org/api/iterator"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/cloud/gcs"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// minPeriod is the shortest real polling or save period, however large the
+// speedup.
+const minPeriod = time.Millisecond
+
+// Config describes a simulation.  Durations are in simulated time.
+type Config struct {
+	Project    string
+	Bucket     string
+	Experiment string
+	Datatype   string
+	Start      time.Time // First simulated date.
+	Days       int       // Number of dates to process.
+	Parsers    int       // Number of concurrent simulated parsers.
+	ParseTime  time.Duration
+	Watch      time.Duration // Monitor polling period.
+	Save       time.Duration // Tracker save interval.
+	Speedup    float64       // Ratio of simulated to real time.
+	Files      int           // Mean task files per date.
+	Rows       int           // Rows per task file.
+	MaxDedups  int           // Concurrent dedup limit.  Zero is unlimited.
+	MaxCopies  int           // Concurrent copy limit.  Zero is unlimited.
+	Seed       int64         // Seed for the per date file counts.
+	RealLimit  time.Duration // Real time limit for the whole simulation.
+}
+
+// real converts a simulated duration to real time.
+func (c Config) real(d time.Duration) time.Duration {
+	r := time.Duration(float64(d) / c.Speedup)
+	if r < minPeriod {
+		return minPeriod
+	}
+	return r
+}
+
+// counts are the simulated task files and rows of a date.
+type counts struct {
+	files int64
+	rows  int64
+}
+
+// expected state transitions of the standard pipeline.
+var transitions = map[tracker.State]tracker.State{
+	tracker.Init:          tracker.Parsing,
+	tracker.Parsing:       tracker.ParseComplete,
+	tracker.ParseComplete: tracker.Loading,
+	tracker.Loading:       tracker.Deduplicating,
+	tracker.Deduplicating: tracker.Copying,
+	tracker.Copying:       tracker.Validating,
+	tracker.Validating:    tracker.Deleting,
+	tracker.Deleting:      tracker.Complete,
+}
+
+// recorder observes the tracker, and records the time jobs spend in each
+// state, and any unexpected transitions.
+type recorder struct {
+	lock     sync.Mutex
+	entered  map[tracker.Job]time.Time
+	inState  map[tracker.State][]time.Duration // Real time spent in each state.
+	complete map[tracker.Job]int
+	failed   map[tracker.Job]string
+	bad      []string
+	done     chan struct{} // Closed when all jobs are complete or failed.
+	want     int
+}
+
+func newRecorder(want int) *recorder {
+	return &recorder{entered: make(map[tracker.Job]time.Time),
+		inState: make(map[tracker.State][]time.Duration), complete: make(map[tracker.Job]int),
+		failed: make(map[tracker.Job]string), done: make(chan struct{}), want: want}
+}
+
+// observe implements tracker.Observer.
+func (r *recorder) observe(j tracker.Job, s tracker.Status) {
+	now := time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	prev, state := s.Prev(), s.State()
+	if t, ok := r.entered[j]; ok {
+		r.inState[prev] = append(r.inState[prev], now.Sub(t))
+	}
+	r.entered[j] = now
+	switch {
+	case state == tracker.Failed:
+		r.failed[j] = s.Detail()
+	case transitions[prev] != state:
+		r.bad = append(r.bad, fmt.Sprintf("%s: %s -> %s", j, prev, state))
+	}
+	if state == tracker.Complete {
+		r.complete[j]++
+	}
+	if state == tracker.Complete || state == tracker.Failed {
+		if len(r.complete)+len(r.failed) == r.want {
+			close(r.done)
+		}
+	}
+}
+
+// archive is a fake GCS client, that lists the simulated task files of each
+// date.
+type archive struct {
+	stiface.Client
+	files map[string]int64 // Keyed by prefix.
+}
+
+func (a *archive) Bucket(name string) stiface.BucketHandle {
+	return &archiveBucket{archive: a}
+}
+
+type archiveBucket struct {
+	stiface.BucketHandle
+	archive *archive
+}
+
+func (b *archiveBucket) Objects(ctx context.Context, q *storage.Query) stiface.ObjectIterator {
+	objects := []*storage.ObjectAttrs{{Name: q.Prefix}}
+	for i := int64(0); i < b.archive.files[q.Prefix]; i++ {
+		objects = append(objects, &storage.ObjectAttrs{
+			Name: fmt.Sprintf("%s%06d.tgz", q.Prefix, i), Size: 1 << 20})
+	}
+	return &archiveIterator{objects: objects}
+}
+
+type archiveIterator struct {
+	stiface.ObjectIterator
+	objects []*storage.ObjectAttrs
+}
+
+func (it *archiveIterator) Next() (*storage.ObjectAttrs, error) {
+	if len(it.objects) == 0 {
+		return nil, iterator.Done
+	}
+	o := it.objects[0]
+	it.objects = it.objects[1:]
+	return o, nil
+}
+
+// Simulation holds the fakes and state of a single simulation run.
+type Simulation struct {
+	cfg     Config
+	jobs    []tracker.Job
+	counts  map[tracker.Job]counts
+	bq      *bqfake.Client
+	archive *archive
+	ds      *dsfake.Client
+	rec     *recorder
+}
+
+// NewSimulation creates the jobs and fakes for the config.  The fake
+// BigQuery client is scripted so that each job's raw counts match its
+// archive and parser counts.
+func NewSimulation(cfg Config) (*Simulation, error) {
+	s := &Simulation{cfg: cfg, counts: make(map[tracker.Job]counts),
+		bq: bqfake.NewClient(cfg.Project), archive: &archive{files: make(map[string]int64)},
+		ds: dsfake.NewClient(), rec: newRecorder(cfg.Days)}
+	rnd := rand.New(rand.NewSource(cfg.Seed))
+	s.bq.AddResult("# Delete all duplicate rows", bqfake.Result{
+		Stats: &bigquery.JobStatistics{Details: &bigquery.QueryStatistics{}}})
+	for i := 0; i < cfg.Days; i++ {
+		j := tracker.NewJob(cfg.Bucket, cfg.Experiment, cfg.Datatype, cfg.Start.AddDate(0, 0, i))
+		names, err := bq.DefaultNaming.Names(j)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			// The dedup schema check needs the tmp table.
+			s.bq.AddTable(names.TmpDataset, names.Table, &bigquery.TableMetadata{Schema: bigquery.Schema{
+				{Name: "id"}, {Name: "date"}, {Name: "parser", Schema: bigquery.Schema{{Name: "Time"}}}}})
+		}
+		c := counts{files: int64(cfg.Files/2 + rnd.Intn(cfg.Files+1))}
+		c.rows = c.files * int64(cfg.Rows)
+		s.counts[j] = c
+		s.archive.files[gcs.Prefix(j)] = c.files
+		// The tmp partition, so that cleanup has something to delete.
+		s.bq.AddTable(names.TmpDataset, names.Table+"$"+j.Date.Format("20060102"),
+			&bigquery.TableMetadata{NumRows: uint64(c.rows)})
+		s.bq.AddResult(fmt.Sprintf("%s.%s`\nWHERE date = %q", names.RawDataset, names.Table, j.Date.Format("2006-01-02")),
+			bqfake.Result{Rows: []interface{}{bq.RawCounts{Files: c.files, Rows: c.rows}}})
+		s.jobs = append(s.jobs, j)
+	}
+	return s, nil
+}
+
+// parse simulates the parsers, which add each job, and report it parsed
+// after ParseTime.
+func (s *Simulation) parse(ctx context.Context, tk *tracker.Tracker) error {
+	jobs := make(chan tracker.Job)
+	errs := make(chan error, s.cfg.Parsers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < s.cfg.Parsers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				err := tk.AddJob(j)
+				if err == nil {
+					err = tk.SetStatus(j, tracker.Parsing, "simulated parser")
+				}
+				if err == nil {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(s.cfg.real(s.cfg.ParseTime)):
+					}
+					c := s.counts[j]
+					err = tk.SetParseStats(j, tracker.ParseStats{Files: c.files, Rows: c.rows})
+				}
+				if err == nil {
+					err = tk.SetStatus(j, tracker.ParseComplete, "parsed")
+				}
+				if err != nil {
+					errs <- fmt.Errorf("%v: %w", j, err)
+					return
+				}
+			}
+		}()
+	}
+	var err error
+dispatch:
+	for _, j := range s.jobs {
+		select {
+		case jobs <- j:
+		case <-ctx.Done():
+			break dispatch
+		case err = <-errs:
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return err
+}
+
+// Run runs the simulation until all jobs are complete or failed, or the
+// real time limit expires, and returns the report.
+func (s *Simulation) Run(ctx context.Context) (*Report, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RealLimit)
+	defer cancel()
+
+	key := datastore.NameKey("tracker", "jobs", nil)
+	key.Namespace = "gardener-sim"
+	tk, err := tracker.InitTracker(ctx, s.ds, key, s.cfg.real(s.cfg.Save), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	tk.AddObserver(s.rec.observe)
+
+	monitor, err := ops.NewStandardMonitor(ctx, cloud.BQConfig{BQProject: s.cfg.Project}, tk)
+	if err != nil {
+		return nil, err
+	}
+	monitor.SetBQClient(s.bq)
+	monitor.SetStorageClient(s.archive)
+	monitor.SetConcurrency(tracker.Deduplicating, s.cfg.MaxDedups)
+	monitor.SetConcurrency(tracker.Copying, s.cfg.MaxCopies)
+
+	start := time.Now()
+	go monitor.Watch(ctx, s.cfg.real(s.cfg.Watch))
+	parseErr := make(chan error, 1)
+	go func() { parseErr <- s.parse(ctx, tk) }()
+
+wait:
+	for {
+		select {
+		case <-s.rec.done:
+			break wait
+		case <-ctx.Done():
+			break wait
+		case err = <-parseErr:
+			if err != nil {
+				break wait
+			}
+			parseErr = nil // All jobs were parsed.
+		}
+	}
+	elapsed := time.Since(start)
+	monitor.Drain(context.Background())
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tk.Sync(context.Background(), time.Time{}); err != nil {
+		return nil, err
+	}
+	return s.report(elapsed), nil
+}
+
+// report checks the recorded transitions and fake BigQuery operations, and
+// summarizes the run.
+func (s *Simulation) report(elapsed time.Duration) *Report {
+	s.rec.lock.Lock()
+	defer s.rec.lock.Unlock()
+	r := &Report{Config: s.cfg, Jobs: len(s.jobs), Elapsed: elapsed,
+		Simulated: time.Duration(float64(elapsed) * s.cfg.Speedup)}
+	for state, ds := range s.rec.inState {
+		st := StateTime{State: state, Count: len(ds)}
+		var total time.Duration
+		for _, d := range ds {
+			total += d
+			if d > st.Max {
+				st.Max = d
+			}
+		}
+		st.Mean = time.Duration(float64(total) / float64(len(ds)) * s.cfg.Speedup)
+		st.Max = time.Duration(float64(st.Max) * s.cfg.Speedup)
+		r.States = append(r.States, st)
+	}
+	sort.Slice(r.States, func(i, k int) bool { return r.States[i].Mean > r.States[k].Mean })
+
+	copied := make(map[string]int)
+	for _, c := range s.bq.Copies() {
+		copied[c.Dst.TableID()]++
+	}
+	deleted := make(map[string]int)
+	for _, d := range s.bq.Deleted() {
+		deleted[d]++
+	}
+	for _, q := range s.bq.QueryRuns() {
+		if strings.Contains(q.Q, "# Delete all duplicate rows") {
+			r.Dedups++
+		}
+	}
+	r.Loads, r.Copies, r.Deletes = len(s.bq.Loads()), len(s.bq.Copies()), len(s.bq.Deleted())
+
+	for _, j := range s.jobs {
+		names, _ := bq.DefaultNaming.Names(j)
+		partition := names.Table + "$" + j.Date.Format("20060102")
+		switch n := s.rec.complete[j]; {
+		case s.rec.failed[j] != "":
+			r.Errors = append(r.Errors, fmt.Sprintf("%s failed: %s", j, s.rec.failed[j]))
+			continue
+		case n == 0:
+			r.Errors = append(r.Errors, fmt.Sprintf("%s did not complete", j))
+			continue
+		case n > 1:
+			r.Errors = append(r.Errors, fmt.Sprintf("%s completed %d times", j, n))
+		}
+		r.Complete++
+		if copied[partition] != 1 {
+			r.Errors = append(r.Errors, fmt.Sprintf("%s copied %d times", j, copied[partition]))
+		}
+		if n := deleted[names.TmpDataset+"."+partition]; n != 1 {
+			r.Errors = append(r.Errors, fmt.Sprintf("%s tmp partition deleted %d times", j, n))
+		}
+	}
+	r.Errors = append(r.Errors, s.rec.bad...)
+	return r
+}
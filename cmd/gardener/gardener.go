@@ -12,14 +12,28 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"cloud.google.com/go/bigquery/storage/managedwriter"
 	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
 	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/m-lab/go/flagx"
@@ -27,15 +41,38 @@ import (
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/rtx"
 
+	"github.com/m-lab/etl-gardener/admin"
+	"github.com/m-lab/etl-gardener/backfill"
+	"github.com/m-lab/etl-gardener/callbacks"
+	"github.com/m-lab/etl-gardener/changes"
 	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bqwrite"
+	"github.com/m-lab/etl-gardener/cloud/gcs"
+	"github.com/m-lab/etl-gardener/cloud/ps"
 	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/errreport"
+	"github.com/m-lab/etl-gardener/events"
+	"github.com/m-lab/etl-gardener/health"
+	"github.com/m-lab/etl-gardener/hooks"
 	job "github.com/m-lab/etl-gardener/job-service"
+	"github.com/m-lab/etl-gardener/joblog"
+	"github.com/m-lab/etl-gardener/leader"
+	"github.com/m-lab/etl-gardener/logging"
+	"github.com/m-lab/etl-gardener/marker"
+	"github.com/m-lab/etl-gardener/middleware"
+	"github.com/m-lab/etl-gardener/notify"
 	"github.com/m-lab/etl-gardener/ops"
 	"github.com/m-lab/etl-gardener/persistence"
+	"github.com/m-lab/etl-gardener/queue"
+	"github.com/m-lab/etl-gardener/reconcile"
 	"github.com/m-lab/etl-gardener/reproc"
 	"github.com/m-lab/etl-gardener/rex"
+	"github.com/m-lab/etl-gardener/selftest"
+	"github.com/m-lab/etl-gardener/shutdown"
 	"github.com/m-lab/etl-gardener/state"
 	"github.com/m-lab/etl-gardener/tracker"
+	"github.com/m-lab/etl-gardener/worker"
 
 	// Enable exported debug vars.  See https://golang.org/pkg/expvar/
 	_ "expvar"
@@ -46,6 +83,26 @@ var (
 	jobCleanupDelay   = flag.Duration("job_cleanup_delay", 3*time.Hour, "Time after which completed jobs will be removed from tracker")
 	shutdownTimeout   = flag.Duration("shutdown_timeout", 1*time.Minute, "Graceful shutdown time allowance")
 	statusPort        = flag.String("status_port", ":0", "The public interface port where status (and pprof) will be published")
+	adminKeys         = flag.String("admin_keys", "", "Comma separated user:key pairs for the admin API.  If empty, and admin_iam_users is empty, the admin API is disabled")
+	adminIAMUsers     = flag.String("admin_iam_users", "", "Comma separated emails of users or service accounts that may use the admin API with Google ID tokens")
+	adminIAMAudience  = flag.String("admin_iam_audience", "", "Audience of Google ID tokens for the admin API, e.g. the gardener URL.  Required with admin_iam_users")
+	workerKeys        = flag.String("worker_keys", "", "Comma separated worker:key pairs for the external worker API.  If empty, the worker API is disabled")
+	workerLease       = flag.Duration("worker_lease", 10*time.Minute, "Duration of external worker job leases")
+	logFormat         = flag.String("log_format", "text", "Log format, either text or json.  Use json for Stackdriver")
+	otlpEndpoint      = flag.String("otlp_endpoint", "", "OTLP gRPC endpoint for exporting traces.  If empty, tracing is disabled")
+	dryRun            = flag.Bool("dry_run", false, "Simulate all actions, logging and recording what they would do, without changing any tables.  Intended for validating config changes in staging")
+	leaderElection    = flag.Bool("leader_election", false, "Run as one of several replicas, of which only the elected leader dispatches and processes jobs")
+	namespace         = flag.String("namespace", persistence.DefaultNamespace, "Namespace for all persisted state.  Deployments sharing a project, e.g. sandbox and staging, must use distinct namespaces")
+	persistenceDir    = flag.String("persistence_dir", "", "If set, tracker and job service state are saved as files in this directory instead of Datastore.  Intended for local development")
+	etcdEndpoint      = flag.String("etcd_endpoint", "", "If set, tracker and job service state are saved in etcd, through the JSON gateway at this URL, e.g. http://etcd:2379, instead of Datastore")
+	jobQueue          = flag.Bool("job_queue", false, "Share pending jobs with other instances through a Datastore job queue")
+	jobQueueLease     = flag.Duration("job_queue_lease", 10*time.Minute, "Duration of job claims in the job queue")
+	errorReporting    = flag.Bool("error_reporting", false, "Report job failures and panics to Cloud Error Reporting, through structured log entries on stderr")
+	bqLocation        = flag.String("bq_location", "", "BigQuery location, e.g. US, EU or europe-west1, of all datasets and jobs.  If empty, the US multi-region is used")
+	clientRateLimit   = flag.Float64("client_rate_limit", 0, "Requests per second allowed from each client to the parser job and update endpoints.  If zero, requests are not rate limited")
+	clientRateBurst   = flag.Int("client_rate_burst", 20, "Requests each client may burst above client_rate_limit")
+	parseSubscription = flag.String("parse_subscription", "", "Pub/Sub subscription for parser completion messages.  If empty, only polled updates are used")
+	selfTest          = flag.Bool("self_test", false, "Probe GCS, BigQuery and Datastore permissions at startup, and exit with a report if any are missing")
 
 	// Context and injected variables to allow smoke testing of main()
 	mainCtx, mainCancel = context.WithCancel(context.Background())
@@ -96,6 +153,8 @@ var (
 	ErrBadStartDate    = errors.New("Bad StartDate")
 	ErrNoExperiment    = errors.New("No env var for Experiment")
 	ErrNoBucket        = errors.New("No env var for Bucket")
+
+	ErrBadSanityThreshold = errors.New("sanity threshold must be a fraction from 0 to 1")
 )
 
 func loadEnvVarsForTaskQueue() {
@@ -190,6 +249,7 @@ func NewBQConfig(config cloud.Config) cloud.BQConfig {
 		BQProject:      config.Project,
 		BQBatchDataset: env.BatchDataset,
 		BQFinalDataset: env.FinalDataset,
+		BQLocation:     *bqLocation,
 	}
 }
 
@@ -207,6 +267,11 @@ func taskHandlerFromEnv(ctx context.Context, client *http.Client) (*reproc.TaskH
 	if err != nil {
 		return nil, err
 	}
+	exec.SanityThresholds, err = sanityThresholdsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	exec.DetailCache = bq.NewTableDetailCache(detailTTL)
 	// TODO - exec.StorageClient should be closed.
 	queues := make([]string, env.NumQueues)
 	for i := 0; i < env.NumQueues; i++ {
@@ -218,9 +283,32 @@ func taskHandlerFromEnv(ctx context.Context, client *http.Client) (*reproc.TaskH
 	if err != nil {
 		return nil, err
 	}
+	saver.Namespace = *namespace
 	return reproc.NewTaskHandler(env.Experiment, exec, queues, saver), nil
 }
 
+// sanityThresholdsFromEnv returns the final copy thresholds, from the
+// SANITY_MAX_TEST_LOSS and SANITY_MAX_TASK_LOSS fractions, with defaults from
+// bq.DefaultSanityThresholds.
+func sanityThresholdsFromEnv() (bq.SanityThresholds, error) {
+	th := bq.DefaultSanityThresholds
+	for name, v := range map[string]*float64{
+		"SANITY_MAX_TEST_LOSS": &th.MaxTestLoss,
+		"SANITY_MAX_TASK_LOSS": &th.MaxTaskLoss,
+	} {
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f < 0 || f > 1 {
+			return th, fmt.Errorf("%w: %s=%q", ErrBadSanityThreshold, name, s)
+		}
+		*v = f
+	}
+	return th, nil
+}
+
 // StartDateRFC3339 is the date at which reprocessing will start when it catches
 // up to present.  For now, we are making this the beginning of the ETL timeframe,
 // until we get annotation fixed to use the actual data date instead of NOW.
@@ -229,6 +317,25 @@ const StartDateRFC3339 = "2017-05-01T00:00:00Z"
 // Job state tracker, when operating in manager mode.
 var globalTracker *tracker.Tracker
 
+// statusTracker holds the *tracker.Tracker shown by Status and Dashboard.
+// Unlike globalTracker, it is set while the main server is running, by
+// each standby refresh and then by the leader.
+var statusTracker atomic.Value
+
+func setStatusTracker(tk *tracker.Tracker) {
+	statusTracker.Store(tk)
+}
+
+// getStatusTracker returns the tracker to show, or nil if there is none yet.
+func getStatusTracker() *tracker.Tracker {
+	tk, _ := statusTracker.Load().(*tracker.Tracker)
+	return tk
+}
+
+// Job transitions of the globalTracker, to which reactions such as
+// notifications and done markers subscribe.
+var jobEvents = events.NewBus()
+
 // ###############################################################################
 //  Top level service control code.
 // ###############################################################################
@@ -247,11 +354,12 @@ func Status(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Release: %s <br>  Commit: unknown\n", env.Release)
 	}
 
+	fmt.Fprintf(w, "<a href=\"/dashboard\">Dashboard</a><br>\n")
 	fmt.Fprintf(w, "</br></br>\n")
 
 	// TODO - attach the environment to the context.
-	if globalTracker != nil {
-		globalTracker.WriteHTMLStatusTo(r.Context(), w)
+	if tk := getStatusTracker(); tk != nil {
+		tk.WriteHTMLStatusTo(r.Context(), w)
 	}
 	state.WriteHTMLStatusTo(r.Context(), w, env.Project, env.Experiment)
 	fmt.Fprintf(w, "</br>\n")
@@ -263,6 +371,26 @@ func Status(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "</body></html>\n")
 }
 
+// Dashboard writes the job dashboard.  The "days" parameter controls the
+// number of dates shown, defaulting to 60, and at most
+// tracker.MaxDashboardDays.
+func Dashboard(w http.ResponseWriter, r *http.Request) {
+	tk := getStatusTracker()
+	if tk == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	days := 60
+	if d, err := strconv.Atoi(r.FormValue("days")); err == nil {
+		days = d
+	}
+	fmt.Fprintf(w, "<html><body>\n")
+	if err := tk.WriteDashboard(w, days); err != nil {
+		fmt.Fprintf(w, "%v\n", err)
+	}
+	fmt.Fprintf(w, "</body></html>\n")
+}
+
 // Used for testing.
 var statusServerAddr string
 
@@ -272,6 +400,7 @@ func startStatusServer() *http.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", Status)
 	mux.HandleFunc("/status", Status)
+	mux.HandleFunc("/dashboard", Dashboard)
 
 	// Start up the http server.
 	server := &http.Server{
@@ -298,16 +427,148 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func mustStandardTracker() *tracker.Tracker {
+// sourceBuckets returns the distinct archive buckets of the sources.
+func sourceBuckets(sources []config.SourceConfig) []string {
+	buckets := []string{}
+	seen := map[string]bool{}
+	for _, s := range sources {
+		if !seen[s.Bucket] {
+			seen[s.Bucket] = true
+			buckets = append(buckets, s.Bucket)
+		}
+	}
+	return buckets
+}
+
+// addDependencyChecks adds readiness checks for BigQuery, each GCS bucket
+// and, if useDatastore is true, Datastore.
+// If a client cannot be created, its check reports the error.
+func addDependencyChecks(ctx context.Context, checker *health.Checker, dataset string, buckets []string, useDatastore bool) {
+	failed := func(err error) health.Check {
+		log.Println(err)
+		return func(ctx context.Context) error { return err }
+	}
+
+	if bqClient, err := bq.NewClient(ctx, env.Project); err != nil {
+		checker.AddReadiness("bigquery", failed(err))
+	} else {
+		checker.AddReadiness("bigquery", func(ctx context.Context) error {
+			_, err := bqClient.Dataset(dataset).Metadata(ctx)
+			return err
+		})
+	}
+
+	if gcsClient, err := storage.NewClient(ctx); err != nil {
+		checker.AddReadiness("gcs", failed(err))
+	} else {
+		checker.AddReadiness("gcs", func(ctx context.Context) error {
+			for _, bucket := range buckets {
+				if _, err := gcsClient.Bucket(bucket).Attrs(ctx); err != nil {
+					return fmt.Errorf("%s: %w", bucket, err)
+				}
+			}
+			return nil
+		})
+	}
+
+	if !useDatastore {
+		return
+	}
+	if dsClient, err := datastore.NewClient(ctx, env.Project); err != nil {
+		checker.AddReadiness("datastore", failed(err))
+	} else {
+		key := datastore.NameKey("tracker", "jobs", nil)
+		key.Namespace = *namespace
+		checker.AddReadiness("datastore", func(ctx context.Context) error {
+			var props datastore.PropertyList
+			err := dsClient.Get(ctx, key, &props)
+			if err == datastore.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		})
+	}
+}
+
+// mustPassSelfTest probes the permissions needed by the sources, and exits
+// with a report of the failed probes if any are missing.
+func mustPassSelfTest(ctx context.Context, sources []config.SourceConfig) {
+	gcsClient, err := storage.NewClient(ctx)
+	rtx.Must(err, "Could not create GCS client")
+	bqClient, err := bq.NewClient(ctx, env.Project)
+	rtx.Must(err, "Could not create BigQuery client")
+	var dsClient dsiface.Client
+	if usesDatastore() {
+		client, err := datastore.NewClient(ctx, env.Project)
+		rtx.Must(err, "Could not create datastore client")
+		dsClient = dsiface.AdaptClient(client)
+	}
+	nc := config.Naming()
+	naming := bq.Naming{
+		TmpDataset: nc.TmpDataset, RawDataset: nc.RawDataset,
+		FinalDataset: nc.FinalDataset, Table: nc.Table}
+	prober, err := selftest.New(stiface.AdaptClient(gcsClient), bqClient, dsClient,
+		*namespace, naming, sources)
+	rtx.Must(err, "Invalid naming config")
+	report := prober.Run(ctx)
+	log.Print("Self test:\n", report)
+	rtx.Must(report.Err(), "Self test failed")
+}
+
+// trackerLoader recovers the tracker state, reusing a single Datastore
+// client or saver for every load.
+type trackerLoader struct {
+	client dsiface.Client    // Set if the state is saved in Datastore.
+	saver  persistence.Saver // Set otherwise.
+}
+
+func newTrackerLoader() (*trackerLoader, error) {
+	if !usesDatastore() {
+		return &trackerLoader{saver: mustCreateSaver()}, nil
+	}
 	client, err := datastore.NewClient(context.Background(), env.Project)
-	rtx.Must(err, "datastore client")
+	if err != nil {
+		return nil, err
+	}
+	return &trackerLoader{client: dsiface.AdaptClient(client)}, nil
+}
+
+// load recovers the tracker state.  The tracker saves its state every
+// saveInterval, or never if it is zero.
+func (l *trackerLoader) load(saveInterval time.Duration) (*tracker.Tracker, error) {
+	if l.client == nil {
+		return tracker.InitTrackerWithSaver(context.Background(), l.saver,
+			saveInterval, *jobExpirationTime, *jobCleanupDelay)
+	}
 	dsKey := datastore.NameKey("tracker", "jobs", nil)
-	dsKey.Namespace = "gardener"
+	dsKey.Namespace = *namespace
 
-	tk, err := tracker.InitTracker(
+	return tracker.InitTracker(
 		context.Background(),
-		dsiface.AdaptClient(client), dsKey,
-		time.Minute, *jobExpirationTime, *jobCleanupDelay)
+		l.client, dsKey,
+		saveInterval, *jobExpirationTime, *jobCleanupDelay)
+}
+
+// Close closes the Datastore client, if any.
+func (l *trackerLoader) Close() error {
+	if l.client == nil {
+		return nil
+	}
+	return l.client.Close()
+}
+
+// loadTracker recovers the tracker state.  The tracker saves its state
+// every saveInterval, or never if it is zero.
+func loadTracker(saveInterval time.Duration) (*tracker.Tracker, error) {
+	l, err := newTrackerLoader()
+	if err != nil {
+		return nil, err
+	}
+	return l.load(saveInterval)
+}
+
+func mustStandardTracker() *tracker.Tracker {
+	tk, err := loadTracker(time.Minute)
 	rtx.Must(err, "tracker init")
 	if tk == nil {
 		log.Fatal("nil tracker")
@@ -316,13 +577,551 @@ func mustStandardTracker() *tracker.Tracker {
 	return tk
 }
 
-func mustCreateJobService(ctx context.Context, mux *http.ServeMux) {
+// startParseSubscriber starts a subscriber for parser completion messages.
+// The parser /update requests remain in place as a fallback.
+func startParseSubscriber(ctx context.Context, subscription string) {
+	client, err := pubsub.NewClient(ctx, env.Project)
+	rtx.Must(err, "pubsub client")
+	sub := ps.NewSubscriber(client.Subscription(subscription), globalTracker)
+	go func() {
+		defer client.Close()
+		if err := sub.Run(ctx); err != nil {
+			log.Println("Parse subscriber terminated:", err)
+		}
+	}()
+}
+
+// mustStartTracing exports traces to the OTLP endpoint, and returns a function
+// that flushes and stops the exporter.
+func mustStartTracing(ctx context.Context, endpoint string) func(context.Context) error {
+	exporter, err := otlptracegrpc.New(ctx,
+		otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	rtx.Must(err, "Could not create trace exporter")
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "gardener"),
+			attribute.String("gcp.project", env.Project))))
+	otel.SetTracerProvider(tp)
+	log.Println("Exporting traces to", endpoint)
+	return tp.Shutdown
+}
+
+// startTmpSweeper starts enforcing the tmp partition expiration, and
+// sweeping orphaned tmp partitions, for all configured sources.
+func startTmpSweeper(ctx context.Context, naming bq.Naming, cfg config.TmpConfig) {
+	bqClient, err := bq.NewClient(ctx, env.Project)
+	rtx.Must(err, "Could not create bigquery client")
+	sweeper := bq.NewTmpSweeper(bqClient, env.Project, naming, cfg.Expiration)
+	for _, s := range config.Sources() {
+		sweeper.Add(s.Experiment, s.Datatype)
+	}
+	interval := cfg.SweepInterval
+	if interval <= 0 {
+		interval = 6 * time.Hour
+	}
+	go sweeper.Run(ctx, globalTracker, interval)
+}
+
+// startTmpWatchdog starts monitoring the size of the tmp datasets of all
+// configured sources, and pauses dispatch while they are too large.  If the
+// notifier is not nil, it is sent an event when dispatch pauses or resumes.
+func startTmpWatchdog(ctx context.Context, naming bq.Naming, cfg config.TmpConfig,
+	svc *job.Service, notifier *notify.Notifier) {
+	bqClient, err := bq.NewClient(ctx, env.Project)
+	rtx.Must(err, "Could not create bigquery client")
+	datasets := []string{}
+	seen := map[string]bool{}
+	for _, s := range config.Sources() {
+		names, err := naming.WithDefaults().Names(tracker.Job{Experiment: s.Experiment, Datatype: s.Datatype})
+		rtx.Must(err, "Invalid naming config")
+		if !seen[names.TmpDataset] {
+			seen[names.TmpDataset] = true
+			datasets = append(datasets, names.TmpDataset)
+		}
+	}
+	w, err := bq.NewTmpWatchdog(bqClient, env.Project, datasets, cfg.MaxBytes, cfg.ResumeBytes)
+	rtx.Must(err, "Invalid tmp size config")
+	if notifier != nil {
+		w.OnChange = func(engaged bool, bytes int64) {
+			msg := fmt.Sprintf("tmp datasets hold %d bytes, resuming dispatch", bytes)
+			if engaged {
+				msg = fmt.Sprintf("tmp datasets hold %d bytes, over %d, pausing dispatch", bytes, cfg.MaxBytes)
+			}
+			notifier.Send(notify.Event{Kind: notify.BackPressure, Message: msg, Time: time.Now()})
+		}
+	}
+	svc.SetThrottle(w)
+	interval := cfg.SizeInterval
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	go w.Run(ctx, interval)
+}
+
+// dayStages returns the tracker stages of an experiment's days.
+func dayStages(dc config.DayConfig) []tracker.DayStage {
+	stages := make([]tracker.DayStage, 0, len(dc.Stages))
+	for _, s := range dc.Stages {
+		stages = append(stages, tracker.DayStage{Name: s.Name, Datatypes: s.Datatypes})
+	}
+	return stages
+}
+
+// completionSLOs returns the completion SLOs of the sources that set one,
+// keyed by experiment/datatype.
+func completionSLOs(sources []config.SourceConfig) map[string]tracker.SLO {
+	slos := map[string]tracker.SLO{}
+	for _, s := range sources {
+		if s.CompletionSLO > 0 {
+			slos[s.Experiment+"/"+s.Datatype] = tracker.SLO{Deadline: s.CompletionSLO, Target: s.SLOTarget}
+		}
+	}
+	return slos
+}
+
+// startStaleRelease requeues parser jobs that haven't sent a heartbeat or
+// update within timeout, every minute.  If the notifier is not nil, it is
+// sent an event for each requeued job.
+func startStaleRelease(ctx context.Context, svc *job.Service, timeout time.Duration, notifier *notify.Notifier) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, j := range svc.RequeueStale(ctx, globalTracker, timeout, now) {
+					if notifier != nil {
+						notifier.Send(notify.Event{Kind: notify.StaleJob, Experiment: j.Experiment,
+							Datatype: j.Datatype, Date: j.Date, Time: now,
+							Message: fmt.Sprintf("no heartbeat for %v, returned to pending", timeout)})
+					}
+				}
+			}
+		}
+	}()
+}
+
+// startSlotThrottle starts monitoring the slot reservation utilization, and
+// throttles dedups while it is saturated.
+func startSlotThrottle(ctx context.Context, monitor *ops.Monitor, cfg config.SlotThrottleConfig) {
+	bqClient, err := bq.NewClient(ctx, env.Project)
+	rtx.Must(err, "Could not create bigquery client")
+	st, err := bq.NewSlotThrottle(bqClient, env.Project,
+		cfg.Region, cfg.Reservation, cfg.Capacity, cfg.High, cfg.Low)
+	rtx.Must(err, "Invalid slot throttle config")
+	monitor.SetThrottle(tracker.Deduplicating, st)
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go st.Run(ctx, interval)
+}
+
+// Table details are cached for detailTTL, and the details of active jobs'
+// partitions are refreshed every detailRefresh, so that status requests
+// rarely wait for queries.
+const (
+	detailTTL     = 10 * time.Minute
+	detailRefresh = 5 * time.Minute
+)
+
+// activeJobs returns the jobs that may have tmp or raw partitions being
+// modified.
+func activeJobs() []tracker.Job {
+	jobs, _, _ := globalTracker.GetState()
+	active := []tracker.Job{}
+	for j, s := range jobs {
+		switch s.State() {
+		case tracker.Loading, tracker.Deduplicating, tracker.Copying, tracker.Validating,
+			tracker.Publishing, tracker.Joining, tracker.Deleting:
+			active = append(active, j)
+		}
+	}
+	return active
+}
+
+// startDetailCache creates the cache of partition details served at
+// /detail, and starts refreshing the details of active jobs.
+func startDetailCache(ctx context.Context, naming bq.Naming) *bq.DetailCache {
+	bqClient, err := bq.NewClient(ctx, env.Project)
+	rtx.Must(err, "Could not create bigquery client")
+	c := bq.NewDetailCache(bqClient, env.Project, naming, detailTTL)
+	go c.Run(ctx, detailRefresh, activeJobs)
+	return c
+}
+
+// newCompletionChecker creates the checker that serves experiment
+// completion at /complete.
+func newCompletionChecker(ctx context.Context, naming bq.Naming,
+	publish map[string]bq.PublishTarget) *bq.CompletionChecker {
+	bqClient, err := bq.NewClient(ctx, env.Project)
+	rtx.Must(err, "Could not create bigquery client")
+	c := bq.NewCompletionChecker(bqClient, env.Project, naming, globalTracker)
+	for _, s := range config.Sources() {
+		c.Add(s.Experiment, s.Datatype)
+	}
+	c.SetPublish(publish)
+	return c
+}
+
+// newViewManager creates the manager of the annotation join views.
+func newViewManager(ctx context.Context, naming bq.Naming, cfg config.ViewsConfig,
+	publish map[string]bq.PublishTarget) *bq.ViewManager {
+	bqClient, err := bq.NewClient(ctx, env.Project)
+	rtx.Must(err, "Could not create bigquery client")
+	v := bq.NewViewManager(bqClient, env.Project, naming, cfg.Suffix)
+	for _, s := range config.Sources() {
+		v.Add(s.Experiment, s.Datatype)
+	}
+	v.SetPublish(publish)
+	return v
+}
+
+// startHooks runs the post-completion hooks of each experiment when all of
+// its datatypes complete a date.
+func startHooks(ctx context.Context, naming bq.Naming, hc map[string]config.HookConfig,
+	publish map[string]bq.PublishTarget) {
+	bqClient, err := bq.NewClient(ctx, env.Project)
+	rtx.Must(err, "Could not create bigquery client")
+	r := hooks.New()
+	for _, s := range config.Sources() {
+		r.AddDatatype(s.Experiment, s.Datatype)
+	}
+	var views *bq.ViewManager
+	for exp, cfg := range hc {
+		if cfg.RefreshViews {
+			if views == nil {
+				views = newViewManager(ctx, naming, config.Views(), publish)
+			}
+			r.Register(exp, hooks.NewViewRefresh(views, r.Datatypes(exp)...))
+		}
+		for _, qc := range cfg.Queries {
+			q, err := hooks.NewQuery(bqClient, env.Project, qc.Name, qc.SQL)
+			rtx.Must(err, "Invalid hook query for %s", exp)
+			r.Register(exp, q)
+		}
+	}
+	jobEvents.Subscribe("hooks", r.Observe, tracker.Complete)
+	go r.Run(ctx)
+}
+
+// startChangeFeed serves the partitions rewritten by the monitor at
+// /changes.json, and publishes each change to the configured topic.
+func startChangeFeed(ctx context.Context, mux *http.ServeMux, cc config.ChangesConfig) *changes.Feed {
+	feed := changes.NewFeed(cc.Retention)
+	mux.HandleFunc("/changes.json", feed.Handler)
+	if cc.Topic == "" {
+		return feed
+	}
+	client, err := pubsub.NewClient(ctx, env.Project)
+	rtx.Must(err, "pubsub client")
+	feed.SetPublisher(ps.NewTopicPublisher(client.Topic(cc.Topic)))
+	go func() {
+		defer client.Close()
+		feed.Run(ctx)
+	}()
+	return feed
+}
+
+// startReconciler starts periodically detecting archived dates with no raw
+// rows and no job, and serves them at /missing.json.
+func startReconciler(ctx context.Context, mux *http.ServeMux, naming bq.Naming,
+	adder job.Adder, svc *job.Service, cfg config.ReconcileConfig) {
+	bqClient, err := bq.NewClient(ctx, env.Project)
+	rtx.Must(err, "Could not create bigquery client")
+	gcsClient, err := storage.NewClient(ctx)
+	rtx.Must(err, "Could not create storage client")
+	r := reconcile.New(stiface.AdaptClient(gcsClient), bqClient,
+		env.Project, naming, globalTracker, adder, config.Sources())
+	// Requeued jobs would only be simulated in a dry run.
+	r.AutoRequeue = cfg.AutoRequeue && !*dryRun
+	r.MaxRequeue = cfg.MaxRequeue
+	r.Skipped = svc.SkipList
+	mux.HandleFunc("/missing.json", r.Handler)
+	go r.Run(ctx, config.StartDate(), cfg.Interval)
+}
+
+// startVerifier starts periodically spot checking the raw partitions of
+// completed jobs, and serves the discrepancies at /discrepancies.json.
+func startVerifier(ctx context.Context, mux *http.ServeMux, naming bq.Naming,
+	adder job.Adder, cfg config.ReconcileConfig) {
+	bqClient, err := bq.NewClient(ctx, env.Project)
+	rtx.Must(err, "Could not create bigquery client")
+	v := reconcile.NewVerifier(bqClient, env.Project, naming, adder)
+	if cfg.VerifySample > 0 {
+		v.Sample = cfg.VerifySample
+	}
+	v.Threshold = config.ValidationThreshold()
+	if v.Threshold <= 0 {
+		v.Threshold = ops.DefaultValidationThreshold
+	}
+	// Repair jobs would only be simulated in a dry run.
+	v.Repair = cfg.Repair && !*dryRun
+	v.Annotator = globalTracker
+	jobEvents.Subscribe("verify", v.Observe, tracker.Complete)
+	mux.HandleFunc("/discrepancies.json", v.Handler)
+	go v.Run(ctx, cfg.VerifyInterval)
+}
+
+// mustSetArchiveCheck validates each job's GCS archive before dispatch.
+func mustSetArchiveCheck(ctx context.Context, svc *job.Service, cfg config.ArchiveCheckConfig) {
+	gcsClient, err := storage.NewClient(ctx)
+	rtx.Must(err, "Could not create storage client")
+	client := stiface.AdaptClient(gcsClient)
+	svc.SetArchiveCheck(func(ctx context.Context, j tracker.Job) error {
+		return gcs.Validate(ctx, client, j, cfg.Sample)
+	}, globalTracker)
+}
+
+// mustSetBackfill enables backfills planned through the admin API, sized by
+// listing each job's GCS archive.
+func mustSetBackfill(ctx context.Context, svc *job.Service, cfg config.BackfillConfig) {
+	p, err := backfill.NewPolicy(cfg)
+	rtx.Must(err, "Invalid backfill config")
+	gcsClient, err := storage.NewClient(ctx)
+	rtx.Must(err, "Could not create storage client")
+	svc.SetBackfill(p, backfill.GCSSizer(stiface.AdaptClient(gcsClient)))
+}
+
+// mustAddJobSources adds the job sources that are fed by requests over HTTP
+// and Pub/Sub, and by periodic GCS scans, and orders the sources.  HTTP
+// requests require one of the keys, and are disabled if there are none.
+func mustAddJobSources(ctx context.Context, mux *http.ServeMux, svc *job.Service, cfg config.IntakeConfig, keys map[string]string) {
+	q := job.NewRequestQueue("requests", tracker.Reprocess, svc.Accepts)
+	rtx.Must(svc.AddSource(q), "Could not add request source")
+	if len(keys) > 0 {
+		mux.HandleFunc("/v2/request", admin.RequireKeys(keys, q.Handler))
+	}
+	if cfg.RequestSubscription != "" {
+		client, err := pubsub.NewClient(ctx, env.Project)
+		rtx.Must(err, "pubsub client")
+		sub := ps.NewRequestSubscriber(client.Subscription(cfg.RequestSubscription), q)
+		go func() {
+			defer client.Close()
+			if err := sub.Run(ctx); err != nil {
+				log.Println("Request subscriber terminated:", err)
+			}
+		}()
+	}
+	if cfg.ScanInterval > 0 {
+		gcsClient, err := storage.NewClient(ctx)
+		rtx.Must(err, "Could not create storage client")
+		scan := job.NewScanSource(job.GCSDateLister(stiface.AdaptClient(gcsClient)), config.Sources(), tracker.Daily)
+		if cfg.ScanDays > 0 {
+			scan.Days = cfg.ScanDays
+		}
+		rtx.Must(svc.AddSource(scan), "Could not add scan source")
+		go scan.Run(ctx, cfg.ScanInterval)
+	}
+	rtx.Must(svc.SetSourceOrder(cfg.Order), "Invalid intake order")
+}
+
+// usesDatastore returns true unless state is saved in files or etcd.
+func usesDatastore() bool {
+	return *persistenceDir == "" && *etcdEndpoint == ""
+}
+
+// mustCreateSaver creates a file saver if -persistence_dir is set, an etcd
+// saver if -etcd_endpoint is set, and a datastore saver otherwise.  Objects
+// are saved in the -namespace, which is a subdirectory for file savers,
+// unless it is the default.
+func mustCreateSaver() persistence.Saver {
+	if *persistenceDir != "" {
+		dir := *persistenceDir
+		if *namespace != persistence.DefaultNamespace {
+			dir = filepath.Join(dir, *namespace)
+		}
+		saver, err := persistence.NewFileSaver(dir)
+		rtx.Must(err, "Could not initialize file saver")
+		return saver
+	}
+	if *etcdEndpoint != "" {
+		u, err := url.Parse(*etcdEndpoint)
+		rtx.Must(err, "Invalid etcd_endpoint")
+		return persistence.NewKVSaver(persistence.NewEtcdKV(*u), *namespace)
+	}
 	saver, err := persistence.NewDatastoreSaver(context.Background(), os.Getenv("PROJECT"))
 	rtx.Must(err, "Could not initialize datastore saver")
-	svc, err := job.NewJobService(ctx, globalTracker, config.StartDate(),
+	saver.Namespace = *namespace
+	return saver
+}
+
+// Namespace locks expire after namespaceLockTTL unless renewed.
+const namespaceLockTTL = 2 * time.Minute
+
+// On shutdown, draining actions leaves drainReserve of -shutdown_timeout for
+// the servers to stop.  Flushing the tracker and releasing the namespace
+// lock then have their own deadlines.
+const (
+	drainReserve  = 20 * time.Second
+	flushTimeout  = 15 * time.Second
+	resignTimeout = 10 * time.Second
+)
+
+// startNotifier sends notifications of job state changes and freshness SLO
+// violations for the globalTracker, until ctx is done.
+func startNotifier(ctx context.Context, nc config.NotifyConfig) *notify.Notifier {
+	sinks, err := notify.NewSinks(nc.Sinks)
+	rtx.Must(err, "Invalid notify sinks")
+	n, err := notify.New(sinks, nc.Routes, nc.FreshnessSLO)
+	rtx.Must(err, "Invalid notify routes")
+	interval := nc.CheckInterval
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	jobEvents.Subscribe("notify", n.Observe, tracker.Failed, tracker.Complete)
+	go n.Run(ctx, globalTracker, interval)
+	return n
+}
+
+// startJobLog streams a row for each finished job into the job log table.
+func startJobLog(ctx context.Context, jc config.JobLogConfig) {
+	bqClient, err := bq.NewClient(ctx, env.Project)
+	rtx.Must(err, "Could not create bigquery client")
+	table := jc.Table
+	if table == "" {
+		table = "job_log"
+	}
+	l := joblog.New(bqClient.Dataset(jc.Dataset).Table(table), jc.BatchSize)
+	rtx.Must(l.EnsureTable(ctx), "Could not create job log table")
+	if jc.WriteAPI {
+		schema, err := joblog.Schema()
+		rtx.Must(err, "Could not infer job log schema")
+		enc, err := bqwrite.NewEncoder(schema)
+		rtx.Must(err, "Could not encode job log schema")
+		client, err := managedwriter.NewClient(ctx, env.Project)
+		rtx.Must(err, "Could not create storage write client")
+		app, err := bqwrite.NewStreamAppender(ctx, client, env.Project, jc.Dataset, table, enc)
+		rtx.Must(err, "Could not create job log write stream")
+		l.UseWriteAPI(bqwrite.NewWriter(table, app, enc))
+	}
+	interval := jc.FlushInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	jobEvents.Subscribe("joblog", l.Observe, tracker.Complete, tracker.PartialComplete, tracker.Failed)
+	go l.Run(ctx, interval)
+}
+
+// startCallbacks invokes the HTTP callbacks of jobs that finish stages.
+func startCallbacks(ctx context.Context, cc []config.CallbackConfig) {
+	s, err := callbacks.New(cc)
+	rtx.Must(err, "Invalid callback config")
+	jobEvents.Subscribe("callbacks", s.Observe)
+	go s.Run(ctx)
+}
+
+// startDoneMarkers writes a GCS marker object for each completed job.
+func startDoneMarkers(ctx context.Context, dc config.DoneMarkerConfig) {
+	gcsClient, err := storage.NewClient(ctx)
+	rtx.Must(err, "Could not create storage client")
+	w := marker.NewWriter(stiface.AdaptClient(gcsClient), dc.Bucket, dc.Prefix)
+	jobEvents.Subscribe("done_markers", w.Observe, tracker.Complete, tracker.PartialComplete)
+	go w.Run(ctx)
+}
+
+// newNamespaceLocker creates a Locker for the -namespace, owned by this host.
+func newNamespaceLocker() *persistence.Locker {
+	owner, err := os.Hostname()
+	rtx.Must(err, "hostname")
+	return persistence.NewLocker(mustCreateSaver(), owner, namespaceLockTTL)
+}
+
+// mustLockNamespace takes the lock on the -namespace, and exits if it is
+// held by another live instance, e.g. from another deployment.  The lock is
+// renewed until ctx is done.
+func mustLockNamespace(ctx context.Context) *persistence.Locker {
+	locker := newNamespaceLocker()
+	rtx.Must(locker.Acquire(ctx), "Could not lock namespace %s", *namespace)
+	log.Println("Locked namespace", *namespace)
+	go locker.RenewEvery(ctx, namespaceLockTTL/4)
+	return locker
+}
+
+// mustBecomeLeader serves read-only status as a standby, until this replica
+// is elected leader, using the namespace lock as the lease.  The main server
+// is started while waiting, so that standbys pass liveness checks, but the
+// "leader" readiness check keeps parser traffic on the leader.  If the
+// leader loses the lease, it exits, so that it can't act on jobs that the
+// new leader owns.
+func mustBecomeLeader(ctx context.Context, server *http.Server, checker *health.Checker) *leader.Elector {
+	elector := leader.New(newNamespaceLocker(), namespaceLockTTL)
+	checker.AddReadiness("leader", elector.Check)
+	rtx.Must(httpx.ListenAndServeAsync(server), "Could not start main server")
+	healthy = true
+	loader, err := newTrackerLoader()
+	rtx.Must(err, "Could not create standby tracker loader")
+	standby := func() {
+		// Refresh the read-only tracker from the leader's saved state.
+		tk, err := loader.load(0)
+		if err != nil {
+			log.Println("Standby tracker refresh error:", err)
+			return
+		}
+		setStatusTracker(tk)
+	}
+	log.Println("Standby for namespace", *namespace)
+	rtx.Must(elector.Campaign(ctx, standby), "Leader election failed")
+	loader.Close()
+	go elector.Hold(ctx, func() {
+		log.Fatal("Lost leadership")
+	})
+	return elector
+}
+
+// requestKeys returns the worker and admin keys, which may request jobs.
+func requestKeys() map[string]string {
+	keys := map[string]string{}
+	for _, flag := range []string{*workerKeys, *adminKeys} {
+		if flag == "" {
+			continue
+		}
+		k, err := admin.ParseKeys(flag)
+		rtx.Must(err, "Invalid keys")
+		for key, user := range k {
+			keys[key] = user
+		}
+	}
+	return keys
+}
+
+// queuedTracker adds new jobs to the job queue, as well as the tracker.
+type queuedTracker struct {
+	*tracker.Tracker
+	q *queue.Queue
+}
+
+func (qt queuedTracker) AddJob(j tracker.Job) error {
+	if err := qt.q.Add(context.Background(), j); err != nil {
+		return err
+	}
+	return qt.Tracker.AddJob(j)
+}
+
+// mustStartQueue creates the job queue, and restores its pending jobs into the tracker.
+func mustStartQueue(ctx context.Context) *queue.Queue {
+	client, err := datastore.NewClient(ctx, env.Project)
+	rtx.Must(err, "datastore client")
+	owner, err := os.Hostname()
+	rtx.Must(err, "hostname")
+	q := queue.NewQueue(dsiface.AdaptClient(client), *namespace, owner, *jobQueueLease)
+	n, err := q.Restore(ctx, globalTracker)
+	rtx.Must(err, "Could not restore jobs from queue")
+	log.Println("Restored", n, "jobs from queue")
+	go q.RestoreEvery(ctx, globalTracker, time.Minute)
+	return q
+}
+
+func mustCreateJobService(ctx context.Context, mux *http.ServeMux, tk job.Adder, saver persistence.Saver) *job.Service {
+	svc, err := job.NewJobService(ctx, tk, config.StartDate(),
 		os.Getenv("PROJECT"), config.Sources(), saver)
 	rtx.Must(err, "Could not initialize job service")
 	mux.HandleFunc("/job", svc.JobHandler)
+	mux.HandleFunc("/v2/job", svc.JobHandler)
+	return svc
 }
 
 // ###############################################################################
@@ -334,6 +1133,7 @@ func main() {
 
 	flag.Parse()
 	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not get args from env")
+	logging.SetJSON(*logFormat == "json")
 
 	LoadEnv()
 	if env.Error != nil {
@@ -341,6 +1141,16 @@ func main() {
 		log.Println(env)
 		os.Exit(1)
 	}
+	bq.SetLocation(*bqLocation)
+	var reporter *errreport.Reporter
+	if *errorReporting {
+		version := env.Release
+		if version == "" {
+			version = env.Commit
+		}
+		reporter = errreport.New(os.Stderr, "etl-gardener", version)
+		defer reporter.Recover()
+	}
 
 	// Enable block profiling
 	runtime.SetBlockProfileRate(1000000) // One event per msec.
@@ -353,28 +1163,106 @@ func main() {
 	defer statusServer.Close()
 	log.Println("Status server at", statusServer.Addr)
 
+	if *otlpEndpoint != "" {
+		shutdown := mustStartTracing(mainCtx, *otlpEndpoint)
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			shutdown(ctx)
+		}()
+	}
+
 	mux := http.NewServeMux()
+	stack := middleware.New(mux)
+	if *clientRateLimit > 0 {
+		stack.SetRateLimit(*clientRateLimit, *clientRateBurst, middleware.ParserPaths...)
+	}
+	if reporter != nil {
+		stack.SetErrorReporter(reporter)
+	}
 	// Start up the main job and update server.
 	server := &http.Server{
 		Addr:    ":8080",
-		Handler: mux,
+		Handler: stack,
 	}
 
 	mux.HandleFunc("/", Status)
 	mux.HandleFunc("/status", Status)
+	mux.HandleFunc("/dashboard", Dashboard)
 
 	// TODO - do we want different health checks for manager mode?
 	mux.HandleFunc("/alive", healthCheck)
 	mux.HandleFunc("/ready", healthCheck)
 
+	checker := health.NewChecker(5 * time.Second)
+	checker.AddLiveness("started", health.Flag(&healthy))
+	mux.HandleFunc("/healthz", checker.HealthzHandler)
+	mux.HandleFunc("/readyz", checker.ReadyzHandler)
+
+	// Shutdown stages run in the order they are added.
+	coordinator := shutdown.New()
+	// resign releases the namespace lock or leadership, if any.
+	var resign func(context.Context) error
+	serving := false // Whether the main server has been started.
+
 	switch env.ServiceMode {
 	case "manager":
 		// This is new new "manager" mode, in which Gardener provides /job and /update apis
 		// for parsers to get work and report progress.
 		// TODO Once the legacy deployments are turned down, this should move to head of main().
 		config.ParseConfig()
+		for _, s := range config.Sources() {
+			rtx.Must(tracker.SetPathTemplate(s.Bucket, s.Experiment, s.Datatype, s.PathTemplate),
+				"Invalid path template for %s/%s", s.Experiment, s.Datatype)
+		}
+
+		rtx.Must(persistence.ValidateNamespace(*namespace), "Invalid namespace")
+		if *persistenceDir != "" && *etcdEndpoint != "" {
+			log.Fatal("At most one of -persistence_dir and -etcd_endpoint may be set")
+		}
+		if *selfTest {
+			mustPassSelfTest(mainCtx, config.Sources())
+		}
+		switch {
+		case *leaderElection:
+			elector := mustBecomeLeader(mainCtx, server, checker)
+			serving = true
+			resign = elector.Resign
+		case !*jobQueue:
+			// Instances sharing a job queue intentionally share the namespace.
+			resign = mustLockNamespace(mainCtx).Release
+		}
 
 		globalTracker = mustStandardTracker()
+		setStatusTracker(globalTracker)
+		globalTracker.AddObserver(jobEvents.Publish)
+		jobEvents.Subscribe("metrics", events.CountTransitions)
+		jobEvents.Subscribe("completions", events.NewCompletions().Observe, tracker.Complete)
+		globalTracker.SetCompaction(config.Tracker().CompactEvery)
+		rtx.Must(globalTracker.SetSLOs(completionSLOs(config.Sources())), "Invalid completion SLO")
+		for exp, dc := range config.Days() {
+			rtx.Must(globalTracker.SetDayStages(exp, dayStages(dc)), "Invalid day stages")
+		}
+		if interval := config.Tracker().SnapshotInterval; interval > 0 {
+			globalTracker.StartSnapshots(mainCtx, interval)
+		}
+		globalTracker.StartMetrics(mainCtx, tracker.MetricsInterval)
+		var notifier *notify.Notifier
+		if nc := config.Notify(); len(nc.Sinks) > 0 {
+			notifier = startNotifier(mainCtx, nc)
+		}
+		if jc := config.JobLog(); jc.Dataset != "" && !*dryRun {
+			startJobLog(mainCtx, jc)
+		}
+		if dc := config.DoneMarker(); dc.Bucket != "" && !*dryRun {
+			startDoneMarkers(mainCtx, dc)
+		}
+		if cc := config.Callbacks(); len(cc) > 0 && !*dryRun {
+			startCallbacks(mainCtx, cc)
+		}
+		if reporter != nil {
+			jobEvents.Subscribe("error_reporting", reporter.Observe, tracker.Failed)
+		}
 
 		// TODO - refactor this block.
 		cloudCfg := cloud.Config{
@@ -385,12 +1273,174 @@ func main() {
 		bqConfig.BQBatchDataset = "batch"
 		monitor, err := ops.NewStandardMonitor(mainCtx, bqConfig, globalTracker)
 		rtx.Must(err, "NewStandardMonitor failed")
-		go monitor.Watch(mainCtx, 5*time.Second)
+		monitor.SetIncremental(config.Sources())
+		monitor.SetSchemaPatching(config.Sources())
+		rtx.Must(monitor.SetDedupStrategies(config.Sources()), "Invalid dedup strategy")
+		rtx.Must(monitor.SetDedupCostCaps(config.Sources()), "Invalid dedup cost cap")
+		rtx.Must(monitor.SetCopyDispositions(config.Sources()), "Invalid copy disposition")
+		rtx.Must(monitor.SetAnnotationHolds(config.Sources()), "Invalid annotation table")
+		publish := map[string]bq.PublishTarget{}
+		for exp, p := range config.Publish() {
+			readers, err := bq.ParseReaders(p.Readers)
+			rtx.Must(err, "Invalid publish readers")
+			rawReaders, err := bq.ParseReaders(p.RawReaders)
+			rtx.Must(err, "Invalid publish raw readers")
+			publish[exp] = bq.PublishTarget{Project: p.Project, Dataset: p.Dataset,
+				Readers: readers, RawReaders: rawReaders, FailOnDrift: p.FailOnAccessDrift}
+		}
+		rtx.Must(monitor.SetPublish(publish), "Invalid publish config")
+		mc := config.Monitor()
+		rtx.Must(monitor.SetDuplicationPolicy(mc.DuplicationThreshold, mc.DuplicationPolicy),
+			"Invalid duplication policy")
+		sa := mc.SizeAnomaly
+		rtx.Must(monitor.SetSizeAnomaly(ops.SizeAnomaly{High: sa.High, Low: sa.Low, Weeks: sa.Weeks}),
+			"Invalid size anomaly config")
+		if notifier != nil {
+			monitor.SetSizeAlert(func(j tracker.Job, warning string) {
+				notifier.Send(notify.Event{Kind: notify.SizeAnomaly, Experiment: j.Experiment,
+					Datatype: j.Datatype, Date: j.Date, Message: warning})
+			})
+		}
+		rtx.Must(monitor.ConfigureSteps(config.Sources()), "Invalid pipeline steps")
+		nc := config.Naming()
+		naming := bq.Naming{
+			TmpDataset: nc.TmpDataset, RawDataset: nc.RawDataset,
+			FinalDataset: nc.FinalDataset, Table: nc.Table}
+		rtx.Must(monitor.SetNaming(naming), "Invalid naming config")
+		if vc := config.Views(); vc.Enabled && !*dryRun {
+			monitor.SetViews(newViewManager(mainCtx, naming, vc, publish))
+		}
+		if !*dryRun {
+			monitor.SetChangeRecorder(startChangeFeed(mainCtx, mux, config.Changes()))
+		}
+		if hc := config.Hooks(); len(hc) > 0 && !*dryRun {
+			startHooks(mainCtx, naming, hc, publish)
+		}
+		if *dryRun {
+			log.Println("Dry run: actions will be simulated")
+			monitor.SetDryRun(true)
+		}
+		if reporter != nil {
+			monitor.SetErrorReporter(reporter)
+		}
+		var adder job.Adder = globalTracker
+		if *jobQueue {
+			q := mustStartQueue(mainCtx)
+			monitor.SetQueue(q)
+			adder = queuedTracker{Tracker: globalTracker, q: q}
+			jobEvents.Subscribe("queue", q.ParserUpdates(mainCtx), tracker.Parsing, tracker.ParseComplete)
+		}
+		if st := config.Monitor().SlotThrottle; st.Reservation != "" {
+			startSlotThrottle(mainCtx, monitor, st)
+		}
+		period := mc.PollingInterval
+		if period == 0 {
+			period = 5 * time.Second
+		}
+		rtx.Must(monitor.SetPolling(period, mc.MaxPollingInterval, config.Sources()), "Invalid polling config")
+		// Act on parse completions, whether reported by the parser or
+		// through Pub/Sub, without waiting for the job's next poll.
+		jobEvents.Subscribe("nudge", func(j tracker.Job, s tracker.Status) { monitor.Nudge(j) }, tracker.ParseComplete)
+		go monitor.Watch(mainCtx, period)
+
+		if tmp := config.Tmp(); tmp.Expiration > 0 && !*dryRun {
+			startTmpSweeper(mainCtx, naming, tmp)
+		}
 
 		handler := tracker.NewHandler(globalTracker)
 		handler.Register(mux)
+		mux.HandleFunc("/debug/query", monitor.QueryHandler)
+		mux.HandleFunc("/debug/statemachine", monitor.StateMachineHandler)
+		mux.HandleFunc("/detail", startDetailCache(mainCtx, naming).Handler)
+		mux.HandleFunc("/complete", newCompletionChecker(mainCtx, naming, publish).Handler)
+		mux.HandleFunc("/status.json", globalTracker.SummaryHandler)
+		mux.HandleFunc("/jobs.json", globalTracker.JobsHandler)
+		mux.HandleFunc("/days.json", globalTracker.DaysHandler)
+
+		if *parseSubscription != "" {
+			startParseSubscriber(mainCtx, *parseSubscription)
+		}
+
+		saver := health.NewSaverHealth(mustCreateSaver())
+		svc := mustCreateJobService(mainCtx, mux, adder, saver)
+		rtx.Must(svc.SetDispatch(config.Dispatch(), globalTracker.InFlight), "Invalid dispatch config")
+		rtx.Must(svc.SetShards(config.Sources(), globalTracker), "Invalid shards config")
+		if ac := config.ArchiveCheck(); ac.Enabled {
+			mustSetArchiveCheck(mainCtx, svc, ac)
+		}
+		if *adminKeys != "" {
+			mustSetBackfill(mainCtx, svc, config.Backfill())
+		}
+		mustAddJobSources(mainCtx, mux, svc, config.Intake(), requestKeys())
+		if tmp := config.Tmp(); tmp.MaxBytes > 0 {
+			startTmpWatchdog(mainCtx, naming, tmp, svc, notifier)
+		}
+		if timeout := config.Tracker().HeartbeatTimeout; timeout > 0 {
+			startStaleRelease(mainCtx, svc, timeout, notifier)
+		}
+		globalTracker.SetBacklog(svc.Backlog, config.Monitor().BackfillConcurrency)
+		monitor.SetReparser(svc)
+		coordinator.Add("dispatch", func(ctx context.Context) error {
+			svc.Stop()
+			monitor.Pause()
+			return nil
+		})
+		coordinator.Add("actions", func(ctx context.Context) error {
+			// Leave time for the servers to stop after a long action.
+			ctx, cancel := shutdown.Reserve(ctx, drainReserve)
+			defer cancel()
+			if jobs := monitor.Drain(ctx); len(jobs) > 0 {
+				log.Println("Handed back", len(jobs), "jobs")
+			}
+			return nil
+		})
+		mux.HandleFunc("/eta.json", globalTracker.ETAHandler)
+		if rc := config.Reconcile(); rc.Interval > 0 {
+			startReconciler(mainCtx, mux, naming, adder, svc, rc)
+		}
+		if rc := config.Reconcile(); rc.VerifyInterval > 0 {
+			startVerifier(mainCtx, mux, naming, adder, rc)
+		}
+
+		checker.AddLiveness("tracker", func(ctx context.Context) error {
+			return globalTracker.PersistenceCheck(ctx, 10*time.Minute)
+		})
+		checker.AddReadiness("tracker_save", globalTracker.SaveCheck)
+		checker.AddReadiness("saver", saver.Check)
+		if buckets := sourceBuckets(config.Sources()); len(buckets) > 0 {
+			addDependencyChecks(mainCtx, checker, bqConfig.BQFinalDataset, buckets, usesDatastore())
+		}
 
-		mustCreateJobService(mainCtx, mux)
+		if *workerKeys != "" {
+			keys, err := admin.ParseKeys(*workerKeys)
+			rtx.Must(err, "Invalid worker keys")
+			worker.NewHandler(keys, globalTracker, monitor, *workerLease).Register(mux)
+		}
+
+		if *adminKeys != "" || *adminIAMUsers != "" {
+			keys, err := admin.ParseKeys(*adminKeys)
+			rtx.Must(err, "Invalid admin keys")
+			h := admin.NewHandler(keys, globalTracker, monitor, svc, saver)
+			if *adminIAMUsers != "" {
+				if *adminIAMAudience == "" {
+					log.Fatal("-admin_iam_users requires -admin_iam_audience")
+				}
+				h.SetTokenVerifier(admin.IDTokenVerifier{Audience: *adminIAMAudience}, strings.Split(*adminIAMUsers, ","))
+			}
+			h.SetRequeuer(svc)
+			bqClient, err := bq.NewClient(mainCtx, env.Project)
+			rtx.Must(err, "Could not create bigquery client")
+			h.SetOnboarder(bq.NewOnboarder(bqClient, env.Project, naming))
+			h.SetVersionFinder(bq.NewVersionFinder(bqClient, env.Project, naming))
+			h.SetBackfiller(svc)
+			if cfg := config.Backfill(); cfg.EstimateSample > 0 {
+				m, err := backfill.NewCostModel(cfg, backfill.DedupEstimator(bqClient, env.Project, naming, config.Sources()))
+				rtx.Must(err, "Invalid backfill estimate config")
+				h.SetCostEstimator(m)
+			}
+			h.Register(mux)
+			monitor.SetAuditor(h)
+		}
 
 		healthy = true
 		log.Println("Running as manager service")
@@ -419,14 +1469,11 @@ func main() {
 		os.Exit(1)
 	}
 
-	rtx.Must(httpx.ListenAndServeAsync(server), "Could not start main server")
+	if !serving {
+		rtx.Must(httpx.ListenAndServeAsync(server), "Could not start main server")
+	}
 
-	select {
-	case <-mainCtx.Done():
-		log.Println("Shutting down servers")
-		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
-		defer cancel()
-		start := time.Now()
+	coordinator.Add("servers", func(ctx context.Context) error {
 		eg := errgroup.Group{}
 		eg.Go(func() error {
 			return server.Shutdown(ctx)
@@ -437,7 +1484,36 @@ func main() {
 		eg.Go(func() error {
 			return promServer.Shutdown(ctx)
 		})
-		eg.Wait()
-		log.Println("Shutdown took", time.Since(start))
+		return eg.Wait()
+	})
+	coordinator.Add("pollers", func(ctx context.Context) error {
+		mainCancel()
+		return nil
+	})
+	// State must be saved and the lock released even if the actions or
+	// servers used up the shutdown deadline.
+	if globalTracker != nil {
+		coordinator.AddWithTimeout("tracker", flushTimeout, globalTracker.Flush)
+	}
+	if resign != nil {
+		coordinator.AddWithTimeout("namespace", resignTimeout, resign)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sigs)
+	select {
+	case sig := <-sigs:
+		log.Println("Received", sig)
+	case <-mainCtx.Done():
+	}
+
+	log.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := coordinator.Run(ctx); err != nil {
+		log.Println("Shutdown error:", err)
 	}
+	log.Println("Shutdown took", time.Since(start))
 }
@@ -0,0 +1,124 @@
+// replay re-drives jobs that completed in production through a sandbox
+// gardener, and compares the raw partitions that they produce, so that
+// pipeline changes can be validated end to end before promotion.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/api/client"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+)
+
+var (
+	jobLog         = flag.String("job_log", "", "Production job log table, as project.dataset.table")
+	project        = flag.String("project", "mlab-oti", "Production project")
+	sandboxProject = flag.String("sandbox_project", "mlab-sandbox", "Sandbox project")
+	sandboxURL     = flag.String("sandbox_url", "http://localhost:8080", "Base URL of the sandbox gardener manager")
+	adminKey       = flag.String("admin_key", "", "API key for the sandbox gardener admin API")
+	sandboxBucket  = flag.String("sandbox_bucket", "", "Sandbox archive bucket.  Empty keeps the production bucket")
+	datasetSuffix  = flag.String("dataset_suffix", "", "Suffix of the sandbox dataset names, e.g. _replay")
+	experiment     = flag.String("experiment", "", "Experiment of the jobs to replay")
+	datatype       = flag.String("datatype", "", "Datatype of the jobs to replay")
+	startDate      = flag.String("start_date", "", "First date to replay, as yyyy-mm-dd")
+	endDate        = flag.String("end_date", "", "Last date to replay, as yyyy-mm-dd.  Defaults to start_date")
+	limit          = flag.Int("limit", 10, "Maximum number of jobs to replay, most recent first")
+	dryRun         = flag.Bool("dry_run", false, "List the jobs that would be replayed, without replaying them")
+	interval       = flag.Duration("interval", time.Minute, "Polling interval for the sandbox jobs")
+	timeout        = flag.Duration("timeout", 12*time.Hour, "Time limit for the replayed jobs to complete")
+)
+
+var usageText = `
+NAME
+  replay - replay completed production jobs in a sandbox gardener
+
+DESCRIPTION
+  replay reads the jobs of -experiment and -datatype that completed in
+  production between -start_date and -end_date from the -job_log table.  It
+  rewrites each job's bucket to -sandbox_bucket, and requeues it, with force,
+  in the sandbox gardener at -sandbox_url.  Once the jobs complete, or
+  -timeout expires, it compares the task file and row counts of each raw
+  partition in production with those in -sandbox_project, whose datasets
+  have the -dataset_suffix.  Exits with status 1 if any job failed, did not
+  complete, or has different counts.
+
+  The sandbox gardener must be configured with the sandbox bucket as a
+  source, and with dataset names matching the suffix.
+
+EXAMPLES
+  replay -job_log=mlab-oti.gardener.job_log -admin_key=$KEY \
+    -sandbox_url=https://gardener.mlab-sandbox.measurementlab.net \
+    -sandbox_bucket=archive-mlab-sandbox -experiment=ndt -datatype=ndt7 \
+    -start_date=2020-06-01 -end_date=2020-06-07
+`
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usageText)
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not get args from env")
+
+	if *jobLog == "" || *experiment == "" || *datatype == "" || *startDate == "" || *limit <= 0 {
+		flag.Usage()
+		log.Fatal("job_log, experiment, datatype and start_date are required, and limit must be positive")
+	}
+	start, err := time.Parse("2006-01-02", *startDate)
+	rtx.Must(err, "Invalid start_date")
+	end := start
+	if *endDate != "" {
+		end, err = time.Parse("2006-01-02", *endDate)
+		rtx.Must(err, "Invalid end_date")
+	}
+
+	ctx := context.Background()
+	prodBQ, err := bq.NewClient(ctx, *project)
+	rtx.Must(err, "Could not create production bigquery client")
+	jobs, err := History(ctx, prodBQ, *jobLog, Filter{
+		Experiment: *experiment, Datatype: *datatype, Start: start, End: end, Limit: *limit})
+	rtx.Must(err, "Could not read job history")
+
+	rewrite := Rewrite{Project: *sandboxProject, Bucket: *sandboxBucket, DatasetSuffix: *datasetSuffix}
+	for _, j := range jobs {
+		fmt.Printf("Replay %s as %s\n", j, rewrite.Job(j).Path())
+	}
+	if *dryRun {
+		return
+	}
+
+	base, err := url.Parse(*sandboxURL)
+	rtx.Must(err, "Invalid sandbox_url")
+	sandboxBQ, err := bq.NewClient(ctx, *sandboxProject)
+	rtx.Must(err, "Could not create sandbox bigquery client")
+	r := &Replayer{
+		Sandbox:   client.New(*base, *adminKey),
+		ProdBQ:    prodBQ,
+		SandboxBQ: sandboxBQ,
+		Project:   *project,
+		Naming:    bq.DefaultNaming,
+		Rewrite:   rewrite,
+		Interval:  *interval,
+	}
+	wctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	results, err := r.Replay(wctx, jobs)
+	rtx.Must(err, "Replay failed")
+	if WriteResults(os.Stdout, results) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/api/client"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func date(d int) time.Time {
+	return time.Date(2020, 6, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestHistory(t *testing.T) {
+	f := Filter{Experiment: "ndt", Datatype: "ndt7", Start: date(1), End: date(7), Limit: 5}
+	empty := bqfake.NewClient("mlab-oti")
+	if _, err := History(context.Background(), empty, "mlab-oti.gardener.job_log", f); !errors.Is(err, ErrNoJobs) {
+		t.Error("Expected ErrNoJobs", err)
+	}
+
+	c := bqfake.NewClient("mlab-oti")
+	c.AddResult("`mlab-oti.gardener.job_log`", bqfake.Result{Rows: []interface{}{
+		historyRow{Bucket: "archive", Experiment: "ndt", Datatype: "ndt7", Date: date(2)},
+		historyRow{Bucket: "archive", Experiment: "ndt", Datatype: "ndt7", Date: date(1), Prefix: "20200601T15"},
+	}})
+	jobs, err := History(context.Background(), c, "mlab-oti.gardener.job_log", f)
+	rtx.Must(err, "History")
+	if len(jobs) != 2 || !jobs[0].Date.Equal(date(2)) || jobs[1].Prefix != "20200601T15" {
+		t.Error("Wrong jobs", jobs)
+	}
+	q := c.QueryRuns()
+	if len(q) != 0 {
+		t.Error("History should read, not run, the query", q)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	rw := Rewrite{Project: "mlab-sandbox", Bucket: "archive-sandbox", DatasetSuffix: "_replay"}
+	j := rw.Job(tracker.NewJob("archive", "ndt", "ndt7", date(1)))
+	if j.Bucket != "archive-sandbox" || j.Experiment != "ndt" {
+		t.Error("Wrong sandbox job", j)
+	}
+	names, err := rw.Naming(bq.Naming{}).Names(j)
+	rtx.Must(err, "Names")
+	if names.TmpDataset != "tmp_ndt_replay" || names.RawDataset != "raw_ndt_replay" || names.Table != "ndt7" {
+		t.Errorf("Wrong sandbox names %+v", names)
+	}
+	if (Rewrite{}).Job(tracker.NewJob("archive", "ndt", "ndt7", date(1))).Bucket != "archive" {
+		t.Error("Empty bucket should keep the job's bucket")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	// The sandbox gardener completes the jobs that are requeued, except
+	// the one for 2020-06-03, which fails.  Complete jobs are kept for the
+	// cleanup delay, as they are by the deployed tracker.
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, time.Hour)
+	rtx.Must(err, "tk init")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs.json", tk.JobsHandler)
+	mux.HandleFunc("/admin/requeue", func(resp http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Header.Get("Authorization") != "Bearer key" || req.Form.Get("force") != "true" {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var j tracker.Job
+		rtx.Must(j.Unmarshal([]byte(req.Form.Get("job"))), "unmarshal")
+		rtx.Must(tk.AddJob(j), "add")
+		if j.Date.Equal(date(3)) {
+			rtx.Must(tk.SetStatus(j, tracker.Failed, "parse error"), "fail")
+		} else {
+			rtx.Must(tk.SetStatus(j, tracker.Complete, ""), "complete")
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	base, err := url.Parse(server.URL)
+	rtx.Must(err, "parse")
+
+	prod := bqfake.NewClient("mlab-oti")
+	sandbox := bqfake.NewClient("mlab-sandbox")
+	for _, d := range []string{"2020-06-01", "2020-06-02"} {
+		prod.AddResult("`mlab-oti.raw_ndt.ndt7`\nWHERE date = \""+d, bqfake.Result{
+			Rows: []interface{}{bq.RawCounts{Files: 10, Rows: 1000}}})
+	}
+	sandbox.AddResult("`mlab-sandbox.raw_ndt_replay.ndt7`\nWHERE date = \"2020-06-01", bqfake.Result{
+		Rows: []interface{}{bq.RawCounts{Files: 10, Rows: 1000}}})
+	sandbox.AddResult("`mlab-sandbox.raw_ndt_replay.ndt7`\nWHERE date = \"2020-06-02", bqfake.Result{
+		Rows: []interface{}{bq.RawCounts{Files: 10, Rows: 990}}})
+
+	r := &Replayer{
+		Sandbox:   client.New(*base, "key"),
+		ProdBQ:    prod,
+		SandboxBQ: sandbox,
+		Project:   "mlab-oti",
+		Naming:    bq.DefaultNaming,
+		Rewrite:   Rewrite{Project: "mlab-sandbox", Bucket: "archive-sandbox", DatasetSuffix: "_replay"},
+		Interval:  time.Millisecond,
+	}
+	jobs := []tracker.Job{}
+	for d := 3; d > 0; d-- {
+		jobs = append(jobs, tracker.NewJob("archive", "ndt", "ndt7", date(d)))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results, err := r.Replay(ctx, jobs)
+	rtx.Must(err, "Replay")
+
+	if len(results) != 3 {
+		t.Fatal("Wrong results", results)
+	}
+	if !errors.Is(results[0].Err, ErrNotCompleted) || results[0].State != tracker.Failed {
+		t.Errorf("Expected failed replay %+v", results[0])
+	}
+	if !errors.Is(results[1].Err, ErrCountMismatch) || results[1].Sandbox.Rows != 990 {
+		t.Errorf("Expected count mismatch %+v", results[1])
+	}
+	if results[2].Err != nil || results[2].Prod.Rows != 1000 || results[2].Job.Bucket != "archive" {
+		t.Errorf("Expected matching replay %+v", results[2])
+	}
+
+	buf := bytes.Buffer{}
+	if n := WriteResults(&buf, results); n != 2 {
+		t.Error("Expected 2 failures, got", n)
+	}
+	if !strings.Contains(buf.String(), "1 of 3 jobs replayed successfully") {
+		t.Error("Wrong summary", buf.String())
+	}
+
+	if _, err := r.Replay(ctx, nil); !errors.Is(err, ErrNoJobs) {
+		t.Error("Expected ErrNoJobs", err)
+	}
+}
+
+func TestReplayTimeout(t *testing.T) {
+	// The sandbox gardener accepts the job, but never processes it.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs.json", func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("[]"))
+	})
+	mux.HandleFunc("/admin/requeue", func(resp http.ResponseWriter, req *http.Request) {})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	base, err := url.Parse(server.URL)
+	rtx.Must(err, "parse")
+
+	r := &Replayer{Sandbox: client.New(*base, ""), Naming: bq.DefaultNaming, Interval: time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	results, err := r.Replay(ctx, []tracker.Job{tracker.NewJob("archive", "ndt", "ndt7", date(1))})
+	rtx.Must(err, "Replay")
+	if len(results) != 1 || !errors.Is(results[0].Err, ErrNotCompleted) {
+		t.Error("Expected incomplete replay", results)
+	}
+}
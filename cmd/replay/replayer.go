@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"google.golang.org/api/iterator"
+
+	"github.com/m-lab/etl-gardener/api/client"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Errors returned by the Replayer.
+var (
+	ErrNoJobs        = errors.New("no jobs in history")
+	ErrNotCompleted  = errors.New("replay did not complete")
+	ErrCountMismatch = errors.New("raw counts differ")
+)
+
+// Filter selects the historical jobs to replay.
+type Filter struct {
+	Experiment string
+	Datatype   string
+	Start, End time.Time // Inclusive job dates.
+	Limit      int       // Maximum number of jobs, most recent first.
+}
+
+// historyRow is a completed job, as read from the job log.
+type historyRow struct {
+	Bucket     string
+	Experiment string
+	Datatype   string
+	Date       time.Time
+	Prefix     string
+}
+
+// History reads the jobs that completed in production from the job log
+// table, e.g. mlab-oti.gardener.job_log, with the most recent dates first.
+func History(ctx context.Context, c bqiface.Client, table string, f Filter) ([]tracker.Job, error) {
+	qs := fmt.Sprintf(`
+#standardSQL
+# Select the jobs that completed in production, for replay.
+SELECT DISTINCT bucket AS Bucket, experiment AS Experiment, datatype AS Datatype,
+  date AS Date, prefix AS Prefix
+FROM `+"`%s`"+`
+WHERE state IN (%q, %q) AND experiment = @experiment AND datatype = @datatype
+  AND DATE(date) BETWEEN CAST(@start AS DATE) AND CAST(@end AS DATE)
+ORDER BY Date DESC, Prefix
+LIMIT %d`, table, tracker.Complete, tracker.PartialComplete, f.Limit)
+	q := c.Query(qs)
+	q.SetQueryConfig(bqiface.QueryConfig{QueryConfig: bigquery.QueryConfig{Q: qs, Parameters: []bigquery.QueryParameter{
+		{Name: "experiment", Value: f.Experiment},
+		{Name: "datatype", Value: f.Datatype},
+		{Name: "start", Value: f.Start.Format("2006-01-02")},
+		{Name: "end", Value: f.End.Format("2006-01-02")},
+	}}})
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []tracker.Job{}
+	for {
+		var r historyRow
+		err := it.Next(&r)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		j := tracker.NewJob(r.Bucket, r.Experiment, r.Datatype, r.Date)
+		j.Prefix = r.Prefix
+		jobs = append(jobs, j)
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("%w: %s/%s from %s to %s", ErrNoJobs, f.Experiment, f.Datatype,
+			f.Start.Format("2006-01-02"), f.End.Format("2006-01-02"))
+	}
+	return jobs, nil
+}
+
+// Rewrite maps production jobs and tables to their sandbox equivalents.
+type Rewrite struct {
+	Project       string // Sandbox project.
+	Bucket        string // Sandbox archive bucket.  Empty keeps the job's bucket.
+	DatasetSuffix string // Appended to each dataset name, e.g. "_replay".
+}
+
+// Job returns the sandbox job for a production job.
+func (rw Rewrite) Job(j tracker.Job) tracker.Job {
+	if rw.Bucket != "" {
+		j.Bucket = rw.Bucket
+	}
+	return j
+}
+
+// Naming returns the sandbox naming for the production naming.
+func (rw Rewrite) Naming(n bq.Naming) bq.Naming {
+	n = n.WithDefaults()
+	n.TmpDataset += rw.DatasetSuffix
+	n.RawDataset += rw.DatasetSuffix
+	n.FinalDataset += rw.DatasetSuffix
+	return n
+}
+
+// Result is the outcome of replaying a single job.
+type Result struct {
+	Job     tracker.Job   // The production job.
+	State   tracker.State // The last sandbox state seen.
+	Detail  string
+	Prod    bq.RawCounts
+	Sandbox bq.RawCounts
+	Err     error
+}
+
+// Replayer replays production jobs in a sandbox gardener, and compares the
+// raw partitions that they produce.
+type Replayer struct {
+	Sandbox   *client.Client // The sandbox gardener's API, with its admin key.
+	ProdBQ    bqiface.Client // Client for the production project.
+	SandboxBQ bqiface.Client // Client for the sandbox project.
+	Project   string         // Production project.
+	Naming    bq.Naming      // Production naming.
+	Rewrite   Rewrite
+	Interval  time.Duration // Polling interval for the sandbox jobs.
+}
+
+// requeue adds each sandbox job to the sandbox gardener, forcing jobs that
+// it has already processed to be reprocessed.
+func (r *Replayer) requeue(ctx context.Context, jobs []tracker.Job) error {
+	for _, j := range jobs {
+		if err := r.Sandbox.Requeue(ctx, r.Rewrite.Job(j), time.Time{}, true); err != nil {
+			return fmt.Errorf("%v: %w", j, err)
+		}
+	}
+	return nil
+}
+
+// wait polls the sandbox gardener until every job has completed or failed,
+// or ctx is done, and returns the results, keyed by sandbox job key.
+func (r *Replayer) wait(ctx context.Context, jobs []tracker.Job) map[string]*Result {
+	results := make(map[string]*Result, len(jobs))
+	for _, j := range jobs {
+		results[r.Rewrite.Job(j).Key()] = &Result{Job: j, State: tracker.Init}
+	}
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		pending := 0
+		// The jobs share an experiment and datatype.
+		statuses, err := r.Sandbox.Jobs(ctx, client.JobFilter{Experiment: jobs[0].Experiment, Datatype: jobs[0].Datatype})
+		if err != nil {
+			log.Println(err)
+		}
+		for _, js := range statuses {
+			if res, ok := results[js.Job.Key()]; ok {
+				res.State, res.Detail = js.Status.State(), js.Status.Detail()
+			}
+		}
+		for _, res := range results {
+			if !done(res.State) {
+				pending++
+			}
+		}
+		if pending == 0 {
+			return results
+		}
+		select {
+		case <-ctx.Done():
+			return results
+		case <-ticker.C:
+		}
+	}
+}
+
+// done returns true for the final states of a replayed job.
+func done(s tracker.State) bool {
+	return s == tracker.Complete || s == tracker.PartialComplete || s == tracker.Failed
+}
+
+// compare counts the task files and rows of the production and sandbox raw
+// partitions of the job.
+func (r *Replayer) compare(ctx context.Context, res *Result) {
+	prod, err := bq.NewTableOpsWithClientAndNaming(r.ProdBQ, res.Job, r.Project, "", r.Naming)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	sandbox, err := bq.NewTableOpsWithClientAndNaming(r.SandboxBQ, r.Rewrite.Job(res.Job), r.Rewrite.Project,
+		"", r.Rewrite.Naming(r.Naming))
+	if err != nil {
+		res.Err = err
+		return
+	}
+	if res.Prod, err = prod.CountRaw(ctx); err != nil {
+		res.Err = fmt.Errorf("production counts: %w", err)
+		return
+	}
+	if res.Sandbox, err = sandbox.CountRaw(ctx); err != nil {
+		res.Err = fmt.Errorf("sandbox counts: %w", err)
+		return
+	}
+	if res.Prod != res.Sandbox {
+		res.Err = fmt.Errorf("%w: %d files, %d rows in production, %d files, %d rows in sandbox", ErrCountMismatch,
+			res.Prod.Files, res.Prod.Rows, res.Sandbox.Files, res.Sandbox.Rows)
+	}
+}
+
+// Replay requeues the jobs in the sandbox gardener, waits until they are
+// done or ctx expires, and compares the raw partitions of the completed
+// jobs.  Results are in the order of the jobs.
+func (r *Replayer) Replay(ctx context.Context, jobs []tracker.Job) ([]Result, error) {
+	if len(jobs) == 0 {
+		return nil, ErrNoJobs
+	}
+	if err := r.requeue(ctx, jobs); err != nil {
+		return nil, err
+	}
+	byKey := r.wait(ctx, jobs)
+	// Compare with a fresh context, since ctx may have expired.
+	cctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	results := make([]Result, 0, len(jobs))
+	for _, j := range jobs {
+		res := byKey[r.Rewrite.Job(j).Key()]
+		switch res.State {
+		case tracker.Complete, tracker.PartialComplete:
+			r.compare(cctx, res)
+		case tracker.Failed:
+			res.Err = fmt.Errorf("%w: failed: %s", ErrNotCompleted, res.Detail)
+		default:
+			res.Err = fmt.Errorf("%w: still %s", ErrNotCompleted, res.State)
+		}
+		results = append(results, *res)
+	}
+	return results, nil
+}
+
+// WriteResults writes the results as a table, and returns the number that
+// failed.
+func WriteResults(w io.Writer, results []Result) int {
+	failed := 0
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB\tSTATE\tPROD ROWS\tSANDBOX ROWS\tRESULT")
+	for _, res := range results {
+		result := "ok"
+		if res.Err != nil {
+			failed++
+			result = res.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", res.Job, res.State, res.Prod.Rows, res.Sandbox.Rows, result)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d of %d jobs replayed successfully\n", len(results)-failed, len(results))
+	return failed
+}
@@ -13,16 +13,364 @@ import (
 
 	"github.com/kelseyhightower/envconfig"
 	"gopkg.in/yaml.v2"
+
+	"github.com/m-lab/etl-gardener/civil"
 )
 
 // TrackerConfig holds the config for the job tracker.
 type TrackerConfig struct {
 	Timeout time.Duration `yaml:"timeout"`
+	// CompactEvery is the number of incremental saves between full state
+	// snapshots.  Zero saves the full state every time.
+	CompactEvery int `yaml:"compact_every"`
+	// HeartbeatTimeout is the time after which jobs held by parsers, in
+	// init or parsing, with no heartbeat or update are returned to pending
+	// and dispatched again.  Zero disables the check.
+	HeartbeatTimeout time.Duration `yaml:"heartbeat_timeout"`
+	// SnapshotInterval is the minimum time between snapshots of the job
+	// map served by the status endpoints.  Zero serves the current state,
+	// under the tracker lock.
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
 }
 
 // MonitorConfig holds the config for the state machine monitor.
 type MonitorConfig struct {
+	// PollingInterval is the interval between polls of a job just after it
+	// enters a state with an action.  While the job stays in the state,
+	// the interval doubles, up to MaxPollingInterval.  Sources may override
+	// both.  If zero, the monitor polls every 5 seconds.
 	PollingInterval time.Duration `yaml:"polling_interval"`
+	// MaxPollingInterval is the longest interval between polls of a job.
+	// Zero polls jobs at PollingInterval, without backing off.
+	MaxPollingInterval time.Duration `yaml:"max_polling_interval"`
+	// ValidationThreshold is the fractional difference allowed between the
+	// archive, parser and BigQuery counts before a job is marked failed.
+	// If zero, ops.DefaultValidationThreshold is used.
+	ValidationThreshold float64 `yaml:"validation_threshold"`
+
+	// Limits on concurrent actions.  Zero means unlimited.
+	MaxConcurrentDedups   int `yaml:"max_concurrent_dedups"`
+	MaxConcurrentCopies   int `yaml:"max_concurrent_copies"`
+	MaxConcurrentCleanups int `yaml:"max_concurrent_cleanups"`
+	// MaxConcurrentDMLPerTable limits the mutating DML statements, i.e.
+	// delete dedups and prefix copies, running against each table.  Zero
+	// means 1, which serializes them.
+	MaxConcurrentDMLPerTable int `yaml:"max_concurrent_dml_per_table"`
+
+	// Deadlines limits the duration of each action, by state, e.g.
+	// "deduplicating: 2h".  Actions exceeding their deadline are abandoned,
+	// with their BigQuery job cancelled, and retried.
+	Deadlines map[string]time.Duration `yaml:"deadlines"`
+
+	// BackfillConcurrency is the number of jobs per experiment/datatype
+	// expected to be processed concurrently, for backlog ETA estimates.
+	// Zero uses the number of jobs currently in flight.
+	BackfillConcurrency int `yaml:"backfill_concurrency"`
+
+	// VerifyCopies enables comparison of tmp and raw partition checksums
+	// after each copy.  This costs an additional query per job.
+	VerifyCopies bool `yaml:"verify_copies"`
+
+	// DuplicationThreshold is the fraction of partition rows that dedup may
+	// remove before DuplicationPolicy is applied.  Zero disables the check.
+	DuplicationThreshold float64 `yaml:"duplication_threshold"`
+	// DuplicationPolicy is one of "flag" (the default), "fail" or "reparse".
+	DuplicationPolicy string `yaml:"duplication_policy"`
+
+	// SlotThrottle defers dedups while the BigQuery reservation is saturated.
+	SlotThrottle SlotThrottleConfig `yaml:"slot_throttle"`
+
+	// SizeAnomaly flags published partitions whose row counts deviate from
+	// the same weekday in earlier weeks.
+	SizeAnomaly SizeAnomalyConfig `yaml:"size_anomaly"`
+}
+
+// SizeAnomalyConfig holds the bounds on the ratio of a published partition's
+// rows to the median of the same weekday in earlier weeks.  Zero High and
+// Low disable the check.
+type SizeAnomalyConfig struct {
+	High  float64 `yaml:"high"`  // e.g. 3
+	Low   float64 `yaml:"low"`   // e.g. 0.3
+	Weeks int     `yaml:"weeks"` // Zero means 4.
+}
+
+// SlotThrottleConfig holds the config for throttling on BigQuery slot
+// reservation utilization.  An empty Reservation disables throttling.
+type SlotThrottleConfig struct {
+	Reservation string `yaml:"reservation"` // e.g. admin-project:US.batch
+	Region      string `yaml:"region"`      // e.g. us
+	Capacity    int    `yaml:"capacity"`    // Slots in the reservation.
+	// High and Low are the utilization fractions at which throttling
+	// starts and stops.
+	High     float64       `yaml:"high"`
+	Low      float64       `yaml:"low"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// IncrementalConfig holds the config for incremental processing of the current date.
+type IncrementalConfig struct {
+	// Interval between successive dispatches of the current date's jobs.
+	// Zero disables incremental processing.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// DispatchConfig selects the work an instance dispatches to the parsers.
+// Daily processing dispatches yesterday's and the current date's jobs, and
+// reprocessing dispatches historical dates, starting from start_date.
+type DispatchConfig struct {
+	// Mode is "daily", "reprocess" or "both", the default.
+	Mode string `yaml:"mode"`
+	// DailyQuota and ReprocessQuota limit the jobs in flight in each lane.
+	// Zero means no limit.
+	DailyQuota     int `yaml:"daily_quota"`
+	ReprocessQuota int `yaml:"reprocess_quota"`
+}
+
+// BackfillConfig holds the policy for planned backfills, which order a
+// range of historical dates by the size of their archives.
+type BackfillConfig struct {
+	// Order is "date" (the default), "largest" or "smallest".
+	Order string `yaml:"order"`
+	// LargeBytes is the archive size at and above which a date is only
+	// dispatched during the idle window.  Zero disables the window.
+	LargeBytes int64 `yaml:"large_bytes"`
+	// IdleStartHour and IdleEndHour bound the idle window, in UTC hours,
+	// e.g. 22 and 6.  Equal hours allow large dates at any time.
+	IdleStartHour int `yaml:"idle_start_hour"`
+	IdleEndHour   int `yaml:"idle_end_hour"`
+	// EstimateSample is the number of dates whose dedup queries are dry run
+	// to estimate the cost of a backfill.  Zero disables estimates.
+	EstimateSample int `yaml:"estimate_sample"`
+	// SlotSecondsPerGB projects slot usage from the estimated bytes
+	// processed.  Zero uses backfill.DefaultSlotSecondsPerGB.
+	SlotSecondsPerGB float64 `yaml:"slot_seconds_per_gb"`
+	// ApprovalBytes is the estimated bytes processed above which a backfill
+	// must be approved.  Zero means no approval is required.
+	ApprovalBytes int64 `yaml:"approval_bytes"`
+}
+
+// IntakeConfig composes the sources of jobs dispatched to the parsers.
+type IntakeConfig struct {
+	// Order lists the job sources in priority order, e.g. [requeue, shards,
+	// requests, yesterday, today, scan, backfill, historical].  Empty uses
+	// the default order.  See job.Service.SetSourceOrder.
+	Order []string `yaml:"order"`
+	// RequestSubscription is a Pub/Sub subscription for job requests, e.g.
+	// re-parse requests from the parsers, which are dispatched by the
+	// "requests" source.  Empty means requests are only taken over HTTP.
+	RequestSubscription string `yaml:"request_subscription"`
+	// ScanInterval is the interval between scans of the sources' GCS
+	// archives for new dates, which are dispatched by the "scan" source.
+	// Zero disables scanning.
+	ScanInterval time.Duration `yaml:"scan_interval"`
+	// ScanDays is the number of recent dates scanned.  Zero means 7.
+	ScanDays int `yaml:"scan_days"`
+}
+
+// StepConfig adds a pipeline step, applied to jobs in State using the
+// registered runner, which advances the job to Next on success.
+type StepConfig struct {
+	State  string `yaml:"state"`
+	Runner string `yaml:"runner"`
+	Next   string `yaml:"next"`
+}
+
+// NamingConfig holds the templates for dataset and table names.  Templates
+// may use {{.Experiment}} and {{.Datatype}}.  Empty templates use the M-Lab
+// defaults, e.g. tmp_{{.Experiment}}.
+type NamingConfig struct {
+	TmpDataset   string `yaml:"tmp_dataset"`
+	RawDataset   string `yaml:"raw_dataset"`
+	FinalDataset string `yaml:"final_dataset"`
+	Table        string `yaml:"table"`
+}
+
+// TmpConfig holds the config for tmp table maintenance.
+type TmpConfig struct {
+	// Expiration is the partition expiration enforced on tmp tables, and the
+	// age after which orphaned tmp partitions are deleted.  Zero disables
+	// tmp table maintenance.
+	Expiration time.Duration `yaml:"expiration"`
+	// SweepInterval is the interval between sweeps.
+	SweepInterval time.Duration `yaml:"sweep_interval"`
+
+	// MaxBytes is the total logical size of the tmp datasets above which
+	// dispatch of new jobs is paused, until the size drops to ResumeBytes.
+	// Zero disables the check.  ResumeBytes defaults to 80% of MaxBytes.
+	MaxBytes    int64 `yaml:"max_bytes"`
+	ResumeBytes int64 `yaml:"resume_bytes"`
+	// SizeInterval is the interval between size checks.
+	SizeInterval time.Duration `yaml:"size_interval"`
+}
+
+// ReconcileConfig holds the config for detecting archived dates that were
+// never processed.
+type ReconcileConfig struct {
+	// Interval between reconciliations.  Zero disables reconciliation.
+	Interval time.Duration `yaml:"interval"`
+	// AutoRequeue adds jobs for missing dates.  Otherwise they are only
+	// listed at /missing.json, for operator approval.
+	AutoRequeue bool `yaml:"auto_requeue"`
+	// MaxRequeue limits the jobs added per reconciliation.  Zero means no limit.
+	MaxRequeue int `yaml:"max_requeue"`
+	// VerifyInterval between spot checks of the raw partitions of completed
+	// jobs.  Zero disables them.
+	VerifyInterval time.Duration `yaml:"verify_interval"`
+	// VerifySample is the number of completed jobs checked each time.
+	// Defaults to 10.
+	VerifySample int `yaml:"verify_sample"`
+	// Repair adds a repair job for each completed job whose raw partition is
+	// missing or no longer matches.  Otherwise they are only listed at
+	// /discrepancies.json.
+	Repair bool `yaml:"repair"`
+}
+
+// ArchiveCheckConfig holds the config for checking each job's GCS archive
+// before it is dispatched to the parsers.
+type ArchiveCheckConfig struct {
+	// Enabled lists the archive, and fails jobs with no task files or empty
+	// task files.
+	Enabled bool `yaml:"enabled"`
+	// Sample is the number of task files per job that are read, to verify
+	// gzip integrity.  Negative verifies every file.
+	Sample int `yaml:"sample"`
+}
+
+// JobLogConfig holds the config for logging finished jobs to BigQuery.
+type JobLogConfig struct {
+	// Dataset for the job log table.  Empty disables the job log.
+	Dataset string `yaml:"dataset"`
+	// Table name, "job_log" by default.
+	Table string `yaml:"table"`
+	// FlushInterval is the maximum time rows are held before insertion.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// BatchSize is the maximum number of rows per insert.
+	BatchSize int `yaml:"batch_size"`
+	// WriteAPI writes rows with the BigQuery Storage Write API, exactly
+	// once, rather than with streaming inserts.  Experimental.
+	WriteAPI bool `yaml:"write_api"`
+}
+
+// DoneMarkerConfig holds the config for GCS done markers for completed jobs.
+type DoneMarkerConfig struct {
+	// Bucket for the marker objects.  Empty disables markers.
+	Bucket string `yaml:"bucket"`
+	// Prefix for the marker objects, "gardener/done" by default.
+	Prefix string `yaml:"prefix"`
+}
+
+// ChangesConfig holds the config for notifications of rewritten partitions.
+type ChangesConfig struct {
+	// Topic is the Pub/Sub topic that each change is published to.  Empty
+	// disables publication, but changes are still served at /changes.json.
+	Topic string `yaml:"topic"`
+	// Retention is how long changes are served, 30 days by default.
+	Retention time.Duration `yaml:"retention"`
+}
+
+// NotifyConfig holds the config for notifications of job failures,
+// freshness SLO violations and daily completions.
+type NotifyConfig struct {
+	Sinks  []SinkConfig  `yaml:"sinks"`
+	Routes []RouteConfig `yaml:"routes"`
+	// FreshnessSLO is the maximum age of the oldest pending date of each
+	// experiment/datatype.  Zero disables freshness alerts.
+	FreshnessSLO time.Duration `yaml:"freshness_slo"`
+	// CheckInterval is the interval between freshness checks.
+	CheckInterval time.Duration `yaml:"check_interval"`
+}
+
+// SinkConfig describes a notification destination.  Secrets, such as
+// webhook URLs and API keys, are read from the named environment variables,
+// so that they don't appear in the config or logs.
+type SinkConfig struct {
+	Name string `yaml:"name"`
+	// Type is one of "slack", "sendgrid" or "webhook".
+	Type      string   `yaml:"type"`
+	URL       string   `yaml:"url"`
+	URLEnv    string   `yaml:"url_env"`
+	APIKeyEnv string   `yaml:"api_key_env"`
+	From      string   `yaml:"from"`
+	To        []string `yaml:"to"`
+}
+
+// RouteConfig sends the listed events for an experiment to the named sinks.
+// Empty Experiment or Events match all.
+type RouteConfig struct {
+	Experiment string   `yaml:"experiment"`
+	Events     []string `yaml:"events"`
+	Sinks      []string `yaml:"sinks"`
+}
+
+// CallbackConfig is an HTTP callback, a signed JSON POST of the job and its
+// status, when jobs finish any of the listed stages.  Stages are job states,
+// e.g. copying or publishing, and complete when the job completes.  The URL
+// is read from the environment variable named by URLEnv, if set, and the
+// signing secret from the one named by SecretEnv.  Empty Experiment or
+// Datatype match all.
+type CallbackConfig struct {
+	Name       string   `yaml:"name"`
+	URL        string   `yaml:"url"`
+	URLEnv     string   `yaml:"url_env"`
+	SecretEnv  string   `yaml:"secret_env"`
+	Experiment string   `yaml:"experiment"`
+	Datatype   string   `yaml:"datatype"`
+	Stages     []string `yaml:"stages"`
+}
+
+// ViewsConfig holds the config for the annotation join views.
+type ViewsConfig struct {
+	// Enabled creates a view for each datatype of an experiment that also
+	// has an annotation source, joining its rows with their annotations.
+	// Views are refreshed after publication.
+	Enabled bool `yaml:"enabled"`
+	// Suffix of the view names, "_annotated" by default, e.g. ndt7_annotated.
+	Suffix string `yaml:"suffix"`
+}
+
+// HookConfig holds the actions run for each date of an experiment, once
+// all of its datatypes, including annotation, are complete for the date.
+type HookConfig struct {
+	// RefreshViews refreshes the annotation join views of the experiment.
+	RefreshViews bool `yaml:"refresh_views"`
+	// Queries are run in order, e.g. to rebuild a unified table.
+	Queries []HookQueryConfig `yaml:"queries"`
+}
+
+// HookQueryConfig is a query run by a hook.  SQL is a template, executed
+// with hooks.QueryParams, e.g. `{{.Date.Format "2006-01-02"}}`.
+type HookQueryConfig struct {
+	Name string `yaml:"name"`
+	SQL  string `yaml:"sql"`
+}
+
+// DayConfig holds the ordered stages of an experiment's days.  The post
+// processing of each date's jobs in a stage waits until the date's jobs in
+// earlier stages finish, e.g. annotation before the measurement datatypes.
+type DayConfig struct {
+	Stages []DayStageConfig `yaml:"stages"`
+}
+
+// DayStageConfig is a named group of an experiment's datatypes.
+type DayStageConfig struct {
+	Name      string   `yaml:"name"`
+	Datatypes []string `yaml:"datatypes"`
+}
+
+// PublishConfig holds the destination that an experiment's raw partitions
+// are published to, e.g. the public serving project.
+type PublishConfig struct {
+	Project string `yaml:"project"`
+	Dataset string `yaml:"dataset"`
+	// Readers must be able to read the publish dataset, and RawReaders the
+	// raw dataset, as type:entity, e.g. group:team@example.com, or a special
+	// group, e.g. allAuthenticatedUsers.  They are checked before each
+	// publish.
+	Readers    []string `yaml:"readers"`
+	RawReaders []string `yaml:"raw_readers"`
+	// FailOnAccessDrift fails jobs whose datasets can't be read by the
+	// readers.  By default they are published with a warning.
+	FailOnAccessDrift bool `yaml:"fail_on_access_drift"`
 }
 
 // SourceConfig holds the config that defines all data sources to be processed.
@@ -32,6 +380,61 @@ type SourceConfig struct {
 	Datatype   string `yaml:"datatype"`
 	Filter     string `yaml:"filter"`
 	Target     string `yaml:"target"`
+	// Incremental sources are also processed for the current date.
+	Incremental bool `yaml:"incremental"`
+	// Pipeline is the ordered list of runners applied to this datatype
+	// after parsing, e.g. [inventory, load, dedup, copy, validate, delete].
+	// If empty, the standard sequence is used.
+	Pipeline []string `yaml:"pipeline"`
+	// Steps add or replace pipeline steps for this datatype.
+	Steps []StepConfig `yaml:"steps"`
+	// Dedup selects the dedup strategy, "delete" (default) or "overwrite".
+	Dedup string `yaml:"dedup"`
+	// MaxDedupBytesBilled caps the bytes billed by each dedup query.  Jobs
+	// whose dedup would exceed it fail.  Zero means no cap.
+	MaxDedupBytesBilled int64 `yaml:"max_dedup_bytes_billed"`
+	// CopyWrite is the write disposition of the copy to the raw partition,
+	// "truncate" (default), "append" or "empty".  CopyCreate is the create
+	// disposition, "if_needed" (default) or "never".
+	CopyWrite  string `yaml:"copy_write"`
+	CopyCreate string `yaml:"copy_create"`
+	// PatchRawSchema adds nullable and repeated fields of the tmp table that
+	// are missing from the raw table to it before the copy, rather than
+	// failing the copy, e.g. when the parser adds fields.
+	PatchRawSchema bool `yaml:"patch_raw_schema"`
+	// DailyDelay is how long after a date ends before its daily job is
+	// dispatched, for datatypes that finish uploading late.  If zero, the
+	// job service default is used.
+	DailyDelay time.Duration `yaml:"daily_delay"`
+	// PathTemplate is the archive layout within Bucket, for sources that
+	// don't use <experiment>/<datatype>/YYYY/MM/DD/, e.g.
+	// `{{.Experiment}}/{{.Date.Format "2006/01/02"}}`.  See
+	// tracker.SetPathTemplate.
+	PathTemplate string `yaml:"path_template"`
+	// Shards splits each date's job into prefix jobs, e.g. one per site or
+	// block of hours, that are dispatched to the parsers in parallel.  Each
+	// is a template executed with the job, e.g.
+	// `{{.Date.Format "20060102"}}T0`.  The date is post processed once all
+	// shards are parsed.  See tracker.AddSharded.
+	Shards []string `yaml:"shards"`
+	// CompletionSLO is the time after a date ends by which its job should
+	// be complete, e.g. 36h.  Zero means no SLO.
+	CompletionSLO time.Duration `yaml:"completion_slo"`
+	// SLOTarget is the fraction of dates that should meet CompletionSLO.
+	// If zero, tracker.DefaultSLOTarget is used.
+	SLOTarget float64 `yaml:"slo_target"`
+	// AnnotationTable is the date partitioned table, e.g. "ndt.annotation2"
+	// or "mlab-oti.ndt.annotation2", whose partition for the job's date
+	// must have rows before the job is copied to the raw table, for
+	// datatypes that can't be used without annotations.  AnnotationWait is
+	// the maximum time the copy is held back, after which it proceeds
+	// anyway.  If zero, ops.DefaultAnnotationWait is used.
+	AnnotationTable string        `yaml:"annotation_table"`
+	AnnotationWait  time.Duration `yaml:"annotation_wait"`
+	// MinPollInterval and MaxPollInterval override the monitor's
+	// polling_interval and max_polling_interval for the source's jobs.
+	MinPollInterval time.Duration `yaml:"min_poll_interval"`
+	MaxPollInterval time.Duration `yaml:"max_poll_interval"`
 }
 
 // Gardener is the full config for a Gardener instance.
@@ -40,6 +443,29 @@ type Gardener struct {
 	Tracker   TrackerConfig  `yaml:"tracker"`
 	Monitor   MonitorConfig  `yaml:"monitor"`
 	Sources   []SourceConfig `yaml:"sources"`
+
+	Incremental IncrementalConfig  `yaml:"incremental"`
+	Dispatch    DispatchConfig     `yaml:"dispatch"`
+	Backfill    BackfillConfig     `yaml:"backfill"`
+	Intake      IntakeConfig       `yaml:"intake"`
+	Naming      NamingConfig       `yaml:"naming"`
+	Tmp         TmpConfig          `yaml:"tmp"`
+	Reconcile   ReconcileConfig    `yaml:"reconcile"`
+	Notify      NotifyConfig       `yaml:"notify"`
+	Archive     ArchiveCheckConfig `yaml:"archive_check"`
+	JobLog      JobLogConfig       `yaml:"job_log"`
+	DoneMarker  DoneMarkerConfig   `yaml:"done_marker"`
+	Views       ViewsConfig        `yaml:"views"`
+	Changes     ChangesConfig      `yaml:"changes"`
+
+	// Publish maps experiment names to publish destinations.
+	Publish map[string]PublishConfig `yaml:"publish"`
+	// Hooks maps experiment names to their post-completion hooks.
+	Hooks map[string]HookConfig `yaml:"hooks"`
+	// Days maps experiment names to the ordered stages of their days.
+	Days map[string]DayConfig `yaml:"days"`
+	// Callbacks are invoked when jobs finish pipeline stages.
+	Callbacks []CallbackConfig `yaml:"callbacks"`
 }
 
 var gardener Gardener
@@ -53,7 +479,123 @@ func Sources() []SourceConfig {
 
 // StartDate returns the first date that should be processed.
 func StartDate() time.Time {
-	return gardener.StartDate.UTC().Truncate(24 * time.Hour)
+	return civil.Date(gardener.StartDate)
+}
+
+// Tracker returns the job tracker config.
+func Tracker() TrackerConfig {
+	return gardener.Tracker
+}
+
+// Monitor returns the state machine monitor config.
+func Monitor() MonitorConfig {
+	return gardener.Monitor
+}
+
+// ValidationThreshold returns the fractional count difference allowed
+// when validating a job.
+func ValidationThreshold() float64 {
+	return gardener.Monitor.ValidationThreshold
+}
+
+// IncrementalInterval returns the interval between dispatches of the current
+// date's jobs for incremental sources.
+func IncrementalInterval() time.Duration {
+	return gardener.Incremental.Interval
+}
+
+// Dispatch returns the dispatch mode config.
+func Dispatch() DispatchConfig {
+	return gardener.Dispatch
+}
+
+// Backfill returns the planned backfill policy config.
+func Backfill() BackfillConfig {
+	return gardener.Backfill
+}
+
+// Intake returns the job intake config.
+func Intake() IntakeConfig {
+	return gardener.Intake
+}
+
+// Naming returns the dataset and table naming config.
+func Naming() NamingConfig {
+	return gardener.Naming
+}
+
+// Tmp returns the tmp table maintenance config.
+func Tmp() TmpConfig {
+	return gardener.Tmp
+}
+
+// Reconcile returns the missing date reconciliation config.
+func Reconcile() ReconcileConfig {
+	return gardener.Reconcile
+}
+
+// Notify returns the notification config.
+func Notify() NotifyConfig {
+	return gardener.Notify
+}
+
+// ArchiveCheck returns the pre-dispatch archive check config.
+func ArchiveCheck() ArchiveCheckConfig {
+	return gardener.Archive
+}
+
+// JobLog returns the job log config.
+func JobLog() JobLogConfig {
+	return gardener.JobLog
+}
+
+// DoneMarker returns the done marker config.
+func DoneMarker() DoneMarkerConfig {
+	return gardener.DoneMarker
+}
+
+// Views returns the annotation join view config.
+func Views() ViewsConfig {
+	return gardener.Views
+}
+
+// Changes returns the partition change config.
+func Changes() ChangesConfig {
+	return gardener.Changes
+}
+
+// Publish returns the publish destinations, keyed by experiment.
+func Publish() map[string]PublishConfig {
+	p := make(map[string]PublishConfig, len(gardener.Publish))
+	for k, v := range gardener.Publish {
+		p[k] = v
+	}
+	return p
+}
+
+// Days returns the day stages, keyed by experiment.
+func Days() map[string]DayConfig {
+	d := make(map[string]DayConfig, len(gardener.Days))
+	for k, v := range gardener.Days {
+		d[k] = v
+	}
+	return d
+}
+
+// Callbacks returns the HTTP callbacks of job stages.
+func Callbacks() []CallbackConfig {
+	c := make([]CallbackConfig, len(gardener.Callbacks))
+	copy(c, gardener.Callbacks)
+	return c
+}
+
+// Hooks returns the post-completion hooks, keyed by experiment.
+func Hooks() map[string]HookConfig {
+	h := make(map[string]HookConfig, len(gardener.Hooks))
+	for k, v := range gardener.Hooks {
+		h[k] = v
+	}
+	return h
 }
 
 // ParseConfig loads the full Config, or Exits on failure.
@@ -0,0 +1,187 @@
+// Package errreport reports job failures and panics to Cloud Error
+// Reporting, grouped by error category, with the job attached.
+//
+// Errors are written as structured log entries in the ReportedErrorEvent
+// format, which Error Reporting ingests from Cloud Logging, so no additional
+// API client or credentials are needed.
+package errreport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// eventType marks log entries for Error Reporting.
+const eventType = "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent"
+
+// Error categories.  Errors are grouped by category in Error Reporting.
+const (
+	Timeout     = "timeout"
+	Quota       = "quota"
+	NotFound    = "not_found"
+	Permission  = "permission"
+	Schema      = "schema"
+	Validation  = "validation"
+	Duplication = "duplication"
+	Panic       = "panic"
+	Other       = "other"
+)
+
+// categories maps lower case error substrings to categories, in the order
+// they are checked.
+var categories = []struct {
+	match    string
+	category string
+}{
+	{"deadline exceeded", Timeout},
+	{"timed out", Timeout},
+	{"quota", Quota},
+	{"rate limit", Quota},
+	{"too many", Quota},
+	{"not found", NotFound},
+	{"notfound", NotFound},
+	{"permission", Permission},
+	{"access denied", Permission},
+	{"schema", Schema},
+	{"no such field", Schema},
+	{"validation failed", Validation},
+	{"checksum mismatch", Validation},
+	{"excess duplication", Duplication},
+}
+
+// Category returns the category of an error message.
+func Category(msg string) string {
+	msg = strings.ToLower(msg)
+	for _, c := range categories {
+		if strings.Contains(msg, c.match) {
+			return c.category
+		}
+	}
+	return Other
+}
+
+type serviceContext struct {
+	Service string `json:"service"`
+	Version string `json:"version,omitempty"`
+}
+
+type reportLocation struct {
+	FilePath     string `json:"filePath"`
+	LineNumber   int    `json:"lineNumber"`
+	FunctionName string `json:"functionName"`
+}
+
+type errorContext struct {
+	ReportLocation *reportLocation `json:"reportLocation,omitempty"`
+}
+
+// event is a ReportedErrorEvent log entry.
+type event struct {
+	Type           string         `json:"@type"`
+	Severity       string         `json:"severity"`
+	EventTime      string         `json:"eventTime"`
+	Message        string         `json:"message"`
+	ServiceContext serviceContext `json:"serviceContext"`
+	Context        errorContext   `json:"context"`
+
+	Category   string `json:"category"`
+	Job        string `json:"job,omitempty"`
+	Experiment string `json:"experiment,omitempty"`
+	Datatype   string `json:"datatype,omitempty"`
+	Date       string `json:"date,omitempty"`
+	State      string `json:"state,omitempty"`
+}
+
+// Reporter writes error events for Error Reporting.  It is safe for
+// concurrent use.
+type Reporter struct {
+	service serviceContext
+
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// New creates a Reporter that writes events to w, normally os.Stderr, for
+// the service and version, e.g. the release tag.
+func New(w io.Writer, service, version string) *Reporter {
+	return &Reporter{w: w, service: serviceContext{Service: service, Version: version}}
+}
+
+// write writes a single event.  Events without a stack trace are grouped by
+// their category, through the report location.
+func (r *Reporter) write(e event, stack []byte) {
+	e.Type = eventType
+	e.Severity = "ERROR"
+	e.EventTime = time.Now().UTC().Format(time.RFC3339Nano)
+	e.ServiceContext = r.service
+	if len(stack) > 0 {
+		e.Message += "\n\n" + string(stack)
+	} else {
+		e.Context.ReportLocation = &reportLocation{FilePath: "gardener", FunctionName: e.Category}
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Println(err, e.Message)
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, err := r.w.Write(append(b, '\n')); err != nil {
+		log.Println(err, e.Message)
+		return
+	}
+	metrics.ErrorReports.WithLabelValues(e.Category).Inc()
+}
+
+// withJob attaches the job to the event.
+func withJob(e event, j tracker.Job) event {
+	e.Job = j.Key()
+	e.Experiment = j.Experiment
+	e.Datatype = j.Datatype
+	e.Date = j.Date.Format("2006-01-02")
+	return e
+}
+
+// ReportJob reports a job failure in state.
+func (r *Reporter) ReportJob(j tracker.Job, state tracker.State, msg string) {
+	category := Category(msg)
+	e := withJob(event{Category: category, State: string(state),
+		Message: fmt.Sprintf("%s: %s failed in %s: %s", category, j, state, msg)}, j)
+	r.write(e, nil)
+}
+
+// Observe is a tracker.Observer that reports failed jobs.
+func (r *Reporter) Observe(j tracker.Job, s tracker.Status) {
+	if s.State() != tracker.Failed {
+		return
+	}
+	r.ReportJob(j, s.Prev(), s.Detail())
+}
+
+// ReportPanic reports a panic, with the stack trace, and the job if it is
+// not nil.
+func (r *Reporter) ReportPanic(j *tracker.Job, v interface{}, stack []byte) {
+	e := event{Category: Panic, Message: fmt.Sprintf("panic: %v", v)}
+	if j != nil {
+		e = withJob(e, *j)
+	}
+	r.write(e, stack)
+}
+
+// Recover reports a panic and then panics again, so that the process still
+// crashes.  It must be deferred directly, e.g. defer r.Recover().
+func (r *Reporter) Recover() {
+	if v := recover(); v != nil {
+		r.ReportPanic(nil, v, debug.Stack())
+		panic(v)
+	}
+}
@@ -0,0 +1,109 @@
+package errreport_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/errreport"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestCategory(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"action deadline exceeded: 2h0m0s", errreport.Timeout},
+		{"googleapi: Error 403: Quota exceeded", errreport.Quota},
+		{"Too many DML statements outstanding", errreport.Quota},
+		{"googleapi: Error 404: Not found: Table p:d.t", errreport.NotFound},
+		{"Access Denied: Table p:d.t", errreport.Permission},
+		{"schema mismatch: missing parser.Version", errreport.Schema},
+		{"validation failed: rows 10 != 11", errreport.Validation},
+		{"excess duplication: 0.6", errreport.Duplication},
+		{"something else", errreport.Other},
+	}
+	for _, tt := range tests {
+		if got := errreport.Category(tt.msg); got != tt.want {
+			t.Errorf("Category(%q) = %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
+
+// events decodes the events written to buf.
+func events(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		e := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err, line)
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+func TestReporter_Observe(t *testing.T) {
+	buf := &bytes.Buffer{}
+	r := errreport.New(buf, "etl-gardener", "v1.2.3")
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	tk.AddObserver(r.Observe)
+	j := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(j), "AddJob")
+	rtx.Must(tk.SetStatus(j, tracker.Deduplicating, ""), "SetStatus")
+	rtx.Must(tk.SetJobError(j, "googleapi: Error 403: Quota exceeded"), "SetJobError")
+
+	got := events(t, buf)
+	if len(got) != 1 {
+		t.Fatal("Expected 1 event", buf.String())
+	}
+	e := got[0]
+	if e["@type"] != "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent" ||
+		e["severity"] != "ERROR" || e["category"] != errreport.Quota ||
+		e["experiment"] != "ndt" || e["datatype"] != "ndt7" || e["date"] != "2020-06-01" ||
+		e["state"] != string(tracker.Deduplicating) {
+		t.Errorf("Wrong event %v", e)
+	}
+	if !strings.Contains(e["message"].(string), "Quota exceeded") {
+		t.Error("Wrong message", e["message"])
+	}
+	service := e["serviceContext"].(map[string]interface{})
+	if service["service"] != "etl-gardener" || service["version"] != "v1.2.3" {
+		t.Error("Wrong service context", service)
+	}
+	loc := e["context"].(map[string]interface{})["reportLocation"].(map[string]interface{})
+	if loc["functionName"] != errreport.Quota {
+		t.Error("Events should be grouped by category", loc)
+	}
+}
+
+func TestReporter_Recover(t *testing.T) {
+	buf := &bytes.Buffer{}
+	r := errreport.New(buf, "etl-gardener", "")
+	v := func() (v interface{}) {
+		defer func() { v = recover() }()
+		defer r.Recover()
+		panic("boom")
+	}()
+	if v != "boom" {
+		t.Error("Should have panicked again", v)
+	}
+	got := events(t, buf)
+	if len(got) != 1 || got[0]["category"] != errreport.Panic {
+		t.Fatal("Expected a panic event", buf.String())
+	}
+	msg := got[0]["message"].(string)
+	if !strings.HasPrefix(msg, "panic: boom\n\ngoroutine ") {
+		t.Error("Message should include the stack trace", msg)
+	}
+	if _, ok := got[0]["context"].(map[string]interface{})["reportLocation"]; ok {
+		t.Error("Panics should be grouped by stack trace", got[0])
+	}
+}
@@ -0,0 +1,137 @@
+// Package events is an in-process publish/subscribe bus for job state
+// transitions.  The tracker publishes each transition to the Bus, as its
+// only Observer, and reactions such as metrics, notifications, done markers
+// and the job log subscribe to the Bus, so that adding a reaction doesn't
+// require changes to the tracker.
+package events
+
+import (
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// A Handler reacts to a job transition.  Like a tracker.Observer, it is
+// called on the goroutine that changed the state, so it should not block.
+type Handler func(j tracker.Job, s tracker.Status)
+
+// subscription is a named Handler, and the states it is interested in.
+type subscription struct {
+	name    string
+	states  map[tracker.State]bool // Empty means all states.
+	handler Handler
+}
+
+// Bus delivers each published transition to the matching subscribers, in
+// the order they subscribed.
+type Bus struct {
+	lock sync.Mutex
+	subs []subscription // Copy on write, since Publish uses it without the lock.
+}
+
+// NewBus creates a Bus with no subscribers.
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe adds a named Handler for transitions to the states, or to any
+// state if none are given.  Names label the delivery metrics, so they
+// should be distinct, e.g. "notify".
+func (b *Bus) Subscribe(name string, h Handler, states ...tracker.State) {
+	sub := subscription{name: name, states: map[tracker.State]bool{}, handler: h}
+	for _, s := range states {
+		sub.states[s] = true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	subs := make([]subscription, len(b.subs), len(b.subs)+1)
+	copy(subs, b.subs)
+	b.subs = append(subs, sub)
+}
+
+// Subscribers returns the sorted names of the subscribers.
+func (b *Bus) Subscribers() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	names := make([]string, 0, len(b.subs))
+	for _, s := range b.subs {
+		names = append(names, s.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Publish delivers the transition to each matching subscriber.  It is a
+// tracker.Observer.  A subscriber that panics is logged and counted, and
+// doesn't affect the others or the tracker.
+func (b *Bus) Publish(j tracker.Job, s tracker.Status) {
+	b.lock.Lock()
+	subs := b.subs
+	b.lock.Unlock()
+	state := s.State()
+	for _, sub := range subs {
+		if len(sub.states) > 0 && !sub.states[state] {
+			continue
+		}
+		deliver(sub, j, s)
+	}
+}
+
+// deliver calls the subscriber's handler, recovering from any panic.
+func deliver(sub subscription, j tracker.Job, s tracker.Status) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Event subscriber %s panicked on %v: %v\n%s", sub.name, j, r, debug.Stack())
+			metrics.EventDeliveries.WithLabelValues(sub.name, "panic").Inc()
+		}
+	}()
+	sub.handler(j, s)
+	metrics.EventDeliveries.WithLabelValues(sub.name, "delivered").Inc()
+}
+
+// CountTransitions is a Handler that counts transitions by state.
+func CountTransitions(j tracker.Job, s tracker.Status) {
+	metrics.JobTransitions.WithLabelValues(j.Experiment, j.Datatype, string(s.State())).Inc()
+}
+
+// Completions is a subscriber that records the newest date completed, and
+// the time of the last completion, for each datatype.
+type Completions struct {
+	lock   sync.Mutex
+	newest map[string]time.Time // Newest date completed, by experiment/datatype.
+}
+
+// NewCompletions creates a Completions with no dates recorded.
+func NewCompletions() *Completions {
+	return &Completions{newest: map[string]time.Time{}}
+}
+
+// Observe is a Handler that records Complete transitions.  Completions of
+// older dates, e.g. reprocessing, only update the completion time.
+func (c *Completions) Observe(j tracker.Job, s tracker.Status) {
+	if s.State() != tracker.Complete {
+		return
+	}
+	metrics.LastCompleteTimestamp.WithLabelValues(j.Experiment, j.Datatype).Set(float64(s.StateChangeTime().Unix()))
+	key := j.Experiment + "/" + j.Datatype
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !j.Date.After(c.newest[key]) {
+		return
+	}
+	c.newest[key] = j.Date
+	metrics.LastCompleteDate.WithLabelValues(j.Experiment, j.Datatype).Set(float64(j.Date.Unix()))
+}
+
+// Newest returns the newest date completed for the experiment and datatype,
+// or the zero time if none has completed.
+func (c *Completions) Newest(experiment, datatype string) time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.newest[experiment+"/"+datatype]
+}
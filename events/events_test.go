@@ -0,0 +1,80 @@
+package events_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/events"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestBus(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	b := events.NewBus()
+	tk.AddObserver(b.Publish)
+
+	all := []tracker.State{}
+	failed := 0
+	b.Subscribe("all", func(j tracker.Job, s tracker.Status) {
+		all = append(all, s.State())
+	})
+	b.Subscribe("panics", func(j tracker.Job, s tracker.Status) {
+		panic("subscriber bug")
+	})
+	b.Subscribe("failed", func(j tracker.Job, s tracker.Status) {
+		failed++
+	}, tracker.Failed)
+	b.Subscribe("metrics", events.CountTransitions)
+
+	want := []string{"all", "failed", "metrics", "panics"}
+	if got := b.Subscribers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Subscribers() = %v, want %v", got, want)
+	}
+
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(job), "add job")
+	rtx.Must(tk.SetStatus(job, tracker.Parsing, ""), "parsing")
+	rtx.Must(tk.SetStatus(job, tracker.Failed, "bad archive"), "failed")
+
+	// The panicking subscriber must not stop delivery to the later ones.
+	wantStates := []tracker.State{tracker.Parsing, tracker.Failed}
+	if !reflect.DeepEqual(all, wantStates) {
+		t.Errorf("all got %v, want %v", all, wantStates)
+	}
+	if failed != 1 {
+		t.Error("Expected 1 Failed delivery, got", failed)
+	}
+}
+
+func TestCompletions(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	b := events.NewBus()
+	tk.AddObserver(b.Publish)
+	c := events.NewCompletions()
+	b.Subscribe("completions", c.Observe, tracker.Complete)
+
+	complete := func(d time.Time) {
+		job := tracker.NewJob("bucket", "ndt", "ndt7", d)
+		rtx.Must(tk.AddJob(job), "add job")
+		rtx.Must(tk.SetStatus(job, tracker.Complete, ""), "complete")
+	}
+	if !c.Newest("ndt", "ndt7").IsZero() {
+		t.Error("Expected no completions")
+	}
+	newer := time.Date(2020, 6, 2, 0, 0, 0, 0, time.UTC)
+	complete(newer)
+	// Reprocessing an older date doesn't move the newest date back.
+	complete(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	if got := c.Newest("ndt", "ndt7"); !got.Equal(newer) {
+		t.Error("Wrong newest date", got)
+	}
+	if !c.Newest("ndt", "tcpinfo").IsZero() {
+		t.Error("Expected no tcpinfo completions")
+	}
+}
@@ -0,0 +1,194 @@
+// Package health provides liveness and readiness endpoints, backed by
+// dependency checks such as BigQuery, GCS and Datastore connectivity.
+//
+// Liveness checks should only fail when restarting gardener is likely to
+// help, for example when tracker persistence has stalled.  Readiness checks
+// cover external dependencies, so that traffic is held while they are
+// unavailable, without restarting gardener.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m-lab/etl-gardener/persistence"
+)
+
+// Errors that may be returned by checks.
+var (
+	ErrNotReady = errors.New("not ready")
+	ErrStale    = errors.New("last success is too old")
+)
+
+// Check verifies a single dependency.  It should respect the ctx deadline.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of a single Check.
+type Result struct {
+	OK      bool
+	Error   string `json:",omitempty"`
+	Latency string
+}
+
+// Status is the structured response of the health endpoints.
+type Status struct {
+	OK     bool
+	Checks map[string]Result
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs liveness and readiness checks.
+type Checker struct {
+	timeout time.Duration // Timeout for each check.
+
+	lock      sync.Mutex
+	liveness  []namedCheck
+	readiness []namedCheck
+}
+
+// NewChecker creates a Checker that applies the timeout to each check.
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// AddLiveness adds a check for /healthz.  Liveness checks are also
+// included in readiness.
+func (c *Checker) AddLiveness(name string, check Check) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.liveness = append(c.liveness, namedCheck{name, check})
+}
+
+// AddReadiness adds a check for /readyz.
+func (c *Checker) AddReadiness(name string, check Check) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readiness = append(c.readiness, namedCheck{name, check})
+}
+
+// run runs the checks concurrently, each with the Checker timeout.
+func (c *Checker) run(ctx context.Context, checks []namedCheck) Status {
+	status := Status{OK: true, Checks: make(map[string]Result, len(checks))}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, nc := range checks {
+		wg.Add(1)
+		go func(nc namedCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+			start := time.Now()
+			err := nc.check(ctx)
+			r := Result{OK: err == nil, Latency: time.Since(start).Round(time.Millisecond).String()}
+			if err != nil {
+				r.Error = err.Error()
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			status.Checks[nc.name] = r
+			status.OK = status.OK && r.OK
+		}(nc)
+	}
+	wg.Wait()
+	return status
+}
+
+// Liveness runs the liveness checks.
+func (c *Checker) Liveness(ctx context.Context) Status {
+	c.lock.Lock()
+	checks := append([]namedCheck(nil), c.liveness...)
+	c.lock.Unlock()
+	return c.run(ctx, checks)
+}
+
+// Readiness runs the liveness and readiness checks.
+func (c *Checker) Readiness(ctx context.Context) Status {
+	c.lock.Lock()
+	checks := append(append([]namedCheck(nil), c.liveness...), c.readiness...)
+	c.lock.Unlock()
+	return c.run(ctx, checks)
+}
+
+func writeStatus(resp http.ResponseWriter, req *http.Request, s Status) {
+	if !s.OK {
+		failed := []string{}
+		for name, r := range s.Checks {
+			if !r.OK {
+				failed = append(failed, name+": "+r.Error)
+			}
+		}
+		sort.Strings(failed)
+		log.Println("Reporting unhealthy for", req.RequestURI, failed)
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if !s.OK {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
+	resp.Write(b)
+}
+
+// HealthzHandler serves the liveness status.
+func (c *Checker) HealthzHandler(resp http.ResponseWriter, req *http.Request) {
+	writeStatus(resp, req, c.Liveness(req.Context()))
+}
+
+// ReadyzHandler serves the readiness status.
+func (c *Checker) ReadyzHandler(resp http.ResponseWriter, req *http.Request) {
+	writeStatus(resp, req, c.Readiness(req.Context()))
+}
+
+// Flag returns a Check that fails with ErrNotReady until *ok is true.
+// The flag must only be changed before it is read concurrently.
+func Flag(ok *bool) Check {
+	return func(ctx context.Context) error {
+		if !*ok {
+			return ErrNotReady
+		}
+		return nil
+	}
+}
+
+// SaverHealth wraps a persistence.Saver, and records the outcome of
+// the most recent Save.
+type SaverHealth struct {
+	persistence.Saver
+
+	lock    sync.Mutex
+	lastErr error
+}
+
+// NewSaverHealth wraps the saver.
+func NewSaverHealth(saver persistence.Saver) *SaverHealth {
+	return &SaverHealth{Saver: saver}
+}
+
+// Save implements persistence.Saver.Save, recording the outcome.
+func (s *SaverHealth) Save(ctx context.Context, o persistence.StateObject) error {
+	err := s.Saver.Save(ctx, o)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastErr = err
+	return err
+}
+
+// Check returns the error from the most recent Save, if any.
+func (s *SaverHealth) Check(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastErr
+}
@@ -0,0 +1,80 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/health"
+	"github.com/m-lab/etl-gardener/persistence"
+)
+
+type fakeSaver struct {
+	err error
+}
+
+func (s *fakeSaver) Save(ctx context.Context, o persistence.StateObject) error   { return s.err }
+func (s *fakeSaver) Delete(ctx context.Context, o persistence.StateObject) error { return nil }
+func (s *fakeSaver) Fetch(ctx context.Context, o persistence.StateObject) error  { return nil }
+
+func get(t *testing.T, h http.HandlerFunc) (int, health.Status) {
+	server := httptest.NewServer(h)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	rtx.Must(err, "get")
+	defer resp.Body.Close()
+	var s health.Status
+	rtx.Must(json.NewDecoder(resp.Body).Decode(&s), "decode")
+	return resp.StatusCode, s
+}
+
+func TestChecker(t *testing.T) {
+	started := false
+	saver := health.NewSaverHealth(&fakeSaver{})
+	c := health.NewChecker(20 * time.Millisecond)
+	c.AddLiveness("started", health.Flag(&started))
+	c.AddReadiness("saver", saver.Check)
+	c.AddReadiness("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	code, s := get(t, c.HealthzHandler)
+	if code != http.StatusServiceUnavailable || s.OK || s.Checks["started"].Error != health.ErrNotReady.Error() {
+		t.Error("Expected not started", code, s)
+	}
+	started = true
+	code, s = get(t, c.HealthzHandler)
+	if code != http.StatusOK || !s.OK || len(s.Checks) != 1 {
+		t.Error("Expected healthy", code, s)
+	}
+
+	// The slow check should time out.
+	code, s = get(t, c.ReadyzHandler)
+	if code != http.StatusServiceUnavailable || len(s.Checks) != 3 ||
+		!s.Checks["saver"].OK || s.Checks["slow"].OK {
+		t.Error("Expected slow check failure", code, s)
+	}
+}
+
+func TestSaverHealth(t *testing.T) {
+	fs := &fakeSaver{err: errors.New("save failed")}
+	saver := health.NewSaverHealth(fs)
+	ctx := context.Background()
+	if saver.Check(ctx) != nil {
+		t.Error("Should be healthy before first save")
+	}
+	if saver.Save(ctx, nil) == nil || saver.Check(ctx) == nil {
+		t.Error("Expected save failure")
+	}
+	fs.err = nil
+	if saver.Save(ctx, nil) != nil || saver.Check(ctx) != nil {
+		t.Error("Expected recovery")
+	}
+}
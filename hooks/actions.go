@@ -0,0 +1,123 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"text/template"
+	"time"
+
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+
+	"github.com/m-lab/go/dataset"
+
+	"github.com/m-lab/etl-gardener/metrics"
+)
+
+// ErrInvalidQuery is returned by NewQuery for an empty or malformed query
+// template.
+var ErrInvalidQuery = errors.New("invalid hook query")
+
+// A Refresher refreshes the view of a datatype, e.g. bq.ViewManager.
+type Refresher interface {
+	Refresh(ctx context.Context, experiment, datatype string) (bool, error)
+}
+
+// ViewRefresh is a Hook that refreshes the views of each datatype of the
+// experiment.
+type ViewRefresh struct {
+	views     Refresher
+	datatypes []string
+}
+
+// NewViewRefresh creates a ViewRefresh for the datatypes.
+func NewViewRefresh(views Refresher, datatypes ...string) *ViewRefresh {
+	return &ViewRefresh{views: views, datatypes: datatypes}
+}
+
+// Name implements Hook.
+func (v *ViewRefresh) Name() string {
+	return "refresh_views"
+}
+
+// Run implements Hook.  All of the views are refreshed, and the first error
+// is returned.
+func (v *ViewRefresh) Run(ctx context.Context, experiment string, date time.Time) error {
+	var first error
+	for _, dt := range v.datatypes {
+		updated, err := v.views.Refresh(ctx, experiment, dt)
+		switch {
+		case err != nil:
+			metrics.ViewRefreshCount.WithLabelValues(experiment, dt, "error").Inc()
+			if first == nil {
+				first = fmt.Errorf("%s/%s: %w", experiment, dt, err)
+			}
+		case updated:
+			log.Println("Refreshed view of", experiment, dt)
+			metrics.ViewRefreshCount.WithLabelValues(experiment, dt, "updated").Inc()
+		default:
+			metrics.ViewRefreshCount.WithLabelValues(experiment, dt, "current").Inc()
+		}
+	}
+	return first
+}
+
+// QueryParams are the parameters of a Query template.
+type QueryParams struct {
+	Project    string
+	Experiment string
+	Date       time.Time
+}
+
+// Query is a Hook that runs a templated query, e.g. to rebuild a unified
+// table or run the SQL of a scheduled query, and waits for it to finish.
+type Query struct {
+	client  bqiface.Client
+	project string
+	name    string
+	tmpl    *template.Template
+}
+
+// NewQuery creates a Query hook from the sql template, which is executed
+// with QueryParams, e.g. `WHERE date = "{{.Date.Format "2006-01-02"}}"`.
+func NewQuery(client bqiface.Client, project, name, sql string) (*Query, error) {
+	if sql == "" {
+		return nil, fmt.Errorf("%w: %s: empty", ErrInvalidQuery, name)
+	}
+	tmpl, err := template.New(name).Parse(sql)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidQuery, name, err)
+	}
+	return &Query{client: client, project: project, name: name, tmpl: tmpl}, nil
+}
+
+// Name implements Hook.
+func (q *Query) Name() string {
+	return q.name
+}
+
+// SQL returns the query for the experiment and date.
+func (q *Query) SQL(experiment string, date time.Time) (string, error) {
+	out := bytes.NewBuffer(nil)
+	err := q.tmpl.Execute(out, QueryParams{Project: q.project, Experiment: experiment, Date: date})
+	return out.String(), err
+}
+
+// Run implements Hook.
+func (q *Query) Run(ctx context.Context, experiment string, date time.Time) error {
+	if q.client == nil {
+		return dataset.ErrNilBqClient
+	}
+	sql, err := q.SQL(experiment, date)
+	if err != nil {
+		return err
+	}
+	query := q.client.Query(sql)
+	if query == nil {
+		return dataset.ErrNilQuery
+	}
+	_, err = query.Read(ctx)
+	return err
+}
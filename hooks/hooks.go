@@ -0,0 +1,152 @@
+// Package hooks runs post-completion actions, such as refreshing the views
+// that downstream users query, for each date of an experiment once all of
+// its datatypes, including annotation, are complete.
+package hooks
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// A Hook is an action run for a date of an experiment, once all of the
+// experiment's datatypes are complete for the date.
+type Hook interface {
+	// Name identifies the hook in logs and metrics.
+	Name() string
+	Run(ctx context.Context, experiment string, date time.Time) error
+}
+
+// maxQueued limits the dates waiting for their hooks to run.
+const maxQueued = 1000
+
+// hookTimeout limits the time each hook may run.
+const hookTimeout = 10 * time.Minute
+
+type queued struct {
+	experiment string
+	date       time.Time
+}
+
+// Runner runs the hooks registered for an experiment when the last of its
+// datatypes completes a date, and again whenever a datatype of the date is
+// reprocessed, e.g. so that views pick up schema changes.  Completions are
+// only known since the manager started, so after a restart, each datatype
+// of a date must complete again before the hooks run.
+type Runner struct {
+	datatypes map[string][]string // By experiment.  Static after AddDatatype.
+	hooks     map[string][]Hook   // By experiment.  Static after Register.
+	queue     chan queued
+
+	lock sync.Mutex
+	// done holds the completed datatypes of each date, by experiment.
+	done map[string]map[time.Time]map[string]bool
+}
+
+// New creates a Runner with no hooks.
+func New() *Runner {
+	return &Runner{
+		datatypes: map[string][]string{},
+		hooks:     map[string][]Hook{},
+		queue:     make(chan queued, maxQueued),
+		done:      map[string]map[time.Time]map[string]bool{},
+	}
+}
+
+// AddDatatype adds a datatype of an experiment.  Duplicates are ignored.
+// Should be called for all sources, including annotation, before Observe.
+func (r *Runner) AddDatatype(experiment, datatype string) {
+	for _, dt := range r.datatypes[experiment] {
+		if dt == datatype {
+			return
+		}
+	}
+	r.datatypes[experiment] = append(r.datatypes[experiment], datatype)
+}
+
+// Datatypes returns the datatypes of an experiment.
+func (r *Runner) Datatypes(experiment string) []string {
+	return append([]string(nil), r.datatypes[experiment]...)
+}
+
+// Register adds a hook for an experiment.  Hooks run in the order they are
+// registered.  Should be called before Observe.
+func (r *Runner) Register(experiment string, h Hook) {
+	r.hooks[experiment] = append(r.hooks[experiment], h)
+}
+
+// Observe is a tracker.Observer that queues the hooks of a date when the
+// job completing it is the last of the experiment's datatypes to complete.
+// Partial jobs are ignored.  Dates are dropped if the queue is full.
+func (r *Runner) Observe(j tracker.Job, s tracker.Status) {
+	if s.State() != tracker.Complete || j.Prefix != "" || len(r.hooks[j.Experiment]) == 0 {
+		return
+	}
+	if !r.complete(j) {
+		return
+	}
+	select {
+	case r.queue <- queued{experiment: j.Experiment, date: j.Date}:
+	default:
+		metrics.HookRuns.WithLabelValues(j.Experiment, "", "dropped").Inc()
+	}
+}
+
+// complete records the job's datatype as complete for its date, and
+// returns true if all of the experiment's datatypes are complete.
+func (r *Runner) complete(j tracker.Job) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	dates := r.done[j.Experiment]
+	if dates == nil {
+		dates = map[time.Time]map[string]bool{}
+		r.done[j.Experiment] = dates
+	}
+	if dates[j.Date] == nil {
+		dates[j.Date] = map[string]bool{}
+	}
+	dates[j.Date][j.Datatype] = true
+	for _, dt := range r.datatypes[j.Experiment] {
+		if !dates[j.Date][dt] {
+			return false
+		}
+	}
+	return true
+}
+
+// RunHooks runs the hooks of the experiment for the date, in order.  A
+// failed hook is logged and doesn't prevent the later hooks from running.
+// Returns the number of failed hooks.
+func (r *Runner) RunHooks(ctx context.Context, experiment string, date time.Time) int {
+	failed := 0
+	for _, h := range r.hooks[experiment] {
+		hctx, cancel := context.WithTimeout(ctx, hookTimeout)
+		err := h.Run(hctx, experiment, date)
+		cancel()
+		if err != nil {
+			log.Println("Hook", h.Name(), "failed for", experiment, date.Format("2006-01-02"), err)
+			metrics.HookRuns.WithLabelValues(experiment, h.Name(), "error").Inc()
+			failed++
+			continue
+		}
+		metrics.HookRuns.WithLabelValues(experiment, h.Name(), "success").Inc()
+	}
+	return failed
+}
+
+// Run runs the hooks of queued dates until ctx is done.  Failed hooks are
+// not retried until a datatype of the date completes again.
+func (r *Runner) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case q := <-r.queue:
+			r.RunHooks(ctx, q.experiment, q.date)
+		}
+	}
+}
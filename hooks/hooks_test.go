@@ -0,0 +1,127 @@
+package hooks_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/hooks"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+type fakeHook struct {
+	name string
+	err  error
+	ran  chan time.Time
+}
+
+func (h *fakeHook) Name() string { return h.name }
+
+func (h *fakeHook) Run(ctx context.Context, experiment string, date time.Time) error {
+	h.ran <- date
+	return h.err
+}
+
+type fakeRefresher struct {
+	refreshed []string
+}
+
+func (f *fakeRefresher) Refresh(ctx context.Context, experiment, datatype string) (bool, error) {
+	f.refreshed = append(f.refreshed, experiment+"/"+datatype)
+	if datatype == "bad" {
+		return false, errors.New("refresh failed")
+	}
+	return datatype != "annotation", nil
+}
+
+func TestRunner(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "InitTracker")
+
+	r := hooks.New()
+	for _, dt := range []string{"ndt7", "annotation", "ndt7"} {
+		r.AddDatatype("ndt", dt)
+	}
+	r.AddDatatype("other", "tcpinfo")
+	failing := &fakeHook{name: "failing", err: errors.New("oops"), ran: make(chan time.Time, 10)}
+	hook := &fakeHook{name: "fake", ran: make(chan time.Time, 10)}
+	r.Register("ndt", failing)
+	r.Register("ndt", hook)
+	tk.AddObserver(r.Observe)
+	go r.Run(ctx)
+
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	complete := func(exp, dt string, prefix string) {
+		j := tracker.NewJob("bucket", exp, dt, date)
+		j.Prefix = prefix
+		rtx.Must(tk.AddJob(j), "AddJob")
+		rtx.Must(tk.SetStatus(j, tracker.Complete, ""), "SetStatus")
+	}
+	// Partial jobs, other experiments, and incomplete dates don't run the
+	// hooks.
+	complete("ndt", "annotation", "20200601T12")
+	complete("other", "tcpinfo", "")
+	complete("ndt", "ndt7", "")
+	select {
+	case d := <-hook.ran:
+		t.Fatal("Hook ran before annotation was complete", d)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The last datatype runs all of the hooks, even if one fails.
+	complete("ndt", "annotation", "")
+	for _, h := range []*fakeHook{failing, hook} {
+		select {
+		case d := <-h.ran:
+			if !d.Equal(date) {
+				t.Error("Wrong date", d)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Hook did not run", h.name)
+		}
+	}
+	// Reprocessing a datatype runs them again.
+	complete("ndt", "ndt7", "")
+	select {
+	case <-hook.ran:
+	case <-time.After(time.Second):
+		t.Error("Hook did not run after reprocessing")
+	}
+}
+
+func TestViewRefresh(t *testing.T) {
+	f := &fakeRefresher{}
+	v := hooks.NewViewRefresh(f, "ndt7", "bad", "annotation")
+	err := v.Run(context.Background(), "ndt", time.Now())
+	if err == nil {
+		t.Error("Expected error")
+	}
+	if len(f.refreshed) != 3 {
+		t.Error("All views should be refreshed", f.refreshed)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	if _, err := hooks.NewQuery(nil, "proj", "empty", ""); !errors.Is(err, hooks.ErrInvalidQuery) {
+		t.Error("Expected ErrInvalidQuery", err)
+	}
+	if _, err := hooks.NewQuery(nil, "proj", "bad", "{{.Date"); !errors.Is(err, hooks.ErrInvalidQuery) {
+		t.Error("Expected ErrInvalidQuery", err)
+	}
+	q, err := hooks.NewQuery(nil, "proj", "unified",
+		"SELECT * FROM `{{.Project}}.{{.Experiment}}.t` WHERE date = \"{{.Date.Format \"2006-01-02\"}}\"")
+	rtx.Must(err, "NewQuery")
+	sql, err := q.SQL("ndt", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(err, "SQL")
+	if sql != "SELECT * FROM `proj.ndt.t` WHERE date = \"2020-06-01\"" {
+		t.Error("Wrong SQL", sql)
+	}
+	if q.Run(context.Background(), "ndt", time.Now()) == nil {
+		t.Error("Expected error with nil client")
+	}
+}
@@ -4,13 +4,21 @@ package job
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
+	"github.com/m-lab/etl-gardener/backfill"
+	"github.com/m-lab/etl-gardener/civil"
+	"github.com/m-lab/etl-gardener/cloud/gcs"
 	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/metrics"
 	"github.com/m-lab/etl-gardener/persistence"
 	"github.com/m-lab/etl-gardener/tracker"
 )
@@ -21,68 +29,103 @@ var ErrMoreJSON = errors.New("JSON body not completely consumed")
 // ErrNilParameter is returned on disallowed nil parameter.
 var ErrNilParameter = errors.New("nil parameter not allowed")
 
-type jobAdder interface {
+// ErrUnknownSource is returned when a job does not match any configured source.
+var ErrUnknownSource = errors.New("job does not match a configured source")
+
+// ErrInvalidShards is returned by SetShards for sharded incremental sources.
+var ErrInvalidShards = errors.New("invalid shards")
+
+// Adder adds jobs, e.g. to a tracker.Tracker.
+type Adder interface {
 	AddJob(job tracker.Job) error
 	LastJob() tracker.Job // temporary
 }
 
+// DefaultDailyDelay is the time after midnight UTC at which yesterday's jobs
+// are dispatched, for sources that don't configure a daily delay.
+const DefaultDailyDelay = 10*time.Hour + 30*time.Minute
+
+// Sharder adds jobs that are parsed as shards, e.g. a tracker.Tracker.
+type Sharder interface {
+	AddSharded(job tracker.Job, prefixes []string) error
+}
+
+// Failer marks jobs as failed, e.g. a tracker.Tracker.
+type Failer interface {
+	SetJobError(job tracker.Job, errString string) error
+}
+
+// ArchiveCheck checks a job's archive before it is dispatched, e.g. with
+// gcs.Validate.  It returns an error wrapping gcs.ErrBadArchive if the
+// archive should not be parsed.
+type ArchiveCheck func(ctx context.Context, job tracker.Job) error
+
 // YesterdaySource provides pending jobs for yesterday's data.
-// When the scheduled delay has passed, it cycles through all the
-// job specs, then advances to the next date.
+// When the scheduled delay for each job spec has passed, it dispatches that
+// spec, and when all specs have been dispatched, advances to the next date.
 type YesterdaySource struct {
 	saver persistence.Saver
 
-	jobSpecs  []tracker.JobWithTarget // The job prefixes to be iterated through.
-	Date      time.Time               // The next "yesterday" date to be processed.
-	delay     time.Duration           // time after UTC to process yesterday.
-	nextIndex int
+	jobSpecs   []tracker.JobWithTarget // The job prefixes to be iterated through.
+	delays     []time.Duration         // Time after UTC midnight to process yesterday, per spec.
+	Date       time.Time               // The next "yesterday" date to be processed.
+	dispatched []bool                  // Specs already dispatched for Date.
 }
 
 // nextJob returns a yesterday Job if appropriate
 // Not thread-safe.
 func (y *YesterdaySource) nextJob(ctx context.Context) *tracker.JobWithTarget {
-	// Defer until "delay" after midnight next day.
-	if time.Since(y.Date) < 24*time.Hour+y.delay {
+	// Find the first spec not yet dispatched whose delay after midnight next
+	// day has passed.
+	since := time.Since(y.Date)
+	i := 0
+	for ; i < len(y.jobSpecs); i++ {
+		if !y.dispatched[i] && since >= 24*time.Hour+y.delays[i] {
+			break
+		}
+	}
+	if i == len(y.jobSpecs) {
 		return nil
 	}
 
 	// Copy the jobspec and set the date.
-	job := y.jobSpecs[y.nextIndex]
+	job := y.jobSpecs[i]
 	job.Date = y.Date
+	y.dispatched[i] = true
 
-	// Advance to the next jobSpec for next call.
-	y.nextIndex++
-	// When we have dispatched all jobs, advance yesterdayDate to next day
-	// and reset the index.
-	if y.nextIndex >= len(y.jobSpecs) {
-		y.nextIndex = 0
-		y.Date = y.Date.AddDate(0, 0, 1).UTC().Truncate(24 * time.Hour)
-
-		ctx, cf := context.WithTimeout(ctx, 5*time.Second)
-		defer cf()
-		log.Println("Saving", y.GetName(), y.GetKind(), y.Date.Format("2006-01-02"))
-		err := y.saver.Save(ctx, y)
-		if err != nil {
-			log.Println(err)
+	// When we have dispatched all jobs, advance yesterdayDate to next day.
+	for _, d := range y.dispatched {
+		if !d {
+			return &job
 		}
 	}
+	y.dispatched = make([]bool, len(y.jobSpecs))
+	y.Date = civil.AddDays(y.Date, 1)
+
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	log.Println("Saving", y.GetName(), y.GetKind(), civil.Format(y.Date))
+	err := y.saver.Save(ctx, y)
+	if err != nil {
+		log.Println(err)
+	}
 
 	return &job
 }
 
-func initYesterday(ctx context.Context, saver persistence.Saver, delay time.Duration, specs []tracker.JobWithTarget) (*YesterdaySource, error) {
+func initYesterday(ctx context.Context, saver persistence.Saver, delays []time.Duration, specs []tracker.JobWithTarget) (*YesterdaySource, error) {
 	if saver == nil {
 		return nil, ErrNilParameter
 	}
 	// This is the fallback start date.
-	date := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	date := civil.AddDays(time.Now(), -1)
 
 	src := YesterdaySource{
-		saver:     saver,
-		jobSpecs:  specs,
-		Date:      date,
-		delay:     delay,
-		nextIndex: 0,
+		saver:      saver,
+		jobSpecs:   specs,
+		delays:     delays,
+		Date:       date,
+		dispatched: make([]bool, len(specs)),
 	}
 
 	// Recover the date from datastore.
@@ -92,6 +135,8 @@ func initYesterday(ctx context.Context, saver persistence.Saver, delay time.Dura
 	if err != nil {
 		log.Println(err)
 	}
+	// Datastore returns times in the local zone.
+	src.Date = civil.Date(src.Date)
 
 	log.Println("Yesterday starting at", src.Date)
 	return &src, nil
@@ -107,6 +152,47 @@ func (y YesterdaySource) GetKind() string {
 	return reflect.TypeOf(y).String()
 }
 
+// TodaySource provides periodic jobs for the current date, for sources
+// configured for incremental processing.  Each time the interval elapses,
+// it cycles through all the incremental job specs.
+type TodaySource struct {
+	jobSpecs  []tracker.JobWithTarget // The incremental job prefixes.
+	interval  time.Duration           // Time between dispatches of each spec.
+	next      time.Time               // Time of the next round of dispatches.
+	nextIndex int
+}
+
+// nextJob returns a job for the current date if appropriate.
+// Not thread-safe.
+func (td *TodaySource) nextJob(now time.Time) *tracker.JobWithTarget {
+	if len(td.jobSpecs) == 0 || td.interval <= 0 || now.Before(td.next) {
+		return nil
+	}
+
+	// Copy the jobspec and set the date.
+	job := td.jobSpecs[td.nextIndex]
+	job.Date = civil.Date(now)
+
+	td.nextIndex++
+	if td.nextIndex >= len(td.jobSpecs) {
+		td.nextIndex = 0
+		td.next = now.Add(td.interval)
+	}
+	return &job
+}
+
+// ErrInvalidMode is returned for an unknown dispatch mode, or negative quotas.
+var ErrInvalidMode = errors.New("invalid dispatch mode")
+
+// InFlightFunc returns the number of jobs in flight in each lane.
+type InFlightFunc func(now time.Time) map[tracker.Lane]int
+
+// Throttle pauses dispatch while engaged, e.g. while the tmp datasets are
+// too large.
+type Throttle interface {
+	Throttled() bool
+}
+
 // Service contains all information needed to provide a job service.
 // It iterates through successive dates, processing that date from
 // all TypeSources in the source bucket.
@@ -118,7 +204,7 @@ type Service struct {
 	startDate time.Time // The date to restart at.
 
 	// Optional jobAdder to add jobs to.
-	jobAdder jobAdder
+	jobAdder Adder
 
 	// All fields above are const after initialization.
 	// All fields below are protected by *lock*
@@ -130,11 +216,250 @@ type Service struct {
 	Date      time.Time // The date currently being dispatched.
 	nextIndex int       // index of TypeSource to dispatch next.
 
+	// Skip lists jobs that should not be dispatched.  It is also persisted.
+	Skip []tracker.Job
+	// Requeued lists jobs to be parsed again, ahead of all other jobs.  It
+	// is also persisted.
+	Requeued []tracker.Job
+	// Backfill lists the planned backfill jobs, in dispatch order.  It is
+	// also persisted.
+	Backfill []backfill.Item
+	// PendingShards lists the shards of sharded jobs that have not been
+	// dispatched yet.  It is also persisted.
+	PendingShards []tracker.Job
+
+	// Optional check of each job's archive before dispatch.
+	archiveCheck ArchiveCheck
+	failer       Failer
+
+	// Optional throttle on dispatch.
+	throttle Throttle
+
+	// Optional sharding of whole day jobs, by experiment/datatype.
+	shards  map[string][]*template.Template
+	sharder Sharder
+
+	// Optional backfill planning.
+	backfillPolicy backfill.Policy
+	sizer          backfill.Sizer
+
+	// Lanes that are dispatched, with their quotas.  All lanes are enabled
+	// with no quota by default.
+	lanes    map[tracker.Lane]bool
+	quotas   map[tracker.Lane]int
+	inFlight InFlightFunc
+
 	yesterday *YesterdaySource // Provides jobs for high priority yesterday
+	today     *TodaySource     // Provides incremental jobs for the current date
+
+	// Sources of jobs, in priority order.  Static after SetSourceOrder.
+	sources []JobSource
+
+	stopped int32 // Accessed atomically.  Non-zero when no jobs should be dispatched.
+}
+
+// SetArchiveCheck sets a check applied to each job's archive before it is
+// dispatched.  Jobs with bad archives are added, then marked failed with the
+// failer, instead of being dispatched.  It should be called before serving.
+func (svc *Service) SetArchiveCheck(check ArchiveCheck, failer Failer) {
+	svc.archiveCheck = check
+	svc.failer = failer
+}
+
+// SetThrottle pauses dispatch while the throttle is engaged.  JobHandler
+// then responds with 503, so that parsers try again later.  It should be
+// called before serving.
+func (svc *Service) SetThrottle(t Throttle) {
+	svc.throttle = t
+}
+
+// SetShards splits the whole day jobs of sources with Shards into prefix
+// jobs, which are dispatched ahead of other jobs, except requeued jobs.  The
+// whole day job is added to the sharder, which tracks the shards as its
+// children.  Shards are templates executed with the job, e.g.
+// `{{.Date.Format "20060102"}}T0` for the first ten hours.  Incremental
+// sources may not be sharded.  It should be called before serving.
+func (svc *Service) SetShards(sources []config.SourceConfig, sharder Sharder) error {
+	shards := map[string][]*template.Template{}
+	for _, s := range sources {
+		if len(s.Shards) == 0 {
+			continue
+		}
+		if s.Incremental {
+			return fmt.Errorf("%w: %s/%s is incremental", ErrInvalidShards, s.Experiment, s.Datatype)
+		}
+		key := s.Experiment + "/" + s.Datatype
+		for _, shard := range s.Shards {
+			t, err := template.New(key).Parse(shard)
+			if err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrInvalidShards, key, err)
+			}
+			shards[key] = append(shards[key], t)
+		}
+	}
+	svc.shards = shards
+	svc.sharder = sharder
+	return nil
+}
+
+// shard adds the sharded job to the sharder, and queues its shards for
+// dispatch, if the job's source is sharded.  It returns the first shard,
+// or the job itself if it isn't sharded.
+func (svc *Service) shard(ctx context.Context, job tracker.JobWithTarget) (tracker.JobWithTarget, error) {
+	templates := svc.shards[job.Experiment+"/"+job.Datatype]
+	if job.Prefix != "" || len(templates) == 0 {
+		return job, nil
+	}
+	prefixes := make([]string, 0, len(templates))
+	for _, t := range templates {
+		var b strings.Builder
+		if err := t.Execute(&b, job.Job); err != nil {
+			return job, err
+		}
+		prefixes = append(prefixes, b.String())
+	}
+	if err := svc.sharder.AddSharded(job.Job, prefixes); err != nil {
+		return job, err
+	}
+	log.Println("Sharding", job.Job, "into", len(prefixes), "shards")
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	for _, p := range prefixes[1:] {
+		shard := job.Job
+		shard.Prefix = p
+		svc.PendingShards = append(svc.PendingShards, shard)
+	}
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	if err := svc.saver.Save(ctx, svc); err != nil {
+		log.Println(err)
+	}
+	job.Prefix = prefixes[0]
+	return job, nil
+}
+
+// SetBackfill enables planned backfills, which are sized with the sizer and
+// ordered by the policy.  It should be called before serving.
+func (svc *Service) SetBackfill(p backfill.Policy, sizer backfill.Sizer) {
+	svc.backfillPolicy = p
+	svc.sizer = sizer
+}
+
+// PlanBackfill sizes the jobs, and adds them to the backfill plan in the
+// policy's order, after any jobs already planned.  The jobs must match the
+// configured sources.  It returns the newly planned items.
+func (svc *Service) PlanBackfill(ctx context.Context, jobs []tracker.Job) ([]backfill.Item, error) {
+	if svc.sizer == nil {
+		return nil, ErrNilParameter
+	}
+	for _, j := range jobs {
+		if _, ok := svc.spec(j); !ok {
+			return nil, fmt.Errorf("%w: %v", ErrUnknownSource, j)
+		}
+	}
+	// The archives are sized before locking, since listing may be slow.
+	items, err := svc.backfillPolicy.Plan(ctx, svc.sizer, jobs)
+	if err != nil {
+		return nil, err
+	}
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	svc.Backfill = append(svc.Backfill, items...)
+
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	if err := svc.saver.Save(ctx, svc); err != nil {
+		// The plan is still updated, and saved with the next change.
+		log.Println(err)
+	}
+	return items, nil
+}
+
+// BackfillPlan returns a copy of the planned backfill jobs, in dispatch
+// order.
+func (svc *Service) BackfillPlan() []backfill.Item {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	plan := make([]backfill.Item, len(svc.Backfill))
+	copy(plan, svc.Backfill)
+	return plan
+}
+
+// SetDispatch selects the lanes that are dispatched, by mode, and limits the
+// jobs in flight in each lane, as reported by inFlight.  Requeued jobs are
+// always dispatched.  It should be called before serving.
+func (svc *Service) SetDispatch(cfg config.DispatchConfig, inFlight InFlightFunc) error {
+	lanes := map[tracker.Lane]bool{}
+	switch cfg.Mode {
+	case "", "both":
+		lanes[tracker.Daily], lanes[tracker.Reprocess] = true, true
+	case "daily":
+		lanes[tracker.Daily] = true
+	case "reprocess":
+		lanes[tracker.Reprocess] = true
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidMode, cfg.Mode)
+	}
+	if cfg.DailyQuota < 0 || cfg.ReprocessQuota < 0 {
+		return fmt.Errorf("%w: negative quota", ErrInvalidMode)
+	}
+	if (cfg.DailyQuota > 0 || cfg.ReprocessQuota > 0) && inFlight == nil {
+		return ErrNilParameter
+	}
+	svc.lanes = lanes
+	svc.quotas = map[tracker.Lane]int{
+		tracker.Daily: cfg.DailyQuota, tracker.Reprocess: cfg.ReprocessQuota}
+	svc.inFlight = inFlight
+	return nil
+}
+
+// openLanes returns the lanes that are enabled and below their quota.
+func (svc *Service) openLanes(now time.Time) map[tracker.Lane]bool {
+	if svc.lanes == nil {
+		return map[tracker.Lane]bool{tracker.Daily: true, tracker.Reprocess: true}
+	}
+	var counts map[tracker.Lane]int
+	if svc.inFlight != nil {
+		counts = svc.inFlight(now)
+	}
+	open := map[tracker.Lane]bool{}
+	for lane, enabled := range svc.lanes {
+		quota := svc.quotas[lane]
+		open[lane] = enabled && (quota == 0 || counts[lane] < quota)
+	}
+	return open
+}
+
+// checkArchive applies the archive check, if any, returning an error if the
+// job should not be dispatched.  Other check errors, e.g. GCS outages, are
+// logged, and the job is dispatched anyway.
+func (svc *Service) checkArchive(ctx context.Context, job tracker.Job) error {
+	if svc.archiveCheck == nil {
+		return nil
+	}
+	err := svc.archiveCheck(ctx, job)
+	switch {
+	case err == nil:
+		metrics.ArchiveChecks.WithLabelValues(job.Experiment, job.Datatype, "ok").Inc()
+		return nil
+	case errors.Is(err, gcs.ErrBadArchive):
+		metrics.ArchiveChecks.WithLabelValues(job.Experiment, job.Datatype, "bad").Inc()
+		return err
+	default:
+		log.Println("Archive check error:", job, err)
+		metrics.ArchiveChecks.WithLabelValues(job.Experiment, job.Datatype, "error").Inc()
+		return nil
+	}
+}
+
+// Stop stops dispatching jobs, e.g. on shutdown.  JobHandler then responds
+// with 503, so that parsers try again later.
+func (svc *Service) Stop() {
+	atomic.StoreInt32(&svc.stopped, 1)
 }
 
 func (svc *Service) advanceDate() {
-	date := svc.Date.UTC().AddDate(0, 0, 1).Truncate(24 * time.Hour)
+	date := civil.AddDays(svc.Date, 1)
 	// Start over when we reach yesterday.
 	if time.Since(date) < 36*time.Hour {
 		date = svc.startDate
@@ -143,57 +468,267 @@ func (svc *Service) advanceDate() {
 	svc.nextIndex = 0
 }
 
-// NextJob returns a tracker.Job to dispatch.
+// Backlog returns the number of dates not yet dispatched in the current
+// pass, and of planned backfill jobs, keyed by experiment/datatype.  Dates
+// are dispatched up to 36 hours before now, when the pass restarts from the
+// start date.
+func (svc *Service) Backlog(now time.Time) map[string]int {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	last := civil.Date(now.Add(-36 * time.Hour))
+	days := 0
+	if !svc.Date.After(last) {
+		days = civil.Days(svc.Date, last) + 1
+	}
+	if svc.lanes != nil && !svc.lanes[tracker.Reprocess] {
+		// Historical dates are never dispatched.
+		days = 0
+	}
+	backlog := make(map[string]int, len(svc.jobSpecs))
+	for i, spec := range svc.jobSpecs {
+		n := days
+		if i < svc.nextIndex && n > 0 {
+			// Already dispatched for the current date.
+			n--
+		}
+		backlog[spec.Job.Experiment+"/"+spec.Job.Datatype] += n
+	}
+	if svc.lanes == nil || svc.lanes[tracker.Reprocess] {
+		for _, item := range svc.Backfill {
+			backlog[item.Job.Experiment+"/"+item.Job.Datatype]++
+		}
+	}
+	return backlog
+}
+
+// maxSkips limits the number of skipped jobs examined in a single NextJob call.
+const maxSkips = 1000
+
+// NextJob returns a tracker.Job to dispatch.  Jobs in the skip list are
+// never returned.  If no lane is open, i.e. every enabled lane is at its
+// quota, or every candidate examined is skipped, it returns the zero
+// JobWithTarget.
 func (svc *Service) NextJob(ctx context.Context) tracker.JobWithTarget {
+	// The tracker is queried before locking, to avoid holding both locks.
+	open := svc.openLanes(time.Now())
+
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+
+	job := svc.nextJob(ctx, open)
+	for i := 0; i < maxSkips && svc.isSkipped(job.Job); i++ {
+		log.Println("Skipping", job.Job)
+		job = svc.nextJob(ctx, open)
+	}
+	if svc.isSkipped(job.Job) {
+		return tracker.JobWithTarget{}
+	}
+	return job
+}
+
+// isSkipped returns true if the job is in the skip list.
+// Caller must hold the lock.
+func (svc *Service) isSkipped(job tracker.Job) bool {
+	for _, j := range svc.Skip {
+		if j == job {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSkip adds the job to, or removes it from, the skip list, and saves the
+// updated list.
+func (svc *Service) SetSkip(ctx context.Context, job tracker.Job, skip bool) error {
 	svc.lock.Lock()
 	defer svc.lock.Unlock()
+	list := make([]tracker.Job, 0, len(svc.Skip)+1)
+	for _, j := range svc.Skip {
+		if j != job {
+			list = append(list, j)
+		}
+	}
+	if skip {
+		list = append(list, job)
+	}
+	svc.Skip = list
+
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	return svc.saver.Save(ctx, svc)
+}
+
+// SkipList returns a copy of the skip list.
+func (svc *Service) SkipList() []tracker.Job {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	list := make([]tracker.Job, len(svc.Skip))
+	copy(list, svc.Skip)
+	return list
+}
 
-	// Check whether there is yesterday work to do.
-	if j := svc.yesterday.nextJob(ctx); j != nil {
-		log.Println("Yesterday job:", j.Job)
-		return *j
+// Requeue adds a job to be dispatched again, before any other jobs, e.g.
+// for a clean reparse, and saves the updated list.  The job must match one
+// of the configured sources.
+func (svc *Service) Requeue(ctx context.Context, job tracker.Job) error {
+	if _, ok := svc.spec(job); !ok {
+		return ErrUnknownSource
 	}
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	for _, j := range svc.Requeued {
+		if j == job {
+			return nil
+		}
+	}
+	svc.Requeued = append(svc.Requeued, job)
 
-	job := svc.jobSpecs[svc.nextIndex]
-	job.Date = svc.Date
-	svc.nextIndex++
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	return svc.saver.Save(ctx, svc)
+}
 
-	if svc.nextIndex >= len(svc.jobSpecs) {
-		svc.advanceDate()
-		// Note that this will block other calls to NextJob
-		ctx, cf := context.WithTimeout(ctx, 5*time.Second)
-		defer cf()
-		log.Println("Saving", svc.GetName(), svc.GetKind(), svc.Date.Format("2006-01-02"))
-		err := svc.saver.Save(ctx, svc)
+// StaleReleaser releases jobs whose parsers stopped sending heartbeats, e.g.
+// a tracker.Tracker.
+type StaleReleaser interface {
+	ReleaseStale(timeout time.Duration, now time.Time) []tracker.Job
+}
+
+// RequeueStale releases the parser jobs that have not been heard from for
+// longer than timeout at now, and requeues them, so that they are dispatched
+// again before other jobs.  It returns the requeued jobs.
+func (svc *Service) RequeueStale(ctx context.Context, r StaleReleaser, timeout time.Duration, now time.Time) []tracker.Job {
+	var requeued []tracker.Job
+	for _, j := range r.ReleaseStale(timeout, now) {
+		err := svc.Requeue(ctx, j)
+		if errors.Is(err, ErrUnknownSource) {
+			log.Println("Not requeueing stale job", j, err)
+			continue
+		}
 		if err != nil {
+			// The job is queued, but the list wasn't saved.
 			log.Println(err)
 		}
+		requeued = append(requeued, j)
 	}
-	return job
+	return requeued
+}
+
+// spec returns the job spec with the job's bucket, experiment and datatype,
+// preferring one with the job's filter, with the job's date and prefix.
+func (svc *Service) spec(job tracker.Job) (tracker.JobWithTarget, bool) {
+	found := -1
+	for i, s := range svc.jobSpecs {
+		if s.Job.Bucket == job.Bucket && s.Job.Experiment == job.Experiment &&
+			s.Job.Datatype == job.Datatype {
+			if s.Job.Filter == job.Filter {
+				found = i
+				break
+			}
+			if found < 0 {
+				found = i
+			}
+		}
+	}
+	if found < 0 {
+		return tracker.JobWithTarget{}, false
+	}
+	s := svc.jobSpecs[found]
+	s.Job = job
+	return s, true
+}
+
+// Accepts returns ErrUnknownSource if the job doesn't match any of the
+// configured sources, e.g. for requests from a JobSource.
+func (svc *Service) Accepts(job tracker.Job) error {
+	if _, ok := svc.spec(job); !ok {
+		return fmt.Errorf("%w: %v", ErrUnknownSource, job)
+	}
+	return nil
+}
+
+// nextBackfill removes and returns the first planned backfill job that may
+// be dispatched at now.  Large jobs wait for the idle window, while the
+// historical sources are dispatched instead.
+// Caller must hold the lock.
+func (svc *Service) nextBackfill(ctx context.Context, now time.Time) (tracker.Job, bool) {
+	i := svc.backfillPolicy.Next(svc.Backfill, now)
+	if i < 0 {
+		return tracker.Job{}, false
+	}
+	item := svc.Backfill[i]
+	svc.Backfill = append(svc.Backfill[:i:i], svc.Backfill[i+1:]...)
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	if err := svc.saver.Save(ctx, svc); err != nil {
+		log.Println(err)
+	}
+	return item.Job, true
+}
+
+// dispatch returns the next job, and adds it to the tracker.  If there is
+// no job to dispatch, it returns the status code and a message for the
+// parser.
+func (svc *Service) dispatch(ctx context.Context) (tracker.JobWithTarget, int, string) {
+	if atomic.LoadInt32(&svc.stopped) != 0 {
+		return tracker.JobWithTarget{}, http.StatusServiceUnavailable, ""
+	}
+	if svc.throttle != nil && svc.throttle.Throttled() {
+		return tracker.JobWithTarget{}, http.StatusServiceUnavailable, "Dispatch paused.  Try again later."
+	}
+	job := svc.NextJob(ctx)
+	if job.Job == (tracker.Job{}) {
+		metrics.LaneQuotaFull.Inc()
+		return job, http.StatusServiceUnavailable, "Lane quotas reached.  Try again later."
+	}
+	job, err := svc.shard(ctx, job)
+	if err != nil {
+		log.Println(err, job)
+		return job, http.StatusInternalServerError, "Job already exists.  Try again."
+	}
+	err = svc.jobAdder.AddJob(job.Job)
+	if err != nil {
+		log.Println(err, job)
+		return job, http.StatusInternalServerError, "Job already exists.  Try again."
+	}
+	if err := svc.checkArchive(ctx, job.Job); err != nil {
+		log.Println(err, job)
+		if err := svc.failer.SetJobError(job.Job, err.Error()); err != nil {
+			log.Println(err)
+		}
+		return job, http.StatusInternalServerError, "Bad archive.  Try again."
+	}
+
+	log.Println("Dispatching", job.Job)
+	metrics.LaneDispatches.WithLabelValues(string(job.Lane(time.Now()))).Inc()
+	return job, http.StatusOK, ""
 }
 
-// JobHandler handle requests for new jobs.
+// JobHandler handle requests for new jobs.  v1 responses have only the
+// Job, without the target.  Requests to /v2/job, or that accept
+// tracker.MediaTypeV2, get a tracker.JobResponse.
 // TODO - should update tracker instance.
 func (svc *Service) JobHandler(resp http.ResponseWriter, req *http.Request) {
+	if tracker.WantsV2(req) {
+		svc.jobHandlerV2(resp, req)
+		return
+	}
 	// Must be a post because it changes state.
 	if req.Method != http.MethodPost {
 		resp.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	job := svc.NextJob(req.Context())
-	err := svc.jobAdder.AddJob(job.Job)
-	if err != nil {
-		log.Println(err, job)
-		resp.WriteHeader(http.StatusInternalServerError)
-		_, err = resp.Write([]byte("Job already exists.  Try again."))
-		if err != nil {
-			log.Println(err)
+	job, status, msg := svc.dispatch(req.Context())
+	if status != http.StatusOK {
+		resp.WriteHeader(status)
+		if msg != "" {
+			if _, err := resp.Write([]byte(msg)); err != nil {
+				log.Println(err)
+			}
 		}
 		return
 	}
-
-	log.Println("Dispatching", job.Job)
-	_, err = resp.Write(job.Marshal())
+	_, err := resp.Write(job.Marshal())
 	if err != nil {
 		log.Println(err)
 		// This should precede the Write(), but the Write failed, so this
@@ -203,6 +738,26 @@ func (svc *Service) JobHandler(resp http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (svc *Service) jobHandlerV2(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		tracker.WriteError(resp, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	if !tracker.Acceptable(req) {
+		resp.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	job, status, msg := svc.dispatch(req.Context())
+	if status != http.StatusOK {
+		if msg == "" {
+			msg = http.StatusText(status)
+		}
+		tracker.WriteError(resp, status, msg)
+		return
+	}
+	tracker.WriteJSON(resp, http.StatusOK, tracker.JobResponse{Version: tracker.ProtocolV2, Job: job})
+}
+
 // Recover the processing date.
 // Not thread-safe - should be called before activating service.
 func (svc *Service) recoverDate(ctx context.Context) {
@@ -218,6 +773,8 @@ func (svc *Service) recoverDate(ctx context.Context) {
 		log.Println(err, svc)
 	}
 
+	// Datastore returns times in the local zone.
+	svc.Date = civil.Date(svc.Date)
 	// Adjust if Date is too early.
 	if svc.Date.Before(svc.startDate) {
 		svc.Date = svc.startDate
@@ -229,7 +786,7 @@ var ErrInvalidStartDate = errors.New("Invalid start date")
 
 // NewJobService creates the default job service.
 // Context is used for retrieving state from datastore.
-func NewJobService(ctx context.Context, tk jobAdder, startDate time.Time,
+func NewJobService(ctx context.Context, tk Adder, startDate time.Time,
 	targetBase string, sources []config.SourceConfig,
 	saver persistence.Saver,
 ) (*Service, error) {
@@ -242,6 +799,8 @@ func NewJobService(ctx context.Context, tk jobAdder, startDate time.Time,
 
 	// The service cycles through the jobSpecs.  Each spec is a job (bucket/exp/type) and a target GCS bucket or BQ table.
 	specs := make([]tracker.JobWithTarget, 0)
+	delays := make([]time.Duration, 0)
+	todaySpecs := make([]tracker.JobWithTarget, 0)
 	for _, s := range sources {
 		log.Println(s)
 		job := tracker.Job{
@@ -258,12 +817,20 @@ func NewJobService(ctx context.Context, tk jobAdder, startDate time.Time,
 			continue
 		}
 		specs = append(specs, jt)
+		delay := s.DailyDelay
+		if delay <= 0 {
+			delay = DefaultDailyDelay
+		}
+		delays = append(delays, delay)
+		if s.Incremental {
+			todaySpecs = append(todaySpecs, jt)
+		}
 	}
 	if len(specs) < 1 {
 		log.Fatal("No jobs specified")
 	}
 
-	yesterday, err := initYesterday(ctx, saver, 10*time.Hour+30*time.Minute, specs)
+	yesterday, err := initYesterday(ctx, saver, delays, specs)
 	if err != nil {
 		return nil, err
 	}
@@ -271,11 +838,13 @@ func NewJobService(ctx context.Context, tk jobAdder, startDate time.Time,
 		jobAdder:  tk,
 		saver:     saver,
 		jobSpecs:  specs,
-		startDate: startDate,
+		startDate: civil.Date(startDate),
 		lock:      &sync.Mutex{},
 		nextIndex: 0,
 		yesterday: yesterday,
+		today:     &TodaySource{jobSpecs: todaySpecs, interval: config.IncrementalInterval()},
 	}
+	svc.sources = svc.builtinSources()
 
 	svc.recoverDate(ctx)
 
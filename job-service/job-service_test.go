@@ -5,6 +5,8 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -17,6 +19,8 @@ import (
 
 	"github.com/m-lab/go/rtx"
 
+	"github.com/m-lab/etl-gardener/backfill"
+	"github.com/m-lab/etl-gardener/cloud/gcs"
 	"github.com/m-lab/etl-gardener/config"
 	"github.com/m-lab/etl-gardener/job-service"
 	"github.com/m-lab/etl-gardener/persistence"
@@ -103,6 +107,42 @@ func TestService_NextJob(t *testing.T) {
 	}
 }
 
+func TestBacklog(t *testing.T) {
+	now := time.Date(2011, 2, 6, 1, 2, 3, 4, time.UTC)
+	monkey.Patch(time.Now, func() time.Time {
+		return now
+	})
+	defer monkey.Unpatch(time.Now)
+
+	ctx := context.Background()
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "tcpinfo", Target: "tmp_ndt.tcpinfo"},
+	}
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	svc, err := job.NewJobService(ctx, &NullTracker{}, start, "fakebucket", sources, &NullSaver{})
+	must(t, err)
+
+	// 2011-02-03 and 2011-02-04 remain for both datatypes.
+	backlog := svc.Backlog(now)
+	if backlog["ndt/ndt5"] != 2 || backlog["ndt/tcpinfo"] != 2 {
+		t.Error("Wrong backlog", backlog)
+	}
+	svc.NextJob(ctx)
+	backlog = svc.Backlog(now)
+	if backlog["ndt/ndt5"] != 1 || backlog["ndt/tcpinfo"] != 2 {
+		t.Error("Wrong backlog", backlog)
+	}
+	svc.NextJob(ctx)
+	svc.NextJob(ctx)
+	svc.NextJob(ctx)
+	// The service has wrapped back to the start date.
+	backlog = svc.Backlog(now)
+	if backlog["ndt/ndt5"] != 2 || backlog["ndt/tcpinfo"] != 2 {
+		t.Error("Wrong backlog after wrap", backlog)
+	}
+}
+
 func TestJobHandler(t *testing.T) {
 	ctx := context.Background()
 
@@ -138,6 +178,124 @@ func TestJobHandler(t *testing.T) {
 	if want != resp.Body.String() {
 		t.Fatal(resp.Body.String())
 	}
+
+	throttle := &fakeThrottle{throttled: true}
+	svc.SetThrottle(throttle)
+	req = httptest.NewRequest("POST", "/job", nil)
+	resp = httptest.NewRecorder()
+	svc.JobHandler(resp, req)
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Error("Should be ServiceUnavailable while throttled", http.StatusText(resp.Code))
+	}
+	throttle.throttled = false
+	req = httptest.NewRequest("POST", "/job", nil)
+	resp = httptest.NewRecorder()
+	svc.JobHandler(resp, req)
+	want = `{"Bucket":"fake-bucket","Experiment":"ndt","Datatype":"tcpinfo","Date":"2011-02-03T00:00:00Z"}`
+	if resp.Code != http.StatusOK || want != resp.Body.String() {
+		t.Error("Should dispatch the next job after throttle releases", resp.Code, resp.Body.String())
+	}
+
+	// v2 responses include the target.
+	req = httptest.NewRequest("POST", "/v2/job", nil)
+	resp = httptest.NewRecorder()
+	svc.JobHandler(resp, req)
+	r := tracker.JobResponse{}
+	must(t, json.Unmarshal(resp.Body.Bytes(), &r))
+	if resp.Code != http.StatusOK || r.Version != tracker.ProtocolV2 || r.Job.TargetTable.Table != "ndt5" ||
+		r.Job.Date != time.Date(2011, 2, 4, 0, 0, 0, 0, time.UTC) {
+		t.Error("Wrong v2 job", resp.Code, resp.Body.String())
+	}
+	// So do v1 requests that accept them.
+	req = httptest.NewRequest("POST", "/job", nil)
+	req.Header.Set("Accept", tracker.MediaTypeV2)
+	resp = httptest.NewRecorder()
+	svc.JobHandler(resp, req)
+	if resp.Code != http.StatusOK || resp.Header().Get("Content-Type") != tracker.MediaTypeV2 {
+		t.Error("Should negotiate a v2 response", resp.Code, resp.Body.String())
+	}
+
+	svc.Stop()
+	req = httptest.NewRequest("POST", "/job", nil)
+	resp = httptest.NewRecorder()
+	svc.JobHandler(resp, req)
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Error("Should be ServiceUnavailable after Stop", http.StatusText(resp.Code))
+	}
+	req = httptest.NewRequest("POST", "/v2/job", nil)
+	resp = httptest.NewRecorder()
+	svc.JobHandler(resp, req)
+	r2 := tracker.Response{}
+	must(t, json.Unmarshal(resp.Body.Bytes(), &r2))
+	if resp.Code != http.StatusServiceUnavailable || r2.Error == "" {
+		t.Error("Should be a v2 error after Stop", resp.Code, resp.Body.String())
+	}
+}
+
+// fakeThrottle is a job.Throttle that is engaged while throttled is true.
+type fakeThrottle struct {
+	throttled bool
+}
+
+func (f *fakeThrottle) Throttled() bool {
+	return f.throttled
+}
+
+// failTracker records failed jobs.
+type failTracker struct {
+	NullTracker
+	failed map[tracker.Job]string
+}
+
+func (ft *failTracker) SetJobError(job tracker.Job, errString string) error {
+	ft.failed[job] = errString
+	return nil
+}
+
+func TestArchiveCheck(t *testing.T) {
+	ctx := context.Background()
+
+	// Fake time will avoid yesterday trigger.
+	now := time.Date(2011, 2, 16, 1, 2, 3, 4, time.UTC)
+	monkey.Patch(time.Now, func() time.Time {
+		return now
+	})
+	defer monkey.Unpatch(time.Now)
+
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "tcpinfo", Target: "tmp_ndt.tcpinfo"},
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "pcap", Target: "tmp_ndt.pcap"},
+	}
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	ft := &failTracker{failed: map[tracker.Job]string{}}
+	svc, err := job.NewJobService(ctx, ft, start, "fakebucket", sources, &NullSaver{})
+	must(t, err)
+	svc.SetArchiveCheck(func(ctx context.Context, j tracker.Job) error {
+		switch j.Datatype {
+		case "tcpinfo":
+			return fmt.Errorf("%w: corrupt", gcs.ErrBadArchive)
+		case "pcap":
+			return errors.New("GCS unavailable")
+		}
+		return nil
+	}, ft)
+
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("POST", "/job", nil)
+		resp := httptest.NewRecorder()
+		svc.JobHandler(resp, req)
+		codes = append(codes, resp.Code)
+	}
+	// Other check errors should not prevent dispatch.
+	if codes[0] != http.StatusOK || codes[1] != http.StatusInternalServerError || codes[2] != http.StatusOK {
+		t.Error("Wrong response codes", codes)
+	}
+	bad := tracker.Job{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "tcpinfo", Date: start}
+	if len(ft.failed) != 1 || ft.failed[bad] != "bad archive: corrupt" {
+		t.Error("Expected failed tcpinfo job", ft.failed)
+	}
 }
 
 func TestResume(t *testing.T) {
@@ -297,6 +455,93 @@ func TestYesterdayFromSaver(t *testing.T) {
 	}
 }
 
+func TestDailyDelay(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2011, 2, 16, 11, 2, 3, 4, time.UTC)
+	monkey.Patch(time.Now, func() time.Time {
+		return now
+	})
+	defer monkey.Unpatch(time.Now)
+
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "pcap", Target: "tmp_ndt.pcap", DailyDelay: 20 * time.Hour},
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+	}
+	resume := time.Date(2011, 2, 10, 0, 0, 0, 0, time.UTC)
+	yesterday := time.Date(2011, 2, 15, 0, 0, 0, 0, time.UTC)
+	fs := FakeSaver{Current: resume, Yesterday: yesterday}
+	svc, err := job.NewJobService(ctx, &NullTracker{}, start, "fake-bucket", sources, &fs)
+	must(t, err)
+
+	// Only ndt5 is due for yesterday, so historical jobs follow.
+	j := svc.NextJob(ctx)
+	if j.Job.Datatype != "ndt5" || j.Job.Date != yesterday {
+		t.Error("Expected ndt5 yesterday job, got", j.Job)
+	}
+	j = svc.NextJob(ctx)
+	if j.Job.Datatype != "pcap" || j.Job.Date != resume {
+		t.Error("Expected pcap historical job, got", j.Job)
+	}
+	if fs.Yesterday != yesterday {
+		t.Error("Yesterday should not advance until pcap is dispatched", fs.Yesterday)
+	}
+
+	// After the pcap delay, pcap is dispatched and yesterday advances.
+	now = time.Date(2011, 2, 16, 20, 0, 0, 0, time.UTC)
+	j = svc.NextJob(ctx)
+	if j.Job.Datatype != "pcap" || j.Job.Date != yesterday {
+		t.Error("Expected pcap yesterday job, got", j.Job)
+	}
+	if fs.Yesterday != yesterday.AddDate(0, 0, 1) {
+		t.Error("Expected", yesterday.AddDate(0, 0, 1), "got", fs.Yesterday)
+	}
+}
+
+func TestTodayJobs(t *testing.T) {
+	ctx := context.Background()
+	flag.Set("config_path", "testdata/incremental.yml")
+	config.ParseConfig()
+
+	// Early enough in the day that yesterday will not trigger.
+	now := time.Date(2011, 2, 16, 5, 0, 0, 0, time.UTC)
+	monkey.Patch(time.Now, func() time.Time {
+		return now
+	})
+	defer monkey.Unpatch(time.Now)
+
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5", Incremental: true},
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "tcpinfo", Target: "tmp_ndt.tcpinfo"},
+	}
+	svc, err := job.NewJobService(ctx, &NullTracker{}, start, "fake-bucket", sources, &NullSaver{})
+	must(t, err)
+
+	today := time.Date(2011, 2, 16, 0, 0, 0, 0, time.UTC)
+	expected := []struct {
+		after    time.Duration
+		datatype string
+		date     time.Time
+	}{
+		{0, "ndt5", today},
+		{0, "ndt5", start},
+		{0, "tcpinfo", start},
+		// Not yet time for the next incremental update.
+		{30 * time.Minute, "ndt5", start.AddDate(0, 0, 1)},
+		{time.Hour, "ndt5", today},
+		{0, "tcpinfo", start.AddDate(0, 0, 1)},
+	}
+	for i, e := range expected {
+		now = now.Add(e.after)
+		j := svc.NextJob(ctx)
+		if j.Datatype != e.datatype || !j.Date.Equal(e.date) {
+			t.Error(i, "Expected", e.datatype, e.date, "got", j.Job)
+		}
+	}
+}
+
 func TestEarlyWrapping(t *testing.T) {
 	ctx := context.Background()
 
@@ -389,3 +634,299 @@ func TestPersistence(t *testing.T) {
 		t.Fatal("Should have errored", err)
 	}
 }
+
+func TestSkip(t *testing.T) {
+	ctx := context.Background()
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "tcpinfo", Target: "tmp_ndt.tcpinfo"},
+	}
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	svc, err := job.NewJobService(ctx, &NullTracker{}, start, "fakebucket", sources, &NullSaver{})
+	must(t, err)
+
+	skipped := tracker.NewJob("fake-bucket", "ndt", "tcpinfo", start)
+	// NullSaver fails, but the skip list is still updated.
+	svc.SetSkip(ctx, skipped, true)
+	if len(svc.SkipList()) != 1 {
+		t.Fatal("Expected one skipped job", svc.SkipList())
+	}
+
+	first := svc.NextJob(ctx)
+	second := svc.NextJob(ctx)
+	if first.Job.Datatype != "ndt5" || second.Job.Datatype != "ndt5" || second.Job.Date == start {
+		t.Error("Expected skipped job to be omitted:", first.Job, second.Job)
+	}
+
+	svc.SetSkip(ctx, skipped, false)
+	if len(svc.SkipList()) != 0 {
+		t.Error("Expected empty skip list", svc.SkipList())
+	}
+	// After too many skipped candidates, no job is returned.
+	svc, err = job.NewJobService(ctx, &NullTracker{}, start, "fakebucket", sources[:1], &NullSaver{})
+	must(t, err)
+	for i := 0; i <= 1000; i++ {
+		svc.SetSkip(ctx, tracker.NewJob("fake-bucket", "ndt", "ndt5", start.AddDate(0, 0, i)), true)
+	}
+	if j := svc.NextJob(ctx); j.Job != (tracker.Job{}) {
+		t.Error("Expected no job", j.Job)
+	}
+	if j := svc.NextJob(ctx); j.Job.Date != start.AddDate(0, 0, 1001) {
+		t.Error("Expected the first date not skipped", j.Job)
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	ctx := context.Background()
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "tcpinfo", Target: "tmp_ndt.tcpinfo"},
+	}
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	svc, err := job.NewJobService(ctx, &NullTracker{}, start, "fakebucket", sources, &NullSaver{})
+	must(t, err)
+
+	unknown := tracker.NewJob("fake-bucket", "ndt", "foobar", start)
+	if err := svc.Requeue(ctx, unknown); err != job.ErrUnknownSource {
+		t.Error("Expected ErrUnknownSource", err)
+	}
+
+	requeued := tracker.NewJob("fake-bucket", "ndt", "tcpinfo", start.AddDate(1, 0, 0))
+	// NullSaver fails, but the job is still requeued.
+	svc.Requeue(ctx, requeued)
+	svc.Requeue(ctx, requeued)
+
+	first := svc.NextJob(ctx)
+	if first.Job != requeued || first.TargetTable.Table != "tcpinfo" {
+		t.Error("Expected requeued job first:", first)
+	}
+	second := svc.NextJob(ctx)
+	if second.Job.Datatype != "ndt5" || !second.Job.Date.Equal(start) {
+		t.Error("Expected requeued job only once:", second.Job)
+	}
+}
+
+// staleTracker releases its jobs if the timeout has passed since dispatch.
+type staleTracker struct {
+	dispatch time.Time
+	jobs     []tracker.Job
+}
+
+func (st *staleTracker) ReleaseStale(timeout time.Duration, now time.Time) []tracker.Job {
+	if now.Sub(st.dispatch) <= timeout {
+		return nil
+	}
+	jobs := st.jobs
+	st.jobs = nil
+	return jobs
+}
+
+func TestRequeueStale(t *testing.T) {
+	ctx := context.Background()
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+	}
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	svc, err := job.NewJobService(ctx, &NullTracker{}, start, "fakebucket", sources, &NullSaver{})
+	must(t, err)
+
+	stale := tracker.NewJob("fake-bucket", "ndt", "ndt5", start.AddDate(1, 0, 0))
+	unknown := tracker.NewJob("fake-bucket", "ndt", "foobar", start)
+	now := time.Now()
+	st := &staleTracker{dispatch: now, jobs: []tracker.Job{stale, unknown}}
+	if jobs := svc.RequeueStale(ctx, st, time.Hour, now.Add(time.Minute)); len(jobs) != 0 {
+		t.Error("Nothing should be stale yet", jobs)
+	}
+	jobs := svc.RequeueStale(ctx, st, time.Hour, now.Add(2*time.Hour))
+	if len(jobs) != 1 || jobs[0] != stale {
+		t.Error("Expected only the known job to be requeued", jobs)
+	}
+	if next := svc.NextJob(ctx); next.Job != stale {
+		t.Error("Expected the stale job to be dispatched first", next.Job)
+	}
+}
+
+func TestDispatchModes(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2011, 2, 16, 11, 2, 3, 4, time.UTC)
+	monkey.Patch(time.Now, func() time.Time {
+		return now
+	})
+	defer monkey.Unpatch(time.Now)
+
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	resume := time.Date(2011, 2, 10, 0, 0, 0, 0, time.UTC)
+	yesterday := time.Date(2011, 2, 15, 0, 0, 0, 0, time.UTC)
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+	}
+	inFlight := map[tracker.Lane]int{}
+	counts := func(time.Time) map[tracker.Lane]int { return inFlight }
+	newService := func(cfg config.DispatchConfig) *job.Service {
+		svc, err := job.NewJobService(ctx, &NullTracker{}, start, "fake-bucket", sources,
+			&FakeSaver{Current: resume, Yesterday: yesterday})
+		must(t, err)
+		must(t, svc.SetDispatch(cfg, counts))
+		return svc
+	}
+
+	// Reprocessing skips yesterday's job.
+	svc := newService(config.DispatchConfig{Mode: "reprocess"})
+	if j := svc.NextJob(ctx); j.Job.Date != resume {
+		t.Error("Expected historical job, got", j.Job)
+	}
+
+	// Daily processing dispatches only yesterday's job, with no backlog.
+	svc = newService(config.DispatchConfig{Mode: "daily"})
+	if j := svc.NextJob(ctx); j.Job.Date != yesterday {
+		t.Error("Expected yesterday job, got", j.Job)
+	}
+	if j := svc.NextJob(ctx); j.Job != (tracker.Job{}) {
+		t.Error("Expected no job, got", j.Job)
+	}
+	if backlog := svc.Backlog(now); backlog["ndt/ndt5"] != 0 {
+		t.Error("Expected no backlog in daily mode", backlog)
+	}
+
+	// The reprocessing quota doesn't hold up daily jobs.
+	inFlight[tracker.Reprocess] = 2
+	svc = newService(config.DispatchConfig{ReprocessQuota: 2})
+	if j := svc.NextJob(ctx); j.Job.Date != yesterday {
+		t.Error("Expected yesterday job, got", j.Job)
+	}
+	req := httptest.NewRequest("POST", "/job", nil)
+	resp := httptest.NewRecorder()
+	svc.JobHandler(resp, req)
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Error("Should be ServiceUnavailable at quota", http.StatusText(resp.Code))
+	}
+	inFlight[tracker.Reprocess] = 1
+	if j := svc.NextJob(ctx); j.Job.Date != resume {
+		t.Error("Expected historical job below quota, got", j.Job)
+	}
+
+	if err := svc.SetDispatch(config.DispatchConfig{Mode: "weekly"}, counts); !errors.Is(err, job.ErrInvalidMode) {
+		t.Error("Expected ErrInvalidMode, got", err)
+	}
+	if err := svc.SetDispatch(config.DispatchConfig{DailyQuota: -1}, counts); !errors.Is(err, job.ErrInvalidMode) {
+		t.Error("Expected ErrInvalidMode, got", err)
+	}
+	if err := svc.SetDispatch(config.DispatchConfig{DailyQuota: 1}, nil); err != job.ErrNilParameter {
+		t.Error("Expected ErrNilParameter, got", err)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2011, 2, 16, 12, 0, 0, 0, time.UTC)
+	monkey.Patch(time.Now, func() time.Time {
+		return now
+	})
+	defer monkey.Unpatch(time.Now)
+
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+	}
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	svc, err := job.NewJobService(ctx, &NullTracker{}, start, "fakebucket", sources, &NullSaver{})
+	must(t, err)
+	must(t, svc.SetDispatch(config.DispatchConfig{Mode: "reprocess"}, nil))
+
+	jobs := []tracker.Job{}
+	for d := 1; d <= 3; d++ {
+		jobs = append(jobs, tracker.NewJob("fake-bucket", "ndt", "ndt5", time.Date(2010, 1, d, 0, 0, 0, 0, time.UTC)))
+	}
+	if _, err := svc.PlanBackfill(ctx, jobs); err != job.ErrNilParameter {
+		t.Error("Expected ErrNilParameter without a sizer", err)
+	}
+	p, err := backfill.NewPolicy(config.BackfillConfig{
+		Order: "largest", LargeBytes: 1000, IdleStartHour: 22, IdleEndHour: 6})
+	must(t, err)
+	svc.SetBackfill(p, func(ctx context.Context, j tracker.Job) (int64, error) {
+		return int64(j.Date.Day()) * 500, nil
+	})
+	unknown := tracker.NewJob("fake-bucket", "ndt", "foobar", start)
+	if _, err := svc.PlanBackfill(ctx, []tracker.Job{unknown}); !errors.Is(err, job.ErrUnknownSource) {
+		t.Error("Expected ErrUnknownSource", err)
+	}
+	// NullSaver fails, but the jobs are still planned.
+	items, err := svc.PlanBackfill(ctx, jobs)
+	must(t, err)
+	if len(items) != 3 || items[0].Job != jobs[2] || len(svc.BackfillPlan()) != 3 {
+		t.Error("Wrong plan", items)
+	}
+	if backlog := svc.Backlog(now); backlog["ndt/ndt5"] != 3+13 {
+		t.Error("Expected backfill jobs in the backlog", backlog)
+	}
+
+	// Outside the idle window, only the small job is dispatched, then the
+	// historical dates.
+	if j := svc.NextJob(ctx); j.Job != jobs[0] || j.TargetTable.Table != "ndt5" {
+		t.Error("Expected the small backfill job, got", j.Job)
+	}
+	if j := svc.NextJob(ctx); j.Job.Date != start {
+		t.Error("Expected a historical job, got", j.Job)
+	}
+	now = time.Date(2011, 2, 16, 23, 0, 0, 0, time.UTC)
+	for _, want := range []tracker.Job{jobs[2], jobs[1]} {
+		if j := svc.NextJob(ctx); j.Job != want {
+			t.Error("Expected", want, "got", j.Job)
+		}
+	}
+	if len(svc.BackfillPlan()) != 0 {
+		t.Error("Expected an empty plan", svc.BackfillPlan())
+	}
+}
+
+func TestShards(t *testing.T) {
+	ctx := context.Background()
+
+	// Fake time will avoid yesterday trigger.
+	now := time.Date(2011, 2, 16, 1, 2, 3, 4, time.UTC)
+	monkey.Patch(time.Now, func() time.Time {
+		return now
+	})
+	defer monkey.Unpatch(time.Now)
+
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5",
+			Shards: []string{"mlab1", `{{.Date.Format "20060102"}}T0`}},
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "tcpinfo", Target: "tmp_ndt.tcpinfo"},
+	}
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	must(t, err)
+	svc, err := job.NewJobService(ctx, tk, start, "fakebucket", sources, &NullSaver{})
+	must(t, err)
+	incremental := []config.SourceConfig{{Experiment: "ndt", Datatype: "ndt5", Incremental: true,
+		Shards: []string{"mlab1"}}}
+	if err := svc.SetShards(incremental, tk); !errors.Is(err, job.ErrInvalidShards) {
+		t.Error("Expected ErrInvalidShards", err)
+	}
+	invalid := []config.SourceConfig{{Experiment: "ndt", Datatype: "ndt5", Shards: []string{"{{.Date"}}}
+	if err := svc.SetShards(invalid, tk); !errors.Is(err, job.ErrInvalidShards) {
+		t.Error("Expected ErrInvalidShards", err)
+	}
+	must(t, svc.SetShards(sources, tk))
+
+	want := []string{
+		`{"Bucket":"fake-bucket","Experiment":"ndt","Datatype":"ndt5","Date":"2011-02-03T00:00:00Z","Prefix":"mlab1"}`,
+		`{"Bucket":"fake-bucket","Experiment":"ndt","Datatype":"ndt5","Date":"2011-02-03T00:00:00Z","Prefix":"20110203T0"}`,
+		`{"Bucket":"fake-bucket","Experiment":"ndt","Datatype":"tcpinfo","Date":"2011-02-03T00:00:00Z"}`,
+	}
+	for i := range want {
+		req := httptest.NewRequest("POST", "/job", nil)
+		resp := httptest.NewRecorder()
+		svc.JobHandler(resp, req)
+		if resp.Code != http.StatusOK || resp.Body.String() != want[i] {
+			t.Errorf("%d: got %d %s, want %s", i, resp.Code, resp.Body.String(), want[i])
+		}
+	}
+	s, err := tk.GetStatus(tracker.NewJob("fake-bucket", "ndt", "ndt5", start))
+	must(t, err)
+	if s.State() != tracker.Sharded {
+		t.Error("Expected the whole day job to wait for its shards", s)
+	}
+}
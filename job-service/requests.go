@@ -0,0 +1,135 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// ErrQueueFull is returned for requests while a RequestQueue is full.
+var ErrQueueFull = errors.New("request queue full")
+
+// MaxRequests is the number of jobs a RequestQueue holds, unless changed
+// with SetLimit.
+const MaxRequests = 10000
+
+// RequestQueue is a JobSource of requested jobs, e.g. re-parse requests from
+// the parsers, received over HTTP or Pub/Sub.  Requests are only kept in
+// memory, so requests that have not been dispatched are lost on restart.
+type RequestQueue struct {
+	name   string
+	lane   tracker.Lane
+	accept func(tracker.Job) error
+
+	lock   sync.Mutex
+	jobs   []tracker.Job
+	queued map[tracker.Job]struct{} // The jobs, for duplicate checks.
+	limit  int
+}
+
+// NewRequestQueue creates an empty RequestQueue, whose jobs are dispatched
+// in the lane.  Accept, if not nil, rejects requests, e.g. Service.Accepts.
+func NewRequestQueue(name string, lane tracker.Lane, accept func(tracker.Job) error) *RequestQueue {
+	return &RequestQueue{name: name, lane: lane, accept: accept,
+		queued: make(map[tracker.Job]struct{}), limit: MaxRequests}
+}
+
+// SetLimit changes the number of jobs the queue holds before refusing
+// requests with ErrQueueFull.
+func (q *RequestQueue) SetLimit(limit int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.limit = limit
+}
+
+// Name implements JobSource.Name.
+func (q *RequestQueue) Name() string {
+	return q.name
+}
+
+// Lane implements JobSource.Lane.
+func (q *RequestQueue) Lane() tracker.Lane {
+	return q.lane
+}
+
+// Next implements JobSource.Next, returning the oldest request.
+func (q *RequestQueue) Next(ctx context.Context, now time.Time) (tracker.Job, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.jobs) == 0 {
+		return tracker.Job{}, false
+	}
+	j := q.jobs[0]
+	q.jobs = q.jobs[1:]
+	delete(q.queued, j)
+	return j, true
+}
+
+// Request queues the job, unless it is already queued.  Returns an error if
+// the job is rejected, or ErrQueueFull if the queue is full.
+func (q *RequestQueue) Request(job tracker.Job) error {
+	if q.accept != nil {
+		if err := q.accept(job); err != nil {
+			metrics.JobRequests.WithLabelValues(q.name, "rejected").Inc()
+			return err
+		}
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.queued[job]; ok {
+		metrics.JobRequests.WithLabelValues(q.name, "duplicate").Inc()
+		return nil
+	}
+	if len(q.jobs) >= q.limit {
+		metrics.JobRequests.WithLabelValues(q.name, "full").Inc()
+		return ErrQueueFull
+	}
+	q.jobs = append(q.jobs, job)
+	q.queued[job] = struct{}{}
+	metrics.JobRequests.WithLabelValues(q.name, "queued").Inc()
+	return nil
+}
+
+// Pending returns a copy of the queued jobs, oldest first.
+func (q *RequestQueue) Pending() []tracker.Job {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return append([]tracker.Job{}, q.jobs...)
+}
+
+// Handler queues the job in the "job" parameter of a POST, e.g. from a
+// parser that found a bad task file, and logs the optional "reason".  It
+// responds with 429 while the queue is full.  Handler doesn't authenticate
+// requests, so it should be wrapped, e.g. with admin.RequireKeys.
+func (q *RequestQueue) Handler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var job tracker.Job
+	if err := job.Unmarshal([]byte(req.FormValue("job"))); err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	if err := q.Request(job); err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrUnknownSource):
+			status = http.StatusBadRequest
+		case errors.Is(err, ErrQueueFull):
+			status = http.StatusTooManyRequests
+		}
+		resp.WriteHeader(status)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	log.Println("Requested", job, req.FormValue("reason"))
+	resp.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,124 @@
+package job
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+
+	"github.com/m-lab/etl-gardener/civil"
+	"github.com/m-lab/etl-gardener/cloud/gcs"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// SourceScan is the name of the ScanSource.
+const SourceScan = "scan"
+
+// DefaultScanDays is the number of dates scanned, if not configured.
+const DefaultScanDays = 7
+
+// DateLister returns the dates from start to end, inclusive, that have an
+// archive for the source.
+type DateLister func(ctx context.Context, src config.SourceConfig, start, end time.Time) ([]time.Time, error)
+
+// GCSDateLister returns a DateLister that lists the date prefixes of the
+// standard archive layout with gcs.Dates.
+func GCSDateLister(client stiface.Client) DateLister {
+	return func(ctx context.Context, src config.SourceConfig, start, end time.Time) ([]time.Time, error) {
+		return gcs.Dates(ctx, client, src.Bucket, src.Experiment, src.Datatype, start, end)
+	}
+}
+
+// ScanSource is a JobSource of jobs for archive dates that appear after
+// the daily sources have passed them, e.g. archives uploaded days late.  It
+// periodically lists the archive dates of the sources, from Days before now
+// until the day before yesterday, and queues the dates that were not
+// present in earlier scans.  The dates present at the first scan are
+// assumed to be processed already.  Sources with a path template are not
+// scanned.
+type ScanSource struct {
+	list    DateLister
+	sources []config.SourceConfig
+	queue   *RequestQueue
+
+	// Days is the number of dates scanned.
+	Days int
+
+	seen map[tracker.Job]bool // Dates found by earlier scans.  Nil until the first scan.
+}
+
+// NewScanSource creates a ScanSource for the sources, whose jobs are
+// dispatched in the lane.
+func NewScanSource(list DateLister, sources []config.SourceConfig, lane tracker.Lane) *ScanSource {
+	return &ScanSource{list: list, sources: sources,
+		queue: NewRequestQueue(SourceScan, lane, nil), Days: DefaultScanDays}
+}
+
+// Name implements JobSource.Name.
+func (s *ScanSource) Name() string {
+	return s.queue.Name()
+}
+
+// Lane implements JobSource.Lane.
+func (s *ScanSource) Lane() tracker.Lane {
+	return s.queue.Lane()
+}
+
+// Next implements JobSource.Next, returning the oldest new date found.
+func (s *ScanSource) Next(ctx context.Context, now time.Time) (tracker.Job, bool) {
+	return s.queue.Next(ctx, now)
+}
+
+// Scan lists the archive dates of each source, and queues the new ones.
+// It returns the queued jobs.  Not thread-safe.
+func (s *ScanSource) Scan(ctx context.Context, now time.Time) ([]tracker.Job, error) {
+	end := civil.AddDays(now, -2)
+	start := civil.AddDays(end, 1-s.Days)
+	found := map[tracker.Job]bool{}
+	queued := []tracker.Job{}
+	for _, src := range s.sources {
+		if src.PathTemplate != "" {
+			// Archive dates can only be listed in the standard layout.
+			continue
+		}
+		dates, err := s.list(ctx, src, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range dates {
+			j := tracker.NewJob(src.Bucket, src.Experiment, src.Datatype, d)
+			j.Filter = src.Filter
+			found[j] = true
+			if s.seen != nil && !s.seen[j] {
+				queued = append(queued, j)
+			}
+		}
+	}
+	for _, j := range queued {
+		log.Println("Scan found new archive date", j)
+		if err := s.queue.Request(j); err != nil {
+			log.Println(err)
+		}
+	}
+	// Dates that leave the window are forgotten.
+	s.seen = found
+	return queued, nil
+}
+
+// Run scans every interval until ctx is done.
+func (s *ScanSource) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.Scan(ctx, time.Now()); err != nil {
+			log.Println("Archive scan failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
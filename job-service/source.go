@@ -0,0 +1,198 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/m-lab/etl-gardener/civil"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Names of the built in job sources, in their default order.
+const (
+	SourceRequeue    = "requeue"    // Jobs added with Requeue, e.g. stale parser jobs.
+	SourceShards     = "shards"     // Pending shards of dispatched jobs.
+	SourceYesterday  = "yesterday"  // Yesterday's jobs, after each source's daily delay.
+	SourceToday      = "today"      // Incremental jobs for the current date.
+	SourceBackfill   = "backfill"   // Planned backfill jobs.
+	SourceHistorical = "historical" // Historical dates, from the start date.
+)
+
+// ErrInvalidSources is returned for unknown or repeated job source names.
+var ErrInvalidSources = errors.New("invalid job sources")
+
+// JobSource provides jobs for the Service to dispatch, e.g. the daily
+// dates, or jobs requested by the parsers.  Sources are asked for a job in
+// priority order, and the first job returned is dispatched, so that new
+// intake mechanisms don't require changes to dispatch.
+type JobSource interface {
+	// Name identifies the source in logs, metrics and config.
+	Name() string
+	// Lane is the lane whose mode and quota apply to the source's jobs, or
+	// "" if they are always dispatched.
+	Lane() tracker.Lane
+	// Next removes and returns the source's next job at now, or false if
+	// it has none.  The job must match one of the Service's sources.  Next
+	// is called with the Service lock held, so it must not block, or call
+	// the Service.
+	Next(ctx context.Context, now time.Time) (tracker.Job, bool)
+}
+
+// stage adapts one of the Service's built in stages to a JobSource.
+type stage struct {
+	name string
+	lane tracker.Lane
+	next func(ctx context.Context, now time.Time) (tracker.Job, bool)
+}
+
+func (s stage) Name() string       { return s.name }
+func (s stage) Lane() tracker.Lane { return s.lane }
+func (s stage) Next(ctx context.Context, now time.Time) (tracker.Job, bool) {
+	return s.next(ctx, now)
+}
+
+// builtinSources returns the built in sources, in their default order.
+func (svc *Service) builtinSources() []JobSource {
+	return []JobSource{
+		stage{SourceRequeue, "", func(ctx context.Context, now time.Time) (tracker.Job, bool) {
+			return svc.pop(ctx, &svc.Requeued)
+		}},
+		stage{SourceShards, "", func(ctx context.Context, now time.Time) (tracker.Job, bool) {
+			return svc.pop(ctx, &svc.PendingShards)
+		}},
+		stage{SourceYesterday, tracker.Daily, func(ctx context.Context, now time.Time) (tracker.Job, bool) {
+			if j := svc.yesterday.nextJob(ctx); j != nil {
+				return j.Job, true
+			}
+			return tracker.Job{}, false
+		}},
+		stage{SourceToday, tracker.Daily, func(ctx context.Context, now time.Time) (tracker.Job, bool) {
+			if j := svc.today.nextJob(now); j != nil {
+				return j.Job, true
+			}
+			return tracker.Job{}, false
+		}},
+		stage{SourceBackfill, tracker.Reprocess, svc.nextBackfill},
+		stage{SourceHistorical, tracker.Reprocess, svc.nextHistorical},
+	}
+}
+
+// AddSource adds a job source, with lower priority than the built in
+// sources, except the historical dates, which always have a job.  The
+// priority can be changed with SetSourceOrder.  It should be called before
+// serving.
+func (svc *Service) AddSource(src JobSource) error {
+	for i, s := range svc.sources {
+		if s.Name() == src.Name() {
+			return fmt.Errorf("%w: %q added twice", ErrInvalidSources, src.Name())
+		}
+		if s.Name() == SourceHistorical {
+			svc.sources = append(svc.sources[:i:i], append([]JobSource{src}, svc.sources[i:]...)...)
+			return nil
+		}
+	}
+	svc.sources = append(svc.sources, src)
+	return nil
+}
+
+// SetSourceOrder orders the built in and added sources by name, in
+// priority order.  Sources that are not named are not dispatched.  An empty
+// list keeps the default order.  It should be called before serving, after
+// AddSource.
+func (svc *Service) SetSourceOrder(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	byName := make(map[string]JobSource, len(svc.sources))
+	for _, s := range svc.sources {
+		byName[s.Name()] = s
+	}
+	sources := make([]JobSource, 0, len(names))
+	for _, name := range names {
+		s, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("%w: unknown or repeated source %q", ErrInvalidSources, name)
+		}
+		delete(byName, name)
+		sources = append(sources, s)
+	}
+	svc.sources = sources
+	return nil
+}
+
+// SourceNames returns the names of the sources, in priority order.
+func (svc *Service) SourceNames() []string {
+	names := make([]string, 0, len(svc.sources))
+	for _, s := range svc.sources {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+// pop removes and returns the first job of the list, and saves the Service.
+// Caller must hold the lock.
+func (svc *Service) pop(ctx context.Context, list *[]tracker.Job) (tracker.Job, bool) {
+	if len(*list) == 0 {
+		return tracker.Job{}, false
+	}
+	job := (*list)[0]
+	*list = (*list)[1:]
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	if err := svc.saver.Save(ctx, svc); err != nil {
+		log.Println(err)
+	}
+	return job, true
+}
+
+// nextHistorical returns the next source's job for the historical date
+// being dispatched, and advances the date after the last source.
+// Caller must hold the lock.
+func (svc *Service) nextHistorical(ctx context.Context, now time.Time) (tracker.Job, bool) {
+	job := svc.jobSpecs[svc.nextIndex].Job
+	job.Date = svc.Date
+	svc.nextIndex++
+
+	if svc.nextIndex >= len(svc.jobSpecs) {
+		svc.advanceDate()
+		// Note that this will block other calls to NextJob
+		ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+		defer cf()
+		log.Println("Saving", svc.GetName(), svc.GetKind(), civil.Format(svc.Date))
+		err := svc.saver.Save(ctx, svc)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return job, true
+}
+
+// nextJob returns the next job from the first source, in priority order,
+// whose lane is open and that has a job.  Jobs that match none of the
+// configured sources are dropped.
+// Caller must hold the lock.
+func (svc *Service) nextJob(ctx context.Context, open map[tracker.Lane]bool) tracker.JobWithTarget {
+	now := time.Now()
+	for _, src := range svc.sources {
+		if lane := src.Lane(); lane != "" && !open[lane] {
+			continue
+		}
+		for {
+			job, ok := src.Next(ctx, now)
+			if !ok {
+				break
+			}
+			if j, ok := svc.spec(job); ok {
+				log.Println(src.Name(), "job:", j.Job)
+				metrics.SourceJobs.WithLabelValues(src.Name()).Inc()
+				return j
+			}
+			log.Println("Dropping", src.Name(), "job with no source:", job)
+		}
+	}
+	return tracker.JobWithTarget{}
+}
@@ -0,0 +1,179 @@
+package job_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/job-service"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestSourceOrder(t *testing.T) {
+	ctx := context.Background()
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "tcpinfo", Target: "tmp_ndt.tcpinfo"},
+	}
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	svc, err := job.NewJobService(ctx, &NullTracker{}, start, "fakebucket", sources, &NullSaver{})
+	must(t, err)
+
+	q := job.NewRequestQueue("requests", tracker.Reprocess, svc.Accepts)
+	must(t, svc.AddSource(q))
+	if err := svc.AddSource(q); !errors.Is(err, job.ErrInvalidSources) {
+		t.Error("Expected ErrInvalidSources", err)
+	}
+	want := []string{"requeue", "shards", "yesterday", "today", "backfill", "requests", "historical"}
+	if diff := deep.Equal(svc.SourceNames(), want); diff != nil {
+		t.Error(diff)
+	}
+
+	unknown := tracker.NewJob("fake-bucket", "ndt", "foobar", start)
+	if err := q.Request(unknown); !errors.Is(err, job.ErrUnknownSource) {
+		t.Error("Expected ErrUnknownSource", err)
+	}
+	requested := tracker.NewJob("fake-bucket", "ndt", "tcpinfo", start.AddDate(1, 0, 0))
+	must(t, q.Request(requested))
+	must(t, q.Request(requested))
+	if len(q.Pending()) != 1 {
+		t.Error("Expected a single request", q.Pending())
+	}
+	if next := svc.NextJob(ctx); next.Job != requested || next.TargetTable.Table != "tcpinfo" {
+		t.Error("Expected the requested job ahead of historical dates", next)
+	}
+	if next := svc.NextJob(ctx); next.Job.Datatype != "ndt5" || !next.Job.Date.Equal(start) {
+		t.Error("Expected the first historical job", next.Job)
+	}
+
+	if err := svc.SetSourceOrder([]string{"requests", "bogus"}); !errors.Is(err, job.ErrInvalidSources) {
+		t.Error("Expected ErrInvalidSources", err)
+	}
+	if err := svc.SetSourceOrder([]string{"requests", "requests"}); !errors.Is(err, job.ErrInvalidSources) {
+		t.Error("Expected ErrInvalidSources", err)
+	}
+	// Without the historical source, only requests are dispatched.
+	must(t, svc.SetSourceOrder([]string{"requests"}))
+	if next := svc.NextJob(ctx); !next.Job.Date.IsZero() {
+		t.Error("Expected no job", next.Job)
+	}
+	must(t, q.Request(requested))
+	if next := svc.NextJob(ctx); next.Job != requested {
+		t.Error("Expected the requested job", next.Job)
+	}
+}
+
+func TestRequestHandler(t *testing.T) {
+	ctx := context.Background()
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5", Target: "tmp_ndt.ndt5"},
+	}
+	start := time.Date(2011, 2, 3, 0, 0, 0, 0, time.UTC)
+	svc, err := job.NewJobService(ctx, &NullTracker{}, start, "fakebucket", sources, &NullSaver{})
+	must(t, err)
+	q := job.NewRequestQueue("requests", tracker.Reprocess, svc.Accepts)
+
+	post := func(method, body string) int {
+		req := httptest.NewRequest(method, "/v2/request", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp := httptest.NewRecorder()
+		q.Handler(resp, req)
+		return resp.Code
+	}
+	good := tracker.NewJob("fake-bucket", "ndt", "ndt5", start)
+	unknown := tracker.NewJob("fake-bucket", "ndt", "foobar", start)
+	form := func(j tracker.Job) string {
+		return url.Values{"job": {string(j.Marshal())}, "reason": {"test"}}.Encode()
+	}
+	if code := post(http.MethodGet, form(good)); code != http.StatusMethodNotAllowed {
+		t.Error("Expected 405", code)
+	}
+	if code := post(http.MethodPost, "job=garbage"); code != http.StatusBadRequest {
+		t.Error("Expected 400 for a bad job", code)
+	}
+	if code := post(http.MethodPost, form(unknown)); code != http.StatusBadRequest {
+		t.Error("Expected 400 for an unknown source", code)
+	}
+	if code := post(http.MethodPost, form(good)); code != http.StatusOK {
+		t.Error("Expected 200", code)
+	}
+	if diff := deep.Equal(q.Pending(), []tracker.Job{good}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Duplicates don't count towards the limit.
+	q.SetLimit(2)
+	if code := post(http.MethodPost, form(good)); code != http.StatusOK {
+		t.Error("Expected 200 for a duplicate", code)
+	}
+	next := tracker.NewJob("fake-bucket", "ndt", "ndt5", start.AddDate(0, 0, 1))
+	if code := post(http.MethodPost, form(next)); code != http.StatusOK {
+		t.Error("Expected 200", code)
+	}
+	full := tracker.NewJob("fake-bucket", "ndt", "ndt5", start.AddDate(0, 0, 2))
+	if code := post(http.MethodPost, form(full)); code != http.StatusTooManyRequests {
+		t.Error("Expected 429", code)
+	}
+	// Dispatched jobs make room, and may be requested again.
+	if j, ok := q.Next(ctx, start); !ok || j != good {
+		t.Error("Expected the first request", j)
+	}
+	if code := post(http.MethodPost, form(good)); code != http.StatusOK {
+		t.Error("Expected 200", code)
+	}
+	if diff := deep.Equal(q.Pending(), []tracker.Job{next, good}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestScanSource(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2011, 2, 16, 11, 2, 3, 4, time.UTC)
+	day := func(d int) time.Time { return time.Date(2011, 2, d, 0, 0, 0, 0, time.UTC) }
+	sources := []config.SourceConfig{
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "ndt5"},
+		{Bucket: "fake-bucket", Experiment: "ndt", Datatype: "custom", PathTemplate: "{{.Datatype}}"},
+	}
+	archives := []time.Time{day(10), day(12)}
+	var first, last time.Time
+	list := func(ctx context.Context, src config.SourceConfig, start, end time.Time) ([]time.Time, error) {
+		if src.PathTemplate != "" {
+			t.Error("Unexpected scan of", src.Datatype)
+		}
+		first, last = start, end
+		return archives, nil
+	}
+	s := job.NewScanSource(list, sources, tracker.Daily)
+
+	// The first scan is the baseline.
+	queued, err := s.Scan(ctx, now)
+	must(t, err)
+	if len(queued) != 0 {
+		t.Error("Expected no jobs from the first scan", queued)
+	}
+	if !first.Equal(day(8)) || !last.Equal(day(14)) {
+		t.Error("Wrong scan window", first, last)
+	}
+
+	archives = append(archives, day(11))
+	queued, err = s.Scan(ctx, now)
+	must(t, err)
+	want := tracker.NewJob("fake-bucket", "ndt", "ndt5", day(11))
+	if diff := deep.Equal(queued, []tracker.Job{want}); diff != nil {
+		t.Error(diff)
+	}
+	if j, ok := s.Next(ctx, now); !ok || j != want {
+		t.Error("Expected the new date", j, ok)
+	}
+	if _, ok := s.Next(ctx, now); ok {
+		t.Error("Expected no more jobs")
+	}
+}
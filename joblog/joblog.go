@@ -0,0 +1,246 @@
+// Package joblog streams a row for each completed or failed job into a
+// BigQuery table, e.g. gardener.job_log, for SQL analysis of pipeline
+// throughput and failure patterns over long periods.  Rows are written with
+// streaming inserts, or with the Storage Write API.
+package joblog
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"google.golang.org/api/googleapi"
+
+	"github.com/m-lab/etl-gardener/cloud/bqwrite"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// StateRow describes one state in a job's history.
+type StateRow struct {
+	State   string    `bigquery:"state"`
+	Start   time.Time `bigquery:"start"`
+	Seconds float64   `bigquery:"seconds"`
+	Detail  string    `bigquery:"detail"`
+}
+
+// Row describes a finished job.
+type Row struct {
+	Bucket     string    `bigquery:"bucket"`
+	Experiment string    `bigquery:"experiment"`
+	Datatype   string    `bigquery:"datatype"`
+	Date       time.Time `bigquery:"date"`
+	Prefix     string    `bigquery:"prefix"`
+
+	State   string    `bigquery:"state"` // The final state, e.g. Complete or Failed.
+	Error   string    `bigquery:"error"` // The failure detail, for failed jobs.
+	Start   time.Time `bigquery:"start"`
+	End     time.Time `bigquery:"end"`
+	Seconds float64   `bigquery:"seconds"`
+	Updates int64     `bigquery:"updates"`
+
+	ParsedFiles  int64      `bigquery:"parsed_files"`
+	ParsedRows   int64      `bigquery:"parsed_rows"`
+	ArchiveFiles int64      `bigquery:"archive_files"`
+	ArchiveBytes int64      `bigquery:"archive_bytes"`
+	BQJobID      string     `bigquery:"bq_job_id"`
+	States       []StateRow `bigquery:"states"`
+}
+
+// NewRow creates the Row for a finished job.
+func NewRow(j tracker.Job, s tracker.Status) Row {
+	last := s.LastStateInfo()
+	r := Row{
+		Bucket:     j.Bucket,
+		Experiment: j.Experiment,
+		Datatype:   j.Datatype,
+		Date:       j.Date,
+		Prefix:     j.Prefix,
+		State:      string(last.State),
+		Start:      s.History[0].Start,
+		End:        last.Start,
+		Updates:    int64(s.UpdateCount),
+		BQJobID:    s.BQJobID,
+	}
+	r.Seconds = r.End.Sub(r.Start).Seconds()
+	if last.State == tracker.Failed {
+		r.Error = s.Detail()
+	}
+	if s.ParseStats != nil {
+		r.ParsedFiles, r.ParsedRows = s.ParseStats.Files, s.ParseStats.Rows
+	}
+	if s.Inventory != nil {
+		r.ArchiveFiles, r.ArchiveBytes = s.Inventory.Files, s.Inventory.Bytes
+	}
+	for i, si := range s.History {
+		sr := StateRow{State: string(si.State), Start: si.Start, Detail: si.Detail}
+		if i+1 < len(s.History) {
+			sr.Seconds = s.History[i+1].Start.Sub(si.Start).Seconds()
+		}
+		r.States = append(r.States, sr)
+	}
+	return r
+}
+
+// values returns the row's columns, for encoding with bqwrite.
+func (r Row) values() map[string]bigquery.Value {
+	states := make([]bigquery.Value, 0, len(r.States))
+	for _, s := range r.States {
+		states = append(states, map[string]bigquery.Value{
+			"state": s.State, "start": s.Start, "seconds": s.Seconds, "detail": s.Detail,
+		})
+	}
+	return map[string]bigquery.Value{
+		"bucket":        r.Bucket,
+		"experiment":    r.Experiment,
+		"datatype":      r.Datatype,
+		"date":          r.Date,
+		"prefix":        r.Prefix,
+		"state":         r.State,
+		"error":         r.Error,
+		"start":         r.Start,
+		"end":           r.End,
+		"seconds":       r.Seconds,
+		"updates":       r.Updates,
+		"parsed_files":  r.ParsedFiles,
+		"parsed_rows":   r.ParsedRows,
+		"archive_files": r.ArchiveFiles,
+		"archive_bytes": r.ArchiveBytes,
+		"bq_job_id":     r.BQJobID,
+		"states":        states,
+	}
+}
+
+// Schema returns the schema of the job log table.
+func Schema() (bigquery.Schema, error) {
+	return bigquery.InferSchema(Row{})
+}
+
+// maxPending limits the rows held for retry, in batches, when inserts fail.
+const maxPending = 10
+
+// Logger batches job rows, and streams them into a table.
+type Logger struct {
+	table     bqiface.Table
+	writer    *bqwrite.Writer // Writes rows with the Storage Write API, if not nil.
+	batchSize int
+	rows      chan Row
+}
+
+// New creates a Logger for the table.  Rows are inserted in batches of up
+// to batchSize.
+func New(table bqiface.Table, batchSize int) *Logger {
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	return &Logger{table: table, batchSize: batchSize, rows: make(chan Row, maxPending*batchSize)}
+}
+
+// EnsureTable creates the table, partitioned by job end time, if it does
+// not exist.
+func (l *Logger) EnsureTable(ctx context.Context) error {
+	_, err := l.table.Metadata(ctx)
+	var gerr *googleapi.Error
+	if err == nil || !errors.As(err, &gerr) || gerr.Code != http.StatusNotFound {
+		return err
+	}
+	schema, err := Schema()
+	if err != nil {
+		return err
+	}
+	log.Println("Creating job log table", l.table.FullyQualifiedName())
+	return l.table.Create(ctx, &bigquery.TableMetadata{
+		Schema: schema,
+		TimePartitioning: &bigquery.TimePartitioning{
+			Type:  bigquery.DayPartitioningType,
+			Field: "end",
+		},
+	})
+}
+
+// UseWriteAPI writes rows with the Storage Write API, instead of streaming
+// inserts.  The writer must encode rows with the table's Schema.  Should be
+// called before Run.
+func (l *Logger) UseWriteAPI(w *bqwrite.Writer) {
+	l.writer = w
+}
+
+// Observe is a tracker.Observer that queues a row for each job that
+// completes or fails.  Rows are dropped if the queue is full.
+func (l *Logger) Observe(j tracker.Job, s tracker.Status) {
+	switch s.State() {
+	case tracker.Complete, tracker.PartialComplete, tracker.Failed:
+	default:
+		return
+	}
+	select {
+	case l.rows <- NewRow(j, s):
+	default:
+		metrics.JobLogRows.WithLabelValues("dropped").Inc()
+	}
+}
+
+// insert writes the batch into the table.  Returns the number of leading
+// rows written.  The rest should be retried.
+func (l *Logger) insert(ctx context.Context, batch []Row) int {
+	if len(batch) == 0 {
+		return 0
+	}
+	var err error
+	n := len(batch)
+	if l.writer != nil {
+		values := make([]map[string]bigquery.Value, 0, len(batch))
+		for _, r := range batch {
+			values = append(values, r.values())
+		}
+		n, err = l.writer.Write(ctx, values)
+	} else if err = l.table.Uploader().Put(ctx, batch); err != nil {
+		n = 0
+	}
+	metrics.JobLogRows.WithLabelValues("inserted").Add(float64(n))
+	if err != nil {
+		log.Println("Job log insert failed:", err)
+		metrics.JobLogRows.WithLabelValues("error").Add(float64(len(batch) - n))
+	}
+	return n
+}
+
+// Run inserts queued rows every interval, or whenever a batch is full,
+// until ctx is done.  Remaining rows are then inserted, if possible.
+func (l *Logger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	batch := []Row{}
+	flush := func(ctx context.Context) {
+		n := l.insert(ctx, batch)
+		batch = append(batch[:0], batch[n:]...)
+		if len(batch) >= maxPending*l.batchSize {
+			// Don't hold unbounded rows while BigQuery is unavailable.
+			metrics.JobLogRows.WithLabelValues("dropped").Add(float64(len(batch)))
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			for len(l.rows) > 0 {
+				batch = append(batch, <-l.rows)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			flush(ctx)
+			cancel()
+			return
+		case r := <-l.rows:
+			batch = append(batch, r)
+			if len(batch)%l.batchSize == 0 {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package joblog_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/cloud/bqwrite"
+	"github.com/m-lab/etl-gardener/joblog"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestNewRow(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, time.Hour)
+	rtx.Must(err, "tk init")
+	j := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(j), "add job")
+	rtx.Must(tk.SetStatus(j, tracker.Parsing, "parsing"), "set status")
+	rtx.Must(tk.SetParseStats(j, tracker.ParseStats{Files: 3, Rows: 100}), "set stats")
+	rtx.Must(tk.SetInventory(j, tracker.Inventory{Files: 3, Bytes: 1000}), "set inventory")
+	rtx.Must(tk.SetJobError(j, "bad"), "set error")
+	s, err := tk.GetStatus(j)
+	rtx.Must(err, "GetStatus")
+
+	r := joblog.NewRow(j, s)
+	if r.Experiment != "ndt" || r.Datatype != "ndt7" || !r.Date.Equal(j.Date) {
+		t.Errorf("Wrong job fields %+v", r)
+	}
+	if r.State != string(tracker.Failed) || r.Error != "parsing: bad" {
+		t.Errorf("Wrong final state %+v", r)
+	}
+	if r.ParsedRows != 100 || r.ArchiveBytes != 1000 {
+		t.Errorf("Wrong counts %+v", r)
+	}
+	// The detail of a state change is recorded on the previous state.
+	if len(r.States) != 3 || r.States[1].State != string(tracker.Parsing) || r.States[0].Detail != "parsing" {
+		t.Errorf("Wrong states %+v", r.States)
+	}
+	if r.End.Before(r.Start) || r.Seconds < 0 {
+		t.Errorf("Wrong timing %+v", r)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client := bqfake.NewClient("project")
+	client.AddDataset("gardener")
+	table := client.Dataset("gardener").Table("job_log")
+
+	l := joblog.New(table, 2)
+	rtx.Must(l.EnsureTable(ctx), "EnsureTable")
+	if _, err := table.Metadata(ctx); err != nil {
+		t.Fatal("Expected table to be created", err)
+	}
+	// A second call is a no-op.
+	rtx.Must(l.EnsureTable(ctx), "EnsureTable")
+
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, time.Hour)
+	rtx.Must(err, "tk init")
+	tk.AddObserver(l.Observe)
+	done := make(chan struct{})
+	go func() {
+		l.Run(ctx, time.Hour)
+		close(done)
+	}()
+
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		j := tracker.NewJob("bucket", "ndt", "ndt7", date.AddDate(0, 0, i))
+		rtx.Must(tk.AddJob(j), "add job")
+		rtx.Must(tk.SetStatus(j, tracker.Parsing, ""), "set status")
+		rtx.Must(tk.SetStatus(j, tracker.Complete, ""), "set status")
+	}
+
+	// The first batch of two is inserted when full.
+	for i := 0; i < 500 && len(client.Inserted("gardener", "job_log")) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(client.Inserted("gardener", "job_log")); n != 2 {
+		t.Error("Expected a full batch, got", n)
+	}
+
+	// The remaining row is inserted on shutdown.
+	cancel()
+	<-done
+	rows := client.Inserted("gardener", "job_log")
+	if len(rows) != 3 {
+		t.Fatal("Expected 3 rows, got", len(rows))
+	}
+	if r := rows[2].(joblog.Row); r.State != string(tracker.Complete) || !r.Date.Equal(date.AddDate(0, 0, 2)) {
+		t.Errorf("Wrong row %+v", r)
+	}
+}
+
+// fakeAppender counts the rows appended, and fails the first appends.
+type fakeAppender struct {
+	lock  sync.Mutex
+	rows  int
+	fails int
+}
+
+func (f *fakeAppender) Append(ctx context.Context, rows [][]byte, offset int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.fails > 0 {
+		f.fails--
+		return errors.New("unavailable")
+	}
+	if offset != int64(f.rows) {
+		return errors.New("wrong offset")
+	}
+	f.rows += len(rows)
+	return nil
+}
+
+func TestLoggerWriteAPI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client := bqfake.NewClient("project")
+	client.AddDataset("gardener")
+	table := client.Dataset("gardener").Table("job_log")
+
+	schema, err := joblog.Schema()
+	rtx.Must(err, "Schema")
+	enc, err := bqwrite.NewEncoder(schema)
+	rtx.Must(err, "NewEncoder")
+	app := &fakeAppender{fails: 1}
+	w := bqwrite.NewWriter("job_log", app, enc)
+	w.Retries = 0
+
+	l := joblog.New(table, 2)
+	l.UseWriteAPI(w)
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, time.Hour)
+	rtx.Must(err, "tk init")
+	tk.AddObserver(l.Observe)
+	done := make(chan struct{})
+	go func() {
+		l.Run(ctx, time.Hour)
+		close(done)
+	}()
+
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		j := tracker.NewJob("bucket", "ndt", "ndt7", date.AddDate(0, 0, i))
+		rtx.Must(tk.AddJob(j), "add job")
+		rtx.Must(tk.SetStatus(j, tracker.Parsing, ""), "set status")
+		rtx.Must(tk.SetStatus(j, tracker.Complete, ""), "set status")
+	}
+
+	// The first batch fails, and is written with the remaining row on
+	// shutdown.
+	for i := 0; i < 500; i++ {
+		app.lock.Lock()
+		fails := app.fails
+		app.lock.Unlock()
+		if fails == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if app.rows != 3 {
+		t.Error("Expected 3 rows, got", app.rows)
+	}
+	if n := len(client.Inserted("gardener", "job_log")); n != 0 {
+		t.Error("Expected no streaming inserts, got", n)
+	}
+}
@@ -0,0 +1,128 @@
+// Package leader provides leader election among gardener replicas, so that
+// one replica actively dispatches and processes jobs, while the standbys
+// serve read-only status, and take over when the leader stops renewing its
+// lease.  The lease is a persistence.NamespaceLock.
+package leader
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/persistence"
+)
+
+// ErrNotLeader is returned by Check when this instance is a standby.
+var ErrNotLeader = errors.New("not the leader")
+
+// Lease is the lease shared by all replicas, e.g. a persistence.Locker.
+type Lease interface {
+	Acquire(ctx context.Context) error
+	Release(ctx context.Context) error
+}
+
+// Elector campaigns for, and holds, the lease.
+type Elector struct {
+	lease Lease
+	ttl   time.Duration // Lease duration.
+
+	leading int32 // Accessed atomically.  Non-zero while leading.
+}
+
+// New creates an Elector.  The ttl must match the lease duration.
+func New(lease Lease, ttl time.Duration) *Elector {
+	return &Elector{lease: lease, ttl: ttl}
+}
+
+// IsLeader returns true while this instance holds the lease.
+func (e *Elector) IsLeader() bool {
+	return atomic.LoadInt32(&e.leading) != 0
+}
+
+// Check returns ErrNotLeader for standbys, e.g. for a readiness check, so
+// that only the leader receives parser traffic.
+func (e *Elector) Check(ctx context.Context) error {
+	if !e.IsLeader() {
+		return ErrNotLeader
+	}
+	return nil
+}
+
+func (e *Elector) setLeading(leading bool, event string) {
+	if leading {
+		atomic.StoreInt32(&e.leading, 1)
+		metrics.Leader.Set(1)
+	} else {
+		atomic.StoreInt32(&e.leading, 0)
+		metrics.Leader.Set(0)
+	}
+	metrics.LeadershipChanges.WithLabelValues(event).Inc()
+	log.Println("Leadership", event)
+}
+
+// Campaign blocks until this instance acquires the lease, or ctx is done.
+// While waiting, standby is called after each attempt, e.g. to refresh
+// read-only status.  Attempts are made every quarter of the ttl.
+func (e *Elector) Campaign(ctx context.Context, standby func()) error {
+	metrics.Leader.Set(0)
+	ticker := time.NewTicker(e.ttl / 4)
+	defer ticker.Stop()
+	for {
+		err := e.lease.Acquire(ctx)
+		if err == nil {
+			e.setLeading(true, "acquired")
+			return nil
+		}
+		if !errors.Is(err, persistence.ErrNamespaceLocked) {
+			log.Println("Leader election error:", err)
+		}
+		if standby != nil {
+			standby()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Hold renews the lease every quarter of the ttl, until ctx is done.  If
+// another instance takes the lease, or the lease can't be renewed before it
+// expires, lost is called.  The leader should then stop acting on jobs,
+// usually by exiting.
+func (e *Elector) Hold(ctx context.Context, lost func()) {
+	ticker := time.NewTicker(e.ttl / 4)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := e.lease.Acquire(ctx)
+		if err == nil {
+			renewed = time.Now()
+			continue
+		}
+		log.Println("Lease renewal error:", err)
+		if errors.Is(err, persistence.ErrNamespaceLocked) || time.Since(renewed) >= e.ttl {
+			e.setLeading(false, "lost")
+			lost()
+			return
+		}
+	}
+}
+
+// Resign releases the lease, so that a standby can take over immediately.
+func (e *Elector) Resign(ctx context.Context) error {
+	if !e.IsLeader() {
+		return nil
+	}
+	e.setLeading(false, "resigned")
+	return e.lease.Release(ctx)
+}
@@ -0,0 +1,81 @@
+package leader_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/leader"
+	"github.com/m-lab/etl-gardener/persistence"
+)
+
+func TestElector(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir, err := ioutil.TempDir("", "leader")
+	rtx.Must(err, "TempDir")
+	defer os.RemoveAll(dir)
+	fs, err := persistence.NewFileSaver(dir)
+	rtx.Must(err, "NewFileSaver")
+
+	ttl := 100 * time.Millisecond
+	a := leader.New(persistence.NewLocker(fs, "a", ttl), ttl)
+	b := leader.New(persistence.NewLocker(fs, "b", ttl), ttl)
+
+	rtx.Must(a.Campaign(ctx, nil), "Campaign")
+	if !a.IsLeader() || a.Check(ctx) != nil {
+		t.Error("a should be leader")
+	}
+	holdCtx, holdCancel := context.WithCancel(ctx)
+	go a.Hold(holdCtx, func() { t.Error("a should not lose the lease") })
+
+	// b remains a standby while a holds the lease.
+	standbys := 0
+	shortCtx, shortCancel := context.WithTimeout(ctx, 3*ttl)
+	defer shortCancel()
+	err = b.Campaign(shortCtx, func() { standbys++ })
+	if err != context.DeadlineExceeded || b.IsLeader() || standbys < 2 {
+		t.Error("b should be standby", err, standbys)
+	}
+	if !errors.Is(b.Check(ctx), leader.ErrNotLeader) {
+		t.Error("Expected ErrNotLeader")
+	}
+
+	// b takes over promptly when a resigns.
+	holdCancel()
+	rtx.Must(a.Resign(ctx), "Resign")
+	if a.IsLeader() {
+		t.Error("a should not be leader after resigning")
+	}
+	rtx.Must(b.Campaign(ctx, nil), "Campaign")
+	if !b.IsLeader() {
+		t.Error("b should be leader")
+	}
+}
+
+// stolenLease is a lease that has been taken by another instance.
+type stolenLease struct{}
+
+func (stolenLease) Acquire(ctx context.Context) error {
+	return persistence.ErrNamespaceLocked
+}
+func (stolenLease) Release(ctx context.Context) error { return nil }
+
+func TestHoldLost(t *testing.T) {
+	e := leader.New(stolenLease{}, 20*time.Millisecond)
+	lost := make(chan struct{})
+	go e.Hold(context.Background(), func() { close(lost) })
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected lost lease")
+	}
+	if e.IsLeader() {
+		t.Error("Should not be leader")
+	}
+}
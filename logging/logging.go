@@ -0,0 +1,162 @@
+// Package logging provides a structured logger, that attaches context fields,
+// such as the experiment, datatype, date and state of a job, to every log line.
+//
+// By default, lines are written through the standard log package, with the
+// fields appended as key=value pairs.  With SetJSON(true), each line is
+// written as a JSON object, in the format expected by Stackdriver.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severity levels, as used by Stackdriver.
+const (
+	Info    = "INFO"
+	Warning = "WARNING"
+	Error   = "ERROR"
+)
+
+var (
+	lock       sync.Mutex
+	jsonOutput bool
+	out        io.Writer = os.Stderr
+)
+
+// SetJSON selects JSON output if true, or standard log output if false.
+func SetJSON(enable bool) {
+	lock.Lock()
+	defer lock.Unlock()
+	jsonOutput = enable
+}
+
+// SetOutput sets the destination for JSON output.  Text output goes to the
+// standard log package destination.
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	defer lock.Unlock()
+	out = w
+}
+
+// Field is a single key/value pair attached to log lines.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger writes log lines with a fixed set of fields.
+// Loggers are immutable, and safe for concurrent use.
+type Logger struct {
+	fields []Field
+}
+
+var std = &Logger{}
+
+// With returns a Logger with the additional field.
+func With(key string, value interface{}) *Logger {
+	return std.With(key, value)
+}
+
+// With returns a copy of the Logger with the additional field.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]Field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{fields: append(fields, Field{Key: key, Value: value})}
+}
+
+// Fields returns the fields attached to the Logger.
+func (l *Logger) Fields() []Field {
+	return append([]Field(nil), l.fields...)
+}
+
+// Println logs at Info severity.  Arguments are handled like log.Println.
+func (l *Logger) Println(v ...interface{}) {
+	l.output(Info, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// Printf logs at Info severity.  Arguments are handled like log.Printf.
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.output(Info, strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+}
+
+// Warningln logs at Warning severity.
+func (l *Logger) Warningln(v ...interface{}) {
+	l.output(Warning, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// Errorln logs at Error severity.
+func (l *Logger) Errorln(v ...interface{}) {
+	l.output(Error, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// sourceLocation is the Stackdriver representation of the caller.
+type sourceLocation struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+// output writes a single log line.  It must be called directly from one of
+// the exported logging methods, so that the caller is correctly identified.
+func (l *Logger) output(severity, msg string) {
+	const callDepth = 3
+
+	lock.Lock()
+	useJSON, w := jsonOutput, out
+	lock.Unlock()
+
+	if !useJSON {
+		b := strings.Builder{}
+		b.WriteString(msg)
+		if severity != Info {
+			b.WriteString(" severity=" + severity)
+		}
+		for _, f := range l.fields {
+			fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+		}
+		log.Output(callDepth, b.String())
+		return
+	}
+
+	entry := make(map[string]interface{}, len(l.fields)+4)
+	for _, f := range l.fields {
+		entry[f.Key] = fmt.Sprint(f.Value)
+	}
+	entry["severity"] = severity
+	entry["message"] = msg
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	if _, file, line, ok := runtime.Caller(callDepth - 1); ok {
+		entry["logging.googleapis.com/sourceLocation"] = sourceLocation{File: file, Line: line}
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Println(err, msg)
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	w.Write(append(b, '\n'))
+}
+
+type loggerKey struct{}
+
+// NewContext returns a context carrying the Logger.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the Logger carried by ctx, or a Logger with no fields.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return std
+}
@@ -0,0 +1,71 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/etl-gardener/logging"
+)
+
+func TestText(t *testing.T) {
+	buf := bytes.Buffer{}
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	flags := log.Flags()
+	log.SetFlags(log.Lshortfile)
+	defer log.SetFlags(flags)
+
+	l := logging.With("experiment", "ndt").With("datatype", "ndt7")
+	l.Println("hello", 42)
+	l.Errorln("failed")
+	got := buf.String()
+	if !strings.Contains(got, "logging_test.go:") {
+		t.Error("Missing caller:", got)
+	}
+	if !strings.Contains(got, "hello 42 experiment=ndt datatype=ndt7\n") {
+		t.Error("Wrong output:", got)
+	}
+	if !strings.Contains(got, "failed severity=ERROR experiment=ndt") {
+		t.Error("Wrong error output:", got)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buf := bytes.Buffer{}
+	logging.SetOutput(&buf)
+	logging.SetJSON(true)
+	defer logging.SetJSON(false)
+
+	base := logging.With("experiment", "ndt")
+	ctx := logging.NewContext(context.Background(), base.With("state", "loading"))
+	logging.FromContext(ctx).Printf("took %d seconds\n", 3)
+	if len(base.Fields()) != 1 {
+		t.Error("With should not modify the original logger", base.Fields())
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	want := map[string]string{
+		"message": "took 3 seconds", "severity": "INFO",
+		"experiment": "ndt", "state": "loading"}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("%s: got %v, want %s", k, entry[k], v)
+		}
+	}
+	loc, ok := entry["logging.googleapis.com/sourceLocation"].(map[string]interface{})
+	if !ok || !strings.HasSuffix(loc["file"].(string), "logging_test.go") {
+		t.Error("Wrong source location", entry)
+	}
+
+	if len(logging.FromContext(context.Background()).Fields()) != 0 {
+		t.Error("Expected default logger")
+	}
+}
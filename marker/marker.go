@@ -0,0 +1,148 @@
+// Package marker writes a small JSON "done" marker object to GCS for each
+// completed job, so that downstream consumers can trigger on object-create
+// notifications instead of polling the gardener API.
+package marker
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"path"
+	"time"
+
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// DefaultPrefix is the object prefix for markers, if none is configured.
+const DefaultPrefix = "gardener/done"
+
+// Marker is the content of a done marker object.
+type Marker struct {
+	Experiment string
+	Datatype   string
+	Date       string // YYYY-MM-DD
+	Prefix     string `json:",omitempty"`
+	State      string // Complete or PartialComplete.
+	Version    string `json:",omitempty"` // The parser release, if reported.
+
+	Start   time.Time // When the job was added.
+	End     time.Time // When the job completed.
+	Written time.Time // When the marker was written.
+
+	ParsedFiles  int64
+	ParsedRows   int64
+	ArchiveFiles int64
+	ArchiveBytes int64
+}
+
+// New creates the Marker for a completed job.
+func New(j tracker.Job, s tracker.Status) Marker {
+	m := Marker{
+		Experiment: j.Experiment,
+		Datatype:   j.Datatype,
+		Date:       j.Date.Format("2006-01-02"),
+		Prefix:     j.Prefix,
+		State:      string(s.State()),
+		Version:    s.Version,
+		Start:      s.StartTime(),
+		End:        s.StateChangeTime(),
+	}
+	if s.ParseStats != nil {
+		m.ParsedFiles, m.ParsedRows = s.ParseStats.Files, s.ParseStats.Rows
+	}
+	if s.Inventory != nil {
+		m.ArchiveFiles, m.ArchiveBytes = s.Inventory.Files, s.Inventory.Bytes
+	}
+	return m
+}
+
+// Name returns the object name of the marker for the job, within prefix,
+// e.g. gardener/done/ndt/ndt7/2020-06-01.json.  Partial jobs have the job
+// Prefix appended to the date, e.g. 2020-06-01_20200601T15.json.
+func Name(prefix string, j tracker.Job) string {
+	file := j.Date.Format("2006-01-02")
+	if j.Prefix != "" {
+		file += "_" + j.Prefix
+	}
+	return path.Join(prefix, j.Experiment, j.Datatype, file+".json")
+}
+
+// maxQueued limits the markers waiting to be written.
+const maxQueued = 1000
+
+type queued struct {
+	job    tracker.Job
+	marker Marker
+}
+
+// Writer writes markers for completed jobs to a GCS bucket.
+type Writer struct {
+	client stiface.Client
+	bucket string
+	prefix string
+	queue  chan queued
+}
+
+// NewWriter creates a Writer for markers in bucket, under prefix.
+func NewWriter(client stiface.Client, bucket, prefix string) *Writer {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	return &Writer{client: client, bucket: bucket, prefix: prefix, queue: make(chan queued, maxQueued)}
+}
+
+// Observe is a tracker.Observer that queues a marker for each job that
+// completes.  Markers are dropped if the queue is full.
+func (w *Writer) Observe(j tracker.Job, s tracker.Status) {
+	switch s.State() {
+	case tracker.Complete, tracker.PartialComplete:
+	default:
+		return
+	}
+	select {
+	case w.queue <- queued{job: j, marker: New(j, s)}:
+	default:
+		metrics.DoneMarkers.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Write writes the marker object for the job, replacing any existing
+// marker, e.g. from an earlier processing of the same date.
+func (w *Writer) Write(ctx context.Context, j tracker.Job, m Marker) error {
+	m.Written = time.Now().UTC()
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	ow := w.client.Bucket(w.bucket).Object(Name(w.prefix, j)).NewWriter(ctx)
+	ow.ObjectAttrs().ContentType = "application/json"
+	if _, err := ow.Write(b); err != nil {
+		ow.Close()
+		return err
+	}
+	return ow.Close()
+}
+
+// Run writes queued markers until ctx is done.  Failed writes are logged
+// and not retried.
+func (w *Writer) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case q := <-w.queue:
+			wctx, cancel := context.WithTimeout(ctx, time.Minute)
+			err := w.Write(wctx, q.job, q.marker)
+			cancel()
+			if err != nil {
+				log.Println("Done marker write failed:", q.job, err)
+				metrics.DoneMarkers.WithLabelValues("error").Inc()
+				continue
+			}
+			metrics.DoneMarkers.WithLabelValues("written").Inc()
+		}
+	}
+}
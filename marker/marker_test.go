@@ -0,0 +1,132 @@
+package marker_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/marker"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// fakeClient records the objects written to it, by bucket/name.
+type fakeClient struct {
+	stiface.Client
+	lock    sync.Mutex
+	objects map[string][]byte
+	types   map[string]string
+}
+
+func (f *fakeClient) Bucket(name string) stiface.BucketHandle {
+	return &fakeBucketHandle{client: f, bucket: name}
+}
+
+func (f *fakeClient) object(name string) ([]byte, string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.objects[name], f.types[name]
+}
+
+type fakeBucketHandle struct {
+	stiface.BucketHandle
+	client *fakeClient
+	bucket string
+}
+
+func (bh *fakeBucketHandle) Object(name string) stiface.ObjectHandle {
+	return &fakeObjectHandle{client: bh.client, name: bh.bucket + "/" + name}
+}
+
+type fakeObjectHandle struct {
+	stiface.ObjectHandle
+	client *fakeClient
+	name   string
+}
+
+func (oh *fakeObjectHandle) NewWriter(ctx context.Context) stiface.Writer {
+	return &fakeWriter{handle: oh}
+}
+
+type fakeWriter struct {
+	stiface.Writer
+	handle *fakeObjectHandle
+	attrs  storage.ObjectAttrs
+	buf    bytes.Buffer
+}
+
+func (w *fakeWriter) ObjectAttrs() *storage.ObjectAttrs { return &w.attrs }
+func (w *fakeWriter) Write(p []byte) (int, error)       { return w.buf.Write(p) }
+func (w *fakeWriter) Close() error {
+	c := w.handle.client
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.objects[w.handle.name] = w.buf.Bytes()
+	c.types[w.handle.name] = w.attrs.ContentType
+	return nil
+}
+
+func TestName(t *testing.T) {
+	j := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	if n := marker.Name(marker.DefaultPrefix, j); n != "gardener/done/ndt/ndt7/2020-06-01.json" {
+		t.Error("Wrong name", n)
+	}
+	j.Prefix = "20200601T15"
+	if n := marker.Name("done/", j); n != "done/ndt/ndt7/2020-06-01_20200601T15.json" {
+		t.Error("Wrong name", n)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fc := &fakeClient{objects: map[string][]byte{}, types: map[string]string{}}
+	w := marker.NewWriter(fc, "markers", "")
+	go w.Run(ctx)
+
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, time.Hour)
+	rtx.Must(err, "tk init")
+	tk.AddObserver(w.Observe)
+	done := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	failed := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 2, 0, 0, 0, 0, time.UTC))
+	for _, j := range []tracker.Job{done, failed} {
+		rtx.Must(tk.AddJob(j), "add job")
+	}
+	rtx.Must(tk.SetParseStats(done, tracker.ParseStats{Files: 3, Rows: 100}), "set stats")
+	rtx.Must(tk.SetInventory(done, tracker.Inventory{Files: 3, Bytes: 1000}), "set inventory")
+	rtx.Must(tk.SetVersion(done, "v2.3.4"), "set version")
+	rtx.Must(tk.SetJobError(failed, "bad"), "set error")
+	rtx.Must(tk.SetStatus(done, tracker.Complete, ""), "set status")
+
+	name := "markers/gardener/done/ndt/ndt7/2020-06-01.json"
+	var b []byte
+	var contentType string
+	for i := 0; i < 500 && b == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		b, contentType = fc.object(name)
+	}
+	if b == nil {
+		t.Fatal("Expected marker", name)
+	}
+	if contentType != "application/json" {
+		t.Error("Wrong content type", contentType)
+	}
+	var m marker.Marker
+	rtx.Must(json.Unmarshal(b, &m), "unmarshal")
+	if m.Experiment != "ndt" || m.Date != "2020-06-01" || m.State != string(tracker.Complete) ||
+		m.Version != "v2.3.4" {
+		t.Errorf("Wrong marker %+v", m)
+	}
+	if m.ParsedRows != 100 || m.ArchiveBytes != 1000 || m.End.Before(m.Start) || m.Written.IsZero() {
+		t.Errorf("Wrong marker counts or times %+v", m)
+	}
+	if b, _ := fc.object("markers/gardener/done/ndt/ndt7/2020-06-02.json"); b != nil {
+		t.Error("Failed jobs should not have markers")
+	}
+}
@@ -94,8 +94,67 @@ var (
 		[]string{"experiment", "datatype", "state"},
 	)
 
-	// StateTimeHistogram tracks the time spent in each state.  Not necessary to label data type, as
-	// we currently have separate gardener deployments for each type.
+	// JobsByState counts the jobs currently in the tracker in each state.
+	//
+	// Provides metrics:
+	//   gardener_jobs_by_state{state}
+	// Example usage:
+	// metrics.JobsByState.WithLabelValues(state).Set(count)
+	JobsByState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gardener_jobs_by_state",
+			Help: "Number of jobs in the tracker in each state.",
+		},
+		[]string{"state"},
+	)
+
+	// OldestPendingDate identifies the oldest date still pending for each datatype,
+	// so that alerts can fire when the backlog grows.
+	//
+	// Provides metrics:
+	//   gardener_oldest_pending_date_seconds{experiment, datatype}
+	// Example usage:
+	// metrics.OldestPendingDate.WithLabelValues(exp, dt).Set(float64(date.Unix()))
+	OldestPendingDate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gardener_oldest_pending_date_seconds",
+			Help: "Oldest date with a job still pending, as seconds since epoch.",
+		},
+		[]string{"experiment", "datatype"},
+	)
+
+	// LastCompleteDate identifies the newest date completed for each datatype,
+	// so that alerts can fire when no new date completes within the expected
+	// window.
+	//
+	// Provides metrics:
+	//   gardener_last_complete_date{experiment, datatype}
+	// Example usage:
+	// metrics.LastCompleteDate.WithLabelValues(exp, dt).Set(float64(date.Unix()))
+	LastCompleteDate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gardener_last_complete_date",
+			Help: "Newest date with a complete job, as seconds since epoch.",
+		},
+		[]string{"experiment", "datatype"},
+	)
+
+	// LastCompleteTimestamp identifies when a job last completed for each
+	// datatype.
+	//
+	// Provides metrics:
+	//   gardener_last_complete_timestamp{experiment, datatype}
+	// Example usage:
+	// metrics.LastCompleteTimestamp.WithLabelValues(exp, dt).SetToCurrentTime()
+	LastCompleteTimestamp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gardener_last_complete_timestamp",
+			Help: "Time of the most recent job completion, as seconds since epoch.",
+		},
+		[]string{"experiment", "datatype"},
+	)
+
+	// StateTimeHistogram tracks the time spent in each state, by experiment and datatype.
 	// Usage example:
 	//   metrics.StateTimeHistogram.WithLabelValues(
 	//           exp, dt, StateName[state]).Observe(time.Since(start).Seconds())
@@ -111,6 +170,52 @@ var (
 		},
 		[]string{"experiment", "datatype", "state"})
 
+	// StateTransitionCount counts the transitions between job states.
+	//
+	// Provides metrics:
+	//   gardener_state_transitions_total{experiment, datatype, from, to}
+	// Example usage:
+	//   metrics.StateTransitionCount.WithLabelValues(exp, dt, "loading", "deduplicating").Inc()
+	StateTransitionCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_state_transitions_total",
+			Help: "Number of job state transitions.",
+		},
+		[]string{"experiment", "datatype", "from", "to"},
+	)
+
+	// StateFailureCount counts the jobs that failed in each state.
+	//
+	// Provides metrics:
+	//   gardener_state_failures_total{experiment, datatype, state}
+	// Example usage:
+	//   metrics.StateFailureCount.WithLabelValues(exp, dt, "copying").Inc()
+	StateFailureCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_state_failures_total",
+			Help: "Number of jobs that failed, by the state in which they failed.",
+		},
+		[]string{"experiment", "datatype", "state"},
+	)
+
+	// JobDurationHistogram tracks the total time from job creation to completion.
+	//
+	// Provides metrics:
+	//   gardener_job_duration_seconds{experiment, datatype}
+	// Example usage:
+	//   metrics.JobDurationHistogram.WithLabelValues(exp, dt).Observe(elapsed.Seconds())
+	JobDurationHistogram = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "gardener_job_duration_seconds",
+			Help: "Time from job creation to completion.",
+			// These values range from minutes to days.
+			Buckets: []float64{
+				60, 300, 600, 1800, 3600, 2 * 3600, 4 * 3600, 8 * 3600,
+				12 * 3600, 24 * 3600, 2 * 24 * 3600, 4 * 24 * 3600,
+			},
+		},
+		[]string{"experiment", "datatype"})
+
 	// FilesPerDateHistogram provides a histogram of files per date submitted to pipeline.
 	//
 	// Provides metrics:
@@ -162,6 +267,801 @@ var (
 		[]string{"experiment", "datatype", "year"},
 	)
 
+	// TmpPartitionsSwept counts the orphaned tmp partitions deleted by the sweeper.
+	//
+	// Provides metrics:
+	//   gardener_tmp_partitions_swept_total{experiment, datatype}
+	// Example usage:
+	// metrics.TmpPartitionsSwept.WithLabelValues(exp, dt).Add(n)
+	TmpPartitionsSwept = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_tmp_partitions_swept_total",
+			Help: "Number of orphaned tmp partitions deleted.",
+		},
+		[]string{"experiment", "datatype"},
+	)
+
+	// TmpBytesReclaimed counts the logical bytes of tmp partitions deleted by the sweeper.
+	//
+	// Provides metrics:
+	//   gardener_tmp_bytes_reclaimed_total{experiment, datatype}
+	// Example usage:
+	// metrics.TmpBytesReclaimed.WithLabelValues(exp, dt).Add(bytes)
+	TmpBytesReclaimed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_tmp_bytes_reclaimed_total",
+			Help: "Logical bytes reclaimed by deleting orphaned tmp partitions.",
+		},
+		[]string{"experiment", "datatype"},
+	)
+
+	// TmpBytes is the most recent total logical size of a tmp dataset.
+	//
+	// Provides metrics:
+	//   gardener_tmp_bytes{dataset}
+	// Example usage:
+	// metrics.TmpBytes.WithLabelValues(dataset).Set(bytes)
+	TmpBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gardener_tmp_bytes",
+			Help: "Logical bytes in all partitions of a tmp dataset.",
+		},
+		[]string{"dataset"},
+	)
+
+	// TmpBackPressure is 1 while dispatch is paused because the tmp datasets
+	// are too large, and 0 otherwise.
+	//
+	// Provides metrics:
+	//   gardener_tmp_back_pressure
+	// Example usage:
+	// metrics.TmpBackPressure.Set(1)
+	TmpBackPressure = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gardener_tmp_back_pressure",
+			Help: "Whether dispatch is paused because the tmp datasets are too large.",
+		},
+	)
+
+	// LaneDispatches counts the jobs dispatched to the parsers in each lane,
+	// i.e. daily or reprocess.
+	//
+	// Provides metrics:
+	//   gardener_lane_dispatches_total{lane}
+	// Example usage:
+	// metrics.LaneDispatches.WithLabelValues("daily").Inc()
+	LaneDispatches = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_lane_dispatches_total",
+			Help: "Number of jobs dispatched in each lane.",
+		},
+		[]string{"lane"},
+	)
+
+	// SourceJobs counts the jobs taken from each job source, e.g.
+	// "yesterday" or "requests", for dispatch.
+	//
+	// Provides metrics:
+	//   gardener_source_jobs_total{source}
+	// Example usage:
+	// metrics.SourceJobs.WithLabelValues("requests").Inc()
+	SourceJobs = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_source_jobs_total",
+			Help: "Number of jobs taken from each job source.",
+		},
+		[]string{"source"},
+	)
+
+	// JobRequests counts the jobs requested through a RequestQueue, over
+	// HTTP or Pub/Sub, by outcome, which is "queued", "duplicate",
+	// "rejected" or "full".
+	//
+	// Provides metrics:
+	//   gardener_job_requests_total{source, outcome}
+	// Example usage:
+	// metrics.JobRequests.WithLabelValues("requests", "queued").Inc()
+	JobRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_job_requests_total",
+			Help: "Number of job requests, by outcome.",
+		},
+		[]string{"source", "outcome"},
+	)
+
+	// LaneQuotaFull counts dispatch requests refused because every enabled
+	// lane was at its quota of jobs in flight.
+	//
+	// Provides metrics:
+	//   gardener_lane_quota_full_total
+	// Example usage:
+	// metrics.LaneQuotaFull.Inc()
+	LaneQuotaFull = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gardener_lane_quota_full_total",
+			Help: "Number of dispatch requests refused because all lanes were at quota.",
+		},
+	)
+
+	// PublishCount counts the outcomes of publishing partitions to the
+	// serving project.
+	//
+	// Provides metrics:
+	//   gardener_publish_total{experiment, datatype, status}
+	// Example usage:
+	// metrics.PublishCount.WithLabelValues(exp, dt, "success").Inc()
+	PublishCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_publish_total",
+			Help: "Number of partition publish attempts, by outcome.",
+		},
+		[]string{"experiment", "datatype", "status"},
+	)
+
+	// AccessChecks counts checks of the access policies of the raw and
+	// publish datasets before publishing, by result, which is "ok", "drift"
+	// or "error".
+	//
+	// Provides metrics:
+	//   gardener_access_checks_total{experiment, datatype, result}
+	// Example usage:
+	// metrics.AccessChecks.WithLabelValues(exp, dt, "drift").Inc()
+	AccessChecks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_access_checks_total",
+			Help: "Number of dataset access policy checks before publishing, by result.",
+		},
+		[]string{"experiment", "datatype", "result"},
+	)
+
+	// PublishedRows counts the rows published to the serving project.
+	//
+	// Provides metrics:
+	//   gardener_published_rows_total{experiment, datatype}
+	// Example usage:
+	// metrics.PublishedRows.WithLabelValues(exp, dt).Add(rows)
+	PublishedRows = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_published_rows_total",
+			Help: "Number of rows published to the serving project.",
+		},
+		[]string{"experiment", "datatype"},
+	)
+
+	// SizeAnomalyCount counts the comparisons of published partition row
+	// counts with the same weekday in earlier weeks, by outcome, i.e. ok,
+	// high, low or error.
+	//
+	// Provides metrics:
+	//   gardener_size_anomaly_total{experiment, datatype, status}
+	// Example usage:
+	// metrics.SizeAnomalyCount.WithLabelValues(exp, dt, "low").Inc()
+	SizeAnomalyCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_size_anomaly_total",
+			Help: "Number of published partition size checks, by outcome.",
+		},
+		[]string{"experiment", "datatype", "status"},
+	)
+
+	// BQQueryCount counts the queries run by the bq package's TableOps, by
+	// template, e.g. "dedup" or "count", and status, which is "started",
+	// "succeeded" or "failed".
+	//
+	// Provides metrics:
+	//   gardener_bq_queries_total{template, datatype, status}
+	// Example usage:
+	// metrics.BQQueryCount.WithLabelValues("dedup", dt, "started").Inc()
+	BQQueryCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_bq_queries_total",
+			Help: "Number of BigQuery queries, by template and status.",
+		},
+		[]string{"template", "datatype", "status"},
+	)
+
+	// BQQueryDuration is the time from starting a query to its completion.
+	//
+	// Provides metrics:
+	//   gardener_bq_query_duration_seconds{template, datatype}
+	// Example usage:
+	// metrics.BQQueryDuration.WithLabelValues("dedup", dt).Observe(elapsed.Seconds())
+	BQQueryDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "gardener_bq_query_duration_seconds",
+			Help: "BigQuery query durations, by template.",
+			// These values range from seconds to hours.
+			Buckets: []float64{
+				1, 3, 10, 30, 100, 300, 1000, 1800, 3600, 2 * 3600, 4 * 3600,
+			},
+		},
+		[]string{"template", "datatype"},
+	)
+
+	// BQBytesBilled counts the bytes billed for completed query jobs.
+	//
+	// Provides metrics:
+	//   gardener_bq_bytes_billed_total{template, datatype}
+	// Example usage:
+	// metrics.BQBytesBilled.WithLabelValues("dedup", dt).Add(float64(bytes))
+	BQBytesBilled = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_bq_bytes_billed_total",
+			Help: "Number of bytes billed for BigQuery queries, by template.",
+		},
+		[]string{"template", "datatype"},
+	)
+
+	// BQDryRunCount counts the queries that were only dry run.
+	//
+	// Provides metrics:
+	//   gardener_bq_dry_runs_total{template, datatype}
+	// Example usage:
+	// metrics.BQDryRunCount.WithLabelValues("dedup", dt).Inc()
+	BQDryRunCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_bq_dry_runs_total",
+			Help: "Number of BigQuery dry run queries, by template.",
+		},
+		[]string{"template", "datatype"},
+	)
+
+	// ViewRefreshCount counts the outcomes of refreshing the annotation join
+	// views after publication.
+	//
+	// Provides metrics:
+	//   gardener_view_refresh_total{experiment, datatype, status}
+	// Example usage:
+	// metrics.ViewRefreshCount.WithLabelValues(exp, dt, "updated").Inc()
+	ViewRefreshCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_view_refresh_total",
+			Help: "Number of annotation view refreshes, by outcome.",
+		},
+		[]string{"experiment", "datatype", "status"},
+	)
+
+	// SlotUtilization is the most recent slot utilization of a BigQuery
+	// reservation, as a fraction of its capacity.
+	//
+	// Provides metrics:
+	//   gardener_slot_utilization{reservation}
+	// Example usage:
+	// metrics.SlotUtilization.WithLabelValues(reservation).Set(u)
+	SlotUtilization = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gardener_slot_utilization",
+			Help: "Fraction of the BigQuery slot reservation in use.",
+		},
+		[]string{"reservation"},
+	)
+
+	// SlotThrottled is 1 while dispatch is throttled because the slot
+	// reservation is saturated, and 0 otherwise.
+	//
+	// Provides metrics:
+	//   gardener_slot_throttled{reservation}
+	// Example usage:
+	// metrics.SlotThrottled.WithLabelValues(reservation).Set(1)
+	SlotThrottled = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gardener_slot_throttled",
+			Help: "Whether dispatch is throttled by slot reservation utilization.",
+		},
+		[]string{"reservation"},
+	)
+
+	// MissingDates is the number of dates found in the GCS archive with no
+	// rows in the raw table and no job in the tracker, by the last reconcile.
+	//
+	// Provides metrics:
+	//   gardener_missing_dates{experiment, datatype}
+	// Example usage:
+	// metrics.MissingDates.WithLabelValues(exp, dt).Set(n)
+	MissingDates = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gardener_missing_dates",
+			Help: "Number of archived dates with no raw rows and no job.",
+		},
+		[]string{"experiment", "datatype"},
+	)
+
+	// MissingRequeued counts the missing dates requeued by reconciliation.
+	//
+	// Provides metrics:
+	//   gardener_missing_requeued_total{experiment, datatype}
+	// Example usage:
+	// metrics.MissingRequeued.WithLabelValues(exp, dt).Inc()
+	MissingRequeued = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_missing_requeued_total",
+			Help: "Number of missing dates requeued by reconciliation.",
+		},
+		[]string{"experiment", "datatype"},
+	)
+
+	// CallbackDeliveries counts the HTTP callbacks of job stages, which
+	// are "delivered", "retried", "dropped" when the queue is full, or
+	// "error" after the last retry.
+	//
+	// Provides metrics:
+	//   gardener_callback_deliveries_total{callback, result}
+	// Example usage:
+	// metrics.CallbackDeliveries.WithLabelValues("stats", "delivered").Inc()
+	CallbackDeliveries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_callback_deliveries_total",
+			Help: "Number of HTTP callbacks of job stages, by result.",
+		},
+		[]string{"callback", "result"},
+	)
+
+	// Notifications counts notifications sent to each sink.
+	//
+	// Provides metrics:
+	//   gardener_notifications_total{sink, event, status}
+	// Example usage:
+	// metrics.Notifications.WithLabelValues("ops-slack", "job_failed", "ok").Inc()
+	Notifications = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_notifications_total",
+			Help: "Number of notifications, by sink, event and status.",
+		},
+		[]string{"sink", "event", "status"},
+	)
+
+	// Leader is one when this instance is the active leader, and zero when
+	// it is a standby.
+	//
+	// Provides metrics:
+	//   gardener_leader
+	// Example usage:
+	// metrics.Leader.Set(1)
+	Leader = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gardener_leader",
+			Help: "Whether this instance is the active leader.",
+		},
+	)
+
+	// LeadershipChanges counts leadership transitions of this instance.
+	//
+	// Provides metrics:
+	//   gardener_leadership_changes_total{event}
+	// Example usage:
+	// metrics.LeadershipChanges.WithLabelValues("acquired").Inc()
+	LeadershipChanges = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_leadership_changes_total",
+			Help: "Number of leadership changes, by event.",
+		},
+		[]string{"event"},
+	)
+
+	// ExcessDuplication counts dedups that removed more than the configured
+	// fraction of rows, by the duplication policy applied.
+	//
+	// Provides metrics:
+	//   gardener_excess_duplication_total{experiment, datatype, policy}
+	// Example usage:
+	// metrics.ExcessDuplication.WithLabelValues(exp, dt, "flag").Inc()
+	ExcessDuplication = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_excess_duplication_total",
+			Help: "Number of dedups that removed an excessive fraction of rows.",
+		},
+		[]string{"experiment", "datatype", "policy"},
+	)
+
+	// ArchiveChecks counts pre-dispatch archive checks, by result, which is
+	// "ok", "bad" or "error".
+	//
+	// Provides metrics:
+	//   gardener_archive_checks_total{experiment, datatype, result}
+	// Example usage:
+	// metrics.ArchiveChecks.WithLabelValues(exp, dt, "bad").Inc()
+	ArchiveChecks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_archive_checks_total",
+			Help: "Number of archive checks before dispatch, by result.",
+		},
+		[]string{"experiment", "datatype", "result"},
+	)
+
+	// JobLogRows counts job log rows, by status, which is "inserted",
+	// "error" or "dropped".
+	//
+	// Provides metrics:
+	//   gardener_job_log_rows_total{status}
+	// Example usage:
+	// metrics.JobLogRows.WithLabelValues("inserted").Add(10)
+	JobLogRows = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_job_log_rows_total",
+			Help: "Number of job log rows, by status.",
+		},
+		[]string{"status"},
+	)
+
+	// BQWriteRows counts rows written with the Storage Write API, by
+	// destination and result, which is "written", "retried", "error" or
+	// "invalid".
+	//
+	// Provides metrics:
+	//   gardener_bq_write_rows_total{name, result}
+	// Example usage:
+	// metrics.BQWriteRows.WithLabelValues("job_log", "written").Add(10)
+	BQWriteRows = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_bq_write_rows_total",
+			Help: "Number of rows written with the Storage Write API, by result.",
+		},
+		[]string{"name", "result"},
+	)
+
+	// DoneMarkers counts GCS done marker objects, by status, which is
+	// "written", "error" or "dropped".
+	//
+	// Provides metrics:
+	//   gardener_done_markers_total{status}
+	// Example usage:
+	// metrics.DoneMarkers.WithLabelValues("written").Inc()
+	DoneMarkers = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_done_markers_total",
+			Help: "Number of done marker objects, by status.",
+		},
+		[]string{"status"},
+	)
+
+	// TableDetailRequests counts table detail cache lookups, by result,
+	// which is "hit", "miss" or "refresh".
+	//
+	// Provides metrics:
+	//   gardener_table_detail_requests_total{result}
+	// Example usage:
+	// metrics.TableDetailRequests.WithLabelValues("hit").Inc()
+	TableDetailRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_table_detail_requests_total",
+			Help: "Number of table detail cache lookups, by result.",
+		},
+		[]string{"result"},
+	)
+
+	// ErrorReports counts the errors reported to Error Reporting, by
+	// category, e.g. "timeout" or "panic".
+	//
+	// Provides metrics:
+	//   gardener_error_reports_total{category}
+	// Example usage:
+	// metrics.ErrorReports.WithLabelValues("panic").Inc()
+	ErrorReports = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_error_reports_total",
+			Help: "Number of errors reported to Error Reporting, by category.",
+		},
+		[]string{"category"},
+	)
+
+	// StaleJobsReleased counts the jobs returned to pending because the
+	// parser that held them stopped sending heartbeats.
+	//
+	// Provides metrics:
+	//   gardener_stale_jobs_released_total{experiment, datatype, state}
+	// Example usage:
+	// metrics.StaleJobsReleased.WithLabelValues(exp, dt, "parsing").Inc()
+	StaleJobsReleased = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_stale_jobs_released_total",
+			Help: "Number of stale parser jobs returned to pending, by state.",
+		},
+		[]string{"experiment", "datatype", "state"},
+	)
+
+	// CancelledJobs counts the jobs cancelled, by the state they were
+	// cancelled in.
+	//
+	// Provides metrics:
+	//   gardener_cancelled_jobs_total{experiment, datatype, state}
+	// Example usage:
+	// metrics.CancelledJobs.WithLabelValues(exp, dt, "parsing").Inc()
+	CancelledJobs = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_cancelled_jobs_total",
+			Help: "Number of jobs cancelled, by the state they were cancelled in.",
+		},
+		[]string{"experiment", "datatype", "state"},
+	)
+
+	// ShardUpdates counts the state changes of shards of sharded jobs, by
+	// the shard's new state.
+	//
+	// Provides metrics:
+	//   gardener_shard_updates_total{experiment, datatype, state}
+	// Example usage:
+	// metrics.ShardUpdates.WithLabelValues(exp, dt, "complete").Inc()
+	ShardUpdates = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_shard_updates_total",
+			Help: "Number of shard state changes, by state.",
+		},
+		[]string{"experiment", "datatype", "state"},
+	)
+
+	// EventDeliveries counts the job transitions delivered to each event
+	// bus subscriber, by outcome, i.e. delivered or panic.
+	//
+	// Provides metrics:
+	//   gardener_event_deliveries_total{subscriber, status}
+	// Example usage:
+	// metrics.EventDeliveries.WithLabelValues("notify", "delivered").Inc()
+	EventDeliveries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_event_deliveries_total",
+			Help: "Number of job transitions delivered to event subscribers, by outcome.",
+		},
+		[]string{"subscriber", "status"},
+	)
+
+	// JobTransitions counts job state transitions, by new state.
+	//
+	// Provides metrics:
+	//   gardener_job_transitions_total{experiment, datatype, state}
+	// Example usage:
+	// metrics.JobTransitions.WithLabelValues(exp, dt, "complete").Inc()
+	JobTransitions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_job_transitions_total",
+			Help: "Number of job state transitions, by new state.",
+		},
+		[]string{"experiment", "datatype", "state"},
+	)
+
+	// VerifiedPartitions counts the spot checks of completed jobs' raw
+	// partitions, by result, e.g. "ok", "missing", "mismatch" or "error".
+	//
+	// Provides metrics:
+	//   gardener_verified_partitions_total{experiment, datatype, result}
+	// Example usage:
+	// metrics.VerifiedPartitions.WithLabelValues(exp, dt, "ok").Inc()
+	VerifiedPartitions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_verified_partitions_total",
+			Help: "Number of completed job raw partitions spot checked, by result.",
+		},
+		[]string{"experiment", "datatype", "result"},
+	)
+
+	// RepairJobs counts the jobs requeued because their raw partition no
+	// longer matched when spot checked.
+	//
+	// Provides metrics:
+	//   gardener_repair_jobs_total{experiment, datatype}
+	// Example usage:
+	// metrics.RepairJobs.WithLabelValues(exp, dt).Inc()
+	RepairJobs = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_repair_jobs_total",
+			Help: "Number of repair jobs for raw partitions that no longer match.",
+		},
+		[]string{"experiment", "datatype"},
+	)
+
+	// SLOCompliance is the fraction of recent dates that were completed
+	// within the completion SLO deadline.
+	//
+	// Provides metrics:
+	//   gardener_slo_compliance_ratio{experiment, datatype}
+	// Example usage:
+	// metrics.SLOCompliance.WithLabelValues(exp, dt).Set(0.98)
+	SLOCompliance = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gardener_slo_compliance_ratio",
+			Help: "Fraction of recent dates completed within the SLO deadline.",
+		},
+		[]string{"experiment", "datatype"},
+	)
+
+	// SLOBurnRate is the rate at which the SLO error budget is used over
+	// each window.  A rate above 1 will exhaust the budget.
+	//
+	// Provides metrics:
+	//   gardener_slo_burn_rate{experiment, datatype, window}
+	// Example usage:
+	// metrics.SLOBurnRate.WithLabelValues(exp, dt, "7d").Set(2)
+	SLOBurnRate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gardener_slo_burn_rate",
+			Help: "SLO error budget burn rate, by window.",
+		},
+		[]string{"experiment", "datatype", "window"},
+	)
+
+	// HTTPRequests counts the requests served, by the mux pattern that
+	// handled them, and status code.
+	//
+	// Provides metrics:
+	//   gardener_http_requests_total{endpoint, code}
+	// Example usage:
+	// metrics.HTTPRequests.WithLabelValues("/job", "200").Inc()
+	HTTPRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_http_requests_total",
+			Help: "Number of HTTP requests, by endpoint and status code.",
+		},
+		[]string{"endpoint", "code"},
+	)
+
+	// HTTPRequestDuration is the time to serve each request.
+	//
+	// Provides metrics:
+	//   gardener_http_request_duration_seconds{endpoint}
+	// Example usage:
+	// metrics.HTTPRequestDuration.WithLabelValues("/job").Observe(elapsed.Seconds())
+	HTTPRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "gardener_http_request_duration_seconds",
+			Help: "HTTP request latencies, by endpoint.",
+			Buckets: []float64{
+				.001, .003, .01, .03, .1, .3, 1, 3, 10, 30,
+			},
+		},
+		[]string{"endpoint"},
+	)
+
+	// HTTPRateLimited counts the requests refused because the client
+	// exceeded its rate limit.
+	//
+	// Provides metrics:
+	//   gardener_http_rate_limited_total{endpoint}
+	// Example usage:
+	// metrics.HTTPRateLimited.WithLabelValues("/update").Inc()
+	HTTPRateLimited = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_http_rate_limited_total",
+			Help: "Number of HTTP requests refused by the rate limit, by endpoint.",
+		},
+		[]string{"endpoint"},
+	)
+
+	// HTTPPanics counts the panics recovered while serving requests.
+	//
+	// Provides metrics:
+	//   gardener_http_panics_total{endpoint}
+	// Example usage:
+	// metrics.HTTPPanics.WithLabelValues("/update").Inc()
+	HTTPPanics = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_http_panics_total",
+			Help: "Number of panics recovered while serving HTTP requests, by endpoint.",
+		},
+		[]string{"endpoint"},
+	)
+
+	// HookRuns counts the post-completion hook runs, by experiment, hook and
+	// status, which is "success", "error" or "dropped".  Dropped dates have
+	// an empty hook label.
+	//
+	// Provides metrics:
+	//   gardener_hook_runs_total{experiment, hook, status}
+	// Example usage:
+	// metrics.HookRuns.WithLabelValues(exp, "refresh_views", "success").Inc()
+	HookRuns = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_hook_runs_total",
+			Help: "Number of post-completion hook runs, by status.",
+		},
+		[]string{"experiment", "hook", "status"},
+	)
+
+	// PartitionChanges counts the partition change notifications, by status,
+	// which is "published", "error" or "dropped".
+	//
+	// Provides metrics:
+	//   gardener_partition_changes_total{experiment, datatype, status}
+	// Example usage:
+	// metrics.PartitionChanges.WithLabelValues(exp, dt, "published").Inc()
+	PartitionChanges = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_partition_changes_total",
+			Help: "Number of partition change notifications, by status.",
+		},
+		[]string{"experiment", "datatype", "status"},
+	)
+
+	// DedupCheckCount counts the outcomes of the post-dedup duplicate key
+	// check, which is "passed", "duplicates" or "error".
+	//
+	// Provides metrics:
+	//   gardener_dedup_check_total{experiment, datatype, status}
+	// Example usage:
+	// metrics.DedupCheckCount.WithLabelValues(exp, dt, "passed").Inc()
+	DedupCheckCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_dedup_check_total",
+			Help: "Number of post-dedup duplicate key checks, by outcome.",
+		},
+		[]string{"experiment", "datatype", "status"},
+	)
+
+	// DedupCheckDuplicateKeys counts the duplicate keys found by the
+	// post-dedup check.
+	//
+	// Provides metrics:
+	//   gardener_dedup_check_duplicate_keys_total{experiment, datatype}
+	// Example usage:
+	// metrics.DedupCheckDuplicateKeys.WithLabelValues(exp, dt).Add(3)
+	DedupCheckDuplicateKeys = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_dedup_check_duplicate_keys_total",
+			Help: "Number of duplicate keys remaining after dedup.",
+		},
+		[]string{"experiment", "datatype"},
+	)
+
+	// SchemaPatchCount counts the outcomes of patching raw table schemas
+	// before copies, which is "patched", "incompatible" or "error".  Copies
+	// that need no patch are not counted.
+	//
+	// Provides metrics:
+	//   gardener_schema_patch_total{experiment, datatype, status}
+	// Example usage:
+	// metrics.SchemaPatchCount.WithLabelValues(exp, dt, "patched").Inc()
+	SchemaPatchCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_schema_patch_total",
+			Help: "Number of raw table schema patches, by outcome.",
+		},
+		[]string{"experiment", "datatype", "status"},
+	)
+
+	// AnnotationHolds counts the checks of annotation availability before
+	// copies, which are "held", "ready", "expired", "released" or "error".
+	//
+	// Provides metrics:
+	//   gardener_annotation_holds_total{experiment, datatype, status}
+	// Example usage:
+	// metrics.AnnotationHolds.WithLabelValues(exp, dt, "held").Inc()
+	AnnotationHolds = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_annotation_holds_total",
+			Help: "Number of annotation availability checks before copies, by outcome.",
+		},
+		[]string{"experiment", "datatype", "status"},
+	)
+
+	// DayHolds counts the jobs held for earlier day stages before post
+	// processing, which are "held", and later "released".
+	//
+	// Provides metrics:
+	//   gardener_day_holds_total{experiment, datatype, status}
+	// Example usage:
+	// metrics.DayHolds.WithLabelValues(exp, dt, "held").Inc()
+	DayHolds = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_day_holds_total",
+			Help: "Number of jobs held for earlier day stages, by status.",
+		},
+		[]string{"experiment", "datatype", "status"},
+	)
+
+	// MonitorPolls counts the monitor's polls of jobs in states with
+	// actions, which are "polled", "deferred" by the job's backoff, or
+	// "nudged" when a hint arrives for the job.
+	//
+	// Provides metrics:
+	//   gardener_monitor_polls_total{experiment, datatype, result}
+	// Example usage:
+	// metrics.MonitorPolls.WithLabelValues(exp, dt, "polled").Inc()
+	MonitorPolls = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_monitor_polls_total",
+			Help: "Number of monitor polls of jobs, by result.",
+		},
+		[]string{"experiment", "datatype", "result"},
+	)
+
 	// QueryCostHistogram tracks the costs of dedup and other queries.
 	QueryCostHistogram = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
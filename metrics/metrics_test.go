@@ -13,7 +13,45 @@ func TestLintMetrics(t *testing.T) {
 	WarningCount.WithLabelValues("exp", "type", "status")
 	StateDate.WithLabelValues("exp", "type", "x")
 	StateTimeHistogram.WithLabelValues("exp", "type", "x")
+	StateTransitionCount.WithLabelValues("exp", "type", "x", "y")
+	StateFailureCount.WithLabelValues("exp", "type", "x")
+	JobDurationHistogram.WithLabelValues("exp", "type")
+	JobsByState.WithLabelValues("x")
+	OldestPendingDate.WithLabelValues("exp", "type")
+	LastCompleteDate.WithLabelValues("exp", "type")
+	LastCompleteTimestamp.WithLabelValues("exp", "type")
 	FilesPerDateHistogram.WithLabelValues("exp", "type", "x")
 	BytesPerDateHistogram.WithLabelValues("exp", "type", "x")
+	BQQueryCount.WithLabelValues("dedup", "type", "started")
+	BQQueryDuration.WithLabelValues("dedup", "type")
+	BQBytesBilled.WithLabelValues("dedup", "type")
+	BQDryRunCount.WithLabelValues("dedup", "type")
+	BQWriteRows.WithLabelValues("job_log", "written")
+	AccessChecks.WithLabelValues("exp", "type", "ok")
+	StaleJobsReleased.WithLabelValues("exp", "type", "parsing")
+	CancelledJobs.WithLabelValues("exp", "type", "parsing")
+	SLOCompliance.WithLabelValues("exp", "type")
+	SLOBurnRate.WithLabelValues("exp", "type", "7d")
+	HTTPRequests.WithLabelValues("/job", "200")
+	HTTPRequestDuration.WithLabelValues("/job")
+	HTTPRateLimited.WithLabelValues("/job")
+	HTTPPanics.WithLabelValues("/job")
+	HookRuns.WithLabelValues("exp", "refresh_views", "success")
+	PartitionChanges.WithLabelValues("exp", "type", "published")
+	DedupCheckCount.WithLabelValues("exp", "type", "passed")
+	DedupCheckDuplicateKeys.WithLabelValues("exp", "type")
+	SchemaPatchCount.WithLabelValues("exp", "type", "patched")
+	SizeAnomalyCount.WithLabelValues("exp", "type", "low")
+	ShardUpdates.WithLabelValues("exp", "type", "complete")
+	EventDeliveries.WithLabelValues("notify", "delivered")
+	JobTransitions.WithLabelValues("exp", "type", "complete")
+	VerifiedPartitions.WithLabelValues("exp", "type", "ok")
+	RepairJobs.WithLabelValues("exp", "type")
+	AnnotationHolds.WithLabelValues("exp", "type", "held")
+	DayHolds.WithLabelValues("exp", "type", "held")
+	CallbackDeliveries.WithLabelValues("stats", "delivered")
+	MonitorPolls.WithLabelValues("exp", "type", "polled")
+	SourceJobs.WithLabelValues("requests")
+	JobRequests.WithLabelValues("requests", "queued")
 	promtest.LintMetrics(nil) // Log warnings only.
 }
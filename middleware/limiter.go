@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// pruneEvery is the interval at which idle clients are forgotten.
+const pruneEvery = time.Minute
+
+// bucket holds a client's tokens, as of last.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a token bucket rate limiter for each client.
+type Limiter struct {
+	rate  float64 // Tokens per second.
+	burst float64
+
+	lock      sync.Mutex
+	clients   map[string]*bucket
+	lastPrune time.Time
+}
+
+// NewLimiter returns a Limiter that allows each client rate requests per
+// second, with bursts of up to burst requests.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{rate: rate, burst: float64(burst), clients: map[string]*bucket{}}
+}
+
+// Allow returns true if the client may make a request at now, and takes a
+// token from its bucket.
+func (l *Limiter) Allow(client string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Sub(l.lastPrune) > pruneEvery {
+		l.prune(now)
+	}
+	b, ok := l.clients[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RetryAfter returns the time for a client to earn a token.
+func (l *Limiter) RetryAfter() time.Duration {
+	if l.rate <= 0 {
+		return time.Second
+	}
+	return time.Duration(float64(time.Second) / l.rate)
+}
+
+// refill returns the bucket's tokens at now.
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.rate
+	if tokens > l.burst {
+		return l.burst
+	}
+	return tokens
+}
+
+// prune forgets the clients whose buckets are full, which are the same as
+// new clients.
+// Caller must hold the lock.
+func (l *Limiter) prune(now time.Time) {
+	for c, b := range l.clients {
+		if l.refill(b, now) >= l.burst {
+			delete(l.clients, c)
+		}
+	}
+	l.lastPrune = now
+}
@@ -0,0 +1,196 @@
+// Package middleware wraps the manager's HTTP handlers with request logging,
+// per-endpoint metrics, panic recovery, and per-client rate limiting of the
+// endpoints that parsers call for every job.
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	runtimedebug "runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/etl-gardener/logging"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// ParserPaths are the endpoints that parsers and external workers call for
+// every job, which are rate limited by SetRateLimit.
+var ParserPaths = []string{
+	"/job", "/update", "/heartbeat", "/error",
+	"/v2/job", "/v2/update", "/v2/heartbeat", "/v2/error",
+	"/job/claim", "/job/update",
+}
+
+// SlowRequest is the duration above which successful requests are logged.
+const SlowRequest = time.Second
+
+// maxPeek is the largest request body that is read to find the job.
+const maxPeek = 64 * 1024
+
+// An ErrorReporter reports panics, e.g. to Cloud Error Reporting.
+type ErrorReporter interface {
+	ReportPanic(j *tracker.Job, v interface{}, stack []byte)
+}
+
+// Stack serves requests with a ServeMux, and records and logs each request,
+// labelled with the mux pattern that handles it.
+type Stack struct {
+	mux      *http.ServeMux
+	limiter  *Limiter        // Static after SetRateLimit.  May be nil.
+	limited  map[string]bool // Patterns that are rate limited.
+	reporter ErrorReporter   // Static after SetErrorReporter.  May be nil.
+}
+
+// New returns a Stack that serves requests with the mux.
+func New(mux *http.ServeMux) *Stack {
+	return &Stack{mux: mux}
+}
+
+// SetRateLimit limits each client to rate requests per second, with bursts
+// of up to burst requests, to the patterns.  Clients are identified by the
+// first X-Forwarded-For address, or the remote address.  Should be called
+// before serving.
+func (s *Stack) SetRateLimit(rate float64, burst int, patterns ...string) {
+	s.limiter = NewLimiter(rate, burst)
+	s.limited = make(map[string]bool, len(patterns))
+	for _, p := range patterns {
+		s.limited[p] = true
+	}
+}
+
+// SetErrorReporter reports recovered panics, with the request's job, if
+// any.  Should be called before serving.
+func (s *Stack) SetErrorReporter(r ErrorReporter) {
+	s.reporter = r
+}
+
+// statusWriter records the status of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Stack) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	_, pattern := s.mux.Handler(req)
+	if pattern == "" {
+		pattern = "unmatched"
+	}
+	client := clientAddr(req)
+	job, hasJob := peekJob(req)
+	logger := logging.FromContext(req.Context())
+	if hasJob {
+		logger = job.Logger()
+	}
+	logger = logger.With("method", req.Method).With("path", req.URL.Path).With("client", client)
+	req = req.WithContext(logging.NewContext(req.Context(), logger))
+	w := &statusWriter{ResponseWriter: resp}
+
+	defer func() {
+		if v := recover(); v != nil {
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			stack := runtimedebug.Stack()
+			metrics.HTTPPanics.WithLabelValues(pattern).Inc()
+			logger.Errorln("panic:", v, string(stack))
+			if s.reporter != nil {
+				var jp *tracker.Job
+				if hasJob {
+					jp = &job
+				}
+				s.reporter.ReportPanic(jp, v, stack)
+			}
+			if w.status == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		elapsed := time.Since(start)
+		metrics.HTTPRequests.WithLabelValues(pattern, strconv.Itoa(w.status)).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(pattern).Observe(elapsed.Seconds())
+		if w.status >= http.StatusInternalServerError || elapsed > SlowRequest {
+			logger.With("status", w.status).With("latency", elapsed).Println("HTTP request")
+		}
+	}()
+
+	if s.limiter != nil && s.limited[pattern] && !s.limiter.Allow(client, start) {
+		metrics.HTTPRateLimited.WithLabelValues(pattern).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.limiter.RetryAfter().Seconds()+0.5)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintln(w, "Rate limit exceeded.  Try again later.")
+		return
+	}
+	s.mux.ServeHTTP(w, req)
+}
+
+// clientAddr returns the first X-Forwarded-For address, or the host of the
+// remote address.
+func clientAddr(req *http.Request) string {
+	if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+		return strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// peekJob returns the job in the request's "job" parameter, or in the Job
+// field of a JSON body, if any.  The body is restored for the handler.
+func peekJob(req *http.Request) (tracker.Job, bool) {
+	var job tracker.Job
+	if s := req.URL.Query().Get("job"); s != "" {
+		return job, job.Unmarshal([]byte(s)) == nil
+	}
+	if req.Body == nil || req.ContentLength > maxPeek {
+		return job, false
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(req.Body, maxPeek+1))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+	if err != nil || len(b) == 0 || len(b) > maxPeek {
+		return job, false
+	}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(string(b))
+		if err != nil || form.Get("job") == "" {
+			return job, false
+		}
+		return job, job.Unmarshal([]byte(form.Get("job"))) == nil
+	}
+	u := struct{ Job *tracker.Job }{&job}
+	if json.Unmarshal(b, &u) != nil || job == (tracker.Job{}) {
+		return job, false
+	}
+	return job, true
+}
@@ -0,0 +1,97 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/middleware"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+type fakeReporter struct {
+	jobs []*tracker.Job
+}
+
+func (r *fakeReporter) ReportPanic(j *tracker.Job, v interface{}, stack []byte) {
+	r.jobs = append(r.jobs, j)
+}
+
+func TestStack(t *testing.T) {
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	form := url.Values{"job": {string(job.Marshal())}, "state": {"parsing"}}.Encode()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/update", func(resp http.ResponseWriter, req *http.Request) {
+		// The handler still sees the body that was peeked.
+		if err := req.ParseForm(); err != nil || req.Form.Get("state") != "parsing" {
+			t.Error("Body not restored", err, req.Form)
+		}
+	})
+	mux.HandleFunc("/panic", func(resp http.ResponseWriter, req *http.Request) {
+		panic("oops")
+	})
+	s := middleware.New(mux)
+	s.SetRateLimit(0.001, 2, middleware.ParserPaths...)
+	reporter := &fakeReporter{}
+	s.SetErrorReporter(reporter)
+
+	ok := testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("/update", "200"))
+	limited := testutil.ToFloat64(metrics.HTTPRateLimited.WithLabelValues("/update"))
+	post := func(path, client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", client)
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Each client gets its own burst.
+	for _, client := range []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"} {
+		if resp := post("/update", client); resp.Code != http.StatusOK {
+			t.Error("Expected OK for", client, resp.Code)
+		}
+	}
+	resp := post("/update", "10.0.0.1")
+	if resp.Code != http.StatusTooManyRequests || resp.Header().Get("Retry-After") == "" {
+		t.Error("Expected TooManyRequests", resp.Code, resp.Header())
+	}
+	if n := testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("/update", "200")) - ok; n != 3 {
+		t.Error("Wrong request count", n)
+	}
+	if n := testutil.ToFloat64(metrics.HTTPRateLimited.WithLabelValues("/update")) - limited; n != 1 {
+		t.Error("Wrong rate limited count", n)
+	}
+
+	// Panics are recovered and reported, with the job.  Paths that aren't
+	// listed are not rate limited.
+	for i := 0; i < 3; i++ {
+		if resp := post("/panic", "10.0.0.1"); resp.Code != http.StatusInternalServerError {
+			t.Error("Expected InternalServerError", resp.Code)
+		}
+	}
+	if len(reporter.jobs) != 3 || reporter.jobs[0] == nil || *reporter.jobs[0] != job {
+		t.Error("Panic not reported with the job", reporter.jobs)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := middleware.NewLimiter(1, 2)
+	now := time.Now()
+	if !l.Allow("a", now) || !l.Allow("a", now) || l.Allow("a", now) {
+		t.Error("Expected a burst of 2")
+	}
+	if !l.Allow("a", now.Add(time.Second)) || l.Allow("a", now.Add(time.Second)) {
+		t.Error("Expected one token per second")
+	}
+	if l.RetryAfter() != time.Second {
+		t.Error("Wrong RetryAfter", l.RetryAfter())
+	}
+}
@@ -0,0 +1,211 @@
+// Package notify sends notifications of job failures, freshness SLO
+// violations and daily completions to pluggable sinks, such as Slack, email
+// or a generic webhook, with per-experiment routing.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Event kinds.
+const (
+	JobFailed     = "job_failed"
+	Freshness     = "freshness"
+	DailyComplete = "daily_complete"
+	BackPressure  = "back_pressure" // Dispatch paused or resumed.  Has no experiment.
+	StaleJob      = "stale_job"     // A parser job was returned to pending.
+	SizeAnomaly   = "size_anomaly"  // A partition was published with a size warning.
+)
+
+// Event describes something an operator should know about.
+type Event struct {
+	Kind       string
+	Experiment string
+	Datatype   string
+	Date       time.Time // The job date, or the oldest pending date.
+	Message    string
+	Time       time.Time
+}
+
+// Text returns a one line summary of the event.
+func (e Event) Text() string {
+	if e.Experiment == "" {
+		return fmt.Sprintf("[%s] %s", e.Kind, e.Message)
+	}
+	return fmt.Sprintf("[%s] %s/%s %s: %s", e.Kind, e.Experiment, e.Datatype,
+		e.Date.Format("2006-01-02"), e.Message)
+}
+
+// A Sink delivers events, e.g. to a Slack channel.
+type Sink interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+// route sends events of the listed kinds for an experiment to the sinks.
+type route struct {
+	experiment string          // Empty matches all experiments.
+	kinds      map[string]bool // Empty matches all kinds.
+	sinks      []string
+}
+
+func (r route) matches(e Event) bool {
+	return (r.experiment == "" || r.experiment == e.Experiment) &&
+		(len(r.kinds) == 0 || r.kinds[e.Kind])
+}
+
+// queueSize limits the events waiting to be sent.  Further events are dropped.
+const queueSize = 100
+
+// Notifier routes events to sinks.  Events are queued, and sent by Run, so
+// that callers are not delayed by slow sinks.
+type Notifier struct {
+	sinks  map[string]Sink
+	routes []route
+	events chan Event
+
+	slo time.Duration // Maximum age of the oldest pending date.
+
+	lock  sync.Mutex
+	stale map[string]bool // experiment/datatype currently violating the SLO.
+}
+
+// New creates a Notifier.  Every route must name known sinks.
+func New(sinks map[string]Sink, routes []config.RouteConfig, slo time.Duration) (*Notifier, error) {
+	n := &Notifier{sinks: sinks, events: make(chan Event, queueSize), slo: slo, stale: map[string]bool{}}
+	for _, rc := range routes {
+		r := route{experiment: rc.Experiment, kinds: map[string]bool{}, sinks: rc.Sinks}
+		for _, k := range rc.Events {
+			if k != JobFailed && k != Freshness && k != DailyComplete && k != BackPressure && k != StaleJob &&
+				k != SizeAnomaly {
+				return nil, fmt.Errorf("%w: event %q", ErrInvalidConfig, k)
+			}
+			r.kinds[k] = true
+		}
+		for _, s := range rc.Sinks {
+			if _, ok := sinks[s]; !ok {
+				return nil, fmt.Errorf("%w: unknown sink %q", ErrInvalidConfig, s)
+			}
+		}
+		n.routes = append(n.routes, r)
+	}
+	return n, nil
+}
+
+// Send queues an event for delivery to the sinks of all matching routes.
+func (n *Notifier) Send(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	select {
+	case n.events <- e:
+	default:
+		log.Println("Notification queue full, dropping", e.Text())
+		metrics.Notifications.WithLabelValues("", e.Kind, "dropped").Inc()
+	}
+}
+
+// deliver sends the event to the sinks of all matching routes, once each.
+func (n *Notifier) deliver(ctx context.Context, e Event) {
+	sent := map[string]bool{}
+	for _, r := range n.routes {
+		if !r.matches(e) {
+			continue
+		}
+		for _, name := range r.sinks {
+			if sent[name] {
+				continue
+			}
+			sent[name] = true
+			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			err := n.sinks[name].Notify(ctx, e)
+			cancel()
+			status := "ok"
+			if err != nil {
+				log.Println("Notification to", name, "failed:", err)
+				status = "error"
+			}
+			metrics.Notifications.WithLabelValues(name, e.Kind, status).Inc()
+		}
+	}
+}
+
+// Observe is a tracker.Observer that sends events for failed jobs, and for
+// completed jobs for yesterday or today, i.e. daily processing.
+func (n *Notifier) Observe(j tracker.Job, s tracker.Status) {
+	e := Event{Experiment: j.Experiment, Datatype: j.Datatype, Date: j.Date}
+	switch s.State() {
+	case tracker.Failed:
+		e.Kind, e.Message = JobFailed, s.Detail()
+	case tracker.Complete:
+		if j.Lane(time.Now()) != tracker.Daily || j.Prefix != "" {
+			// Backfill and partial jobs are not daily processing.
+			return
+		}
+		e.Kind, e.Message = DailyComplete, "processing complete"
+	default:
+		return
+	}
+	n.Send(e)
+}
+
+// CheckFreshness sends a Freshness event for each experiment/datatype whose
+// oldest pending date is older than the SLO.  Each violation is reported
+// once, until the backlog is fresh again.
+func (n *Notifier) CheckFreshness(oldest map[string]time.Time, now time.Time) {
+	if n.slo <= 0 {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for key := range n.stale {
+		if date, ok := oldest[key]; !ok || now.Sub(date) <= n.slo {
+			delete(n.stale, key)
+		}
+	}
+	for key, date := range oldest {
+		age := now.Sub(date)
+		if age <= n.slo || n.stale[key] {
+			continue
+		}
+		n.stale[key] = true
+		e := Event{Kind: Freshness, Date: date, Time: now,
+			Message: fmt.Sprintf("oldest pending date is %v old, exceeding %v", age.Round(time.Hour), n.slo)}
+		e.Experiment, e.Datatype = splitKey(key)
+		n.Send(e)
+	}
+}
+
+// splitKey splits an experiment/datatype key.
+func splitKey(key string) (string, string) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) < 2 {
+		return key, ""
+	}
+	return parts[0], parts[1]
+}
+
+// Run delivers queued events, and checks freshness of the tracker backlog
+// every interval, until ctx is done.
+func (n *Notifier) Run(ctx context.Context, tk *tracker.Tracker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-n.events:
+			n.deliver(ctx, e)
+		case now := <-ticker.C:
+			n.CheckFreshness(tk.GetSummary().OldestPending, now)
+		}
+	}
+}
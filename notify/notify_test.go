@@ -0,0 +1,192 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/notify"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// fakeSink records the events it receives.
+type fakeSink struct {
+	lock   sync.Mutex
+	events []notify.Event
+}
+
+func (s *fakeSink) Notify(ctx context.Context, e notify.Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *fakeSink) kinds() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	kinds := []string{}
+	for _, e := range s.events {
+		kinds = append(kinds, e.Experiment+":"+e.Kind)
+	}
+	return kinds
+}
+
+func waitFor(t *testing.T, s *fakeSink, n int) []string {
+	for i := 0; i < 500 && len(s.kinds()) < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s.kinds()
+}
+
+func TestNotifier(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all, ndt := &fakeSink{}, &fakeSink{}
+	sinks := map[string]notify.Sink{"all": all, "ndt": ndt}
+	_, err := notify.New(sinks, []config.RouteConfig{{Sinks: []string{"nonesuch"}}}, 0)
+	if !errors.Is(err, notify.ErrInvalidConfig) {
+		t.Error("Expected ErrInvalidConfig", err)
+	}
+	_, err = notify.New(sinks, []config.RouteConfig{{Events: []string{"nonesuch"}, Sinks: []string{"all"}}}, 0)
+	if !errors.Is(err, notify.ErrInvalidConfig) {
+		t.Error("Expected ErrInvalidConfig", err)
+	}
+
+	n, err := notify.New(sinks, []config.RouteConfig{
+		{Sinks: []string{"all"}},
+		{Experiment: "ndt", Events: []string{notify.JobFailed}, Sinks: []string{"ndt", "all"}},
+	}, 72*time.Hour)
+	rtx.Must(err, "New")
+
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, time.Hour)
+	rtx.Must(err, "tk init")
+	tk.AddObserver(n.Observe)
+	go n.Run(ctx, tk, time.Hour)
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	failed := tracker.NewJob("bucket", "ndt", "ndt7", today.AddDate(0, 0, -10))
+	daily := tracker.NewJob("bucket", "host", "nodeinfo", today.AddDate(0, 0, -1))
+	backfill := tracker.NewJob("bucket", "host", "nodeinfo", today.AddDate(0, 0, -10))
+	for _, j := range []tracker.Job{failed, daily, backfill} {
+		rtx.Must(tk.AddJob(j), "add job")
+	}
+	rtx.Must(tk.SetJobError(failed, "bad"), "set error")
+	rtx.Must(tk.SetStatus(backfill, tracker.Complete, ""), "set status")
+	rtx.Must(tk.SetStatus(daily, tracker.Complete, ""), "set status")
+
+	got := waitFor(t, all, 2)
+	if len(got) != 2 || got[0] != "ndt:job_failed" || got[1] != "host:daily_complete" {
+		t.Error("Wrong events for all", got)
+	}
+	got = waitFor(t, ndt, 1)
+	if len(got) != 1 || got[0] != "ndt:job_failed" {
+		t.Error("Wrong events for ndt", got)
+	}
+
+	// Freshness violations are reported once, until the backlog recovers.
+	now := today.Add(12 * time.Hour)
+	stale := map[string]time.Time{"ndt/ndt7": today.AddDate(0, 0, -5), "host/nodeinfo": today}
+	n.CheckFreshness(stale, now)
+	n.CheckFreshness(stale, now)
+	n.CheckFreshness(map[string]time.Time{}, now)
+	n.CheckFreshness(stale, now)
+	got = waitFor(t, all, 4)
+	if len(got) != 4 || got[2] != "ndt:freshness" || got[3] != "ndt:freshness" {
+		t.Error("Wrong freshness events", got)
+	}
+
+	// Back pressure events have no experiment, so only match the first route.
+	n.Send(notify.Event{Kind: notify.BackPressure, Message: "pausing dispatch", Time: now})
+	got = waitFor(t, all, 5)
+	if len(got) != 5 || got[4] != ":back_pressure" {
+		t.Error("Wrong back pressure events", got)
+	}
+	if len(ndt.kinds()) != 1 {
+		t.Error("Unexpected events for ndt", ndt.kinds())
+	}
+}
+
+func TestEventText(t *testing.T) {
+	e := notify.Event{Kind: notify.JobFailed, Experiment: "ndt", Datatype: "ndt7",
+		Date: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), Message: "bad"}
+	if e.Text() != "[job_failed] ndt/ndt7 2020-06-01: bad" {
+		t.Error("Wrong text", e.Text())
+	}
+	e = notify.Event{Kind: notify.BackPressure, Message: "pausing dispatch"}
+	if e.Text() != "[back_pressure] pausing dispatch" {
+		t.Error("Wrong text", e.Text())
+	}
+}
+
+func TestSinks(t *testing.T) {
+	bodies := make(chan map[string]interface{}, 10)
+	auth := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		rtx.Must(json.NewDecoder(req.Body).Decode(&body), "decode")
+		bodies <- body
+		auth <- req.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	_, err := notify.NewSinks([]config.SinkConfig{{Name: "x", Type: "nonesuch"}})
+	if !errors.Is(err, notify.ErrUnknownSinkType) {
+		t.Error("Expected ErrUnknownSinkType", err)
+	}
+	_, err = notify.NewSinks([]config.SinkConfig{{Name: "x", Type: "slack"}})
+	if !errors.Is(err, notify.ErrInvalidConfig) {
+		t.Error("Expected ErrInvalidConfig", err)
+	}
+	_, err = notify.NewSinks([]config.SinkConfig{{Name: "x", Type: "sendgrid", From: "a@b"}})
+	if !errors.Is(err, notify.ErrInvalidConfig) {
+		t.Error("Expected ErrInvalidConfig", err)
+	}
+
+	os.Setenv("TEST_SLACK_URL", server.URL)
+	defer os.Unsetenv("TEST_SLACK_URL")
+	sinks, err := notify.NewSinks([]config.SinkConfig{
+		{Name: "slack", Type: "slack", URLEnv: "TEST_SLACK_URL"},
+		{Name: "hook", Type: "webhook", URL: server.URL},
+	})
+	rtx.Must(err, "NewSinks")
+	e := notify.Event{Kind: notify.JobFailed, Experiment: "ndt", Datatype: "ndt7",
+		Date: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), Message: "bad"}
+
+	rtx.Must(sinks["slack"].Notify(context.Background(), e), "slack")
+	if b := <-bodies; b["text"] != "[job_failed] ndt/ndt7 2020-06-01: bad" {
+		t.Error("Wrong slack body", b)
+	}
+	<-auth
+	rtx.Must(sinks["hook"].Notify(context.Background(), e), "webhook")
+	if b := <-bodies; b["Kind"] != "job_failed" || b["Experiment"] != "ndt" {
+		t.Error("Wrong webhook body", b)
+	}
+	<-auth
+
+	sg := &notify.SendGridSink{URL: server.URL, APIKey: "key", From: "a@b", To: []string{"c@d"},
+		Client: http.DefaultClient}
+	rtx.Must(sg.Notify(context.Background(), e), "sendgrid")
+	if b := <-bodies; b["subject"] != "gardener: [job_failed] ndt/ndt7 2020-06-01: bad" {
+		t.Error("Wrong sendgrid body", b)
+	}
+	if a := <-auth; a != "Bearer key" {
+		t.Error("Wrong sendgrid auth", a)
+	}
+
+	failServer := httptest.NewServer(http.NotFoundHandler())
+	defer failServer.Close()
+	failing := &notify.WebhookSink{URL: failServer.URL, Client: http.DefaultClient}
+	if err := failing.Notify(context.Background(), e); err == nil {
+		t.Error("Expected error for 404")
+	}
+}
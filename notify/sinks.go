@@ -0,0 +1,204 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/m-lab/etl-gardener/config"
+)
+
+// Errors associated with notification config.
+var (
+	ErrInvalidConfig   = errors.New("invalid notify config")
+	ErrUnknownSinkType = errors.New("unknown sink type")
+)
+
+// A SinkFactory creates a Sink from its config.
+type SinkFactory func(c config.SinkConfig) (Sink, error)
+
+// sinkTypes is the registry of sink types that may be referenced in config.
+var sinkTypes = map[string]SinkFactory{
+	"slack":    newSlackSink,
+	"sendgrid": newSendGridSink,
+	"webhook":  newWebhookSink,
+}
+
+// RegisterSinkType adds a named SinkFactory to the registry.
+// It should be called from init functions, and is not thread-safe.
+func RegisterSinkType(name string, f SinkFactory) {
+	sinkTypes[name] = f
+}
+
+// SinkTypes returns the sorted names of all registered sink types.
+func SinkTypes() []string {
+	names := make([]string, 0, len(sinkTypes))
+	for name := range sinkTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewSinks creates the configured sinks, keyed by name.
+func NewSinks(configs []config.SinkConfig) (map[string]Sink, error) {
+	sinks := make(map[string]Sink, len(configs))
+	for _, c := range configs {
+		f, ok := sinkTypes[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q, expected one of %v", ErrUnknownSinkType, c.Type, SinkTypes())
+		}
+		if c.Name == "" || sinks[c.Name] != nil {
+			return nil, fmt.Errorf("%w: missing or duplicate sink name %q", ErrInvalidConfig, c.Name)
+		}
+		s, err := f(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.Name, err)
+		}
+		sinks[c.Name] = s
+	}
+	return sinks, nil
+}
+
+// url returns the URL from the URLEnv environment variable, or URL.
+func url(c config.SinkConfig) (string, error) {
+	u := c.URL
+	if c.URLEnv != "" {
+		u = os.Getenv(c.URLEnv)
+	}
+	if u == "" {
+		return "", fmt.Errorf("%w: %s sink requires url or url_env", ErrInvalidConfig, c.Type)
+	}
+	return u, nil
+}
+
+// post sends a JSON body, and returns an error for non 2xx responses.
+func post(ctx context.Context, client *http.Client, url string, body interface{}, header http.Header) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notification POST failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// WebhookSink posts each Event as JSON.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func newWebhookSink(c config.SinkConfig) (Sink, error) {
+	u, err := url(c)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookSink{URL: u, Client: http.DefaultClient}, nil
+}
+
+// Notify implements Sink.
+func (s *WebhookSink) Notify(ctx context.Context, e Event) error {
+	return post(ctx, s.Client, s.URL, e, nil)
+}
+
+// SlackSink posts each Event to a Slack incoming webhook.
+type SlackSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func newSlackSink(c config.SinkConfig) (Sink, error) {
+	u, err := url(c)
+	if err != nil {
+		return nil, err
+	}
+	return &SlackSink{URL: u, Client: http.DefaultClient}, nil
+}
+
+// Notify implements Sink.
+func (s *SlackSink) Notify(ctx context.Context, e Event) error {
+	return post(ctx, s.Client, s.URL, map[string]string{"text": e.Text()}, nil)
+}
+
+// sendGridURL is the SendGrid v3 mail API.
+const sendGridURL = "https://api.sendgrid.com/v3/mail/send"
+
+// SendGridSink emails each Event through the SendGrid API.
+type SendGridSink struct {
+	URL    string
+	APIKey string
+	From   string
+	To     []string
+	Client *http.Client
+}
+
+func newSendGridSink(c config.SinkConfig) (Sink, error) {
+	key := ""
+	if c.APIKeyEnv != "" {
+		key = os.Getenv(c.APIKeyEnv)
+	}
+	if key == "" || c.From == "" || len(c.To) == 0 {
+		return nil, fmt.Errorf("%w: sendgrid sink requires api_key_env, from and to", ErrInvalidConfig)
+	}
+	return &SendGridSink{URL: sendGridURL, APIKey: key, From: c.From, To: c.To, Client: http.DefaultClient}, nil
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridPersonalization struct {
+	To []sendGridAddress `json:"to"`
+}
+
+type sendGridMessage struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+}
+
+// Notify implements Sink.
+func (s *SendGridSink) Notify(ctx context.Context, e Event) error {
+	p := sendGridPersonalization{}
+	for _, to := range s.To {
+		p.To = append(p.To, sendGridAddress{Email: to})
+	}
+	msg := sendGridMessage{
+		Personalizations: []sendGridPersonalization{p},
+		From:             sendGridAddress{Email: s.From},
+		Subject:          "gardener: " + e.Text(),
+		Content: []sendGridContent{{Type: "text/plain", Value: fmt.Sprintf(
+			"%s\n\nExperiment: %s\nDatatype: %s\nDate: %s\nTime: %s\n",
+			e.Message, e.Experiment, e.Datatype, e.Date.Format("2006-01-02"), e.Time.Format(time.RFC3339))}},
+	}
+	header := http.Header{"Authorization": {"Bearer " + s.APIKey}}
+	return post(ctx, s.Client, s.URL, msg, header)
+}
@@ -0,0 +1,91 @@
+package ops_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/m-lab/go/osx"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestPublishAccessDrift(t *testing.T) {
+	cleanup := osx.MustSetenv("PROJECT", "fake-project")
+	defer cleanup()
+	readers, err := bq.ParseReaders([]string{"allAuthenticatedUsers"})
+	rtx.Must(err, "ParseReaders")
+	tests := []struct {
+		name   string
+		public bool
+		fail   bool
+		state  tracker.State
+		detail string
+	}{
+		{name: "ok", public: true, state: "waiting", detail: "Published 10 rows"},
+		{name: "warn", state: "waiting", detail: "Published with warning: dataset access drift"},
+		{name: "fail", fail: true, state: tracker.Failed, detail: "access drift"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+			rtx.Must(err, "tk init")
+			job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 8, 0, 0, 0, 0, time.UTC))
+			rtx.Must(tk.AddJob(job), "add job")
+			rtx.Must(tk.SetStatus(job, tracker.ParseComplete, "-"), "set status")
+
+			client := bqfake.NewClient("fake-project")
+			client.AddResult("rows in the raw and published", bqfake.Result{Rows: []interface{}{
+				bq.PublishCount{Table: "raw", Rows: 10}, bq.PublishCount{Table: "published", Rows: 10}}})
+			access := []*bqiface.AccessEntry{}
+			if tt.public {
+				access = append(access, &bqiface.AccessEntry{AccessEntry: bigquery.AccessEntry{
+					Role: bigquery.ReaderRole, EntityType: bigquery.SpecialGroupEntity, Entity: "allAuthenticatedUsers"}})
+			}
+			client.SetAccess("ndt", access)
+			m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+			rtx.Must(err, "NewMonitor failure")
+			m.SetBQClient(client)
+			rtx.Must(m.SetPublish(map[string]bq.PublishTarget{"ndt": {Project: "public", Dataset: "ndt",
+				Readers: readers, FailOnDrift: tt.fail}}), "SetPublish")
+			rtx.Must(m.ConfigureSteps([]config.SourceConfig{{Experiment: "ndt", Datatype: "ndt7",
+				Pipeline: []string{"publish", "external:waiting"}}}), "ConfigureSteps")
+			go m.Watch(ctx, 5*time.Millisecond)
+
+			var s tracker.Status
+			for i := 0; i < 500; i++ {
+				if s, err = tk.GetStatus(job); err == nil && s.State() == tt.state {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if s.State() != tt.state {
+				t.Fatal("Wrong state", s.State(), s.Error())
+			}
+			if tt.state == tracker.Failed {
+				if !strings.Contains(s.Error(), tt.detail) {
+					t.Error("Wrong error", s.Error())
+				}
+				if len(client.Copies()) != 0 {
+					t.Error("Expected no publish copy", client.Copies())
+				}
+				return
+			}
+			// The publishing detail is in the penultimate state.
+			if detail := s.History[len(s.History)-2].Detail; !strings.HasPrefix(detail, tt.detail) {
+				t.Error("Wrong detail", detail)
+			}
+		})
+	}
+}
@@ -4,72 +4,131 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/api/googleapi"
 
 	"github.com/m-lab/etl-gardener/cloud"
 	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/gcs"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/logging"
 	"github.com/m-lab/etl-gardener/metrics"
 	"github.com/m-lab/etl-gardener/tracker"
 )
 
+// CleanupKey is the job annotation that records whether the delete action
+// deleted the tmp partition, or found it already empty.
+const CleanupKey = "cleanup"
+
+// ScriptKeyPrefix prefixes the job annotations that record the row counts
+// reported by each step of the script runner.
+const ScriptKeyPrefix = "script_"
+
 func newStateFunc(detail string) ActionFunc {
 	return func(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
 		return Success(j, detail)
 	}
 }
 
+func init() {
+	// Register the standard actions, so they can also be referenced in config.
+	RegisterRunner("inventory", funcFactory("inventory",
+		func(m *Monitor) ActionFunc { return m.inventoryFunc }))
+	RegisterRunner("load", funcFactory("load",
+		func(m *Monitor) ActionFunc { return m.loadFunc }))
+	RegisterRunner("dedup", funcFactory("dedup",
+		func(m *Monitor) ActionFunc { return m.dedupFunc }))
+	RegisterRunner("dedup_check", funcFactory("dedup_check",
+		func(m *Monitor) ActionFunc { return m.dedupCheckFunc }))
+	RegisterRunner("copy", funcFactory("copy",
+		func(m *Monitor) ActionFunc { return m.copyFunc }))
+	RegisterRunner("validate", funcFactory("validate",
+		func(m *Monitor) ActionFunc { return m.validateFunc(config.ValidationThreshold()) }))
+	RegisterRunner("publish", funcFactory("publish",
+		func(m *Monitor) ActionFunc { return m.publishFunc }))
+	RegisterRunner("script", funcFactory("script",
+		func(m *Monitor) ActionFunc { return m.scriptFunc }))
+	RegisterRunner("delete", funcFactory("delete",
+		func(m *Monitor) ActionFunc { return m.deleteFunc }))
+}
+
 // NewStandardMonitor creates the standard monitor that handles several state transitions.
-func NewStandardMonitor(ctx context.Context, config cloud.BQConfig, tk *tracker.Tracker) (*Monitor, error) {
-	m, err := NewMonitor(ctx, config, tk)
+func NewStandardMonitor(ctx context.Context, bqConfig cloud.BQConfig, tk *tracker.Tracker) (*Monitor, error) {
+	m, err := NewMonitor(ctx, bqConfig, tk)
 	if err != nil {
 		return nil, err
 	}
 	m.AddAction(tracker.ParseComplete,
 		nil,
-		newStateFunc("-"),
+		m.inventoryFunc,
 		tracker.Loading,
-		"Changing to Loading")
+		"Listing archive")
 	m.AddAction(tracker.Loading,
 		nil,
-		loadFunc,
+		m.loadFunc,
 		tracker.Deduplicating,
 		"Loading")
 	m.AddAction(tracker.Deduplicating,
 		nil,
-		dedupFunc,
+		m.dedupFunc,
 		tracker.Copying,
 		"Deduplicating")
 	m.AddAction(tracker.Copying,
 		nil,
-		copyFunc,
-		tracker.Deleting,
+		m.copyFunc,
+		tracker.Validating,
 		"Copying")
+	m.AddAction(tracker.Validating,
+		nil,
+		m.validateFunc(config.ValidationThreshold()),
+		tracker.Deleting,
+		"Validating")
+	// Validated jobs of experiments with a publish target go through
+	// Publishing before Deleting.  See SetPublish.
+	m.AddAction(tracker.Publishing,
+		nil,
+		m.publishFunc,
+		tracker.Deleting,
+		"Publishing")
 	m.AddAction(tracker.Deleting,
 		nil,
-		deleteFunc,
+		m.deleteFunc,
 		tracker.Complete,
 		"Deleting")
+
+	limits := config.Monitor()
+	m.SetConcurrency(tracker.Deduplicating, limits.MaxConcurrentDedups)
+	m.SetConcurrency(tracker.Copying, limits.MaxConcurrentCopies)
+	m.SetConcurrency(tracker.Publishing, limits.MaxConcurrentCopies)
+	m.SetConcurrency(tracker.Deleting, limits.MaxConcurrentCleanups)
+	m.SetDMLConcurrency(limits.MaxConcurrentDMLPerTable)
+	for state, d := range limits.Deadlines {
+		m.SetDeadline(tracker.State(state), d)
+	}
+	m.verifyCopies = limits.VerifyCopies
 	return m, nil
 }
 
 // Waits for bqjob to complete, handles backoff and job updates.
 // Returns non-nil status if successful.
 func waitAndCheck(ctx context.Context, bqJob bqiface.Job, j tracker.Job, label string) (*bigquery.JobStatus, *Outcome) {
+	logger := logging.FromContext(ctx)
 	status, err := bqJob.Wait(ctx)
 	if err != nil {
 		switch typedErr := err.(type) {
 		case *googleapi.Error:
 			if typedErr.Code == http.StatusBadRequest &&
 				strings.Contains(typedErr.Error(), "streaming buffer") {
-				log.Println(typedErr)
+				logger.Println(typedErr)
 				metrics.WarningCount.WithLabelValues(
 					j.Experiment, j.Datatype,
 					label+"WaitingForStreamingBuffer").Inc()
@@ -77,12 +136,12 @@ func waitAndCheck(ctx context.Context, bqJob bqiface.Job, j tracker.Job, label s
 				// Leave in current state, Wait a while and try again.
 				return nil, Retry(j, err, "waiting for empty streaming buffer")
 			}
-			log.Println(typedErr, typedErr.Code)
+			logger.Println(typedErr, typedErr.Code)
 		default:
 			// We don't know the problem...
 		}
 		// Not googleapi.Error, OR not streaming buffer problem.
-		log.Println(j, label, err)
+		logger.Println(label, err)
 		metrics.WarningCount.WithLabelValues(
 			j.Experiment, j.Datatype,
 			label+"UnknownError").Inc()
@@ -91,9 +150,9 @@ func waitAndCheck(ctx context.Context, bqJob bqiface.Job, j tracker.Job, label s
 	}
 	if status.Err() != nil {
 		err := status.Err()
-		log.Println(j, label, err)
+		logger.Println(label, err)
 		for i := range status.Errors {
-			log.Println("---", j, label, status.Errors[i])
+			logger.Println("---", label, status.Errors[i])
 		}
 		metrics.WarningCount.WithLabelValues(
 			j.Experiment, j.Datatype,
@@ -105,39 +164,178 @@ func waitAndCheck(ctx context.Context, bqJob bqiface.Job, j tracker.Job, label s
 	return status, Success(j, "-")
 }
 
+// startOrResume returns the in-flight BigQuery job recorded for j, if any,
+// so that work in progress when gardener restarted is not resubmitted.
+// Otherwise, it starts a new job, and records its ID in the tracker.
+func (m *Monitor) startOrResume(ctx context.Context, qp *bq.TableOps, j tracker.Job,
+	start func(context.Context, bool) (bqiface.Job, error)) (bqiface.Job, error) {
+	logger := logging.FromContext(ctx)
+	if status, err := m.tk.GetStatus(j); err == nil && status.BQJobID != "" {
+		bqJob, err := qp.JobFromID(ctx, status.BQJobID)
+		if err == nil {
+			logger.Println("resuming BigQuery job", status.BQJobID)
+			setSpanAttributes(ctx, attribute.String("bigquery.job_id", status.BQJobID),
+				attribute.Bool("bigquery.resumed", true))
+			return bqJob, nil
+		}
+		// The job may have expired, so just start a new one.
+		logger.Println("could not resume BigQuery job", status.BQJobID, err)
+	}
+	bqJob, err := start(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	setSpanAttributes(ctx, attribute.String("bigquery.job_id", bqJob.ID()))
+	if err := m.tk.SetBQJobID(j, bqJob.ID()); err != nil {
+		logger.Println(err)
+	}
+	return bqJob, nil
+}
+
+// startAndWait starts or resumes the BigQuery job, and waits for it.  If
+// dmlTable is not empty, the job is mutating DML against that table, and
+// is scheduled with the Monitor's DML limits.  DML limit errors are retried.
+func (m *Monitor) startAndWait(ctx context.Context, qp *bq.TableOps, j tracker.Job, label, dmlTable string,
+	start func(context.Context, bool) (bqiface.Job, error)) (*bigquery.JobStatus, *Outcome) {
+	release := func(error) {}
+	if dmlTable != "" {
+		r, err := m.dml.acquire(ctx, dmlTable)
+		if err != nil {
+			return nil, Retry(j, err, "waiting for DML slot")
+		}
+		release = r
+	}
+	bqJob, err := m.startOrResume(ctx, qp, j, start)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		release(err)
+		// Try again soon.
+		return nil, dmlOutcome(Retry(j, err, "-"))
+	}
+	status, outcome := waitAndCheck(ctx, bqJob, j, label)
+	release(outcome.error)
+	return status, dmlOutcome(outcome)
+}
+
+// clearOnRetry clears the recorded BigQuery job, so that a retry will
+// start a new job.  If the action was cancelled, e.g. on shutdown, the
+// BigQuery job may still be running, so it is kept for resumption.
+func (m *Monitor) clearOnRetry(ctx context.Context, j tracker.Job, outcome *Outcome) {
+	if outcome.ShouldRetry() && ctx.Err() == nil {
+		if err := m.tk.SetBQJobID(j, ""); err != nil {
+			j.Logger().Println(err)
+		}
+	}
+}
+
+// loadSource returns the GCS pattern of the parser output files for the job.
+func loadSource(project string, j tracker.Job) string {
+	return fmt.Sprintf("gs://etl-%s/%s/%s/%s%s*",
+		project,
+		j.Experiment, j.Datatype, j.Date.Format("2006/01/02/"), j.Prefix)
+}
+
 // TODO - would be nice to persist this object, instead of creating it
 // repeatedly.  If we end up with separate state machine per job, that
 // would be a good place for the TableOps object.
-func tableOps(ctx context.Context, j tracker.Job) (*bq.TableOps, error) {
+func (m *Monitor) tableOps(ctx context.Context, j tracker.Job) (*bq.TableOps, error) {
 	// TODO pass in the JobWithTarget, and get this info from Target.
 	project := os.Getenv("PROJECT")
-	loadSource := fmt.Sprintf("gs://etl-%s/%s/%s/%s",
-		project,
-		j.Experiment, j.Datatype, j.Date.Format("2006/01/02/*"))
-	return bq.NewTableOps(ctx, j, project, loadSource)
+	loadSource := loadSource(project, j)
+	setSpanAttributes(ctx, attribute.String("gcs.prefix", loadSource))
+	var to *bq.TableOps
+	var err error
+	if m.bqClient != nil {
+		to, err = bq.NewTableOpsWithClientAndNaming(m.bqClient, j, project, loadSource, m.naming)
+	} else {
+		to, err = bq.NewTableOpsWithNaming(ctx, j, project, loadSource, m.naming)
+	}
+	if err != nil {
+		return nil, err
+	}
+	to.DedupStrategy = m.dedupStrategies[j.Experiment+"/"+j.Datatype]
+	to.CopyDisposition = m.copyDispositions[j.Experiment+"/"+j.Datatype]
+	to.MaxBytesBilled = m.dedupCostCaps[j.Experiment+"/"+j.Datatype]
+	version := ""
+	if status, err := m.tk.GetStatus(j); err == nil {
+		version = status.Version
+	}
+	to.Labels = bq.JobLabels(j, version)
+	return to, nil
+}
+
+// inventoryFunc lists the archive for the job, and records the task file
+// and byte counts in the tracker, for later comparison with the parsed rows.
+func (m *Monitor) inventoryFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+	logger := logging.FromContext(ctx)
+	client := m.gcsClient
+	if client == nil {
+		c, err := storage.NewClient(ctx)
+		if err != nil {
+			logger.Println(err)
+			// Try again soon.
+			return Retry(j, err, "-")
+		}
+		defer c.Close()
+		client = stiface.AdaptClient(c)
+	}
+
+	setSpanAttributes(ctx, attribute.String("gcs.prefix", j.Path()))
+	inv, err := gcs.Inventory(ctx, client, j)
+	if err != nil {
+		logger.Println(err)
+		// Try again soon.
+		return Retry(j, err, "-")
+	}
+	if err := m.tk.SetInventory(j, inv); err != nil {
+		logger.Println(err)
+		return Failure(j, err, "-")
+	}
+	msg := fmt.Sprintf("Archive has %d files with %d bytes", inv.Files, inv.Bytes)
+	logger.Println(msg)
+	return Success(j, msg)
 }
 
 // TODO improve test coverage?
-func dedupFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+func (m *Monitor) dedupFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+	logger := logging.FromContext(ctx)
 	// This is the delay since entering the dedup state, due to monitor delay
 	// and retries.
 	delay := time.Since(stateChangeTime).Round(time.Minute)
 
 	// TODO pass in the JobWithTarget, and get the base from the target.
-	qp, err := tableOps(ctx, j)
+	qp, err := m.tableOps(ctx, j)
 	if err != nil {
-		log.Println(err)
+		logger.Println(err)
 		// This terminates this job.
 		return Failure(j, err, "-")
 	}
-	bqJob, err := qp.Dedup(ctx, false)
-	if err != nil {
-		log.Println(err)
+	// Check the schema first, as a missing column would otherwise only be
+	// reported as a SQL error in the job status.
+	if err := qp.CheckDedupSchema(ctx); err != nil {
+		logger.Println(err)
+		if errors.Is(err, bq.ErrSchemaMismatch) {
+			metrics.WarningCount.WithLabelValues(j.Experiment, j.Datatype, "DedupSchemaMismatch").Inc()
+			return Failure(j, err, "schema mismatch")
+		}
 		// Try again soon.
 		return Retry(j, err, "-")
 	}
-	status, outcome := waitAndCheck(ctx, bqJob, j, "Dedup")
+	// Delete dedups are DML against the tmp table.  Overwrites are not.
+	dmlTable := ""
+	if qp.DedupStrategy != bq.DedupOverwrite {
+		dmlTable = fmt.Sprintf("%s.%s.%s", qp.Project, qp.Names.TmpDataset, qp.Names.Table)
+	}
+	status, outcome := m.startAndWait(ctx, qp, j, "Dedup", dmlTable, qp.Dedup)
+	if bq.IsCostCapExceeded(outcome.error) {
+		// Retrying would fail the same way, so fail the job, rather than
+		// let a pathological partition burn slots.
+		logger.Println("Dedup exceeds", qp.MaxBytesBilled, "bytes billed:", outcome.error)
+		metrics.WarningCount.WithLabelValues(j.Experiment, j.Datatype, "DedupCostCapExceeded").Inc()
+		return Failure(j, fmt.Errorf("%w: %v", bq.ErrCostCapExceeded, outcome.error), "cost cap exceeded")
+	}
 	if !outcome.IsDone() {
+		m.clearOnRetry(ctx, j, outcome)
 		return outcome
 	}
 	if status == nil {
@@ -146,30 +344,102 @@ func dedupFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *O
 	}
 
 	// Dedup job was successful.  Handle the statistics, metrics, tracker update.
+	// The strategy is included, so that strategies can be compared.
+	strategy, query := bq.DedupDelete, "dedup"
+	if qp.DedupStrategy == bq.DedupOverwrite {
+		strategy, query = bq.DedupOverwrite, "dedup_overwrite"
+	}
 	var msg string
 	stats := status.Statistics
 	switch details := stats.Details.(type) {
 	case *bigquery.QueryStatistics:
 		opTime := stats.EndTime.Sub(stats.StartTime)
-		metrics.QueryCostHistogram.WithLabelValues(j.Datatype, "dedup").Observe(float64(details.SlotMillis) / 1000.0)
-		msg = fmt.Sprintf("Dedup took %s (after %v waiting), %5.2f Slot Minutes, %d Rows affected, %d MB Processed, %d MB Billed",
+		metrics.QueryCostHistogram.WithLabelValues(j.Datatype, query).Observe(float64(details.SlotMillis) / 1000.0)
+		msg = fmt.Sprintf("Dedup (%s) took %s (after %v waiting), %5.2f Slot Minutes, %d Rows affected, %d MB Processed, %d MB Billed",
+			strategy,
 			opTime.Round(100*time.Millisecond),
 			delay,
 			float64(details.SlotMillis)/60000, details.NumDMLAffectedRows,
 			details.TotalBytesProcessed/1000000, details.TotalBytesBilled/1000000)
-		log.Println(msg)
-		log.Printf("Dedup %s: %+v\n", j, details)
+		logger.Println(msg)
+		logger.Printf("Dedup: %+v", details)
 	default:
-		log.Printf("Could not convert to QueryStatistics: %+v\n", status.Statistics.Details)
+		logger.Printf("Could not convert to QueryStatistics: %+v", status.Statistics.Details)
 		msg = "Could not convert Detail to QueryStatistics"
 	}
 
+	if o := m.dedupDuplication(ctx, qp, j, status); o != nil {
+		return o
+	}
 	return Success(j, msg)
 }
 
+// dedupDuplication measures the rows removed by a successful dedup, and
+// applies the duplication policy if there were too many.
+func (m *Monitor) dedupDuplication(ctx context.Context, qp *bq.TableOps, j tracker.Job, status *bigquery.JobStatus) *Outcome {
+	if m.dupPolicy == nil || m.dupThreshold <= 0 {
+		return nil
+	}
+	after, err := qp.CountTmp(ctx)
+	if err != nil {
+		// Don't hold up the job just for the check.
+		logging.FromContext(ctx).Println("Could not count deduped rows:", err)
+		return nil
+	}
+	d := Duplication{}
+	if qp.DedupStrategy == bq.DedupOverwrite {
+		// The overwrite replaces the partition, so compare with the rows
+		// reported by the parser.
+		ts, err := m.tk.GetStatus(j)
+		if err != nil || ts.ParseStats == nil || ts.ParseStats.Rows <= 0 {
+			return nil
+		}
+		d.Rows = ts.ParseStats.Rows
+		d.Removed = d.Rows - after
+	} else {
+		details, ok := status.Statistics.Details.(*bigquery.QueryStatistics)
+		if !ok {
+			return nil
+		}
+		d.Removed = details.NumDMLAffectedRows
+		d.Rows = after + d.Removed
+	}
+	return m.checkDuplication(ctx, qp, j, d)
+}
+
+// dedupCheckFunc verifies that no dedup key has more than one row in the
+// tmp partition after dedup, and fails the job with the count if any do.
+// It is an optional pipeline stage, between dedup and copy.
+func (m *Monitor) dedupCheckFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+	logger := logging.FromContext(ctx)
+	qp, err := m.tableOps(ctx, j)
+	if err != nil {
+		logger.Println(err)
+		// This terminates this job.
+		return Failure(j, err, "-")
+	}
+	counts, err := qp.CheckDedup(ctx)
+	if errors.Is(err, bq.ErrDuplicateKeys) {
+		logger.Warningln(err)
+		metrics.DedupCheckCount.WithLabelValues(j.Experiment, j.Datatype, "duplicates").Inc()
+		metrics.DedupCheckDuplicateKeys.WithLabelValues(j.Experiment, j.Datatype).Add(float64(counts.Keys))
+		// This terminates this job, leaving the tmp partition for inspection.
+		return Failure(j, err, fmt.Sprintf("%d duplicate keys", counts.Keys))
+	}
+	if err != nil {
+		logger.Println(err)
+		metrics.DedupCheckCount.WithLabelValues(j.Experiment, j.Datatype, "error").Inc()
+		// Try again soon.
+		return Retry(j, err, "checking dedup")
+	}
+	metrics.DedupCheckCount.WithLabelValues(j.Experiment, j.Datatype, "passed").Inc()
+	return Success(j, "no duplicate keys")
+}
+
 func handleLoadError(label string, j tracker.Job, status *bigquery.JobStatus) *Outcome {
+	logger := j.Logger()
 	err := status.Err()
-	log.Println(label, err)
+	logger.Println(label, err)
 	msg := "unknown error"
 	for _, e := range status.Errors {
 		if strings.Contains(e.Message, "Please look into") {
@@ -181,14 +451,14 @@ func handleLoadError(label string, j tracker.Job, status *bigquery.JobStatus) *O
 		// When there is mismatch between row content and table schema,
 		// the bigquery Load may return "No such field:" errors.
 		if strings.Contains(e.Message, "No such field:") {
-			log.Printf("--- Field missing in bigquery: %s: %s -- %s", label, e.Message, e.Location)
+			logger.Printf("--- Field missing in bigquery: %s: %s -- %s", label, e.Message, e.Location)
 			metrics.WarningCount.WithLabelValues(
 				j.Experiment, j.Datatype,
 				label+"GCS load failed - missing field").Inc()
 			msg = e.Message
 			continue
 		}
-		log.Println("---", label, e)
+		logger.Println("---", label, e)
 		metrics.WarningCount.WithLabelValues(
 			j.Experiment, j.Datatype,
 			label+"UnknownStatusError").Inc()
@@ -199,10 +469,11 @@ func handleLoadError(label string, j tracker.Job, status *bigquery.JobStatus) *O
 }
 
 func handleWaitError(label string, j tracker.Job, status *bigquery.JobStatus) *Outcome {
+	logger := j.Logger()
 	err := status.Err()
-	log.Println(label, err)
+	logger.Println(label, err)
 	for i := range status.Errors {
-		log.Println("---", label, status.Errors[i])
+		logger.Println("---", label, status.Errors[i])
 	}
 	metrics.WarningCount.WithLabelValues(
 		j.Experiment, j.Datatype,
@@ -230,25 +501,27 @@ func waitForLoad(ctx context.Context, bqJob bqiface.Job, j tracker.Job, label st
 }
 
 // TODO improve test coverage?
-func loadFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+func (m *Monitor) loadFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+	logger := logging.FromContext(ctx)
 	// This is the delay since entering the dedup state, due to monitor delay
 	// and retries.
 	delay := time.Since(stateChangeTime).Round(time.Minute)
 
-	qp, err := tableOps(ctx, j)
+	qp, err := m.tableOps(ctx, j)
 	if err != nil {
-		log.Println(err)
+		logger.Println(err)
 		// This terminates this job.
 		return Failure(j, err, "-")
 	}
-	bqJob, err := qp.LoadToTmp(ctx, false)
+	bqJob, err := m.startOrResume(ctx, qp, j, qp.LoadToTmp)
 	if err != nil {
-		log.Println(err)
+		logger.Println(err)
 		// Try again soon.
 		return Retry(j, err, "-")
 	}
 	status, outcome := waitAndCheck(ctx, bqJob, j, "Load")
 	if !outcome.IsDone() {
+		m.clearOnRetry(ctx, j, outcome)
 		return outcome
 	}
 
@@ -273,30 +546,37 @@ func loadFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Ou
 			msg = "Load statistics unknown type"
 		}
 	}
-	log.Println(j, msg)
+	logger.Println(msg)
 	return Success(j, msg)
 }
 
 // TODO improve test coverage?
-func copyFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+func (m *Monitor) copyFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+	logger := logging.FromContext(ctx)
 	// This is the delay since entering the dedup state, due to monitor delay
 	// and retries.
 	delay := time.Since(stateChangeTime).Round(time.Minute)
 
-	qp, err := tableOps(ctx, j)
+	qp, err := m.tableOps(ctx, j)
 	if err != nil {
-		log.Println(err)
+		logger.Println(err)
 		// This terminates this job.
 		return Failure(j, err, "-")
 	}
-	bqJob, err := qp.CopyToRaw(ctx, false)
-	if err != nil {
-		log.Println(err)
-		// Try again soon.
-		return Retry(j, err, "-")
+	if o := m.holdForAnnotations(ctx, qp, j, stateChangeTime); o != nil {
+		return o
 	}
-	status, outcome := waitAndCheck(ctx, bqJob, j, "Copy")
+	if o := m.patchRawSchema(ctx, qp, j); o != nil {
+		return o
+	}
+	// Prefix copies are DML against the raw table.  Whole day copies are not.
+	dmlTable := ""
+	if j.Prefix != "" {
+		dmlTable = fmt.Sprintf("%s.%s.%s", qp.Project, qp.Names.RawDataset, qp.Names.Table)
+	}
+	status, outcome := m.startAndWait(ctx, qp, j, "Copy", dmlTable, qp.CopyToRaw)
 	if !outcome.IsDone() {
+		m.clearOnRetry(ctx, j, outcome)
 		return outcome
 	}
 
@@ -310,25 +590,265 @@ func copyFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Ou
 			delay,
 			stats.TotalBytesProcessed/1000000)
 	}
-	log.Println(j, msg)
+	if m.verifyCopies {
+		err := qp.VerifyCopy(ctx)
+		if errors.Is(err, bq.ErrChecksumMismatch) {
+			logger.Warningln(err)
+			metrics.WarningCount.WithLabelValues(
+				j.Experiment, j.Datatype, "CopyChecksumMismatch").Inc()
+			// This terminates this job, leaving the tmp partition for inspection.
+			return Failure(j, err, "checksum mismatch")
+		}
+		if err != nil {
+			logger.Println(err)
+			// Try again soon.
+			return Retry(j, err, "verifying copy")
+		}
+		msg += ", checksum verified"
+	}
+	m.recordChange(j, fmt.Sprintf("%s.%s.%s", qp.Project, qp.Names.RawDataset, qp.Names.Table), status)
+	if _, published := m.publish[j.Experiment]; !published {
+		m.refreshView(ctx, j)
+	}
+	logger.Println(msg)
+	return Success(j, msg)
+}
+
+// scriptFunc deduplicates, copies and verifies the job's partition with a
+// single BigQuery script job, in place of the dedup and copy stages.  The
+// row counts reported by the script are recorded in the job annotations.
+func (m *Monitor) scriptFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+	logger := logging.FromContext(ctx)
+	delay := time.Since(stateChangeTime).Round(time.Minute)
+
+	qp, err := m.tableOps(ctx, j)
+	if err != nil {
+		logger.Println(err)
+		// This terminates this job.
+		return Failure(j, err, "-")
+	}
+	if o := m.holdForAnnotations(ctx, qp, j, stateChangeTime); o != nil {
+		return o
+	}
+	if o := m.patchRawSchema(ctx, qp, j); o != nil {
+		return o
+	}
+	// The script modifies the raw table with DML.
+	dmlTable := fmt.Sprintf("%s.%s.%s", qp.Project, qp.Names.RawDataset, qp.Names.Table)
+	status, outcome := m.startAndWait(ctx, qp, j, "Script", dmlTable, qp.RunScript)
+	if !outcome.IsDone() {
+		m.clearOnRetry(ctx, j, outcome)
+		return outcome
+	}
+
+	js, err := m.tk.GetStatus(j)
+	if err != nil {
+		logger.Println(err)
+		return Retry(j, err, "reading script result")
+	}
+	result, err := qp.ReadScriptResult(ctx, js.BQJobID)
+	if err != nil {
+		logger.Println(err)
+		// Try again soon.  This will also repeat the script.
+		outcome := Retry(j, err, "reading script result")
+		m.clearOnRetry(ctx, j, outcome)
+		return outcome
+	}
+	if err := m.tk.Annotate(j, map[string]string{
+		ScriptKeyPrefix + "tmp_rows":     fmt.Sprint(result.TmpRows),
+		ScriptKeyPrefix + "deduped_rows": fmt.Sprint(result.DedupedRows),
+		ScriptKeyPrefix + "raw_rows":     fmt.Sprint(result.RawRows),
+	}); err != nil {
+		logger.Println(err)
+	}
+	m.recordChange(j, dmlTable, status)
+	msg := fmt.Sprintf("Script removed %d of %d rows, copied %d rows (after %s waiting)",
+		result.TmpRows-result.DedupedRows, result.TmpRows, result.RawRows, delay)
+	if status != nil && status.Statistics != nil {
+		stats := status.Statistics
+		msg += fmt.Sprintf(", %d statements took %s, %d MB processed", stats.NumChildJobs,
+			stats.EndTime.Sub(stats.StartTime).Round(100*time.Millisecond), stats.TotalBytesProcessed/1000000)
+	}
+	logger.Println(msg)
+	return Success(j, msg)
+}
+
+// recordChange records that the action rewrote the job's partition of
+// table, at the end time of the BigQuery job, if known.  Simulated actions
+// are not recorded.
+func (m *Monitor) recordChange(j tracker.Job, table string, status *bigquery.JobStatus) {
+	if m.changes == nil || m.dryRun {
+		return
+	}
+	modified := time.Now()
+	if status != nil && status.Statistics != nil && !status.Statistics.EndTime.IsZero() {
+		modified = status.Statistics.EndTime
+	}
+	m.changes.Record(j, table, modified)
+}
+
+// refreshView refreshes the annotation join view of the job's datatype, if
+// any.  Errors are logged, but don't affect the job, since the view is
+// refreshed again by the next job.
+func (m *Monitor) refreshView(ctx context.Context, j tracker.Job) {
+	if m.views == nil {
+		return
+	}
+	logger := logging.FromContext(ctx)
+	updated, err := m.views.Refresh(ctx, j.Experiment, j.Datatype)
+	switch {
+	case err != nil:
+		logger.Println("refreshing annotation view:", err)
+		metrics.ViewRefreshCount.WithLabelValues(j.Experiment, j.Datatype, "error").Inc()
+	case updated:
+		logger.Println("refreshed annotation view")
+		metrics.ViewRefreshCount.WithLabelValues(j.Experiment, j.Datatype, "updated").Inc()
+	default:
+		metrics.ViewRefreshCount.WithLabelValues(j.Experiment, j.Datatype, "current").Inc()
+	}
+}
+
+// checkAccess checks that the raw and publish datasets can be read by the
+// target's readers.  It returns a warning if they can't, so that the job is
+// published anyway, or an outcome that stops the publish, if the target
+// fails on drift.
+func (m *Monitor) checkAccess(ctx context.Context, qp *bq.TableOps, j tracker.Job, target bq.PublishTarget) (string, *Outcome) {
+	if len(target.Readers)+len(target.RawReaders) == 0 {
+		return "", nil
+	}
+	logger := logging.FromContext(ctx)
+	err := qp.CheckAccess(ctx, target)
+	switch {
+	case err == nil:
+		metrics.AccessChecks.WithLabelValues(j.Experiment, j.Datatype, "ok").Inc()
+		return "", nil
+	case !errors.Is(err, bq.ErrAccessDrift):
+		metrics.AccessChecks.WithLabelValues(j.Experiment, j.Datatype, "error").Inc()
+		logger.Println(err)
+		if target.FailOnDrift {
+			metrics.PublishCount.WithLabelValues(j.Experiment, j.Datatype, "retry").Inc()
+			return "", Retry(j, err, "checking dataset access")
+		}
+		return "", nil
+	}
+	metrics.AccessChecks.WithLabelValues(j.Experiment, j.Datatype, "drift").Inc()
+	logger.Warningln(err)
+	if target.FailOnDrift {
+		metrics.PublishCount.WithLabelValues(j.Experiment, j.Datatype, "failure").Inc()
+		// This terminates this job.  The tmp partition is retained.
+		return "", Failure(j, err, "access drift")
+	}
+	return err.Error(), nil
+}
+
+// publishFunc copies the raw partition to the experiment's publish target,
+// and checks that the row counts match.  Jobs without a target are passed
+// through, e.g. if the target was removed from the config.
+func (m *Monitor) publishFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+	logger := logging.FromContext(ctx)
+	target, ok := m.publish[j.Experiment]
+	if !ok {
+		return Success(j, "not published")
+	}
+	delay := time.Since(stateChangeTime).Round(time.Minute)
+
+	qp, err := m.tableOps(ctx, j)
+	if err != nil {
+		logger.Println(err)
+		metrics.PublishCount.WithLabelValues(j.Experiment, j.Datatype, "failure").Inc()
+		// This terminates this job.
+		return Failure(j, err, "-")
+	}
+	warnings := []string{}
+	warning, outcome := m.checkAccess(ctx, qp, j, target)
+	if outcome != nil {
+		return outcome
+	}
+	if warning != "" {
+		warnings = append(warnings, warning)
+	}
+	bqJob, err := m.startOrResume(ctx, qp, j, func(ctx context.Context, dryRun bool) (bqiface.Job, error) {
+		return qp.Publish(ctx, target, dryRun)
+	})
+	if err != nil {
+		logger.Println(err)
+		metrics.PublishCount.WithLabelValues(j.Experiment, j.Datatype, "retry").Inc()
+		// Try again soon.
+		return Retry(j, err, "-")
+	}
+	status, outcome := waitAndCheck(ctx, bqJob, j, "Publish")
+	if !outcome.IsDone() {
+		m.clearOnRetry(ctx, j, outcome)
+		label := "failure"
+		if outcome.ShouldRetry() {
+			label = "retry"
+		}
+		metrics.PublishCount.WithLabelValues(j.Experiment, j.Datatype, label).Inc()
+		return outcome
+	}
+
+	counts, err := qp.CheckPublished(ctx, target)
+	if errors.Is(err, bq.ErrPublishMismatch) {
+		logger.Warningln(err)
+		metrics.PublishCount.WithLabelValues(j.Experiment, j.Datatype, "mismatch").Inc()
+		// This terminates this job.  The tmp partition is retained.
+		return Failure(j, err, "publish mismatch")
+	}
+	if err != nil {
+		logger.Println(err)
+		metrics.PublishCount.WithLabelValues(j.Experiment, j.Datatype, "retry").Inc()
+		// Try again soon.  This will also repeat the copy.
+		outcome := Retry(j, err, "checking published partition")
+		m.clearOnRetry(ctx, j, outcome)
+		return outcome
+	}
+
+	metrics.PublishCount.WithLabelValues(j.Experiment, j.Datatype, "success").Inc()
+	metrics.PublishedRows.WithLabelValues(j.Experiment, j.Datatype).Add(float64(counts.Published))
+	m.recordChange(j, fmt.Sprintf("%s.%s.%s", target.Project, target.Dataset, qp.Names.Table), status)
+	m.refreshView(ctx, j)
+	msg := fmt.Sprintf("Published %d rows to %s.%s (after %s waiting)",
+		counts.Published, target.Project, target.Dataset, delay)
+	if warning := m.checkSize(ctx, qp, j, target, counts.Published); warning != "" {
+		warnings = append(warnings, warning)
+	}
+	if len(warnings) > 0 {
+		msg = "Published with warning: " + strings.Join(warnings, "; ") + ". " + msg
+	}
+	if status != nil && status.Statistics != nil {
+		stats := status.Statistics
+		msg += fmt.Sprintf(", copy took %s", stats.EndTime.Sub(stats.StartTime).Round(100*time.Millisecond))
+	}
+	logger.Println(msg)
 	return Success(j, msg)
 }
 
 // TODO improve test coverage?
-func deleteFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+func (m *Monitor) deleteFunc(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+	logger := logging.FromContext(ctx)
 	// TODO pass in the JobWithTarget, and get the base from the target.
-	qp, err := tableOps(ctx, j)
+	qp, err := m.tableOps(ctx, j)
 	if err != nil {
-		log.Println(err)
+		logger.Println(err)
 		// This terminates this job.
 		return Failure(j, err, "-")
 	}
-	err = qp.DeleteTmp(ctx)
+	empty, err := qp.CleanupTmp(ctx)
 	if err != nil {
-		log.Println(err)
+		logger.Println(err)
 		// Try again soon.
 		return Retry(j, err, "-")
 	}
+	if empty {
+		// Usually a retry after the partition was deleted.
+		if err := m.tk.Annotate(j, map[string]string{CleanupKey: "already empty"}); err != nil {
+			logger.Println(err)
+		}
+		return Success(j, "Tmp partition already empty")
+	}
+	if err := m.tk.Annotate(j, map[string]string{CleanupKey: "deleted"}); err != nil {
+		logger.Println(err)
+	}
 
 	// TODO - add elapsed time to message.
 	return Success(j, "Successfully deleted partition")
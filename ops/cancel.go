@@ -0,0 +1,106 @@
+package ops
+
+import (
+	"context"
+	"errors"
+
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Cancel cancels a job, and any shards of it.  The job moves to Cancelling,
+// with the reason, any action in progress for it is abandoned, and any
+// in-flight BigQuery job launched for it is cancelled, to avoid wasting
+// slots.  Jobs held by a parser, i.e. in Init or Parsing without an action,
+// stay Cancelling until the parser's next heartbeat or update is refused,
+// or they are stale.  Other jobs are failed immediately.
+func (m *Monitor) Cancel(ctx context.Context, j tracker.Job, reason string) error {
+	// Move the job to Cancelling first, so that the abandoned action will
+	// not update it further.
+	status, err := m.tk.Cancel(j, reason)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	cancel, claimed := m.jobClaims[j]
+	m.lock.Unlock()
+	if claimed {
+		cancel()
+	}
+
+	if status.BQJobID != "" {
+		if err := m.cancelBQJob(ctx, j, status.BQJobID); err != nil {
+			// The job has been cancelled, so just log the error.
+			j.Logger().Warningln("could not cancel BigQuery job", status.BQJobID, err)
+			metrics.WarningCount.WithLabelValues(
+				j.Experiment, j.Datatype, "CancelBQJobFailed").Inc()
+		} else {
+			j.Logger().Println("cancelled BigQuery job", status.BQJobID)
+		}
+	}
+
+	// Shards that are already complete or gone are skipped.
+	for prefix := range status.Shards {
+		shard := j
+		shard.Prefix = prefix
+		err := m.Cancel(ctx, shard, "sharded job cancelled: "+reason)
+		if err != nil && !errors.Is(err, tracker.ErrJobNotFound) &&
+			!errors.Is(err, tracker.ErrInvalidStateTransition) {
+			shard.Logger().Warningln("could not cancel shard:", err)
+		}
+	}
+
+	if state := status.State(); claimed || (state != tracker.Init && state != tracker.Parsing) {
+		return m.tk.FinishCancel(j)
+	}
+	return nil
+}
+
+// Reprocess forces a job to be processed again from the start, even if it
+// is in flight or already complete, e.g. after a parser fix.  Any action in
+// progress is cancelled, and the job's tmp partition is deleted, so that no
+// rows from earlier processing survive into the raw partition, which the copy
+// overwrites.  The job is then failed, and requeued through the Reparser, so
+// that it is dispatched to a parser again, with a new history, before other
+// jobs.
+func (m *Monitor) Reprocess(ctx context.Context, j tracker.Job, reason string) error {
+	_, err := m.tk.GetStatus(j)
+	tracked := err == nil
+	if tracked {
+		// Complete and failed jobs don't need to be cancelled.
+		err := m.Cancel(ctx, j, "reprocess: "+reason)
+		if err != nil && !errors.Is(err, tracker.ErrInvalidStateTransition) {
+			return err
+		}
+	}
+	qp, err := m.tableOps(ctx, j)
+	if err == nil {
+		err = qp.DeleteTmp(ctx)
+	}
+	if err != nil {
+		// The tmp partition may not exist.  Any stale rows are removed by dedup.
+		j.Logger().Println("could not delete tmp partition for reprocess:", err)
+	}
+	if tracked {
+		// A job still held by a parser stays Cancelling until the parser is
+		// heard from, but it must be done before it can be dispatched again.
+		if err := m.tk.FinishCancel(j); err != nil {
+			return err
+		}
+	}
+	return m.requeue(ctx, j)
+}
+
+// cancelBQJob requests cancellation of a BigQuery job.
+func (m *Monitor) cancelBQJob(ctx context.Context, j tracker.Job, id string) error {
+	qp, err := m.tableOps(ctx, j)
+	if err != nil {
+		return err
+	}
+	bqJob, err := qp.JobFromID(ctx, id)
+	if err != nil {
+		return err
+	}
+	return bqJob.Cancel(ctx)
+}
@@ -0,0 +1,102 @@
+package ops_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(job), "add job")
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	started := make(chan struct{})
+	m.AddAction(tracker.Init,
+		nil,
+		func(ctx context.Context, j tracker.Job, t time.Time) *ops.Outcome {
+			close(started)
+			<-ctx.Done()
+			return ops.Success(j, "should be ignored")
+		},
+		tracker.Complete,
+		"Blocking")
+	go m.Watch(ctx, 10*time.Millisecond)
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Action did not start")
+	}
+
+	other := tracker.NewJob("bucket", "exp", "other", job.Date)
+	if err := m.Cancel(ctx, other, "testing"); err != tracker.ErrJobNotFound {
+		t.Error("Expected ErrJobNotFound", err)
+	}
+	rtx.Must(m.Cancel(ctx, job, "testing"), "Cancel")
+
+	// Allow the abandoned action to return.
+	time.Sleep(50 * time.Millisecond)
+	status, err := tk.GetStatus(job)
+	rtx.Must(err, "get status")
+	if status.State() != tracker.Failed {
+		t.Error("Expected Failed:", status.State())
+	}
+	if !strings.Contains(status.Detail(), "cancelled: testing") {
+		t.Error("Wrong detail:", status.Detail())
+	}
+}
+
+func TestReprocess(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(job), "add job")
+	rtx.Must(tk.SetStatus(job, tracker.Copying, "copying"), "set status")
+	parsing := tracker.NewJob("bucket", "exp", "type", job.Date.AddDate(0, 0, 1))
+	rtx.Must(tk.AddJob(parsing), "add job")
+	rtx.Must(tk.SetStatus(parsing, tracker.Parsing, ""), "set status")
+
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	if err := m.Reprocess(ctx, job, "testing"); err == nil {
+		t.Error("Expected an error without a reparser")
+	}
+	r := &fakeReparser{jobs: make(chan tracker.Job, 10)}
+	m.SetReparser(r)
+
+	// Jobs in flight, including those held by a parser, are failed and
+	// requeued, so that they can be dispatched again.
+	for _, j := range []tracker.Job{job, parsing} {
+		rtx.Must(m.Reprocess(ctx, j, "testing"), "Reprocess")
+		status, err := tk.GetStatus(j)
+		rtx.Must(err, "get status")
+		if status.State() != tracker.Failed || !strings.Contains(status.Detail(), "reprocess: testing") {
+			t.Error("Expected Failed:", status.State(), status.Detail())
+		}
+		if q := <-r.jobs; q != j {
+			t.Error("Wrong requeued job", q)
+		}
+		rtx.Must(tk.AddJob(j), "dispatch")
+	}
+
+	// Jobs that are not tracked, e.g. long complete, are requeued.
+	other := tracker.NewJob("bucket", "exp", "type", job.Date.AddDate(0, 0, 2))
+	rtx.Must(m.Reprocess(ctx, other, "testing"), "Reprocess")
+	if q := <-r.jobs; q != other {
+		t.Error("Wrong requeued job", q)
+	}
+}
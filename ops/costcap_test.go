@@ -0,0 +1,79 @@
+package ops_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/go/osx"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestSetDedupCostCaps(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	err = m.SetDedupCostCaps([]config.SourceConfig{
+		{Experiment: "ndt", Datatype: "ndt7", MaxDedupBytesBilled: 1 << 40},
+		{Experiment: "ndt", Datatype: "annotation"},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	err = m.SetDedupCostCaps([]config.SourceConfig{
+		{Experiment: "ndt", Datatype: "ndt7", MaxDedupBytesBilled: -1},
+	})
+	if !errors.Is(err, ops.ErrInvalidCostCap) {
+		t.Error("Expected ErrInvalidCostCap", err)
+	}
+}
+
+func TestDedupCostCapExceeded(t *testing.T) {
+	cleanup := osx.MustSetenv("PROJECT", "fake-project")
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(job), "add job")
+	rtx.Must(tk.SetStatus(job, tracker.Deduplicating, "-"), "set status")
+
+	client := bqfake.NewClient("fake-project")
+	client.AddTable("tmp_ndt", "ndt7", &bigquery.TableMetadata{Schema: bigquery.Schema{
+		{Name: "id"}, {Name: "date"}, {Name: "parser", Schema: bigquery.Schema{{Name: "Time"}}}}})
+	client.AddResult("# Delete all duplicate rows", bqfake.Result{JobErr: &bigquery.Error{
+		Reason: "bytesBilledLimitExceeded", Message: "Query exceeded limit for bytes billed: 1000."}})
+
+	m, err := ops.NewStandardMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	m.SetBQClient(client)
+	rtx.Must(m.SetDedupCostCaps([]config.SourceConfig{
+		{Experiment: "ndt", Datatype: "ndt7", MaxDedupBytesBilled: 1000}}), "SetDedupCostCaps")
+	go m.Watch(ctx, 5*time.Millisecond)
+
+	for i := 0; i < 500; i++ {
+		if s, err := tk.GetStatus(job); err == nil && s.State() == tracker.Failed {
+			if !strings.HasSuffix(s.Error(), "cost cap exceeded") {
+				t.Error("Wrong error", s.Error())
+			}
+			if runs := client.QueryRuns(); len(runs) != 1 || runs[0].MaxBytesBilled != 1000 {
+				t.Error("Expected one capped dedup", runs)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected job to fail")
+}
@@ -0,0 +1,78 @@
+package ops_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/m-lab/go/osx"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestDedupCheck(t *testing.T) {
+	cleanup := osx.MustSetenv("PROJECT", "fake-project")
+	defer cleanup()
+	tests := []struct {
+		name   string
+		counts bq.DuplicateCounts
+		state  tracker.State
+		detail string
+	}{
+		{name: "passed", state: tracker.Complete},
+		{name: "duplicates", counts: bq.DuplicateCounts{Keys: 3, ExtraRows: 4},
+			state: tracker.Failed, detail: "3 duplicate keys"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+			rtx.Must(err, "tk init")
+			job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+			rtx.Must(tk.AddJob(job), "add job")
+			rtx.Must(tk.SetStatus(job, tracker.ParseComplete, "-"), "set status")
+
+			client := bqfake.NewClient("fake-project")
+			client.AddResult("HAVING key_rows > 1", bqfake.Result{Rows: []interface{}{tt.counts}})
+			m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+			rtx.Must(err, "NewMonitor failure")
+			m.SetBQClient(client)
+			rtx.Must(m.ConfigureSteps([]config.SourceConfig{
+				{Experiment: "ndt", Datatype: "ndt7", Pipeline: []string{"dedup_check"}}}), "ConfigureSteps")
+			before := testutil.ToFloat64(metrics.DedupCheckCount.WithLabelValues("ndt", "ndt7", tt.name))
+			go m.Watch(ctx, 5*time.Millisecond)
+
+			// Completed jobs are removed from the tracker.
+			done := func() bool {
+				s, err := tk.GetStatus(job)
+				if tt.state == tracker.Complete {
+					return err == tracker.ErrJobNotFound
+				}
+				return err == nil && s.State() == tt.state && strings.HasSuffix(s.Error(), tt.detail)
+			}
+			for i := 0; i < 500 && !done(); i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if !done() {
+				t.Fatal("Expected job to be", tt.state)
+			}
+			if n := testutil.ToFloat64(metrics.DedupCheckCount.WithLabelValues("ndt", "ndt7", tt.name)) - before; n != 1 {
+				t.Error("Wrong check count", n)
+			}
+			if q := client.Queries(); len(q) != 1 {
+				t.Error("Expected one check query", q)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// dmlQueueDepth tracks the number of jobs waiting to run DML on a table.
+	// Provides metrics:
+	//   gardener_dml_queue_depth{table}
+	dmlQueueDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gardener_dml_queue_depth",
+			Help: "Number of jobs waiting to run DML, by table.",
+		},
+		[]string{"table"},
+	)
+
+	// dmlLimitErrors counts DML statements rejected by BigQuery's
+	// concurrent DML limits.
+	// Provides metrics:
+	//   gardener_dml_limit_errors_total{table}
+	dmlLimitErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_dml_limit_errors_total",
+			Help: "Number of DML statements rejected for too many concurrent DML statements, by table.",
+		},
+		[]string{"table"},
+	)
+)
+
+// ErrTooManyDML is the retryable error for DML statements rejected by
+// BigQuery's limits on concurrent DML per table.
+var ErrTooManyDML = errors.New("too many DML statements")
+
+// Backoff limits after DML limit errors.
+const (
+	minDMLBackoff = 10 * time.Second
+	maxDMLBackoff = 10 * time.Minute
+)
+
+// isDMLLimitError returns true for BigQuery errors reporting too many
+// concurrent or queued DML statements against a table.
+func isDMLLimitError(err error) bool {
+	return err != nil && (errors.Is(err, ErrTooManyDML) ||
+		strings.Contains(strings.ToLower(err.Error()), "too many dml statements"))
+}
+
+// dmlTable is the DML schedule for a single table.
+type dmlTable struct {
+	sem      chan struct{}
+	failures int       // Consecutive DML limit errors.
+	until    time.Time // No new DML before this time.
+}
+
+// dmlScheduler limits the mutating DML statements that run concurrently
+// against each table, queueing the excess, and backs off from tables after
+// DML limit errors.
+type dmlScheduler struct {
+	lock   sync.Mutex
+	limit  int
+	tables map[string]*dmlTable
+}
+
+func newDMLScheduler(limit int) *dmlScheduler {
+	return &dmlScheduler{limit: limit, tables: make(map[string]*dmlTable)}
+}
+
+func (s *dmlScheduler) table(name string) *dmlTable {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t, ok := s.tables[name]
+	if !ok {
+		t = &dmlTable{sem: make(chan struct{}, s.limit)}
+		s.tables[name] = t
+	}
+	return t
+}
+
+// acquire waits for any backoff, and then for a DML slot for the table.
+// It returns a func that releases the slot, with the result of the DML, so
+// that DML limit errors extend the backoff.  Returns an error if the
+// context is cancelled first.
+func (s *dmlScheduler) acquire(ctx context.Context, name string) (func(error), error) {
+	t := s.table(name)
+	dmlQueueDepth.WithLabelValues(name).Inc()
+	defer dmlQueueDepth.WithLabelValues(name).Dec()
+
+	s.lock.Lock()
+	wait := time.Until(t.until)
+	s.lock.Unlock()
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+	select {
+	case t.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return func(err error) {
+		s.lock.Lock()
+		switch {
+		case isDMLLimitError(err):
+			dmlLimitErrors.WithLabelValues(name).Inc()
+			t.failures++
+			backoff := minDMLBackoff << uint(t.failures-1)
+			if backoff > maxDMLBackoff || backoff <= 0 {
+				backoff = maxDMLBackoff
+			}
+			t.until = time.Now().Add(backoff)
+		case err == nil:
+			t.failures = 0
+		}
+		s.lock.Unlock()
+		<-t.sem
+	}, nil
+}
+
+// SetDMLConcurrency limits the mutating DML statements, i.e. delete dedups
+// and prefix copies, that run concurrently against each table.  The
+// default of 1 serializes them, to stay within BigQuery's concurrent DML
+// limits.  Should be called before Watch.
+func (m *Monitor) SetDMLConcurrency(perTable int) {
+	if perTable <= 0 {
+		perTable = 1
+	}
+	m.dml = newDMLScheduler(perTable)
+}
+
+// dmlOutcome converts DML limit errors into retryable outcomes, so that
+// the job is not failed.
+func dmlOutcome(o *Outcome) *Outcome {
+	if o.IsDone() || !isDMLLimitError(o.error) {
+		return o
+	}
+	return Retry(o.job, o.error, "too many DML statements, backing off")
+}
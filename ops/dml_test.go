@@ -0,0 +1,92 @@
+package ops_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestIsDMLLimitError(t *testing.T) {
+	bqErr := errors.New("googleapi: Error 400: Too many DML statements outstanding against table p:d.t, limit is 20")
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("other"), false},
+		{ops.ErrTooManyDML, true},
+		{fmt.Errorf("wrapped: %w", ops.ErrTooManyDML), true},
+		{bqErr, true},
+	}
+	for _, tt := range tests {
+		if got := ops.IsDMLLimitError(tt.err); got != tt.want {
+			t.Errorf("IsDMLLimitError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDMLOutcome(t *testing.T) {
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	o := ops.DMLOutcome(ops.Failure(job, ops.ErrTooManyDML, "-"))
+	if !o.ShouldRetry() {
+		t.Error("DML limit failures should be retried:", o)
+	}
+	o = ops.DMLOutcome(ops.Failure(job, errors.New("other"), "-"))
+	if o.ShouldRetry() {
+		t.Error("Other failures should not be retried:", o)
+	}
+	o = ops.DMLOutcome(ops.Success(job, "-"))
+	if !o.IsDone() {
+		t.Error("Success should be done:", o)
+	}
+}
+
+func TestDMLScheduling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+
+	release, err := m.AcquireDML(ctx, "p.d.t")
+	rtx.Must(err, "acquire")
+
+	// A second statement against the same table should wait.
+	short, shortCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err = m.AcquireDML(short, "p.d.t")
+	shortCancel()
+	if err != context.DeadlineExceeded {
+		t.Error("Should have waited for the table:", err)
+	}
+	// Other tables are not affected.
+	other, err := m.AcquireDML(ctx, "p.d.other")
+	rtx.Must(err, "acquire other")
+	other(nil)
+
+	// A DML limit error should back off the table, even though the slot is free.
+	release(ops.ErrTooManyDML)
+	short, shortCancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err = m.AcquireDML(short, "p.d.t")
+	shortCancel()
+	if err != context.DeadlineExceeded {
+		t.Error("Should have backed off the table:", err)
+	}
+
+	// Higher limits allow concurrent statements.
+	m.SetDMLConcurrency(2)
+	r1, err := m.AcquireDML(ctx, "p.d.t")
+	rtx.Must(err, "acquire 1")
+	r2, err := m.AcquireDML(ctx, "p.d.t")
+	rtx.Must(err, "acquire 2")
+	r1(nil)
+	r2(nil)
+}
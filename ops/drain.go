@@ -0,0 +1,58 @@
+package ops
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// drainCancelWait bounds the wait for cancelled actions to return.
+const drainCancelWait = 5 * time.Second
+
+// Drain stops the Monitor from starting new actions, and waits for actions
+// in progress to finish, until ctx is done.  Actions still running are then
+// cancelled, leaving their jobs in the current state, with any in-flight
+// BigQuery job ID recorded in the tracker, so that the work is resumed after
+// restart.  Returns the jobs handed back.
+func (m *Monitor) Drain(ctx context.Context) []tracker.Job {
+	m.Pause()
+	m.drainOnce.Do(func() { close(m.draining) })
+
+	done := make(chan struct{})
+	go func() {
+		m.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	m.lock.Lock()
+	jobs := make([]tracker.Job, 0, len(m.jobClaims))
+	cancels := make([]context.CancelFunc, 0, len(m.jobClaims))
+	for j, cancel := range m.jobClaims {
+		jobs = append(jobs, j)
+		cancels = append(cancels, cancel)
+	}
+	m.lock.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+	for _, j := range jobs {
+		if s, err := m.tk.GetStatus(j); err == nil && s.BQJobID != "" {
+			j.Logger().Println("handing back", s.State(), "with BigQuery job", s.BQJobID)
+		} else {
+			j.Logger().Println("handing back", s.State())
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(drainCancelWait):
+		log.Println("Timed out waiting for cancelled actions")
+	}
+	return jobs
+}
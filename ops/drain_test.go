@@ -0,0 +1,77 @@
+package ops_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	short := tracker.NewJob("bucket", "exp", "short", date)
+	long := tracker.NewJob("bucket", "exp", "long", date)
+	rtx.Must(tk.AddJob(short), "add job")
+	rtx.Must(tk.AddJob(long), "add job")
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	started := make(chan struct{}, 2)
+	m.AddAction(tracker.Init,
+		nil,
+		func(ctx context.Context, j tracker.Job, t time.Time) *ops.Outcome {
+			if j == long {
+				rtx.Must(tk.SetBQJobID(j, "bq-job-1"), "set job id")
+			}
+			started <- struct{}{}
+			if j == long {
+				<-ctx.Done()
+				return ops.Retry(j, ctx.Err(), "cancelled")
+			}
+			time.Sleep(50 * time.Millisecond)
+			return ops.Success(j, "-")
+		},
+		tracker.Complete,
+		"Drain")
+	go m.Watch(ctx, 5*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Actions did not start")
+		}
+	}
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer drainCancel()
+	jobs := m.Drain(drainCtx)
+	if len(jobs) != 1 || jobs[0] != long {
+		t.Error("Expected long job handed back, got", jobs)
+	}
+	if !m.IsPaused() {
+		t.Error("Expected monitor paused")
+	}
+	if _, err := tk.GetStatus(short); err != tracker.ErrJobNotFound {
+		t.Error("Expected short job to complete", err)
+	}
+	status, err := tk.GetStatus(long)
+	rtx.Must(err, "get status")
+	if status.State() != tracker.Init || status.BQJobID != "bq-job-1" {
+		t.Error("Expected long job unchanged, with BigQuery job", status.State(), status.BQJobID)
+	}
+
+	// With no actions in progress, Drain returns immediately.
+	if jobs := m.Drain(context.Background()); len(jobs) != 0 {
+		t.Error("Expected no jobs", jobs)
+	}
+}
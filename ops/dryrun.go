@@ -0,0 +1,90 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// DryRunKeyPrefix prefixes the runner name in the job annotation that
+// records each simulated action's plan.
+const DryRunKeyPrefix = "dry_run_"
+
+// SetDryRun makes the Monitor simulate every action.  Instead of running,
+// each action logs and records what it would do, such as the rendered SQL,
+// copy sources and destinations, or GCS prefixes, and the job advances as
+// if the action succeeded.  Should be called before Watch.
+func (m *Monitor) SetDryRun(dryRun bool) {
+	m.dryRun = dryRun
+}
+
+// IsDryRun returns true if actions are simulated.
+func (m *Monitor) IsDryRun() bool {
+	return m.dryRun
+}
+
+// stateRunners maps the states of the standard actions, which are named for
+// their state, to the equivalent registered runner.
+var stateRunners = map[string]string{
+	string(tracker.ParseComplete): "inventory",
+	string(tracker.Loading):       "load",
+	string(tracker.Deduplicating): "dedup",
+	string(tracker.Copying):       "copy",
+	string(tracker.Validating):    "validate",
+	string(tracker.Publishing):    "publish",
+	string(tracker.Deleting):      "delete",
+}
+
+// plan describes what the named runner would do for the job.  Standard
+// action names must first be mapped with stateRunners.
+func (m *Monitor) plan(name string, j tracker.Job) (string, error) {
+	project := os.Getenv("PROJECT")
+	switch name {
+	case "inventory":
+		return fmt.Sprintf("list %s", j.Path()), nil
+	case "validate":
+		return "compare archive, parser and BigQuery row counts", nil
+	case "dedup_check":
+		return "count duplicate keys in the tmp partition", nil
+	case "load", "dedup", "copy", "script", "delete", "publish":
+		to, err := bq.NewTableOpsWithClientAndNaming(nil, j, project, loadSource(project, j), m.naming)
+		if err != nil {
+			return "", err
+		}
+		to.DedupStrategy = m.dedupStrategies[j.Experiment+"/"+j.Datatype]
+		to.CopyDisposition = m.copyDispositions[j.Experiment+"/"+j.Datatype]
+		if name != "publish" {
+			return to.Plan(name)
+		}
+		target, ok := m.publish[j.Experiment]
+		if !ok {
+			return "not published", nil
+		}
+		return to.PublishPlan(target), nil
+	}
+	return fmt.Sprintf("run %s", name), nil
+}
+
+// simulate logs and records the plan for the action, in the job detail and
+// annotations, and returns a successful Outcome, so that the job advances.
+func (m *Monitor) simulate(ctx context.Context, a Action, j tracker.Job) *Outcome {
+	name := a.runner.Name()
+	if r, ok := stateRunners[name]; ok {
+		name = r
+	}
+	p, err := m.plan(name, j)
+	if err != nil {
+		j.Logger().Println("dry run:", name, err)
+		return Failure(j, err, "dry run")
+	}
+	j.Logger().Println("dry run: would", p)
+	if err := m.tk.Annotate(j, map[string]string{DryRunKeyPrefix + name: p}); err != nil {
+		j.Logger().Println(err)
+	}
+	summary := strings.SplitN(p, "\n", 2)[0]
+	return Success(j, "dry run: would "+summary)
+}
@@ -0,0 +1,61 @@
+package ops_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestSetDryRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(job), "add job")
+	rtx.Must(tk.SetStatus(job, tracker.Deduplicating, ""), "set status")
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	m.SetDryRun(true)
+	if !m.IsDryRun() {
+		t.Error("Expected dry run")
+	}
+	m.AddAction(tracker.Deduplicating,
+		nil,
+		func(ctx context.Context, j tracker.Job, now time.Time) *ops.Outcome {
+			t.Error("Action should not run in dry run mode")
+			return ops.Success(j, "-")
+		},
+		tracker.Copying,
+		"Deduplicating")
+	go m.Watch(ctx, 5*time.Millisecond)
+
+	failTime := time.Now().Add(5 * time.Second)
+	var status tracker.Status
+	for time.Now().Before(failTime) {
+		status, err = tk.GetStatus(job)
+		rtx.Must(err, "GetStatus")
+		if status.State() == tracker.Copying {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if status.State() != tracker.Copying {
+		t.Fatal("Expected job to advance, got", status.State())
+	}
+	if !strings.HasPrefix(status.Detail(), "dry run: would dedup") {
+		t.Error("Wrong detail", status.Detail())
+	}
+	p := status.Annotations[ops.DryRunKeyPrefix+"dedup"]
+	if !strings.Contains(p, "tmp_ndt.ndt7") || !strings.Contains(p, "DELETE") {
+		t.Error("Expected dedup plan with SQL, got", p)
+	}
+}
@@ -0,0 +1,141 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/logging"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Errors associated with duplication policies.
+var (
+	ErrUnknownDuplicationPolicy = errors.New("unknown duplication policy")
+	ErrExcessDuplication        = errors.New("excess duplication")
+)
+
+// Duplication describes the rows removed from a tmp partition by dedup.
+type Duplication struct {
+	Rows    int64 // Rows in the partition before dedup.
+	Removed int64 // Rows removed by dedup.
+}
+
+// Fraction returns the fraction of rows removed by dedup.
+func (d Duplication) Fraction() float64 {
+	if d.Rows <= 0 {
+		return 0
+	}
+	return float64(d.Removed) / float64(d.Rows)
+}
+
+func (d Duplication) String() string {
+	return fmt.Sprintf("dedup removed %d of %d rows (%.1f%%)", d.Removed, d.Rows, 100*d.Fraction())
+}
+
+// A DuplicationPolicy decides the outcome of a dedup that removed more than
+// the configured fraction of rows, which usually means that some task files
+// were parsed more than once.
+type DuplicationPolicy func(ctx context.Context, m *Monitor, to *bq.TableOps, j tracker.Job, d Duplication) *Outcome
+
+// duplicationPolicies is the registry of named policies that may be
+// referenced in config.
+var duplicationPolicies = map[string]DuplicationPolicy{
+	"flag":    flagDuplication,
+	"fail":    failDuplication,
+	"reparse": reparseDuplication,
+}
+
+// RegisterDuplicationPolicy adds a named DuplicationPolicy to the registry.
+// It should be called from init functions, and is not thread-safe.
+func RegisterDuplicationPolicy(name string, p DuplicationPolicy) {
+	duplicationPolicies[name] = p
+}
+
+// DuplicationPolicyNames returns the sorted names of all registered policies.
+func DuplicationPolicyNames() []string {
+	names := make([]string, 0, len(duplicationPolicies))
+	for name := range duplicationPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// flagDuplication lets the job continue, with a warning in the job detail.
+func flagDuplication(ctx context.Context, m *Monitor, to *bq.TableOps, j tracker.Job, d Duplication) *Outcome {
+	metrics.WarningCount.WithLabelValues(j.Experiment, j.Datatype, "ExcessDuplication").Inc()
+	return Success(j, "Warning: "+d.String())
+}
+
+// failDuplication fails the job, retaining the tmp partition for inspection.
+func failDuplication(ctx context.Context, m *Monitor, to *bq.TableOps, j tracker.Job, d Duplication) *Outcome {
+	return Failure(j, ErrExcessDuplication, d.String())
+}
+
+// reparseDuplication deletes the tmp partition, and fails the job, which the
+// Monitor then hands to its Reparser, so that the date is parsed again from
+// scratch.
+func reparseDuplication(ctx context.Context, m *Monitor, to *bq.TableOps, j tracker.Job, d Duplication) *Outcome {
+	if err := to.DeleteTmp(ctx); err != nil {
+		logging.FromContext(ctx).Println(err)
+		// Try again soon.
+		return Retry(j, err, "-")
+	}
+	return Reparse(j, ErrExcessDuplication, d.String())
+}
+
+// A Reparser schedules a clean reparse of a job, e.g. job.Service.
+type Reparser interface {
+	Requeue(ctx context.Context, j tracker.Job) error
+}
+
+// SetDuplicationPolicy applies the named policy to dedups that remove more
+// than threshold of the partition rows.  Zero threshold disables the check,
+// and an empty name uses "flag".  Should be called before Watch.
+func (m *Monitor) SetDuplicationPolicy(threshold float64, name string) error {
+	if name == "" {
+		name = "flag"
+	}
+	p, ok := duplicationPolicies[name]
+	if !ok {
+		return fmt.Errorf("%w: %q, expected one of %v", ErrUnknownDuplicationPolicy, name, DuplicationPolicyNames())
+	}
+	m.dupThreshold, m.dupPolicyName, m.dupPolicy = threshold, name, p
+	return nil
+}
+
+// SetReparser sets the Reparser used by the "reparse" duplication policy.
+// It may be called after Watch, since the job service is usually created
+// after the Monitor.
+func (m *Monitor) SetReparser(r Reparser) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.reparser = r
+}
+
+// requeue hands a job to the Reparser, if there is one.
+func (m *Monitor) requeue(ctx context.Context, j tracker.Job) error {
+	m.lock.Lock()
+	r := m.reparser
+	m.lock.Unlock()
+	if r == nil {
+		return errors.New("no reparser")
+	}
+	return r.Requeue(ctx, j)
+}
+
+// checkDuplication applies the duplication policy if dedup removed more than
+// the threshold fraction of rows.  Returns nil if the job should continue as
+// usual.
+func (m *Monitor) checkDuplication(ctx context.Context, to *bq.TableOps, j tracker.Job, d Duplication) *Outcome {
+	if m.dupPolicy == nil || m.dupThreshold <= 0 || d.Fraction() <= m.dupThreshold {
+		return nil
+	}
+	logging.FromContext(ctx).Println("Excess duplication:", d)
+	metrics.ExcessDuplication.WithLabelValues(j.Experiment, j.Datatype, m.dupPolicyName).Inc()
+	return m.dupPolicy(ctx, m, to, j, d)
+}
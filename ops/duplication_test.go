@@ -0,0 +1,92 @@
+package ops_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestDuplication(t *testing.T) {
+	d := ops.Duplication{Rows: 200, Removed: 50}
+	if d.Fraction() != 0.25 {
+		t.Error("Wrong fraction", d.Fraction())
+	}
+	if d.String() != "dedup removed 50 of 200 rows (25.0%)" {
+		t.Error("Wrong string", d)
+	}
+	if (ops.Duplication{}).Fraction() != 0 {
+		t.Error("Expected zero fraction for empty partition")
+	}
+}
+
+func TestSetDuplicationPolicy(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+
+	for _, name := range []string{"", "flag", "fail", "reparse"} {
+		if err := m.SetDuplicationPolicy(0.1, name); err != nil {
+			t.Error(name, err)
+		}
+	}
+	if err := m.SetDuplicationPolicy(0.1, "foobar"); !errors.Is(err, ops.ErrUnknownDuplicationPolicy) {
+		t.Error("Expected ErrUnknownDuplicationPolicy", err)
+	}
+}
+
+type fakeReparser struct {
+	jobs chan tracker.Job
+}
+
+func (r *fakeReparser) Requeue(ctx context.Context, j tracker.Job) error {
+	r.jobs <- j
+	return nil
+}
+
+func TestReparse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(job), "add job")
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	r := &fakeReparser{jobs: make(chan tracker.Job, 1)}
+	m.SetReparser(r)
+	m.AddAction(tracker.Init,
+		nil,
+		func(ctx context.Context, j tracker.Job, t time.Time) *ops.Outcome {
+			return ops.Reparse(j, ops.ErrExcessDuplication, "too many duplicates")
+		},
+		tracker.Complete,
+		"Reparse")
+	go m.Watch(ctx, 5*time.Millisecond)
+
+	select {
+	case j := <-r.jobs:
+		if j != job {
+			t.Error("Wrong job requeued", j)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Job was not requeued")
+	}
+	// The job is failed, so that the job service may restart it.
+	for i := 0; i < 100; i++ {
+		if s, err := tk.GetStatus(job); err == nil && s.State() == tracker.Failed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected job to be failed")
+}
@@ -14,6 +14,8 @@ type Outcome struct {
 	error  // possibly nil
 	retry  bool
 	detail string
+
+	reparse bool // The job should be parsed again from scratch.
 }
 
 // ShouldRetry indicates of the operation should be retried later.
@@ -55,3 +57,9 @@ func Retry(job tracker.Job, err error, detail string) *Outcome {
 func Success(job tracker.Job, detail string) *Outcome {
 	return &Outcome{job: job, detail: detail}
 }
+
+// Reparse creates a failure Outcome for a job that should be parsed again
+// from scratch, e.g. because its tmp partition has excess duplicates.
+func Reparse(job tracker.Job, err error, detail string) *Outcome {
+	return &Outcome{job: job, error: err, detail: detail, reparse: true}
+}
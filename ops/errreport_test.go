@@ -0,0 +1,45 @@
+package ops_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+type fakeReporter struct {
+	job   *tracker.Job
+	value interface{}
+	stack []byte
+}
+
+func (r *fakeReporter) ReportPanic(j *tracker.Job, v interface{}, stack []byte) {
+	r.job, r.value, r.stack = j, v, stack
+}
+
+func TestSetErrorReporter(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	r := &fakeReporter{}
+	m.SetErrorReporter(r)
+	j := tracker.NewJob("bucket", "exp", "type", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	repanicked := func() (v interface{}) {
+		defer func() { v = recover() }()
+		defer ops.RecoverAction(m, j)
+		panic("boom")
+	}()
+	if repanicked != "boom" {
+		t.Error("Should have panicked again", repanicked)
+	}
+	if r.job == nil || *r.job != j || r.value != "boom" || len(r.stack) == 0 {
+		t.Errorf("Wrong report %+v", r)
+	}
+}
@@ -0,0 +1,24 @@
+package ops
+
+import "context"
+
+var IsDMLLimitError = isDMLLimitError
+var DMLOutcome = dmlOutcome
+var ValidationThreshold = validationThreshold
+
+// AcquireDML waits for a DML slot for the table.
+func (m *Monitor) AcquireDML(ctx context.Context, table string) (func(error), error) {
+	return m.dml.acquire(ctx, table)
+}
+
+// RecoverAction must be deferred directly, e.g. defer RecoverAction(m, j).
+var RecoverAction = (*Monitor).recoverAction
+
+// HoldForAnnotations must be called with a *Monitor receiver.
+var HoldForAnnotations = (*Monitor).holdForAnnotations
+
+// ShouldPoll must be called with a *Monitor receiver.
+var ShouldPoll = (*Monitor).shouldPoll
+
+// HoldForDay must be called with a *Monitor receiver.
+var HoldForDay = (*Monitor).holdForDay
@@ -0,0 +1,173 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/logging"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// DefaultAnnotationWait is the longest a copy is held back for annotations,
+// if the source doesn't specify a wait.
+const DefaultAnnotationWait = 24 * time.Hour
+
+// Job annotations of copies held back for annotations.
+const (
+	// HoldKey records why the job's copy is, or was, held back.
+	HoldKey = "annotation_hold"
+	// ReleaseKey releases a held copy, e.g. through the admin API.  Its
+	// value is the user who released it.
+	ReleaseKey = "annotation_release"
+	// DayHoldKey records the earlier day stages that the job's post
+	// processing is, or was, held for.  See tracker.SetDayStages.
+	DayHoldKey = "day_hold"
+)
+
+// Errors of annotation holds.
+var (
+	ErrInvalidAnnotationTable = errors.New("invalid annotation table")
+	ErrAnnotationsNotReady    = errors.New("annotations not ready")
+)
+
+// annotationHold is the annotation table that must have rows before a
+// datatype is copied to raw.
+type annotationHold struct {
+	table   string // [project.]dataset.table
+	maxWait time.Duration
+}
+
+// SetAnnotationHolds holds back the copy, or script, stage of each source
+// with an AnnotationTable, until the table's partition for the job's date
+// has rows, so that un-annotatable data is not published.  After the
+// source's AnnotationWait in the copy state, or once the job is released,
+// the copy proceeds anyway.  Should be called before Watch.
+func (m *Monitor) SetAnnotationHolds(sources []config.SourceConfig) error {
+	holds := make(map[string]annotationHold, len(sources))
+	for _, s := range sources {
+		if s.AnnotationTable == "" {
+			continue
+		}
+		name := s.Experiment + "/" + s.Datatype
+		parts := strings.Split(s.AnnotationTable, ".")
+		if len(parts) < 2 || len(parts) > 3 || s.AnnotationWait < 0 {
+			return fmt.Errorf("%s: %w: %q", name, ErrInvalidAnnotationTable, s.AnnotationTable)
+		}
+		for _, p := range parts {
+			if p == "" {
+				return fmt.Errorf("%s: %w: %q", name, ErrInvalidAnnotationTable, s.AnnotationTable)
+			}
+		}
+		h := annotationHold{table: s.AnnotationTable, maxWait: s.AnnotationWait}
+		if h.maxWait == 0 {
+			h.maxWait = DefaultAnnotationWait
+		}
+		holds[name] = h
+	}
+	m.annotationHolds = holds
+	return nil
+}
+
+// ReleaseHold lets the job's copy proceed without waiting for annotations.
+func (m *Monitor) ReleaseHold(job tracker.Job, user string) error {
+	return m.tk.Annotate(job, map[string]string{ReleaseKey: user})
+}
+
+// holdForAnnotations returns a retry Outcome if the job's datatype requires
+// annotations, and the annotation partition for the job's date is still
+// empty.  Returns nil if the job should continue with the copy.  The
+// outcome is recorded in the job's HoldKey annotation.
+func (m *Monitor) holdForAnnotations(ctx context.Context, qp *bq.TableOps, j tracker.Job, stateChangeTime time.Time) *Outcome {
+	h, ok := m.annotationHolds[j.Experiment+"/"+j.Datatype]
+	if !ok {
+		return nil
+	}
+	logger := logging.FromContext(ctx)
+	annotations := map[string]string{}
+	if s, err := m.tk.GetStatus(j); err == nil {
+		annotations = s.Annotations
+	}
+	note := func(status, detail string) {
+		metrics.AnnotationHolds.WithLabelValues(j.Experiment, j.Datatype, status).Inc()
+		if annotations[HoldKey] == detail {
+			return
+		}
+		if err := m.tk.Annotate(j, map[string]string{HoldKey: detail}); err != nil {
+			logger.Println(err)
+		}
+	}
+	if user := annotations[ReleaseKey]; user != "" {
+		note("released", "released by "+user)
+		return nil
+	}
+
+	table := h.table
+	if strings.Count(table, ".") == 1 {
+		table = qp.Project + "." + table
+	}
+	rows, err := qp.CountAnnotations(ctx, table)
+	switch {
+	case err != nil:
+		logger.Println(err)
+		metrics.AnnotationHolds.WithLabelValues(j.Experiment, j.Datatype, "error").Inc()
+	case rows > 0:
+		if annotations[HoldKey] != "" {
+			note("ready", fmt.Sprintf("%s ready with %d rows", table, rows))
+		} else {
+			metrics.AnnotationHolds.WithLabelValues(j.Experiment, j.Datatype, "ready").Inc()
+		}
+		return nil
+	}
+	if waited := time.Since(stateChangeTime); waited >= h.maxWait {
+		logger.Warningln("Copying without annotations from", table, "after", waited.Round(time.Minute))
+		note("expired", fmt.Sprintf("%s empty after %s", table, h.maxWait))
+		return nil
+	}
+	if err != nil {
+		// Try again soon.
+		return Retry(j, err, "counting annotations")
+	}
+	note("held", fmt.Sprintf("waiting for %s since %s", table, stateChangeTime.UTC().Format(time.RFC3339)))
+	return Retry(j, fmt.Errorf("%w: %s", ErrAnnotationsNotReady, table), "waiting for annotations")
+}
+
+// holdForDay returns true if the job, which is ready for post processing,
+// must wait for unfinished jobs of the same date in earlier day stages.
+// The hold, and its release, are recorded in the job's DayHoldKey
+// annotation.
+func (m *Monitor) holdForDay(j tracker.Job, s tracker.Status) bool {
+	waiting := m.tk.WaitingOn(j)
+	current := s.Annotations[DayHoldKey]
+	detail := ""
+	status := "held"
+	if len(waiting) > 0 {
+		seen := map[string]bool{}
+		names := []string{}
+		for _, w := range waiting {
+			if !seen[w.Datatype] {
+				seen[w.Datatype] = true
+				names = append(names, w.Experiment+"/"+w.Datatype)
+			}
+		}
+		detail = "waiting for " + strings.Join(names, ", ")
+	} else if strings.HasPrefix(current, "waiting for ") {
+		detail = "released at " + time.Now().UTC().Format(time.RFC3339)
+		status = "released"
+	} else {
+		return false
+	}
+	if current != detail {
+		metrics.DayHolds.WithLabelValues(j.Experiment, j.Datatype, status).Inc()
+		if err := m.tk.Annotate(j, map[string]string{DayHoldKey: detail}); err != nil {
+			log.Println(err)
+		}
+	}
+	return len(waiting) > 0
+}
@@ -0,0 +1,149 @@
+package ops_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestSetAnnotationHolds(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	for _, table := range []string{"annotation", "ndt.", "a.b.c.d", "a..c"} {
+		err := m.SetAnnotationHolds([]config.SourceConfig{{Experiment: "ndt", Datatype: "ndt7", AnnotationTable: table}})
+		if !errors.Is(err, ops.ErrInvalidAnnotationTable) {
+			t.Error("Expected ErrInvalidAnnotationTable", table, err)
+		}
+	}
+}
+
+func TestHoldForAnnotations(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	rtx.Must(m.SetAnnotationHolds([]config.SourceConfig{
+		{Experiment: "ndt", Datatype: "ndt7", AnnotationTable: "ndt.annotation", AnnotationWait: time.Hour}}), "holds")
+
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(job), "add job")
+	other := tracker.NewJob("bucket", "ndt", "annotation", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(other), "add job")
+	tableOps := func(j tracker.Job, rows int64) (*bq.TableOps, *bqfake.Client) {
+		client := bqfake.NewClient("fake-project")
+		client.AddResult("fake-project.ndt.annotation", bqfake.Result{Rows: []interface{}{bq.RawCounts{Rows: rows}}})
+		qp, err := bq.NewTableOpsWithClient(client, j, "fake-project", "")
+		rtx.Must(err, "NewTableOps failed")
+		return qp, client
+	}
+	hold := func() string {
+		s, err := tk.GetStatus(job)
+		rtx.Must(err, "status")
+		return s.Annotations[ops.HoldKey]
+	}
+
+	// Datatypes without an annotation table are not held.
+	qp, client := tableOps(other, 0)
+	if o := ops.HoldForAnnotations(m, ctx, qp, other, time.Now()); o != nil || len(client.Queries()) != 0 {
+		t.Error("Expected no hold", o, client.Queries())
+	}
+
+	// The copy is held while the annotation partition is empty.
+	start := time.Now()
+	qp, client = tableOps(job, 0)
+	o := ops.HoldForAnnotations(m, ctx, qp, job, start)
+	if o == nil || !o.ShouldRetry() || !errors.Is(o, ops.ErrAnnotationsNotReady) {
+		t.Fatal("Expected retry", o)
+	}
+	if q := client.Queries(); len(q) != 1 || !strings.Contains(q[0], "`fake-project.ndt.annotation`") {
+		t.Error("Wrong query", q)
+	}
+	if !strings.HasPrefix(hold(), "waiting for fake-project.ndt.annotation since") {
+		t.Error("Wrong hold annotation", hold())
+	}
+
+	// Until the annotations arrive.
+	qp, _ = tableOps(job, 100)
+	if o := ops.HoldForAnnotations(m, ctx, qp, job, start); o != nil {
+		t.Error("Expected no hold", o)
+	}
+	if hold() != "fake-project.ndt.annotation ready with 100 rows" {
+		t.Error("Wrong hold annotation", hold())
+	}
+
+	// Or the wait expires.
+	qp, _ = tableOps(job, 0)
+	if o := ops.HoldForAnnotations(m, ctx, qp, job, start.Add(-time.Hour)); o != nil {
+		t.Error("Expected no hold", o)
+	}
+	if hold() != "fake-project.ndt.annotation empty after 1h0m0s" {
+		t.Error("Wrong hold annotation", hold())
+	}
+
+	// Or the job is released.
+	rtx.Must(m.ReleaseHold(job, "alice"), "release")
+	qp, client = tableOps(job, 0)
+	if o := ops.HoldForAnnotations(m, ctx, qp, job, start); o != nil || len(client.Queries()) != 0 {
+		t.Error("Expected no hold", o, client.Queries())
+	}
+	if hold() != "released by alice" {
+		t.Error("Wrong hold annotation", hold())
+	}
+}
+
+func TestHoldForDay(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, time.Hour)
+	rtx.Must(err, "tk init")
+	rtx.Must(tk.SetDayStages("ndt", []tracker.DayStage{
+		{Name: "annotation", Datatypes: []string{"annotation"}},
+		{Name: "measurements", Datatypes: []string{"ndt7"}},
+	}), "SetDayStages")
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	annotation := tracker.NewJob("bucket", "ndt", "annotation", date)
+	job := tracker.NewJob("bucket", "ndt", "ndt7", date)
+	rtx.Must(tk.AddJob(annotation), "add job")
+	rtx.Must(tk.AddJob(job), "add job")
+	rtx.Must(tk.SetStatus(job, tracker.ParseComplete, ""), "set status")
+	status := func() tracker.Status {
+		s, err := tk.GetStatus(job)
+		rtx.Must(err, "status")
+		return s
+	}
+
+	if !ops.HoldForDay(m, job, status()) {
+		t.Error("Expected ndt7 to be held for annotation")
+	}
+	if h := status().Annotations[ops.DayHoldKey]; h != "waiting for ndt/annotation" {
+		t.Error("Wrong hold annotation", h)
+	}
+	rtx.Must(tk.SetStatus(annotation, tracker.Complete, ""), "set status")
+	if ops.HoldForDay(m, job, status()) {
+		t.Error("Expected ndt7 to be released")
+	}
+	if h := status().Annotations[ops.DayHoldKey]; !strings.HasPrefix(h, "released at ") {
+		t.Error("Wrong release annotation", h)
+	}
+	// Jobs that were never held are not annotated.
+	if ops.HoldForDay(m, annotation, tracker.Status{}) {
+		t.Error("Expected no hold for the first stage")
+	}
+}
@@ -0,0 +1,160 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+var (
+	// actionQueueDepth tracks the number of jobs waiting for an action slot.
+	// Provides metrics:
+	//   gardener_action_queue_depth{action}
+	actionQueueDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gardener_action_queue_depth",
+			Help: "Number of jobs waiting for a concurrency slot, by action.",
+		},
+		[]string{"action"},
+	)
+
+	// actionWaitTime tracks the time jobs wait for an action slot.
+	// Provides metrics:
+	//   gardener_action_wait_seconds{action}
+	actionWaitTime = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "gardener_action_wait_seconds",
+			Help: "Time spent waiting for a concurrency slot, by action.",
+			Buckets: []float64{
+				0.1, 0.3, 1, 3, 10, 30, 100, 300, 1000, 3000, 10000,
+			},
+		},
+		[]string{"action"},
+	)
+
+	// actionDeadlinesExceeded counts actions abandoned at their deadline.
+	// Provides metrics:
+	//   gardener_action_deadlines_exceeded_total{action}
+	actionDeadlinesExceeded = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gardener_action_deadlines_exceeded_total",
+			Help: "Number of actions abandoned at their deadline, by action.",
+		},
+		[]string{"action"},
+	)
+)
+
+// ErrDeadlineExceeded is the retryable error for actions that exceed their deadline.
+var ErrDeadlineExceeded = errors.New("action deadline exceeded")
+
+// SetConcurrency limits the number of concurrent actions for jobs in state.
+// A limit of zero or less means unlimited.  Should be called before Watch.
+func (m *Monitor) SetConcurrency(state tracker.State, limit int) {
+	if limit <= 0 {
+		delete(m.limits, state)
+		return
+	}
+	m.limits[state] = make(chan struct{}, limit)
+}
+
+// acquire waits for a concurrency slot for the state, and returns a func
+// that releases it.  Returns an error if the context is cancelled first.
+func (m *Monitor) acquire(ctx context.Context, state tracker.State) (func(), error) {
+	sem, ok := m.limits[state]
+	if !ok {
+		return func() {}, nil
+	}
+	label := string(state)
+	start := time.Now()
+	actionQueueDepth.WithLabelValues(label).Inc()
+	defer actionQueueDepth.WithLabelValues(label).Dec()
+	select {
+	case sem <- struct{}{}:
+		actionWaitTime.WithLabelValues(label).Observe(time.Since(start).Seconds())
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// SetDeadline limits the time each action for jobs in state may take.  A
+// deadline of zero or less means unlimited.  Should be called before Watch.
+func (m *Monitor) SetDeadline(state tracker.State, d time.Duration) {
+	if d <= 0 {
+		delete(m.deadlines, state)
+		return
+	}
+	m.deadlines[state] = d
+}
+
+// run applies the action's runner, enforcing the deadline for the state, if
+// any.  At the deadline, the runner's context is cancelled, any BigQuery job
+// recorded for the job is cancelled, and the job is given a retryable
+// ErrDeadlineExceeded error.
+func (m *Monitor) run(ctx context.Context, a Action, j tracker.Job) *Outcome {
+	if m.dryRun {
+		return m.simulate(ctx, a, j)
+	}
+	d, ok := m.deadlines[a.fromState]
+	if !ok {
+		return outcome(a.runner, j, a.runner.Run(ctx, j))
+	}
+	runCtx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	o := outcome(a.runner, j, a.runner.Run(runCtx, j))
+	if o.IsDone() || runCtx.Err() != context.DeadlineExceeded || ctx.Err() != nil {
+		return o
+	}
+
+	logger := j.Logger()
+	logger.Warningln(a.Name(), "exceeded deadline of", d)
+	actionDeadlinesExceeded.WithLabelValues(a.Name()).Inc()
+	if status, err := m.tk.GetStatus(j); err == nil && status.BQJobID != "" {
+		cancelCtx, cf := context.WithTimeout(ctx, time.Minute)
+		if err := m.cancelBQJob(cancelCtx, j, status.BQJobID); err != nil {
+			logger.Warningln("could not cancel BigQuery job", status.BQJobID, err)
+		} else {
+			logger.Println("cancelled BigQuery job", status.BQJobID)
+		}
+		cf()
+		// The retry should start a new BigQuery job.
+		if err := m.tk.SetBQJobID(j, ""); err != nil {
+			logger.Println(err)
+		}
+	}
+	o = Retry(j, fmt.Errorf("%w: %v", ErrDeadlineExceeded, d), "-")
+	// Record the timeout now, rather than after the retry delay.
+	if err := m.tk.SetDetail(j, o.error.Error()); err != nil {
+		logger.Println(err)
+	}
+	return o
+}
+
+// A Throttle reports whether new actions should be deferred, e.g. because a
+// shared resource is saturated.
+type Throttle interface {
+	Throttled() bool
+}
+
+// SetThrottle defers new actions for jobs in state while the throttle is
+// engaged.  Jobs remain in the state, and are retried on later polls.
+// Actions already in progress are not affected.  Should be called before Watch.
+func (m *Monitor) SetThrottle(state tracker.State, t Throttle) {
+	if t == nil {
+		delete(m.throttles, state)
+		return
+	}
+	m.throttles[state] = t
+}
+
+// isThrottled returns true if new actions for jobs in state should be deferred.
+func (m *Monitor) isThrottled(state tracker.State) bool {
+	t, ok := m.throttles[state]
+	return ok && t.Throttled()
+}
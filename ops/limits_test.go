@@ -0,0 +1,156 @@
+package ops_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestSetConcurrency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		rtx.Must(tk.AddJob(tracker.NewJob("bucket", "exp", "type", date.AddDate(0, 0, i))), "add job")
+	}
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	m.SetConcurrency(tracker.Init, 2)
+
+	var running, maxRunning int32
+	m.AddAction(tracker.Init,
+		nil,
+		func(ctx context.Context, j tracker.Job, t time.Time) *ops.Outcome {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				old := atomic.LoadInt32(&maxRunning)
+				if n <= old || atomic.CompareAndSwapInt32(&maxRunning, old, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			return ops.Success(j, "-")
+		},
+		tracker.Complete,
+		"Init")
+	go m.Watch(ctx, 5*time.Millisecond)
+
+	failTime := time.Now().Add(5 * time.Second)
+	for time.Now().Before(failTime) && tk.NumJobs() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if tk.NumJobs() != 0 {
+		t.Error("Expected all jobs complete:", tk.NumJobs())
+	}
+	if atomic.LoadInt32(&maxRunning) != 2 {
+		t.Error("Expected 2 concurrent actions, got", maxRunning)
+	}
+}
+
+type fakeThrottle struct {
+	throttled int32
+}
+
+func (f *fakeThrottle) Throttled() bool {
+	return atomic.LoadInt32(&f.throttled) != 0
+}
+
+func TestSetThrottle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rtx.Must(tk.AddJob(tracker.NewJob("bucket", "exp", "type", date)), "add job")
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	throttle := &fakeThrottle{throttled: 1}
+	m.SetThrottle(tracker.Init, throttle)
+
+	var calls int32
+	m.AddAction(tracker.Init,
+		nil,
+		func(ctx context.Context, j tracker.Job, t time.Time) *ops.Outcome {
+			atomic.AddInt32(&calls, 1)
+			return ops.Success(j, "-")
+		},
+		tracker.Complete,
+		"Init")
+	go m.Watch(ctx, 5*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&calls) != 0 || tk.NumJobs() != 1 {
+		t.Error("Expected no action while throttled")
+	}
+
+	atomic.StoreInt32(&throttle.throttled, 0)
+	failTime := time.Now().Add(5 * time.Second)
+	for time.Now().Before(failTime) && tk.NumJobs() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if tk.NumJobs() != 0 {
+		t.Error("Expected job complete after release:", tk.NumJobs())
+	}
+}
+
+func TestSetDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(job), "add job")
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	m.SetDeadline(tracker.Init, 20*time.Millisecond)
+
+	var runErr atomic.Value
+	m.AddAction(tracker.Init,
+		nil,
+		func(ctx context.Context, j tracker.Job, t time.Time) *ops.Outcome {
+			// A long running BigQuery job.
+			rtx.Must(tk.SetBQJobID(j, "bqjob"), "set job id")
+			<-ctx.Done()
+			runErr.Store(ctx.Err())
+			return ops.Failure(j, ctx.Err(), "-")
+		},
+		tracker.Complete,
+		"Init")
+	go m.Watch(ctx, 5*time.Millisecond)
+
+	failTime := time.Now().Add(5 * time.Second)
+	var status tracker.Status
+	for time.Now().Before(failTime) {
+		status, err = tk.GetStatus(job)
+		rtx.Must(err, "GetStatus")
+		if strings.Contains(status.Detail(), "deadline") {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !strings.Contains(status.Detail(), ops.ErrDeadlineExceeded.Error()) {
+		t.Fatal("Expected deadline exceeded detail, got", status.Detail())
+	}
+	// The job should be retried, not failed, with a new BigQuery job.
+	if status.State() != tracker.Init || status.BQJobID != "" {
+		t.Errorf("Expected retryable job with no BigQuery job, got %+v", status)
+	}
+	if err, ok := runErr.Load().(error); !ok || !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected runner context to exceed deadline", err)
+	}
+}
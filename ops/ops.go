@@ -4,15 +4,24 @@ package ops
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	runtimedebug "runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
 	"github.com/m-lab/go/logx"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/logging"
 	"github.com/m-lab/etl-gardener/tracker"
 )
 
@@ -25,11 +34,20 @@ ultimately update the Job's State.
 A Monitor is initialized by adding Actions for each State that should be handled.  The client
 code should then invoke "go Watch(...)" to start watching the tracker for eligible Jobs.
 
+Each Action wraps a Runner.  Runners may be registered by name with RegisterRunner, and then
+added for specific datatypes through the "steps" in each source config, without code changes
+to the Monitor.
+
 The package assumes that there is only one Action associated with a State, and
 that States with Actions are never operated on independently by some other agent,
 such as the Parser.  Should this cease to be true, then the claim mechanism
 should be moved into the tracker.
 
+When several gardener instances share work, a JobQueue may be set with SetQueue.
+Jobs are then also claimed in the queue before an action is applied, and each
+outcome is recorded in the queue.  The tracker remains a per-instance cache of
+the queued jobs.
+
 Note that when Gardener restarts, it fetches the current state from datastore, and
 creates the monitor.  In the new monitor, none of the tracker items will have leases,
 so the Monitor will automatically restart the appropriate Actions.
@@ -75,12 +93,12 @@ type Action struct {
 	fromState tracker.State // State that action applies to.
 	nextState tracker.State // Next State when action succeeds.
 
-	// condition or action may be nil if not required
+	// condition or runner may be nil if not required
 	// condition that must be satisfied before applying action.
 	condition ConditionFunc
-	// action performs an action on the job, and
-	// updates the state when complete.  It may place the job into an error state.
-	action ActionFunc
+	// runner performs an action on the job.  Its result determines
+	// whether the job advances, is retried, or is placed in an error state.
+	runner Runner
 
 	annotation string // Annotation to be used for UpdateDetail while applying Op
 }
@@ -92,16 +110,186 @@ func (a Action) Name() string {
 
 // Monitor "owns" all jobs in the states that have actions.
 type Monitor struct {
-	// TODO add bqClient, to allow fakes for testing.
 	bqconfig cloud.BQConfig // static after creation
 
-	// TODO allow different action map for each datatype?
-	actions map[tracker.State]Action // static after creation
+	bqClient  bqiface.Client // Optional shared client, e.g. a fake.  Static after SetBQClient.
+	gcsClient stiface.Client // Optional shared client, e.g. a fake.  Static after SetStorageClient.
+
+	actions     map[tracker.State]Action                   // static after creation
+	typeActions map[string]map[tracker.State]Action        // Per datatype overrides, static after creation
+	external    map[string]map[tracker.State]tracker.State // Per datatype external stages, to next state.
 
 	tk *tracker.Tracker
 
-	lock      sync.Mutex               // protects jobClaims
-	jobClaims map[tracker.Job]struct{} // Claimed jobs currently being acted on.
+	incremental map[string]bool // experiment/datatype of incremental sources.
+
+	sources []config.SourceConfig // Sources added by ConfigureSteps, for StateMachineHandler.
+
+	limits    map[tracker.State]chan struct{} // Concurrency limits, static after creation.
+	throttles map[tracker.State]Throttle      // Throttles, static after creation.
+	deadlines map[tracker.State]time.Duration // Action deadlines, static after creation.
+	dml       *dmlScheduler                   // Per table DML limits, static after SetDMLConcurrency.
+
+	paused int32 // Accessed atomically.  Non-zero when no new actions should start.
+
+	active    sync.WaitGroup // Actions in progress.
+	draining  chan struct{}  // Closed by Drain.
+	drainOnce sync.Once
+
+	lock        sync.Mutex                         // protects jobClaims and pausedTypes
+	jobClaims   map[tracker.Job]context.CancelFunc // Claimed jobs currently being acted on.
+	pausedTypes map[string]bool                    // experiment/datatype with new actions paused.
+
+	queue JobQueue // Optional shared queue, static after SetQueue.
+
+	naming bq.Naming // Dataset and table naming scheme, static after SetNaming.
+
+	verifyCopies bool // Compare tmp and raw checksums after copy, static after creation.
+
+	dryRun bool // Simulate actions, static after SetDryRun.
+
+	errReporter ErrorReporter // Reports action panics.  May be nil, static after SetErrorReporter.
+
+	dedupStrategies  map[string]string             // experiment/datatype to dedup strategy, static after SetDedupStrategies.
+	copyDispositions map[string]bq.CopyDisposition // experiment/datatype to copy disposition, static after SetCopyDispositions.
+	dedupCostCaps    map[string]int64              // experiment/datatype to dedup bytes billed cap, static after SetDedupCostCaps.
+	schemaPatching   map[string]bool               // experiment/datatype with raw schema patching, static after SetSchemaPatching.
+	annotationHolds  map[string]annotationHold     // experiment/datatype to annotation hold, static after SetAnnotationHolds.
+
+	publish map[string]bq.PublishTarget // experiment to publish target, static after SetPublish.
+	views   *bq.ViewManager             // Annotation join views.  May be nil, static after SetViews.
+	changes ChangeRecorder              // Rewritten partitions.  May be nil, static after SetChangeRecorder.
+
+	sizeAnomaly SizeAnomaly                         // static after SetSizeAnomaly.
+	sizeAlert   func(j tracker.Job, warning string) // May be nil, static after SetSizeAlert.
+
+	dupThreshold  float64           // Fraction of rows removed by dedup that triggers dupPolicy.
+	dupPolicyName string            // static after SetDuplicationPolicy.
+	dupPolicy     DuplicationPolicy // static after SetDuplicationPolicy.
+	reparser      Reparser          // protected by lock.
+	auditor       Auditor           // protected by lock.  May be nil.
+
+	pollDefault   pollInterval            // static after SetPolling.  Zero polls every job on every tick.
+	pollIntervals map[string]pollInterval // experiment/datatype overrides, static after SetPolling.
+	pollTick      time.Duration           // Shortest min interval, static after SetPolling.
+	pollLock      sync.Mutex              // protects polls
+	polls         map[tracker.Job]pollState
+	nudges        chan struct{} // Requests an early poll.
+}
+
+// SetNaming sets the dataset and table naming scheme.  Empty templates use
+// the defaults.  Should be called before Watch.
+func (m *Monitor) SetNaming(n bq.Naming) error {
+	n = n.WithDefaults()
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	m.naming = n
+	return nil
+}
+
+// JobQueue is a persistent queue shared by multiple gardener instances.
+// Jobs are claimed in the queue before an action is applied, so that only one
+// instance acts on a job at a time.  Claims last for the Lease, and are
+// renewed by claiming the job again.
+type JobQueue interface {
+	Lease() time.Duration
+	Claim(ctx context.Context, j tracker.Job) error
+	Release(ctx context.Context, j tracker.Job) error
+	Update(ctx context.Context, j tracker.Job, state tracker.State, detail string) error
+	Complete(ctx context.Context, j tracker.Job) error
+}
+
+// SetQueue sets a shared JobQueue.  Should be called before Watch.
+func (m *Monitor) SetQueue(q JobQueue) {
+	m.queue = q
+}
+
+// SetBQClient sets the BigQuery client used by all actions, e.g. a fake for
+// simulation.  By default, each action creates its own client.  Should be
+// called before Watch.
+func (m *Monitor) SetBQClient(c bqiface.Client) {
+	m.bqClient = c
+}
+
+// SetStorageClient sets the GCS client used to inventory archives, e.g. a
+// fake for simulation.  By default, each inventory creates its own client.
+// Should be called before Watch.
+func (m *Monitor) SetStorageClient(c stiface.Client) {
+	m.gcsClient = c
+}
+
+// claimQueued claims the job in the shared queue, if there is one, and
+// renews the claim every third of the lease, including while the action
+// waits for a semaphore, so that no other instance claims the job.  If the
+// claim can't be renewed before it expires, the action is cancelled.
+// Returns a function that releases the queue claim, or nil if the claim failed.
+func (m *Monitor) claimQueued(ctx context.Context, j tracker.Job, cancel context.CancelFunc) func() {
+	if m.queue == nil {
+		return func() {}
+	}
+	if err := m.queue.Claim(ctx, j); err != nil {
+		debug.Println("Queue claim failed:", j, err)
+		return nil
+	}
+	done := make(chan struct{})
+	if lease := m.queue.Lease(); lease > 0 {
+		go m.renewQueued(ctx, j, lease, cancel, done)
+	}
+	return func() {
+		close(done)
+		// The job may already have been completed and removed.
+		m.queue.Release(context.Background(), j)
+	}
+}
+
+// renewQueued renews the queue claim on the job until done is closed.
+func (m *Monitor) renewQueued(ctx context.Context, j tracker.Job, lease time.Duration, cancel context.CancelFunc, done chan struct{}) {
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	expires := time.Now().Add(lease)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			err := m.queue.Claim(ctx, j)
+			if err == nil {
+				expires = now.Add(lease)
+				continue
+			}
+			j.Logger().Warningln("could not renew queue claim:", err)
+			if !now.Add(lease / 3).Before(expires) {
+				// Another instance may claim the job before the next renewal.
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// updateQueued records the outcome in the shared queue, if there is one.
+func (m *Monitor) updateQueued(ctx context.Context, o *Outcome, state tracker.State) error {
+	if m.queue == nil {
+		return nil
+	}
+	detail := o.detail
+	switch {
+	case o.IsDone():
+		if state == tracker.Complete {
+			return m.queue.Complete(ctx, o.job)
+		}
+	case o.ShouldRetry():
+		return nil
+	default:
+		state = tracker.Failed
+		if o.error != nil {
+			detail = o.error.Error()
+		}
+	}
+	return m.queue.Update(ctx, o.job, state, detail)
 }
 
 // releaser creates a function that releases the claim on a job.
@@ -109,30 +297,33 @@ func (m *Monitor) releaser(j tracker.Job) func() {
 	return func() {
 		m.lock.Lock()
 		defer m.lock.Unlock()
-		delete(m.jobClaims, j)
+		if cancel, ok := m.jobClaims[j]; ok {
+			cancel()
+			delete(m.jobClaims, j)
+		}
 	}
 }
 
 // Returns releaser if successful, nil otherwise.
-func (m *Monitor) tryClaimJob(j tracker.Job) func() {
+// The cancel func is called when the claim is released, or the job is cancelled.
+func (m *Monitor) tryClaimJob(j tracker.Job, cancel context.CancelFunc) func() {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	if _, ok := m.jobClaims[j]; ok {
 		return nil
 	}
-	m.jobClaims[j] = struct{}{}
+	m.jobClaims[j] = cancel
 	return m.releaser(j)
 }
 
-// AddAction adds a specific action to the Monitor.
+// AddAction adds a specific action to the Monitor, for all datatypes.
 func (m *Monitor) AddAction(state tracker.State, cond ConditionFunc, op ActionFunc,
 	successState tracker.State, annotation string) {
-	m.actions[state] = Action{
-		fromState:  state,
-		nextState:  successState,
-		condition:  cond,
-		action:     op,
-		annotation: annotation}
+	var r Runner
+	if op != nil {
+		r = funcRunner{name: string(state), f: op, tk: m.tk}
+	}
+	m.AddRunner("", state, cond, r, successState, annotation)
 }
 
 // UpdateJob updates the tracker state with the outcome.
@@ -162,27 +353,224 @@ func (m *Monitor) UpdateJob(o *Outcome, state tracker.State) (string, error) {
 	}
 }
 
+// SetIncremental marks the experiment/datatype of each incremental source.
+// Jobs for these sources on the current (UTC) date may be processed again
+// later in the day, so they are marked PartialComplete rather than Complete.
+// Should be called before Watch.
+func (m *Monitor) SetIncremental(sources []config.SourceConfig) {
+	m.incremental = make(map[string]bool, len(sources))
+	for _, s := range sources {
+		if s.Incremental {
+			m.incremental[s.Experiment+"/"+s.Datatype] = true
+		}
+	}
+}
+
+// SetDedupStrategies sets the dedup strategy for each source that specifies
+// one.  Should be called before Watch.
+func (m *Monitor) SetDedupStrategies(sources []config.SourceConfig) error {
+	strategies := make(map[string]string, len(sources))
+	for _, s := range sources {
+		if err := bq.ValidDedupStrategy(s.Dedup); err != nil {
+			return fmt.Errorf("%s/%s: %w", s.Experiment, s.Datatype, err)
+		}
+		if s.Dedup != "" {
+			strategies[s.Experiment+"/"+s.Datatype] = s.Dedup
+		}
+	}
+	m.dedupStrategies = strategies
+	return nil
+}
+
+// ErrInvalidCostCap is returned for negative dedup cost caps.
+var ErrInvalidCostCap = errors.New("invalid cost cap")
+
+// SetDedupCostCaps sets the maximum bytes billed by the dedup query for
+// each source that specifies one.  Should be called before Watch.
+func (m *Monitor) SetDedupCostCaps(sources []config.SourceConfig) error {
+	caps := make(map[string]int64, len(sources))
+	for _, s := range sources {
+		if s.MaxDedupBytesBilled < 0 {
+			return fmt.Errorf("%s/%s: %w: %d", s.Experiment, s.Datatype, ErrInvalidCostCap, s.MaxDedupBytesBilled)
+		}
+		if s.MaxDedupBytesBilled > 0 {
+			caps[s.Experiment+"/"+s.Datatype] = s.MaxDedupBytesBilled
+		}
+	}
+	m.dedupCostCaps = caps
+	return nil
+}
+
+// An ErrorReporter reports panics, e.g. to Cloud Error Reporting.
+type ErrorReporter interface {
+	ReportPanic(j *tracker.Job, v interface{}, stack []byte)
+}
+
+// SetErrorReporter reports panics in actions, with the job, before the
+// process crashes.  Should be called before Watch.
+func (m *Monitor) SetErrorReporter(r ErrorReporter) {
+	m.errReporter = r
+}
+
+// recoverAction reports a panic in an action for the job, and then panics
+// again.  It must be deferred directly.
+func (m *Monitor) recoverAction(j tracker.Job) {
+	if v := recover(); v != nil {
+		if m.errReporter != nil {
+			m.errReporter.ReportPanic(&j, v, runtimedebug.Stack())
+		}
+		panic(v)
+	}
+}
+
+// SetCopyDispositions sets the copy write and create dispositions for each
+// source that specifies them.  Dispositions are validated against the
+// source's pipeline: they require a copy stage, and appends are rejected
+// for pipelines that validate the raw partition against the tmp partition,
+// and for incremental sources, whose repeated copies would duplicate rows.
+// Should be called before Watch.
+func (m *Monitor) SetCopyDispositions(sources []config.SourceConfig) error {
+	dispositions := make(map[string]bq.CopyDisposition, len(sources))
+	for _, s := range sources {
+		if s.CopyWrite == "" && s.CopyCreate == "" {
+			continue
+		}
+		name := s.Experiment + "/" + s.Datatype
+		d, err := bq.ParseCopyDisposition(s.CopyWrite, s.CopyCreate)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		stages := map[string]bool{"copy": true, "validate": true}
+		if len(s.Pipeline) > 0 {
+			stages = map[string]bool{}
+			for _, stage := range s.Pipeline {
+				stages[stage] = true
+			}
+		}
+		if !stages["copy"] {
+			return fmt.Errorf("%s: %w: no copy stage", name, ErrInvalidDisposition)
+		}
+		if s.CopyWrite == bq.CopyAppend && stages["validate"] {
+			return fmt.Errorf("%s: %w: append with validate stage", name, ErrInvalidDisposition)
+		}
+		if s.CopyWrite == bq.CopyAppend && s.Incremental {
+			return fmt.Errorf("%s: %w: append with incremental source", name, ErrInvalidDisposition)
+		}
+		dispositions[name] = d
+	}
+	m.copyDispositions = dispositions
+	return nil
+}
+
+// SetPublish sets the targets that validated raw partitions are published
+// to, keyed by experiment.  Jobs of other experiments skip the Publishing
+// state.  Should be called before Watch.
+func (m *Monitor) SetPublish(targets map[string]bq.PublishTarget) error {
+	for exp, t := range targets {
+		if t.Project == "" || t.Dataset == "" {
+			return fmt.Errorf("%w: publish target for %s", ErrInvalidStep, exp)
+		}
+	}
+	m.publish = targets
+	return nil
+}
+
+// SetViews sets the manager of the annotation join views, which are
+// refreshed when a job's final table is written, i.e. after publication, or
+// after the copy for experiments that are not published.  Should be called
+// before Watch.
+func (m *Monitor) SetViews(v *bq.ViewManager) {
+	m.views = v
+}
+
+// A ChangeRecorder records the table partitions rewritten by actions, e.g.
+// changes.Feed.
+type ChangeRecorder interface {
+	Record(j tracker.Job, table string, modified time.Time)
+}
+
+// SetChangeRecorder records each raw partition rewritten by the copy or
+// script stages, and each published partition.  Should be called before
+// Watch.
+func (m *Monitor) SetChangeRecorder(r ChangeRecorder) {
+	m.changes = r
+}
+
+// nextState returns the state to apply when an action in state from succeeds.
+func (m *Monitor) nextState(from, state tracker.State, j tracker.Job, now time.Time) tracker.State {
+	if from == tracker.Validating && state == tracker.Deleting {
+		if _, ok := m.publish[j.Experiment]; ok {
+			return tracker.Publishing
+		}
+	}
+	if state == tracker.Complete && m.incremental[j.Experiment+"/"+j.Datatype] &&
+		!now.UTC().Truncate(24*time.Hour).After(j.Date) {
+		return tracker.PartialComplete
+	}
+	return state
+}
+
 // applyAction tries to claim a job and apply an action.  Returns false if the job is already claimed.
 func (m *Monitor) tryApplyAction(ctx context.Context, a Action, j tracker.Job, s tracker.Status) bool {
 	// If job is not already claimed.
-	releaser := m.tryClaimJob(j)
+	ctx, cancel := context.WithCancel(ctx)
+	logger := j.Logger().With("state", a.fromState)
+	ctx = logging.NewContext(ctx, logger)
+	releaser := m.tryClaimJob(j, cancel)
 	if releaser == nil {
+		cancel()
 		return false
 	}
+	m.active.Add(1)
 	go func(j tracker.Job, s tracker.Status, a Action, releaser func()) {
+		defer m.recoverAction(j)
+		defer m.active.Done()
 		defer releaser()
+		queueReleaser := m.claimQueued(ctx, j, cancel)
+		if queueReleaser == nil {
+			return
+		}
+		defer queueReleaser()
 		if a.condition == nil || a.condition(ctx, j) {
 			// These jobs may be deleted by other calls to GetAll, so tk.UpdateJob may fail.
-			if a.action != nil {
+			if a.runner != nil {
+				release, err := m.acquire(ctx, a.fromState)
+				if err != nil {
+					logger.Println(a.Name(), "abandoned while waiting:", err)
+					return
+				}
 				start := time.Now()
-				outcome := a.action(ctx, j, s.StateChangeTime())
+				spanCtx, span := startActionSpan(ctx, a, j)
+				outcome := m.run(spanCtx, a, j)
+				endActionSpan(span, outcome)
+				release()
+				if ctx.Err() != nil {
+					// The job was cancelled, or the monitor is terminating.
+					logger.Println(a.Name(), "abandoned:", ctx.Err())
+					return
+				}
 				if outcome.ShouldRetry() {
-					time.Sleep(2 * time.Minute)
+					select {
+					case <-time.After(2 * time.Minute):
+					case <-m.draining:
+						// Leave the job for retry after restart.
+						logger.Println(a.Name(), "retry abandoned for shutdown")
+						return
+					}
 				}
 				// nextState will be applied only if the outcome was successful
-				status, err := m.UpdateJob(outcome, a.nextState)
+				next := m.nextState(a.fromState, a.nextState, j, time.Now())
+				status, err := m.UpdateJob(outcome, next)
 				if err != nil {
-					log.Println("Error updating job:", err)
+					logger.Errorln("Error updating job:", err)
+				}
+				if err := m.updateQueued(ctx, outcome, next); err != nil {
+					logger.Errorln("Error updating queue:", err)
+				}
+				if outcome.reparse {
+					if err := m.requeue(ctx, j); err != nil {
+						logger.Errorln("Error requeueing job for reparse:", err)
+					}
 				}
 				actionDuration.WithLabelValues(a.Name(), status).Observe(time.Since(start).Seconds())
 			}
@@ -191,8 +579,52 @@ func (m *Monitor) tryApplyAction(ctx context.Context, a Action, j tracker.Job, s
 	return true
 }
 
-// Watch polls the tracker, and takes appropriate actions.
+// Pause stops the Monitor from starting new actions.  Actions already in
+// progress are not affected.
+func (m *Monitor) Pause() {
+	atomic.StoreInt32(&m.paused, 1)
+}
+
+// Resume allows the Monitor to start new actions again.
+func (m *Monitor) Resume() {
+	atomic.StoreInt32(&m.paused, 0)
+}
+
+// IsPaused returns true if the Monitor is paused.
+func (m *Monitor) IsPaused() bool {
+	return atomic.LoadInt32(&m.paused) != 0
+}
+
+// PauseDatatype stops the Monitor from starting new actions for jobs of a
+// single experiment/datatype.
+func (m *Monitor) PauseDatatype(experiment, datatype string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.pausedTypes[experiment+"/"+datatype] = true
+}
+
+// ResumeDatatype allows the Monitor to start new actions for the
+// experiment/datatype again.
+func (m *Monitor) ResumeDatatype(experiment, datatype string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.pausedTypes, experiment+"/"+datatype)
+}
+
+// IsPausedDatatype returns true if the experiment/datatype is paused.
+func (m *Monitor) IsPausedDatatype(experiment, datatype string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.pausedTypes[experiment+"/"+datatype]
+}
+
+// Watch polls the tracker, and takes appropriate actions.  It polls every
+// period, or at the shortest interval set by SetPolling, if shorter, and
+// whenever a job is nudged.
 func (m *Monitor) Watch(ctx context.Context, period time.Duration) {
+	if m.pollTick > 0 && m.pollTick < period {
+		period = m.pollTick
+	}
 	ticker := time.NewTicker(period)
 	defer ticker.Stop()
 
@@ -203,23 +635,51 @@ func (m *Monitor) Watch(ctx context.Context, period time.Duration) {
 			return
 
 		case <-ticker.C:
-			debug.Println("===== Monitor Loop Starting =====")
-			// These jobs may be deleted by other calls to GetAll, so tk.UpdateJob may fail.
-			jobs, _, _ := m.tk.GetState()
-			// Iterate over the job/status map...
-			for j, s := range jobs {
-				// If job is in a state that has an associated action...
-				if a, ok := m.actions[s.LastStateInfo().State]; ok {
-					m.tryApplyAction(ctx, a, j, s)
-				}
-			}
+		case <-m.nudges:
+		}
+		m.poll(ctx)
+	}
+}
+
+// poll applies the actions for jobs that are due to be polled.
+func (m *Monitor) poll(ctx context.Context) {
+	if m.IsPaused() {
+		debug.Println("===== Monitor Paused =====")
+		return
+	}
+	debug.Println("===== Monitor Loop Starting =====")
+	// These jobs may be deleted by other calls to GetAll, so tk.UpdateJob may fail.
+	jobs, _, _ := m.tk.GetState()
+	now := time.Now()
+	// Iterate over the job/status map...
+	for j, s := range jobs {
+		// If job is in a state that has an associated action...
+		if m.IsPausedDatatype(j.Experiment, j.Datatype) {
+			continue
+		}
+		state := s.LastStateInfo().State
+		if state == tracker.ParseComplete && m.holdForDay(j, s) {
+			continue
+		}
+		if a, ok := m.actionFor(j, state); ok && !m.isThrottled(a.fromState) && m.shouldPoll(j, state, now) {
+			m.tryApplyAction(ctx, a, j, s)
 		}
 	}
+	m.prunePolls(jobs)
 }
 
 // NewMonitor creates a Monitor with no Actions
 func NewMonitor(clientCtx context.Context, config cloud.BQConfig, tk *tracker.Tracker) (*Monitor, error) {
 	m := Monitor{bqconfig: config, actions: make(map[tracker.State]Action),
-		tk: tk, jobClaims: make(map[tracker.Job]struct{})}
+		typeActions: make(map[string]map[tracker.State]Action),
+		external:    make(map[string]map[tracker.State]tracker.State),
+		limits:      make(map[tracker.State]chan struct{}),
+		throttles:   make(map[tracker.State]Throttle),
+		deadlines:   make(map[tracker.State]time.Duration),
+		dml:         newDMLScheduler(1),
+		tk:          tk, jobClaims: make(map[tracker.Job]context.CancelFunc),
+		pausedTypes: make(map[string]bool), naming: bq.DefaultNaming,
+		draining: make(chan struct{}),
+		polls:    make(map[tracker.Job]pollState), nudges: make(chan struct{}, 1)}
 	return &m, nil
 }
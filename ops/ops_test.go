@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"log"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,6 +13,8 @@ import (
 	"github.com/m-lab/go/rtx"
 
 	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/config"
 	"github.com/m-lab/etl-gardener/ops"
 	"github.com/m-lab/etl-gardener/tracker"
 )
@@ -105,3 +108,343 @@ func TestOutcomeUpdate(t *testing.T) {
 		t.Error(status.Detail())
 	}
 }
+
+func TestIncremental(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	partial := tracker.NewJob("bucket", "exp", "type", today)
+	tk.AddJob(partial)
+	tk.AddJob(tracker.NewJob("bucket", "exp", "type", today.AddDate(0, 0, -1)))
+	tk.AddJob(tracker.NewJob("bucket", "exp", "other", today))
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	m.SetIncremental([]config.SourceConfig{
+		{Experiment: "exp", Datatype: "type", Incremental: true},
+		{Experiment: "exp", Datatype: "other"},
+	})
+	m.AddAction(tracker.Init,
+		nil,
+		newStateFunc(""),
+		tracker.Complete,
+		"Init")
+	go m.Watch(ctx, 10*time.Millisecond)
+
+	failTime := time.Now().Add(5 * time.Second)
+	for time.Now().Before(failTime) && tk.NumJobs() > 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if tk.NumJobs() != 1 {
+		t.Fatal("Expected one partial job:", tk.NumJobs())
+	}
+	status, err := tk.GetStatus(partial)
+	rtx.Must(err, "get status")
+	if status.State() != tracker.PartialComplete {
+		t.Error("Expected PartialComplete:", status.State())
+	}
+	// A partial job can be restarted.
+	if err := tk.AddJob(partial); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPause(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	tk.AddJob(tracker.NewJob("bucket", "exp", "type", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	m.AddAction(tracker.Init,
+		nil,
+		newStateFunc(""),
+		tracker.Complete,
+		"Init")
+	m.Pause()
+	if !m.IsPaused() {
+		t.Error("Should be paused")
+	}
+	go m.Watch(ctx, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if tk.NumJobs() != 1 {
+		t.Fatal("Paused monitor should not complete jobs")
+	}
+
+	m.Resume()
+	failTime := time.Now().Add(5 * time.Second)
+	for time.Now().Before(failTime) && tk.NumJobs() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if tk.NumJobs() != 0 {
+		t.Error("Resumed monitor should complete jobs", tk.NumJobs())
+	}
+}
+
+func TestPauseDatatype(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	paused := tracker.NewJob("bucket", "exp", "paused", date)
+	tk.AddJob(paused)
+	tk.AddJob(tracker.NewJob("bucket", "exp", "type", date))
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	m.AddAction(tracker.Init,
+		nil,
+		newStateFunc(""),
+		tracker.Complete,
+		"Init")
+	m.PauseDatatype("exp", "paused")
+	go m.Watch(ctx, 5*time.Millisecond)
+
+	failTime := time.Now().Add(5 * time.Second)
+	for time.Now().Before(failTime) && tk.NumJobs() > 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := tk.GetStatus(paused); err != nil || tk.NumJobs() != 1 {
+		t.Fatal("Only the paused datatype should remain", tk.NumJobs(), err)
+	}
+
+	m.ResumeDatatype("exp", "paused")
+	for time.Now().Before(failTime) && tk.NumJobs() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if tk.NumJobs() != 0 {
+		t.Error("Resumed datatype should complete", tk.NumJobs())
+	}
+}
+
+// fakeQueue refuses claims on jobs that are claimed by another instance.
+type fakeQueue struct {
+	lock      sync.Mutex
+	lease     time.Duration
+	other     tracker.Job // Claimed by another instance.
+	claims    int
+	renewErr  error // Returned by claims after the first.
+	completed []tracker.Job
+	released  int
+}
+
+var errClaimed = errors.New("claimed")
+
+func (q *fakeQueue) Lease() time.Duration {
+	return q.lease
+}
+
+func (q *fakeQueue) Claim(ctx context.Context, j tracker.Job) error {
+	if j == q.other {
+		return errClaimed
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.claims++
+	if q.claims > 1 {
+		return q.renewErr
+	}
+	return nil
+}
+
+func (q *fakeQueue) Release(ctx context.Context, j tracker.Job) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.released++
+	return nil
+}
+
+func (q *fakeQueue) Update(ctx context.Context, j tracker.Job, state tracker.State, detail string) error {
+	return nil
+}
+
+func (q *fakeQueue) Complete(ctx context.Context, j tracker.Job) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.completed = append(q.completed, j)
+	return nil
+}
+
+func TestQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, time.Hour)
+	must(t, err)
+	d := time.Date(2011, 1, 1, 0, 0, 0, 0, time.UTC)
+	mine := tracker.NewJob("bucket", "exp", "type", d)
+	other := tracker.NewJob("bucket", "exp", "type", d.AddDate(0, 0, 1))
+	must(t, tk.AddJob(mine))
+	must(t, tk.AddJob(other))
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	must(t, err)
+	q := &fakeQueue{other: other}
+	m.SetQueue(q)
+	m.AddAction(tracker.Init, nil, newStateFunc("-"), tracker.Complete, "Init")
+	go m.Watch(ctx, 10*time.Millisecond)
+
+	time.Sleep(200 * time.Millisecond)
+	s, err := tk.GetStatus(other)
+	must(t, err)
+	if s.State() != tracker.Init {
+		t.Error("Job claimed by another instance should not be processed", s)
+	}
+	s, err = tk.GetStatus(mine)
+	must(t, err)
+	if s.State() != tracker.Complete {
+		t.Error("Expected Complete", s)
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.completed) != 1 || q.completed[0] != mine {
+		t.Error("Expected job completed in queue", q.completed)
+	}
+	if q.released != 1 {
+		t.Error("Expected one release", q.released)
+	}
+}
+
+func TestQueueRenewal(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		renewErr error
+		want     tracker.State
+	}{
+		{"renewed", nil, tracker.Complete},
+		{"lost", errClaimed, tracker.Init},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, time.Hour)
+			must(t, err)
+			job := tracker.NewJob("bucket", "exp", "type", time.Date(2011, 1, 1, 0, 0, 0, 0, time.UTC))
+			must(t, tk.AddJob(job))
+
+			m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+			must(t, err)
+			q := &fakeQueue{lease: 30 * time.Millisecond, renewErr: tt.renewErr}
+			m.SetQueue(q)
+			// The action outlasts the lease.
+			m.AddAction(tracker.Init, nil,
+				func(ctx context.Context, j tracker.Job, t time.Time) *ops.Outcome {
+					time.Sleep(100 * time.Millisecond)
+					return ops.Success(j, "-")
+				}, tracker.Complete, "Slow")
+			go m.Watch(ctx, 10*time.Millisecond)
+
+			time.Sleep(300 * time.Millisecond)
+			s, err := tk.GetStatus(job)
+			must(t, err)
+			if s.State() != tt.want {
+				t.Error("Expected", tt.want, s.State())
+			}
+			q.lock.Lock()
+			defer q.lock.Unlock()
+			if q.claims < 3 {
+				t.Error("Expected claim renewals", q.claims)
+			}
+		})
+	}
+}
+
+func TestSetDedupStrategies(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	err = m.SetDedupStrategies([]config.SourceConfig{
+		{Experiment: "ndt", Datatype: "ndt7", Dedup: "overwrite"},
+		{Experiment: "ndt", Datatype: "annotation"},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	err = m.SetDedupStrategies([]config.SourceConfig{
+		{Experiment: "ndt", Datatype: "ndt7", Dedup: "merge"},
+	})
+	if !errors.Is(err, bq.ErrUnknownDedupStrategy) {
+		t.Error("Expected ErrUnknownDedupStrategy", err)
+	}
+}
+
+func TestSetCopyDispositions(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	derived := []string{"inventory", "load", "copy", "delete"}
+	tests := []struct {
+		name   string
+		source config.SourceConfig
+		err    error
+	}{
+		{"default", config.SourceConfig{Datatype: "a"}, nil},
+		{"empty", config.SourceConfig{Datatype: "a", CopyWrite: "empty", CopyCreate: "never"}, nil},
+		{"append", config.SourceConfig{Datatype: "a", CopyWrite: "append", Pipeline: derived}, nil},
+		{"unknown", config.SourceConfig{Datatype: "a", CopyWrite: "merge"}, bq.ErrUnknownDisposition},
+		{"append validated", config.SourceConfig{Datatype: "a", CopyWrite: "append"}, ops.ErrInvalidDisposition},
+		{"append incremental", config.SourceConfig{Datatype: "a", CopyWrite: "append", Pipeline: derived,
+			Incremental: true}, ops.ErrInvalidDisposition},
+		{"no copy", config.SourceConfig{Datatype: "a", CopyWrite: "empty",
+			Pipeline: []string{"inventory", "load", "delete"}}, ops.ErrInvalidDisposition},
+	}
+	for _, tt := range tests {
+		err := m.SetCopyDispositions([]config.SourceConfig{tt.source})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestSetPublish(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tk.AddJob(tracker.NewJob("bucket", "pub", "type", date))
+	tk.AddJob(tracker.NewJob("bucket", "private", "type", date))
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	if err := m.SetPublish(map[string]bq.PublishTarget{"pub": {Project: "public"}}); !errors.Is(err, ops.ErrInvalidStep) {
+		t.Error("Expected ErrInvalidStep", err)
+	}
+	rtx.Must(m.SetPublish(map[string]bq.PublishTarget{"pub": {Project: "public", Dataset: "pub_raw"}}), "SetPublish")
+
+	var lock sync.Mutex
+	published := []tracker.Job{}
+	m.AddAction(tracker.Init, nil, newStateFunc(""), tracker.Validating, "Init")
+	m.AddAction(tracker.Validating, nil, newStateFunc(""), tracker.Deleting, "Validating")
+	m.AddAction(tracker.Publishing,
+		nil,
+		func(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *ops.Outcome {
+			lock.Lock()
+			defer lock.Unlock()
+			published = append(published, j)
+			return ops.Success(j, "")
+		},
+		tracker.Deleting,
+		"Publishing")
+	m.AddAction(tracker.Deleting, nil, newStateFunc(""), tracker.Complete, "Deleting")
+	go m.Watch(ctx, 5*time.Millisecond)
+
+	failTime := time.Now().Add(5 * time.Second)
+	for time.Now().Before(failTime) && tk.NumJobs() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if tk.NumJobs() != 0 {
+		t.Fatal("Jobs should complete", tk.NumJobs())
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(published) != 1 || published[0].Experiment != "pub" {
+		t.Error("Only the pub experiment should be published", published)
+	}
+}
@@ -0,0 +1,133 @@
+package ops
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// ErrInvalidPolling is returned for non-positive or inverted poll intervals.
+var ErrInvalidPolling = errors.New("invalid polling intervals")
+
+// pollInterval bounds the interval between polls of a job.
+type pollInterval struct {
+	min, max time.Duration
+}
+
+// pollState is the poll schedule of a job in a state.
+type pollState struct {
+	state    tracker.State
+	next     time.Time
+	interval time.Duration
+}
+
+// SetPolling makes the Monitor poll each job at min just after it enters a
+// state with an action, e.g. after the parser finishes, and then back off,
+// doubling the interval up to max while it stays in the state, e.g. while
+// its copy waits for annotations.  Sources may override both with
+// MinPollInterval and MaxPollInterval.  A zero max means no backoff.
+// Watch ticks at the shortest min.  Should be called before Watch.
+func (m *Monitor) SetPolling(min, max time.Duration, sources []config.SourceConfig) error {
+	check := func(name string, p pollInterval) (pollInterval, error) {
+		if p.max == 0 {
+			p.max = p.min
+		}
+		if p.min <= 0 || p.max < p.min {
+			return p, fmt.Errorf("%s: %w: %v to %v", name, ErrInvalidPolling, p.min, p.max)
+		}
+		return p, nil
+	}
+	def, err := check("monitor", pollInterval{min: min, max: max})
+	if err != nil {
+		return err
+	}
+	intervals := make(map[string]pollInterval, len(sources))
+	tick := def.min
+	for _, s := range sources {
+		if s.MinPollInterval == 0 && s.MaxPollInterval == 0 {
+			continue
+		}
+		p := pollInterval{min: s.MinPollInterval, max: s.MaxPollInterval}
+		if p.min == 0 {
+			p.min = def.min
+		}
+		if s.MaxPollInterval == 0 {
+			p.max = def.max
+		}
+		name := s.Experiment + "/" + s.Datatype
+		if p, err = check(name, p); err != nil {
+			return err
+		}
+		intervals[name] = p
+		if p.min < tick {
+			tick = p.min
+		}
+	}
+	m.pollDefault = def
+	m.pollIntervals = intervals
+	m.pollTick = tick
+	return nil
+}
+
+// Nudge polls the job at the next opportunity, rather than waiting out its
+// backoff, e.g. when a Pub/Sub message reports that the parser finished.
+// It doesn't block.
+func (m *Monitor) Nudge(j tracker.Job) {
+	m.pollLock.Lock()
+	delete(m.polls, j)
+	m.pollLock.Unlock()
+	metrics.MonitorPolls.WithLabelValues(j.Experiment, j.Datatype, "nudged").Inc()
+	select {
+	case m.nudges <- struct{}{}:
+	default:
+		// A poll is already pending.
+	}
+}
+
+// shouldPoll returns true if the job, in the state, is due to be polled at
+// now, and schedules its next poll.  Jobs are due when they change state,
+// and then at increasing intervals.  Without SetPolling, every job is due.
+func (m *Monitor) shouldPoll(j tracker.Job, state tracker.State, now time.Time) bool {
+	if m.pollDefault.min == 0 {
+		return true
+	}
+	p, ok := m.pollIntervals[j.Experiment+"/"+j.Datatype]
+	if !ok {
+		p = m.pollDefault
+	}
+	m.pollLock.Lock()
+	defer m.pollLock.Unlock()
+	ps, ok := m.polls[j]
+	switch {
+	case !ok || ps.state != state:
+		ps = pollState{state: state, interval: p.min}
+	case now.Before(ps.next):
+		metrics.MonitorPolls.WithLabelValues(j.Experiment, j.Datatype, "deferred").Inc()
+		return false
+	default:
+		ps.interval *= 2
+		if ps.interval > p.max {
+			ps.interval = p.max
+		}
+	}
+	// Allow for ticks that are slightly early.
+	ps.next = now.Add(ps.interval - m.pollTick/2)
+	m.polls[j] = ps
+	metrics.MonitorPolls.WithLabelValues(j.Experiment, j.Datatype, "polled").Inc()
+	return true
+}
+
+// prunePolls drops the schedules of jobs that are no longer tracked.
+func (m *Monitor) prunePolls(jobs tracker.JobMap) {
+	m.pollLock.Lock()
+	defer m.pollLock.Unlock()
+	for j := range m.polls {
+		if _, ok := jobs[j]; !ok {
+			delete(m.polls, j)
+		}
+	}
+}
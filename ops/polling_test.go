@@ -0,0 +1,129 @@
+package ops_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestSetPolling(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	tests := []struct {
+		min, max time.Duration
+		source   config.SourceConfig
+	}{
+		{0, time.Minute, config.SourceConfig{}},
+		{time.Minute, time.Second, config.SourceConfig{}},
+		{time.Second, 0, config.SourceConfig{MinPollInterval: time.Minute}},
+		{time.Second, time.Minute, config.SourceConfig{MinPollInterval: -time.Second}},
+		{time.Second, time.Minute, config.SourceConfig{MaxPollInterval: time.Millisecond}},
+	}
+	for _, tt := range tests {
+		err := m.SetPolling(tt.min, tt.max, []config.SourceConfig{tt.source})
+		if !errors.Is(err, ops.ErrInvalidPolling) {
+			t.Errorf("Expected ErrInvalidPolling for %v %v %+v, got %v", tt.min, tt.max, tt.source, err)
+		}
+	}
+}
+
+func TestShouldPoll(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	fast := tracker.NewJob("bucket", "ndt", "annotation", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	start := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	// Without SetPolling, jobs are always polled.
+	for i := 0; i < 3; i++ {
+		if !ops.ShouldPoll(m, job, tracker.ParseComplete, start) {
+			t.Error("Expected a poll on every tick")
+		}
+	}
+
+	rtx.Must(m.SetPolling(10*time.Second, 40*time.Second, []config.SourceConfig{
+		{Experiment: "ndt", Datatype: "annotation", MinPollInterval: time.Second, MaxPollInterval: 2 * time.Second}}), "SetPolling")
+	// Polls of a job that stays in the same state back off from 10s to 40s.
+	polls := []time.Duration{}
+	for s := 0; s <= 120; s += 10 {
+		if ops.ShouldPoll(m, job, tracker.Deduplicating, start.Add(time.Duration(s)*time.Second)) {
+			polls = append(polls, time.Duration(s)*time.Second)
+		}
+	}
+	want := []time.Duration{0, 10 * time.Second, 30 * time.Second, 70 * time.Second, 110 * time.Second}
+	if len(polls) != len(want) {
+		t.Fatal("Wrong polls", polls)
+	}
+	for i := range want {
+		if polls[i] != want[i] {
+			t.Error("Wrong polls", polls, want)
+		}
+	}
+	// A state change resets the backoff.
+	if !ops.ShouldPoll(m, job, tracker.Copying, start.Add(115*time.Second)) {
+		t.Error("Expected a poll after a state change")
+	}
+	if ops.ShouldPoll(m, job, tracker.Copying, start.Add(116*time.Second)) {
+		t.Error("Expected no poll before the min interval")
+	}
+	// So does a nudge.
+	m.Nudge(job)
+	if !ops.ShouldPoll(m, job, tracker.Copying, start.Add(117*time.Second)) {
+		t.Error("Expected a poll after a nudge")
+	}
+
+	// Sources may poll at their own intervals.
+	polls = polls[:0]
+	for ms := 0; ms <= 6000; ms += 1000 {
+		if ops.ShouldPoll(m, fast, tracker.Deduplicating, start.Add(time.Duration(ms)*time.Millisecond)) {
+			polls = append(polls, time.Duration(ms)*time.Millisecond)
+		}
+	}
+	if len(polls) != 4 || polls[1] != time.Second || polls[3] != 5*time.Second {
+		t.Error("Wrong source polls", polls)
+	}
+}
+
+func TestWatchNudge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	done := make(chan tracker.Job, 1)
+	m.AddAction(tracker.ParseComplete, nil,
+		func(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *ops.Outcome {
+			done <- j
+			return ops.Success(j, "done")
+		}, tracker.Complete, "testing")
+	rtx.Must(m.SetPolling(time.Hour, 0, nil), "SetPolling")
+	go m.Watch(ctx, time.Hour)
+
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(job), "add job")
+	rtx.Must(tk.SetStatus(job, tracker.ParseComplete, ""), "set status")
+	m.Nudge(job)
+	select {
+	case j := <-done:
+		if j != job {
+			t.Error("Wrong job", j)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("Nudge should poll without waiting for the tick")
+	}
+}
@@ -0,0 +1,57 @@
+package ops
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// QueryHandler renders the SQL that would be run for a job, so that
+// operators can review and test it before large backfills.  It takes the
+// "experiment", "datatype", "date" (yyyy-mm-dd) and "op" parameters, where
+// op is one of bq.QueryOps, and defaults to "dedup".  The optional "bucket"
+// and "prefix" parameters render the queries for a prefix job.
+func (m *Monitor) QueryHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	exp, dt, op := q.Get("experiment"), q.Get("datatype"), q.Get("op")
+	if op == "" {
+		op = "dedup"
+	}
+	date, err := time.Parse("2006-01-02", q.Get("date"))
+	if exp == "" || dt == "" || err != nil {
+		http.Error(resp, "experiment, datatype and date (yyyy-mm-dd) are required", http.StatusBadRequest)
+		return
+	}
+	j := tracker.Job{Bucket: q.Get("bucket"), Experiment: exp, Datatype: dt, Date: date,
+		Prefix: q.Get("prefix")}
+	if err := j.Validate(); err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := bq.NewTableOpsWithClientAndNaming(nil, j, os.Getenv("PROJECT"), "", m.naming)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+	to.DedupStrategy = m.dedupStrategies[exp+"/"+dt]
+	sql, err := to.QueryFor(op)
+	if errors.Is(err, bq.ErrUnknownQuery) {
+		http.Error(resp, fmt.Sprintf("%v, expected one of %v", err, bq.QueryOps), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(resp, sql)
+}
@@ -0,0 +1,56 @@
+package ops_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestQueryHandler(t *testing.T) {
+	ctx := context.Background()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	rtx.Must(m.SetDedupStrategies([]config.SourceConfig{
+		{Experiment: "ndt", Datatype: "ndt7", Dedup: "overwrite"}}), "SetDedupStrategies")
+
+	tests := []struct {
+		method string
+		query  string
+		code   int
+		want   string
+	}{
+		{"POST", "experiment=ndt&datatype=ndt7&date=2020-03-01", http.StatusMethodNotAllowed, ""},
+		{"GET", "experiment=ndt&datatype=ndt7", http.StatusBadRequest, "required"},
+		{"GET", "experiment=ndt&datatype=ndt7&date=20200301", http.StatusBadRequest, "required"},
+		{"GET", "experiment=ndt&datatype=other&date=2020-03-01", http.StatusNotFound, "not supported"},
+		{"GET", "experiment=ndt&datatype=ndt7&date=2020-03-01&op=drop", http.StatusBadRequest, "cleanup"},
+		{"GET", "experiment=ndt&datatype=ndt7&date=2020-03-01", http.StatusOK, "row_number = 1"},
+		{"GET", "experiment=ndt&datatype=annotation&date=2020-03-01", http.StatusOK, "NOT EXISTS"},
+		{"GET", "experiment=ndt&datatype=ndt7&date=2020-03-01&op=cleanup", http.StatusOK, "--parameter=date::2020-03-01"},
+		{"GET", "experiment=ndt&datatype=ndt7&date=2020-03-01&op=count&bucket=b&prefix=20200301T15", http.StatusOK,
+			"--parameter=archive_prefix::gs://b/ndt/ndt7/2020/03/01/20200301T15"},
+		{"GET", "experiment=ndt&datatype=ndt7&date=2020-03-01&prefix=a/b", http.StatusBadRequest, "invalid job prefix"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/debug/query?"+tt.query, nil)
+		resp := httptest.NewRecorder()
+		m.QueryHandler(resp, req)
+		if resp.Code != tt.code {
+			t.Error(tt.query, "expected", tt.code, "got", resp.Code)
+		}
+		if !strings.Contains(resp.Body.String(), tt.want) {
+			t.Error(tt.query, "expected", tt.want, "got", resp.Body.String())
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Errors associated with Runner registration and configuration.
+var (
+	ErrUnknownRunner = errors.New("unknown runner")
+	ErrInvalidStep   = errors.New("invalid step config")
+	// ErrInvalidDisposition is returned for copy dispositions that conflict
+	// with the source's pipeline.
+	ErrInvalidDisposition = errors.New("copy disposition conflicts with pipeline")
+)
+
+// A Runner performs a single pipeline step on a job, such as dedup or copy.
+// Run returns nil on success.  Run may also return an *Outcome, including a
+// successful one, to control the detail message and retry behavior.
+// Any other error is passed to IsRetryable to decide whether the job should
+// be retried later, or failed.
+type Runner interface {
+	Name() string
+	Run(ctx context.Context, j tracker.Job) error
+	IsRetryable(err error) bool
+}
+
+// A RunnerFactory creates a Runner for use by a specific Monitor.
+type RunnerFactory func(m *Monitor) Runner
+
+// runners is the registry of named Runners that may be referenced in config.
+var runners = map[string]RunnerFactory{}
+
+// RegisterRunner adds a named RunnerFactory to the registry.
+// It should be called from init functions, and is not thread-safe.
+func RegisterRunner(name string, f RunnerFactory) {
+	runners[name] = f
+}
+
+// RunnerNames returns the sorted names of all registered Runners.
+func RunnerNames() []string {
+	names := make([]string, 0, len(runners))
+	for name := range runners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// funcRunner adapts an ActionFunc to the Runner interface.
+type funcRunner struct {
+	name string
+	f    ActionFunc
+	tk   *tracker.Tracker
+}
+
+func (r funcRunner) Name() string {
+	return r.name
+}
+
+// Run applies the ActionFunc, using the job's last state transition time.
+func (r funcRunner) Run(ctx context.Context, j tracker.Job) error {
+	var stateChangeTime time.Time
+	if status, err := r.tk.GetStatus(j); err == nil {
+		stateChangeTime = status.StateChangeTime()
+	}
+	if o := r.f(ctx, j, stateChangeTime); o != nil {
+		return o
+	}
+	return nil
+}
+
+// IsRetryable is never needed, since ActionFuncs always return an Outcome.
+func (r funcRunner) IsRetryable(err error) bool {
+	return false
+}
+
+// funcFactory returns a RunnerFactory for an ActionFunc.
+func funcFactory(name string, f func(m *Monitor) ActionFunc) RunnerFactory {
+	return func(m *Monitor) Runner {
+		return funcRunner{name: name, f: f(m), tk: m.tk}
+	}
+}
+
+// outcome converts the result of Runner.Run to an Outcome.
+func outcome(r Runner, j tracker.Job, err error) *Outcome {
+	var o *Outcome
+	switch {
+	case err == nil:
+		return Success(j, "-")
+	case errors.As(err, &o):
+		return o
+	case r.IsRetryable(err):
+		return Retry(j, err, "-")
+	default:
+		return Failure(j, err, "-")
+	}
+}
+
+// AddRunner adds a Runner for jobs in a specific state.  If datatype is
+// non-empty, the Runner applies only to jobs of that datatype, and takes
+// precedence over any Runner for all datatypes.
+func (m *Monitor) AddRunner(datatype string, state tracker.State, cond ConditionFunc, r Runner,
+	successState tracker.State, annotation string) {
+	a := Action{
+		fromState:  state,
+		nextState:  successState,
+		condition:  cond,
+		runner:     r,
+		annotation: annotation}
+	if datatype == "" {
+		m.actions[state] = a
+		return
+	}
+	if m.typeActions[datatype] == nil {
+		m.typeActions[datatype] = make(map[tracker.State]Action)
+	}
+	m.typeActions[datatype][state] = a
+}
+
+// stageStates maps the names of the standard runners to the states they run
+// in when used as pipeline stages.  Other runners run in a state with the
+// runner's name.
+var stageStates = map[string]tracker.State{
+	"inventory": tracker.ParseComplete,
+	"load":      tracker.Loading,
+	"dedup":     tracker.Deduplicating,
+	"copy":      tracker.Copying,
+	"validate":  tracker.Validating,
+	"publish":   tracker.Publishing,
+	"join":      tracker.Joining,
+	"delete":    tracker.Deleting,
+}
+
+func stageState(name string) tracker.State {
+	if state, ok := stageStates[name]; ok {
+		return state
+	}
+	return tracker.State(name)
+}
+
+// configurePipeline adds the Runners for an ordered list of stage names.
+// The first stage applies to jobs that have finished parsing, each stage
+// advances the job to the state of the next stage on success, and the last
+// stage completes the job.
+func (m *Monitor) configurePipeline(datatype string, stages []string) error {
+	states := make([]tracker.State, len(stages))
+	seen := map[tracker.State]bool{}
+	for i, name := range stages {
+		if ext := strings.TrimPrefix(name, externalPrefix); ext != name {
+			if ext == "" {
+				return ErrInvalidStep
+			}
+			states[i] = tracker.State(ext)
+		} else if _, ok := runners[name]; !ok {
+			return ErrUnknownRunner
+		} else {
+			states[i] = stageState(name)
+		}
+		if i == 0 {
+			states[i] = tracker.ParseComplete
+		}
+		if seen[states[i]] {
+			return ErrInvalidStep
+		}
+		seen[states[i]] = true
+	}
+	for i, name := range stages {
+		next := tracker.Complete
+		if i+1 < len(stages) {
+			next = states[i+1]
+		}
+		if strings.HasPrefix(name, externalPrefix) {
+			if m.external[datatype] == nil {
+				m.external[datatype] = make(map[tracker.State]tracker.State)
+			}
+			m.external[datatype][states[i]] = next
+			continue
+		}
+		m.AddRunner(datatype, states[i], nil, runners[name](m), next, name)
+	}
+	return nil
+}
+
+// externalPrefix marks pipeline stages that are performed by external
+// workers, e.g. "external:exporting".  The rest of the name is the state.
+const externalPrefix = "external:"
+
+// ExternalNext returns the state that follows the job's state, and true, if
+// the state is an external pipeline stage for the job's datatype.
+func (m *Monitor) ExternalNext(j tracker.Job, state tracker.State) (tracker.State, bool) {
+	next, ok := m.external[j.Datatype][state]
+	if !ok {
+		return "", false
+	}
+	return m.nextState(state, next, j, time.Now()), true
+}
+
+// ConfigureSteps adds the registered Runners named in each source's pipeline
+// and steps.  Steps are applied after the pipeline, so they may replace
+// pipeline stages.  Should be called before Watch.
+func (m *Monitor) ConfigureSteps(sources []config.SourceConfig) error {
+	for _, s := range sources {
+		m.sources = append(m.sources, s)
+		if len(s.Pipeline) > 0 {
+			if err := m.configurePipeline(s.Datatype, s.Pipeline); err != nil {
+				return err
+			}
+		}
+		for _, step := range s.Steps {
+			if step.State == "" || step.Next == "" {
+				return ErrInvalidStep
+			}
+			f, ok := runners[step.Runner]
+			if !ok {
+				return ErrUnknownRunner
+			}
+			m.AddRunner(s.Datatype, tracker.State(step.State), nil, f(m),
+				tracker.State(step.Next), step.Runner)
+		}
+	}
+	return nil
+}
+
+// actionFor returns the Action for the job's datatype and state, if any.
+func (m *Monitor) actionFor(j tracker.Job, state tracker.State) (Action, bool) {
+	if _, ok := m.external[j.Datatype][state]; ok {
+		// Left for external workers.
+		return Action{}, false
+	}
+	if a, ok := m.typeActions[j.Datatype][state]; ok {
+		return a, true
+	}
+	a, ok := m.actions[state]
+	return a, ok
+}
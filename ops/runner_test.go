@@ -0,0 +1,217 @@
+package ops_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// fakeRunner fails jobs for the "bad" experiment.
+type fakeRunner struct{}
+
+func (fakeRunner) Name() string { return "fake" }
+
+func (fakeRunner) Run(ctx context.Context, j tracker.Job) error {
+	if j.Experiment == "bad" {
+		return errors.New("bad experiment")
+	}
+	return nil
+}
+
+func (fakeRunner) IsRetryable(err error) bool { return false }
+
+func init() {
+	ops.RegisterRunner("fake", func(*ops.Monitor) ops.Runner { return fakeRunner{} })
+	ops.RegisterRunner("annotate", func(*ops.Monitor) ops.Runner { return fakeRunner{} })
+	ops.RegisterRunner("enrich", func(*ops.Monitor) ops.Runner { return fakeRunner{} })
+}
+
+func TestConfigureSteps(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	joined := tracker.NewJob("bucket", "exp", "joined", date)
+	bad := tracker.NewJob("bucket", "bad", "joined", date)
+	plain := tracker.NewJob("bucket", "exp", "plain", date)
+	for _, j := range []tracker.Job{joined, bad, plain} {
+		rtx.Must(tk.AddJob(j), "add job")
+	}
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	m.AddAction(tracker.Init, nil, newStateFunc(""), tracker.Copying, "Init")
+
+	err = m.ConfigureSteps([]config.SourceConfig{
+		{Datatype: "joined", Steps: []config.StepConfig{{State: "init", Runner: "nonesuch", Next: "joining"}}}})
+	if err != ops.ErrUnknownRunner {
+		t.Error("Expected ErrUnknownRunner", err)
+	}
+	// The joined datatype gets an extra Joining step.
+	err = m.ConfigureSteps([]config.SourceConfig{
+		{Datatype: "joined", Steps: []config.StepConfig{
+			{State: "init", Runner: "fake", Next: "joining"},
+			{State: "joining", Runner: "fake", Next: "copying"},
+		}}})
+	rtx.Must(err, "ConfigureSteps")
+
+	go m.Watch(ctx, 10*time.Millisecond)
+
+	want := map[tracker.Job]tracker.State{
+		joined: tracker.Copying,
+		bad:    tracker.Failed,
+		plain:  tracker.Copying,
+	}
+	failTime := time.Now().Add(5 * time.Second)
+	for time.Now().Before(failTime) {
+		done := true
+		for j, state := range want {
+			if s, err := tk.GetStatus(j); err != nil || s.State() != state {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for j, state := range want {
+		s, err := tk.GetStatus(j)
+		rtx.Must(err, "get status")
+		if s.State() != state {
+			t.Error(j, "expected", state, "got", s.State())
+		}
+	}
+	s, _ := tk.GetStatus(joined)
+	if s.Prev() != tracker.Joining {
+		t.Error("Expected joined job to pass through Joining", s.History)
+	}
+	s, _ = tk.GetStatus(plain)
+	if s.Prev() != tracker.Init {
+		t.Error("Expected plain job to skip Joining", s.History)
+	}
+}
+
+func TestConfigurePipeline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, time.Hour)
+	rtx.Must(err, "tk init")
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	long := tracker.NewJob("bucket", "exp", "long", date)
+	short := tracker.NewJob("bucket", "exp", "short", date)
+	for _, j := range []tracker.Job{long, short} {
+		rtx.Must(tk.AddJob(j), "add job")
+		rtx.Must(tk.SetStatus(j, tracker.ParseComplete, "parsed"), "set status")
+	}
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+
+	bad := []struct {
+		pipeline []string
+		want     error
+	}{
+		{[]string{"fake", "nonesuch"}, ops.ErrUnknownRunner},
+		{[]string{"fake", "annotate", "annotate"}, ops.ErrInvalidStep},
+		{[]string{"fake", "inventory"}, ops.ErrInvalidStep}, // Both run in ParseComplete.
+		{[]string{"fake", "external:"}, ops.ErrInvalidStep},
+	}
+	for _, b := range bad {
+		err := m.ConfigureSteps([]config.SourceConfig{{Datatype: "long", Pipeline: b.pipeline}})
+		if err != b.want {
+			t.Error(b.pipeline, "expected", b.want, "got", err)
+		}
+	}
+
+	err = m.ConfigureSteps([]config.SourceConfig{
+		{Datatype: "long", Pipeline: []string{"fake", "annotate", "enrich"}},
+		{Datatype: "short", Pipeline: []string{"fake"}},
+	})
+	rtx.Must(err, "ConfigureSteps")
+
+	go m.Watch(ctx, 5*time.Millisecond)
+
+	failTime := time.Now().Add(5 * time.Second)
+	for time.Now().Before(failTime) {
+		ls, _ := tk.GetStatus(long)
+		ss, _ := tk.GetStatus(short)
+		if ls.State() == tracker.Complete && ss.State() == tracker.Complete {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	want := map[tracker.Job][]tracker.State{
+		long:  {tracker.ParseComplete, tracker.State("annotate"), tracker.State("enrich"), tracker.Complete},
+		short: {tracker.ParseComplete, tracker.Complete},
+	}
+	for j, states := range want {
+		s, err := tk.GetStatus(j)
+		rtx.Must(err, "get status")
+		got := []tracker.State{}
+		for _, h := range s.History {
+			if h.State != tracker.Init {
+				got = append(got, h.State)
+			}
+		}
+		if len(got) != len(states) {
+			t.Error(j, "expected", states, "got", got)
+			continue
+		}
+		for i := range got {
+			if got[i] != states[i] {
+				t.Error(j, "expected", states, "got", got)
+				break
+			}
+		}
+	}
+}
+
+func TestExternalStage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, time.Hour)
+	rtx.Must(err, "tk init")
+	job := tracker.NewJob("bucket", "exp", "exported", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(job), "add job")
+	rtx.Must(tk.SetStatus(job, tracker.ParseComplete, "parsed"), "set status")
+
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	err = m.ConfigureSteps([]config.SourceConfig{
+		{Datatype: "exported", Pipeline: []string{"fake", "external:exporting", "enrich"}},
+	})
+	rtx.Must(err, "ConfigureSteps")
+	if next, ok := m.ExternalNext(job, "exporting"); !ok || next != "enrich" {
+		t.Error("Expected enrich to follow exporting", next, ok)
+	}
+	if _, ok := m.ExternalNext(job, "enrich"); ok {
+		t.Error("enrich should not be external")
+	}
+
+	go m.Watch(ctx, 5*time.Millisecond)
+
+	// The job waits in the external stage.
+	failTime := time.Now().Add(5 * time.Second)
+	for time.Now().Before(failTime) {
+		if s, _ := tk.GetStatus(job); s.State() == "exporting" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	s, err := tk.GetStatus(job)
+	rtx.Must(err, "get status")
+	if s.State() != "exporting" {
+		t.Error("Expected job to wait in exporting", s.State())
+	}
+}
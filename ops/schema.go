@@ -0,0 +1,89 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/logging"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// SchemaPatchKey is the job annotation that records the fields added to the
+// raw table schema before the job's copy.
+const SchemaPatchKey = "schema_patch"
+
+// AuditUser is the user of the audit entries recorded by the Monitor.
+const AuditUser = "gardener"
+
+// An Auditor records changes made by the Monitor outside the job's own
+// partitions, e.g. admin.Handler.
+type Auditor interface {
+	Record(ctx context.Context, user, action string, jobs []tracker.Job, detail string)
+}
+
+// SetSchemaPatching enables raw schema patching for each source with
+// PatchRawSchema set.  Before the copy or script stage, the nullable and
+// repeated fields of the tmp table that are missing from the raw table are
+// added to it, rather than failing the job.  Should be called before Watch.
+func (m *Monitor) SetSchemaPatching(sources []config.SourceConfig) {
+	m.schemaPatching = make(map[string]bool, len(sources))
+	for _, s := range sources {
+		if s.PatchRawSchema {
+			m.schemaPatching[s.Experiment+"/"+s.Datatype] = true
+		}
+	}
+}
+
+// SetAuditor records each raw schema patch.  It may be called after Watch,
+// since the admin handler is usually created after the Monitor.
+func (m *Monitor) SetAuditor(a Auditor) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.auditor = a
+}
+
+// patchRawSchema adds the fields of the tmp table that are missing from the
+// raw table, if schema patching is enabled for the job's datatype.  The
+// added fields are recorded in the job's SchemaPatchKey annotation, and by
+// the Auditor.  Returns nil if the job should continue with the copy.
+func (m *Monitor) patchRawSchema(ctx context.Context, qp *bq.TableOps, j tracker.Job) *Outcome {
+	if !m.schemaPatching[j.Experiment+"/"+j.Datatype] {
+		return nil
+	}
+	logger := logging.FromContext(ctx)
+	added, err := qp.PatchRawSchema(ctx, false)
+	if errors.Is(err, bq.ErrIncompatibleSchema) {
+		logger.Warningln(err)
+		metrics.SchemaPatchCount.WithLabelValues(j.Experiment, j.Datatype, "incompatible").Inc()
+		// This terminates this job, leaving the tmp partition for inspection.
+		return Failure(j, err, "incompatible schema")
+	}
+	if err != nil {
+		logger.Println(err)
+		metrics.SchemaPatchCount.WithLabelValues(j.Experiment, j.Datatype, "error").Inc()
+		// Try again soon.
+		return Retry(j, err, "patching raw schema")
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	fields := strings.Join(added, ", ")
+	logger.Println("Added", fields, "to the raw table schema")
+	metrics.SchemaPatchCount.WithLabelValues(j.Experiment, j.Datatype, "patched").Inc()
+	if err := m.tk.Annotate(j, map[string]string{SchemaPatchKey: fields}); err != nil {
+		logger.Println(err)
+	}
+	m.lock.Lock()
+	a := m.auditor
+	m.lock.Unlock()
+	if a != nil {
+		a.Record(ctx, AuditUser, "patch-schema", []tracker.Job{j},
+			fmt.Sprintf("added %s to %s.%s", fields, qp.Names.RawDataset, qp.Names.Table))
+	}
+	return nil
+}
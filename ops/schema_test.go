@@ -0,0 +1,82 @@
+package ops_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+
+	"github.com/m-lab/go/osx"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+type fakeAuditor struct {
+	lock    sync.Mutex
+	details []string
+}
+
+func (a *fakeAuditor) Record(ctx context.Context, user, action string, jobs []tracker.Job, detail string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.details = append(a.details, user+" "+action+" "+detail)
+}
+
+func TestSchemaPatching(t *testing.T) {
+	cleanup := osx.MustSetenv("PROJECT", "fake-project")
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(job), "add job")
+	rtx.Must(tk.SetStatus(job, tracker.ParseComplete, "-"), "set status")
+
+	client := bqfake.NewClient("fake-project")
+	client.AddTable("tmp_ndt", "ndt7", &bigquery.TableMetadata{Schema: bigquery.Schema{
+		{Name: "id"}, {Name: "date"}, {Name: "extra"}}})
+	client.AddTable("raw_ndt", "ndt7", &bigquery.TableMetadata{Schema: bigquery.Schema{
+		{Name: "id"}, {Name: "date"}}})
+	m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	m.SetBQClient(client)
+	sources := []config.SourceConfig{{Experiment: "ndt", Datatype: "ndt7", PatchRawSchema: true,
+		Pipeline: []string{"copy", "external:waiting"}}}
+	m.SetSchemaPatching(sources)
+	rtx.Must(m.ConfigureSteps(sources), "ConfigureSteps")
+	auditor := &fakeAuditor{}
+	go m.Watch(ctx, 5*time.Millisecond)
+	m.SetAuditor(auditor)
+
+	var s tracker.Status
+	for i := 0; i < 500; i++ {
+		if s, err = tk.GetStatus(job); err == nil && s.State() == "waiting" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.State() != "waiting" {
+		t.Fatal("Expected job to be copied", s.State(), s.Error())
+	}
+	if s.Annotations[ops.SchemaPatchKey] != "extra" {
+		t.Error("Wrong schema patch annotation", s.Annotations)
+	}
+	meta, err := client.Dataset("raw_ndt").Table("ndt7").Metadata(ctx)
+	rtx.Must(err, "Metadata")
+	if len(meta.Schema) != 3 {
+		t.Error("Raw schema not patched", meta.Schema)
+	}
+	auditor.lock.Lock()
+	defer auditor.lock.Unlock()
+	if len(auditor.details) != 1 || auditor.details[0] != "gardener patch-schema added extra to raw_ndt.ndt7" {
+		t.Error("Wrong audit", auditor.details)
+	}
+}
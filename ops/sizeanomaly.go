@@ -0,0 +1,112 @@
+package ops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/logging"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// ErrInvalidSizeAnomaly is returned by SetSizeAnomaly for inconsistent
+// bounds.
+var ErrInvalidSizeAnomaly = errors.New("invalid size anomaly bounds")
+
+// SizeWarningKey is the job annotation that records a size anomaly of the
+// published partition.
+const SizeWarningKey = "size_warning"
+
+// minSizeHistory is the number of earlier partitions needed for a baseline.
+const minSizeHistory = 2
+
+// SizeAnomaly holds the bounds on the ratio of a published partition's rows
+// to the median of the same weekday in earlier weeks.  Zero High and Low
+// disable the check.
+type SizeAnomaly struct {
+	High  float64 // e.g. 3, for partitions with more than 3x the median.
+	Low   float64 // e.g. 0.3, for partitions with less than 0.3x the median.
+	Weeks int     // Number of earlier weeks in the baseline.  Zero means 4.
+}
+
+// SetSizeAnomaly enables the comparison of each published partition's row
+// count with the same weekday in earlier weeks.  Should be called before
+// Watch.
+func (m *Monitor) SetSizeAnomaly(sa SizeAnomaly) error {
+	if sa.High < 0 || sa.Low < 0 || sa.Weeks < 0 ||
+		(sa.High > 0 && sa.High <= 1) || sa.Low >= 1 {
+		return fmt.Errorf("%w: high %v, low %v, weeks %d", ErrInvalidSizeAnomaly, sa.High, sa.Low, sa.Weeks)
+	}
+	if sa.Weeks == 0 {
+		sa.Weeks = 4
+	}
+	m.sizeAnomaly = sa
+	return nil
+}
+
+// SetSizeAlert sets a function that is called for each partition published
+// with a size warning, e.g. to send a notification.  Should be called
+// before Watch.
+func (m *Monitor) SetSizeAlert(f func(j tracker.Job, warning string)) {
+	m.sizeAlert = f
+}
+
+// median returns the median of counts, which must not be empty.
+func median(counts []int64) float64 {
+	sorted := append([]int64(nil), counts...)
+	sort.Slice(sorted, func(i, k int) bool { return sorted[i] < sorted[k] })
+	n := len(sorted)
+	if n%2 == 1 {
+		return float64(sorted[n/2])
+	}
+	return float64(sorted[n/2-1]+sorted[n/2]) / 2
+}
+
+// checkSize compares the rows of the published partition with the median
+// of the same weekday in earlier weeks.  If the ratio is outside the
+// bounds, the warning is annotated, counted and alerted, and returned.
+// Prefix jobs and dates with too little history are skipped, and errors are
+// only logged, since they don't affect the published data.
+func (m *Monitor) checkSize(ctx context.Context, qp *bq.TableOps, j tracker.Job, target bq.PublishTarget, rows int64) string {
+	sa := m.sizeAnomaly
+	if (sa.High == 0 && sa.Low == 0) || j.Prefix != "" {
+		return ""
+	}
+	logger := logging.FromContext(ctx)
+	history, err := qp.WeekdayRows(ctx, target, sa.Weeks)
+	if err != nil {
+		logger.Println(err)
+		metrics.SizeAnomalyCount.WithLabelValues(j.Experiment, j.Datatype, "error").Inc()
+		return ""
+	}
+	if len(history) < minSizeHistory {
+		return ""
+	}
+	base := median(history)
+	ratio := float64(rows) / base
+	status := "ok"
+	switch {
+	case sa.High > 0 && ratio > sa.High:
+		status = "high"
+	case ratio < sa.Low:
+		status = "low"
+	}
+	metrics.SizeAnomalyCount.WithLabelValues(j.Experiment, j.Datatype, status).Inc()
+	if status == "ok" {
+		return ""
+	}
+	warning := fmt.Sprintf("%d rows is %.2fx the median of %d earlier %ss (%.0f)",
+		rows, ratio, len(history), j.Date.Weekday(), base)
+	logger.Warningln("Size anomaly:", warning)
+	metrics.WarningCount.WithLabelValues(j.Experiment, j.Datatype, "SizeAnomaly").Inc()
+	if err := m.tk.Annotate(j, map[string]string{SizeWarningKey: warning}); err != nil {
+		logger.Println(err)
+	}
+	if m.sizeAlert != nil {
+		m.sizeAlert(j, warning)
+	}
+	return warning
+}
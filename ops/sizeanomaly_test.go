@@ -0,0 +1,121 @@
+package ops_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/osx"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestSetSizeAnomaly(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewMonitor failure")
+	tests := []struct {
+		sa  ops.SizeAnomaly
+		err error
+	}{
+		{ops.SizeAnomaly{}, nil},
+		{ops.SizeAnomaly{High: 3, Low: 0.3, Weeks: 8}, nil},
+		{ops.SizeAnomaly{Low: 0.5}, nil},
+		{ops.SizeAnomaly{High: 0.5}, ops.ErrInvalidSizeAnomaly},
+		{ops.SizeAnomaly{Low: 2}, ops.ErrInvalidSizeAnomaly},
+		{ops.SizeAnomaly{High: 3, Weeks: -1}, ops.ErrInvalidSizeAnomaly},
+	}
+	for _, tt := range tests {
+		if err := m.SetSizeAnomaly(tt.sa); !errors.Is(err, tt.err) {
+			t.Errorf("%+v: got %v, want %v", tt.sa, err, tt.err)
+		}
+	}
+}
+
+func TestSizeAnomaly(t *testing.T) {
+	cleanup := osx.MustSetenv("PROJECT", "fake-project")
+	defer cleanup()
+	tests := []struct {
+		name    string
+		rows    int64
+		history []interface{}
+		warning string
+	}{
+		{name: "ok", rows: 1100, history: []interface{}{
+			bq.DateRows{Date: "2020-01-01", Rows: 1000}, bq.DateRows{Date: "2019-12-25", Rows: 1200}}},
+		{name: "low", rows: 200, history: []interface{}{
+			bq.DateRows{Date: "2020-01-01", Rows: 1000}, bq.DateRows{Date: "2019-12-25", Rows: 900},
+			bq.DateRows{Date: "2019-12-18", Rows: 1100}},
+			warning: "200 rows is 0.20x the median of 3 earlier Wednesdays (1000)"},
+		{name: "high", rows: 5000, history: []interface{}{
+			bq.DateRows{Date: "2020-01-01", Rows: 1000}, bq.DateRows{Date: "2019-12-25", Rows: 1000}},
+			warning: "5000 rows is 5.00x the median of 2 earlier Wednesdays (1000)"},
+		{name: "no history", rows: 5000, history: []interface{}{
+			bq.DateRows{Date: "2020-01-01", Rows: 1000}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+			rtx.Must(err, "tk init")
+			job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 8, 0, 0, 0, 0, time.UTC))
+			rtx.Must(tk.AddJob(job), "add job")
+			rtx.Must(tk.SetStatus(job, tracker.ParseComplete, "-"), "set status")
+
+			client := bqfake.NewClient("fake-project")
+			client.AddResult("rows in the raw and published", bqfake.Result{Rows: []interface{}{
+				bq.PublishCount{Table: "raw", Rows: tt.rows}, bq.PublishCount{Table: "published", Rows: tt.rows}}})
+			client.AddResult("published partitions of earlier weeks", bqfake.Result{Rows: tt.history})
+			m, err := ops.NewMonitor(ctx, cloud.BQConfig{}, tk)
+			rtx.Must(err, "NewMonitor failure")
+			m.SetBQClient(client)
+			rtx.Must(m.SetPublish(map[string]bq.PublishTarget{"ndt": {Project: "public", Dataset: "ndt"}}), "SetPublish")
+			rtx.Must(m.SetSizeAnomaly(ops.SizeAnomaly{High: 3, Low: 0.3}), "SetSizeAnomaly")
+			var lock sync.Mutex
+			alerts := []string{}
+			m.SetSizeAlert(func(j tracker.Job, warning string) {
+				lock.Lock()
+				defer lock.Unlock()
+				alerts = append(alerts, warning)
+			})
+			rtx.Must(m.ConfigureSteps([]config.SourceConfig{{Experiment: "ndt", Datatype: "ndt7",
+				Pipeline: []string{"publish", "external:waiting"}}}), "ConfigureSteps")
+			go m.Watch(ctx, 5*time.Millisecond)
+
+			var s tracker.Status
+			for i := 0; i < 500; i++ {
+				if s, err = tk.GetStatus(job); err == nil && s.State() == "waiting" {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if s.State() != "waiting" {
+				t.Fatal("Expected job to be published", s.State(), s.Error())
+			}
+			if s.Annotations[ops.SizeWarningKey] != tt.warning {
+				t.Errorf("Wrong annotation %q, want %q", s.Annotations[ops.SizeWarningKey], tt.warning)
+			}
+			// The publishing detail is in the penultimate state.
+			detail := s.History[len(s.History)-2].Detail
+			if tt.warning != "" && !strings.HasPrefix(detail, "Published with warning: "+tt.warning) {
+				t.Error("Wrong detail", detail)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if (tt.warning == "") != (len(alerts) == 0) {
+				t.Error("Wrong alerts", alerts)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package ops
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// A Transition is an edge of a state machine.
+type Transition struct {
+	From, To tracker.State
+	Label    string // The action, or "parser" or "external" for work done elsewhere.
+	Note     string `json:",omitempty"` // Conditions, limits and deadlines.
+}
+
+// StateMachine describes the transitions that jobs of a datatype go through.
+type StateMachine struct {
+	Experiment  string
+	Datatype    string
+	Transitions []Transition
+}
+
+// actionNote describes the conditions, limits and deadlines of an action.
+func (m *Monitor) actionNote(a Action) string {
+	notes := []string{}
+	if a.condition != nil {
+		notes = append(notes, "conditional")
+	}
+	if limit, ok := m.limits[a.fromState]; ok {
+		notes = append(notes, fmt.Sprint("limit ", cap(limit)))
+	}
+	if _, ok := m.throttles[a.fromState]; ok {
+		notes = append(notes, "throttled")
+	}
+	if d, ok := m.deadlines[a.fromState]; ok {
+		notes = append(notes, fmt.Sprint("deadline ", d))
+	}
+	return strings.Join(notes, ", ")
+}
+
+// successors returns the transitions from a state whose work advances the
+// job to next, including the detours applied by nextState, e.g. for
+// publishing or incremental sources.
+func (m *Monitor) successors(j tracker.Job, from, next tracker.State, label, note string) []Transition {
+	now := time.Now().UTC()
+	past := j
+	past.Date = time.Time{}
+	today := j
+	today.Date = now.Truncate(24 * time.Hour)
+	t := []Transition{{From: from, To: m.nextState(from, next, past, now), Label: label, Note: note}}
+	if alt := m.nextState(from, next, today, now); alt != t[0].To {
+		t[0].Note = strings.TrimPrefix(note+", past dates", ", ")
+		t = append(t, Transition{From: from, To: alt, Label: label,
+			Note: strings.TrimPrefix(note+", current date", ", ")})
+	}
+	return t
+}
+
+// transitionsFrom returns the transitions from a state, if any.
+func (m *Monitor) transitionsFrom(j tracker.Job, s tracker.State) []Transition {
+	if next, ok := m.external[j.Datatype][s]; ok {
+		return m.successors(j, s, next, "external", "")
+	}
+	a, ok := m.actionFor(j, s)
+	if !ok {
+		return nil
+	}
+	label := a.annotation
+	if label == "" && a.runner != nil {
+		label = a.runner.Name()
+	}
+	return m.successors(j, s, a.nextState, label, m.actionNote(a))
+}
+
+// StateMachine returns the configured state machine for jobs of the
+// experiment and datatype, generated from the registered actions.  It
+// starts with parsing, then follows the actions from ParseComplete.
+// Datatype specific actions and external stages that can't be reached are
+// listed last, so that misconfigured steps are visible.
+func (m *Monitor) StateMachine(experiment, datatype string) StateMachine {
+	j := tracker.Job{Experiment: experiment, Datatype: datatype}
+	sm := StateMachine{Experiment: experiment, Datatype: datatype, Transitions: []Transition{
+		{From: tracker.Init, To: tracker.Parsing, Label: "parser"},
+		{From: tracker.Parsing, To: tracker.ParseComplete, Label: "parser"},
+	}}
+	seen := map[tracker.State]bool{tracker.Init: true, tracker.Parsing: true}
+	queue := []tracker.State{tracker.ParseComplete}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		for _, e := range m.transitionsFrom(j, s) {
+			sm.Transitions = append(sm.Transitions, e)
+			queue = append(queue, e.To)
+		}
+	}
+
+	unreachable := []tracker.State{}
+	for s := range m.typeActions[datatype] {
+		if !seen[s] {
+			unreachable = append(unreachable, s)
+		}
+	}
+	for s := range m.external[datatype] {
+		if !seen[s] {
+			unreachable = append(unreachable, s)
+		}
+	}
+	sort.Slice(unreachable, func(i, j int) bool { return unreachable[i] < unreachable[j] })
+	for _, s := range unreachable {
+		for _, e := range m.transitionsFrom(j, s) {
+			e.Note = strings.TrimPrefix(e.Note+", unreachable", ", ")
+			sm.Transitions = append(sm.Transitions, e)
+		}
+	}
+	return sm
+}
+
+// states returns the states of the machine, in order of first appearance.
+func (sm StateMachine) states() []tracker.State {
+	seen := map[tracker.State]bool{}
+	states := []tracker.State{}
+	for _, t := range sm.Transitions {
+		for _, s := range []tracker.State{t.From, t.To} {
+			if !seen[s] {
+				seen[s] = true
+				states = append(states, s)
+			}
+		}
+	}
+	return states
+}
+
+// edgeLabel returns the label and note of a transition, on separate lines.
+func (t Transition) edgeLabel() []string {
+	if t.Note == "" {
+		return []string{t.Label}
+	}
+	return []string{t.Label, "(" + t.Note + ")"}
+}
+
+// WriteDOT writes the state machines as a Graphviz digraph, with a cluster
+// for each machine.
+func WriteDOT(w io.Writer, machines []StateMachine) error {
+	b := &strings.Builder{}
+	fmt.Fprintln(b, "digraph gardener {")
+	fmt.Fprintln(b, "  node [shape=box];")
+	for i, sm := range machines {
+		name := sm.Experiment + "/" + sm.Datatype
+		fmt.Fprintf(b, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(b, "    label=%q;\n", name)
+		for _, s := range sm.states() {
+			fmt.Fprintf(b, "    %q [label=%q];\n", name+":"+string(s), string(s))
+		}
+		for _, t := range sm.Transitions {
+			fmt.Fprintf(b, "    %q -> %q [label=%q];\n", name+":"+string(t.From), name+":"+string(t.To),
+				strings.Join(t.edgeLabel(), "\n"))
+		}
+		fmt.Fprintln(b, "  }")
+	}
+	fmt.Fprintln(b, "}")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// SVG layout dimensions, in pixels.
+const (
+	svgNodeWidth  = 160
+	svgNodeHeight = 30
+	svgColumnGap  = 40
+	svgRowGap     = 70
+	svgMargin     = 20
+)
+
+// ranks returns the rank of each state, i.e. its distance from Init.
+// States that can't be reached from Init are ranked last.
+func (sm StateMachine) ranks() map[tracker.State]int {
+	rank := map[tracker.State]int{tracker.Init: 0}
+	queue := []tracker.State{tracker.Init}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for _, t := range sm.Transitions {
+			if _, ok := rank[t.To]; !ok && t.From == s {
+				rank[t.To] = rank[s] + 1
+				queue = append(queue, t.To)
+			}
+		}
+	}
+	last := 0
+	for _, r := range rank {
+		if r > last {
+			last = r
+		}
+	}
+	for _, s := range sm.states() {
+		if _, ok := rank[s]; !ok {
+			last++
+			rank[s] = last
+		}
+	}
+	return rank
+}
+
+// WriteSVG writes the state machines as an SVG image, side by side, with
+// the states of each machine in rows by distance from Init.  It needs no
+// external tools, so the layout is simple.
+func WriteSVG(w io.Writer, machines []StateMachine) error {
+	type point struct{ x, y int }
+	b := &strings.Builder{}
+	body := &strings.Builder{}
+	left, height := svgMargin, 0
+	for _, sm := range machines {
+		ranks := sm.ranks()
+		rows := map[int][]tracker.State{}
+		for _, s := range sm.states() {
+			rows[ranks[s]] = append(rows[ranks[s]], s)
+		}
+		columns := 1
+		for _, row := range rows {
+			if len(row) > columns {
+				columns = len(row)
+			}
+		}
+		width := columns*(svgNodeWidth+svgColumnGap) - svgColumnGap
+		pos := map[tracker.State]point{}
+		bottom := 0
+		for r, row := range rows {
+			offset := (width - len(row)*(svgNodeWidth+svgColumnGap) + svgColumnGap) / 2
+			for i, s := range row {
+				p := point{left + offset + i*(svgNodeWidth+svgColumnGap), 2*svgMargin + r*svgRowGap}
+				pos[s] = p
+				if p.y+svgNodeHeight > bottom {
+					bottom = p.y + svgNodeHeight
+				}
+			}
+		}
+		fmt.Fprintf(body, `<text x="%d" y="%d" font-weight="bold">%s</text>`+"\n",
+			left, svgMargin, html.EscapeString(sm.Experiment+"/"+sm.Datatype))
+		for _, t := range sm.Transitions {
+			from, to := pos[t.From], pos[t.To]
+			x1, y1 := from.x+svgNodeWidth/2, from.y+svgNodeHeight
+			x2, y2 := to.x+svgNodeWidth/2, to.y
+			if to.y <= from.y {
+				// Back edges run from the side.
+				x1, y1 = from.x+svgNodeWidth, from.y+svgNodeHeight/2
+				x2, y2 = to.x+svgNodeWidth, to.y+svgNodeHeight/2
+			}
+			fmt.Fprintf(body, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="black" marker-end="url(#arrow)"/>`+"\n",
+				x1, y1, x2, y2)
+			for i, line := range t.edgeLabel() {
+				fmt.Fprintf(body, `<text x="%d" y="%d" font-size="10">%s</text>`+"\n",
+					(x1+x2)/2+4, (y1+y2)/2+i*12, html.EscapeString(line))
+			}
+		}
+		for _, s := range sm.states() {
+			p := pos[s]
+			fmt.Fprintf(body, `<rect x="%d" y="%d" width="%d" height="%d" rx="4" fill="white" stroke="black"/>`+"\n",
+				p.x, p.y, svgNodeWidth, svgNodeHeight)
+			fmt.Fprintf(body, `<text x="%d" y="%d" text-anchor="middle">%s</text>`+"\n",
+				p.x+svgNodeWidth/2, p.y+svgNodeHeight/2+5, html.EscapeString(string(s)))
+		}
+		left += width + 3*svgColumnGap
+		if bottom > height {
+			height = bottom
+		}
+	}
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="12">`+"\n",
+		left, height+svgMargin)
+	fmt.Fprintln(b, `<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="6" markerHeight="6" orient="auto"><path d="M 0 0 L 10 5 L 0 10 z"/></marker></defs>`)
+	b.WriteString(body.String())
+	fmt.Fprintln(b, "</svg>")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// StateMachineHandler renders the state machines of the configured sources,
+// so that operators can verify what a config change does.  The optional
+// "experiment" and "datatype" parameters select the sources, and "format"
+// is "dot" (the default) or "svg".
+func (m *Monitor) StateMachineHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	exp, dt := q.Get("experiment"), q.Get("datatype")
+	machines := []StateMachine{}
+	for _, s := range m.sources {
+		if (exp == "" || s.Experiment == exp) && (dt == "" || s.Datatype == dt) {
+			machines = append(machines, m.StateMachine(s.Experiment, s.Datatype))
+		}
+	}
+	if len(machines) == 0 {
+		http.Error(resp, "no matching sources", http.StatusNotFound)
+		return
+	}
+	var err error
+	switch q.Get("format") {
+	case "", "dot":
+		resp.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		err = WriteDOT(resp, machines)
+	case "svg":
+		resp.Header().Set("Content-Type", "image/svg+xml")
+		err = WriteSVG(resp, machines)
+	default:
+		http.Error(resp, "format must be dot or svg", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,98 @@
+package ops_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud"
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestMonitor_StateMachine(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	m, err := ops.NewStandardMonitor(context.Background(), cloud.BQConfig{}, tk)
+	rtx.Must(err, "NewStandardMonitor failure")
+	m.SetConcurrency(tracker.Deduplicating, 4)
+	m.SetDeadline(tracker.Loading, 2*time.Hour)
+	rtx.Must(m.SetPublish(map[string]bq.PublishTarget{"ndt": {Project: "public", Dataset: "ndt"}}), "SetPublish")
+	sources := []config.SourceConfig{
+		{Experiment: "ndt", Datatype: "ndt7"},
+		{Experiment: "host", Datatype: "nodeinfo", Incremental: true,
+			Pipeline: []string{"inventory", "load", "external:exporting", "delete"},
+			Steps:    []config.StepConfig{{State: "orphaned", Runner: "fake", Next: "complete"}}},
+	}
+	m.SetIncremental(sources)
+	rtx.Must(m.ConfigureSteps(sources), "ConfigureSteps")
+
+	edges := func(sm ops.StateMachine) string {
+		s := []string{}
+		for _, t := range sm.Transitions {
+			e := string(t.From) + ">" + string(t.To) + ":" + t.Label
+			if t.Note != "" {
+				e += "(" + t.Note + ")"
+			}
+			s = append(s, e)
+		}
+		return strings.Join(s, " ")
+	}
+	want := "init>parsing:parser parsing>postProcessing:parser postProcessing>loading:Listing archive " +
+		"loading>deduplicating:Loading(deadline 2h0m0s) deduplicating>copying:Deduplicating(limit 4) " +
+		"copying>validating:Copying validating>publishing:Validating publishing>deleting:Publishing " +
+		"deleting>complete:Deleting"
+	if got := edges(m.StateMachine("ndt", "ndt7")); got != want {
+		t.Errorf("Wrong ndt7 machine:\n got %s\nwant %s", got, want)
+	}
+	want = "init>parsing:parser parsing>postProcessing:parser postProcessing>loading:inventory " +
+		"loading>exporting:load(deadline 2h0m0s) exporting>deleting:external " +
+		"deleting>complete:delete(past dates) deleting>partialComplete:delete(current date) " +
+		"orphaned>complete:fake(past dates, unreachable) orphaned>partialComplete:fake(current date, unreachable)"
+	if got := edges(m.StateMachine("host", "nodeinfo")); got != want {
+		t.Errorf("Wrong nodeinfo machine:\n got %s\nwant %s", got, want)
+	}
+
+	tests := []struct {
+		method, query string
+		code          int
+		want          string
+	}{
+		{"POST", "", http.StatusMethodNotAllowed, ""},
+		{"GET", "", http.StatusOK, `"host/nodeinfo:exporting" -> "host/nodeinfo:deleting" [label="external"]`},
+		{"GET", "datatype=ndt7&format=dot", http.StatusOK, `label="ndt/ndt7"`},
+		{"GET", "experiment=ndt&format=svg", http.StatusOK, "<svg"},
+		{"GET", "experiment=ndt&format=png", http.StatusBadRequest, "format"},
+		{"GET", "experiment=foo", http.StatusNotFound, "no matching sources"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/debug/statemachine?"+tt.query, nil)
+		rec := httptest.NewRecorder()
+		m.StateMachineHandler(rec, req)
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Error(tt.method, tt.query, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestWriteSVG(t *testing.T) {
+	sm := ops.StateMachine{Experiment: "exp", Datatype: "a<b", Transitions: []ops.Transition{
+		{From: tracker.Init, To: tracker.Parsing, Label: "parser"},
+		{From: tracker.Parsing, To: tracker.Init, Label: "retry", Note: "back"},
+		{From: "orphan", To: tracker.Complete, Label: "x"},
+	}}
+	b := &strings.Builder{}
+	rtx.Must(ops.WriteSVG(b, []ops.StateMachine{sm, sm}), "WriteSVG")
+	svg := b.String()
+	if !strings.HasPrefix(svg, "<svg") || !strings.Contains(svg, "exp/a&lt;b") ||
+		!strings.Contains(svg, "(back)") || strings.Count(svg, "<rect") != 8 {
+		t.Error("Bad svg", svg)
+	}
+}
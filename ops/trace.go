@@ -0,0 +1,70 @@
+package ops
+
+import (
+	"context"
+	"crypto/sha256"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// tracer creates the spans for monitor actions.  It uses the global
+// TracerProvider, so spans are only exported if main configures one.
+var tracer = otel.Tracer("github.com/m-lab/etl-gardener/ops")
+
+// JobTraceID returns the trace ID for a job.  The ID is derived from the job
+// itself, so that every action on the job, across gardener restarts, belongs
+// to the same trace, and so that parsers can compute the same ID.
+func JobTraceID(j tracker.Job) trace.TraceID {
+	var id trace.TraceID
+	sum := sha256.Sum256(j.Marshal())
+	copy(id[:], sum[:])
+	return id
+}
+
+// jobSpanContext returns a context whose parent span is the root of the job's trace.
+func jobSpanContext(ctx context.Context, j tracker.Job) context.Context {
+	// The root span is never exported, but must have a valid ID.
+	var sid trace.SpanID
+	sum := sha256.Sum256(j.Marshal())
+	copy(sid[:], sum[len(trace.TraceID{}):])
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    JobTraceID(j),
+		SpanID:     sid,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	return trace.ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// startActionSpan starts a span for an action on a job.
+func startActionSpan(ctx context.Context, a Action, j tracker.Job) (context.Context, trace.Span) {
+	return tracer.Start(jobSpanContext(ctx, j), a.Name(),
+		trace.WithAttributes(
+			attribute.String("job", j.Key()),
+			attribute.String("experiment", j.Experiment),
+			attribute.String("datatype", j.Datatype),
+			attribute.String("date", j.Date.Format("2006-01-02")),
+			attribute.String("state", string(a.fromState)),
+		))
+}
+
+// endActionSpan records the outcome, and ends the span.
+func endActionSpan(span trace.Span, o *Outcome) {
+	if o.error != nil {
+		span.RecordError(o.error)
+		span.SetStatus(codes.Error, o.Error())
+		span.SetAttributes(attribute.Bool("retry", o.retry))
+	}
+	span.End()
+}
+
+// setSpanAttributes adds attributes, such as BigQuery job IDs or GCS
+// prefixes, to the current span.
+func setSpanAttributes(ctx context.Context, kv ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).SetAttributes(kv...)
+}
@@ -0,0 +1,24 @@
+package ops_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestJobTraceID(t *testing.T) {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	j := tracker.NewJob("bucket", "exp", "type", date)
+	id := ops.JobTraceID(j)
+	if !id.IsValid() {
+		t.Error("Invalid trace ID")
+	}
+	if ops.JobTraceID(tracker.NewJob("bucket", "exp", "type", date)) != id {
+		t.Error("Trace ID should be deterministic")
+	}
+	if ops.JobTraceID(tracker.NewJob("bucket", "exp", "type", date.AddDate(0, 0, 1))) == id {
+		t.Error("Trace ID should differ for different jobs")
+	}
+}
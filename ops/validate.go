@@ -0,0 +1,105 @@
+package ops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/logging"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// ErrValidationFailed is returned when job counts disagree beyond the threshold.
+var ErrValidationFailed = errors.New("validation failed")
+
+// DefaultValidationThreshold is the fractional count difference allowed when
+// no threshold is configured.  Exact matches are too strict, since archives
+// may hold a few files the parser skips, e.g. corrupt or empty ones.
+const DefaultValidationThreshold = 0.01
+
+// validationThreshold returns the threshold, or the default if it is zero.
+func validationThreshold(threshold float64) float64 {
+	if threshold <= 0 {
+		return DefaultValidationThreshold
+	}
+	return threshold
+}
+
+// A Mismatch describes a pair of counts that disagree.
+type Mismatch struct {
+	Name string  // Name of the comparison, e.g. "archive/bigquery files"
+	Want int64   // Count from the upstream source.
+	Got  int64   // Count from the downstream source.
+	Diff float64 // Fractional difference, relative to Want.
+}
+
+// Compare checks the archive inventory and parser stats against the BigQuery
+// counts, and returns any pair that differs by more than threshold.
+// The inventory and stats may be nil, in which case those comparisons are skipped.
+func Compare(inv *tracker.Inventory, stats *tracker.ParseStats, counts bq.RawCounts, threshold float64) []Mismatch {
+	result := []Mismatch{}
+	check := func(name string, want, got int64) {
+		diff := 0.0
+		if want != got {
+			diff = math.Abs(float64(want-got)) / math.Max(1, float64(want))
+		}
+		if diff > threshold {
+			result = append(result, Mismatch{Name: name, Want: want, Got: got, Diff: diff})
+		}
+	}
+	if inv != nil {
+		if stats != nil {
+			check("archive/parser files", inv.Files, stats.Files)
+		}
+		check("archive/bigquery files", inv.Files, counts.Files)
+	}
+	if stats != nil {
+		check("parser/bigquery files", stats.Files, counts.Files)
+		check("parser/bigquery rows", stats.Rows, counts.Rows)
+	}
+	return result
+}
+
+// validateFunc returns an ActionFunc that compares the job's archive, parser
+// and raw partition counts, and fails the job if they disagree.  A zero
+// threshold uses DefaultValidationThreshold.
+func (m *Monitor) validateFunc(threshold float64) ActionFunc {
+	threshold = validationThreshold(threshold)
+	return func(ctx context.Context, j tracker.Job, stateChangeTime time.Time) *Outcome {
+		logger := logging.FromContext(ctx)
+		status, err := m.tk.GetStatus(j)
+		if err != nil {
+			logger.Println(err)
+			return Failure(j, err, "-")
+		}
+		qp, err := m.tableOps(ctx, j)
+		if err != nil {
+			logger.Println(err)
+			// This terminates this job.
+			return Failure(j, err, "-")
+		}
+		counts, err := qp.CountRaw(ctx)
+		if err != nil {
+			logger.Println(err)
+			// Try again soon.
+			return Retry(j, err, "-")
+		}
+
+		diffs := Compare(status.Inventory, status.ParseStats, counts, threshold)
+		if len(diffs) > 0 {
+			metrics.WarningCount.WithLabelValues(
+				j.Experiment, j.Datatype, "ValidationMismatch").Inc()
+			detail, _ := json.Marshal(diffs)
+			logger.Warningln(ErrValidationFailed, string(detail))
+			return Failure(j, ErrValidationFailed, string(detail))
+		}
+		msg := fmt.Sprintf("Validated %d files, %d rows", counts.Files, counts.Rows)
+		logger.Println(msg)
+		return Success(j, msg)
+	}
+}
@@ -0,0 +1,58 @@
+package ops_test
+
+import (
+	"testing"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/ops"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestCompare(t *testing.T) {
+	inv := &tracker.Inventory{Files: 100, Bytes: 12345}
+	stats := &tracker.ParseStats{Files: 100, Rows: 5000}
+	tests := []struct {
+		name   string
+		inv    *tracker.Inventory
+		stats  *tracker.ParseStats
+		counts bq.RawCounts
+		want   []string
+	}{
+		{name: "match", inv: inv, stats: stats, counts: bq.RawCounts{Files: 100, Rows: 5000}},
+		{name: "within threshold", inv: inv, stats: stats, counts: bq.RawCounts{Files: 100, Rows: 4950}},
+		{name: "missing rows", inv: inv, stats: stats, counts: bq.RawCounts{Files: 100, Rows: 4000},
+			want: []string{"parser/bigquery rows"}},
+		{name: "missing files", inv: inv, stats: stats, counts: bq.RawCounts{Files: 90, Rows: 5000},
+			want: []string{"archive/bigquery files", "parser/bigquery files"}},
+		{name: "no parser stats", inv: inv, counts: bq.RawCounts{Files: 90, Rows: 0},
+			want: []string{"archive/bigquery files"}},
+		{name: "no inventory or stats", counts: bq.RawCounts{Files: 90, Rows: 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ops.Compare(tt.inv, tt.stats, tt.counts, 0.02)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Compare() = %+v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Name != tt.want[i] {
+					t.Errorf("Compare() = %+v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidationThreshold(t *testing.T) {
+	if got := ops.ValidationThreshold(0); got != ops.DefaultValidationThreshold || got == 0 {
+		t.Error("Wrong default threshold", got)
+	}
+	if got := ops.ValidationThreshold(0.05); got != 0.05 {
+		t.Error("Wrong configured threshold", got)
+	}
+	// A job off by one row passes with the default threshold.
+	stats := &tracker.ParseStats{Files: 100, Rows: 5000}
+	if got := ops.Compare(nil, stats, bq.RawCounts{Files: 100, Rows: 4999}, ops.ValidationThreshold(0)); len(got) != 0 {
+		t.Error("Expected no mismatches", got)
+	}
+}
@@ -0,0 +1,141 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrEtcdRequestFailed is returned, wrapped with the status and response
+// body, for etcd requests that don't succeed.
+var ErrEtcdRequestFailed = errors.New("etcd request failed")
+
+// EtcdKV implements KV with the JSON gateway of the etcd v3 API, e.g. at
+// http://localhost:2379, so that no etcd client library is needed.
+type EtcdKV struct {
+	Endpoint url.URL
+	// HTTP is the client used for requests, e.g. with TLS client
+	// certificates.  If nil, http.DefaultClient is used.
+	HTTP *http.Client
+}
+
+// NewEtcdKV returns an EtcdKV for the endpoint.
+func NewEtcdKV(endpoint url.URL) *EtcdKV {
+	return &EtcdKV{Endpoint: endpoint}
+}
+
+// etcdKeyValue is a key value in a range response.  Byte slices are
+// base64 encoded, and 64 bit integers are strings.
+type etcdKeyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+type etcdCompare struct {
+	Key         []byte `json:"key"`
+	Target      string `json:"target"`
+	Result      string `json:"result"`
+	ModRevision string `json:"mod_revision"`
+}
+
+type etcdPut struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdRequestOp struct {
+	RequestPut etcdPut `json:"request_put"`
+}
+
+type etcdTxnRequest struct {
+	Compare []etcdCompare   `json:"compare"`
+	Success []etcdRequestOp `json:"success"`
+}
+
+type etcdTxnResponse struct {
+	Header struct {
+		Revision string `json:"revision"`
+	} `json:"header"`
+	Succeeded bool `json:"succeeded"`
+}
+
+// post sends the request to the gateway path, and decodes the response.
+func (e *EtcdKV) post(ctx context.Context, path string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	u := e.Endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	hc := e.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s: %s %s", ErrEtcdRequestFailed, path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return json.Unmarshal(b, response)
+}
+
+// Get implements KV.Get.
+func (e *EtcdKV) Get(ctx context.Context, key string) ([]byte, int64, error) {
+	resp := etcdRangeResponse{}
+	if err := e.post(ctx, "/v3/kv/range", map[string][]byte{"key": []byte(key)}, &resp); err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, ErrKeyNotFound
+	}
+	rev, err := strconv.ParseInt(resp.Kvs[0].ModRevision, 10, 64)
+	return resp.Kvs[0].Value, rev, err
+}
+
+// CompareAndSwap implements KV.CompareAndSwap, with a transaction that
+// puts the value if the key's mod revision is rev.  The mod revision of a
+// missing key is zero.
+func (e *EtcdKV) CompareAndSwap(ctx context.Context, key string, value []byte, rev int64) (int64, error) {
+	txn := etcdTxnRequest{
+		Compare: []etcdCompare{{Key: []byte(key), Target: "MOD", Result: "EQUAL", ModRevision: strconv.FormatInt(rev, 10)}},
+		Success: []etcdRequestOp{{RequestPut: etcdPut{Key: []byte(key), Value: value}}},
+	}
+	resp := etcdTxnResponse{}
+	if err := e.post(ctx, "/v3/kv/txn", txn, &resp); err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		return 0, ErrConflict
+	}
+	return strconv.ParseInt(resp.Header.Revision, 10, 64)
+}
+
+// Delete implements KV.Delete.
+func (e *EtcdKV) Delete(ctx context.Context, key string) error {
+	resp := struct{}{}
+	return e.post(ctx, "/v3/kv/deleterange", map[string][]byte{"key": []byte(key)}, &resp)
+}
@@ -0,0 +1,31 @@
+// +build integration
+
+package persistence_test
+
+import (
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/persistence"
+)
+
+// These tests use an actual etcd server, at ETCD_ENDPOINT, or the default
+// local endpoint.
+func etcdKV(t *testing.T) *persistence.EtcdKV {
+	endpoint := os.Getenv("ETCD_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "http://localhost:2379"
+	}
+	u, err := url.Parse(endpoint)
+	rtx.Must(err, "Invalid ETCD_ENDPOINT")
+	return persistence.NewEtcdKV(*u)
+}
+
+func TestEtcdIntegration(t *testing.T) {
+	t.Run("kv", func(t *testing.T) { testKV(t, etcdKV(t)) })
+	t.Run("saver", func(t *testing.T) { testSaver(t, persistence.NewKVSaver(etcdKV(t), "test")) })
+	t.Run("conflict", func(t *testing.T) { testKVSaver(t, etcdKV(t)) })
+}
@@ -0,0 +1,82 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+// FileSaver implements a Saver that stores each state object as a JSON file
+// in a local directory.  It is intended for local development, so that
+// gardener can run without a cloud project.
+type FileSaver struct {
+	Dir string
+
+	lock sync.Mutex // Serializes writes, so that concurrent saves don't interleave.
+}
+
+// NewFileSaver creates a FileSaver, and the directory if necessary.
+func NewFileSaver(dir string) (*FileSaver, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileSaver{Dir: dir}, nil
+}
+
+// path returns the file path for the object.  Kinds such as "*job.Service"
+// are used as directory names, so they are escaped.
+func (fs *FileSaver) path(o StateObject) string {
+	return filepath.Join(fs.Dir, filepath.Base(o.GetKind()), filepath.Base(o.GetName())+".json")
+}
+
+// Save implements Saver.Save by writing the object to a file.
+func (fs *FileSaver) Save(ctx context.Context, o StateObject) error {
+	b, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	path := fs.path(o)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it, so that a crash never leaves a
+	// partially written file.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Delete implements Saver.Delete by removing the file.
+func (fs *FileSaver) Delete(ctx context.Context, o StateObject) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	err := os.Remove(fs.path(o))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Fetch implements Saver.Fetch by reading the file.  Like DatastoreSaver, it
+// returns datastore.ErrNoSuchEntity if the object has not been saved.
+func (fs *FileSaver) Fetch(ctx context.Context, o StateObject) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	b, err := ioutil.ReadFile(fs.path(o))
+	if os.IsNotExist(err) {
+		return datastore.ErrNoSuchEntity
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, o)
+}
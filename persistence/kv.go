@@ -0,0 +1,161 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Errors returned by KV stores.
+var (
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrConflict is returned by CompareAndSwap, and by KVSaver.Save, when
+	// the key was changed by another writer since it was last read.
+	ErrConflict = errors.New("concurrent update conflict")
+)
+
+// KV is a key value store with compare-and-swap, e.g. etcd.  Each write of
+// a key gives it a new, larger revision.
+type KV interface {
+	// Get returns the value and revision of the key, or ErrKeyNotFound.
+	Get(ctx context.Context, key string) ([]byte, int64, error)
+	// CompareAndSwap writes the value if the key's revision is still rev,
+	// where zero means that the key must not exist, and returns the new
+	// revision.  Otherwise it returns ErrConflict.
+	CompareAndSwap(ctx context.Context, key string, value []byte, rev int64) (int64, error)
+	// Delete deletes the key, if it exists.
+	Delete(ctx context.Context, key string) error
+}
+
+// KVSaver implements a Saver that stores each state object as JSON in a KV
+// store, under Prefix/Namespace/Kind/Name.  Saves compare-and-swap against
+// the revision this saver last read or wrote, so an object changed by
+// another instance, e.g. a second manager in the same namespace, is not
+// overwritten.  Such saves return ErrConflict, and the object must be
+// fetched again before it can be saved.  An object that has not been
+// fetched can only be saved if it doesn't exist.
+type KVSaver struct {
+	KV        KV
+	Prefix    string
+	Namespace string
+
+	lock sync.Mutex
+	revs map[string]int64 // Last revision read or written, by key.
+}
+
+// NewKVSaver creates a KVSaver for the namespace, with the "gardener" prefix.
+func NewKVSaver(kv KV, namespace string) *KVSaver {
+	return &KVSaver{KV: kv, Prefix: "gardener", Namespace: namespace, revs: make(map[string]int64)}
+}
+
+// key returns the KV key for the object.
+func (ks *KVSaver) key(o StateObject) string {
+	return path.Join("/", ks.Prefix, ks.Namespace, path.Base(o.GetKind()), path.Base(o.GetName()))
+}
+
+func (ks *KVSaver) rev(key string) int64 {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	return ks.revs[key]
+}
+
+func (ks *KVSaver) setRev(key string, rev int64) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	if ks.revs == nil {
+		ks.revs = make(map[string]int64)
+	}
+	ks.revs[key] = rev
+}
+
+// Save implements Saver.Save with a compare-and-swap.
+func (ks *KVSaver) Save(ctx context.Context, o StateObject) error {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	key := ks.key(o)
+	rev, err := ks.KV.CompareAndSwap(ctx, key, b, ks.rev(key))
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	ks.setRev(key, rev)
+	return nil
+}
+
+// Delete implements Saver.Delete.
+func (ks *KVSaver) Delete(ctx context.Context, o StateObject) error {
+	key := ks.key(o)
+	if err := ks.KV.Delete(ctx, key); err != nil {
+		return err
+	}
+	ks.setRev(key, 0)
+	return nil
+}
+
+// Fetch implements Saver.Fetch.  Like DatastoreSaver, it returns
+// datastore.ErrNoSuchEntity if the object has not been saved.
+func (ks *KVSaver) Fetch(ctx context.Context, o StateObject) error {
+	key := ks.key(o)
+	b, rev, err := ks.KV.Get(ctx, key)
+	if errors.Is(err, ErrKeyNotFound) {
+		ks.setRev(key, 0)
+		return datastore.ErrNoSuchEntity
+	}
+	if err != nil {
+		return err
+	}
+	ks.setRev(key, rev)
+	return json.Unmarshal(b, o)
+}
+
+// MemKV is an in memory KV, e.g. for tests.
+type MemKV struct {
+	lock   sync.Mutex
+	rev    int64
+	values map[string][]byte
+	revs   map[string]int64
+}
+
+// NewMemKV creates an empty MemKV.
+func NewMemKV() *MemKV {
+	return &MemKV{values: make(map[string][]byte), revs: make(map[string]int64)}
+}
+
+// Get implements KV.Get.
+func (m *MemKV) Get(ctx context.Context, key string) ([]byte, int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	v, ok := m.values[key]
+	if !ok {
+		return nil, 0, ErrKeyNotFound
+	}
+	return append([]byte(nil), v...), m.revs[key], nil
+}
+
+// CompareAndSwap implements KV.CompareAndSwap.
+func (m *MemKV) CompareAndSwap(ctx context.Context, key string, value []byte, rev int64) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.revs[key] != rev {
+		return 0, ErrConflict
+	}
+	m.rev++
+	m.values[key] = append([]byte(nil), value...)
+	m.revs[key] = m.rev
+	return m.rev, nil
+}
+
+// Delete implements KV.Delete.
+func (m *MemKV) Delete(ctx context.Context, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.values, key)
+	delete(m.revs, key)
+	return nil
+}
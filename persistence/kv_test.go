@@ -0,0 +1,203 @@
+package persistence_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/persistence"
+)
+
+// testKV checks the compare-and-swap semantics of a KV backend.
+func testKV(t *testing.T, kv persistence.KV) {
+	ctx := context.Background()
+	key := "/test/" + t.Name()
+	rtx.Must(kv.Delete(ctx, key), "Delete")
+	if _, _, err := kv.Get(ctx, key); !errors.Is(err, persistence.ErrKeyNotFound) {
+		t.Error("Expected ErrKeyNotFound", err)
+	}
+	rev, err := kv.CompareAndSwap(ctx, key, []byte("one"), 0)
+	rtx.Must(err, "Create")
+	if _, err := kv.CompareAndSwap(ctx, key, []byte("again"), 0); !errors.Is(err, persistence.ErrConflict) {
+		t.Error("Expected ErrConflict creating an existing key", err)
+	}
+	v, got, err := kv.Get(ctx, key)
+	rtx.Must(err, "Get")
+	if string(v) != "one" || got != rev {
+		t.Errorf("Get = %q, %d, want one, %d", v, got, rev)
+	}
+	next, err := kv.CompareAndSwap(ctx, key, []byte("two"), rev)
+	rtx.Must(err, "Swap")
+	if next <= rev {
+		t.Error("Revision should increase", rev, next)
+	}
+	if _, err := kv.CompareAndSwap(ctx, key, []byte("stale"), rev); !errors.Is(err, persistence.ErrConflict) {
+		t.Error("Expected ErrConflict with a stale revision", err)
+	}
+	rtx.Must(kv.Delete(ctx, key), "Delete")
+	if _, _, err := kv.Get(ctx, key); !errors.Is(err, persistence.ErrKeyNotFound) {
+		t.Error("Expected ErrKeyNotFound after Delete", err)
+	}
+}
+
+// testSaver checks the behavior shared by all Savers.
+func testSaver(t *testing.T, saver persistence.Saver) {
+	ctx := context.Background()
+	o := NewO1("shared")
+	rtx.Must(saver.Delete(ctx, &o), "Delete")
+	if err := saver.Fetch(ctx, &o); err != datastore.ErrNoSuchEntity {
+		t.Fatal("Expected ErrNoSuchEntity", err)
+	}
+	o.Integer = 1234
+	rtx.Must(saver.Save(ctx, &o), "Save")
+	o.Integer = 5678
+	rtx.Must(saver.Save(ctx, &o), "Save again")
+
+	fetched := NewO1("shared")
+	rtx.Must(saver.Fetch(ctx, &fetched), "Fetch")
+	if fetched.Integer != 5678 {
+		t.Error("Integer should be 5678", fetched)
+	}
+	rtx.Must(saver.Delete(ctx, &o), "Delete")
+	if err := saver.Fetch(ctx, &o); err != datastore.ErrNoSuchEntity {
+		t.Error("Expected ErrNoSuchEntity after Delete", err)
+	}
+}
+
+// testKVSaver checks that KVSavers sharing a KV don't overwrite each
+// other's changes.
+func testKVSaver(t *testing.T, kv persistence.KV) {
+	ctx := context.Background()
+	a := persistence.NewKVSaver(kv, "test")
+	b := persistence.NewKVSaver(kv, "test")
+	o := NewO1("contended")
+	rtx.Must(a.Delete(ctx, &o), "Delete")
+	if err := a.Fetch(ctx, &o); err != datastore.ErrNoSuchEntity {
+		t.Fatal("Expected ErrNoSuchEntity", err)
+	}
+	o.Integer = 1
+	rtx.Must(a.Save(ctx, &o), "Save a")
+	if err := b.Save(ctx, &o); !errors.Is(err, persistence.ErrConflict) {
+		t.Error("Expected ErrConflict saving an object that wasn't fetched", err)
+	}
+
+	rtx.Must(b.Fetch(ctx, &o), "Fetch b")
+	o.Integer = 2
+	rtx.Must(a.Save(ctx, &o), "Save a again")
+	o.Integer = 3
+	if err := b.Save(ctx, &o); !errors.Is(err, persistence.ErrConflict) {
+		t.Error("Expected ErrConflict saving a stale object", err)
+	}
+	rtx.Must(b.Fetch(ctx, &o), "Fetch b again")
+	if o.Integer != 2 {
+		t.Error("Integer should be 2", o)
+	}
+	o.Integer = 3
+	rtx.Must(b.Save(ctx, &o), "Save b")
+	rtx.Must(b.Delete(ctx, &o), "Delete")
+}
+
+// fakeEtcd serves the etcd JSON gateway requests used by EtcdKV, with a
+// MemKV.
+func fakeEtcd(kv *persistence.MemKV) http.Handler {
+	mux := http.NewServeMux()
+	reply := func(resp http.ResponseWriter, v interface{}) {
+		b, _ := json.Marshal(v)
+		resp.Write(b)
+	}
+	mux.HandleFunc("/v3/kv/range", func(resp http.ResponseWriter, req *http.Request) {
+		r := struct{ Key []byte }{}
+		b, _ := ioutil.ReadAll(req.Body)
+		rtx.Must(json.Unmarshal(b, &r), "range")
+		v, rev, err := kv.Get(req.Context(), string(r.Key))
+		if err != nil {
+			reply(resp, map[string]string{"count": "0"})
+			return
+		}
+		reply(resp, map[string]interface{}{"kvs": []map[string]interface{}{
+			{"key": r.Key, "value": v, "mod_revision": strconv.FormatInt(rev, 10)}}})
+	})
+	mux.HandleFunc("/v3/kv/txn", func(resp http.ResponseWriter, req *http.Request) {
+		r := struct {
+			Compare []struct {
+				Key         []byte
+				Target      string
+				Result      string
+				ModRevision string `json:"mod_revision"`
+			}
+			Success []struct {
+				RequestPut struct{ Key, Value []byte } `json:"request_put"`
+			}
+		}{}
+		b, _ := ioutil.ReadAll(req.Body)
+		rtx.Must(json.Unmarshal(b, &r), "txn")
+		if len(r.Compare) != 1 || r.Compare[0].Target != "MOD" || r.Compare[0].Result != "EQUAL" {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rev, _ := strconv.ParseInt(r.Compare[0].ModRevision, 10, 64)
+		put := r.Success[0].RequestPut
+		next, err := kv.CompareAndSwap(req.Context(), string(put.Key), put.Value, rev)
+		reply(resp, map[string]interface{}{"header": map[string]string{"revision": strconv.FormatInt(next, 10)},
+			"succeeded": err == nil})
+	})
+	mux.HandleFunc("/v3/kv/deleterange", func(resp http.ResponseWriter, req *http.Request) {
+		r := struct{ Key []byte }{}
+		b, _ := ioutil.ReadAll(req.Body)
+		rtx.Must(json.Unmarshal(b, &r), "deleterange")
+		rtx.Must(kv.Delete(req.Context(), string(r.Key)), "delete")
+		reply(resp, map[string]string{"deleted": "1"})
+	})
+	return mux
+}
+
+func newFakeEtcdKV(t *testing.T) *persistence.EtcdKV {
+	server := httptest.NewServer(fakeEtcd(persistence.NewMemKV()))
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	rtx.Must(err, "parse")
+	return persistence.NewEtcdKV(*u)
+}
+
+func TestKV(t *testing.T) {
+	t.Run("mem", func(t *testing.T) { testKV(t, persistence.NewMemKV()) })
+	t.Run("etcd", func(t *testing.T) { testKV(t, newFakeEtcdKV(t)) })
+}
+
+func TestSavers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saver")
+	rtx.Must(err, "TempDir")
+	defer os.RemoveAll(dir)
+	fs, err := persistence.NewFileSaver(dir)
+	rtx.Must(err, "NewFileSaver")
+
+	t.Run("file", func(t *testing.T) { testSaver(t, fs) })
+	t.Run("mem", func(t *testing.T) { testSaver(t, persistence.NewKVSaver(persistence.NewMemKV(), "test")) })
+	t.Run("etcd", func(t *testing.T) { testSaver(t, persistence.NewKVSaver(newFakeEtcdKV(t), "test")) })
+}
+
+func TestKVSaverConflict(t *testing.T) {
+	t.Run("mem", func(t *testing.T) { testKVSaver(t, persistence.NewMemKV()) })
+	t.Run("etcd", func(t *testing.T) { testKVSaver(t, newFakeEtcdKV(t)) })
+}
+
+func TestEtcdKVError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	rtx.Must(err, "parse")
+	kv := persistence.NewEtcdKV(*u)
+	if _, _, err := kv.Get(context.Background(), "/key"); !errors.Is(err, persistence.ErrEtcdRequestFailed) {
+		t.Error("Expected ErrEtcdRequestFailed", err)
+	}
+}
@@ -0,0 +1,118 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// DefaultNamespace is the namespace used for persisted objects unless
+// another is configured, e.g. for a sandbox or staging deployment.
+const DefaultNamespace = "gardener"
+
+// Errors associated with namespaces.
+var (
+	ErrInvalidNamespace = errors.New("invalid namespace")
+	ErrNamespaceLocked  = errors.New("namespace is locked by another instance")
+)
+
+// validNamespace matches the Datastore namespace syntax.  Empty namespaces
+// are valid in Datastore, but would share the default namespace.
+var validNamespace = regexp.MustCompile(`^[0-9A-Za-z._-]{1,100}$`)
+
+// ValidateNamespace returns ErrInvalidNamespace if ns can't be used as a
+// Datastore namespace, or a file saver directory.
+func ValidateNamespace(ns string) error {
+	if !validNamespace.MatchString(ns) || ns == "." || ns == ".." {
+		return fmt.Errorf("%w: %q", ErrInvalidNamespace, ns)
+	}
+	return nil
+}
+
+// NamespaceLock records the instance that owns a namespace.  The owner
+// must renew the lock before it expires, or another instance may take it.
+type NamespaceLock struct {
+	Base
+
+	Owner   string
+	Expires time.Time
+}
+
+// GetKind implements StateObject.GetKind
+func (l NamespaceLock) GetKind() string {
+	return reflect.TypeOf(l).String()
+}
+
+// Locker acquires and maintains the NamespaceLock for a Saver's namespace,
+// so that instances of different deployments don't overwrite each other's
+// state.  The lock is advisory, and is read and written without a
+// transaction, so it detects collisions, but does not prevent races
+// between instances starting at the same time.
+type Locker struct {
+	saver Saver
+	owner string
+	ttl   time.Duration
+}
+
+// NewLocker creates a Locker for the owner, e.g. the pod name.
+func NewLocker(saver Saver, owner string, ttl time.Duration) *Locker {
+	return &Locker{saver: saver, owner: owner, ttl: ttl}
+}
+
+func (l *Locker) lock(expires time.Time) *NamespaceLock {
+	return &NamespaceLock{Base: NewBase("singleton"), Owner: l.owner, Expires: expires}
+}
+
+// Acquire takes or renews the lock.  It returns ErrNamespaceLocked if
+// another owner holds an unexpired lock.
+func (l *Locker) Acquire(ctx context.Context) error {
+	current := l.lock(time.Time{})
+	err := l.saver.Fetch(ctx, current)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	now := time.Now()
+	if err == nil && current.Owner != l.owner && now.Before(current.Expires) {
+		return fmt.Errorf("%w: %s until %s", ErrNamespaceLocked, current.Owner,
+			current.Expires.Format(time.RFC3339))
+	}
+	return l.saver.Save(ctx, l.lock(now.Add(l.ttl)))
+}
+
+// RenewEvery renews the lock periodically until ctx is done.
+func (l *Locker) RenewEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Acquire(ctx); err != nil {
+				log.Println("Namespace lock renewal error:", err)
+			}
+		}
+	}
+}
+
+// Release expires the lock, if it is held by this owner, so that another
+// instance may start immediately.
+func (l *Locker) Release(ctx context.Context) error {
+	current := l.lock(time.Time{})
+	if err := l.saver.Fetch(ctx, current); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}
+	if current.Owner != l.owner {
+		return nil
+	}
+	return l.saver.Save(ctx, l.lock(time.Now()))
+}
@@ -0,0 +1,59 @@
+package persistence_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/persistence"
+)
+
+func TestValidateNamespace(t *testing.T) {
+	for _, ns := range []string{"gardener", "gardener-staging", "sandbox_1.2"} {
+		if err := persistence.ValidateNamespace(ns); err != nil {
+			t.Error(ns, err)
+		}
+	}
+	for _, ns := range []string{"", ".", "..", "a/b", "has space"} {
+		if err := persistence.ValidateNamespace(ns); !errors.Is(err, persistence.ErrInvalidNamespace) {
+			t.Error(ns, "expected ErrInvalidNamespace", err)
+		}
+	}
+}
+
+func TestLocker(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "locker")
+	rtx.Must(err, "TempDir")
+	defer os.RemoveAll(dir)
+	fs, err := persistence.NewFileSaver(dir)
+	rtx.Must(err, "NewFileSaver")
+
+	a := persistence.NewLocker(fs, "a", time.Minute)
+	b := persistence.NewLocker(fs, "b", time.Minute)
+	rtx.Must(a.Acquire(ctx), "Acquire")
+	// Renewal by the same owner succeeds.
+	rtx.Must(a.Acquire(ctx), "Renew")
+	if err := b.Acquire(ctx); !errors.Is(err, persistence.ErrNamespaceLocked) {
+		t.Error("Expected ErrNamespaceLocked", err)
+	}
+	// Only the owner can release the lock.
+	rtx.Must(b.Release(ctx), "Release")
+	if err := b.Acquire(ctx); !errors.Is(err, persistence.ErrNamespaceLocked) {
+		t.Error("Expected ErrNamespaceLocked", err)
+	}
+	rtx.Must(a.Release(ctx), "Release")
+	rtx.Must(b.Acquire(ctx), "Acquire after release")
+
+	// Expired locks may be taken.
+	c := persistence.NewLocker(fs, "c", -time.Second)
+	d := persistence.NewLocker(fs, "d", time.Minute)
+	rtx.Must(b.Release(ctx), "Release")
+	rtx.Must(c.Acquire(ctx), "Acquire")
+	rtx.Must(d.Acquire(ctx), "Acquire expired")
+}
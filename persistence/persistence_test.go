@@ -3,7 +3,9 @@ package persistence_test
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
 	"reflect"
 	"testing"
 	"time"
@@ -114,3 +116,32 @@ func TestFetchAll(t *testing.T) {
 	err = ds.Client.DeleteMulti(ctx, keys)
 	rtx.Must(err, "Delete error")
 }
+
+func TestFileSaver(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "saver")
+	rtx.Must(err, "TempDir")
+	defer os.RemoveAll(dir)
+	fs, err := persistence.NewFileSaver(dir)
+	rtx.Must(err, "NewFileSaver")
+
+	o := NewO1("foobar")
+	err = fs.Fetch(ctx, &o)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatal("Should have errored", err)
+	}
+	o.Integer = 1234
+	rtx.Must(fs.Save(ctx, &o), "Save error")
+
+	o.Integer = 0
+	rtx.Must(fs.Fetch(ctx, &o), "Fetch error")
+	if o.Integer != 1234 {
+		t.Error("Integer should be 1234", o)
+	}
+
+	rtx.Must(fs.Delete(ctx, &o), "Delete error")
+	err = fs.Fetch(ctx, &o)
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatal("Should have errored", err)
+	}
+}
@@ -0,0 +1,295 @@
+// Package queue provides a persistent job queue, stored in Datastore, with
+// transactional claim and update operations.  It allows several gardener
+// instances to share the pending jobs, and allows jobs to survive restarts
+// without relying on the tracker snapshot.
+//
+// Each job is a separate entity, keyed by the job path.  An instance must
+// claim a job before acting on it, and renew the claim while it acts.  Claims
+// expire after the lease duration, so that jobs claimed by a terminated
+// instance are eventually picked up by another instance.
+package queue
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Errors returned by the queue.
+var (
+	ErrClaimed     = errors.New("job is claimed by another instance")
+	ErrNotClaimed  = errors.New("job is not claimed by this instance")
+	ErrJobNotFound = errors.New("job not in queue")
+)
+
+// Kind is the Datastore kind for queue entries.
+const Kind = "QueueEntry"
+
+// Entry is the persistent record for a single job.
+type Entry struct {
+	Bucket     string
+	Experiment string
+	Datatype   string
+	Date       time.Time
+	Prefix     string // Empty for whole-day jobs.
+	Filter     string `datastore:",noindex"`
+
+	State        string
+	Detail       string `datastore:",noindex"`
+	Updated      time.Time
+	ClaimedBy    string
+	ClaimExpires time.Time
+}
+
+// Job returns the tracker.Job for the entry.
+func (e *Entry) Job() tracker.Job {
+	j := tracker.NewJob(e.Bucket, e.Experiment, e.Datatype, e.Date)
+	j.Prefix = e.Prefix
+	j.Filter = e.Filter
+	return j
+}
+
+// isClaimedByOther returns true if another owner holds an unexpired claim.
+func (e *Entry) isClaimedByOther(owner string, now time.Time) bool {
+	return e.ClaimedBy != "" && e.ClaimedBy != owner && now.Before(e.ClaimExpires)
+}
+
+// Queue is a Datastore backed job queue.
+type Queue struct {
+	client    dsiface.Client
+	namespace string
+	owner     string        // Identifies this instance in claims.
+	lease     time.Duration // Duration of each claim.
+}
+
+// NewQueue creates a Queue.  The owner should be unique for each gardener
+// instance, e.g. the pod name.
+func NewQueue(client dsiface.Client, namespace, owner string, lease time.Duration) *Queue {
+	return &Queue{client: client, namespace: namespace, owner: owner, lease: lease}
+}
+
+// Lease returns the duration of each claim.
+func (q *Queue) Lease() time.Duration {
+	return q.lease
+}
+
+// key returns the entity key for the job.  The path includes any prefix, and
+// any filter is appended, so that jobs for parts of a day don't collide.
+func (q *Queue) key(j tracker.Job) *datastore.Key {
+	name := j.Path()
+	if j.Filter != "" {
+		name += "?" + url.Values{"filter": {j.Filter}}.Encode()
+	}
+	k := datastore.NameKey(Kind, name, nil)
+	k.Namespace = q.namespace
+	return k
+}
+
+// update runs f on the entry for j within a transaction, and saves the
+// result.  If f returns an error, the transaction is rolled back.
+func (q *Queue) update(ctx context.Context, j tracker.Job, f func(e *Entry, now time.Time) error) error {
+	_, err := q.client.RunInTransaction(ctx, func(tx dsiface.Transaction) error {
+		var e Entry
+		if err := tx.Get(q.key(j), &e); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return ErrJobNotFound
+			}
+			return err
+		}
+		now := time.Now()
+		if err := f(&e, now); err != nil {
+			return err
+		}
+		_, err := tx.Put(q.key(j), &e)
+		return err
+	})
+	return err
+}
+
+// Add adds a job in the Init state.  It returns tracker.ErrJobAlreadyExists
+// if the job is already queued, unless it previously failed.
+func (q *Queue) Add(ctx context.Context, j tracker.Job) error {
+	_, err := q.client.RunInTransaction(ctx, func(tx dsiface.Transaction) error {
+		var e Entry
+		err := tx.Get(q.key(j), &e)
+		if err == nil && e.State != string(tracker.Failed) {
+			return tracker.ErrJobAlreadyExists
+		}
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		e = Entry{Bucket: j.Bucket, Experiment: j.Experiment, Datatype: j.Datatype, Date: j.Date,
+			Prefix: j.Prefix, Filter: j.Filter, State: string(tracker.Init), Updated: time.Now()}
+		_, err = tx.Put(q.key(j), &e)
+		return err
+	})
+	return err
+}
+
+// Claim claims the job for this instance, or renews an existing claim.
+// It returns ErrClaimed if another instance holds an unexpired claim.
+func (q *Queue) Claim(ctx context.Context, j tracker.Job) error {
+	return q.update(ctx, j, func(e *Entry, now time.Time) error {
+		if e.isClaimedByOther(q.owner, now) {
+			return ErrClaimed
+		}
+		e.ClaimedBy = q.owner
+		e.ClaimExpires = now.Add(q.lease)
+		return nil
+	})
+}
+
+// Release releases this instance's claim on the job.
+func (q *Queue) Release(ctx context.Context, j tracker.Job) error {
+	return q.update(ctx, j, func(e *Entry, now time.Time) error {
+		if e.ClaimedBy != q.owner {
+			return ErrNotClaimed
+		}
+		e.ClaimedBy = ""
+		e.ClaimExpires = time.Time{}
+		return nil
+	})
+}
+
+// Update records a new state for the job.  It returns ErrClaimed if another
+// instance holds an unexpired claim.
+func (q *Queue) Update(ctx context.Context, j tracker.Job, state tracker.State, detail string) error {
+	return q.update(ctx, j, func(e *Entry, now time.Time) error {
+		if e.isClaimedByOther(q.owner, now) {
+			return ErrClaimed
+		}
+		e.State = string(state)
+		e.Detail = detail
+		e.Updated = now
+		return nil
+	})
+}
+
+// Complete removes the job from the queue.  It returns ErrClaimed if another
+// instance holds an unexpired claim.
+func (q *Queue) Complete(ctx context.Context, j tracker.Job) error {
+	_, err := q.client.RunInTransaction(ctx, func(tx dsiface.Transaction) error {
+		var e Entry
+		if err := tx.Get(q.key(j), &e); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+		if e.isClaimedByOther(q.owner, time.Now()) {
+			return ErrClaimed
+		}
+		return tx.Delete(q.key(j))
+	})
+	return err
+}
+
+// maxParserUpdates is the number of parser updates that may be waiting to be
+// written to the queue.
+const maxParserUpdates = 1000
+
+// ParserUpdates returns a tracker.Observer that records parser transitions,
+// i.e. to Parsing and ParseComplete, which don't pass through the Monitor,
+// so that Restore on other instances sees the job's current state.  Updates
+// are written in order, on another goroutine, until ctx is done, and are
+// dropped if too many are waiting.
+func (q *Queue) ParserUpdates(ctx context.Context) func(j tracker.Job, s tracker.Status) {
+	type update struct {
+		job   tracker.Job
+		state tracker.State
+	}
+	updates := make(chan update, maxParserUpdates)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case u := <-updates:
+				if err := q.Update(ctx, u.job, u.state, ""); err != nil && err != ErrJobNotFound {
+					log.Println("Queue parser update error:", u.job, u.state, err)
+				}
+			}
+		}
+	}()
+	return func(j tracker.Job, s tracker.Status) {
+		switch state := s.State(); state {
+		case tracker.Parsing, tracker.ParseComplete:
+			select {
+			case updates <- update{j, state}:
+			default:
+				log.Println("Queue parser update dropped:", j, state)
+			}
+		}
+	}
+}
+
+// Get returns the entry for the job.
+func (q *Queue) Get(ctx context.Context, j tracker.Job) (Entry, error) {
+	var e Entry
+	err := q.client.Get(ctx, q.key(j), &e)
+	if err == datastore.ErrNoSuchEntity {
+		return e, ErrJobNotFound
+	}
+	return e, err
+}
+
+// Pending returns all the jobs in the queue.
+func (q *Queue) Pending(ctx context.Context) ([]Entry, error) {
+	var entries []Entry
+	_, err := q.client.GetAll(ctx, datastore.NewQuery(Kind).Namespace(q.namespace), &entries)
+	return entries, err
+}
+
+// Restore adds pending jobs that are missing from the tracker, in their
+// queued state.  It is used at startup, and periodically to pick up jobs
+// added by other instances.  The tracker remains a per-instance cache, and
+// the queue is the source of truth for which jobs are pending.
+func (q *Queue) Restore(ctx context.Context, tk *tracker.Tracker) (int, error) {
+	entries, err := q.Pending(ctx)
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	for i := range entries {
+		e := &entries[i]
+		j := e.Job()
+		if _, err := tk.GetStatus(j); err != tracker.ErrJobNotFound {
+			continue
+		}
+		if err := tk.AddJob(j); err != nil {
+			continue
+		}
+		if tracker.State(e.State) != tracker.Init {
+			if err := tk.SetStatus(j, tracker.State(e.State), e.Detail); err != nil {
+				return added, err
+			}
+		}
+		added++
+	}
+	return added, nil
+}
+
+// RestoreEvery calls Restore periodically, until ctx is done.
+func (q *Queue) RestoreEvery(ctx context.Context, tk *tracker.Tracker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := q.Restore(ctx, tk); err != nil {
+				log.Println("Queue restore error:", err)
+			} else if n > 0 {
+				log.Println("Restored", n, "jobs from queue")
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package queue_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
+
+	"github.com/m-lab/etl-gardener/queue"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeClient stores queue entries in memory.  Transactions are serialized,
+// and only applied if the transaction function succeeds.
+type fakeClient struct {
+	dsiface.Client
+	lock    sync.Mutex
+	entries map[string]queue.Entry
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{entries: make(map[string]queue.Entry)}
+}
+
+func (c *fakeClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key.Name]
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	*dst.(*queue.Entry) = e
+	return nil
+}
+
+func (c *fakeClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entries := dst.(*[]queue.Entry)
+	for _, e := range c.entries {
+		*entries = append(*entries, e)
+	}
+	return nil, nil
+}
+
+func (c *fakeClient) RunInTransaction(ctx context.Context, f func(tx dsiface.Transaction) error, opts ...datastore.TransactionOption) (dsiface.Commit, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tx := &fakeTx{entries: make(map[string]queue.Entry, len(c.entries))}
+	for k, v := range c.entries {
+		tx.entries[k] = v
+	}
+	if err := f(tx); err != nil {
+		return nil, err
+	}
+	c.entries = tx.entries
+	return nil, nil
+}
+
+type fakeTx struct {
+	dsiface.Transaction
+	entries map[string]queue.Entry
+}
+
+func (tx *fakeTx) Get(key *datastore.Key, dst interface{}) error {
+	e, ok := tx.entries[key.Name]
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	*dst.(*queue.Entry) = e
+	return nil
+}
+
+func (tx *fakeTx) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	tx.entries[key.Name] = *src.(*queue.Entry)
+	return nil, nil
+}
+
+func (tx *fakeTx) Delete(key *datastore.Key) error {
+	delete(tx.entries, key.Name)
+	return nil
+}
+
+func TestClaim(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeClient()
+	a := queue.NewQueue(client, "test", "a", time.Hour)
+	b := queue.NewQueue(client, "test", "b", time.Hour)
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2019, 01, 02, 0, 0, 0, 0, time.UTC))
+
+	if err := a.Claim(ctx, job); err != queue.ErrJobNotFound {
+		t.Error("Expected ErrJobNotFound", err)
+	}
+	must(t, a.Add(ctx, job))
+	if err := b.Add(ctx, job); err != tracker.ErrJobAlreadyExists {
+		t.Error("Expected ErrJobAlreadyExists", err)
+	}
+
+	must(t, a.Claim(ctx, job))
+	if err := b.Claim(ctx, job); err != queue.ErrClaimed {
+		t.Error("Expected ErrClaimed", err)
+	}
+	if err := b.Update(ctx, job, tracker.Parsing, ""); err != queue.ErrClaimed {
+		t.Error("Expected ErrClaimed", err)
+	}
+	if err := b.Complete(ctx, job); err != queue.ErrClaimed {
+		t.Error("Expected ErrClaimed", err)
+	}
+	must(t, a.Update(ctx, job, tracker.Parsing, "started"))
+
+	if err := b.Release(ctx, job); err != queue.ErrNotClaimed {
+		t.Error("Expected ErrNotClaimed", err)
+	}
+	must(t, a.Release(ctx, job))
+	must(t, b.Claim(ctx, job))
+
+	e, err := a.Get(ctx, job)
+	must(t, err)
+	if e.State != string(tracker.Parsing) || e.Detail != "started" || e.ClaimedBy != "b" {
+		t.Error("Wrong entry", e)
+	}
+
+	must(t, b.Complete(ctx, job))
+	if _, err := a.Get(ctx, job); err != queue.ErrJobNotFound {
+		t.Error("Expected ErrJobNotFound", err)
+	}
+	// The job may be added again once it is complete.
+	must(t, a.Add(ctx, job))
+}
+
+func TestClaimExpires(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeClient()
+	a := queue.NewQueue(client, "test", "a", time.Millisecond)
+	b := queue.NewQueue(client, "test", "b", time.Hour)
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2019, 01, 02, 0, 0, 0, 0, time.UTC))
+
+	must(t, a.Add(ctx, job))
+	must(t, a.Claim(ctx, job))
+	time.Sleep(10 * time.Millisecond)
+	// The claim held by a has expired.
+	must(t, b.Claim(ctx, job))
+	if err := a.Claim(ctx, job); err != queue.ErrClaimed {
+		t.Error("Expected ErrClaimed", err)
+	}
+}
+
+func TestParserUpdates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := queue.NewQueue(newFakeClient(), "test", "a", time.Hour)
+	job := tracker.NewJob("bucket", "exp", "type", time.Date(2019, 01, 02, 0, 0, 0, 0, time.UTC))
+	must(t, q.Add(ctx, job))
+
+	observe := q.ParserUpdates(ctx)
+	for _, state := range []tracker.State{tracker.Parsing, tracker.ParseComplete, tracker.Loading} {
+		s := tracker.NewStatus()
+		s.NewState(state)
+		observe(job, s)
+	}
+	// Unqueued jobs are ignored.
+	s := tracker.NewStatus()
+	s.NewState(tracker.Parsing)
+	observe(tracker.NewJob("bucket", "exp", "other", job.Date), s)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		e, err := q.Get(ctx, job)
+		must(t, err)
+		if e.State == string(tracker.ParseComplete) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected ParseComplete", e.State)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeClient()
+	q := queue.NewQueue(client, "test", "a", time.Hour)
+	d := time.Date(2019, 01, 02, 0, 0, 0, 0, time.UTC)
+	j1 := tracker.NewJob("bucket", "exp", "type", d)
+	j2 := tracker.NewJob("bucket", "exp", "type", d.AddDate(0, 0, 1))
+	must(t, q.Add(ctx, j1))
+	must(t, q.Add(ctx, j2))
+	must(t, q.Update(ctx, j2, tracker.Loading, "loading"))
+
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	must(t, err)
+	must(t, tk.AddJob(j1))
+
+	n, err := q.Restore(ctx, tk)
+	must(t, err)
+	if n != 1 {
+		t.Error("Expected one restored job, got", n)
+	}
+	s, err := tk.GetStatus(j2)
+	must(t, err)
+	if s.State() != tracker.Loading {
+		t.Error("Wrong state", s)
+	}
+}
+
+func TestRestorePrefixJobs(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeClient()
+	q := queue.NewQueue(client, "test", "a", time.Hour)
+	d := time.Date(2019, 01, 02, 0, 0, 0, 0, time.UTC)
+	// Tracked jobs for parts of a day may not overlap whole-day jobs.
+	day := tracker.NewJob("bucket", "exp", "type", d.AddDate(0, 0, 2))
+	prefix := tracker.NewJob("bucket", "exp", "type", d)
+	prefix.Prefix = "20190102T15"
+	filtered := tracker.NewJob("bucket", "exp", "type", d.AddDate(0, 0, 1))
+	filtered.Filter = "parser.ArchiveURL LIKE '%mlab1%'"
+	for _, j := range []tracker.Job{day, prefix, filtered} {
+		must(t, q.Add(ctx, j))
+	}
+	must(t, q.Update(ctx, prefix, tracker.Loading, "loading"))
+
+	e, err := q.Get(ctx, prefix)
+	must(t, err)
+	if e.Job() != prefix {
+		t.Error("Wrong job", e.Job())
+	}
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	must(t, err)
+	n, err := q.Restore(ctx, tk)
+	must(t, err)
+	if n != 3 {
+		t.Error("Expected three restored jobs, got", n)
+	}
+	if s, err := tk.GetStatus(prefix); err != nil || s.State() != tracker.Loading {
+		t.Error("Wrong prefix job status", s.State(), err)
+	}
+	for _, j := range []tracker.Job{day, filtered} {
+		if s, err := tk.GetStatus(j); err != nil || s.State() != tracker.Init {
+			t.Error("Wrong job status", j, s.State(), err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Package reconcile detects dates that are archived in GCS, but have no
+// rows in the raw_ tables and no job in the tracker, e.g. because a job was
+// lost, or failed and was cleaned up.  Missing dates are requeued
+// automatically, or listed for operator approval.
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/gcs"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Adder adds jobs, e.g. to a tracker.Tracker.
+type Adder interface {
+	AddJob(job tracker.Job) error
+}
+
+// Tracker provides the jobs currently tracked, e.g. a tracker.Tracker.
+type Tracker interface {
+	GetState() (tracker.JobMap, tracker.Job, time.Time)
+}
+
+// Reconciler compares the GCS archive with the raw_ tables.
+type Reconciler struct {
+	gcs     stiface.Client
+	bq      bqiface.Client
+	project string
+	naming  bq.Naming
+	tk      Tracker
+	adder   Adder
+	sources []config.SourceConfig
+
+	// AutoRequeue adds jobs for missing dates.  Otherwise they are only
+	// listed, and may be requeued through the admin API.
+	AutoRequeue bool
+	// MaxRequeue limits the jobs added by each Reconcile.  Zero means no limit.
+	MaxRequeue int
+	// Lag excludes recent dates, which may not have been processed yet.
+	Lag time.Duration
+	// Skipped, if set, returns jobs that should not be reported, e.g. the
+	// job service skip list.
+	Skipped func() []tracker.Job
+
+	lock    sync.Mutex
+	missing []tracker.Job // Missing dates that were not requeued.
+}
+
+// New creates a Reconciler for the sources, with a Lag of two days.
+func New(gcsClient stiface.Client, bqClient bqiface.Client, project string, naming bq.Naming,
+	tk Tracker, adder Adder, sources []config.SourceConfig) *Reconciler {
+	return &Reconciler{gcs: gcsClient, bq: bqClient, project: project,
+		naming: naming.WithDefaults(), tk: tk, adder: adder, sources: sources,
+		Lag: 48 * time.Hour}
+}
+
+// known returns the partitions of tracked and skipped jobs.
+func (r *Reconciler) known() map[tracker.Job]bool {
+	known := map[tracker.Job]bool{}
+	jobs, _, _ := r.tk.GetState()
+	for j := range jobs {
+		known[j.Partition()] = true
+	}
+	if r.Skipped != nil {
+		for _, j := range r.Skipped() {
+			known[j.Partition()] = true
+		}
+	}
+	return known
+}
+
+// Find returns jobs for the dates from start to end, inclusive, that are in
+// the source's GCS archive, but have no rows in the raw_ table, and are not
+// tracked or skipped.  Sources with a path template are not reconciled.
+func (r *Reconciler) Find(ctx context.Context, src config.SourceConfig, start, end time.Time) ([]tracker.Job, error) {
+	if src.PathTemplate != "" {
+		// Archive dates can only be listed in the standard layout.
+		return nil, nil
+	}
+	names, err := r.naming.Names(tracker.Job{Experiment: src.Experiment, Datatype: src.Datatype})
+	if err != nil {
+		return nil, err
+	}
+	dates, err := gcs.Dates(ctx, r.gcs, src.Bucket, src.Experiment, src.Datatype, start, end)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := bq.DailyCounts(ctx, r.bq, r.project, names, start, end)
+	if err != nil {
+		return nil, err
+	}
+	known := r.known()
+	missing := []tracker.Job{}
+	for _, d := range dates {
+		j := tracker.NewJob(src.Bucket, src.Experiment, src.Datatype, d)
+		j.Filter = src.Filter
+		if counts[d.Format("2006-01-02")] > 0 || known[j.Partition()] {
+			continue
+		}
+		missing = append(missing, j)
+	}
+	return missing, nil
+}
+
+// Reconcile finds the missing dates of all sources, from start until Lag
+// before now, and requeues them if AutoRequeue is set.  Returns the missing
+// jobs, including any that were requeued.
+func (r *Reconciler) Reconcile(ctx context.Context, start, now time.Time) ([]tracker.Job, error) {
+	end := now.Add(-r.Lag).UTC().Truncate(24 * time.Hour)
+	all := []tracker.Job{}
+	listed := []tracker.Job{}
+	requeued := 0
+	for _, src := range r.sources {
+		missing, err := r.Find(ctx, src, start, end)
+		if err != nil {
+			return nil, err
+		}
+		metrics.MissingDates.WithLabelValues(src.Experiment, src.Datatype).Set(float64(len(missing)))
+		all = append(all, missing...)
+		for _, j := range missing {
+			if !r.AutoRequeue || (r.MaxRequeue > 0 && requeued >= r.MaxRequeue) {
+				listed = append(listed, j)
+				continue
+			}
+			if err := r.adder.AddJob(j); err != nil {
+				log.Println("Requeue of missing date failed:", j, err)
+				listed = append(listed, j)
+				continue
+			}
+			log.Println("Requeued missing date", j)
+			metrics.MissingRequeued.WithLabelValues(j.Experiment, j.Datatype).Inc()
+			requeued++
+		}
+	}
+	r.lock.Lock()
+	r.missing = listed
+	r.lock.Unlock()
+	return all, nil
+}
+
+// Missing returns the missing jobs found by the last Reconcile that were not
+// requeued.
+func (r *Reconciler) Missing() []tracker.Job {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	missing := make([]tracker.Job, len(r.missing))
+	copy(missing, r.missing)
+	return missing
+}
+
+// Handler serves the Missing jobs as JSON.
+func (r *Reconciler) Handler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := json.Marshal(r.Missing())
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
+
+// Run reconciles from start every interval, until ctx is done.
+func (r *Reconciler) Run(ctx context.Context, start time.Time, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.Reconcile(ctx, start, time.Now()); err != nil {
+			log.Println("Reconcile error:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package reconcile_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"google.golang.org/api/iterator"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/reconcile"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// fakeClient emulates delimited listing of a set of object names.
+type fakeClient struct {
+	stiface.Client
+	names []string
+}
+
+func (f *fakeClient) Bucket(name string) stiface.BucketHandle {
+	return &fakeBucketHandle{names: f.names}
+}
+
+type fakeBucketHandle struct {
+	stiface.BucketHandle
+	names []string
+}
+
+func (bh *fakeBucketHandle) Objects(ctx context.Context, q *storage.Query) stiface.ObjectIterator {
+	objects := []*storage.ObjectAttrs{}
+	seen := map[string]bool{}
+	for _, name := range bh.names {
+		if !strings.HasPrefix(name, q.Prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, q.Prefix)
+		if i := strings.Index(rest, q.Delimiter); i >= 0 {
+			p := q.Prefix + rest[:i+1]
+			if !seen[p] {
+				seen[p] = true
+				objects = append(objects, &storage.ObjectAttrs{Prefix: p})
+			}
+			continue
+		}
+		objects = append(objects, &storage.ObjectAttrs{Name: name})
+	}
+	return &fakeObjectIterator{objects: objects}
+}
+
+type fakeObjectIterator struct {
+	stiface.ObjectIterator
+	objects []*storage.ObjectAttrs
+}
+
+func (it *fakeObjectIterator) Next() (*storage.ObjectAttrs, error) {
+	if len(it.objects) == 0 {
+		return nil, iterator.Done
+	}
+	o := it.objects[0]
+	it.objects = it.objects[1:]
+	return o, nil
+}
+
+func date(day int) time.Time {
+	return time.Date(2020, 6, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	gcsClient := &fakeClient{names: []string{
+		"ndt/ndt7/2020/06/01/a.tgz",
+		"ndt/ndt7/2020/06/02/a.tgz",
+		"ndt/ndt7/2020/06/03/a.tgz",
+		"ndt/ndt7/2020/06/04/a.tgz",
+		"ndt/ndt7/2020/06/05/a.tgz",
+		"ndt/ndt7/2020/06/09/a.tgz", // Within the lag.
+	}}
+	bqClient := bqfake.NewClient("proj")
+	bqClient.AddResult("Count the rows in each raw partition", bqfake.Result{Rows: []interface{}{
+		bq.DailyCount{Date: "2020-06-01", Rows: 100},
+		bq.DailyCount{Date: "2020-06-05", Rows: 0},
+	}})
+
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	rtx.Must(tk.AddJob(tracker.NewJob("bucket", "ndt", "ndt7", date(2))), "add")
+
+	sources := []config.SourceConfig{{Bucket: "bucket", Experiment: "ndt", Datatype: "ndt7"}}
+	r := reconcile.New(gcsClient, bqClient, "proj", bq.Naming{}, tk, tk, sources)
+	r.Skipped = func() []tracker.Job {
+		return []tracker.Job{tracker.NewJob("other", "ndt", "ndt7", date(3))}
+	}
+
+	// Without AutoRequeue, the missing dates are only listed.
+	missing, err := r.Reconcile(ctx, date(1), date(10))
+	rtx.Must(err, "Reconcile")
+	if len(missing) != 2 || !missing[0].Date.Equal(date(4)) || !missing[1].Date.Equal(date(5)) {
+		t.Fatal("Wrong missing dates", missing)
+	}
+	if len(r.Missing()) != 2 {
+		t.Error("Missing dates should be listed", r.Missing())
+	}
+	if jobs, _, _ := tk.GetState(); len(jobs) != 1 {
+		t.Error("Jobs should not be added", jobs)
+	}
+
+	resp := httptest.NewRecorder()
+	r.Handler(resp, httptest.NewRequest(http.MethodGet, "/missing.json", nil))
+	listed := []tracker.Job{}
+	rtx.Must(json.Unmarshal(resp.Body.Bytes(), &listed), "unmarshal")
+	if len(listed) != 2 || listed[0] != missing[0] {
+		t.Error("Wrong listing", resp.Body.String())
+	}
+
+	// With AutoRequeue, MaxRequeue jobs are added, and the rest are listed.
+	r.AutoRequeue = true
+	r.MaxRequeue = 1
+	_, err = r.Reconcile(ctx, date(1), date(10))
+	rtx.Must(err, "Reconcile")
+	if _, err := tk.GetStatus(missing[0]); err != nil {
+		t.Error("Missing date should be requeued", err)
+	}
+	if m := r.Missing(); len(m) != 1 || m[0] != missing[1] {
+		t.Error("Remaining date should be listed", m)
+	}
+
+	// Requeued dates are tracked, so they are no longer missing.
+	missing, err = r.Reconcile(ctx, date(1), date(10))
+	rtx.Must(err, "Reconcile")
+	if len(missing) != 1 || len(r.Missing()) != 0 {
+		t.Error("Wrong missing dates", missing, r.Missing())
+	}
+}
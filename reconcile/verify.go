@@ -0,0 +1,259 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Discrepancy kinds.
+const (
+	PartitionMissing = "missing"  // The raw partition has no rows.
+	CountMismatch    = "mismatch" // The raw rows differ from the parsed rows.
+)
+
+// RepairKey is the annotation of repair jobs, which describes the
+// discrepancy that they repair.
+const RepairKey = "repair"
+
+// Annotator annotates jobs, e.g. a tracker.Tracker.
+type Annotator interface {
+	Annotate(job tracker.Job, annotations map[string]string) error
+}
+
+// A Discrepancy is a completed job whose raw partition no longer matches
+// the job, e.g. because the partition was deleted by hand.
+type Discrepancy struct {
+	Job      tracker.Job
+	Kind     string // PartitionMissing or CountMismatch.
+	Want     int64  // Rows parsed by the job, or zero if unknown.
+	Got      int64  // Rows in the raw partition.
+	Checked  time.Time
+	Repaired bool // A repair job was added.
+}
+
+func (d Discrepancy) String() string {
+	return fmt.Sprintf("raw partition %s: %d rows, expected %d", d.Kind, d.Got, d.Want)
+}
+
+// completion is a completed job, and the rows it parsed, if known.
+type completion struct {
+	job  tracker.Job
+	rows int64
+}
+
+// Verifier spot checks the raw partitions of completed jobs, which are
+// recorded by Observe.  Completions are only held in memory, so jobs that
+// completed before the manager started are not checked.
+type Verifier struct {
+	bq      bqiface.Client
+	project string
+	naming  bq.Naming
+	adder   Adder
+
+	// Sample is the number of completed jobs checked by each Verify.
+	Sample int
+	// Threshold is the fractional difference allowed between the parsed
+	// and raw rows, e.g. the validation threshold.
+	Threshold float64
+	// Repair adds a job for each discrepancy.  Otherwise they are only
+	// listed, and may be requeued through the admin API.
+	Repair bool
+	// Annotator, if set, annotates repair jobs with the RepairKey.
+	Annotator Annotator
+	// MaxJobs limits the completions held.  The oldest are dropped.
+	MaxJobs int
+
+	lock          sync.Mutex
+	completed     []completion // Oldest first.
+	discrepancies []Discrepancy
+	rand          *rand.Rand
+}
+
+// NewVerifier creates a Verifier that checks 10 completed jobs at a time, of
+// the last 10000 to complete.
+func NewVerifier(bqClient bqiface.Client, project string, naming bq.Naming, adder Adder) *Verifier {
+	return &Verifier{bq: bqClient, project: project, naming: naming.WithDefaults(), adder: adder,
+		Sample: 10, MaxJobs: 10000, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Observe records each daily job that completes.  It is a tracker.Observer.
+// Partial jobs are not recorded, since the raw counts are per date.
+func (v *Verifier) Observe(j tracker.Job, s tracker.Status) {
+	if s.State() != tracker.Complete || j.Prefix != "" {
+		return
+	}
+	c := completion{job: j}
+	if s.ParseStats != nil {
+		c.rows = s.ParseStats.Rows
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for i := range v.completed {
+		if v.completed[i].job.Partition() == j.Partition() {
+			v.completed = append(v.completed[:i], v.completed[i+1:]...)
+			break
+		}
+	}
+	v.completed = append(v.completed, c)
+	if v.MaxJobs > 0 && len(v.completed) > v.MaxJobs {
+		v.completed = v.completed[len(v.completed)-v.MaxJobs:]
+	}
+}
+
+// sample returns up to Sample of the completions, chosen at random.
+func (v *Verifier) sample() []completion {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	n := v.Sample
+	if n <= 0 || n > len(v.completed) {
+		n = len(v.completed)
+	}
+	sample := make([]completion, 0, n)
+	for _, i := range v.rand.Perm(len(v.completed))[:n] {
+		sample = append(sample, v.completed[i])
+	}
+	return sample
+}
+
+// forget removes the job from the completions, e.g. once it is repaired.
+func (v *Verifier) forget(j tracker.Job) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for i := range v.completed {
+		if v.completed[i].job.Partition() == j.Partition() {
+			v.completed = append(v.completed[:i], v.completed[i+1:]...)
+			return
+		}
+	}
+}
+
+// check counts the rows in the completion's raw partition, and returns a
+// Discrepancy if the partition is empty, or the rows differ from the parsed
+// rows by more than the Threshold.
+func (v *Verifier) check(ctx context.Context, c completion, now time.Time) (*Discrepancy, error) {
+	names, err := v.naming.Names(c.job)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := bq.DailyCounts(ctx, v.bq, v.project, names, c.job.Date, c.job.Date)
+	if err != nil {
+		return nil, err
+	}
+	d := Discrepancy{Job: c.job, Want: c.rows, Got: counts[c.job.Date.Format("2006-01-02")], Checked: now}
+	switch {
+	case d.Got == 0:
+		d.Kind = PartitionMissing
+	case d.Want > 0 && math.Abs(float64(d.Want-d.Got))/float64(d.Want) > v.Threshold:
+		d.Kind = CountMismatch
+	default:
+		return nil, nil
+	}
+	return &d, nil
+}
+
+// repair adds a job for the discrepancy, annotated with the RepairKey.
+func (v *Verifier) repair(d *Discrepancy) {
+	if err := v.adder.AddJob(d.Job); err != nil {
+		log.Println("Repair job failed:", d.Job, err)
+		return
+	}
+	d.Repaired = true
+	log.Println("Added repair job", d.Job, d)
+	metrics.RepairJobs.WithLabelValues(d.Job.Experiment, d.Job.Datatype).Inc()
+	v.forget(d.Job)
+	if v.Annotator != nil {
+		if err := v.Annotator.Annotate(d.Job, map[string]string{RepairKey: d.String()}); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Verify checks a sample of the completed jobs, and repairs any
+// discrepancies if Repair is set.  Returns the discrepancies found.  Those
+// that were not repaired stay listed by Discrepancies until the job is
+// checked again.
+func (v *Verifier) Verify(ctx context.Context, now time.Time) []Discrepancy {
+	found := []Discrepancy{}
+	checked := map[tracker.Job]bool{}
+	for _, c := range v.sample() {
+		checked[c.job.Partition()] = true
+		d, err := v.check(ctx, c, now)
+		switch {
+		case err != nil:
+			log.Println("Verify error:", c.job, err)
+			metrics.VerifiedPartitions.WithLabelValues(c.job.Experiment, c.job.Datatype, "error").Inc()
+			continue
+		case d == nil:
+			metrics.VerifiedPartitions.WithLabelValues(c.job.Experiment, c.job.Datatype, "ok").Inc()
+			continue
+		}
+		log.Println("Completed job", c.job, d)
+		metrics.VerifiedPartitions.WithLabelValues(c.job.Experiment, c.job.Datatype, d.Kind).Inc()
+		if v.Repair {
+			v.repair(d)
+		}
+		found = append(found, *d)
+	}
+	v.lock.Lock()
+	listed := []Discrepancy{}
+	for _, d := range v.discrepancies {
+		if !d.Repaired && !checked[d.Job.Partition()] {
+			listed = append(listed, d)
+		}
+	}
+	v.discrepancies = append(listed, found...)
+	v.lock.Unlock()
+	return found
+}
+
+// Discrepancies returns the discrepancies found by the last Verify, and
+// those found earlier that were not repaired or checked since.
+func (v *Verifier) Discrepancies() []Discrepancy {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	discrepancies := make([]Discrepancy, len(v.discrepancies))
+	copy(discrepancies, v.discrepancies)
+	return discrepancies
+}
+
+// Handler serves the Discrepancies as JSON.
+func (v *Verifier) Handler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := json.Marshal(v.Discrepancies())
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
+
+// Run verifies a sample every interval, until ctx is done.
+func (v *Verifier) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			v.Verify(ctx, time.Now())
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package reconcile_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/reconcile"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// complete adds the job to the tracker, and completes it with the parsed
+// rows.
+func complete(t *testing.T, tk *tracker.Tracker, j tracker.Job, rows int64) {
+	rtx.Must(tk.AddJob(j), "add")
+	rtx.Must(tk.SetParseStats(j, tracker.ParseStats{Files: 1, Rows: rows}), "stats")
+	rtx.Must(tk.SetStatus(j, tracker.Complete, ""), "complete")
+}
+
+func TestVerifier(t *testing.T) {
+	ctx := context.Background()
+	// Complete jobs are removed immediately, so repair jobs can be added.
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+
+	bqClient := bqfake.NewClient("proj")
+	for d, rows := range map[string]int64{"2020-06-01": 1000, "2020-06-02": 500} {
+		bqClient.AddResult(`WHERE date BETWEEN "`+d, bqfake.Result{Rows: []interface{}{
+			bq.DailyCount{Date: d, Rows: rows}}})
+	}
+	v := reconcile.NewVerifier(bqClient, "proj", bq.Naming{}, tk)
+	v.Sample = 0 // Check every completion.
+	v.Threshold = 0.02
+	v.Annotator = tk
+	tk.AddObserver(v.Observe)
+
+	ok := tracker.NewJob("bucket", "ndt", "ndt7", date(1))
+	changed := tracker.NewJob("bucket", "ndt", "ndt7", date(2))
+	deleted := tracker.NewJob("bucket", "ndt", "ndt7", date(3))
+	partial := tracker.NewJob("bucket", "ndt", "ndt7", date(4))
+	partial.Prefix = "20200604T15"
+	complete(t, tk, ok, 1010)
+	complete(t, tk, changed, 1000)
+	complete(t, tk, deleted, 1000)
+	complete(t, tk, partial, 1000)
+
+	// Without Repair, the discrepancies are only listed.
+	found := v.Verify(ctx, date(10))
+	if len(found) != 2 || len(v.Discrepancies()) != 2 {
+		t.Fatal("Expected 2 discrepancies", found)
+	}
+	kinds := map[tracker.Job]string{}
+	for _, d := range found {
+		kinds[d.Job] = d.Kind
+	}
+	if kinds[changed] != reconcile.CountMismatch || kinds[deleted] != reconcile.PartitionMissing {
+		t.Error("Wrong discrepancies", found)
+	}
+	if jobs, _, _ := tk.GetState(); len(jobs) != 0 {
+		t.Error("Jobs should not be added", jobs)
+	}
+
+	resp := httptest.NewRecorder()
+	v.Handler(resp, httptest.NewRequest(http.MethodGet, "/discrepancies.json", nil))
+	listed := []reconcile.Discrepancy{}
+	rtx.Must(json.Unmarshal(resp.Body.Bytes(), &listed), "unmarshal")
+	if len(listed) != 2 {
+		t.Error("Wrong listing", resp.Body.String())
+	}
+
+	// With Repair, a job is added for each discrepancy, and annotated.
+	v.Repair = true
+	found = v.Verify(ctx, date(10))
+	if len(found) != 2 || !found[0].Repaired || !found[1].Repaired {
+		t.Fatal("Expected 2 repaired discrepancies", found)
+	}
+	s, err := tk.GetStatus(deleted)
+	rtx.Must(err, "Repair job should be added")
+	if s.Annotations[reconcile.RepairKey] != "raw partition missing: 0 rows, expected 1000" {
+		t.Error("Wrong annotation", s.Annotations)
+	}
+	if _, err := tk.GetStatus(changed); err != nil {
+		t.Error("Repair job should be added", err)
+	}
+
+	// Repaired jobs are not checked again until they complete.
+	if found = v.Verify(ctx, date(10)); len(found) != 0 || len(v.Discrepancies()) != 0 {
+		t.Error("Expected no discrepancies", found, v.Discrepancies())
+	}
+}
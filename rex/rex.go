@@ -10,6 +10,7 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"math/rand"
@@ -39,6 +40,12 @@ func isTest() bool {
 type ReprocessingExecutor struct {
 	cloud.BQConfig
 	StorageClient stiface.Client
+	// SanityThresholds are used for the copy to the final dataset.  The zero
+	// value means bq.DefaultSanityThresholds.
+	SanityThresholds bq.SanityThresholds
+	// DetailCache, if not nil, is shared by the sanity checks, so that
+	// retried checks don't repeat the detail queries.
+	DetailCache *bq.TableDetailCache
 }
 
 // NewReprocessingExecutor creates a new exec.
@@ -48,18 +55,26 @@ func NewReprocessingExecutor(ctx context.Context, config cloud.BQConfig, bucketO
 	if err != nil {
 		return nil, err
 	}
-	return &ReprocessingExecutor{config, stiface.AdaptClient(storageClient)}, nil
+	return &ReprocessingExecutor{BQConfig: config, StorageClient: stiface.AdaptClient(storageClient)}, nil
 }
 
 // GetBatchDS constructs an appropriate Dataset for BQ operations.
 func (rex *ReprocessingExecutor) GetBatchDS(ctx context.Context) (dataset.Dataset, error) {
-	return dataset.NewDataset(ctx, rex.BQProject, rex.BQBatchDataset, rex.Options...)
+	return rex.locate(dataset.NewDataset(ctx, rex.BQProject, rex.BQBatchDataset, rex.Options...))
 }
 
 // GetFinalDS constructs an appropriate Dataset for BQ operations.
 func (rex *ReprocessingExecutor) GetFinalDS(ctx context.Context) (dataset.Dataset, error) {
 	// TODO - dataset should use the provided context.
-	return dataset.NewDataset(ctx, rex.BQProject, rex.BQFinalDataset, rex.Options...)
+	return rex.locate(dataset.NewDataset(ctx, rex.BQProject, rex.BQFinalDataset, rex.Options...))
+}
+
+// locate runs the dataset's jobs in the configured BigQuery location.
+func (rex *ReprocessingExecutor) locate(ds dataset.Dataset, err error) (dataset.Dataset, error) {
+	if err == nil && rex.BQLocation != "" && ds.BqClient != nil {
+		ds.BqClient.SetLocation(rex.BQLocation)
+	}
+	return ds, err
 }
 
 var (
@@ -413,11 +428,21 @@ func (rex *ReprocessingExecutor) finish(ctx context.Context, t *state.Task, term
 
 	srcAt := bq.NewAnnotatedTable(copy, &srcDs)
 	destAt := bq.NewAnnotatedTable(dest, &destDs)
+	if rex.DetailCache != nil {
+		srcAt.SetDetailCache(rex.DetailCache)
+		destAt.SetDetailCache(rex.DetailCache)
+	}
 
 	// Copy to Final Dataset tables.
-	err = bq.SanityCheckAndCopy(copyCtx, srcAt, destAt)
+	th := rex.SanityThresholds
+	if th == (bq.SanityThresholds{}) {
+		th = bq.DefaultSanityThresholds
+	}
+	diff, err := bq.SanityCheckAndCopyWithThresholds(copyCtx, srcAt, destAt, th)
 	if err != nil {
-		t.SetError(ctx, err, "SanityCheckAndCopy")
+		// The message is shown on the status page, so include the counts that
+		// were compared.
+		t.SetError(ctx, fmt.Errorf("%w (%v)", err, diff), "SanityCheckAndCopy")
 		return err
 	}
 
@@ -0,0 +1,190 @@
+// Package selftest probes the GCP permissions that the gardener needs, so
+// that a misconfigured service account fails at startup with a clear report,
+// rather than mid-pipeline hours later.
+package selftest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"google.golang.org/api/iterator"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// ErrProbeFailed is returned by Report.Err if any probe failed.
+var ErrProbeFailed = errors.New("permission probe failed")
+
+// Kind is the Datastore kind of the probe entity.
+const Kind = "selftest"
+
+// Result is the outcome of a single probe.
+type Result struct {
+	Name string // e.g. "bigquery create table in tmp_ndt"
+	Err  error
+}
+
+// Report holds the results of all probes, in the order they were run.
+type Report []Result
+
+// Failed returns the results of the probes that failed.
+func (r Report) Failed() []Result {
+	failed := []Result{}
+	for _, res := range r {
+		if res.Err != nil {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// Err returns an error wrapping ErrProbeFailed that names the failed probes,
+// or nil if all probes passed.
+func (r Report) Err() error {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(failed))
+	for _, res := range failed {
+		names = append(names, res.Name)
+	}
+	return fmt.Errorf("%w: %s", ErrProbeFailed, strings.Join(names, "; "))
+}
+
+// String returns one line per probe, e.g. "FAIL gcs list gs://archive-bucket: ...".
+func (r Report) String() string {
+	var b strings.Builder
+	for _, res := range r {
+		if res.Err != nil {
+			fmt.Fprintf(&b, "FAIL %s: %v\n", res.Name, res.Err)
+		} else {
+			fmt.Fprintf(&b, "ok   %s\n", res.Name)
+		}
+	}
+	return b.String()
+}
+
+// Prober runs the permission probes.
+type Prober struct {
+	gcs       stiface.Client
+	bq        bqiface.Client
+	ds        dsiface.Client // Optional.  If nil, Datastore is not probed.
+	namespace string
+	buckets   []string
+	datasets  []string
+}
+
+// New creates a Prober for the archive buckets, and the tmp and raw datasets,
+// of the sources.  The Datastore entity is written in namespace, and
+// dsClient may be nil if Datastore is not used, e.g. with -persistence_dir.
+func New(gcsClient stiface.Client, bqClient bqiface.Client, dsClient dsiface.Client,
+	namespace string, naming bq.Naming, sources []config.SourceConfig) (*Prober, error) {
+	p := &Prober{gcs: gcsClient, bq: bqClient, ds: dsClient, namespace: namespace}
+	naming = naming.WithDefaults()
+	seenBucket := map[string]bool{}
+	seenDataset := map[string]bool{}
+	for _, s := range sources {
+		if !seenBucket[s.Bucket] {
+			seenBucket[s.Bucket] = true
+			p.buckets = append(p.buckets, s.Bucket)
+		}
+		names, err := naming.Names(tracker.Job{Experiment: s.Experiment, Datatype: s.Datatype})
+		if err != nil {
+			return nil, err
+		}
+		for _, ds := range []string{names.TmpDataset, names.RawDataset} {
+			if !seenDataset[ds] {
+				seenDataset[ds] = true
+				p.datasets = append(p.datasets, ds)
+			}
+		}
+	}
+	return p, nil
+}
+
+// listBucket checks that the bucket's objects can be listed.
+func (p *Prober) listBucket(ctx context.Context, bucket string) error {
+	it := p.gcs.Bucket(bucket).Objects(ctx, &storage.Query{Delimiter: "/"})
+	_, err := it.Next()
+	if err == iterator.Done {
+		return nil
+	}
+	return err
+}
+
+// query checks that query jobs can be run in the client's project.
+func (p *Prober) query(ctx context.Context) error {
+	it, err := p.bq.Query("SELECT 1 AS probe").Read(ctx)
+	if err != nil {
+		return err
+	}
+	var row []bigquery.Value
+	err = it.Next(&row)
+	if err == iterator.Done {
+		return nil
+	}
+	return err
+}
+
+// createTable checks that tables can be created and deleted in the dataset.
+// The probe table expires after an hour, in case the delete fails.
+func (p *Prober) createTable(ctx context.Context, dataset, table string) error {
+	t := p.bq.Dataset(dataset).Table(table)
+	meta := &bigquery.TableMetadata{
+		Schema:         bigquery.Schema{{Name: "probe", Type: bigquery.StringFieldType}},
+		ExpirationTime: time.Now().Add(time.Hour),
+	}
+	if err := t.Create(ctx, meta); err != nil {
+		return err
+	}
+	return t.Delete(ctx)
+}
+
+// probeEntity is the Datastore entity written by the probe.
+type probeEntity struct {
+	Time time.Time
+}
+
+// writeEntity checks that entities can be written and deleted in the
+// namespace.
+func (p *Prober) writeEntity(ctx context.Context, name string) error {
+	key := datastore.NameKey(Kind, name, nil)
+	key.Namespace = p.namespace
+	if _, err := p.ds.Put(ctx, key, &probeEntity{Time: time.Now()}); err != nil {
+		return err
+	}
+	return p.ds.Delete(ctx, key)
+}
+
+// Run runs all probes, and returns their results.  Probes that create
+// tables or entities clean them up.
+func (p *Prober) Run(ctx context.Context) Report {
+	report := Report{}
+	add := func(name string, err error) {
+		report = append(report, Result{Name: name, Err: err})
+	}
+	for _, b := range p.buckets {
+		add("gcs list gs://"+b, p.listBucket(ctx, b))
+	}
+	add("bigquery query", p.query(ctx))
+	table := fmt.Sprintf("gardener_selftest_%d", time.Now().UnixNano())
+	for _, ds := range p.datasets {
+		add("bigquery create table in "+ds, p.createTable(ctx, ds, table))
+	}
+	if p.ds != nil {
+		add("datastore write in namespace "+p.namespace, p.writeEntity(ctx, table))
+	}
+	return report
+}
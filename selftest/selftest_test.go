@@ -0,0 +1,97 @@
+package selftest_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"google.golang.org/api/iterator"
+
+	"github.com/m-lab/go/cloudtest/dsfake"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/cloud/bq"
+	"github.com/m-lab/etl-gardener/cloud/bq/bqfake"
+	"github.com/m-lab/etl-gardener/config"
+	"github.com/m-lab/etl-gardener/selftest"
+)
+
+// fakeClient lists no objects, or fails for the denied buckets.
+type fakeClient struct {
+	stiface.Client
+	denied map[string]bool
+}
+
+func (f *fakeClient) Bucket(name string) stiface.BucketHandle {
+	return &fakeBucketHandle{denied: f.denied[name]}
+}
+
+type fakeBucketHandle struct {
+	stiface.BucketHandle
+	denied bool
+}
+
+func (bh *fakeBucketHandle) Objects(ctx context.Context, q *storage.Query) stiface.ObjectIterator {
+	return &fakeObjectIterator{denied: bh.denied}
+}
+
+type fakeObjectIterator struct {
+	stiface.ObjectIterator
+	denied bool
+}
+
+func (it *fakeObjectIterator) Next() (*storage.ObjectAttrs, error) {
+	if it.denied {
+		return nil, errors.New("403 forbidden")
+	}
+	return nil, iterator.Done
+}
+
+func TestProber(t *testing.T) {
+	ctx := context.Background()
+	sources := []config.SourceConfig{
+		{Bucket: "archive", Experiment: "ndt", Datatype: "ndt7"},
+		{Bucket: "archive", Experiment: "ndt", Datatype: "annotation"},
+		{Bucket: "private", Experiment: "wehe", Datatype: "replay"},
+	}
+	bqClient := bqfake.NewClient("fake-project")
+	for _, ds := range []string{"tmp_ndt", "raw_ndt", "tmp_wehe"} {
+		bqClient.AddDataset(ds)
+	}
+	dsClient := dsfake.NewClient()
+	p, err := selftest.New(&fakeClient{denied: map[string]bool{"private": true}},
+		bqClient, dsClient, "test", bq.Naming{}, sources)
+	rtx.Must(err, "New")
+
+	report := p.Run(ctx)
+	if len(report) != 8 {
+		t.Fatal("Wrong number of probes", report)
+	}
+	failed := report.Failed()
+	if len(failed) != 2 || failed[0].Name != "gcs list gs://private" ||
+		failed[1].Name != "bigquery create table in raw_wehe" {
+		t.Error("Wrong failed probes", failed)
+	}
+	if err := report.Err(); !errors.Is(err, selftest.ErrProbeFailed) {
+		t.Error("Expected ErrProbeFailed", err)
+	}
+	if !strings.Contains(report.String(), "ok   datastore write in namespace test\n") {
+		t.Error("Wrong report", report.String())
+	}
+	// Probe tables and entities are cleaned up.
+	if len(bqClient.Deleted()) != 3 {
+		t.Error("Expected probe tables to be deleted", bqClient.Deleted())
+	}
+	if keys := dsClient.GetKeys(); len(keys) != 0 {
+		t.Error("Expected probe entity to be deleted", keys)
+	}
+
+	p, err = selftest.New(&fakeClient{}, bqClient, nil, "test", bq.Naming{}, sources[:1])
+	rtx.Must(err, "New")
+	if report := p.Run(ctx); len(report) != 4 || report.Err() != nil {
+		t.Error("Expected all probes to pass", report)
+	}
+}
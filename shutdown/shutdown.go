@@ -0,0 +1,97 @@
+// Package shutdown coordinates an orderly shutdown, running a sequence of
+// stages, such as stopping dispatch, draining actions, stopping servers and
+// flushing state, under a single deadline.  Stages that must run even once
+// that deadline has passed, such as flushing state, may have their own.
+package shutdown
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Stage is a single shutdown step.  It should respect the ctx deadline.
+type Stage func(ctx context.Context) error
+
+type namedStage struct {
+	name    string
+	f       Stage
+	timeout time.Duration // If not zero, the stage's own deadline.
+}
+
+// Coordinator runs shutdown stages in the order they were added.
+type Coordinator struct {
+	lock   sync.Mutex
+	stages []namedStage
+}
+
+// New creates an empty Coordinator.
+func New() *Coordinator {
+	return &Coordinator{}
+}
+
+// Add adds a stage, to run after all previously added stages.
+func (c *Coordinator) Add(name string, f Stage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stages = append(c.stages, namedStage{name: name, f: f})
+}
+
+// AddWithTimeout adds a stage that runs with its own timeout, rather than
+// the Run deadline, so that it may complete even if earlier stages used up
+// that deadline.
+func (c *Coordinator) AddWithTimeout(name string, timeout time.Duration, f Stage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stages = append(c.stages, namedStage{name: name, f: f, timeout: timeout})
+}
+
+// Reserve returns a context that is done reserve before the ctx deadline,
+// leaving time for later stages, or halfway to the deadline if less than
+// twice reserve remains.  Without a deadline, it is ctx.
+func Reserve(ctx context.Context, reserve time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	remaining := time.Until(deadline)
+	if remaining < 2*reserve {
+		return context.WithTimeout(ctx, remaining/2)
+	}
+	return context.WithDeadline(ctx, deadline.Add(-reserve))
+}
+
+// Run runs all stages in order.  Every stage is run, even if an earlier
+// stage fails or the deadline passes, so that later stages, such as
+// flushing state, get a chance to complete.  Returns the first error.
+func (c *Coordinator) Run(ctx context.Context) error {
+	c.lock.Lock()
+	stages := make([]namedStage, len(c.stages))
+	copy(stages, c.stages)
+	c.lock.Unlock()
+
+	var first error
+	for _, s := range stages {
+		start := time.Now()
+		err := s.run(ctx)
+		if err != nil {
+			log.Println("Shutdown", s.name, "failed after", time.Since(start), err)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		log.Println("Shutdown", s.name, "took", time.Since(start))
+	}
+	return first
+}
+
+func (s namedStage) run(ctx context.Context) error {
+	if s.timeout == 0 {
+		return s.f(ctx)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return s.f(ctx)
+}
@@ -0,0 +1,79 @@
+package shutdown_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/shutdown"
+)
+
+func TestCoordinator(t *testing.T) {
+	c := shutdown.New()
+	order := []string{}
+	stage := func(name string, err error) shutdown.Stage {
+		return func(ctx context.Context) error {
+			order = append(order, name)
+			return err
+		}
+	}
+	errFirst := errors.New("first")
+	c.Add("dispatch", stage("dispatch", nil))
+	c.Add("actions", stage("actions", errFirst))
+	c.Add("servers", stage("servers", errors.New("second")))
+	c.Add("tracker", stage("tracker", nil))
+
+	if err := c.Run(context.Background()); err != errFirst {
+		t.Error("Expected first error, got", err)
+	}
+	want := []string{"dispatch", "actions", "servers", "tracker"}
+	if !reflect.DeepEqual(order, want) {
+		t.Error("Wrong stage order", order)
+	}
+}
+
+func TestAddWithTimeout(t *testing.T) {
+	c := shutdown.New()
+	var drained, flushed error
+	c.Add("actions", func(ctx context.Context) error {
+		<-ctx.Done()
+		drained = ctx.Err()
+		return nil
+	})
+	c.AddWithTimeout("tracker", time.Second, func(ctx context.Context) error {
+		flushed = ctx.Err()
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.Run(ctx); err != nil {
+		t.Error(err)
+	}
+	if drained == nil || flushed != nil {
+		t.Error("Expected only the shared deadline to expire", drained, flushed)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	sub, subCancel := shutdown.Reserve(ctx, 20*time.Second)
+	defer subCancel()
+	d, _ := sub.Deadline()
+	if left := time.Until(d); left > 40*time.Second || left < 39*time.Second {
+		t.Error("Wrong reserve", left)
+	}
+	short, shortCancel := shutdown.Reserve(ctx, time.Minute)
+	defer shortCancel()
+	d, _ = short.Deadline()
+	if left := time.Until(d); left > 30*time.Second || left < 29*time.Second {
+		t.Error("Expected half the time remaining", left)
+	}
+	none, noneCancel := shutdown.Reserve(context.Background(), time.Minute)
+	defer noneCancel()
+	if _, ok := none.Deadline(); ok {
+		t.Error("Expected no deadline")
+	}
+}
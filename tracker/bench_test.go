@@ -0,0 +1,149 @@
+package tracker_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// benchJobs is the size of the tracker state in the benchmarks, e.g. a
+// multi-year backfill of many datatypes.
+const benchJobs = 50000
+
+// newBenchTracker returns a tracker with n jobs, spread over 10 datatypes,
+// each with a few state changes.  Logs are discarded.
+func newBenchTracker(b *testing.B, n int) (*tracker.Tracker, []tracker.Job) {
+	log.SetOutput(ioutil.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, time.Hour)
+	rtx.Must(err, "InitTracker")
+	start := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	jobs := make([]tracker.Job, 0, n)
+	for i := 0; i < n; i++ {
+		j := tracker.NewJob("bucket", "ndt", fmt.Sprintf("type%d", i%10), start.AddDate(0, 0, i/10))
+		rtx.Must(tk.AddJob(j), "AddJob")
+		rtx.Must(tk.SetStatus(j, tracker.Parsing, "parsing"), "SetStatus")
+		rtx.Must(tk.SetStatus(j, tracker.ParseComplete, ""), "SetStatus")
+		jobs = append(jobs, j)
+	}
+	return tk, jobs
+}
+
+// newBenchSnapshots returns a tracker with n jobs, serving snapshots, as the
+// gardener does.
+func newBenchSnapshots(b *testing.B, n int) *tracker.Tracker {
+	tk, _ := newBenchTracker(b, n)
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Cleanup(cancel)
+	tk.StartSnapshots(ctx, time.Hour)
+	return tk
+}
+
+// benchHandler benchmarks requests of the handler.
+func benchHandler(b *testing.B, tk *tracker.Tracker, handler http.HandlerFunc, url string) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp := httptest.NewRecorder()
+		handler(resp, httptest.NewRequest(http.MethodGet, url, nil))
+		if resp.Code != http.StatusOK {
+			b.Fatal("Wrong status", resp.Code)
+		}
+	}
+}
+
+// BenchmarkJobsHandler requests the same snapshot repeatedly, as the
+// dashboards do between job changes.
+func BenchmarkJobsHandler(b *testing.B) {
+	tk := newBenchSnapshots(b, benchJobs)
+	benchHandler(b, tk, tk.JobsHandler, "/jobs.json")
+}
+
+func BenchmarkJobsHandlerFiltered(b *testing.B) {
+	tk := newBenchSnapshots(b, benchJobs)
+	benchHandler(b, tk, tk.JobsHandler, "/jobs.json?datatype=type3")
+}
+
+// BenchmarkJobsHandlerNewSnapshot requests each snapshot once, as after
+// every job change.
+func BenchmarkJobsHandlerNewSnapshot(b *testing.B) {
+	tk := newBenchSnapshots(b, benchJobs)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tracker.RefreshSnapshot(tk)
+		b.StartTimer()
+		resp := httptest.NewRecorder()
+		tk.JobsHandler(resp, httptest.NewRequest(http.MethodGet, "/jobs.json", nil))
+		if resp.Code != http.StatusOK {
+			b.Fatal("Wrong status", resp.Code)
+		}
+	}
+}
+
+// BenchmarkJobsHandlerNoSnapshots takes, sorts and encodes a new copy of
+// the state for every request.
+func BenchmarkJobsHandlerNoSnapshots(b *testing.B) {
+	tk, _ := newBenchTracker(b, benchJobs)
+	benchHandler(b, tk, tk.JobsHandler, "/jobs.json")
+}
+
+func BenchmarkSummaryHandler(b *testing.B) {
+	tk := newBenchSnapshots(b, benchJobs)
+	benchHandler(b, tk, tk.SummaryHandler, "/status.json")
+}
+
+func BenchmarkGetState(b *testing.B) {
+	tk, _ := newBenchTracker(b, benchJobs)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tk.GetState()
+	}
+}
+
+func BenchmarkMarshalJobMap(b *testing.B) {
+	tk, _ := newBenchTracker(b, benchJobs)
+	jobs, _, _ := tk.GetState()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := jobs.MarshalJSON(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetStatusParallel reads job status concurrently with updates of
+// other jobs, as the monitor and parsers do.
+func BenchmarkGetStatusParallel(b *testing.B) {
+	tk, jobs := newBenchTracker(b, benchJobs)
+	var next uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddUint64(&next, 1)
+			j := jobs[int(i)%len(jobs)]
+			if i%10 == 0 {
+				rtx.Must(tk.SetDetail(j, "detail"), "SetDetail")
+				continue
+			}
+			if _, err := tk.GetStatus(j); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
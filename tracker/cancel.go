@@ -0,0 +1,63 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/m-lab/etl-gardener/metrics"
+)
+
+// ErrJobCancelled is returned for heartbeats and updates of a Cancelling
+// job, so that the parser or action working on it stops.
+var ErrJobCancelled = errors.New("job cancelled")
+
+// Cancel moves a job to Cancelling, with the reason as its detail, and
+// returns its status from before, e.g. with its BigQuery job ID.  Further
+// heartbeats and updates of the job fail with ErrJobCancelled, which tells
+// its parser to stop, and fail the job.  See FinishCancel.  Jobs that are
+// Complete, Failed or already Cancelling can't be cancelled.
+func (tr *Tracker) Cancel(job Job, reason string) (Status, error) {
+	old, err := tr.GetStatus(job)
+	if err != nil {
+		return Status{}, err
+	}
+	switch state := old.State(); state {
+	case Complete, Failed, Cancelling:
+		return old, fmt.Errorf("%w: %s job can't be cancelled", ErrInvalidStateTransition, state)
+	}
+	status := old
+	status.NewState(Cancelling)
+	status.SetDetail(reason)
+	// Any BigQuery job belonged to the previous state.
+	status.BQJobID = ""
+	if err := tr.UpdateJob(job, status); err != nil {
+		return old, err
+	}
+	metrics.CancelledJobs.WithLabelValues(job.Experiment, job.Datatype, string(old.State())).Inc()
+	return old, nil
+}
+
+// FinishCancel fails a Cancelling job, with the cancellation reason, once
+// the parser or action working on it has stopped.  Jobs in other states are
+// not changed.
+func (tr *Tracker) FinishCancel(job Job) error {
+	status, err := tr.GetStatus(job)
+	if err != nil {
+		return err
+	}
+	if status.State() != Cancelling {
+		return nil
+	}
+	return tr.SetJobError(job, "cancelled: "+status.Detail())
+}
+
+// rejectCancelled fails a Cancelling job, since the parser or action that
+// sent an update for it will stop when it gets the returned
+// ErrJobCancelled.
+func (tr *Tracker) rejectCancelled(job Job, status Status) error {
+	reason := status.Detail()
+	if err := tr.FinishCancel(job); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrJobCancelled, reason)
+}
@@ -0,0 +1,74 @@
+package tracker_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestCancel(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	must(t, err)
+	parsing := tracker.NewJob("bucket", "exp", "type", startDate)
+	updating := tracker.NewJob("bucket", "exp", "type", startDate.AddDate(0, 0, 1))
+	stale := tracker.NewJob("bucket", "exp", "type", startDate.AddDate(0, 0, 2))
+	for _, j := range []tracker.Job{parsing, updating, stale} {
+		must(t, tk.AddJob(j))
+		must(t, tk.SetStatus(j, tracker.Parsing, ""))
+	}
+	must(t, tk.SetBQJobID(parsing, "bq-job"))
+
+	old, err := tk.Cancel(parsing, "stuck")
+	must(t, err)
+	if old.State() != tracker.Parsing || old.BQJobID != "bq-job" {
+		t.Error("Wrong status before cancel", old)
+	}
+	s, err := tk.GetStatus(parsing)
+	must(t, err)
+	if s.State() != tracker.Cancelling || s.Detail() != "stuck" || s.BQJobID != "" {
+		t.Error("Wrong cancelled status", s)
+	}
+	if _, err := tk.Cancel(parsing, "again"); !errors.Is(err, tracker.ErrInvalidStateTransition) {
+		t.Error("Expected ErrInvalidStateTransition", err)
+	}
+	if _, err := tk.Cancel(tracker.NewJob("bucket", "exp", "other", startDate), "x"); err != tracker.ErrJobNotFound {
+		t.Error("Expected ErrJobNotFound", err)
+	}
+
+	// The parser's next heartbeat is refused, and fails the job.
+	if err := tk.Heartbeat(parsing); !errors.Is(err, tracker.ErrJobCancelled) {
+		t.Error("Expected ErrJobCancelled", err)
+	}
+	s, err = tk.GetStatus(parsing)
+	must(t, err)
+	if s.State() != tracker.Failed || !strings.Contains(s.Detail(), "cancelled: stuck") {
+		t.Error("Wrong failed status", s)
+	}
+	if _, err := tk.Cancel(parsing, "again"); !errors.Is(err, tracker.ErrInvalidStateTransition) {
+		t.Error("Failed jobs can't be cancelled", err)
+	}
+
+	// So are updates.
+	_, err = tk.Cancel(updating, "stuck")
+	must(t, err)
+	if err := tk.SetStatus(updating, tracker.ParseComplete, ""); !errors.Is(err, tracker.ErrJobCancelled) {
+		t.Error("Expected ErrJobCancelled", err)
+	}
+	if s, _ := tk.GetStatus(updating); s.State() != tracker.Failed {
+		t.Error("Expected Failed", s)
+	}
+
+	// Jobs whose parser is never heard from again are failed when stale.
+	_, err = tk.Cancel(stale, "stuck")
+	must(t, err)
+	if released := tk.ReleaseStale(time.Minute, time.Now().Add(time.Hour)); len(released) != 0 {
+		t.Error("Cancelled jobs should not be released", released)
+	}
+	if s, _ := tk.GetStatus(stale); s.State() != tracker.Failed {
+		t.Error("Expected Failed", s)
+	}
+}
@@ -0,0 +1,261 @@
+package tracker
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+// maxRecentErrors is the number of recent errors shown on the dashboard.
+const maxRecentErrors = 20
+
+// MaxDashboardDays is the most dates shown on the dashboard.  Outcomes are
+// kept for this many dates before the newest date of each experiment/datatype.
+const MaxDashboardDays = 366
+
+// JobError records a job failure, for display on the dashboard.
+type JobError struct {
+	Job    Job
+	Time   time.Time
+	Detail string
+}
+
+// history records the final outcomes and recent errors for jobs.
+// It is protected by the Tracker lock.
+type history struct {
+	// outcomes maps experiment/datatype to the final state for each date.
+	outcomes map[string]map[time.Time]State
+	errors   []JobError // Most recent last.
+	// durations maps experiment/datatype to recent job durations, most recent last.
+	durations map[string][]time.Duration
+	// completed maps experiment/datatype to the first completion time of
+	// each date, for SLO reports.
+	completed map[string]map[time.Time]time.Time
+	started   time.Time // When recording started.
+}
+
+func newHistory() history {
+	return history{
+		outcomes:  make(map[string]map[time.Time]State),
+		durations: make(map[string][]time.Duration),
+		completed: make(map[string]map[time.Time]time.Time),
+		started:   time.Now(),
+	}
+}
+
+func expType(job Job) string {
+	return job.Experiment + "/" + job.Datatype
+}
+
+// record updates the history if the status is Complete or Failed.
+func (h *history) record(job Job, s *Status) {
+	state := s.State()
+	if state != Complete && state != Failed {
+		return
+	}
+	key := expType(job)
+	if h.outcomes[key] == nil {
+		h.outcomes[key] = make(map[time.Time]State)
+	}
+	h.outcomes[key][job.Date] = state
+	h.pruneOutcomes(key)
+	if state == Complete {
+		h.recordDuration(job, s.StateChangeTime().Sub(s.StartTime()))
+		h.recordCompletion(job, s.StateChangeTime())
+	}
+	if state == Failed {
+		h.errors = append(h.errors, JobError{Job: job, Time: s.DetailTime(), Detail: s.Detail()})
+		if len(h.errors) > maxRecentErrors {
+			h.errors = h.errors[len(h.errors)-maxRecentErrors:]
+		}
+	}
+}
+
+// pruneOutcomes removes the outcomes of dates more than MaxDashboardDays
+// before the newest date of the experiment/datatype, once there are more
+// than MaxDashboardDays of them.
+func (h *history) pruneOutcomes(key string) {
+	m := h.outcomes[key]
+	if len(m) <= MaxDashboardDays {
+		return
+	}
+	newest := time.Time{}
+	for date := range m {
+		if date.After(newest) {
+			newest = date
+		}
+	}
+	cutoff := newest.AddDate(0, 0, -MaxDashboardDays)
+	for date := range m {
+		if date.Before(cutoff) {
+			delete(m, date)
+		}
+	}
+}
+
+// DateCell is a single date in the dashboard calendar.
+type DateCell struct {
+	Date  time.Time
+	Class string // One of complete, failed, active, pending
+}
+
+// Progress summarizes the dashboard for a single experiment/datatype.
+type Progress struct {
+	Name     string
+	Cells    []DateCell
+	Complete int
+	Percent  int
+}
+
+// ActiveJob describes an in-flight job on the dashboard.
+type ActiveJob struct {
+	Job     Job
+	State   State
+	InState time.Duration
+	Detail  string
+}
+
+// Dashboard holds all the data rendered by WriteDashboard.
+type Dashboard struct {
+	Start, End time.Time
+	Progress   []Progress
+	Active     []ActiveJob
+	Errors     []JobError
+	ETAs       []ETA
+}
+
+// GetDashboard summarizes the job state for the days preceding now, at most
+// MaxDashboardDays.
+func (tr *Tracker) GetDashboard(now time.Time, days int) Dashboard {
+	if days > MaxDashboardDays {
+		days = MaxDashboardDays
+	}
+	jobs, _, _ := tr.GetState()
+	end := now.UTC().Truncate(24 * time.Hour)
+	start := end.AddDate(0, 0, 1-days)
+	d := Dashboard{Start: start, End: end, ETAs: tr.GetETAs(now)}
+
+	tr.lock.Lock()
+	outcomes := make(map[string]map[time.Time]State, len(tr.history.outcomes))
+	for k, v := range tr.history.outcomes {
+		m := make(map[time.Time]State, len(v))
+		for date, state := range v {
+			m[date] = state
+		}
+		outcomes[k] = m
+	}
+	d.Errors = make([]JobError, len(tr.history.errors))
+	// Most recent first.
+	for i, e := range tr.history.errors {
+		d.Errors[len(d.Errors)-1-i] = e
+	}
+	tr.lock.Unlock()
+
+	active := make(map[string]map[time.Time]bool)
+	for j, s := range jobs {
+		key := expType(j)
+		if outcomes[key] == nil {
+			outcomes[key] = make(map[time.Time]State)
+		}
+		switch s.State() {
+		case Complete, Failed:
+			outcomes[key][j.Date] = s.State()
+			continue
+		}
+		if active[key] == nil {
+			active[key] = make(map[time.Time]bool)
+		}
+		active[key][j.Date] = true
+		d.Active = append(d.Active, ActiveJob{
+			Job: j, State: s.State(), Detail: s.Detail(),
+			InState: now.Sub(s.StateChangeTime()).Round(time.Second)})
+	}
+	sort.Slice(d.Active, func(i, j int) bool {
+		return d.Active[i].InState > d.Active[j].InState
+	})
+
+	names := make([]string, 0, len(outcomes))
+	for k := range outcomes {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := Progress{Name: name}
+		for date := start; !date.After(end); date = date.AddDate(0, 0, 1) {
+			class := "pending"
+			switch {
+			case active[name][date]:
+				class = "active"
+			case outcomes[name][date] == Complete:
+				class = "complete"
+				p.Complete++
+			case outcomes[name][date] == Failed:
+				class = "failed"
+			}
+			p.Cells = append(p.Cells, DateCell{Date: date, Class: class})
+		}
+		p.Percent = 100 * p.Complete / len(p.Cells)
+		d.Progress = append(d.Progress, p)
+	}
+	return d
+}
+
+var dashboardTemplate = template.Must(template.New("").Parse(`
+	<h1>Dashboard {{.Start.Format "2006-01-02"}} to {{.End.Format "2006-01-02"}}</h1>
+	<style>
+	.cal td { width: 10px; height: 10px; padding: 0; }
+	.complete { background-color: green; }
+	.failed { background-color: red; }
+	.active { background-color: gold; }
+	.pending { background-color: lightgray; }
+	.bar { width: 300px; background-color: lightgray; }
+	.bar div { height: 12px; background-color: green; }
+	table.jobs, .jobs th, .jobs td { border: 1px solid black; }
+	</style>
+	<table>
+	{{range .Progress}}
+		<tr>
+			<td> {{.Name}} </td>
+			<td> <div class="bar"><div style="width: {{.Percent}}%"></div></div> {{.Percent}}% </td>
+			<td> <table class="cal"><tr>
+			{{range .Cells}}<td class="{{.Class}}" title="{{.Date.Format "2006-01-02"}} {{.Class}}"></td>{{end}}
+			</tr></table> </td>
+		</tr>
+	{{end}}
+	</table>
+	<h2>Backlog</h2>
+	<table class="jobs">
+		<tr> <th> Estimate </th> <th> Pending </th> <th> Backlog </th> <th> Mean job time </th> <th> Concurrency </th> </tr>
+	{{range .ETAs}}
+		<tr> <td> {{.}} </td> <td> {{.Pending}} </td> <td> {{.Backlog}} </td> <td> {{.MeanDuration}} </td> <td> {{.Concurrency}} </td> </tr>
+	{{end}}
+	</table>
+	<h2>In flight</h2>
+	<table class="jobs">
+		<tr> <th> Job </th> <th> State </th> <th> Time in State </th> <th> Detail </th> </tr>
+	{{range .Active}}
+		<tr> <td> {{.Job}} </td> <td> {{.State}} </td> <td> {{.InState}} </td> <td> {{.Detail}} </td> </tr>
+	{{end}}
+	</table>
+	<h2>Recent errors</h2>
+	<table class="jobs">
+		<tr> <th> Job </th> <th> Time </th> <th> Error </th> </tr>
+	{{range .Errors}}
+		<tr> <td> {{.Job}} </td> <td> {{.Time.Format "01/02~15:04:05"}} </td> <td> {{.Detail}} </td> </tr>
+	{{end}}
+	</table>`))
+
+// WriteDashboard writes an HTML dashboard covering the preceding days.
+func (tr *Tracker) WriteDashboard(w io.Writer, days int) error {
+	if days < 1 {
+		return fmt.Errorf("invalid number of days: %d", days)
+	}
+	err := dashboardTemplate.Execute(w, tr.GetDashboard(time.Now(), days))
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
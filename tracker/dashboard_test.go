@@ -0,0 +1,90 @@
+package tracker_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestDashboard(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	must(t, err)
+
+	now := time.Date(2020, 6, 10, 12, 0, 0, 0, time.UTC)
+	day := func(d int) time.Time { return time.Date(2020, 6, d, 0, 0, 0, 0, time.UTC) }
+	complete := tracker.NewJob("bucket", "ndt", "ndt7", day(8))
+	failed := tracker.NewJob("bucket", "ndt", "ndt7", day(9))
+	active := tracker.NewJob("bucket", "ndt", "ndt7", day(10))
+	other := tracker.NewJob("bucket", "ndt", "annotation", day(10))
+	for _, j := range []tracker.Job{complete, failed, active, other} {
+		must(t, tk.AddJob(j))
+	}
+	must(t, tk.SetStatus(complete, tracker.Complete, ""))
+	must(t, tk.SetStatus(failed, tracker.Copying, ""))
+	must(t, tk.SetJobError(failed, "copy failed"))
+	must(t, tk.SetStatus(active, tracker.Deduplicating, "working"))
+
+	d := tk.GetDashboard(now, 4)
+	if len(d.Progress) != 2 {
+		t.Fatal("Expected 2 experiment/datatypes", d.Progress)
+	}
+	ndt7 := d.Progress[1]
+	if ndt7.Name != "ndt/ndt7" {
+		t.Error("Wrong name", ndt7.Name)
+	}
+	classes := []string{}
+	for _, c := range ndt7.Cells {
+		classes = append(classes, c.Class)
+	}
+	want := "pending complete failed active"
+	if strings.Join(classes, " ") != want {
+		t.Errorf("Expected %q, got %v", want, classes)
+	}
+	if ndt7.Percent != 25 {
+		t.Error("Expected 25%, got", ndt7.Percent)
+	}
+	if len(d.Active) != 2 {
+		t.Error("Expected 2 active jobs", d.Active)
+	}
+	if len(d.Errors) != 1 || !strings.Contains(d.Errors[0].Detail, "copy failed") {
+		t.Error("Expected copy failed error", d.Errors)
+	}
+
+	buf := bytes.Buffer{}
+	must(t, tk.WriteDashboard(&buf, 30))
+	if !strings.Contains(buf.String(), "copy failed") {
+		t.Error("Dashboard should contain the error", buf.String())
+	}
+	if tk.WriteDashboard(&buf, 0) == nil {
+		t.Error("Expected error for zero days")
+	}
+	if d := tk.GetDashboard(now, 100000); len(d.Progress[0].Cells) != tracker.MaxDashboardDays {
+		t.Error("Expected at most MaxDashboardDays cells", len(d.Progress[0].Cells))
+	}
+}
+
+func TestDashboardPrunesOutcomes(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	must(t, err)
+	old := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	complete := func(date time.Time) {
+		j := tracker.NewJob("bucket", "ndt", "ndt7", date)
+		must(t, tk.AddJob(j))
+		must(t, tk.SetStatus(j, tracker.Complete, ""))
+	}
+	complete(old)
+	if d := tk.GetDashboard(old, 1); d.Progress[0].Cells[0].Class != "complete" {
+		t.Error("Expected complete", d.Progress[0].Cells)
+	}
+	// Outcomes more than MaxDashboardDays before the newest date are removed.
+	for i := 0; i < tracker.MaxDashboardDays; i++ {
+		complete(old.AddDate(0, 0, 400+i))
+	}
+	if d := tk.GetDashboard(old, 1); d.Progress[0].Cells[0].Class != "pending" {
+		t.Error("Expected pruned outcome", d.Progress[0].Cells)
+	}
+}
@@ -0,0 +1,301 @@
+package tracker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Errors associated with day stages.
+var (
+	ErrInvalidDayStages = errors.New("invalid day stages")
+	ErrNoDayStages      = errors.New("experiment has no day stages")
+)
+
+// DefaultDays is the number of recent dates reported by DaysHandler.
+const DefaultDays = 7
+
+// DayStage is a group of an experiment's datatypes that are processed
+// together for each date, e.g. the measurement datatypes.
+type DayStage struct {
+	Name      string
+	Datatypes []string
+}
+
+// DayState is the combined state of the jobs of a day, or of a stage.
+type DayState string
+
+// DayState values.
+const (
+	DayPending  DayState = "pending"  // No datatype has a job yet.
+	DayRunning  DayState = "running"  // Some datatypes are in flight, or have no job yet.
+	DayComplete DayState = "complete" // All datatypes are complete.
+	DayPartial  DayState = "partial"  // All datatypes finished, but some failed.
+	DayFailed   DayState = "failed"   // All datatypes failed.
+)
+
+// DayStageStatus is the status of a stage of a Day.
+type DayStageStatus struct {
+	Name  string
+	State DayState
+	// Datatypes maps each datatype to its job state, or to the empty state
+	// if it has no job.
+	Datatypes map[string]State
+}
+
+// Day is the composite status of all the datatypes of an experiment for a
+// date, in stage order.
+type Day struct {
+	Experiment string
+	Date       time.Time
+	State      DayState
+	Stages     []DayStageStatus
+	// Waiting is the first stage whose jobs are held until an earlier
+	// stage finishes, if any.
+	Waiting  string     `json:",omitempty"`
+	Failures []JobError // Failed jobs of the date that are still tracked.
+}
+
+// SetDayStages sets the ordered stages of an experiment's days.  The post
+// processing of a date's jobs in each stage waits until the jobs of the
+// same date in earlier stages finish.  See WaitingOn.  Each datatype may be
+// in only one stage.  Empty stages clear the experiment's stages.
+func (tr *Tracker) SetDayStages(experiment string, stages []DayStage) error {
+	names := map[string]bool{}
+	datatypes := map[string]bool{}
+	for _, s := range stages {
+		if s.Name == "" || names[s.Name] || len(s.Datatypes) == 0 {
+			return fmt.Errorf("%w: %s stage %q", ErrInvalidDayStages, experiment, s.Name)
+		}
+		names[s.Name] = true
+		for _, dt := range s.Datatypes {
+			if dt == "" || datatypes[dt] {
+				return fmt.Errorf("%w: %s datatype %q", ErrInvalidDayStages, experiment, dt)
+			}
+			datatypes[dt] = true
+		}
+	}
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	if tr.dayStages == nil {
+		tr.dayStages = make(map[string][]DayStage)
+	}
+	if len(stages) == 0 {
+		delete(tr.dayStages, experiment)
+		return nil
+	}
+	tr.dayStages[experiment] = append([]DayStage(nil), stages...)
+	return nil
+}
+
+// finished returns true if a job in the state doesn't hold later stages.
+// Failed jobs don't hold them either, so that a failure is reported for
+// the day rather than stalling it.
+func finished(state State) bool {
+	return state == Complete || state == PartialComplete || state == Failed
+}
+
+// stageOf returns the index of the datatype's stage, or -1.
+func stageOf(stages []DayStage, datatype string) int {
+	for i, s := range stages {
+		for _, dt := range s.Datatypes {
+			if dt == datatype {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// WaitingOn returns the unfinished jobs of the same experiment and date in
+// stages before the job's stage, sorted by job.  Datatypes that have no
+// job don't hold later stages.
+func (tr *Tracker) WaitingOn(job Job) []Job {
+	tr.lock.Lock()
+	stages := tr.dayStages[job.Experiment]
+	tr.lock.Unlock()
+	stage := stageOf(stages, job.Datatype)
+	if stage <= 0 {
+		return nil
+	}
+	waiting := []Job{}
+	for _, earlier := range stages[:stage] {
+		for _, dt := range earlier.Datatypes {
+			tr.jobs.partition(job.Experiment, dt, job.Date, func(j Job, s Status) {
+				if !finished(s.State()) {
+					waiting = append(waiting, j)
+				}
+			})
+		}
+	}
+	sort.Slice(waiting, func(i, j int) bool { return waiting[i].String() < waiting[j].String() })
+	return waiting
+}
+
+// combine returns the combined state of the datatype states.
+func combine(states []State) DayState {
+	known, complete, failed := 0, 0, 0
+	for _, s := range states {
+		switch s {
+		case "":
+			continue
+		case Complete:
+			complete++
+		case Failed:
+			failed++
+		}
+		known++
+	}
+	switch {
+	case known == 0:
+		return DayPending
+	case known < len(states) || complete+failed < known:
+		return DayRunning
+	case failed == 0:
+		return DayComplete
+	case complete == 0:
+		return DayFailed
+	}
+	return DayPartial
+}
+
+// day computes the Day of an experiment for a date.  Each datatype's state
+// is the state of its whole date job if it is tracked, or of any of its
+// prefix jobs, or else its last outcome since startup.
+// Caller must not hold the Tracker lock.
+func (tr *Tracker) day(experiment string, date time.Time, stages []DayStage) Day {
+	d := Day{Experiment: experiment, Date: date, Failures: []JobError{}}
+	inFlight := map[string]State{}
+	for _, stage := range stages {
+		for _, dt := range stage.Datatypes {
+			tr.jobs.partition(experiment, dt, date, func(j Job, s Status) {
+				if s.State() == Failed {
+					d.Failures = append(d.Failures, JobError{Job: j, Time: s.DetailTime(), Detail: s.Detail()})
+				}
+				if _, ok := inFlight[j.Datatype]; !ok || j.Prefix == "" {
+					inFlight[j.Datatype] = s.State()
+				}
+			})
+		}
+	}
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	sort.Slice(d.Failures, func(i, j int) bool {
+		return d.Failures[i].Job.String() < d.Failures[j].Job.String()
+	})
+	all := []State{}
+	heldBy := -1
+	for i, stage := range stages {
+		ss := DayStageStatus{Name: stage.Name, Datatypes: make(map[string]State, len(stage.Datatypes))}
+		states := make([]State, 0, len(stage.Datatypes))
+		for _, dt := range stage.Datatypes {
+			state, ok := inFlight[dt]
+			if !ok {
+				state = tr.history.outcomes[experiment+"/"+dt][date]
+			}
+			ss.Datatypes[dt] = state
+			states = append(states, state)
+			if state == ParseComplete && heldBy >= 0 && d.Waiting == "" {
+				d.Waiting = stage.Name
+			}
+		}
+		for _, s := range states {
+			if s != "" && !finished(s) && heldBy < 0 {
+				heldBy = i
+			}
+		}
+		ss.State = combine(states)
+		d.Stages = append(d.Stages, ss)
+		all = append(all, states...)
+	}
+	d.State = combine(all)
+	return d
+}
+
+// GetDay returns the Day of an experiment for a date.  Returns
+// ErrNoDayStages if the experiment has no stages.
+func (tr *Tracker) GetDay(experiment string, date time.Time) (Day, error) {
+	tr.lock.Lock()
+	stages, ok := tr.dayStages[experiment]
+	tr.lock.Unlock()
+	if !ok {
+		return Day{}, fmt.Errorf("%w: %s", ErrNoDayStages, experiment)
+	}
+	return tr.day(experiment, date.UTC().Truncate(24*time.Hour), stages), nil
+}
+
+// GetDays returns the Days of each experiment with stages, for the given
+// number of dates before now, most recent first.
+func (tr *Tracker) GetDays(now time.Time, days int) []Day {
+	tr.lock.Lock()
+	all := make(map[string][]DayStage, len(tr.dayStages))
+	experiments := make([]string, 0, len(tr.dayStages))
+	for exp, stages := range tr.dayStages {
+		all[exp] = stages
+		experiments = append(experiments, exp)
+	}
+	tr.lock.Unlock()
+	sort.Strings(experiments)
+	today := now.UTC().Truncate(24 * time.Hour)
+	result := make([]Day, 0, days*len(experiments))
+	for i := 1; i <= days; i++ {
+		for _, exp := range experiments {
+			result = append(result, tr.day(exp, today.AddDate(0, 0, -i), all[exp]))
+		}
+	}
+	return result
+}
+
+// DaysHandler serves the Days as JSON.  The optional "experiment" parameter
+// selects an experiment, and "date", e.g. 2020-06-01, a single date.
+// Otherwise, "days" sets the number of recent dates, DefaultDays by
+// default.
+func (tr *Tracker) DaysHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	exp := q.Get("experiment")
+	var result []Day
+	if ds := q.Get("date"); ds != "" {
+		date, err := time.Parse("2006-01-02", ds)
+		if err != nil || exp == "" {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		d, err := tr.GetDay(exp, date)
+		if err != nil {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		result = []Day{d}
+	} else {
+		days := DefaultDays
+		if s := q.Get("days"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				resp.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			days = n
+		}
+		result = []Day{}
+		for _, d := range tr.GetDays(time.Now(), days) {
+			if exp == "" || d.Experiment == exp {
+				result = append(result, d)
+			}
+		}
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
@@ -0,0 +1,117 @@
+package tracker_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestSetDayStages(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "InitTracker")
+	for _, stages := range [][]tracker.DayStage{
+		{{Name: "", Datatypes: []string{"ndt7"}}},
+		{{Name: "measurements"}},
+		{{Name: "a", Datatypes: []string{"ndt7"}}, {Name: "a", Datatypes: []string{"pcap"}}},
+		{{Name: "a", Datatypes: []string{"ndt7"}}, {Name: "b", Datatypes: []string{"ndt7"}}},
+	} {
+		if err := tk.SetDayStages("ndt", stages); !errors.Is(err, tracker.ErrInvalidDayStages) {
+			t.Error("Expected ErrInvalidDayStages", stages, err)
+		}
+	}
+	if _, err := tk.GetDay("ndt", time.Now()); !errors.Is(err, tracker.ErrNoDayStages) {
+		t.Error("Expected ErrNoDayStages", err)
+	}
+}
+
+func TestDays(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, time.Hour)
+	rtx.Must(err, "InitTracker")
+	rtx.Must(tk.SetDayStages("ndt", []tracker.DayStage{
+		{Name: "annotation", Datatypes: []string{"annotation"}},
+		{Name: "measurements", Datatypes: []string{"ndt7", "pcap"}},
+	}), "SetDayStages")
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	job := func(dt string) tracker.Job { return tracker.NewJob("bucket", "ndt", dt, date) }
+
+	d, err := tk.GetDay("ndt", date)
+	rtx.Must(err, "GetDay")
+	if d.State != tracker.DayPending || len(d.Stages) != 2 {
+		t.Errorf("Wrong empty day %+v", d)
+	}
+
+	// Measurements wait for the annotation job.
+	rtx.Must(tk.AddJob(job("annotation")), "AddJob")
+	rtx.Must(tk.AddJob(job("ndt7")), "AddJob")
+	rtx.Must(tk.SetStatus(job("ndt7"), tracker.ParseComplete, ""), "SetStatus")
+	if w := tk.WaitingOn(job("ndt7")); len(w) != 1 || w[0] != job("annotation") {
+		t.Error("Expected ndt7 to wait for annotation", w)
+	}
+	if w := tk.WaitingOn(job("annotation")); len(w) != 0 {
+		t.Error("The first stage should not wait", w)
+	}
+	if w := tk.WaitingOn(tracker.NewJob("bucket", "ndt", "ndt7", date.AddDate(0, 0, 1))); len(w) != 0 {
+		t.Error("Other dates should not wait", w)
+	}
+	if w := tk.WaitingOn(tracker.NewJob("bucket", "other", "ndt7", date)); len(w) != 0 {
+		t.Error("Other experiments should not wait", w)
+	}
+	d, err = tk.GetDay("ndt", date)
+	rtx.Must(err, "GetDay")
+	if d.State != tracker.DayRunning || d.Waiting != "measurements" ||
+		d.Stages[1].Datatypes["ndt7"] != tracker.ParseComplete || d.Stages[1].Datatypes["pcap"] != "" {
+		t.Errorf("Wrong running day %+v", d)
+	}
+
+	// A failed annotation job doesn't hold the measurements, and is
+	// reported as a partial failure.
+	rtx.Must(tk.SetStatus(job("annotation"), tracker.Failed, "bad"), "SetStatus")
+	if w := tk.WaitingOn(job("ndt7")); len(w) != 0 {
+		t.Error("Expected no wait after failure", w)
+	}
+	rtx.Must(tk.SetStatus(job("ndt7"), tracker.Complete, ""), "SetStatus")
+	rtx.Must(tk.AddJob(job("pcap")), "AddJob")
+	rtx.Must(tk.SetStatus(job("pcap"), tracker.Complete, ""), "SetStatus")
+	d, err = tk.GetDay("ndt", date)
+	rtx.Must(err, "GetDay")
+	if d.State != tracker.DayPartial || d.Waiting != "" || d.Stages[0].State != tracker.DayFailed ||
+		d.Stages[1].State != tracker.DayComplete || len(d.Failures) != 1 || d.Failures[0].Job != job("annotation") {
+		t.Errorf("Wrong partial day %+v", d)
+	}
+
+	// Recent days are served as JSON.
+	resp := httptest.NewRecorder()
+	tk.DaysHandler(resp, httptest.NewRequest(http.MethodGet, "/days.json?days=3", nil))
+	days := []tracker.Day{}
+	rtx.Must(json.Unmarshal(resp.Body.Bytes(), &days), "Unmarshal")
+	if len(days) != 3 || days[0].Experiment != "ndt" {
+		t.Error("Wrong days", days)
+	}
+	resp = httptest.NewRecorder()
+	tk.DaysHandler(resp, httptest.NewRequest(http.MethodGet, "/days.json?experiment=ndt&date=2020-06-01", nil))
+	days = []tracker.Day{}
+	rtx.Must(json.Unmarshal(resp.Body.Bytes(), &days), "Unmarshal")
+	if len(days) != 1 || days[0].State != tracker.DayPartial {
+		t.Error("Wrong day", days)
+	}
+	for _, path := range []string{"/days.json?date=2020-06-01", "/days.json?days=x", "/days.json?experiment=ndt&date=June"} {
+		resp = httptest.NewRecorder()
+		tk.DaysHandler(resp, httptest.NewRequest(http.MethodGet, path, nil))
+		if resp.Code != http.StatusBadRequest {
+			t.Error("Expected bad request", path, resp.Code)
+		}
+	}
+	resp = httptest.NewRecorder()
+	tk.DaysHandler(resp, httptest.NewRequest(http.MethodGet, "/days.json?experiment=other&date=2020-06-01", nil))
+	if resp.Code != http.StatusNotFound {
+		t.Error("Expected not found", resp.Code)
+	}
+}
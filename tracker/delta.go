@@ -0,0 +1,170 @@
+package tracker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/m-lab/etl-gardener/persistence"
+)
+
+// deltaStruct is an entry in the append-only log of job changes, saved
+// between full snapshots.  Deltas are named by sequence number, and the
+// snapshot's LogStart is the first delta to replay over it.
+type deltaStruct struct {
+	Seq      int64
+	SaveTime time.Time
+	LastInit Job
+	// Jobs holds the jobs added or updated since the previous save, and
+	// Deleted the jobs removed, both encoded as json.
+	Jobs    []byte `datastore:",noindex"`
+	Deleted []byte `datastore:",noindex"`
+}
+
+// GetName implements persistence.StateObject.
+func (d *deltaStruct) GetName() string {
+	return fmt.Sprintf("jobs-%012d", d.Seq)
+}
+
+// GetKind implements persistence.StateObject.
+func (d *deltaStruct) GetKind() string {
+	return "trackerDelta"
+}
+
+// SetCompaction enables incremental persistence.  Each save writes only the
+// jobs changed since the previous save, and every n saves the full state is
+// written and the older deltas are deleted.  If n is zero, the full state is
+// written on every save.
+func (tr *Tracker) SetCompaction(n int) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	tr.compactEvery = n
+}
+
+// markDirty records a changed job for the next delta, and for the next
+// read snapshot.  Caller must hold the lock.
+func (tr *Tracker) markDirty(job Job) {
+	atomic.AddUint64(&tr.changes, 1)
+	if tr.saver != nil {
+		tr.dirty[job] = struct{}{}
+	}
+}
+
+// takeDirty returns and clears the set of changed jobs, and reports whether
+// the next save should be a full snapshot.
+func (tr *Tracker) takeDirty() (map[Job]struct{}, bool) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	dirty := tr.dirty
+	tr.dirty = make(map[Job]struct{}, len(dirty))
+	return dirty, tr.compactEvery <= 0 || tr.deltas >= tr.compactEvery
+}
+
+// restoreDirty adds back changed jobs after a failed save.
+func (tr *Tracker) restoreDirty(dirty map[Job]struct{}) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	for j := range dirty {
+		tr.dirty[j] = struct{}{}
+	}
+}
+
+// saveDelta saves the state of the dirty jobs as the next delta.
+func (tr *Tracker) saveDelta(ctx context.Context, jobs JobMap, lastInit Job, dirty map[Job]struct{}) error {
+	changed := make(JobMap, len(dirty))
+	deleted := []Job{}
+	for j := range dirty {
+		if s, ok := jobs[j]; ok {
+			changed[j] = s
+		} else {
+			deleted = append(deleted, j)
+		}
+	}
+	jsonJobs, err := changed.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	jsonDeleted, err := json.Marshal(deleted)
+	if err != nil {
+		return err
+	}
+	tr.lock.Lock()
+	seq := tr.nextSeq
+	tr.lock.Unlock()
+	delta := deltaStruct{Seq: seq, SaveTime: time.Now(), LastInit: lastInit,
+		Jobs: jsonJobs, Deleted: jsonDeleted}
+	if err := tr.saver.Save(ctx, &delta); err != nil {
+		return err
+	}
+	tr.lock.Lock()
+	tr.nextSeq++
+	tr.deltas++
+	tr.lock.Unlock()
+	return nil
+}
+
+// saveSnapshot saves the full state, and deletes the deltas it replaces.
+func (tr *Tracker) saveSnapshot(ctx context.Context, jobs JobMap, lastInit Job) error {
+	jsonJobs, err := jobs.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	tr.lock.Lock()
+	first, next := tr.logStart, tr.nextSeq
+	tr.lock.Unlock()
+	state := saverStruct{SaveTime: time.Now(), LastInit: lastInit, Jobs: jsonJobs, LogStart: next}
+	if err := tr.saver.Save(ctx, &state); err != nil {
+		return err
+	}
+	tr.lock.Lock()
+	tr.logStart = next
+	tr.deltas = 0
+	tr.lock.Unlock()
+	// The snapshot no longer refers to older deltas, so failures here only
+	// leave garbage behind.
+	for seq := first; seq < next; seq++ {
+		if err := tr.saver.Delete(ctx, &deltaStruct{Seq: seq}); err != nil {
+			log.Println("Delta delete error:", seq, err)
+		}
+	}
+	return nil
+}
+
+// replayDeltas applies the saved deltas, starting at seq, to jobs, until a
+// delta is missing.  Returns the last initialized job, the next sequence
+// number, and the number of deltas applied.
+func replayDeltas(ctx context.Context, saver persistence.Saver, jobs JobMap,
+	lastInit Job, seq int64) (Job, int64, int, error) {
+	n := 0
+	for ; ; seq++ {
+		delta := deltaStruct{Seq: seq}
+		err := saver.Fetch(ctx, &delta)
+		if err == datastore.ErrNoSuchEntity {
+			return lastInit, seq, n, nil
+		}
+		if err != nil {
+			return lastInit, seq, n, err
+		}
+		changed := make(JobMap)
+		if err := json.Unmarshal(delta.Jobs, &changed); err != nil {
+			return lastInit, seq, n, err
+		}
+		deleted := []Job{}
+		if err := json.Unmarshal(delta.Deleted, &deleted); err != nil {
+			return lastInit, seq, n, err
+		}
+		for j, s := range changed {
+			jobs[j] = s
+		}
+		for _, j := range deleted {
+			delete(jobs, j)
+		}
+		lastInit = delta.LastInit
+		n++
+	}
+}
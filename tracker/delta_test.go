@@ -0,0 +1,80 @@
+package tracker_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/persistence"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestIncrementalSave(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "tracker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+	saver, err := persistence.NewFileSaver(dir)
+	must(t, err)
+	deltas := func() int {
+		files, err := filepath.Glob(filepath.Join(dir, "trackerDelta", "*.json"))
+		must(t, err)
+		return len(files)
+	}
+	restore := func() *tracker.Tracker {
+		tk, err := tracker.InitTrackerWithSaver(ctx, saver, 0, 0, 0)
+		must(t, err)
+		return tk
+	}
+
+	tk := restore()
+	tk.SetCompaction(3)
+	createJobs(t, tk, "Delta", "type", 10)
+	lastSave, err := tk.Sync(ctx, time.Time{})
+	must(t, err)
+
+	// Update one job, and complete (and delete) another.
+	job := tracker.NewJob("bucket", "Delta", "type", startDate)
+	must(t, tk.SetStatus(job, tracker.Parsing, "parsing"))
+	lastSave, err = tk.Sync(ctx, lastSave)
+	must(t, err)
+	done := tracker.NewJob("bucket", "Delta", "type", startDate.AddDate(0, 0, 1))
+	must(t, tk.SetStatus(done, tracker.Complete, ""))
+	lastSave, err = tk.Sync(ctx, lastSave)
+	must(t, err)
+	if deltas() != 3 {
+		t.Error("Expected 3 deltas, got", deltas())
+	}
+
+	restored := restore()
+	if restored.NumJobs() != 9 {
+		t.Error("Expected 9 restored jobs, got", restored.NumJobs())
+	}
+	if s, err := restored.GetStatus(job); err != nil || s.State() != tracker.Parsing {
+		t.Error("Expected parsing job", s.State(), err)
+	}
+	if _, err := restored.GetStatus(done); err != tracker.ErrJobNotFound {
+		t.Error("Expected deleted job, got", err)
+	}
+	if restored.LastJob() != tk.LastJob() {
+		t.Error("Wrong last job", restored.LastJob())
+	}
+
+	// The next save is a full snapshot, which replaces the deltas.
+	must(t, tk.SetStatus(job, tracker.ParseComplete, ""))
+	_, err = tk.Sync(ctx, lastSave)
+	must(t, err)
+	if deltas() != 0 {
+		t.Error("Expected deltas to be compacted, got", deltas())
+	}
+	restored = restore()
+	if restored.NumJobs() != 9 {
+		t.Error("Expected 9 restored jobs, got", restored.NumJobs())
+	}
+	if s, err := restored.GetStatus(job); err != nil || s.State() != tracker.ParseComplete {
+		t.Error("Expected parse complete job", s.State(), err)
+	}
+}
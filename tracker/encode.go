@@ -0,0 +1,260 @@
+package tracker
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The job map is encoded without reflection, into pooled buffers, since
+// with tens of thousands of jobs, e.g. during multi-year backfills,
+// encoding/json dominates the status responses and the saved state.  The
+// output decodes to the same values as encoding/json's.  Fields added to
+// Job, Status, StateInfo, ParseStats or Inventory must also be added here,
+// which TestEncodeFields checks.
+
+// maxPooledBuffer is the largest buffer returned to the pool.
+const maxPooledBuffer = 64 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 64<<10)
+		return &b
+	},
+}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+// putBuffer returns a buffer to the pool.  It must not be used afterwards.
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBuffer {
+		return
+	}
+	*b = (*b)[:0]
+	bufferPool.Put(b)
+}
+
+const hex = "0123456789abcdef"
+
+// appendString appends s as a JSON string, escaped like encoding/json.
+func appendString(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= ' ' && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hex[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
+
+// appendTime appends t as a JSON string, like time.Time.MarshalJSON.
+func appendTime(b []byte, t time.Time) []byte {
+	b = append(b, '"')
+	b = t.AppendFormat(b, time.RFC3339Nano)
+	return append(b, '"')
+}
+
+// appendKey appends a JSON object key, and its colon, preceded by a comma
+// unless it is the first key.
+func appendKey(b []byte, key string, first bool) []byte {
+	if !first {
+		b = append(b, ',')
+	}
+	b = append(b, '"')
+	b = append(b, key...)
+	return append(b, '"', ':')
+}
+
+// appendStringMap appends m as a JSON object with sorted keys.
+func appendStringMap(b []byte, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b = append(b, '{')
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendString(b, k)
+		b = append(b, ':')
+		b = appendString(b, m[k])
+	}
+	return append(b, '}')
+}
+
+// appendJSON appends the JSON encoding of the job.
+func (j *Job) appendJSON(b []byte) []byte {
+	b = appendKey(append(b, '{'), "Bucket", true)
+	b = appendString(b, j.Bucket)
+	b = appendKey(b, "Experiment", false)
+	b = appendString(b, j.Experiment)
+	b = appendKey(b, "Datatype", false)
+	b = appendString(b, j.Datatype)
+	b = appendKey(b, "Date", false)
+	b = appendTime(b, j.Date)
+	if j.Filter != "" {
+		b = appendKey(b, "Filter", false)
+		b = appendString(b, j.Filter)
+	}
+	if j.Prefix != "" {
+		b = appendKey(b, "Prefix", false)
+		b = appendString(b, j.Prefix)
+	}
+	return append(b, '}')
+}
+
+// appendJSON appends the JSON encoding of the state info.
+func (si *StateInfo) appendJSON(b []byte) []byte {
+	b = appendKey(append(b, '{'), "State", true)
+	b = appendString(b, string(si.State))
+	b = appendKey(b, "Start", false)
+	b = appendTime(b, si.Start)
+	b = appendKey(b, "DetailTime", false)
+	b = appendTime(b, si.DetailTime)
+	b = appendKey(b, "Detail", false)
+	b = appendString(b, si.Detail)
+	return append(b, '}')
+}
+
+// appendJSON appends the JSON encoding of the parse stats.
+func (ps *ParseStats) appendJSON(b []byte) []byte {
+	b = appendKey(append(b, '{'), "Files", true)
+	b = strconv.AppendInt(b, ps.Files, 10)
+	b = appendKey(b, "Rows", false)
+	b = strconv.AppendInt(b, ps.Rows, 10)
+	return append(b, '}')
+}
+
+// appendJSON appends the JSON encoding of the inventory.
+func (inv *Inventory) appendJSON(b []byte) []byte {
+	b = appendKey(append(b, '{'), "Files", true)
+	b = strconv.AppendInt(b, inv.Files, 10)
+	b = appendKey(b, "Bytes", false)
+	b = strconv.AppendInt(b, inv.Bytes, 10)
+	return append(b, '}')
+}
+
+// appendJSON appends the JSON encoding of the status.
+func (s *Status) appendJSON(b []byte) []byte {
+	b = appendKey(append(b, '{'), "HeartbeatTime", true)
+	b = appendTime(b, s.HeartbeatTime)
+	b = appendKey(b, "UpdateCount", false)
+	b = strconv.AppendInt(b, int64(s.UpdateCount), 10)
+	if s.ParseStats != nil {
+		b = appendKey(b, "ParseStats", false)
+		b = s.ParseStats.appendJSON(b)
+	}
+	if s.Inventory != nil {
+		b = appendKey(b, "Inventory", false)
+		b = s.Inventory.appendJSON(b)
+	}
+	if s.BQJobID != "" {
+		b = appendKey(b, "BQJobID", false)
+		b = appendString(b, s.BQJobID)
+	}
+	if s.Version != "" {
+		b = appendKey(b, "Version", false)
+		b = appendString(b, s.Version)
+	}
+	if len(s.Annotations) > 0 {
+		b = appendKey(b, "Annotations", false)
+		b = appendStringMap(b, s.Annotations)
+	}
+	if s.Parent != nil {
+		b = appendKey(b, "Parent", false)
+		b = s.Parent.appendJSON(b)
+	}
+	if len(s.Shards) > 0 {
+		shards := make(map[string]string, len(s.Shards))
+		for prefix, state := range s.Shards {
+			shards[prefix] = string(state)
+		}
+		b = appendKey(b, "Shards", false)
+		b = appendStringMap(b, shards)
+	}
+	b = appendKey(b, "History", false)
+	if s.History == nil {
+		b = append(b, "null"...)
+	} else {
+		b = append(b, '[')
+		for i := range s.History {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = s.History[i].appendJSON(b)
+		}
+		b = append(b, ']')
+	}
+	return append(b, '}')
+}
+
+// appendPair appends a JSON object holding the job, and the status keyed by
+// statusKey.
+func appendPair(b []byte, j *Job, statusKey string, s *Status) []byte {
+	b = appendKey(append(b, '{'), "Job", true)
+	b = j.appendJSON(b)
+	b = appendKey(b, statusKey, false)
+	b = s.appendJSON(b)
+	return append(b, '}')
+}
+
+// appendJobs appends a JSON array of the jobs that match.
+func appendJobs(b []byte, jobs []JobStatus, match func(JobStatus) bool) []byte {
+	b = append(b, '[')
+	first := true
+	for i := range jobs {
+		if !match(jobs[i]) {
+			continue
+		}
+		if !first {
+			b = append(b, ',')
+		}
+		first = false
+		b = appendPair(b, &jobs[i].Job, "Status", &jobs[i].Status)
+	}
+	return append(b, ']')
+}
@@ -0,0 +1,95 @@
+package tracker_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// TestEncodeFields fails when fields are added to the types encoded in
+// encode.go, which must then be updated.
+func TestEncodeFields(t *testing.T) {
+	for _, tt := range []struct {
+		v interface{}
+		n int
+	}{
+		{tracker.Job{}, 6},
+		{tracker.Status{}, 10},
+		{tracker.StateInfo{}, 4},
+		{tracker.ParseStats{}, 2},
+		{tracker.Inventory{}, 2},
+	} {
+		if got := reflect.TypeOf(tt.v).NumField(); got != tt.n {
+			t.Errorf("%T has %d fields, encode.go handles %d", tt.v, got, tt.n)
+		}
+	}
+}
+
+func TestJobMapMarshalJSON(t *testing.T) {
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	when := time.Date(2020, 6, 2, 3, 4, 5, 6789, time.UTC)
+	odd := "a<b>&c\"d\\e\n\t\x01\x7f \u2028 \u2029 \u00e9 \xff"
+	parent := tracker.NewJob("bucket", "ndt", "tcpinfo", date)
+	full := parent
+	full.Filter = odd
+	full.Prefix = "20200601T15"
+	jobs := tracker.JobMap{
+		full: tracker.Status{
+			HeartbeatTime: when,
+			UpdateCount:   3,
+			ParseStats:    &tracker.ParseStats{Files: 10, Rows: 1000},
+			Inventory:     &tracker.Inventory{Files: 11, Bytes: 1 << 40},
+			BQJobID:       "job-id",
+			Version:       odd,
+			Annotations:   map[string]string{"z": odd, odd: "a"},
+			Parent:        &parent,
+			Shards:        map[string]tracker.State{"20200601T15": tracker.Parsing, "20200601T16": tracker.Complete},
+			History: []tracker.StateInfo{
+				{State: tracker.Init, Start: when, DetailTime: when},
+				{State: tracker.Failed, Start: when.Add(time.Minute), DetailTime: when.Add(time.Hour), Detail: odd},
+			},
+		},
+		tracker.NewJob("bucket", "ndt", "ndt7", date.In(time.FixedZone("x", 3600))): tracker.NewStatus(),
+		tracker.NewJob("bucket", "ndt", "empty", date):                              {},
+	}
+
+	got, err := jobs.MarshalJSON()
+	rtx.Must(err, "MarshalJSON")
+	type Pair struct {
+		Job   tracker.Job
+		State tracker.Status
+	}
+	pairs := []Pair{}
+	for j, s := range jobs {
+		pairs = append(pairs, Pair{j, s})
+	}
+	want, err := json.Marshal(pairs)
+	rtx.Must(err, "Marshal")
+
+	// Compare the decoded values, since the order of the pairs is random.
+	decode := func(b []byte) map[string]interface{} {
+		var values []map[string]interface{}
+		rtx.Must(json.Unmarshal(b, &values), "Unmarshal %s", b)
+		m := map[string]interface{}{}
+		for _, v := range values {
+			k, err := json.Marshal(v["Job"])
+			rtx.Must(err, "Marshal")
+			m[string(k)] = v["State"]
+		}
+		return m
+	}
+	if g, w := decode(got), decode(want); !reflect.DeepEqual(g, w) {
+		t.Errorf("MarshalJSON() =\n%s\nwant\n%s", got, want)
+	}
+
+	decoded := tracker.JobMap{}
+	rtx.Must(decoded.UnmarshalJSON(got), "UnmarshalJSON")
+	if len(decoded) != len(jobs) {
+		t.Error("Wrong number of jobs", len(decoded))
+	}
+}
@@ -0,0 +1,166 @@
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// maxDurations is the number of recent job durations kept for each
+// experiment/datatype, for ETA estimates.
+const maxDurations = 100
+
+// BacklogFunc returns the number of dates not yet dispatched, keyed by
+// experiment/datatype, e.g. from the job service.
+type BacklogFunc func(now time.Time) map[string]int
+
+// ETA is the estimated time to process the backlog for an experiment/datatype.
+type ETA struct {
+	Name         string        // experiment/datatype
+	Pending      int           // Jobs in the tracker that are not yet complete or failed.
+	Backlog      int           // Dates not yet dispatched.
+	Concurrency  int           // Number of jobs assumed to be processed concurrently.
+	MeanDuration time.Duration // Mean duration of recently completed jobs, or zero if unknown.
+	Remaining    time.Duration // Estimated time remaining, or zero if unknown.
+	Done         time.Time     // Estimated completion time, or zero if unknown.
+}
+
+// Known returns true if there is enough history to make an estimate.
+func (e ETA) Known() bool {
+	return e.MeanDuration > 0
+}
+
+// String returns a human readable summary, e.g.
+// "ndt/ndt7 backlog complete in ~3.2 days".
+func (e ETA) String() string {
+	if e.Pending+e.Backlog == 0 {
+		return e.Name + " backlog complete"
+	}
+	if !e.Known() {
+		return fmt.Sprintf("%s %d jobs remaining, no completed jobs to estimate from", e.Name, e.Pending+e.Backlog)
+	}
+	if e.Remaining >= 24*time.Hour {
+		return fmt.Sprintf("%s backlog complete in ~%.1f days", e.Name, e.Remaining.Hours()/24)
+	}
+	return fmt.Sprintf("%s backlog complete in ~%.1f hours", e.Name, e.Remaining.Hours())
+}
+
+// EstimateRemaining returns the time to process jobs, each taking mean,
+// with the given concurrency.
+func EstimateRemaining(jobs int, mean time.Duration, concurrency int) time.Duration {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return time.Duration(float64(mean) * float64(jobs) / float64(concurrency))
+}
+
+// recordDuration records the duration of a completed job.
+// Caller must hold the Tracker lock.
+func (h *history) recordDuration(job Job, d time.Duration) {
+	key := expType(job)
+	durations := append(h.durations[key], d)
+	if len(durations) > maxDurations {
+		durations = durations[len(durations)-maxDurations:]
+	}
+	h.durations[key] = durations
+}
+
+// SetBacklog sets the source of the undispatched backlog, and the number of
+// jobs expected to be processed concurrently for each experiment/datatype.
+// If concurrency is zero, the number of pending jobs is used instead.
+func (tr *Tracker) SetBacklog(backlog BacklogFunc, concurrency int) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	tr.backlog = backlog
+	tr.concurrency = concurrency
+}
+
+// GetETAs returns the backlog ETAs for each experiment/datatype with pending
+// jobs, undispatched dates or completed job history, sorted by name.
+func (tr *Tracker) GetETAs(now time.Time) []ETA {
+	jobs, _, _ := tr.GetState()
+
+	tr.lock.Lock()
+	backlogFunc, concurrency := tr.backlog, tr.concurrency
+	means := make(map[string]time.Duration, len(tr.history.durations))
+	for k, durations := range tr.history.durations {
+		var total time.Duration
+		for _, d := range durations {
+			total += d
+		}
+		means[k] = total / time.Duration(len(durations))
+	}
+	tr.lock.Unlock()
+
+	etas := make(map[string]*ETA)
+	get := func(name string) *ETA {
+		if etas[name] == nil {
+			etas[name] = &ETA{Name: name}
+		}
+		return etas[name]
+	}
+	for j, s := range jobs {
+		switch s.State() {
+		case Complete, PartialComplete, Failed:
+		default:
+			get(expType(j)).Pending++
+		}
+	}
+	if backlogFunc != nil {
+		for name, n := range backlogFunc(now) {
+			get(name).Backlog += n
+		}
+	}
+	for name := range means {
+		get(name)
+	}
+
+	result := make([]ETA, 0, len(etas))
+	for name, e := range etas {
+		e.MeanDuration = means[name]
+		e.Concurrency = concurrency
+		if e.Concurrency <= 0 {
+			e.Concurrency = e.Pending
+		}
+		if e.Concurrency < 1 {
+			e.Concurrency = 1
+		}
+		if e.Known() {
+			e.Remaining = EstimateRemaining(e.Pending+e.Backlog, e.MeanDuration, e.Concurrency).Round(time.Minute)
+			e.Done = now.Add(e.Remaining)
+		}
+		result = append(result, *e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// etaResponse adds the human readable summary to the ETA JSON.
+type etaResponse struct {
+	ETA
+	Summary string
+}
+
+// ETAHandler serves the backlog ETAs as JSON.
+func (tr *Tracker) ETAHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	etas := tr.GetETAs(time.Now())
+	result := make([]etaResponse, len(etas))
+	for i := range etas {
+		result[i] = etaResponse{ETA: etas[i], Summary: etas[i].String()}
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
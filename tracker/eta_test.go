@@ -0,0 +1,79 @@
+package tracker_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestEstimateRemaining(t *testing.T) {
+	if got := tracker.EstimateRemaining(10, time.Hour, 4); got != 150*time.Minute {
+		t.Error("Expected 2.5 hours, got", got)
+	}
+	if got := tracker.EstimateRemaining(10, time.Hour, 0); got != 10*time.Hour {
+		t.Error("Expected 10 hours, got", got)
+	}
+	eta := tracker.ETA{Name: "ndt/ndt7", Backlog: 77, MeanDuration: time.Hour, Remaining: 77 * time.Hour}
+	if eta.String() != "ndt/ndt7 backlog complete in ~3.2 days" {
+		t.Error("Wrong summary", eta.String())
+	}
+	eta = tracker.ETA{Name: "ndt/ndt7", Backlog: 3}
+	if eta.Known() || !strings.Contains(eta.String(), "3 jobs remaining") {
+		t.Error("Wrong summary", eta.String())
+	}
+}
+
+func TestGetETAs(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	must(t, err)
+	day := func(d int) time.Time { return time.Date(2020, 6, d, 0, 0, 0, 0, time.UTC) }
+	done := tracker.NewJob("bucket", "ndt", "ndt7", day(1))
+	must(t, tk.AddJob(done))
+	must(t, tk.AddJob(tracker.NewJob("bucket", "ndt", "ndt7", day(2))))
+	must(t, tk.AddJob(tracker.NewJob("bucket", "ndt", "ndt7", day(3))))
+	time.Sleep(time.Millisecond)
+	must(t, tk.SetStatus(done, tracker.Complete, ""))
+
+	now := time.Now()
+	tk.SetBacklog(func(time.Time) map[string]int {
+		return map[string]int{"ndt/ndt7": 8, "ndt/annotation": 5}
+	}, 0)
+	etas := tk.GetETAs(now)
+	if len(etas) != 2 {
+		t.Fatal("Expected 2 ETAs", etas)
+	}
+	if etas[0].Name != "ndt/annotation" || etas[0].Known() || etas[0].Backlog != 5 {
+		t.Error("Wrong annotation ETA", etas[0])
+	}
+	ndt7 := etas[1]
+	if ndt7.Pending != 2 || ndt7.Backlog != 8 || ndt7.Concurrency != 2 || !ndt7.Known() {
+		t.Error("Wrong ndt7 ETA", ndt7)
+	}
+	if ndt7.Done.Before(now) {
+		t.Error("Done should not be before now", ndt7.Done)
+	}
+
+	tk.SetBacklog(nil, 5)
+	etas = tk.GetETAs(now)
+	if len(etas) != 1 || etas[0].Concurrency != 5 || etas[0].Backlog != 0 {
+		t.Error("Wrong ETAs", etas)
+	}
+
+	rec := httptest.NewRecorder()
+	tk.ETAHandler(rec, httptest.NewRequest(http.MethodGet, "/eta.json", nil))
+	var got []struct {
+		Name    string
+		Pending int
+		Summary string
+	}
+	must(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	if len(got) != 1 || got[0].Pending != 2 || !strings.HasPrefix(got[0].Summary, "ndt/ndt7 backlog complete in") {
+		t.Error("Wrong ETA response", rec.Body.String())
+	}
+}
@@ -0,0 +1,4 @@
+package tracker
+
+// RefreshSnapshot replaces the snapshot served by GetSnapshot.
+var RefreshSnapshot = (*Tracker).refreshSnapshot
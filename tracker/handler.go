@@ -1,8 +1,8 @@
 package tracker
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
@@ -22,6 +22,16 @@ func UpdateURL(base url.URL, job Job, state State, detail string) *url.URL {
 	return &base
 }
 
+// UpdateURLWithVersion makes an update request URL that also reports the
+// parser release that processed the job.
+func UpdateURLWithVersion(base url.URL, job Job, state State, detail, version string) *url.URL {
+	u := UpdateURL(base, job, state, detail)
+	params := u.Query()
+	params.Add("version", version)
+	u.RawQuery = params.Encode()
+	return u
+}
+
 // HeartbeatURL makes an update request URL.
 func HeartbeatURL(base url.URL, job Job) *url.URL {
 	base.Path += "heartbeat"
@@ -58,90 +68,89 @@ func getJob(jobString string) (Job, error) {
 	if jobString == "" {
 		return job, errors.New("Empty job")
 	}
-	err := json.Unmarshal([]byte(jobString), &job)
+	err := job.Unmarshal([]byte(jobString))
 	return job, err
 }
 
-func (h *Handler) heartbeat(resp http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodPost {
-		resp.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-	if err := req.ParseForm(); err != nil {
-		resp.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	job, err := getJob(req.Form.Get("job"))
-	if err != nil {
-		resp.WriteHeader(http.StatusUnprocessableEntity)
-		return
+// serve returns a handler that decodes v1 or v2 update requests, and
+// applies them with apply, which returns the status code for its error.
+// v1 responses only have the status code.
+func (h *Handler) serve(apply func(u JobUpdate) (int, error)) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		v2 := WantsV2(req)
+		fail := func(status int, err error) {
+			if v2 {
+				WriteError(resp, status, err.Error())
+				return
+			}
+			resp.WriteHeader(status)
+		}
+		if req.Method != http.MethodPost {
+			fail(http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+			return
+		}
+		if v2 && !Acceptable(req) {
+			resp.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		u, err := DecodeUpdate(req)
+		if err != nil {
+			fail(decodeStatus(err), err)
+			return
+		}
+		if status, err := apply(u); err != nil {
+			fail(status, err)
+			return
+		}
+		if v2 {
+			WriteJSON(resp, http.StatusOK, Response{Version: ProtocolV2})
+			return
+		}
+		resp.WriteHeader(http.StatusOK)
 	}
-	if err := h.tracker.Heartbeat(job); err != nil {
-		logx.Debug.Printf("%v %+v\n", err, job)
-		resp.WriteHeader(http.StatusGone)
-		return
-	}
-	resp.WriteHeader(http.StatusOK)
 }
 
-func (h *Handler) update(resp http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodPost {
-		resp.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-	if err := req.ParseForm(); err != nil {
-		resp.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	job, err := getJob(req.Form.Get("job"))
-	if err != nil {
-		resp.WriteHeader(http.StatusUnprocessableEntity)
-		return
+func (h *Handler) heartbeat(u JobUpdate) (int, error) {
+	if err := h.tracker.Heartbeat(u.Job); err != nil {
+		logx.Debug.Printf("%v %+v\n", err, u.Job)
+		return http.StatusGone, err
 	}
-	state := req.Form.Get("state")
-	if state == "" {
-		resp.WriteHeader(http.StatusFailedDependency)
-		return
-	}
-	detail := req.Form.Get("detail")
-
-	if err := h.tracker.SetStatus(job, State(state), detail); err != nil {
-		log.Printf("Not found %+v\n", job)
-		resp.WriteHeader(http.StatusGone)
-		return
-	}
-	resp.WriteHeader(http.StatusOK)
+	return http.StatusOK, nil
 }
 
-func (h *Handler) errorFunc(resp http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodPost {
-		resp.WriteHeader(http.StatusMethodNotAllowed)
-		return
+func (h *Handler) update(u JobUpdate) (int, error) {
+	if u.State == "" {
+		return http.StatusFailedDependency, fmt.Errorf("%w: State", ErrMissingField)
 	}
-	if err := req.ParseForm(); err != nil {
-		resp.WriteHeader(http.StatusBadRequest)
-		return
+	// Parsers may report their release with any update.
+	if u.ParserVersion != "" {
+		if err := h.tracker.SetVersion(u.Job, u.ParserVersion); err != nil {
+			log.Printf("Not found %+v\n", u.Job)
+			return http.StatusGone, err
+		}
 	}
-	jobErr := req.Form.Get("error")
-	job, err := getJob(req.Form.Get("job"))
-	if err != nil {
-		resp.WriteHeader(http.StatusUnprocessableEntity)
-		return
+	if err := h.tracker.SetStatus(u.Job, u.State, u.Detail); err != nil {
+		log.Printf("Not found %+v\n", u.Job)
+		return http.StatusGone, err
 	}
-	if jobErr == "" {
-		resp.WriteHeader(http.StatusFailedDependency)
-		return
+	return http.StatusOK, nil
+}
+
+func (h *Handler) errorFunc(u JobUpdate) (int, error) {
+	if u.Error == "" {
+		return http.StatusFailedDependency, fmt.Errorf("%w: Error", ErrMissingField)
 	}
-	if err := h.tracker.SetStatus(job, ParseError, jobErr); err != nil {
-		resp.WriteHeader(http.StatusGone)
-		return
+	if err := h.tracker.SetStatus(u.Job, ParseError, u.Error); err != nil {
+		return http.StatusGone, err
 	}
-	resp.WriteHeader(http.StatusOK)
+	return http.StatusOK, nil
 }
 
-// Register registers the handlers on the server.
+// Register registers the handlers on the server, at the v1 and v2 paths.
 func (h *Handler) Register(mux *http.ServeMux) {
-	mux.HandleFunc("/heartbeat", h.heartbeat)
-	mux.HandleFunc("/update", h.update)
-	mux.HandleFunc("/error", h.errorFunc)
+	for _, prefix := range []string{"/", "/" + ProtocolV2 + "/"} {
+		mux.HandleFunc(prefix+"heartbeat", h.serve(h.heartbeat))
+		mux.HandleFunc(prefix+"update", h.serve(h.update))
+		mux.HandleFunc(prefix+"error", h.serve(h.errorFunc))
+	}
 }
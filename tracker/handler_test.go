@@ -2,10 +2,12 @@ package tracker_test
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -88,6 +90,15 @@ func TestUpdateHandler(t *testing.T) {
 		t.Fatal("update failed", stat)
 	}
 
+	// The parser may report its version with any update.
+	url = tracker.UpdateURLWithVersion(server, job, tracker.ParseComplete, "", "v2.3.4")
+	postAndExpect(t, url, http.StatusOK)
+	stat, err = tk.GetStatus(job)
+	must(t, err)
+	if stat.State() != tracker.ParseComplete || stat.Version != "v2.3.4" {
+		t.Fatal("version update failed", stat)
+	}
+
 	url = tracker.UpdateURL(server, job, tracker.Complete, "")
 	postAndExpect(t, url, http.StatusOK)
 
@@ -159,3 +170,78 @@ func TestErrorHandler(t *testing.T) {
 		t.Fatal("Expected JobNotFound", err)
 	}
 }
+
+func postJSON(t *testing.T, u url.URL, path, contentType, body string) (int, tracker.Response) {
+	u.Path = path
+	resp, err := http.Post(u.String(), contentType, strings.NewReader(body))
+	must(t, err)
+	defer resp.Body.Close()
+	r := tracker.Response{}
+	if resp.Header.Get("Content-Type") == tracker.MediaTypeV2 {
+		must(t, json.NewDecoder(resp.Body).Decode(&r))
+	}
+	return resp.StatusCode, r
+}
+
+func TestV2Handler(t *testing.T) {
+	server, tk, job := testSetup(t)
+	b, err := json.Marshal(tracker.JobUpdate{Job: job, State: tracker.Parsing, ParserVersion: "v2.3.4"})
+	must(t, err)
+	update := string(b)
+
+	// Unknown jobs get a JSON error.
+	status, r := postJSON(t, server, "/v2/update", tracker.MediaTypeV2, update)
+	if status != http.StatusGone || r.Version != tracker.ProtocolV2 || r.Error == "" {
+		t.Error("Expected Gone", status, r)
+	}
+	tk.AddJob(job)
+
+	tests := []struct {
+		name, path, contentType, body string
+		want                          int
+	}{
+		{"form", "/v2/update", "application/x-www-form-urlencoded", "", http.StatusUnsupportedMediaType},
+		{"bad json", "/v2/update", "application/json", "{", http.StatusBadRequest},
+		{"version", "/v2/update", "application/json", `{"Version":"v3","Job":` + string(job.Marshal()) + `}`, http.StatusBadRequest},
+		{"no job", "/v2/update", "application/json", `{"State":"parsing"}`, http.StatusUnprocessableEntity},
+		{"no state", "/v2/update", "application/json", `{"Job":` + string(job.Marshal()) + `}`, http.StatusFailedDependency},
+		{"no error", "/v2/error", "application/json", `{"Job":` + string(job.Marshal()) + `}`, http.StatusFailedDependency},
+		{"update", "/v2/update", tracker.MediaTypeV2, update, http.StatusOK},
+		{"unknown fields", "/v2/heartbeat", "application/json", `{"New":1,"Job":` + string(job.Marshal()) + `}`, http.StatusOK},
+		// v1 paths accept v2 bodies too.
+		{"v1 path", "/heartbeat", "application/json", `{"Job":` + string(job.Marshal()) + `}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if status, r := postJSON(t, server, tt.path, tt.contentType, tt.body); status != tt.want {
+			t.Errorf("%s: got %d %+v, want %d", tt.name, status, r, tt.want)
+		}
+	}
+	stat, err := tk.GetStatus(job)
+	must(t, err)
+	if stat.State() != tracker.Parsing || stat.Version != "v2.3.4" {
+		t.Error("update failed", stat)
+	}
+
+	// Parsers that don't accept JSON are refused.
+	req, err := http.NewRequest(http.MethodPost, server.String()+"/v2/heartbeat", strings.NewReader(update))
+	must(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	must(t, err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotAcceptable {
+		t.Error("Expected NotAcceptable", resp.Status)
+	}
+
+	b, err = json.Marshal(tracker.JobUpdate{Job: job, Error: "bad archive"})
+	must(t, err)
+	if status, _ := postJSON(t, server, "/v2/error", "application/json", string(b)); status != http.StatusOK {
+		t.Error("error failed", status)
+	}
+	stat, err = tk.GetStatus(job)
+	must(t, err)
+	if stat.State() != tracker.ParseError || stat.Detail() != "bad archive" {
+		t.Error("Wrong state:", stat)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
@@ -18,7 +19,10 @@ import (
 
 	"github.com/m-lab/go/cloud/bqx"
 
+	"github.com/m-lab/etl-gardener/civil"
+	"github.com/m-lab/etl-gardener/logging"
 	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/persistence"
 )
 
 // Job describes a reprocessing "Job", which includes
@@ -30,6 +34,10 @@ type Job struct {
 	Date       time.Time
 	// Filter is an optional regex to apply to ArchiveURL names
 	Filter string `json:",omitempty"`
+	// Prefix optionally limits the job to the task files in the day's archive
+	// directory whose names start with Prefix, e.g. 20200601T15 for a single
+	// hour.
+	Prefix string `json:",omitempty"`
 }
 
 // JobWithTarget specifies a type/date job, and a destination
@@ -40,6 +48,10 @@ type JobWithTarget struct {
 	// either a BigQuery table, or a GCS bucket/prefix string.
 	TargetTable           bqx.PDT `json:",omitempty"`
 	TargetBucketAndPrefix string  `json:",omitempty"` // gs://bucket/prefix
+	// ArchivePath is the GCS path prefix of the job's task files, for
+	// sources with a custom path template.  Otherwise it is empty, and the
+	// standard layout applies.
+	ArchivePath string `json:",omitempty"`
 }
 
 func (j JobWithTarget) String() string {
@@ -48,12 +60,12 @@ func (j JobWithTarget) String() string {
 
 // NewJob creates a new job object.
 // DEPRECATED
-// NB:  The date will be converted to UTC and truncated to day boundary!
+// NB:  The date will be converted to the UTC date that contains it!
 func NewJob(bucket, exp, typ string, date time.Time) Job {
 	return Job{Bucket: bucket,
 		Experiment: exp,
 		Datatype:   typ,
-		Date:       date.UTC().Truncate(24 * time.Hour),
+		Date:       civil.Date(date),
 	}
 }
 
@@ -80,24 +92,33 @@ func (j Job) failureMetric(state State, errString string) {
 
 // Target adds a Target to the job, returning a JobWithTarget
 func (j Job) Target(target string) (JobWithTarget, error) {
+	archivePath := ""
+	if j.pathTemplate() != nil {
+		archivePath = j.Path()
+	}
 	if strings.HasPrefix(target, "gs://") {
-		return JobWithTarget{Job: j, TargetBucketAndPrefix: target}, nil
+		return JobWithTarget{Job: j, TargetBucketAndPrefix: target, ArchivePath: archivePath}, nil
 	}
 	pdt, err := bqx.ParsePDT(target)
 	if err != nil {
 		return JobWithTarget{}, err
 	}
-	return JobWithTarget{Job: j, TargetTable: pdt}, nil
+	return JobWithTarget{Job: j, TargetTable: pdt, ArchivePath: archivePath}, nil
 }
 
-// Path returns the GCS path prefix to the job data.
+// Path returns the GCS path prefix to the job data, including the Prefix,
+// if any.  Sources with a path template use it instead of the standard
+// layout.  See SetPathTemplate.
 func (j Job) Path() string {
+	if t := j.pathTemplate(); t != nil {
+		return j.templatePath(t)
+	}
 	if len(j.Datatype) > 0 {
-		return fmt.Sprintf("gs://%s/%s/%s/%s",
-			j.Bucket, j.Experiment, j.Datatype, j.Date.Format("2006/01/02/"))
+		return fmt.Sprintf("gs://%s/%s/%s/%s%s",
+			j.Bucket, j.Experiment, j.Datatype, j.Date.Format("2006/01/02/"), j.Prefix)
 	}
-	return fmt.Sprintf("gs://%s/%s/%s",
-		j.Bucket, j.Experiment, j.Date.Format("2006/01/02/"))
+	return fmt.Sprintf("gs://%s/%s/%s%s",
+		j.Bucket, j.Experiment, j.Date.Format("2006/01/02/"), j.Prefix)
 }
 
 // Marshal marshals the job to json.
@@ -107,18 +128,77 @@ func (j Job) Marshal() []byte {
 }
 
 func (j Job) String() string {
-	return fmt.Sprintf("%s:%s/%s", j.Date.Format("20060102"), j.Experiment, j.Datatype)
+	return string(j.appendString(make([]byte, 0, 64)))
+}
+
+// appendString appends the job's String, without allocating for each field.
+func (j Job) appendString(b []byte) []byte {
+	y, m, d := j.Date.Date()
+	if y < 1000 || y > 9999 {
+		b = j.Date.AppendFormat(b, "20060102")
+	} else {
+		b = append(b, byte('0'+y/1000), byte('0'+y/100%10), byte('0'+y/10%10), byte('0'+y%10),
+			byte('0'+m/10), byte('0'+m%10), byte('0'+d/10), byte('0'+d%10))
+	}
+	b = append(b, ':')
+	b = append(b, j.Experiment...)
+	b = append(b, '/')
+	b = append(b, j.Datatype...)
+	if j.Prefix != "" {
+		b = append(b, '/')
+		b = append(b, j.Prefix...)
+		b = append(b, '*')
+	}
+	return b
+}
+
+// Logger returns a structured logger that attaches the job fields to each line.
+func (j Job) Logger() *logging.Logger {
+	l := logging.With("job", j.Key()).
+		With("experiment", j.Experiment).
+		With("datatype", j.Datatype).
+		With("date", j.Date.Format("2006-01-02"))
+	if j.Prefix != "" {
+		l = l.With("prefix", j.Prefix)
+	}
+	return l
+}
+
+// validPrefix matches the characters allowed in a Job Prefix, which is
+// used in GCS paths and SQL string literals.
+var validPrefix = regexp.MustCompile(`^[A-Za-z0-9._-]*$`)
+
+// Validate returns ErrInvalidPrefix if the Prefix contains characters other
+// than letters, digits, '.', '_' and '-'.
+func (j Job) Validate() error {
+	if !validPrefix.MatchString(j.Prefix) {
+		return fmt.Errorf("%w: %q", ErrInvalidPrefix, j.Prefix)
+	}
+	return nil
+}
+
+// samePartition returns true if the jobs use the same tmp partition, i.e.
+// they have the same experiment, datatype and date.
+func (j Job) samePartition(other Job) bool {
+	return j.Experiment == other.Experiment && j.Datatype == other.Datatype &&
+		j.Date.Equal(other.Date)
 }
 
 // Error declarations
 var (
-	ErrClientIsNil            = errors.New("nil datastore client")
+	ErrClientIsNil            = errors.New("nil datastore client or saver")
 	ErrJobAlreadyExists       = errors.New("job already exists")
 	ErrJobNotFound            = errors.New("job not found")
+	ErrInvalidJobKey          = errors.New("invalid job key")
 	ErrJobIsObsolete          = errors.New("job is obsolete")
 	ErrInvalidStateTransition = errors.New("invalid state transition")
 	ErrNotYetImplemented      = errors.New("not yet implemented")
 	ErrNoChange               = errors.New("no change since last save")
+	ErrSaveStalled            = errors.New("tracker save stalled")
+	ErrSaveFailing            = errors.New("tracker saves failing")
+	ErrInvalidPrefix          = errors.New("invalid job prefix")
+	ErrPartitionBusy          = errors.New("another job for the partition is in flight")
+	ErrInvalidShards          = errors.New("invalid shards")
 )
 
 // State types are used for the Status.State values
@@ -132,6 +212,7 @@ type State string
 // details, e.g. the dedup query.
 const (
 	Init          State = "init"
+	Sharded       State = "sharded" // Waiting for its shards to be parsed.
 	Parsing       State = "parsing"
 	ParseError    State = "parseError"
 	ParseComplete State = "postProcessing" // Ready for post processing, but not started yet.
@@ -139,11 +220,18 @@ const (
 	Loading       State = "loading"
 	Deduplicating State = "deduplicating"
 	Copying       State = "copying"
+	Validating    State = "validating" // Comparing archive, parser and BigQuery counts.
+	Publishing    State = "publishing" // Copying to the serving project.
 	Joining       State = "joining"
 	Deleting      State = "deleting"
 	Finishing     State = "finishing"
+	Cancelling    State = "cancelling" // Cancelled, until its parser or action stops.  See Cancel.
 	Failed        State = "failed"
 	Complete      State = "complete"
+
+	// PartialComplete is used for the current date, which is processed
+	// incrementally, and only marked Complete after midnight UTC.
+	PartialComplete State = "partialComplete"
 )
 
 // StateInfo describes each state in processing history.
@@ -170,6 +258,18 @@ func (si *StateInfo) setDetail(detail string) {
 	}
 }
 
+// ParseStats holds the counts reported by the parser when it completes a job.
+type ParseStats struct {
+	Files int64 // Number of task files parsed.
+	Rows  int64 // Number of rows committed to BigQuery.
+}
+
+// Inventory describes the task files found in the GCS archive for a job.
+type Inventory struct {
+	Files int64 // Number of task files.
+	Bytes int64 // Total size of task files.
+}
+
 // A Status describes the state of a bucket/exp/type/YYYY/MM/DD job.
 // Completed jobs are removed from the persistent store.
 // Errored jobs are maintained in the persistent store for debugging.
@@ -180,6 +280,28 @@ type Status struct {
 
 	UpdateCount int // Number of updates
 
+	// ParseStats are the counts reported by the parser on completion, if any.
+	ParseStats *ParseStats `json:",omitempty"`
+	// Inventory is the archive listing taken when parsing completed, if any.
+	Inventory *Inventory `json:",omitempty"`
+	// BQJobID is the in-flight BigQuery job for the current state, if any.
+	// It allows the job to be resumed if gardener restarts.
+	BQJobID string `json:",omitempty"`
+	// Version is the release of the parser that processed the job, as
+	// reported by the parser, if any.  It is kept on the Status, rather
+	// than the Job, so that it doesn't change the job's identity.
+	Version string `json:",omitempty"`
+	// Annotations hold free form key/value notes about the job, such as the
+	// external worker that holds a lease on it.  Annotations are replaced,
+	// not modified, since the map is shared with copies of the Status.
+	Annotations map[string]string `json:",omitempty"`
+
+	// Parent is the sharded job that a shard belongs to, if any.
+	Parent *Job `json:",omitempty"`
+	// Shards holds the state of each shard of a sharded job, by prefix.
+	// Like Annotations, the map is replaced, not modified.
+	Shards map[string]State `json:",omitempty"`
+
 	// History has shared backing store.  Copy on write is used to avoid
 	// changing the underlying StateInfo that is shared by the tracker
 	// JobMap and accessed concurrently by other goroutines.
@@ -266,7 +388,8 @@ func (s *Status) Error() string {
 	return ""
 }
 
-// UpdateMetrics handles the StateTimeHistogram and StateDate metric updates.
+// UpdateMetrics handles the StateTimeHistogram, StateDate, and state transition
+// metric updates.
 // Not thread-safe.  Caller must hold the job's lock.
 func (s *Status) updateMetrics(job Job) {
 	new := s.LastStateInfo()
@@ -278,6 +401,13 @@ func (s *Status) updateMetrics(job Job) {
 		old := s.History[len(s.History)-2]
 		timeInState := time.Since(old.Start)
 		metrics.StateTimeHistogram.WithLabelValues(job.Experiment, job.Datatype, string(old.State)).Observe(timeInState.Seconds())
+		metrics.StateTransitionCount.WithLabelValues(job.Experiment, job.Datatype, string(old.State), string(new.State)).Inc()
+		switch new.State {
+		case Failed:
+			metrics.StateFailureCount.WithLabelValues(job.Experiment, job.Datatype, string(old.State)).Inc()
+		case Complete:
+			metrics.JobDurationHistogram.WithLabelValues(job.Experiment, job.Datatype).Observe(time.Since(s.History[0].Start).Seconds())
+		}
 		// old state will never be Failed, so the label is just the old.State.
 		metrics.TasksInFlight.WithLabelValues(job.Experiment, job.Datatype, string(old.State)).Dec()
 	}
@@ -329,20 +459,23 @@ func NewStatus() Status {
 // TODO implement datastore.PropertyLoadSaver
 type JobMap map[Job]Status
 
-// MarshalJSON implements json.Marshal
+// MarshalJSON implements json.Marshal, as an array of Job/State pairs.  See
+// encode.go.
 func (jobs JobMap) MarshalJSON() ([]byte, error) {
-	type Pair struct {
-		Job   Job
-		State Status
-	}
-	pairs := make([]Pair, len(jobs))
-	i := 0
+	buf := getBuffer()
+	defer putBuffer(buf)
+	b := append(*buf, '[')
+	first := true
 	for k, v := range jobs {
-		pairs[i].Job = k
-		pairs[i].State = v
-		i++
+		if !first {
+			b = append(b, ',')
+		}
+		first = false
+		b = appendPair(b, &k, "State", &v)
 	}
-	return json.Marshal(&pairs)
+	b = append(b, ']')
+	*buf = b
+	return append([]byte(nil), b...), nil
 }
 
 // UnmarshalJSON implements json.UnmarshalJSON
@@ -429,29 +562,73 @@ func (jobs JobMap) WriteHTML(w io.Writer) error {
 	return err
 }
 
-// saverStruct is used only for saving and loading from datastore.
+// saverStruct is used only for saving and loading the tracker state.
 type saverStruct struct {
 	SaveTime time.Time
 	LastInit Job
 	// Jobs is encoded as json, because datastore doesn't handle maps.
 	Jobs []byte `datastore:",noindex"`
+	// LogStart is the sequence number of the first delta saved after
+	// this snapshot.
+	LogStart int64
+}
+
+// GetName implements persistence.StateObject.
+func (s *saverStruct) GetName() string {
+	return "jobs"
+}
+
+// GetKind implements persistence.StateObject.
+func (s *saverStruct) GetKind() string {
+	return "tracker"
+}
+
+// clientSaver implements persistence.Saver for the tracker state, using a
+// datastore client and a fixed key.  Deltas are stored with their own kind
+// and name, in the key's namespace.
+type clientSaver struct {
+	client dsiface.Client
+	key    *datastore.Key
+}
+
+func (cs *clientSaver) keyFor(o persistence.StateObject) *datastore.Key {
+	if _, ok := o.(*deltaStruct); !ok {
+		return cs.key
+	}
+	k := datastore.NameKey(o.GetKind(), o.GetName(), nil)
+	k.Namespace = cs.key.Namespace
+	return k
+}
+
+func (cs *clientSaver) Save(ctx context.Context, o persistence.StateObject) error {
+	_, err := cs.client.Put(ctx, cs.keyFor(o), o)
+	return err
+}
+
+func (cs *clientSaver) Delete(ctx context.Context, o persistence.StateObject) error {
+	return cs.client.Delete(ctx, cs.keyFor(o))
+}
+
+func (cs *clientSaver) Fetch(ctx context.Context, o persistence.StateObject) error {
+	return cs.client.Get(ctx, cs.keyFor(o), o)
 }
 
-func loadFromDatastore(ctx context.Context, client dsiface.Client, key *datastore.Key) (saverStruct, error) {
+func loadState(ctx context.Context, saver persistence.Saver) (saverStruct, error) {
 	state := saverStruct{Jobs: make([]byte, 0)}
-	if client == nil {
+	if saver == nil {
 		return state, ErrClientIsNil
 	}
 
-	err := client.Get(ctx, key, &state) // This should error?
+	err := saver.Fetch(ctx, &state) // This should error?
 	return state, err
 }
 
-// loadJobMap loads the persisted map of jobs in flight.
-func loadJobMap(ctx context.Context, client dsiface.Client, key *datastore.Key) (JobMap, Job, error) {
-	state, err := loadFromDatastore(ctx, client, key)
+// loadJobMap loads the persisted map of jobs in flight, and the sequence
+// number of the first delta to replay over it.
+func loadJobMap(ctx context.Context, saver persistence.Saver) (JobMap, Job, int64, error) {
+	state, err := loadState(ctx, saver)
 	if err != nil {
-		return nil, Job{}, err
+		return nil, Job{}, 0, err
 	}
 	log.Println("Last save:", state.SaveTime.Format("01/02T15:04"))
 	log.Println(string(state.Jobs))
@@ -467,6 +644,6 @@ func loadJobMap(ctx context.Context, client dsiface.Client, key *datastore.Key)
 			log.Fatalf("Empty State history %+v : %+v\n", j, s)
 		}
 	}
-	return jobMap, state.LastInit, nil
+	return jobMap, state.LastInit, state.LogStart, nil
 
 }
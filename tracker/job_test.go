@@ -1,8 +1,13 @@
 package tracker_test
 
 import (
+	"context"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/m-lab/etl-gardener/metrics"
 	"github.com/m-lab/etl-gardener/tracker"
 )
 
@@ -69,3 +74,35 @@ func TestStatusFailure(t *testing.T) {
 	}
 	t.Log(s.Detail())
 }
+
+func TestStateMetrics(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	must(t, err)
+	initLoading := metrics.StateTransitionCount.WithLabelValues("metrics", "type", "init", "loading")
+	loadingComplete := metrics.StateTransitionCount.WithLabelValues("metrics", "type", "loading", "complete")
+	loadingFailed := metrics.StateFailureCount.WithLabelValues("metrics", "type", "loading")
+	before := []float64{testutil.ToFloat64(initLoading), testutil.ToFloat64(loadingComplete), testutil.ToFloat64(loadingFailed)}
+
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	complete := tracker.NewJob("bucket", "metrics", "type", date)
+	failed := tracker.NewJob("bucket", "metrics", "type", date.AddDate(0, 0, 1))
+	must(t, tk.AddJob(complete))
+	must(t, tk.AddJob(failed))
+	must(t, tk.SetStatus(complete, tracker.Loading, ""))
+	must(t, tk.SetStatus(complete, tracker.Complete, ""))
+	must(t, tk.SetStatus(failed, tracker.Loading, ""))
+	must(t, tk.SetJobError(failed, "load failed"))
+
+	if n := testutil.ToFloat64(initLoading) - before[0]; n != 2 {
+		t.Error("Expected 2 init->loading transitions", n)
+	}
+	if n := testutil.ToFloat64(loadingComplete) - before[1]; n != 1 {
+		t.Error("Expected 1 loading->complete transition", n)
+	}
+	if n := testutil.ToFloat64(loadingFailed) - before[2]; n != 1 {
+		t.Error("Expected 1 failure in loading", n)
+	}
+	if n := testutil.CollectAndCount(metrics.JobDurationHistogram); n == 0 {
+		t.Error("Expected job duration series")
+	}
+}
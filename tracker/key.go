@@ -0,0 +1,96 @@
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/m-lab/etl-gardener/civil"
+)
+
+// Key returns the canonical key of the job, e.g.
+// "archive-measurement-lab/ndt/ndt7/2019-03-04".  The prefix, if any, is a
+// fifth element, and the filter, if any, a "filter" query parameter.  Each
+// element is escaped, so keys are safe in URLs and persisted names.  Keys
+// identify jobs in structured logs, error reports and the admin audit log,
+// and are accepted wherever a JSON job is, by Unmarshal.  ParseJobKey
+// reverses Key.
+func (j Job) Key() string {
+	parts := []string{url.PathEscape(j.Bucket), url.PathEscape(j.Experiment),
+		url.PathEscape(j.Datatype), civil.Format(j.Date)}
+	if j.Prefix != "" {
+		parts = append(parts, url.PathEscape(j.Prefix))
+	}
+	key := strings.Join(parts, "/")
+	if j.Filter != "" {
+		key += "?" + url.Values{"filter": {j.Filter}}.Encode()
+	}
+	return key
+}
+
+// ParseJobKey parses a job from its Key.
+func ParseJobKey(key string) (Job, error) {
+	path, query := key, ""
+	if i := strings.IndexByte(key, '?'); i >= 0 {
+		path, query = key[:i], key[i+1:]
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) != 4 && len(parts) != 5 {
+		return Job{}, fmt.Errorf("%w: %q", ErrInvalidJobKey, key)
+	}
+	for i := range parts {
+		p, err := url.PathUnescape(parts[i])
+		if err != nil {
+			return Job{}, fmt.Errorf("%w: %q", ErrInvalidJobKey, key)
+		}
+		parts[i] = p
+	}
+	date, err := civil.Parse(parts[3])
+	if err != nil || parts[1] == "" || parts[2] == "" {
+		return Job{}, fmt.Errorf("%w: %q", ErrInvalidJobKey, key)
+	}
+	j := Job{Bucket: parts[0], Experiment: parts[1], Datatype: parts[2], Date: date}
+	if len(parts) == 5 {
+		if parts[4] == "" {
+			return Job{}, fmt.Errorf("%w: %q", ErrInvalidJobKey, key)
+		}
+		j.Prefix = parts[4]
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return Job{}, fmt.Errorf("%w: %q", ErrInvalidJobKey, key)
+	}
+	j.Filter = values.Get("filter")
+	return j, nil
+}
+
+// Unmarshal sets the job from its JSON encoding, as produced by Marshal,
+// or from its Key.  A JSON date is converted to the UTC date containing it,
+// as keys are.
+func (j *Job) Unmarshal(b []byte) error {
+	s := strings.TrimSpace(string(b))
+	if strings.HasPrefix(s, "{") {
+		var job Job
+		if err := json.Unmarshal([]byte(s), &job); err != nil {
+			return err
+		}
+		job.Date = civil.Date(job.Date)
+		*j = job
+		return nil
+	}
+	job, err := ParseJobKey(s)
+	if err != nil {
+		return err
+	}
+	*j = job
+	return nil
+}
+
+// Partition returns the job's experiment, datatype and date, which identify
+// its tmp and raw partitions, e.g. as a map key shared by the prefix jobs of
+// a date.  The bucket, filter and prefix are cleared, and the date is
+// normalized to its UTC date, so that equal partitions compare equal.
+func (j Job) Partition() Job {
+	return Job{Experiment: j.Experiment, Datatype: j.Datatype, Date: civil.Date(j.Date)}
+}
@@ -0,0 +1,102 @@
+package tracker_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestJob_Key(t *testing.T) {
+	date := time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC)
+	prefix := tracker.NewJob("bucket", "ndt", "ndt7", date)
+	prefix.Prefix = "20190304T15"
+	filtered := tracker.NewJob("bucket", "ndt", "ndt7", date)
+	filtered.Filter = `.*T??:??:.*Z-mlab1-.*`
+	tests := []struct {
+		job  tracker.Job
+		want string
+	}{
+		{tracker.NewJob("archive-measurement-lab", "ndt", "ndt7", date), "archive-measurement-lab/ndt/ndt7/2019-03-04"},
+		{prefix, "bucket/ndt/ndt7/2019-03-04/20190304T15"},
+		{filtered, "bucket/ndt/ndt7/2019-03-04?filter=.%2AT%3F%3F%3A%3F%3F%3A.%2AZ-mlab1-.%2A"},
+		{tracker.NewJob("", "a/b", "c d", date), "/a%2Fb/c%20d/2019-03-04"},
+	}
+	for _, tt := range tests {
+		key := tt.job.Key()
+		if key != tt.want {
+			t.Errorf("Key() = %q, want %q", key, tt.want)
+		}
+		got, err := tracker.ParseJobKey(key)
+		if err != nil || got != tt.job {
+			t.Errorf("ParseJobKey(%q) = %+v, %v", key, got, err)
+		}
+	}
+}
+
+func TestParseJobKey(t *testing.T) {
+	for _, key := range []string{
+		"",
+		"bucket/ndt/ndt7",
+		"bucket/ndt/ndt7/20190304",
+		"bucket//ndt7/2019-03-04",
+		"bucket/ndt/ndt7/2019-03-04/",
+		"bucket/ndt/ndt7/2019-03-04/prefix/extra",
+		"bucket/ndt/nd%zz/2019-03-04",
+		"bucket/ndt/ndt7/2019-03-04?filter=%zz",
+	} {
+		if _, err := tracker.ParseJobKey(key); !errors.Is(err, tracker.ErrInvalidJobKey) {
+			t.Errorf("ParseJobKey(%q) expected ErrInvalidJobKey, got %v", key, err)
+		}
+	}
+}
+
+func TestJob_Unmarshal(t *testing.T) {
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC))
+	job.Prefix = "20190304T15"
+	for _, b := range [][]byte{job.Marshal(), []byte(job.Key()), []byte(" " + job.Key() + "\n")} {
+		var got tracker.Job
+		if err := got.Unmarshal(b); err != nil || got != job {
+			t.Errorf("Unmarshal(%q) = %+v, %v", b, got, err)
+		}
+	}
+	var got tracker.Job
+	if err := got.Unmarshal([]byte(`{"Bucket":`)); err == nil {
+		t.Error("Expected JSON error")
+	}
+	if err := got.Unmarshal([]byte("bucket/ndt")); !errors.Is(err, tracker.ErrInvalidJobKey) {
+		t.Error("Expected ErrInvalidJobKey, got", err)
+	}
+}
+
+func TestJob_KeyNearMidnight(t *testing.T) {
+	// 21:00 in New York is the next UTC date.
+	ny := time.FixedZone("EDT", -4*3600)
+	evening := tracker.Job{Bucket: "bucket", Experiment: "ndt", Datatype: "ndt7",
+		Date: time.Date(2020, 2, 28, 21, 0, 0, 0, ny)}
+	if key := evening.Key(); key != "bucket/ndt/ndt7/2020-02-29" {
+		t.Error("Key should use the UTC date", key)
+	}
+	var got tracker.Job
+	rtx.Must(got.Unmarshal(evening.Marshal()), "unmarshal")
+	if got != tracker.NewJob("bucket", "ndt", "ndt7", evening.Date) || got.Key() != evening.Key() {
+		t.Error("Unmarshal should use the UTC date", got)
+	}
+}
+
+func TestJob_Partition(t *testing.T) {
+	date := time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC)
+	prefix := tracker.NewJob("bucket", "ndt", "ndt7", date)
+	prefix.Prefix = "20190304T15"
+	other := tracker.Job{Bucket: "other", Experiment: "ndt", Datatype: "ndt7",
+		Date: date.In(time.FixedZone("EST", -5*3600))}
+	if prefix.Partition() != other.Partition() {
+		t.Error("Expected same partition", prefix.Partition(), other.Partition())
+	}
+	if prefix.Partition() == tracker.NewJob("bucket", "ndt", "ndt7", date.AddDate(0, 0, 1)).Partition() {
+		t.Error("Expected different partitions")
+	}
+}
@@ -0,0 +1,42 @@
+package tracker
+
+import (
+	"time"
+
+	"github.com/m-lab/etl-gardener/civil"
+)
+
+// Lane is the kind of processing a job belongs to.  Daily and reprocessing
+// jobs are dispatched, limited and reported separately.
+type Lane string
+
+// Lanes
+const (
+	Daily     Lane = "daily"     // Jobs for yesterday or today.
+	Reprocess Lane = "reprocess" // Jobs for earlier dates.
+)
+
+// Lane returns the lane of the job at time now.  Jobs for yesterday or
+// today are daily processing.  All others are reprocessing.
+func (j Job) Lane(now time.Time) Lane {
+	yesterday := civil.AddDays(now, -1)
+	if j.Date.Before(yesterday) {
+		return Reprocess
+	}
+	return Daily
+}
+
+// InFlight returns the number of jobs in each lane that have not completed
+// or failed.
+func (tr *Tracker) InFlight(now time.Time) map[Lane]int {
+	jobs, _, _ := tr.GetState()
+	counts := map[Lane]int{Daily: 0, Reprocess: 0}
+	for j, s := range jobs {
+		switch s.State() {
+		case Complete, PartialComplete, Failed:
+		default:
+			counts[j.Lane(now)]++
+		}
+	}
+	return counts
+}
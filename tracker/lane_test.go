@@ -0,0 +1,54 @@
+package tracker_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestJob_Lane(t *testing.T) {
+	now := time.Date(2020, 6, 10, 3, 0, 0, 0, time.UTC)
+	tests := []struct {
+		date time.Time
+		want tracker.Lane
+	}{
+		{time.Date(2020, 6, 10, 0, 0, 0, 0, time.UTC), tracker.Daily},
+		{time.Date(2020, 6, 9, 0, 0, 0, 0, time.UTC), tracker.Daily},
+		{time.Date(2020, 6, 8, 0, 0, 0, 0, time.UTC), tracker.Reprocess},
+	}
+	for _, tt := range tests {
+		if got := tracker.NewJob("bucket", "ndt", "ndt7", tt.date).Lane(now); got != tt.want {
+			t.Error(tt.date, "expected", tt.want, "got", got)
+		}
+	}
+}
+
+func TestLanes(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	must(t, err)
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	yesterday := tracker.NewJob("bucket", "ndt", "ndt7", today.AddDate(0, 0, -1))
+	must(t, tk.AddJob(yesterday))
+	for d := 2; d <= 4; d++ {
+		must(t, tk.AddJob(tracker.NewJob("bucket", "ndt", "ndt7", today.AddDate(0, 0, -d))))
+	}
+	must(t, tk.SetJobError(tracker.NewJob("bucket", "ndt", "ndt7", today.AddDate(0, 0, -4)), "load failed"))
+
+	inFlight := tk.InFlight(time.Now())
+	if inFlight[tracker.Daily] != 1 || inFlight[tracker.Reprocess] != 2 {
+		t.Error("Wrong in flight counts", inFlight)
+	}
+
+	s := tk.GetSummary()
+	daily, reprocess := s.Lanes[tracker.Daily], s.Lanes[tracker.Reprocess]
+	if daily.Counts[tracker.Init] != 1 || !daily.OldestPending["ndt/ndt7"].Equal(yesterday.Date) {
+		t.Error("Wrong daily summary", daily)
+	}
+	if reprocess.Counts[tracker.Init] != 2 || reprocess.Counts[tracker.Failed] != 1 ||
+		!reprocess.OldestPending["ndt/ndt7"].Equal(today.AddDate(0, 0, -3)) {
+		t.Error("Wrong reprocess summary", reprocess)
+	}
+}
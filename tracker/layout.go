@@ -0,0 +1,73 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ErrInvalidPathTemplate is returned by SetPathTemplate for bad templates.
+var ErrInvalidPathTemplate = errors.New("invalid path template")
+
+// pathTemplates holds the archive layouts of sources that don't use the
+// standard <experiment>/<datatype>/YYYY/MM/DD/ layout, keyed by
+// bucket/experiment/datatype.
+var (
+	pathLock      sync.RWMutex
+	pathTemplates = map[string]*template.Template{}
+)
+
+// PathVars are the variables available to path templates.
+type PathVars struct {
+	Experiment string
+	Datatype   string
+	Date       time.Time
+}
+
+// SetPathTemplate sets the archive layout for a source's jobs.  The
+// template renders the date directory within the bucket, and may use
+// {{.Experiment}}, {{.Datatype}} and {{.Date}}, e.g.
+// `archive/{{.Experiment}}/{{.Date.Format "2006/01/02"}}`.  An empty
+// template restores the standard layout.  It should be called at startup,
+// before jobs are created.
+func SetPathTemplate(bucket, experiment, datatype, tmpl string) error {
+	pathLock.Lock()
+	defer pathLock.Unlock()
+	key := bucket + "/" + experiment + "/" + datatype
+	if tmpl == "" {
+		delete(pathTemplates, key)
+		return nil
+	}
+	t, err := template.New(key).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPathTemplate, err)
+	}
+	// Check that the template renders.
+	if err := t.Execute(&strings.Builder{}, PathVars{Experiment: experiment, Datatype: datatype}); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPathTemplate, err)
+	}
+	pathTemplates[key] = t
+	return nil
+}
+
+// pathTemplate returns the job's path template, or nil for the standard layout.
+func (j Job) pathTemplate() *template.Template {
+	pathLock.RLock()
+	defer pathLock.RUnlock()
+	return pathTemplates[j.Bucket+"/"+j.Experiment+"/"+j.Datatype]
+}
+
+// templatePath renders the job's date directory with the path template.
+func (j Job) templatePath(t *template.Template) string {
+	b := strings.Builder{}
+	if err := t.Execute(&b, PathVars{Experiment: j.Experiment, Datatype: j.Datatype, Date: j.Date}); err != nil {
+		// Templates are checked by SetPathTemplate, so this should not happen.
+		log.Println("path template:", j, err)
+	}
+	dir := strings.Trim(b.String(), "/")
+	return fmt.Sprintf("gs://%s/%s/%s", j.Bucket, dir, j.Prefix)
+}
@@ -0,0 +1,45 @@
+package tracker_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestSetPathTemplate(t *testing.T) {
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	j := tracker.NewJob("other", "wehe", "scamper1", date)
+	if j.Path() != "gs://other/wehe/scamper1/2020/06/01/" {
+		t.Error("Wrong standard path", j.Path())
+	}
+	err := tracker.SetPathTemplate("other", "wehe", "scamper1", "{{.Nonesuch}}")
+	if !errors.Is(err, tracker.ErrInvalidPathTemplate) {
+		t.Error("Expected ErrInvalidPathTemplate", err)
+	}
+
+	rtx.Must(tracker.SetPathTemplate("other", "wehe", "scamper1",
+		`archive/{{.Experiment}}/{{.Date.Format "2006/01/02"}}`), "SetPathTemplate")
+	defer tracker.SetPathTemplate("other", "wehe", "scamper1", "")
+	if j.Path() != "gs://other/archive/wehe/2020/06/01/" {
+		t.Error("Wrong template path", j.Path())
+	}
+	j.Prefix = "20200601T15"
+	if j.Path() != "gs://other/archive/wehe/2020/06/01/20200601T15" {
+		t.Error("Wrong template path with prefix", j.Path())
+	}
+	jt, err := j.Target("mlab-sandbox.tmp_wehe.scamper1")
+	rtx.Must(err, "Target")
+	if jt.ArchivePath != j.Path() {
+		t.Error("Wrong ArchivePath", jt.ArchivePath)
+	}
+
+	// Other sources are unaffected.
+	std := tracker.NewJob("archive-measurement-lab", "wehe", "scamper1", date)
+	if jt, _ := std.Target("mlab-sandbox.tmp_wehe.scamper1"); jt.ArchivePath != "" {
+		t.Error("Standard layout should not have ArchivePath", jt.ArchivePath)
+	}
+}
@@ -0,0 +1,176 @@
+package tracker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// The v2 job protocol exchanges JSON documents between the gardener and the
+// parsers, under the /v2 paths.  The v1 paths, which take form parameters
+// and report outcomes only with the status code, are still served, so that
+// parsers and the gardener can be upgraded independently.  Requests to the
+// v1 paths may also send v2 JSON bodies, and ask for v2 responses with
+// Accept: MediaTypeV2.
+
+// Protocol versions.
+const (
+	ProtocolV1 = "v1"
+	ProtocolV2 = "v2"
+)
+
+// MediaTypeV2 is the content type of v2 requests and responses.  Requests
+// may also use application/json.
+const MediaTypeV2 = "application/vnd.gardener.v2+json"
+
+// Errors in v2 requests.
+var (
+	ErrUnsupportedVersion   = errors.New("unsupported protocol version")
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+	ErrInvalidJob           = errors.New("invalid job")
+	ErrMissingField         = errors.New("missing field")
+)
+
+// JobResponse is the response to a v2 job request.
+type JobResponse struct {
+	Version string
+	Job     JobWithTarget
+}
+
+// JobUpdate is the body of v2 update, heartbeat and error requests.  Only
+// Job is required for a heartbeat, State for an update, and Error for an
+// error.  Unknown fields are ignored, so that newer parsers can send fields
+// that older gardeners don't use.
+type JobUpdate struct {
+	// Version is the protocol version the parser uses.  Empty means
+	// ProtocolV2.
+	Version string `json:",omitempty"`
+	Job     Job
+	State   State  `json:",omitempty"`
+	Detail  string `json:",omitempty"`
+	Error   string `json:",omitempty"`
+	// ParserVersion is the parser release that processed the job.
+	ParserVersion string `json:",omitempty"`
+}
+
+// Response is the body of v2 update, heartbeat and error responses, and of
+// any v2 response that doesn't succeed, with the Error.
+type Response struct {
+	Version string
+	Error   string `json:",omitempty"`
+}
+
+// isJSON returns true if the content type is a JSON media type.
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mt == MediaTypeV2 || mt == "application/json")
+}
+
+// WantsV2 returns true if the request is to a v2 path, or asks for a v2
+// response in its Accept header.
+func WantsV2(req *http.Request) bool {
+	if strings.HasPrefix(req.URL.Path, "/"+ProtocolV2+"/") {
+		return true
+	}
+	for _, a := range strings.Split(req.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(a)); err == nil && mt == MediaTypeV2 {
+			return true
+		}
+	}
+	return false
+}
+
+// Acceptable returns false if the request's Accept header excludes JSON
+// responses.
+func Acceptable(req *http.Request) bool {
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	for _, a := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(a))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case MediaTypeV2, "application/json", "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
+// DecodeUpdate returns the update in the request body, which is JSON for
+// v2 requests, and form parameters for v1 requests.  Requests to v2 paths
+// must send JSON.
+func DecodeUpdate(req *http.Request) (JobUpdate, error) {
+	var u JobUpdate
+	if !isJSON(req.Header.Get("Content-Type")) {
+		if strings.HasPrefix(req.URL.Path, "/"+ProtocolV2+"/") {
+			return u, fmt.Errorf("%w: %q", ErrUnsupportedMediaType, req.Header.Get("Content-Type"))
+		}
+		if err := req.ParseForm(); err != nil {
+			return u, err
+		}
+		u.Version = ProtocolV1
+		u.State = State(req.Form.Get("state"))
+		u.Detail = req.Form.Get("detail")
+		u.Error = req.Form.Get("error")
+		u.ParserVersion = req.Form.Get("version")
+		var err error
+		if u.Job, err = getJob(req.Form.Get("job")); err != nil {
+			return u, fmt.Errorf("%w: %v", ErrInvalidJob, err)
+		}
+		return u, nil
+	}
+	if err := json.NewDecoder(req.Body).Decode(&u); err != nil {
+		return u, err
+	}
+	switch u.Version {
+	case "":
+		u.Version = ProtocolV2
+	case ProtocolV2:
+	default:
+		return u, fmt.Errorf("%w: %q", ErrUnsupportedVersion, u.Version)
+	}
+	if u.Job == (Job{}) {
+		return u, fmt.Errorf("%w: missing Job", ErrInvalidJob)
+	}
+	return u, nil
+}
+
+// WriteJSON writes v as the response body, with the status.
+func WriteJSON(resp http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", MediaTypeV2)
+	resp.WriteHeader(status)
+	if _, err := resp.Write(b); err != nil {
+		log.Println(err)
+	}
+}
+
+// WriteError writes a Response with the status and message.
+func WriteError(resp http.ResponseWriter, status int, msg string) {
+	WriteJSON(resp, status, Response{Version: ProtocolV2, Error: msg})
+}
+
+// decodeStatus returns the status code for a DecodeUpdate error.
+func decodeStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnsupportedMediaType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrInvalidJob):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusBadRequest
+	}
+}
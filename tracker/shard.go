@@ -0,0 +1,123 @@
+package tracker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/m-lab/etl-gardener/metrics"
+)
+
+// AddSharded adds a whole day job that is parsed as shards, i.e. prefix jobs
+// for each of the prefixes, e.g. sites or hours, which may be parsed in
+// parallel.  The job waits in the Sharded state while its shards are added
+// with AddJob and parsed.  Each shard is Complete once parsed, and when all
+// are, the job advances to ParseComplete, so that the whole partition is
+// post processed once.  If a shard fails, so does the job.
+// May return ErrInvalidShards, or the errors of AddJob.
+func (tr *Tracker) AddSharded(job Job, prefixes []string) error {
+	if job.Prefix != "" || len(prefixes) == 0 {
+		return fmt.Errorf("%w: %v", ErrInvalidShards, job)
+	}
+	shards := make(map[string]State, len(prefixes))
+	for i, p := range prefixes {
+		if err := (Job{Prefix: p}).Validate(); err != nil || p == "" {
+			return fmt.Errorf("%w: prefix %q", ErrInvalidShards, p)
+		}
+		// Shards must not overlap, since each is post processed by prefix.
+		for _, other := range prefixes[:i] {
+			if strings.HasPrefix(p, other) || strings.HasPrefix(other, p) {
+				return fmt.Errorf("%w: %q overlaps %q", ErrInvalidShards, p, other)
+			}
+		}
+		shards[p] = Init
+	}
+	if err := tr.AddJob(job); err != nil {
+		return err
+	}
+	status, err := tr.GetStatus(job)
+	if err != nil {
+		return err
+	}
+	status.Shards = shards
+	status.NewState(Sharded)
+	status.SetDetail(fmt.Sprintf("0 of %d shards parsed", len(shards)))
+	return tr.UpdateJob(job, status)
+}
+
+// shardParent returns the Sharded job that job is a shard of, if any.  The
+// parent is in the same jobs shard, since it has the same partition.
+// Caller must hold the jobs shard lock.
+func shardParent(sh *jobShard, job Job) (Job, bool) {
+	if job.Prefix == "" {
+		return Job{}, false
+	}
+	parent := job
+	parent.Prefix = ""
+	s, ok := sh.jobs[parent]
+	if !ok || s.State() != Sharded {
+		return Job{}, false
+	}
+	if _, ok := s.Shards[job.Prefix]; !ok {
+		return Job{}, false
+	}
+	return parent, true
+}
+
+// updateShard completes a shard once it is parsed, and records its state in
+// its parent, advancing the parent once all shards are Complete, or failing
+// it if a shard failed.
+// Caller must hold the shardLock, but not the lock.
+func (tr *Tracker) updateShard(job Job, s Status) {
+	state := s.State()
+	if state == ParseComplete {
+		// The shard's rows are post processed with the parent.
+		status, err := tr.GetStatus(job)
+		if err != nil {
+			return
+		}
+		status.NewState(Complete)
+		observers, _, err := tr.updateJob(job, status)
+		if err != nil {
+			return
+		}
+		for _, o := range observers {
+			o(job, status)
+		}
+		s, state = status, Complete
+	}
+
+	parent := *s.Parent
+	ps, ok := tr.jobs.get(parent)
+	if !ok || ps.State() != Sharded {
+		return
+	}
+	// Copy on write, since the map is shared with other copies of the Status.
+	shards := make(map[string]State, len(ps.Shards))
+	done := 0
+	for p, st := range ps.Shards {
+		if p == job.Prefix {
+			st = state
+		}
+		shards[p] = st
+		if st == Complete {
+			done++
+		}
+	}
+	ps.Shards = shards
+	metrics.ShardUpdates.WithLabelValues(job.Experiment, job.Datatype, string(state)).Inc()
+
+	switch {
+	case state == Failed:
+		ps.NewState(Failed)
+		ps.SetDetail(fmt.Sprintf("%s: shard %s failed: %s", Sharded, job.Prefix, s.Detail()))
+	case done == len(shards):
+		ps.SetDetail(fmt.Sprintf("all %d shards parsed", done))
+		ps.NewState(ParseComplete)
+	default:
+		ps.SetDetail(fmt.Sprintf("%d of %d shards parsed", done, len(shards)))
+	}
+	ps.UpdateCount++
+	if err := tr.UpdateJob(parent, ps); err != nil {
+		parent.Logger().Println(err)
+	}
+}
@@ -0,0 +1,112 @@
+package tracker_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestAddSharded(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	job := tracker.NewJob("bucket", "ndt", "ndt7", date)
+	prefix := job
+	prefix.Prefix = "a"
+
+	tests := []struct {
+		name     string
+		job      tracker.Job
+		prefixes []string
+	}{
+		{"no prefixes", job, nil},
+		{"prefix job", prefix, []string{"b"}},
+		{"empty prefix", job, []string{"a", ""}},
+		{"invalid prefix", job, []string{"a/b"}},
+		{"overlapping", job, []string{"mlab1", "mlab1-lga03"}},
+	}
+	for _, tt := range tests {
+		if err := tk.AddSharded(tt.job, tt.prefixes); !errors.Is(err, tracker.ErrInvalidShards) {
+			t.Errorf("%s: expected ErrInvalidShards, got %v", tt.name, err)
+		}
+	}
+	rtx.Must(tk.AddSharded(job, []string{"a", "b"}), "AddSharded")
+	if err := tk.AddSharded(job, []string{"a", "b"}); err != tracker.ErrJobAlreadyExists {
+		t.Error("Expected ErrJobAlreadyExists", err)
+	}
+	s, err := tk.GetStatus(job)
+	rtx.Must(err, "GetStatus")
+	if s.State() != tracker.Sharded || len(s.Shards) != 2 {
+		t.Error("Expected sharded job", s)
+	}
+}
+
+func TestShards(t *testing.T) {
+	date := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	parent := tracker.NewJob("bucket", "ndt", "ndt7", date)
+	shard := func(prefix string) tracker.Job {
+		j := parent
+		j.Prefix = prefix
+		return j
+	}
+
+	t.Run("complete", func(t *testing.T) {
+		tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+		rtx.Must(err, "tk init")
+		rtx.Must(tk.AddSharded(parent, []string{"a", "b"}), "AddSharded")
+		// Shards may be parsed concurrently, but other prefixes are busy.
+		rtx.Must(tk.AddJob(shard("a")), "AddJob a")
+		rtx.Must(tk.AddJob(shard("b")), "AddJob b")
+		if err := tk.AddJob(shard("c")); !errors.Is(err, tracker.ErrPartitionBusy) {
+			t.Error("Expected ErrPartitionBusy", err)
+		}
+		s, err := tk.GetStatus(shard("a"))
+		rtx.Must(err, "GetStatus")
+		if s.Parent == nil || *s.Parent != parent {
+			t.Error("Expected parent", s.Parent)
+		}
+
+		rtx.Must(tk.SetStatus(shard("a"), tracker.Parsing, "-"), "Parsing")
+		rtx.Must(tk.SetStatus(shard("a"), tracker.ParseComplete, "-"), "ParseComplete")
+		// Completed jobs are removed.
+		if _, err := tk.GetStatus(shard("a")); err != tracker.ErrJobNotFound {
+			t.Error("Expected shard to be complete", err)
+		}
+		s, err = tk.GetStatus(parent)
+		rtx.Must(err, "GetStatus")
+		if s.State() != tracker.Sharded || s.Detail() != "1 of 2 shards parsed" ||
+			s.Shards["a"] != tracker.Complete || s.Shards["b"] != tracker.Init {
+			t.Error("Wrong aggregate status", s.Detail(), s.Shards)
+		}
+
+		rtx.Must(tk.SetStatus(shard("b"), tracker.ParseComplete, "-"), "ParseComplete")
+		s, err = tk.GetStatus(parent)
+		rtx.Must(err, "GetStatus")
+		if s.State() != tracker.ParseComplete {
+			t.Error("Expected parent to be parsed", s)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+		rtx.Must(err, "tk init")
+		rtx.Must(tk.AddSharded(parent, []string{"a", "b"}), "AddSharded")
+		rtx.Must(tk.AddJob(shard("a")), "AddJob a")
+		rtx.Must(tk.SetJobError(shard("a"), "bad archive"), "SetJobError")
+		s, err := tk.GetStatus(parent)
+		rtx.Must(err, "GetStatus")
+		if s.State() != tracker.Failed || s.Detail() != "sharded: shard a failed: init: bad archive" {
+			t.Error("Expected parent to fail", s)
+		}
+		// Remaining shards are ordinary prefix jobs.
+		rtx.Must(tk.AddJob(shard("b")), "AddJob b")
+		if s, _ := tk.GetStatus(shard("b")); s.Parent != nil {
+			t.Error("Expected no parent", s.Parent)
+		}
+	})
+}
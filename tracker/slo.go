@@ -0,0 +1,200 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/etl-gardener/metrics"
+)
+
+// ErrInvalidSLO is returned by SetSLOs for a non-positive deadline, or a
+// target outside (0, 1).
+var ErrInvalidSLO = errors.New("invalid SLO")
+
+// DefaultSLOTarget is the fraction of dates that must meet the deadline, if
+// an SLO doesn't set its Target.
+const DefaultSLOTarget = 0.99
+
+// SLOWindows are the windows, in days, over which burn rates are computed.
+// The last, and longest, is also used for compliance and violations.
+var SLOWindows = []int{7, 28}
+
+// SLO is the completion objective for an experiment/datatype: each date
+// should be Complete within Deadline after the date ends, for at least
+// Target of the dates.
+type SLO struct {
+	Deadline time.Duration
+	Target   float64
+}
+
+// SLOViolation is a date that missed its deadline.
+type SLOViolation struct {
+	Date     time.Time
+	Deadline time.Time
+	// Completed is the time the date was completed, or zero if it is not
+	// yet complete.
+	Completed time.Time `json:",omitempty"`
+	// State is the date's job state if it is not complete, or empty if it
+	// was never dispatched.
+	State State `json:",omitempty"`
+}
+
+// SLOReport is the compliance of an experiment/datatype with its SLO, over
+// the longest of the SLOWindows.  Dates whose deadline has not passed are
+// not counted, nor are dates that ended before the manager started and have
+// no job history.
+type SLOReport struct {
+	Name       string // experiment/datatype
+	Deadline   time.Duration
+	Target     float64
+	Met        int
+	Missed     int
+	Compliance float64 // Met / (Met + Missed), or 1 if no dates were counted.
+	// BurnRates is the rate at which the error budget, 1 - Target, is used
+	// over each window, keyed by the window, e.g. "7d".  1 uses exactly the
+	// budget, and higher rates will exhaust it.
+	BurnRates  map[string]float64
+	Violations []SLOViolation // Ordered by date.
+}
+
+// SetSLOs sets the SLOs, keyed by experiment/datatype.  A zero Target uses
+// DefaultSLOTarget.
+func (tr *Tracker) SetSLOs(slos map[string]SLO) error {
+	checked := make(map[string]SLO, len(slos))
+	for name, slo := range slos {
+		if slo.Target == 0 {
+			slo.Target = DefaultSLOTarget
+		}
+		if slo.Deadline <= 0 || slo.Target <= 0 || slo.Target >= 1 {
+			return fmt.Errorf("%w: %s %+v", ErrInvalidSLO, name, slo)
+		}
+		checked[name] = slo
+	}
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	tr.slos = checked
+	return nil
+}
+
+// recordCompletion records the first completion time of each whole date.
+// Later completions, e.g. reprocessing, don't count towards the SLO.
+// Caller must hold the Tracker lock.
+func (h *history) recordCompletion(job Job, t time.Time) {
+	if job.Prefix != "" {
+		return
+	}
+	key := expType(job)
+	if h.completed[key] == nil {
+		h.completed[key] = make(map[time.Time]time.Time)
+	}
+	if first, ok := h.completed[key][job.Date]; !ok || t.Before(first) {
+		h.completed[key][job.Date] = t
+	}
+}
+
+// sloReports computes the SLO reports for the jobs at now.
+// Caller must hold the Tracker lock.
+func (tr *Tracker) sloReports(jobs JobMap, now time.Time) []SLOReport {
+	if len(tr.slos) == 0 {
+		return nil
+	}
+	inFlight := make(map[string]map[time.Time]State)
+	for j, s := range jobs {
+		if j.Prefix != "" {
+			continue
+		}
+		key := expType(j)
+		if inFlight[key] == nil {
+			inFlight[key] = make(map[time.Time]State)
+		}
+		inFlight[key][j.Date] = s.State()
+	}
+	longest := SLOWindows[len(SLOWindows)-1]
+	today := now.UTC().Truncate(24 * time.Hour)
+	reports := make([]SLOReport, 0, len(tr.slos))
+	for name, slo := range tr.slos {
+		r := SLOReport{Name: name, Deadline: slo.Deadline, Target: slo.Target,
+			BurnRates: make(map[string]float64, len(SLOWindows))}
+		// missed[i] is true if the date i+1 days before today missed its
+		// deadline, and counted[i] if it was counted at all.
+		missed := make([]bool, longest)
+		counted := make([]bool, longest)
+		for i := range missed {
+			date := today.AddDate(0, 0, -1-i)
+			end := date.Add(24 * time.Hour)
+			deadline := end.Add(slo.Deadline)
+			if deadline.After(now) {
+				continue
+			}
+			v := SLOViolation{Date: date, Deadline: deadline}
+			if done, ok := tr.history.completed[name][date]; ok {
+				if !done.After(deadline) {
+					counted[i] = true
+					continue
+				}
+				v.Completed = done
+			} else if state, ok := inFlight[name][date]; ok {
+				v.State = state
+			} else if state, ok := tr.history.outcomes[name][date]; ok {
+				v.State = state
+			} else if end.Before(tr.history.started) {
+				// No history from before the manager started.
+				continue
+			}
+			counted[i], missed[i] = true, true
+			r.Violations = append(r.Violations, v)
+		}
+		for _, w := range SLOWindows {
+			n, bad := 0, 0
+			for i := 0; i < w; i++ {
+				if counted[i] {
+					n++
+				}
+				if missed[i] {
+					bad++
+				}
+			}
+			rate := 0.0
+			if n > 0 {
+				rate = float64(bad) / float64(n) / (1 - slo.Target)
+			}
+			r.BurnRates[fmt.Sprintf("%dd", w)] = rate
+			if w == longest {
+				r.Met, r.Missed = n-bad, bad
+			}
+		}
+		r.Compliance = 1
+		if r.Met+r.Missed > 0 {
+			r.Compliance = float64(r.Met) / float64(r.Met+r.Missed)
+		}
+		sort.Slice(r.Violations, func(i, j int) bool {
+			return r.Violations[i].Date.Before(r.Violations[j].Date)
+		})
+		reports = append(reports, r)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+	return reports
+}
+
+// updateSLOMetrics sets the SLO gauges.
+func updateSLOMetrics(reports []SLOReport) {
+	for _, r := range reports {
+		exp, dt := splitKey(r.Name)
+		metrics.SLOCompliance.WithLabelValues(exp, dt).Set(r.Compliance)
+		for w, rate := range r.BurnRates {
+			metrics.SLOBurnRate.WithLabelValues(exp, dt, w).Set(rate)
+		}
+	}
+}
+
+// splitKey splits an experiment/datatype key.
+func splitKey(key string) (string, string) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,69 @@
+package tracker_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/go-test/deep"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestSLO(t *testing.T) {
+	day := func(d, h int) time.Time { return time.Date(2020, 6, d, h, 0, 0, 0, time.UTC) }
+	clock := day(1, 6)
+	monkey.Patch(time.Now, func() time.Time { return clock })
+	defer monkey.Unpatch(time.Now)
+
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "InitTracker")
+	if err := tk.SetSLOs(map[string]tracker.SLO{"ndt/ndt7": {Deadline: 36 * time.Hour, Target: 1}}); !errors.Is(err, tracker.ErrInvalidSLO) {
+		t.Error("Expected ErrInvalidSLO", err)
+	}
+	rtx.Must(tk.SetSLOs(map[string]tracker.SLO{"ndt/ndt7": {Deadline: 36 * time.Hour, Target: 0.9}}), "SetSLOs")
+
+	job := func(d int) tracker.Job { return tracker.NewJob("bucket", "ndt", "ndt7", day(d, 0)) }
+	// June 1 is complete before its deadline, June 2 after it.
+	clock = day(2, 10)
+	rtx.Must(tk.AddJob(job(1)), "AddJob")
+	clock = day(2, 20)
+	rtx.Must(tk.SetStatus(job(1), tracker.Complete, ""), "SetStatus")
+	clock = day(3, 10)
+	rtx.Must(tk.AddJob(job(2)), "AddJob")
+	clock = day(4, 18)
+	rtx.Must(tk.SetStatus(job(2), tracker.Complete, ""), "SetStatus")
+	// June 3 is stuck parsing, and June 4 was never dispatched.  June 5
+	// isn't due yet.
+	rtx.Must(tk.AddJob(job(3)), "AddJob")
+	rtx.Must(tk.SetStatus(job(3), tracker.Parsing, ""), "SetStatus")
+	// Dates without an SLO are not reported.
+	rtx.Must(tk.AddJob(tracker.NewJob("bucket", "ndt", "annotation", day(3, 0))), "AddJob")
+
+	clock = day(7, 0)
+	s := tk.GetSummary()
+	want := []tracker.SLOReport{{
+		Name: "ndt/ndt7", Deadline: 36 * time.Hour, Target: 0.9,
+		Met: 1, Missed: 3, Compliance: 0.25,
+		BurnRates: map[string]float64{"7d": 7.5, "28d": 7.5},
+		Violations: []tracker.SLOViolation{
+			{Date: day(2, 0), Deadline: day(4, 12), Completed: day(4, 18)},
+			{Date: day(3, 0), Deadline: day(5, 12), State: tracker.Parsing},
+			{Date: day(4, 0), Deadline: day(6, 12)},
+		},
+	}}
+	if diff := deep.Equal(s.SLO, want); diff != nil {
+		t.Error(diff)
+	}
+
+	// Reprocessing doesn't change the first completion.
+	rtx.Must(tk.AddJob(job(1)), "AddJob")
+	rtx.Must(tk.SetStatus(job(1), tracker.Complete, ""), "SetStatus")
+	if s := tk.GetSummary(); s.SLO[0].Met != 1 {
+		t.Error("Reprocessing should not count as a violation", s.SLO)
+	}
+}
@@ -0,0 +1,120 @@
+package tracker
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SnapshotMaxAge is the longest a snapshot is served without a refresh, so
+// that expired jobs are removed from it even if no job changes.
+const SnapshotMaxAge = time.Minute
+
+// Snapshot is a read-only copy of the tracker state, shared by concurrent
+// readers, e.g. the status endpoints.  It must not be modified.
+type Snapshot struct {
+	Jobs         JobMap
+	LastJob      Job
+	LastModified time.Time
+	SLO          []SLOReport
+	Time         time.Time // When the snapshot was taken.
+
+	// The jobs sorted by job, and their JSON, are computed once, when first
+	// requested, for JobsHandler.
+	sortOnce sync.Once
+	sorted   []JobStatus
+	jsonOnce sync.Once
+	json     []byte
+}
+
+// sortedJobs returns the jobs sorted by job.  It must not be modified.
+func (s *Snapshot) sortedJobs() []JobStatus {
+	s.sortOnce.Do(func() {
+		// The sort keys are computed once per job, rather than per
+		// comparison, and sorted with the job's index, rather than the job.
+		type key struct {
+			s string
+			i int
+		}
+		jobs := make([]JobStatus, 0, len(s.Jobs))
+		keys := make([]key, 0, len(s.Jobs))
+		var b []byte
+		for j, st := range s.Jobs {
+			b = j.appendString(b[:0])
+			keys = append(keys, key{string(b), len(jobs)})
+			jobs = append(jobs, JobStatus{Job: j, Status: st})
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].s < keys[j].s })
+		s.sorted = make([]JobStatus, len(jobs))
+		for i, k := range keys {
+			s.sorted[i] = jobs[k.i]
+		}
+	})
+	return s.sorted
+}
+
+// jobsJSON returns the JSON array of the sorted jobs.  It must not be
+// modified.
+func (s *Snapshot) jobsJSON() []byte {
+	s.jsonOnce.Do(func() {
+		jobs := s.sortedJobs()
+		buf := getBuffer()
+		defer putBuffer(buf)
+		*buf = appendJobs(*buf, jobs, func(JobStatus) bool { return true })
+		s.json = append([]byte(nil), *buf...)
+	})
+	return s.json
+}
+
+// StartSnapshots takes a snapshot of the job map, and replaces it, at most
+// once per interval, whenever jobs change, until ctx is done.  Readers of
+// GetSnapshot then never wait for the tracker lock, which is held by
+// every job update, e.g. during heavy dispatch.  The snapshot may be up to
+// interval old.
+func (tr *Tracker) StartSnapshots(ctx context.Context, interval time.Duration) {
+	last := tr.refreshSnapshot()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s := tr.snapshot.Load().(*Snapshot)
+				if atomic.LoadUint64(&tr.changes) != last || time.Since(s.Time) >= SnapshotMaxAge {
+					last = tr.refreshSnapshot()
+				}
+			}
+		}
+	}()
+}
+
+// refreshSnapshot replaces the snapshot, and returns the change count it
+// includes.
+func (tr *Tracker) refreshSnapshot() uint64 {
+	changes := atomic.LoadUint64(&tr.changes)
+	tr.snapshot.Store(tr.takeSnapshot())
+	return changes
+}
+
+// takeSnapshot returns a snapshot of the current state.
+func (tr *Tracker) takeSnapshot() *Snapshot {
+	jobs, lastJob, lastMod := tr.GetState()
+	now := time.Now()
+	tr.lock.Lock()
+	slo := tr.sloReports(jobs, now)
+	tr.lock.Unlock()
+	return &Snapshot{Jobs: jobs, LastJob: lastJob, LastModified: lastMod, SLO: slo, Time: now}
+}
+
+// GetSnapshot returns the latest snapshot, without locking, if snapshots
+// were started.  Otherwise it returns the current state, like GetState.
+func (tr *Tracker) GetSnapshot() *Snapshot {
+	if s, ok := tr.snapshot.Load().(*Snapshot); ok {
+		return s
+	}
+	return tr.takeSnapshot()
+}
@@ -0,0 +1,56 @@
+package tracker_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestSnapshots(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, time.Hour)
+	rtx.Must(err, "tk init")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(job), "add")
+
+	// Without StartSnapshots, each snapshot is current.
+	if s := tk.GetSnapshot(); len(s.Jobs) != 1 || s.LastJob != job {
+		t.Fatal("Wrong snapshot", s)
+	}
+
+	tk.StartSnapshots(ctx, 10*time.Millisecond)
+	first := tk.GetSnapshot()
+	time.Sleep(50 * time.Millisecond)
+	if tk.GetSnapshot() != first {
+		t.Error("Snapshot should not be replaced without changes")
+	}
+
+	other := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 6, 2, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(other), "add")
+	rtx.Must(tk.SetStatus(job, tracker.Loading, ""), "status")
+	var s *tracker.Snapshot
+	state := func() tracker.State {
+		status := s.Jobs[job]
+		return status.State()
+	}
+	for i := 0; i < 100; i++ {
+		if s = tk.GetSnapshot(); len(s.Jobs) == 2 && state() == tracker.Loading {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(s.Jobs) != 2 || state() != tracker.Loading || s.LastJob != other {
+		t.Error("Snapshot should be refreshed after changes", s)
+	}
+	if first == s || len(first.Jobs) != 1 {
+		t.Error("Earlier snapshots should not change", first)
+	}
+	if summary := tk.GetSummary(); summary.Counts[tracker.Loading] != 1 {
+		t.Error("Summary should use the snapshot", summary)
+	}
+}
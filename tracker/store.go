@@ -0,0 +1,133 @@
+package tracker
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// storeShards is the number of independently locked shards of the job map.
+const storeShards = 64
+
+// jobShard is a part of the job map, with its own lock.
+type jobShard struct {
+	lock sync.RWMutex
+	jobs JobMap
+}
+
+// jobStore is the tracker's job map, split into shards, so that status
+// reads, e.g. by the monitor and the parser handlers, don't wait for
+// updates of jobs in other shards, or for a full copy of the map.  All the
+// jobs of a partition, i.e. every Prefix of an experiment/datatype/date, are
+// in the same shard, so partition checks only scan a single shard.
+//
+// The shard locks are always taken before the Tracker lock, never after it.
+type jobStore struct {
+	shards [storeShards]jobShard
+	count  int64 // Accessed atomically.
+}
+
+// newJobStore creates a jobStore holding the jobs.
+func newJobStore(jobs JobMap) *jobStore {
+	st := &jobStore{}
+	for i := range st.shards {
+		st.shards[i].jobs = make(JobMap, len(jobs)/storeShards+1)
+	}
+	for j, s := range jobs {
+		st.shards[shardIndex(j)].jobs[j] = s
+	}
+	atomic.StoreInt64(&st.count, int64(len(jobs)))
+	return st
+}
+
+// shardIndex returns the shard of the job's partition, using an FNV-1a hash
+// of its experiment, datatype and date, without allocating.
+func shardIndex(j Job) int {
+	h := uint32(2166136261)
+	add := func(s string) {
+		for i := 0; i < len(s); i++ {
+			h ^= uint32(s[i])
+			h *= 16777619
+		}
+		h ^= '/'
+		h *= 16777619
+	}
+	add(j.Experiment)
+	add(j.Datatype)
+	for d := uint64(j.Date.Unix()); d != 0; d >>= 8 {
+		h ^= uint32(d & 0xff)
+		h *= 16777619
+	}
+	return int(h % storeShards)
+}
+
+// shard returns the shard of the job's partition.
+func (st *jobStore) shard(j Job) *jobShard {
+	return &st.shards[shardIndex(j)]
+}
+
+// len returns the number of jobs.
+func (st *jobStore) len() int {
+	return int(atomic.LoadInt64(&st.count))
+}
+
+// get returns the status of a job.
+func (st *jobStore) get(j Job) (Status, bool) {
+	sh := st.shard(j)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+	s, ok := sh.jobs[j]
+	return s, ok
+}
+
+// put sets the status of a job in a shard.  Caller must hold the shard's
+// write lock.
+func (st *jobStore) put(sh *jobShard, j Job, s Status) {
+	if _, ok := sh.jobs[j]; !ok {
+		atomic.AddInt64(&st.count, 1)
+	}
+	sh.jobs[j] = s
+}
+
+// remove deletes a job from a shard.  Caller must hold the shard's write
+// lock.
+func (st *jobStore) remove(sh *jobShard, j Job) {
+	if _, ok := sh.jobs[j]; ok {
+		atomic.AddInt64(&st.count, -1)
+		delete(sh.jobs, j)
+	}
+}
+
+// each calls f for every job, holding each shard's read lock in turn.  f
+// must not update the tracker.
+func (st *jobStore) each(f func(j Job, s Status)) {
+	for i := range st.shards {
+		sh := &st.shards[i]
+		sh.lock.RLock()
+		for j, s := range sh.jobs {
+			f(j, s)
+		}
+		sh.lock.RUnlock()
+	}
+}
+
+// partition calls f for every job of the partition of experiment, datatype
+// and date, holding its shard's read lock.  f must not update the tracker.
+func (st *jobStore) partition(experiment, datatype string, date time.Time, f func(j Job, s Status)) {
+	key := Job{Experiment: experiment, Datatype: datatype, Date: date}
+	sh := st.shard(key)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+	for j, s := range sh.jobs {
+		if j.samePartition(key) {
+			f(j, s)
+		}
+	}
+}
+
+// copy returns a copy of the job map.
+func (st *jobStore) copy() JobMap {
+	m := make(JobMap, st.len())
+	st.each(func(j Job, s Status) { m[j] = s })
+	return m
+}
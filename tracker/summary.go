@@ -0,0 +1,187 @@
+package tracker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/m-lab/etl-gardener/metrics"
+)
+
+// Summary is a machine-readable summary of the tracker state.
+type Summary struct {
+	Counts map[State]int // Number of jobs in each state.
+	// OldestPending is the oldest in-flight date, keyed by experiment/datatype.
+	OldestPending map[string]time.Time
+	Failures      []JobError // Ordered by job date.
+	// Lanes summarizes the daily and reprocessing jobs separately.
+	Lanes map[Lane]LaneSummary
+	// SLO reports the compliance of each experiment/datatype with a
+	// completion SLO, and the dates that violated it.  See SetSLOs.
+	SLO []SLOReport `json:",omitempty"`
+}
+
+// LaneSummary is the part of the Summary for the jobs in a single Lane.
+type LaneSummary struct {
+	Counts        map[State]int
+	OldestPending map[string]time.Time
+}
+
+// summarize computes a Summary from a JobMap.  Jobs are assigned to lanes
+// at time now.
+func summarize(jobs JobMap, now time.Time) Summary {
+	s := Summary{
+		Counts:        make(map[State]int),
+		OldestPending: make(map[string]time.Time),
+		Failures:      make([]JobError, 0),
+		Lanes:         make(map[Lane]LaneSummary),
+	}
+	for _, lane := range []Lane{Daily, Reprocess} {
+		s.Lanes[lane] = LaneSummary{Counts: make(map[State]int), OldestPending: make(map[string]time.Time)}
+	}
+	keys := make(map[[2]string]string)
+	for j, status := range jobs {
+		state := status.State()
+		lane := s.Lanes[j.Lane(now)]
+		s.Counts[state]++
+		lane.Counts[state]++
+		switch state {
+		case Complete, PartialComplete:
+		case Failed:
+			s.Failures = append(s.Failures, JobError{Job: j, Time: status.DetailTime(), Detail: status.Detail()})
+		default:
+			// Reuse the key strings, rather than allocate one per job.
+			name := [2]string{j.Experiment, j.Datatype}
+			key, ok := keys[name]
+			if !ok {
+				key = expType(j)
+				keys[name] = key
+			}
+			if old, ok := s.OldestPending[key]; !ok || j.Date.Before(old) {
+				s.OldestPending[key] = j.Date
+			}
+			if old, ok := lane.OldestPending[key]; !ok || j.Date.Before(old) {
+				lane.OldestPending[key] = j.Date
+			}
+		}
+	}
+	sort.Slice(s.Failures, func(i, j int) bool {
+		return s.Failures[i].Job.Date.Before(s.Failures[j].Job.Date)
+	})
+	return s
+}
+
+// summaryGauges sets the summary gauges, and deletes the label sets it set
+// before that no longer apply.  Resetting the gauges instead would expose
+// them empty to any concurrent scrape.
+type summaryGauges struct {
+	states  map[State]bool
+	pending map[string]bool // experiment/datatype keys.
+}
+
+// update sets the gauges from the Summary.
+func (g *summaryGauges) update(s Summary) {
+	for state := range g.states {
+		if _, ok := s.Counts[state]; !ok {
+			metrics.JobsByState.DeleteLabelValues(string(state))
+			delete(g.states, state)
+		}
+	}
+	for state, n := range s.Counts {
+		metrics.JobsByState.WithLabelValues(string(state)).Set(float64(n))
+		g.states[state] = true
+	}
+	for key := range g.pending {
+		if _, ok := s.OldestPending[key]; !ok {
+			exp, dt := splitKey(key)
+			metrics.OldestPendingDate.DeleteLabelValues(exp, dt)
+			delete(g.pending, key)
+		}
+	}
+	for key, date := range s.OldestPending {
+		exp, dt := splitKey(key)
+		metrics.OldestPendingDate.WithLabelValues(exp, dt).Set(float64(date.Unix()))
+		g.pending[key] = true
+	}
+}
+
+// MetricsInterval is the interval between updates of the summary and SLO
+// gauges, well within the usual scrape interval.  See StartMetrics.
+const MetricsInterval = 30 * time.Second
+
+// StartMetrics updates the summary and SLO gauges from the latest snapshot
+// every interval, until ctx is done.
+func (tr *Tracker) StartMetrics(ctx context.Context, interval time.Duration) {
+	g := &summaryGauges{states: make(map[State]bool), pending: make(map[string]bool)}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			snap := tr.GetSnapshot()
+			g.update(summarize(snap.Jobs, time.Now()))
+			updateSLOMetrics(snap.SLO)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// GetSummary returns a Summary of the jobs in the latest snapshot.
+func (tr *Tracker) GetSummary() Summary {
+	snap := tr.GetSnapshot()
+	s := summarize(snap.Jobs, time.Now())
+	s.SLO = snap.SLO
+	return s
+}
+
+// SummaryHandler serves the Summary as JSON.
+func (tr *Tracker) SummaryHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := json.Marshal(tr.GetSummary())
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
+
+// JobStatus pairs a job with its status, for JobsHandler.
+type JobStatus struct {
+	Job    Job
+	Status Status
+}
+
+// JobsHandler serves the jobs in the latest snapshot as JSON, sorted by job.
+// The optional "experiment", "datatype" and "state" parameters filter the
+// jobs returned.  The status history provides each job's timeline.
+func (tr *Tracker) JobsHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	exp, dt, state := q.Get("experiment"), q.Get("datatype"), q.Get("state")
+
+	snap := tr.GetSnapshot()
+	resp.Header().Set("Content-Type", "application/json")
+	if exp == "" && dt == "" && state == "" {
+		resp.Write(snap.jobsJSON())
+		return
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = appendJobs(*buf, snap.sortedJobs(), func(js JobStatus) bool {
+		return (exp == "" || js.Job.Experiment == exp) && (dt == "" || js.Job.Datatype == dt) &&
+			(state == "" || string(js.Status.State()) == state)
+	})
+	resp.Write(*buf)
+}
@@ -0,0 +1,134 @@
+package tracker_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+func TestSummary(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	must(t, err)
+
+	day := func(d int) time.Time { return time.Date(2020, 6, d, 0, 0, 0, 0, time.UTC) }
+	for d := 1; d <= 4; d++ {
+		must(t, tk.AddJob(tracker.NewJob("bucket", "ndt", "ndt7", day(d))))
+	}
+	must(t, tk.AddJob(tracker.NewJob("bucket", "ndt", "annotation", day(3))))
+	must(t, tk.SetJobError(tracker.NewJob("bucket", "ndt", "ndt7", day(1)), "load failed"))
+	must(t, tk.SetStatus(tracker.NewJob("bucket", "ndt", "ndt7", day(2)), tracker.Loading, ""))
+
+	server := httptest.NewServer(http.HandlerFunc(tk.SummaryHandler))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	must(t, err)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Expected StatusOK", resp.StatusCode)
+	}
+	var s tracker.Summary
+	must(t, json.NewDecoder(resp.Body).Decode(&s))
+
+	if s.Counts[tracker.Init] != 3 || s.Counts[tracker.Loading] != 1 || s.Counts[tracker.Failed] != 1 {
+		t.Error("Wrong counts", s.Counts)
+	}
+	if !s.OldestPending["ndt/ndt7"].Equal(day(2)) {
+		t.Error("Wrong oldest ndt7", s.OldestPending)
+	}
+	if !s.OldestPending["ndt/annotation"].Equal(day(3)) {
+		t.Error("Wrong oldest annotation", s.OldestPending)
+	}
+	if len(s.Failures) != 1 || s.Failures[0].Job.Date != day(1) {
+		t.Error("Wrong failures", s.Failures)
+	}
+
+	resp, err = http.Post(server.URL, "application/json", nil)
+	must(t, err)
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("Expected StatusMethodNotAllowed", resp.StatusCode)
+	}
+}
+
+func TestJobsHandler(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	must(t, err)
+
+	day := func(d int) time.Time { return time.Date(2020, 6, d, 0, 0, 0, 0, time.UTC) }
+	for d := 1; d <= 3; d++ {
+		must(t, tk.AddJob(tracker.NewJob("bucket", "ndt", "ndt7", day(d))))
+	}
+	must(t, tk.AddJob(tracker.NewJob("bucket", "ndt", "annotation", day(1))))
+	must(t, tk.SetStatus(tracker.NewJob("bucket", "ndt", "ndt7", day(2)), tracker.Loading, ""))
+
+	server := httptest.NewServer(http.HandlerFunc(tk.JobsHandler))
+	defer server.Close()
+	get := func(query string) []tracker.JobStatus {
+		resp, err := http.Get(server.URL + "?" + query)
+		must(t, err)
+		defer resp.Body.Close()
+		var jobs []tracker.JobStatus
+		must(t, json.NewDecoder(resp.Body).Decode(&jobs))
+		return jobs
+	}
+	if jobs := get(""); len(jobs) != 4 {
+		t.Error("Expected 4 jobs", len(jobs))
+	}
+	if jobs := get("datatype=ndt7"); len(jobs) != 3 || jobs[0].Job.Date != day(1) {
+		t.Error("Expected 3 sorted ndt7 jobs", jobs)
+	}
+	jobs := get("datatype=ndt7&state=loading")
+	if len(jobs) != 1 || len(jobs[0].Status.History) != 2 {
+		t.Error("Expected 1 loading job with history", jobs)
+	}
+}
+
+func TestStartMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tk, err := tracker.InitTracker(ctx, nil, nil, 0, 0, 0)
+	must(t, err)
+	day := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	job := tracker.NewJob("bucket", "metrics", "ndt7", day)
+	must(t, tk.AddJob(job))
+	tk.StartSnapshots(ctx, time.Millisecond)
+	tk.StartMetrics(ctx, time.Millisecond)
+
+	wait := func(cond func() bool) bool {
+		for i := 0; i < 500; i++ {
+			if cond() {
+				return true
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return false
+	}
+	pending := func() float64 {
+		return testutil.ToFloat64(metrics.OldestPendingDate.WithLabelValues("metrics", "ndt7"))
+	}
+	if !wait(func() bool { return pending() == float64(day.Unix()) }) {
+		t.Error("Wrong oldest pending date", pending())
+	}
+
+	// Label sets that no longer apply are deleted.
+	must(t, tk.SetStatus(job, tracker.Loading, ""))
+	loading := func() float64 {
+		return testutil.ToFloat64(metrics.JobsByState.WithLabelValues(string(tracker.Loading)))
+	}
+	if !wait(func() bool { return loading() == 1 }) {
+		t.Error("Wrong loading count", loading())
+	}
+	if n := testutil.CollectAndCount(metrics.JobsByState); n != 1 {
+		t.Error("Expected a single state", n)
+	}
+	must(t, tk.SetStatus(job, tracker.Complete, ""))
+	if !wait(func() bool { return testutil.CollectAndCount(metrics.OldestPendingDate) == 0 }) {
+		t.Error("Expected no pending dates")
+	}
+}
@@ -1,49 +1,91 @@
 // Package tracker tracks status of all jobs, and handles persistence.
 //
 // Concurrency properties:
-//  1. The job map is protected by a Mutex, but lock is only required
-//     to get a copy or set the Status value, so there is minimal
-//     contention.
+//  1. The job map is split into shards, each protected by its own
+//     RWMutex, and the lock is only required to get a copy or set the
+//     Status value, so there is minimal contention.  See jobStore.
 //  2. Status objects are persisted to a Saver by a separate
 //     goroutine that periodically updates any modified Status objects.
 //     The Status's updatetime is used to determine whether it needs
-//     to be saved.
+//     to be saved.  With SetCompaction, only the jobs changed since the
+//     previous save are written, as an append-only log of deltas, and the
+//     full state is written periodically.
+//  3. With StartSnapshots, the status endpoints read a copy of the job
+//     map that is replaced after changes, without taking the lock.
 package tracker
 
 import (
 	"context"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
 
 	"github.com/m-lab/etl-gardener/metrics"
+	"github.com/m-lab/etl-gardener/persistence"
 	"github.com/m-lab/go/logx"
 )
 
 // Tracker keeps track of all the jobs in flight.
 // Only tracker functions should access any of the fields.
 type Tracker struct {
-	client dsiface.Client
-	dsKey  *datastore.Key
+	saver  persistence.Saver
 	ticker *time.Ticker
 
-	// The lock should be held whenever accessing the jobs JobMap
+	// The lock protects the fields other than jobs.  When both are needed,
+	// a jobs shard lock must be taken first.
 	lock         sync.Mutex
 	lastModified time.Time
 
 	// These are the stored values.
-	lastJob Job    // The last job that was added/initialized.
-	jobs    JobMap // Map from Job to Status.
+	lastJob Job       // The last job that was added/initialized.
+	jobs    *jobStore // Map from Job to Status, with its own locks.
 
 	// Time after which stale job should be ignored or replaced.
 	expirationTime time.Duration
 	// Delay before removing Complete jobs.
 	cleanupDelay time.Duration
+
+	// history records the final state of jobs, for the dashboard.
+	// It is not persisted, so it only covers jobs since startup.
+	history history
+
+	// backlog and concurrency are used for ETA estimates.  See SetBacklog.
+	backlog     BacklogFunc
+	concurrency int
+
+	slos map[string]SLO // Completion SLOs by experiment/datatype.  See SetSLOs.
+
+	dayStages map[string][]DayStage // Ordered stages by experiment.  See SetDayStages.
+
+	observers []Observer // Notified of state changes.  See AddObserver.
+
+	shardLock sync.Mutex // Serializes updates of sharded jobs by their shards.
+
+	// Incremental persistence state.  See SetCompaction.
+	dirty        map[Job]struct{} // Jobs changed since the last save.
+	compactEvery int              // Deltas between full snapshots.  Zero disables deltas.
+	deltas       int              // Deltas saved since the last snapshot.
+	logStart     int64            // First delta after the last snapshot.
+	nextSeq      int64            // Sequence number of the next delta.
+
+	syncLock sync.Mutex // Serializes Sync calls, so deltas are saved in order.
+
+	// saveLock protects the persistence health fields.
+	saveLock    sync.Mutex
+	lastSaveTry time.Time // Time of the most recent save attempt.
+	lastSaveErr error     // Error from the most recent save attempt.
+	failedSaves int       // Consecutive failed save attempts.
+
+	// Read snapshot state.  See StartSnapshots.
+	changes  uint64       // Count of job changes.  Accessed atomically.
+	snapshot atomic.Value // The latest *Snapshot, if started.
 }
 
 // InitTracker recovers the Tracker state from a Client object.
@@ -52,12 +94,37 @@ func InitTracker(
 	ctx context.Context,
 	client dsiface.Client, key *datastore.Key,
 	saveInterval time.Duration, expirationTime time.Duration, cleanupDelay time.Duration) (*Tracker, error) {
+	var saver persistence.Saver
+	if client != nil {
+		saver = &clientSaver{client: client, key: key}
+	}
+	return InitTrackerWithSaver(ctx, saver, saveInterval, expirationTime, cleanupDelay)
+}
 
-	jobMap, lastJob, err := loadJobMap(ctx, client, key)
+// InitTrackerWithSaver recovers the Tracker state from a Saver, such as a
+// persistence.FileSaver for local development.  The state is stored with
+// kind "tracker" and name "jobs".
+// May return error if recovery fails.
+func InitTrackerWithSaver(
+	ctx context.Context, saver persistence.Saver,
+	saveInterval time.Duration, expirationTime time.Duration, cleanupDelay time.Duration) (*Tracker, error) {
+
+	jobMap, lastJob, logStart, err := loadJobMap(ctx, saver)
 	if err != nil {
-		log.Println(err, key)
+		log.Println(err)
 		jobMap = make(JobMap, 100)
 	}
+	nextSeq, deltas := logStart, 0
+	if saver != nil {
+		// Replay any deltas saved after the snapshot.
+		lastJob, nextSeq, deltas, err = replayDeltas(ctx, saver, jobMap, lastJob, logStart)
+		if err != nil {
+			log.Println("Delta replay error:", err)
+		}
+		if deltas > 0 {
+			log.Println("Replayed", deltas, "deltas")
+		}
+	}
 	for j, s := range jobMap {
 		// Update the metrics for all jobs still in flight or failed.
 		if !s.isDone() {
@@ -66,10 +133,12 @@ func InitTracker(
 		}
 	}
 	t := Tracker{
-		client: client, dsKey: key, lastModified: time.Now(),
-		lastJob: lastJob, jobs: jobMap,
-		expirationTime: expirationTime, cleanupDelay: cleanupDelay}
-	if client != nil && saveInterval > 0 {
+		saver: saver, lastModified: time.Now(),
+		lastJob: lastJob, jobs: newJobStore(jobMap),
+		expirationTime: expirationTime, cleanupDelay: cleanupDelay,
+		history: newHistory(), dirty: make(map[Job]struct{}),
+		logStart: logStart, nextSeq: nextSeq, deltas: deltas}
+	if saver != nil && saveInterval > 0 {
 		t.saveEvery(saveInterval)
 	}
 	return &t, nil
@@ -78,9 +147,7 @@ func InitTracker(
 // NumJobs returns the number of jobs in flight.  This includes
 // jobs in "Complete" state that have not been removed from saver.
 func (tr *Tracker) NumJobs() int {
-	tr.lock.Lock()
-	defer tr.lock.Unlock()
-	return len(tr.jobs)
+	return tr.jobs.len()
 }
 
 // NumFailed returns the number of failed jobs.
@@ -94,33 +161,47 @@ func (tr *Tracker) NumFailed() int {
 	return counts[Failed]
 }
 
-// Sync snapshots the full job state and saves it to the datastore client IFF it has changed.
+// Sync saves the job state to the saver IFF it has changed.  It saves either
+// the full state, or a delta of the jobs changed since the previous save.
 // Returns time last saved, which may or may not be updated.
 func (tr *Tracker) Sync(ctx context.Context, lastSave time.Time) (time.Time, error) {
+	tr.syncLock.Lock()
+	defer tr.syncLock.Unlock()
+	// Jobs changed after this are marked dirty again, and saved next time.
+	dirty, full := tr.takeDirty()
 	jobs, lastInit, lastMod := tr.GetState()
 	if lastMod.Before(lastSave) {
 		logx.Debug.Println("Skipping save", lastMod, lastSave)
+		tr.restoreDirty(dirty)
 		return lastSave, nil
 	}
 
-	jsonJobs, err := jobs.MarshalJSON()
-	if err != nil {
-		return lastSave, err
-	}
-
-	// Save the full state.
 	lastTry := time.Now()
-	state := saverStruct{time.Now(), lastInit, jsonJobs}
 	ctx, cf := context.WithTimeout(ctx, 10*time.Second)
 	defer cf()
-	_, err = tr.client.Put(ctx, tr.dsKey, &state)
-
+	var err error
+	if full {
+		err = tr.saveSnapshot(ctx, jobs, lastInit)
+	} else {
+		err = tr.saveDelta(ctx, jobs, lastInit, dirty)
+	}
 	if err != nil {
+		tr.restoreDirty(dirty)
 		return lastSave, err
 	}
 	return lastTry, nil
 }
 
+// Flush saves the current state, e.g. on shutdown.  It is a no-op if the
+// tracker has no saver.
+func (tr *Tracker) Flush(ctx context.Context) error {
+	if tr.saver == nil {
+		return nil
+	}
+	_, err := tr.Sync(ctx, time.Time{})
+	return err
+}
+
 func (tr *Tracker) saveEvery(interval time.Duration) {
 	tr.ticker = time.NewTicker(interval)
 	go func() {
@@ -133,79 +214,228 @@ func (tr *Tracker) saveEvery(interval time.Duration) {
 			if err != nil {
 				log.Println(err)
 			}
+			tr.saveLock.Lock()
+			tr.lastSaveTry, tr.lastSaveErr = time.Now(), err
+			if err != nil {
+				tr.failedSaves++
+			} else {
+				tr.failedSaves = 0
+			}
+			tr.saveLock.Unlock()
 		}
 	}()
 }
 
+// MaxFailedSaves is the number of consecutive failed periodic saves after
+// which PersistenceCheck fails.
+const MaxFailedSaves = 5
+
+// PersistenceCheck returns an error if no save has been attempted within
+// maxAge, or the last MaxFailedSaves periodic saves failed, e.g. for a
+// liveness check.  A single failed save, e.g. from a transient Datastore
+// error, is reported by SaveCheck instead.  If the tracker is not saving
+// periodically, it always returns nil.
+func (tr *Tracker) PersistenceCheck(ctx context.Context, maxAge time.Duration) error {
+	if tr.ticker == nil {
+		return nil
+	}
+	tr.saveLock.Lock()
+	defer tr.saveLock.Unlock()
+	if tr.failedSaves >= MaxFailedSaves {
+		return fmt.Errorf("%w: %d attempts: %v", ErrSaveFailing, tr.failedSaves, tr.lastSaveErr)
+	}
+	if !tr.lastSaveTry.IsZero() && time.Since(tr.lastSaveTry) > maxAge {
+		return ErrSaveStalled
+	}
+	return nil
+}
+
+// SaveCheck returns the error from the most recent periodic save, if it
+// failed, e.g. for a readiness check.
+func (tr *Tracker) SaveCheck(ctx context.Context) error {
+	tr.saveLock.Lock()
+	defer tr.saveLock.Unlock()
+	return tr.lastSaveErr
+}
+
 // GetStatus retrieves the status of an existing job.
 // Note that the returned object is a shallow copy, and the History
 // field shares the slice objects with the JobMap.
 func (tr *Tracker) GetStatus(job Job) (Status, error) {
-	tr.lock.Lock()
-	defer tr.lock.Unlock()
-	status, ok := tr.jobs[job]
+	status, ok := tr.jobs.get(job)
 	if !ok {
 		return Status{}, ErrJobNotFound
 	}
 	return status, nil
 }
 
-// AddJob adds a new job to the Tracker.
-// May return ErrJobAlreadyExists if job already exists and is still in flight.
+// AddJob adds a new job to the Tracker.  A shard of a Sharded job, i.e. a
+// prefix job with one of its prefixes, is added as its child.  See
+// AddSharded.
+// May return ErrJobAlreadyExists if job already exists and is still in flight,
+// ErrPartitionBusy if a job with a different Prefix for the same partition is
+// in flight, or ErrInvalidPrefix.
 func (tr *Tracker) AddJob(job Job) error {
+	if err := job.Validate(); err != nil {
+		return err
+	}
 	status := NewStatus()
 
-	tr.lock.Lock()
-	defer tr.lock.Unlock()
-	s, ok := tr.jobs[job]
+	sh := tr.jobs.shard(job)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if parent, ok := shardParent(sh, job); ok {
+		// Shards of the same job may be parsed concurrently.
+		status.Parent = &parent
+	} else if other, busy := partitionBusy(sh, job); busy {
+		return fmt.Errorf("%w: %v", ErrPartitionBusy, other)
+	}
+	s, ok := sh.jobs[job]
 	if ok {
 		if s.isDone() {
 			log.Println("Restarting completed job", job)
-		} else if s.State() == Failed {
+		} else if s.State() == Failed || s.State() == PartialComplete {
 			// If job didn't complete, the InFlight metric needs to be updated.
 			metrics.TasksInFlight.WithLabelValues(job.Experiment, job.Datatype, s.Label()).Dec()
-			log.Println("Restarting failed job", job)
+			log.Println("Restarting", s.State(), "job", job)
 		} else {
 			return ErrJobAlreadyExists
 		}
 	}
 
+	tr.lock.Lock()
 	tr.lastJob = job
 	tr.lastModified = time.Now()
+	tr.markDirty(job)
+	tr.lock.Unlock()
 	metrics.StartedCount.WithLabelValues(job.Experiment, job.Datatype).Inc()
-	tr.jobs[job] = status
+	tr.jobs.put(sh, job, status)
 	status.updateMetrics(job)
 	return nil
 }
 
+// ResetJob adds the job, replacing any existing status, even if the job is
+// in flight or complete, e.g. to force a reprocess after a parser fix.  The
+// job starts again in Init, with a new history.  Callers should first stop
+// any action in progress, e.g. with ops.Monitor.Cancel.
+// May return ErrPartitionBusy if a job with a different Prefix for the same
+// partition is in flight, or ErrInvalidPrefix.
+func (tr *Tracker) ResetJob(job Job) error {
+	if err := job.Validate(); err != nil {
+		return err
+	}
+	status := NewStatus()
+
+	sh := tr.jobs.shard(job)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if other, busy := partitionBusy(sh, job); busy {
+		return fmt.Errorf("%w: %v", ErrPartitionBusy, other)
+	}
+	if s, ok := sh.jobs[job]; ok {
+		if !s.isDone() {
+			// The replaced status is no longer in flight.
+			metrics.TasksInFlight.WithLabelValues(job.Experiment, job.Datatype, s.Label()).Dec()
+		}
+		log.Println("Resetting", s.State(), "job", job)
+	}
+
+	tr.lock.Lock()
+	tr.lastModified = time.Now()
+	tr.markDirty(job)
+	tr.lock.Unlock()
+	metrics.StartedCount.WithLabelValues(job.Experiment, job.Datatype).Inc()
+	tr.jobs.put(sh, job, status)
+	status.updateMetrics(job)
+	return nil
+}
+
+// partitionBusy returns an in flight job that shares the tmp partition with
+// job, but has a different Prefix.  Prefix jobs load, dedup and copy only
+// part of the partition, so they must not overlap with each other, or with
+// a whole day job.  The partition's jobs are all in the shard.
+// Caller must hold the jobs shard lock.
+func partitionBusy(sh *jobShard, job Job) (Job, bool) {
+	for other, s := range sh.jobs {
+		if other.Prefix == job.Prefix || !other.samePartition(job) {
+			continue
+		}
+		if s.isDone() || s.State() == Failed || s.State() == PartialComplete {
+			continue
+		}
+		return other, true
+	}
+	return Job{}, false
+}
+
+// An Observer is notified of each job state change, e.g. to send
+// notifications.  It is called without the Tracker lock held, on the
+// goroutine that changed the state, so it should not block.
+type Observer func(job Job, s Status)
+
+// AddObserver adds an Observer for job state changes.
+func (tr *Tracker) AddObserver(o Observer) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	// Copy on write, since the slice is used without the lock.
+	observers := make([]Observer, len(tr.observers), len(tr.observers)+1)
+	copy(observers, tr.observers)
+	tr.observers = append(observers, o)
+}
+
 // UpdateJob updates an existing job.
 // May return ErrJobNotFound if job no longer exists.
 func (tr *Tracker) UpdateJob(job Job, new Status) error {
-	tr.lock.Lock()
-	defer tr.lock.Unlock()
-	old, ok := tr.jobs[job]
+	observers, changed, err := tr.updateJob(job, new)
+	for _, o := range observers {
+		o(job, new)
+	}
+	if changed && new.Parent != nil {
+		tr.shardLock.Lock()
+		tr.updateShard(job, new)
+		tr.shardLock.Unlock()
+	}
+	return err
+}
+
+// updateJob updates an existing job, and returns the Observers and true if
+// the job state changed.
+func (tr *Tracker) updateJob(job Job, new Status) ([]Observer, bool, error) {
+	sh := tr.jobs.shard(job)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	old, ok := sh.jobs[job]
 	if !ok {
-		return ErrJobNotFound
+		return nil, false, ErrJobNotFound
 	}
 
-	if old.State() != new.State() {
-		log.Println(job, old.LastStateInfo(), "->", new.State())
+	var observers []Observer
+	changed := old.State() != new.State()
+	if changed {
+		job.Logger().With("state", new.State()).Println(old.LastStateInfo(), "->", new.State())
 		new.updateMetrics(job)
 	}
 
+	tr.lock.Lock()
+	if changed {
+		tr.history.record(job, &new)
+		observers = tr.observers
+	}
 	tr.lastModified = time.Now()
+	tr.markDirty(job)
+	tr.lock.Unlock()
 	// When jobs are done, we update stats and may remove them from tracker.
 	if new.isDone() {
 		metrics.CompletedCount.WithLabelValues(job.Experiment, job.Datatype).Inc()
 
 		// This could be done by GetStatus, but would change behaviors slightly.
 		if tr.cleanupDelay == 0 {
-			delete(tr.jobs, job)
-			return nil
+			tr.jobs.remove(sh, job)
+			return observers, changed, nil
 		}
 	}
-	tr.jobs[job] = new
-	return nil
+	tr.jobs.put(sh, job, new)
+	return observers, changed, nil
 }
 
 // SetDetail updates a job's detail message in memory.
@@ -215,6 +445,10 @@ func (tr *Tracker) SetDetail(job Job, detail string) error {
 	if err != nil {
 		return err
 	}
+	if status.State() == Cancelling {
+		// Keep the cancellation reason.
+		return tr.rejectCancelled(job, status)
+	}
 	status.SetDetail(detail)
 	status.UpdateCount++
 	return tr.UpdateJob(job, status)
@@ -231,10 +465,15 @@ func (tr *Tracker) SetStatus(job Job, state State, detail string) error {
 		return err
 	}
 	last := status.LastStateInfo()
+	if last.State == Cancelling && state != Cancelling {
+		return tr.rejectCancelled(job, status)
+	}
 	status.SetDetail(detail)
 
 	if state != last.State {
 		status.NewState(state)
+		// Any BigQuery job belonged to the previous state.
+		status.BQJobID = ""
 
 		if state == ParseComplete {
 			// TODO enable this once we have file or byte counts.
@@ -248,12 +487,78 @@ func (tr *Tracker) SetStatus(job Job, state State, detail string) error {
 	return tr.UpdateJob(job, status)
 }
 
+// SetParseStats records the counts reported by the parser for a job.
+func (tr *Tracker) SetParseStats(job Job, stats ParseStats) error {
+	status, err := tr.GetStatus(job)
+	if err != nil {
+		return err
+	}
+	status.ParseStats = &stats
+	return tr.UpdateJob(job, status)
+}
+
+// SetVersion records the parser release that processed a job.
+func (tr *Tracker) SetVersion(job Job, version string) error {
+	status, err := tr.GetStatus(job)
+	if err != nil {
+		return err
+	}
+	status.Version = version
+	return tr.UpdateJob(job, status)
+}
+
+// SetInventory records the archive inventory for a job.
+func (tr *Tracker) SetInventory(job Job, inv Inventory) error {
+	status, err := tr.GetStatus(job)
+	if err != nil {
+		return err
+	}
+	status.Inventory = &inv
+	return tr.UpdateJob(job, status)
+}
+
+// SetBQJobID records the in-flight BigQuery job ID for a job.
+func (tr *Tracker) SetBQJobID(job Job, id string) error {
+	status, err := tr.GetStatus(job)
+	if err != nil {
+		return err
+	}
+	status.BQJobID = id
+	return tr.UpdateJob(job, status)
+}
+
+// Annotate merges the annotations into the job's annotations.  Keys with
+// empty values are removed.
+func (tr *Tracker) Annotate(job Job, annotations map[string]string) error {
+	status, err := tr.GetStatus(job)
+	if err != nil {
+		return err
+	}
+	// Copy on write, since the map is shared with other copies of the Status.
+	a := make(map[string]string, len(status.Annotations)+len(annotations))
+	for k, v := range status.Annotations {
+		a[k] = v
+	}
+	for k, v := range annotations {
+		if v == "" {
+			delete(a, k)
+			continue
+		}
+		a[k] = v
+	}
+	status.Annotations = a
+	return tr.UpdateJob(job, status)
+}
+
 // Heartbeat updates a job's heartbeat time.
 func (tr *Tracker) Heartbeat(job Job) error {
 	status, err := tr.GetStatus(job)
 	if err != nil {
 		return err
 	}
+	if status.State() == Cancelling {
+		return tr.rejectCancelled(job, status)
+	}
 	status.HeartbeatTime = time.Now()
 	return tr.UpdateJob(job, status)
 }
@@ -276,35 +581,94 @@ func (tr *Tracker) SetJobError(job Job, errString string) error {
 // GetState returns the full job map, last initialized Job, and last mod time.
 // It also cleans up any expired jobs from the tracker.
 func (tr *Tracker) GetState() (JobMap, Job, time.Time) {
+	m := make(JobMap, tr.jobs.len())
+	now := time.Now()
+	for i := range tr.jobs.shards {
+		sh := &tr.jobs.shards[i]
+		sh.lock.Lock()
+		for j, s := range sh.jobs {
+			// Remove any obsolete jobs.
+			updateTime := s.DetailTime()
+			if (tr.expirationTime > 0 && now.Sub(updateTime) > tr.expirationTime) ||
+				(s.isDone() && now.Sub(updateTime) > tr.cleanupDelay) {
+				if !s.isDone() {
+					// If job didn't complete, the InFlight metric needs to be updated.
+					metrics.TasksInFlight.WithLabelValues(j.Experiment, j.Datatype, s.Label()).Dec()
+					log.Println("Deleting stale job", j, now.Sub(updateTime), tr.cleanupDelay)
+				}
+				tr.lock.Lock()
+				tr.lastModified = time.Now()
+				tr.markDirty(j)
+				tr.lock.Unlock()
+				tr.jobs.remove(sh, j)
+			} else {
+				m[j] = s
+			}
+		}
+		sh.lock.Unlock()
+	}
 	tr.lock.Lock()
 	defer tr.lock.Unlock()
-	m := make(JobMap, len(tr.jobs))
-	for j, s := range tr.jobs {
-		// Remove any obsolete jobs.
-		updateTime := s.DetailTime()
-		if (tr.expirationTime > 0 && time.Since(updateTime) > tr.expirationTime) ||
-			(s.isDone() && time.Since(updateTime) > tr.cleanupDelay) {
-			if !s.isDone() {
-				// If job didn't complete, the InFlight metric needs to be updated.
-				metrics.TasksInFlight.WithLabelValues(j.Experiment, j.Datatype, s.Label()).Dec()
-				log.Println("Deleting stale job", j, time.Since(updateTime), tr.cleanupDelay)
+	return m, tr.lastJob, tr.lastModified
+}
+
+// ReleaseStale removes the jobs held by parsers, i.e. in Init or Parsing,
+// whose last heartbeat and last update are both more than timeout before
+// now, e.g. because the parser died, and returns them, so that they can be
+// dispatched again.  Stale Cancelling jobs are failed instead, since their
+// parser will never learn of the cancellation.
+func (tr *Tracker) ReleaseStale(timeout time.Duration, now time.Time) []Job {
+	var stale, cancelled []Job
+	for i := range tr.jobs.shards {
+		sh := &tr.jobs.shards[i]
+		sh.lock.Lock()
+		for j, s := range sh.jobs {
+			state := s.State()
+			if state != Init && state != Parsing && state != Cancelling {
+				continue
 			}
-			tr.lastModified = time.Now()
-			delete(tr.jobs, j)
-		} else {
-			m[j] = s
+			last := s.DetailTime()
+			if s.HeartbeatTime.After(last) {
+				last = s.HeartbeatTime
+			}
+			if now.Sub(last) <= timeout {
+				continue
+			}
+			if state == Cancelling {
+				cancelled = append(cancelled, j)
+				continue
+			}
+			log.Println("Releasing stale", s.State(), "job", j, "last heard from", now.Sub(last), "ago")
+			metrics.TasksInFlight.WithLabelValues(j.Experiment, j.Datatype, s.Label()).Dec()
+			metrics.StaleJobsReleased.WithLabelValues(j.Experiment, j.Datatype, string(s.State())).Inc()
+			tr.lock.Lock()
+			tr.lastModified = now
+			tr.markDirty(j)
+			tr.lock.Unlock()
+			tr.jobs.remove(sh, j)
+			stale = append(stale, j)
 		}
+		sh.lock.Unlock()
 	}
-	return m, tr.lastJob, tr.lastModified
+	for _, j := range cancelled {
+		if err := tr.FinishCancel(j); err != nil {
+			log.Println("Could not fail cancelled job", j, err)
+		}
+	}
+	return stale
 }
 
-// WriteHTMLStatusTo writes out the status of all jobs to the html writer.
+// WriteHTMLStatusTo writes out the status of all jobs in the latest
+// snapshot to the html writer.
 func (tr *Tracker) WriteHTMLStatusTo(ctx context.Context, w io.Writer) error {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 	// TODO - add the lastInit job.
-	jobs, _, _ := tr.GetState()
+	jobs := tr.GetSnapshot().Jobs
 
+	for _, eta := range tr.GetETAs(time.Now()) {
+		fmt.Fprintf(w, "<div>%s</div>\n", html.EscapeString(eta.String()))
+	}
 	fmt.Fprint(w, "<div>Tracker State</div>\n")
 
 	return jobs.WriteHTML(w)
@@ -3,7 +3,11 @@ package tracker_test
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io/ioutil"
 	"log"
+	"os"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -14,6 +18,7 @@ import (
 	"github.com/m-lab/go/cloudtest/dsfake"
 	"github.com/m-lab/go/logx"
 
+	"github.com/m-lab/etl-gardener/persistence"
 	"github.com/m-lab/etl-gardener/tracker"
 )
 
@@ -84,14 +89,51 @@ func cleanup(client dsiface.Client, key *datastore.Key) error {
 }
 
 func TestJobPath(t *testing.T) {
-	withType := tracker.Job{"bucket", "exp", "type", startDate, ""}
+	withType := tracker.Job{"bucket", "exp", "type", startDate, "", ""}
 	if withType.Path() != "gs://bucket/exp/type/"+startDate.Format("2006/01/02/") {
 		t.Error("wrong path:", withType.Path())
 	}
-	withoutType := tracker.Job{"bucket", "exp", "", startDate, ""}
+	withoutType := tracker.Job{"bucket", "exp", "", startDate, "", ""}
 	if withoutType.Path() != "gs://bucket/exp/"+startDate.Format("2006/01/02/") {
 		t.Error("wrong path", withType.Path())
 	}
+	withPrefix := tracker.Job{Bucket: "bucket", Experiment: "exp", Datatype: "type", Date: startDate, Prefix: "20110202T15"}
+	if withPrefix.Path() != "gs://bucket/exp/type/"+startDate.Format("2006/01/02/")+"20110202T15" {
+		t.Error("wrong path", withPrefix.Path())
+	}
+	if withPrefix.String() != startDate.Format("20060102")+":exp/type/20110202T15*" {
+		t.Error("wrong string", withPrefix.String())
+	}
+}
+
+func TestPrefixJobs(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	must(t, err)
+	day := tracker.NewJob("bucket", "exp", "type", startDate)
+	hour := day
+	hour.Prefix = "20110202T15"
+	must(t, tk.AddJob(hour))
+
+	// A whole day, or another prefix, may not overlap the prefix job.
+	if err := tk.AddJob(day); !errors.Is(err, tracker.ErrPartitionBusy) {
+		t.Error("Should be ErrPartitionBusy", err)
+	}
+	other := hour
+	other.Prefix = "20110202T16"
+	if err := tk.AddJob(other); !errors.Is(err, tracker.ErrPartitionBusy) {
+		t.Error("Should be ErrPartitionBusy", err)
+	}
+	// Other dates are not affected.
+	must(t, tk.AddJob(tracker.NewJob("bucket", "exp", "type", startDate.AddDate(0, 0, 1))))
+
+	must(t, tk.SetStatus(hour, tracker.Complete, ""))
+	must(t, tk.AddJob(other))
+
+	bad := day
+	bad.Prefix = `x" OR TRUE --`
+	if err := tk.AddJob(bad); !errors.Is(err, tracker.ErrInvalidPrefix) {
+		t.Error("Should be ErrInvalidPrefix", err)
+	}
 }
 
 func TestTrackerAddDelete(t *testing.T) {
@@ -176,7 +218,7 @@ func TestUpdates(t *testing.T) {
 
 	createJobs(t, tk, "JobToUpdate", "type", 1)
 
-	job := tracker.Job{"bucket", "JobToUpdate", "type", startDate, ""}
+	job := tracker.Job{"bucket", "JobToUpdate", "type", startDate, "", ""}
 	must(t, tk.SetStatus(job, tracker.Parsing, "foo"))
 	must(t, tk.SetStatus(job, tracker.Stabilizing, "bar"))
 
@@ -193,7 +235,7 @@ func TestUpdates(t *testing.T) {
 		t.Error("Incorrect detail", status.LastStateInfo())
 	}
 
-	err = tk.SetStatus(tracker.Job{"bucket", "JobToUpdate", "other-type", startDate, ""}, tracker.Stabilizing, "")
+	err = tk.SetStatus(tracker.Job{"bucket", "JobToUpdate", "other-type", startDate, "", ""}, tracker.Stabilizing, "")
 	if err != tracker.ErrJobNotFound {
 		t.Error(err, "should have been ErrJobNotFound")
 	}
@@ -246,6 +288,58 @@ func TestNonexistentJobAccess(t *testing.T) {
 	}
 }
 
+func TestBQJobID(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	must(t, err)
+
+	js := tracker.NewJob("bucket", "exp", "type", startDate)
+	must(t, tk.AddJob(js))
+	must(t, tk.SetStatus(js, tracker.Deduplicating, ""))
+	must(t, tk.SetBQJobID(js, "job-1234"))
+
+	// Detail updates should preserve the job ID.
+	must(t, tk.SetStatus(js, tracker.Deduplicating, "still running"))
+	status, err := tk.GetStatus(js)
+	must(t, err)
+	if status.BQJobID != "job-1234" {
+		t.Error("Expected job-1234, got", status.BQJobID)
+	}
+
+	// State changes should clear it.
+	must(t, tk.SetStatus(js, tracker.Copying, ""))
+	status, err = tk.GetStatus(js)
+	must(t, err)
+	if status.BQJobID != "" {
+		t.Error("Expected empty BQJobID, got", status.BQJobID)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	must(t, err)
+
+	js := tracker.NewJob("bucket", "exp", "type", startDate)
+	must(t, tk.AddJob(js))
+	must(t, tk.Annotate(js, map[string]string{"a": "1", "b": "2"}))
+	before, err := tk.GetStatus(js)
+	must(t, err)
+
+	must(t, tk.Annotate(js, map[string]string{"a": "", "c": "3"}))
+	status, err := tk.GetStatus(js)
+	must(t, err)
+	if len(status.Annotations) != 2 || status.Annotations["b"] != "2" || status.Annotations["c"] != "3" {
+		t.Error("Wrong annotations", status.Annotations)
+	}
+	// Earlier copies of the status are not modified.
+	if before.Annotations["a"] != "1" || len(before.Annotations) != 2 {
+		t.Error("Earlier status modified", before.Annotations)
+	}
+
+	if err := tk.Annotate(tracker.NewJob("bucket", "exp", "other", startDate), nil); err != tracker.ErrJobNotFound {
+		t.Error("Should be ErrJobNotFound", err)
+	}
+}
+
 func TestJobMapHTML(t *testing.T) {
 	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
 	must(t, err)
@@ -293,3 +387,160 @@ func TestExpiration(t *testing.T) {
 	// Job should have been removed by saveEvery, so this should succeed.
 	must(t, tk.AddJob(job))
 }
+
+func TestReleaseStale(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	must(t, err)
+	dispatched := tracker.NewJob("bucket", "exp", "type", startDate)
+	parsing := tracker.NewJob("bucket", "exp", "type", startDate.AddDate(0, 0, 1))
+	beating := tracker.NewJob("bucket", "exp", "type", startDate.AddDate(0, 0, 2))
+	postProcessing := tracker.NewJob("bucket", "exp", "type", startDate.AddDate(0, 0, 3))
+	for _, j := range []tracker.Job{dispatched, parsing, beating, postProcessing} {
+		must(t, tk.AddJob(j))
+	}
+	must(t, tk.SetStatus(parsing, tracker.Parsing, ""))
+	must(t, tk.SetStatus(beating, tracker.Parsing, ""))
+	must(t, tk.SetStatus(postProcessing, tracker.ParseComplete, ""))
+
+	if stale := tk.ReleaseStale(time.Minute, time.Now()); len(stale) != 0 {
+		t.Error("Nothing should be stale yet", stale)
+	}
+	// Heartbeats keep a job, even if its state hasn't changed.
+	time.Sleep(100 * time.Millisecond)
+	must(t, tk.Heartbeat(beating))
+
+	stale := tk.ReleaseStale(50*time.Millisecond, time.Now())
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Date.Before(stale[j].Date) })
+	if len(stale) != 2 || stale[0] != dispatched || stale[1] != parsing {
+		t.Error("Wrong stale jobs", stale)
+	}
+	if _, err := tk.GetStatus(parsing); err != tracker.ErrJobNotFound {
+		t.Error("Stale job should be removed", err)
+	}
+	if tk.NumJobs() != 2 {
+		t.Error("Wrong remaining jobs", tk.NumJobs())
+	}
+}
+
+func TestInitTrackerWithSaver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracker")
+	must(t, err)
+	defer os.RemoveAll(dir)
+	saver, err := persistence.NewFileSaver(dir)
+	must(t, err)
+
+	tk, err := tracker.InitTrackerWithSaver(context.Background(), saver, 0, 0, 0)
+	must(t, err)
+	createJobs(t, tk, "FileSaver", "type", 10)
+	_, err = tk.Sync(context.Background(), time.Time{})
+	must(t, err)
+
+	restored, err := tracker.InitTrackerWithSaver(context.Background(), saver, 0, 0, 0)
+	must(t, err)
+	if restored.NumJobs() != 10 {
+		t.Error("Expected 10 restored jobs, got", restored.NumJobs())
+	}
+}
+
+// failingSaver fails every Save while failing is set.
+type failingSaver struct {
+	persistence.Saver
+	lock    sync.Mutex
+	failing bool
+}
+
+func (s *failingSaver) setFailing(failing bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failing = failing
+}
+
+func (s *failingSaver) Save(ctx context.Context, o persistence.StateObject) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.failing {
+		return errors.New("datastore unavailable")
+	}
+	return nil
+}
+
+func (s *failingSaver) Fetch(ctx context.Context, o persistence.StateObject) error {
+	return datastore.ErrNoSuchEntity
+}
+
+func TestPersistenceCheck(t *testing.T) {
+	ctx := context.Background()
+	saver := &failingSaver{failing: true}
+	tk, err := tracker.InitTrackerWithSaver(ctx, saver, 10*time.Millisecond, 0, 0)
+	must(t, err)
+	wait := func(cond func() bool, msg string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal(msg)
+			}
+		}
+	}
+
+	// A failed save fails readiness, but not liveness.
+	wait(func() bool { return tk.SaveCheck(ctx) != nil }, "Expected a save error")
+	if err := tk.PersistenceCheck(ctx, time.Minute); err != nil {
+		t.Error("Expected liveness after a failed save", err)
+	}
+	// Until saves keep failing.
+	wait(func() bool {
+		return errors.Is(tk.PersistenceCheck(ctx, time.Minute), tracker.ErrSaveFailing)
+	}, "Expected ErrSaveFailing")
+
+	saver.setFailing(false)
+	wait(func() bool { return tk.SaveCheck(ctx) == nil }, "Expected a successful save")
+	if err := tk.PersistenceCheck(ctx, time.Minute); err != nil {
+		t.Error("Expected liveness after a successful save", err)
+	}
+}
+
+func TestObserver(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	must(t, err)
+	changes := []tracker.State{}
+	tk.AddObserver(func(j tracker.Job, s tracker.Status) {
+		// The tracker lock must not be held.
+		tk.NumJobs()
+		changes = append(changes, s.State())
+	})
+
+	js := tracker.NewJob("bucket", "exp", "type", startDate)
+	must(t, tk.AddJob(js))
+	must(t, tk.SetStatus(js, tracker.Parsing, ""))
+	must(t, tk.SetStatus(js, tracker.Parsing, "detail only"))
+	must(t, tk.SetJobError(js, "failed"))
+	if len(changes) != 2 || changes[0] != tracker.Parsing || changes[1] != tracker.Failed {
+		t.Error("Wrong state changes", changes)
+	}
+}
+
+func TestResetJob(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	must(t, err)
+
+	js := tracker.NewJob("bucket", "exp", "type", startDate)
+	must(t, tk.AddJob(js))
+	must(t, tk.SetStatus(js, tracker.Loading, "loading"))
+	must(t, tk.SetBQJobID(js, "bqjob"))
+	if err := tk.AddJob(js); err != tracker.ErrJobAlreadyExists {
+		t.Error("Expected ErrJobAlreadyExists", err)
+	}
+	must(t, tk.ResetJob(js))
+	status, err := tk.GetStatus(js)
+	must(t, err)
+	if status.State() != tracker.Init || len(status.History) != 1 || status.BQJobID != "" {
+		t.Errorf("Expected reset status %+v", status)
+	}
+
+	// A prefix job for the same partition is still refused.
+	prefix := js
+	prefix.Prefix = "20190301T15"
+	if err := tk.ResetJob(prefix); !errors.Is(err, tracker.ErrPartitionBusy) {
+		t.Error("Expected ErrPartitionBusy", err)
+	}
+}
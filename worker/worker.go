@@ -0,0 +1,252 @@
+// Package worker provides an authenticated HTTP API that lets external
+// processing agents, such as a standalone deduper or an exporter, perform
+// pipeline stages.  Stages are marked external in the source pipeline, e.g.
+// "external:exporting", and the Monitor leaves jobs in those states for a
+// worker to claim with POST /job/claim, and report on with POST /job/update.
+//
+// A claim is a lease, recorded in the job annotations along with the
+// identity of the worker.  A worker must renew the lease with a heartbeat
+// update before it expires, or the job may be claimed by another worker.
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m-lab/etl-gardener/admin"
+	"github.com/m-lab/etl-gardener/tracker"
+)
+
+// Errors that may be returned by the worker API.
+var (
+	ErrNotClaimed   = errors.New("job is not claimed by this worker")
+	ErrWrongState   = errors.New("job is not in the claimed state")
+	ErrNotExternal  = errors.New("state is not an external stage")
+	ErrBadOperation = errors.New("operation must be heartbeat, done or failed")
+)
+
+// Annotation keys used to record claims.
+const (
+	WorkerKey = "worker"        // The worker holding the lease.
+	LeaseKey  = "lease_expires" // The lease expiration, in RFC3339 format.
+)
+
+// Tracker is the subset of tracker.Tracker used by the worker API.
+type Tracker interface {
+	GetState() (tracker.JobMap, tracker.Job, time.Time)
+	GetStatus(job tracker.Job) (tracker.Status, error)
+	SetStatus(job tracker.Job, state tracker.State, detail string) error
+	SetJobError(job tracker.Job, errString string) error
+	Heartbeat(job tracker.Job) error
+	Annotate(job tracker.Job, annotations map[string]string) error
+}
+
+// Pipeline reports which states are external stages, e.g. ops.Monitor.
+type Pipeline interface {
+	ExternalNext(j tracker.Job, state tracker.State) (tracker.State, bool)
+}
+
+// Claim is the response to a successful claim or heartbeat.
+type Claim struct {
+	Job     tracker.Job
+	State   tracker.State
+	Worker  string
+	Expires time.Time
+}
+
+// Handler serves the worker API.
+type Handler struct {
+	keys     map[string]string // Maps API key to worker identity.
+	tk       Tracker
+	pipeline Pipeline
+	lease    time.Duration
+
+	// lock serializes claims, so that a job is not claimed twice.
+	lock sync.Mutex
+}
+
+// NewHandler creates a Handler.  The keys map API keys to worker identities.
+func NewHandler(keys map[string]string, tk Tracker, pipeline Pipeline, lease time.Duration) *Handler {
+	return &Handler{keys: keys, tk: tk, pipeline: pipeline, lease: lease}
+}
+
+// Register adds the worker routes to the mux.
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/job/claim", h.auth(h.claim))
+	mux.HandleFunc("/job/update", h.auth(h.update))
+}
+
+type workerFunc func(resp http.ResponseWriter, req *http.Request, worker string)
+
+// auth wraps a workerFunc with authentication and form parsing.
+func (h *Handler) auth(f workerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		worker, ok := admin.Authenticate(h.keys, req)
+		if !ok {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.Method != http.MethodPost {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := req.ParseForm(); err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f(resp, req, worker)
+	}
+}
+
+// holder returns the worker holding an unexpired lease on the job, if any.
+func holder(s tracker.Status, now time.Time) string {
+	expires, err := time.Parse(time.RFC3339Nano, s.Annotations[LeaseKey])
+	if err != nil || !now.Before(expires) {
+		return ""
+	}
+	return s.Annotations[WorkerKey]
+}
+
+// grant records a lease for the worker in the job annotations.
+func (h *Handler) grant(j tracker.Job, state tracker.State, worker string, now time.Time) (Claim, error) {
+	c := Claim{Job: j, State: state, Worker: worker, Expires: now.Add(h.lease).UTC()}
+	err := h.tk.Annotate(j, map[string]string{
+		WorkerKey: worker,
+		LeaseKey:  c.Expires.Format(time.RFC3339Nano),
+	})
+	return c, err
+}
+
+// claim leases the oldest unclaimed job in the requested external state,
+// optionally restricted to an experiment and datatype.  It responds with
+// the Claim, or 204 if there is no job to claim.
+func (h *Handler) claim(resp http.ResponseWriter, req *http.Request, worker string) {
+	state := tracker.State(req.Form.Get("state"))
+	exp, dt := req.Form.Get("experiment"), req.Form.Get("datatype")
+	if state == "" {
+		http.Error(resp, "state is required", http.StatusBadRequest)
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	jobs, _, _ := h.tk.GetState()
+	candidates := []tracker.Job{}
+	now := time.Now()
+	for j, s := range jobs {
+		if s.State() != state || (exp != "" && j.Experiment != exp) || (dt != "" && j.Datatype != dt) {
+			continue
+		}
+		if _, ok := h.pipeline.ExternalNext(j, state); !ok {
+			continue
+		}
+		if holder(s, now) != "" {
+			continue
+		}
+		candidates = append(candidates, j)
+	}
+	if len(candidates) == 0 {
+		resp.WriteHeader(http.StatusNoContent)
+		return
+	}
+	sort.Slice(candidates, func(i, k int) bool {
+		return candidates[i].Date.Before(candidates[k].Date)
+	})
+	c, err := h.grant(candidates[0], state, worker, now)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Println("Worker", worker, "claimed", c.Job, c.State)
+	writeJSON(resp, c)
+}
+
+// update applies the "op" for a job claimed by the worker.  A "heartbeat"
+// renews the lease, "done" advances the job to the next state, and "failed"
+// fails the job.  The "job" parameter is the claimed job, as JSON or its Key, "state" is
+// the claimed state, and "detail" is an optional status message.
+func (h *Handler) update(resp http.ResponseWriter, req *http.Request, worker string) {
+	var j tracker.Job
+	if err := j.Unmarshal([]byte(req.Form.Get("job"))); err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state := tracker.State(req.Form.Get("state"))
+	op, detail := req.Form.Get("op"), req.Form.Get("detail")
+	if detail == "" {
+		detail = "-"
+	}
+	next, ok := h.pipeline.ExternalNext(j, state)
+	if !ok {
+		http.Error(resp, ErrNotExternal.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s, err := h.tk.GetStatus(j)
+	if err == tracker.ErrJobNotFound {
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	switch {
+	case s.State() != state:
+		http.Error(resp, ErrWrongState.Error(), http.StatusConflict)
+		return
+	case holder(s, now) != worker:
+		http.Error(resp, ErrNotClaimed.Error(), http.StatusConflict)
+		return
+	}
+
+	// The lease is released when the stage ends, and the worker recorded
+	// against the state.
+	release := map[string]string{WorkerKey: "", LeaseKey: "", string(state) + "_" + WorkerKey: worker}
+	switch op {
+	case "heartbeat":
+		if err = h.tk.Heartbeat(j); err == nil && detail != "-" {
+			err = h.tk.SetStatus(j, state, detail)
+		}
+		if err == nil {
+			var c Claim
+			c, err = h.grant(j, state, worker, now)
+			if err == nil {
+				writeJSON(resp, c)
+				return
+			}
+		}
+	case "done":
+		if err = h.tk.Annotate(j, release); err == nil {
+			err = h.tk.SetStatus(j, next, detail)
+		}
+	case "failed":
+		if err = h.tk.Annotate(j, release); err == nil {
+			err = h.tk.SetJobError(j, detail)
+		}
+	default:
+		http.Error(resp, ErrBadOperation.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Println("Worker", worker, op, j, state)
+	resp.WriteHeader(http.StatusOK)
+}
+
+func writeJSON(resp http.ResponseWriter, v interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,164 @@
+package worker_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/etl-gardener/tracker"
+	"github.com/m-lab/etl-gardener/worker"
+)
+
+// fakePipeline has a single external "exporting" stage, followed by "deleting".
+type fakePipeline struct{}
+
+func (fakePipeline) ExternalNext(j tracker.Job, state tracker.State) (tracker.State, bool) {
+	if state == "exporting" {
+		return tracker.Deleting, true
+	}
+	return "", false
+}
+
+func TestHandler(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+	older := tracker.NewJob("bucket", "ndt", "ndt7", day(1))
+	newer := tracker.NewJob("bucket", "ndt", "ndt7", day(2))
+	parsing := tracker.NewJob("bucket", "ndt", "ndt7", day(3))
+	for _, j := range []tracker.Job{older, newer, parsing} {
+		rtx.Must(tk.AddJob(j), "add job")
+	}
+	rtx.Must(tk.SetStatus(older, "exporting", ""), "set status")
+	rtx.Must(tk.SetStatus(newer, "exporting", ""), "set status")
+
+	h := worker.NewHandler(map[string]string{"k1": "deduper", "k2": "exporter"}, tk, fakePipeline{}, time.Minute)
+	mux := http.NewServeMux()
+	h.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	post := func(path, key string, values url.Values) (int, []byte) {
+		req, err := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(values.Encode()))
+		rtx.Must(err, "request")
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		rtx.Must(err, "post")
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		rtx.Must(err, "read")
+		return resp.StatusCode, body
+	}
+	claim := func(key string) (int, worker.Claim) {
+		var c worker.Claim
+		code, body := post("/job/claim", key, url.Values{"state": {"exporting"}})
+		if code == http.StatusOK {
+			rtx.Must(json.Unmarshal(body, &c), "unmarshal")
+		}
+		return code, c
+	}
+	update := func(key string, j tracker.Job, op string) int {
+		code, _ := post("/job/update", key, url.Values{
+			"job": {string(j.Marshal())}, "state": {"exporting"}, "op": {op}, "detail": {op}})
+		return code
+	}
+
+	if code, _ := claim("wrong"); code != http.StatusUnauthorized {
+		t.Error("Expected StatusUnauthorized", code)
+	}
+	if code, _ := post("/job/claim", "k1", nil); code != http.StatusBadRequest {
+		t.Error("Expected StatusBadRequest", code)
+	}
+
+	// The oldest job is claimed first, and each job is claimed only once.
+	code, c1 := claim("k1")
+	if code != http.StatusOK || c1.Job != older || c1.Worker != "deduper" {
+		t.Fatal("Wrong claim", code, c1)
+	}
+	code, c2 := claim("k2")
+	if code != http.StatusOK || c2.Job != newer || c2.Worker != "exporter" {
+		t.Fatal("Wrong claim", code, c2)
+	}
+	if code, _ := claim("k2"); code != http.StatusNoContent {
+		t.Error("Expected StatusNoContent", code)
+	}
+	s, err := tk.GetStatus(older)
+	rtx.Must(err, "get status")
+	if s.Annotations[worker.WorkerKey] != "deduper" || s.Annotations[worker.LeaseKey] == "" {
+		t.Error("Claim not recorded", s.Annotations)
+	}
+
+	// Only the lease holder may update the job.
+	if code := update("k2", older, "done"); code != http.StatusConflict {
+		t.Error("Expected StatusConflict", code)
+	}
+	if code := update("k1", older, "nonesuch"); code != http.StatusBadRequest {
+		t.Error("Expected StatusBadRequest", code)
+	}
+	if code := update("k1", older, "heartbeat"); code != http.StatusOK {
+		t.Error("Heartbeat failed", code)
+	}
+	if code := update("k1", older, "done"); code != http.StatusOK {
+		t.Error("Done failed", code)
+	}
+	s, err = tk.GetStatus(older)
+	rtx.Must(err, "get status")
+	if s.State() != tracker.Deleting || s.Annotations[worker.WorkerKey] != "" ||
+		s.Annotations["exporting_worker"] != "deduper" {
+		t.Error("Wrong status after done", s.State(), s.Annotations)
+	}
+	if code := update("k1", older, "done"); code != http.StatusConflict {
+		t.Error("Expected StatusConflict", code)
+	}
+
+	if code := update("k2", newer, "failed"); code != http.StatusOK {
+		t.Error("Failed failed", code)
+	}
+	s, err = tk.GetStatus(newer)
+	rtx.Must(err, "get status")
+	if s.State() != tracker.Failed {
+		t.Error("Expected failed job", s.State())
+	}
+
+	// Jobs in other states can't be updated.
+	code, _ = post("/job/update", "k1", url.Values{
+		"job": {string(parsing.Marshal())}, "state": {"parsing"}, "op": {"done"}})
+	if code != http.StatusBadRequest {
+		t.Error("Expected StatusBadRequest", code)
+	}
+}
+
+func TestExpiredLease(t *testing.T) {
+	tk, err := tracker.InitTracker(context.Background(), nil, nil, 0, 0, 0)
+	rtx.Must(err, "tk init")
+	job := tracker.NewJob("bucket", "ndt", "ndt7", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	rtx.Must(tk.AddJob(job), "add job")
+	rtx.Must(tk.SetStatus(job, "exporting", ""), "set status")
+	rtx.Must(tk.Annotate(job, map[string]string{
+		worker.WorkerKey: "gone",
+		worker.LeaseKey:  time.Now().Add(-time.Second).Format(time.RFC3339Nano),
+	}), "annotate")
+
+	h := worker.NewHandler(map[string]string{"k1": "deduper"}, tk, fakePipeline{}, time.Minute)
+	req := httptest.NewRequest(http.MethodPost, "/job/claim", strings.NewReader("state=exporting"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer k1")
+	resp := httptest.NewRecorder()
+	mux := http.NewServeMux()
+	h.Register(mux)
+	mux.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Error("Expected expired lease to be claimable", resp.Code)
+	}
+}